@@ -0,0 +1,10 @@
+package main
+
+import (
+	"github.com/eurosky/firehose-processor-aas/internal/app/analyze"
+	"github.com/eurosky/firehose-processor-aas/internal/pkg/service"
+)
+
+func main() {
+	service.Main(service.App("analyzer", analyze.Command()))
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/internal/app/consume"
+	"github.com/eurosky/firehose-processor-aas/internal/app/ingest"
+	"github.com/eurosky/firehose-processor-aas/internal/app/receive"
+	"github.com/eurosky/firehose-processor-aas/internal/pkg/service"
+	"github.com/nats-io/nats.go"
+	"github.com/urfave/cli/v2"
+)
+
+const streamWaitTimeout = 30 * time.Second
+
+func allInOneCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "all-in-one",
+		Usage: "run ingest, consume and receive in one process",
+		Description: "Runs the shuffler, one consumer delivering to the built-in webhook receiver and the receiver.\n" +
+			"Other settings come from each component's env vars and section of the --config file.",
+		Action: allInOne,
+		Flags: []cli.Flag{
+			service.ConfigFlag(),
+			&cli.StringFlag{
+				Name:    "relay-host",
+				Usage:   "firehose relay host (e.g., wss://bsky.network); required unless set in the config file",
+				EnvVars: []string{"RELAY_HOST"},
+			},
+			&cli.StringFlag{
+				Name:    "nats-url",
+				Usage:   "NATS server URL",
+				Value:   "nats://localhost:4222",
+				EnvVars: []string{"NATS_URL"},
+			},
+			&cli.StringFlag{
+				Name:  "ingest-metrics-addr",
+				Usage: "metrics and health address of ingest; empty disables it",
+				Value: ":8080",
+			},
+			&cli.StringFlag{
+				Name:  "consume-metrics-addr",
+				Usage: "metrics and health address of consume; empty disables it",
+				Value: ":8082",
+			},
+			&cli.IntFlag{
+				Name:  "receiver-port",
+				Usage: "port of the built-in webhook receiver",
+				Value: 8090,
+			},
+			&cli.StringFlag{
+				Name:  "webhook-url",
+				Usage: "deliver here instead of to the built-in receiver, which then isn't started",
+			},
+			service.LogLevelFlag("info"),
+		},
+	}
+}
+
+type component struct {
+	cmd  *cli.Command
+	args []string
+}
+
+// allInOne runs the components as if started from the command line, so each
+// keeps its own flags, env vars and defaults. The first one to return stops
+// the others.
+func allInOne(cctx *cli.Context) error {
+	logger := service.Logger(cctx)
+	ctx, cancel := service.SignalContext(cctx.Context, logger)
+	defer cancel()
+
+	config := cctx.String("config")
+	file := &service.ConfigFile{}
+	if config != "" {
+		var err error
+		if file, err = service.ReadConfigFile(config); err != nil {
+			return err
+		}
+	}
+
+	// With a config file, only flags given to all-in-one itself override
+	// it. The metrics addresses are passed unless the file has them, so a
+	// shared METRICS_ADDR can't make ingest and consume collide.
+	newComponent := func(cmd *cli.Command, names ...string) component {
+		var args []string
+		if config != "" {
+			args = append(args, "--config", config)
+		}
+		for _, name := range names {
+			// ingest-metrics-addr is --metrics-addr of ingest, and so on
+			flag := strings.TrimPrefix(name, cmd.Name+"-")
+			_, inFile := file.Values(cmd.Name)[flag]
+			if config == "" || cctx.IsSet(name) || (flag == "metrics-addr" && !inFile) {
+				args = append(args, "--"+flag, cctx.String(name))
+			}
+		}
+		return component{cmd: cmd, args: args}
+	}
+
+	natsURL := cctx.String("nats-url")
+	if url, ok := file.Values("ingest")["nats-url"].(string); ok && !cctx.IsSet("nats-url") {
+		natsURL = url
+	}
+	webhookURL := cctx.String("webhook-url")
+
+	components := []component{newComponent(ingest.Command(), "relay-host", "nats-url", "ingest-metrics-addr", "log-level")}
+	if webhookURL == "" {
+		port := strconv.Itoa(cctx.Int("receiver-port"))
+		webhookURL = "http://localhost:" + port + "/webhook"
+		r := newComponent(receive.Command(), "log-level")
+		r.args = append(r.args, "--port", port)
+		components = append(components, r)
+	}
+	consumer := newComponent(consume.Command(), "nats-url", "consume-metrics-addr", "log-level")
+	consumer.args = append(consumer.args, "--use-webhook", "--webhook-url", webhookURL)
+
+	errc := make(chan error, len(components)+1)
+	running := 0
+	launch := func(c component) {
+		running++
+		go func() {
+			err := service.App(c.cmd.Name, c.cmd).RunContext(ctx, append([]string{c.cmd.Name}, c.args...))
+			if err != nil {
+				err = fmt.Errorf("%s: %w", c.cmd.Name, err)
+			}
+			errc <- err
+		}()
+	}
+	for _, c := range components {
+		launch(c)
+	}
+
+	// Consumers need the stream the shuffler creates
+	if err := waitForStream(natsURL); err != nil {
+		cancel()
+		return errors.Join(err, drain(errc, running))
+	}
+	launch(consumer)
+	logger.Info("all components started", "webhook_url", webhookURL)
+
+	err := <-errc
+	cancel()
+	return errors.Join(err, drain(errc, running-1))
+}
+
+func drain(errc chan error, n int) error {
+	var errs []error
+	for range n {
+		errs = append(errs, <-errc)
+	}
+	return errors.Join(errs...)
+}
+
+func waitForStream(natsURL string) error {
+	nc, err := nats.Connect(natsURL)
+	if err != nil {
+		return fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+	defer nc.Close()
+	js, err := nc.JetStream()
+	if err != nil {
+		return fmt.Errorf("failed to create JetStream context: %w", err)
+	}
+
+	deadline := time.Now().Add(streamWaitTimeout)
+	for {
+		if _, err := js.StreamNameBySubject("atproto.firehose.>"); err == nil {
+			return nil
+		} else if time.Now().After(deadline) {
+			return fmt.Errorf("firehose stream wasn't created: %w", err)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
@@ -0,0 +1,517 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"runtime/pprof"
+	"slices"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/internal/app/consume"
+	"github.com/eurosky/firehose-processor-aas/internal/app/ingest"
+	"github.com/eurosky/firehose-processor-aas/internal/app/receive"
+	"github.com/eurosky/firehose-processor-aas/internal/pkg/fakerelay"
+	"github.com/eurosky/firehose-processor-aas/internal/pkg/service"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	// benchSampleInterval is how often NATS and the consumers' lag are
+	// sampled.
+	benchSampleInterval = 2 * time.Second
+	// benchLatencySamples bounds the latencies kept for the percentiles of
+	// a consumer group.
+	benchLatencySamples = 100_000
+)
+
+func benchCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "bench",
+		Usage: "measure the pipeline with many synthetic webhook subscribers",
+		Description: "Starts an embedded NATS server, a relay generating synthetic frames at --rate, ingest, --consumers\n" +
+			"consumers and a webhook receiver answering after --receiver-latency, all in one process. For\n" +
+			"--duration it measures the events delivered, the consumers' lag, what NATS uses and the latency\n" +
+			"from the relay to the receiver, then prints a report. NATS shares the process, so its memory and\n" +
+			"CPU include the other components. Env vars of the components still apply to them.\n" +
+			"fpaas bench run runs a scenario file instead, with groups of consumers polling differently.",
+		Action: bench,
+		Flags: append([]cli.Flag{
+			&cli.IntFlag{
+				Name:  "consumers",
+				Usage: "number of consumers, each delivering the whole stream",
+				Value: 500,
+			},
+			&cli.DurationFlag{
+				Name:  "poll",
+				Usage: "consume poll interval, in whole seconds",
+				Value: 60 * time.Second,
+			},
+			&cli.IntFlag{
+				Name:  "batch",
+				Usage: "events fetched per poll",
+				Value: 100,
+			},
+			&cli.StringFlag{
+				Name:  "receiver-latency",
+				Usage: "delay before the receiver answers, with optional jitter (50ms or 50ms±20ms)",
+				Value: "50ms",
+			},
+			&cli.Float64Flag{
+				Name:  "rate",
+				Usage: "frames per second the relay sends",
+				Value: 50,
+			},
+			&cli.DurationFlag{
+				Name:  "duration",
+				Usage: "how long to measure, from the first frame",
+				Value: 5 * time.Minute,
+			},
+			&cli.IntFlag{
+				Name:  "dids",
+				Usage: "number of distinct repos in the frames",
+				Value: 1000,
+			},
+		}, benchOutputFlags()...),
+		Subcommands: []*cli.Command{
+			{
+				Name:      "run",
+				Usage:     "run a scenario file",
+				ArgsUsage: "<scenario.yaml>",
+				Description: "Runs the pipeline described by a YAML scenario: the relay's rate, the consumer groups with their\n" +
+					"count, poll interval and batch size, the receiver's latency and faults, and the duration.",
+				Flags:  benchOutputFlags(),
+				Action: benchRun,
+			},
+		},
+	}
+}
+
+func benchOutputFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "json",
+			Usage: "also write the results to this JSON file",
+		},
+		&cli.StringFlag{
+			Name:  "csv",
+			Usage: "also append the results to this CSV file, one row per consumer group",
+		},
+		// The consumers' failed deliveries to the receiver stopping first
+		// at the end are warnings
+		service.LogLevelFlag("error"),
+	}
+}
+
+func bench(cctx *cli.Context) error {
+	return runScenario(cctx, benchScenario{
+		Rate:     cctx.Float64("rate"),
+		DIDs:     cctx.Int("dids"),
+		Duration: cctx.Duration("duration"),
+		Consumers: []benchGroup{{
+			Name:  "consumer",
+			Count: cctx.Int("consumers"),
+			Poll:  cctx.Duration("poll"),
+			Batch: cctx.Int("batch"),
+		}},
+		Receiver: benchReceiver{Latency: cctx.String("receiver-latency")},
+	})
+}
+
+func benchRun(cctx *cli.Context) error {
+	if cctx.NArg() != 1 {
+		return errors.New("expected one scenario file")
+	}
+	s, err := readScenario(cctx.Args().First())
+	if err != nil {
+		return err
+	}
+	return runScenario(cctx, s)
+}
+
+func runScenario(cctx *cli.Context, s benchScenario) error {
+	if err := s.validate(); err != nil {
+		return err
+	}
+	logger := service.Logger(cctx)
+	ctx, cancel := service.SignalContext(cctx.Context, logger)
+	defer cancel()
+
+	// Unless set by a component, profiles count goroutines for the bench
+	var res *benchResult
+	var err error
+	pprof.Do(ctx, pprof.Labels(componentLabel, componentBench), func(ctx context.Context) {
+		res, err = runBench(ctx, s, cctx.String("log-level"))
+	})
+	if err != nil {
+		return err
+	}
+	printBench(os.Stdout, s, res)
+	if path := cctx.String("json"); path != "" {
+		if err := writeBenchJSON(path, s, res); err != nil {
+			return err
+		}
+	}
+	if path := cctx.String("csv"); path != "" {
+		if err := writeBenchCSV(path, s, res); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// benchResult is what a bench run measured.
+type benchResult struct {
+	Started time.Time
+	Elapsed time.Duration
+	// Sent are the frames the relay sent, Stored the ones in the stream
+	Sent   int
+	Stored uint64
+	// PeakPending is the most events the consumers had left together
+	// during the run
+	PeakPending uint64
+	// Rejected counts the calls failed without knowing their consumer
+	Rejected int
+	// Groups are in the order of the scenario's consumers
+	Groups []*benchGroupResult
+	NATS   natsUsage
+	Usage  resourceUsage
+}
+
+// benchGroupResult is what a consumer group delivered.
+type benchGroupResult struct {
+	// Delivered counts the events acked by the consumers, after their
+	// webhook calls succeeded
+	Delivered   uint64
+	Calls       int
+	FailedCalls int
+	// Pending is how many events the consumers had left at the end, on
+	// average and for the furthest behind, and OldestPending the age of the
+	// oldest of them
+	PendingAvg    float64
+	PendingMax    uint64
+	OldestPending time.Duration
+	// Latency is from the relay sending a frame to the receiver getting it,
+	// the first time
+	LatencyP50, LatencyP90, LatencyP99, LatencyMax time.Duration
+
+	latencies latencySample
+	floor     uint64
+}
+
+// natsUsage is what the embedded NATS server handled.
+type natsUsage struct {
+	Connections   int
+	SlowConsumers int64
+	InMsgs        int64
+	OutMsgs       int64
+	InBytes       int64
+	OutBytes      int64
+	// Memory and Store are what JetStream holds in memory and on disk
+	Memory, Store uint64
+}
+
+// latencySample keeps a uniform sample of the latencies, so long runs with
+// many consumers don't keep one per delivered event.
+type latencySample struct {
+	seen    int
+	sample  []time.Duration
+	highest time.Duration
+}
+
+func (l *latencySample) add(d time.Duration) {
+	l.seen++
+	l.highest = max(l.highest, d)
+	if len(l.sample) < benchLatencySamples {
+		l.sample = append(l.sample, d)
+	} else if i := rand.IntN(l.seen); i < benchLatencySamples {
+		l.sample[i] = d
+	}
+}
+
+// runBench runs the scenario's pipeline and measures it for s.Duration.
+func runBench(ctx context.Context, s benchScenario, level string) (*benchResult, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var ns *server.Server
+	var shutdown func()
+	var err error
+	pprof.Do(ctx, pprof.Labels(componentLabel, componentNATS), func(context.Context) {
+		ns, shutdown, err = embeddedNATS("fpaas-bench-")
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer shutdown()
+	natsURL := ns.ClientURL()
+
+	// The consumer groups are the consume.consumers of a config file
+	config, err := writeBenchConfig(s)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(config)
+
+	relay := fakerelay.New(fakerelay.Options{Rate: s.Rate, DIDs: s.DIDs})
+	defer relay.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	relayServer := &http.Server{Handler: relay}
+	pprof.Do(ctx, pprof.Labels(componentLabel, componentRelay), func(context.Context) {
+		go relayServer.Serve(ln)
+	})
+	defer relayServer.Close()
+
+	port, err := freePort()
+	if err != nil {
+		return nil, err
+	}
+	receiverURL := "http://127.0.0.1:" + port
+
+	errc := make(chan error, 3)
+	running := 0
+	launch := func(c component) {
+		running++
+		go pprof.Do(ctx, pprof.Labels(componentLabel, c.cmd.Name), func(ctx context.Context) {
+			err := service.App(c.cmd.Name, c.cmd).RunContext(ctx, append([]string{c.cmd.Name}, c.args...))
+			if err != nil {
+				err = fmt.Errorf("%s: %w", c.cmd.Name, err)
+			}
+			errc <- err
+		})
+	}
+	stop := func(err error) error {
+		cancel()
+		return errors.Join(err, drain(errc, running))
+	}
+
+	launch(component{receive.Command(), append([]string{"--port", port, "--log-level", level}, s.Receiver.args()...)})
+	launch(component{ingest.Command(), []string{"--relay-host", "ws://" + ln.Addr().String(), "--nats-url", natsURL, "--metrics-addr", "", "--log-level", level}})
+	if err := waitForStream(natsURL); err != nil {
+		return nil, stop(err)
+	}
+	usage := newUsageSampler(ns)
+	usage.baseline()
+	launch(component{consume.Command(), []string{
+		"--config", config, "--nats-url", natsURL, "--metrics-addr", "", "--log-level", level,
+		"--use-webhook", "--webhook-url", receiverURL + "/webhook",
+	}})
+	if err := waitForConsumers(natsURL, s.consumers()); err != nil {
+		return nil, stop(err)
+	}
+	calls, err := tailCalls(ctx, receiverURL)
+	if err != nil {
+		return nil, stop(err)
+	}
+	nc, err := nats.Connect(natsURL)
+	if err != nil {
+		return nil, stop(fmt.Errorf("failed to connect to NATS: %w", err))
+	}
+	defer nc.Close()
+	js, err := nc.JetStream()
+	if err != nil {
+		return nil, stop(fmt.Errorf("failed to create JetStream context: %w", err))
+	}
+	stream, err := js.StreamNameBySubject("atproto.firehose.>")
+	if err != nil {
+		return nil, stop(err)
+	}
+
+	res, err := measure(ctx, s, relay, ns, usage, js, stream, calls, errc)
+	return res, stop(err)
+}
+
+// measure follows the calls and samples NATS from the first frame until
+// s.Duration has passed.
+func measure(ctx context.Context, s benchScenario, relay *fakerelay.Relay, ns *server.Server, usage *usageSampler, js nats.JetStreamContext, stream string,
+	calls <-chan tailCall, errc chan error) (*benchResult, error) {
+	res := &benchResult{}
+	byConsumer := make(map[string]*benchGroupResult)
+	for _, g := range s.Consumers {
+		r := &benchGroupResult{}
+		res.Groups = append(res.Groups, r)
+		for i := range g.Count {
+			byConsumer[fmt.Sprintf("%s-%d", g.Name, i)] = r
+		}
+	}
+	// The highest seq each consumer delivered; the relay's seq n is the
+	// stream's seq n, as the stream is new
+	highest := make(map[string]uint64)
+
+	sample := func() {
+		usage.sample()
+		var pending uint64
+		for ci := range js.ConsumersInfo(stream) {
+			pending += ci.NumPending + uint64(ci.NumAckPending)
+		}
+		res.PeakPending = max(res.PeakPending, pending)
+	}
+
+	usage.start()
+	pprof.Do(ctx, pprof.Labels(componentLabel, componentRelay), func(context.Context) {
+		relay.Start()
+	})
+	res.Started = time.Now()
+	end := time.NewTimer(s.Duration)
+	defer end.Stop()
+	tick := time.NewTicker(benchSampleInterval)
+	defer tick.Stop()
+	for measuring := true; measuring; {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case err := <-errc:
+			errc <- err
+			return nil, errors.New("a component stopped before the end of the run")
+		case c, ok := <-calls:
+			if !ok {
+				return nil, errors.New("the receiver stopped streaming its calls")
+			}
+			r := byConsumer[c.Consumer]
+			if r == nil {
+				if c.Consumer == "" {
+					// Failed by the receiver's faults before the payload
+					// was read
+					res.Rejected++
+				}
+				continue
+			}
+			r.Calls++
+			if c.Status == "" || c.Status[0] != '2' {
+				r.FailedCalls++
+				continue
+			}
+			if c.Reason != "" || c.FirstSeq == 0 {
+				continue
+			}
+			for seq := max(c.FirstSeq, highest[c.Consumer]+1); seq <= c.LastSeq; seq++ {
+				if sent, ok := relay.SentAt(int64(seq)); ok {
+					r.latencies.add(c.Time.Sub(sent))
+				}
+			}
+			highest[c.Consumer] = max(highest[c.Consumer], c.LastSeq)
+		case <-tick.C:
+			sample()
+		case <-end.C:
+			measuring = false
+		}
+	}
+	res.Elapsed = time.Since(res.Started)
+	res.Sent = relay.Sent()
+
+	si, err := js.StreamInfo(stream)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stream info: %w", err)
+	}
+	res.Stored = si.State.Msgs
+	for _, r := range res.Groups {
+		r.floor = si.State.LastSeq
+	}
+	var pending uint64
+	for ci := range js.ConsumersInfo(stream) {
+		r := byConsumer[ci.Name]
+		if r == nil {
+			continue
+		}
+		left := ci.NumPending + uint64(ci.NumAckPending)
+		pending += left
+		r.Delivered += ci.AckFloor.Stream
+		r.PendingAvg += float64(left)
+		r.PendingMax = max(r.PendingMax, left)
+		r.floor = min(r.floor, ci.AckFloor.Stream)
+	}
+	res.PeakPending = max(res.PeakPending, pending)
+	for i, r := range res.Groups {
+		r.PendingAvg /= float64(s.Consumers[i].Count)
+		if r.floor < si.State.LastSeq {
+			if sent, ok := relay.SentAt(int64(r.floor + 1)); ok {
+				r.OldestPending = time.Since(sent)
+			}
+		}
+		slices.Sort(r.latencies.sample)
+		r.LatencyP50 = percentile(r.latencies.sample, 0.5)
+		r.LatencyP90 = percentile(r.latencies.sample, 0.9)
+		r.LatencyP99 = percentile(r.latencies.sample, 0.99)
+		r.LatencyMax = r.latencies.highest
+	}
+
+	res.Usage = usage.stop(si.State.Bytes)
+	if v, err := ns.Varz(nil); err == nil {
+		res.NATS.Connections = v.Connections
+		res.NATS.SlowConsumers = v.SlowConsumers
+		res.NATS.InMsgs, res.NATS.OutMsgs = v.InMsgs, v.OutMsgs
+		res.NATS.InBytes, res.NATS.OutBytes = v.InBytes, v.OutBytes
+	}
+	if ai, err := js.AccountInfo(); err == nil {
+		res.NATS.Memory, res.NATS.Store = ai.Memory, ai.Store
+	}
+	return res, nil
+}
+
+func printBench(w io.Writer, s benchScenario, r *benchResult) {
+	secs := r.Elapsed.Seconds()
+	if s.Name != "" {
+		fmt.Fprintf(w, "scenario %s: ", s.Name)
+	}
+	fmt.Fprintf(w, "%d consumers, relay at %g frames/s for %s", s.consumers(), s.Rate, r.Elapsed.Round(time.Second))
+	if s.Receiver.Latency != "" {
+		fmt.Fprintf(w, ", receiver latency %s", s.Receiver.Latency)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "ingest:     %d frames sent, %d stored, %.1f/s\n", r.Sent, r.Stored, float64(r.Stored)/secs)
+	for i, g := range s.Consumers {
+		gr := r.Groups[i]
+		fmt.Fprintf(w, "%s: %d consumers polling every %s for up to %d events, at most about %.2f events/s each, %.0f%% of the relay rate\n",
+			g.Name, g.Count, g.Poll, g.Batch, g.capacity(), 100*g.capacity()/s.Rate)
+		fmt.Fprintf(w, "  throughput: %d events delivered in %d calls (%d failed), %.1f events/s, %.2f per consumer\n",
+			gr.Delivered, gr.Calls, gr.FailedCalls, float64(gr.Delivered)/secs, float64(gr.Delivered)/float64(g.Count)/secs)
+		fmt.Fprintf(w, "  lag:        %.0f events pending per consumer at the end, %d at most, oldest sent %s ago\n",
+			gr.PendingAvg, gr.PendingMax, gr.OldestPending.Round(time.Millisecond))
+		fmt.Fprintf(w, "  latency:    p50 %s p90 %s p99 %s max %s\n",
+			gr.LatencyP50.Round(time.Millisecond), gr.LatencyP90.Round(time.Millisecond),
+			gr.LatencyP99.Round(time.Millisecond), gr.LatencyMax.Round(time.Millisecond))
+	}
+	fmt.Fprintf(w, "pending:    %d events in total at the peak\n", r.PeakPending)
+	if r.Rejected > 0 {
+		fmt.Fprintf(w, "receiver:   %d calls rejected before reading their consumer\n", r.Rejected)
+	}
+	fmt.Fprintf(w, "nats:       %d connections, %d slow consumers, %d msgs in (%s), %d out (%s), JetStream %s in memory and %s on disk\n",
+		r.NATS.Connections, r.NATS.SlowConsumers, r.NATS.InMsgs, byteSize(r.NATS.InBytes),
+		r.NATS.OutMsgs, byteSize(r.NATS.OutBytes), byteSize(int64(r.NATS.Memory)), byteSize(int64(r.NATS.Store)))
+	u := r.Usage
+	fmt.Fprintf(w, "process:    peak RSS %s (%s before the consumers), heap %s, %d goroutines, peak CPU %.0f%%, stream %s\n",
+		byteSize(u.PeakRSS), byteSize(u.BaselineRSS), byteSize(int64(u.PeakHeap)), u.PeakGoroutines, u.PeakCPU, byteSize(int64(u.StreamBytes)))
+	if u.PeakFDs > 0 {
+		fmt.Fprintf(w, "            %d open files at the peak (%d before the consumers)\n", u.PeakFDs, u.BaselineFDs)
+	}
+	if mem := u.ConsumerMemory(); mem > 0 {
+		fmt.Fprintf(w, "            the consumers took about %s, %.0f consumers per GiB\n", byteSize(mem), float64(s.consumers())/(float64(mem)/(1<<30)))
+	}
+	for _, c := range u.Components {
+		fmt.Fprintf(w, "  %-11s %s CPU (%.2f cores), %d goroutines at the peak\n",
+			c.Name+":", c.CPU.Round(time.Millisecond), c.CPU.Seconds()/r.Elapsed.Seconds(), c.PeakGoroutines)
+	}
+}
+
+func byteSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// benchScenario is the load of a bench run, as read from a scenario file:
+//
+//	name: mixed
+//	rate: 100
+//	duration: 10m
+//	receiver:
+//	  latency: 50ms±20ms
+//	  error-rate: 0.01
+//	consumers:
+//	  - name: realtime
+//	    count: 20
+//	    poll: 1s
+//	    batch: 500
+//	  - name: hourly
+//	    count: 480
+//	    poll: 60s
+//	    batch: 100
+type benchScenario struct {
+	Name string `yaml:"name"`
+	// Rate is how many frames per second the relay sends
+	Rate      float64       `yaml:"rate"`
+	DIDs      int           `yaml:"dids"`
+	Duration  time.Duration `yaml:"duration"`
+	Consumers []benchGroup  `yaml:"consumers"`
+	Receiver  benchReceiver `yaml:"receiver"`
+}
+
+// benchGroup is a group of consumers polling alike, named <name>-0,
+// <name>-1 and so on.
+type benchGroup struct {
+	Name  string        `yaml:"name"`
+	Count int           `yaml:"count"`
+	Poll  time.Duration `yaml:"poll"`
+	Batch int           `yaml:"batch"`
+}
+
+// benchReceiver are the receive flags injecting latency and faults.
+type benchReceiver struct {
+	Latency         string  `yaml:"latency"`
+	ErrorRate       float64 `yaml:"error-rate"`
+	StatusSequence  string  `yaml:"status-sequence"`
+	DropConnections bool    `yaml:"drop-connections"`
+	RateLimitAfter  int     `yaml:"rate-limit-after"`
+}
+
+func (r benchReceiver) args() []string {
+	var args []string
+	if r.Latency != "" {
+		args = append(args, "--latency", r.Latency)
+	}
+	if r.ErrorRate > 0 {
+		args = append(args, "--error-rate", strconv.FormatFloat(r.ErrorRate, 'g', -1, 64))
+	}
+	if r.StatusSequence != "" {
+		args = append(args, "--status-sequence", r.StatusSequence)
+	}
+	if r.DropConnections {
+		args = append(args, "--drop-connections")
+	}
+	if r.RateLimitAfter > 0 {
+		args = append(args, "--rate-limit-after", strconv.Itoa(r.RateLimitAfter))
+	}
+	return args
+}
+
+// readScenario reads a scenario file. What it leaves out gets the defaults
+// of the bench flags, except the receiver, which answers right away.
+func readScenario(path string) (benchScenario, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return benchScenario{}, err
+	}
+	defer f.Close()
+	var s benchScenario
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(&s); err != nil {
+		return s, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	if s.Name == "" {
+		s.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	if s.Rate == 0 {
+		s.Rate = 50
+	}
+	if s.DIDs == 0 {
+		s.DIDs = 1000
+	}
+	if s.Duration == 0 {
+		s.Duration = 5 * time.Minute
+	}
+	for i := range s.Consumers {
+		g := &s.Consumers[i]
+		if g.Name == "" && len(s.Consumers) == 1 {
+			g.Name = "consumer"
+		}
+		if g.Poll == 0 {
+			g.Poll = 60 * time.Second
+		}
+		if g.Batch == 0 {
+			g.Batch = 100
+		}
+	}
+	return s, nil
+}
+
+func (s benchScenario) validate() error {
+	switch {
+	case s.Rate <= 0:
+		return errors.New("rate must be positive")
+	case s.Duration <= 0:
+		return errors.New("duration must be positive")
+	case len(s.Consumers) == 0:
+		return errors.New("no consumers")
+	}
+	seen := make(map[string]bool)
+	for i, g := range s.Consumers {
+		switch {
+		case g.Name == "":
+			return fmt.Errorf("consumers[%d]: name is required with several groups", i)
+		case seen[g.Name]:
+			return fmt.Errorf("consumers[%d]: duplicate name %q", i, g.Name)
+		case g.Count < 1:
+			return fmt.Errorf("consumers[%d] (%s): count must be positive", i, g.Name)
+		case g.Poll < time.Second || g.Poll%time.Second != 0:
+			return fmt.Errorf("consumers[%d] (%s): poll must be a whole number of seconds", i, g.Name)
+		case g.Batch < 1:
+			return fmt.Errorf("consumers[%d] (%s): batch must be positive", i, g.Name)
+		}
+		seen[g.Name] = true
+	}
+	return nil
+}
+
+func (s benchScenario) consumers() int {
+	n := 0
+	for _, g := range s.Consumers {
+		n += g.Count
+	}
+	return n
+}
+
+// capacity is about how many events per second a consumer of the group can
+// deliver, fetching one batch per poll.
+func (g benchGroup) capacity() float64 {
+	return float64(g.Batch) / g.Poll.Seconds()
+}
+
+// writeBenchConfig writes the groups as the consume.consumers of a config
+// file for consume, and returns its path.
+func writeBenchConfig(s benchScenario) (string, error) {
+	groups := make([]map[string]any, len(s.Consumers))
+	for i, g := range s.Consumers {
+		groups[i] = map[string]any{
+			"name":          g.Name,
+			"count":         g.Count,
+			"poll-interval": int(g.Poll / time.Second),
+			"batch-size":    g.Batch,
+		}
+	}
+	data, err := yaml.Marshal(map[string]any{"consume": map[string]any{"consumers": groups}})
+	if err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp("", "fpaas-bench-*.yaml")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// benchReport is the JSON results report. Durations are in seconds.
+type benchReport struct {
+	Scenario       string             `json:"scenario"`
+	Started        time.Time          `json:"started"`
+	ElapsedSeconds float64            `json:"elapsed_seconds"`
+	Rate           float64            `json:"rate"`
+	DIDs           int                `json:"dids"`
+	Receiver       benchReceiverJSON  `json:"receiver"`
+	Sent           int                `json:"frames_sent"`
+	Stored         uint64             `json:"frames_stored"`
+	PeakPending    uint64             `json:"peak_pending"`
+	Rejected       int                `json:"rejected_calls"`
+	Groups         []benchGroupReport `json:"groups"`
+	NATS           benchNATSReport    `json:"nats"`
+	Process        benchProcessReport `json:"process"`
+}
+
+type benchReceiverJSON struct {
+	Latency         string  `json:"latency,omitempty"`
+	ErrorRate       float64 `json:"error_rate,omitempty"`
+	StatusSequence  string  `json:"status_sequence,omitempty"`
+	DropConnections bool    `json:"drop_connections,omitempty"`
+	RateLimitAfter  int     `json:"rate_limit_after,omitempty"`
+}
+
+type benchGroupReport struct {
+	Name                 string  `json:"name"`
+	Consumers            int     `json:"consumers"`
+	PollSeconds          float64 `json:"poll_seconds"`
+	Batch                int     `json:"batch"`
+	Capacity             float64 `json:"capacity_events_per_second"`
+	Delivered            uint64  `json:"delivered"`
+	EventsPerSecond      float64 `json:"events_per_second"`
+	Calls                int     `json:"calls"`
+	FailedCalls          int     `json:"failed_calls"`
+	PendingAvg           float64 `json:"pending_avg"`
+	PendingMax           uint64  `json:"pending_max"`
+	OldestPendingSeconds float64 `json:"oldest_pending_seconds"`
+	LatencyP50Seconds    float64 `json:"latency_p50_seconds"`
+	LatencyP90Seconds    float64 `json:"latency_p90_seconds"`
+	LatencyP99Seconds    float64 `json:"latency_p99_seconds"`
+	LatencyMaxSeconds    float64 `json:"latency_max_seconds"`
+}
+
+type benchNATSReport struct {
+	Connections          int    `json:"connections"`
+	SlowConsumers        int64  `json:"slow_consumers"`
+	InMsgs               int64  `json:"in_msgs"`
+	OutMsgs              int64  `json:"out_msgs"`
+	InBytes              int64  `json:"in_bytes"`
+	OutBytes             int64  `json:"out_bytes"`
+	JetStreamMemoryBytes uint64 `json:"jetstream_memory_bytes"`
+	JetStreamStoreBytes  uint64 `json:"jetstream_store_bytes"`
+}
+
+type benchProcessReport struct {
+	BaselineRSSBytes    int64   `json:"baseline_rss_bytes"`
+	PeakRSSBytes        int64   `json:"peak_rss_bytes"`
+	PeakHeapBytes       uint64  `json:"peak_heap_bytes"`
+	PeakGoroutines      int     `json:"peak_goroutines"`
+	BaselineOpenFDs     int     `json:"baseline_open_fds"`
+	PeakOpenFDs         int     `json:"peak_open_fds"`
+	PeakCPUPercent      float64 `json:"peak_cpu_percent"`
+	StreamBytes         uint64  `json:"stream_bytes"`
+	ConsumerMemoryBytes int64   `json:"consumer_memory_bytes"`
+	// ConsumersPerGiB is zero when the consumers' memory is unknown
+	ConsumersPerGiB float64                `json:"consumers_per_gib"`
+	Components      []benchComponentReport `json:"components"`
+}
+
+type benchComponentReport struct {
+	Name           string  `json:"name"`
+	CPUSeconds     float64 `json:"cpu_seconds"`
+	Cores          float64 `json:"cores"`
+	PeakGoroutines int     `json:"peak_goroutines"`
+}
+
+func newBenchReport(s benchScenario, r *benchResult) benchReport {
+	secs := r.Elapsed.Seconds()
+	report := benchReport{
+		Scenario:       s.Name,
+		Started:        r.Started.UTC(),
+		ElapsedSeconds: secs,
+		Rate:           s.Rate,
+		DIDs:           s.DIDs,
+		Receiver:       benchReceiverJSON(s.Receiver),
+		Sent:           r.Sent,
+		Stored:         r.Stored,
+		PeakPending:    r.PeakPending,
+		Rejected:       r.Rejected,
+		NATS: benchNATSReport{
+			Connections:          r.NATS.Connections,
+			SlowConsumers:        r.NATS.SlowConsumers,
+			InMsgs:               r.NATS.InMsgs,
+			OutMsgs:              r.NATS.OutMsgs,
+			InBytes:              r.NATS.InBytes,
+			OutBytes:             r.NATS.OutBytes,
+			JetStreamMemoryBytes: r.NATS.Memory,
+			JetStreamStoreBytes:  r.NATS.Store,
+		},
+		Process: benchProcessReport{
+			BaselineRSSBytes:    r.Usage.BaselineRSS,
+			PeakRSSBytes:        r.Usage.PeakRSS,
+			PeakHeapBytes:       r.Usage.PeakHeap,
+			PeakGoroutines:      r.Usage.PeakGoroutines,
+			BaselineOpenFDs:     r.Usage.BaselineFDs,
+			PeakOpenFDs:         r.Usage.PeakFDs,
+			PeakCPUPercent:      r.Usage.PeakCPU,
+			StreamBytes:         r.Usage.StreamBytes,
+			ConsumerMemoryBytes: r.Usage.ConsumerMemory(),
+		},
+	}
+	if mem := r.Usage.ConsumerMemory(); mem > 0 {
+		report.Process.ConsumersPerGiB = float64(s.consumers()) / (float64(mem) / (1 << 30))
+	}
+	for _, c := range r.Usage.Components {
+		report.Process.Components = append(report.Process.Components, benchComponentReport{
+			Name:           c.Name,
+			CPUSeconds:     c.CPU.Seconds(),
+			Cores:          c.CPU.Seconds() / secs,
+			PeakGoroutines: c.PeakGoroutines,
+		})
+	}
+	for i, g := range s.Consumers {
+		gr := r.Groups[i]
+		report.Groups = append(report.Groups, benchGroupReport{
+			Name:                 g.Name,
+			Consumers:            g.Count,
+			PollSeconds:          g.Poll.Seconds(),
+			Batch:                g.Batch,
+			Capacity:             g.capacity(),
+			Delivered:            gr.Delivered,
+			EventsPerSecond:      float64(gr.Delivered) / secs,
+			Calls:                gr.Calls,
+			FailedCalls:          gr.FailedCalls,
+			PendingAvg:           gr.PendingAvg,
+			PendingMax:           gr.PendingMax,
+			OldestPendingSeconds: gr.OldestPending.Seconds(),
+			LatencyP50Seconds:    gr.LatencyP50.Seconds(),
+			LatencyP90Seconds:    gr.LatencyP90.Seconds(),
+			LatencyP99Seconds:    gr.LatencyP99.Seconds(),
+			LatencyMaxSeconds:    gr.LatencyMax.Seconds(),
+		})
+	}
+	return report
+}
+
+func writeBenchJSON(path string, s benchScenario, r *benchResult) error {
+	data, err := json.MarshalIndent(newBenchReport(s, r), "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+// benchCSVHeader ends with the CPU seconds and peak goroutines of each of
+// the benchComponents.
+func benchCSVHeader() []string {
+	header := []string{
+		"scenario", "started", "elapsed_seconds", "rate", "receiver_latency", "frames_sent", "frames_stored",
+		"group", "consumers", "poll_seconds", "batch", "capacity_events_per_second",
+		"delivered", "events_per_second", "calls", "failed_calls", "pending_avg", "pending_max", "oldest_pending_seconds",
+		"latency_p50_seconds", "latency_p90_seconds", "latency_p99_seconds", "latency_max_seconds",
+		"peak_pending", "rejected_calls", "peak_rss_bytes", "peak_cpu_percent", "nats_connections", "nats_slow_consumers",
+		"baseline_rss_bytes", "peak_heap_bytes", "peak_goroutines", "stream_bytes", "consumer_memory_bytes", "consumers_per_gib",
+	}
+	for _, c := range benchComponents {
+		header = append(header, c+"_cpu_seconds", c+"_goroutines")
+	}
+	return header
+}
+
+// writeBenchCSV appends a row per consumer group to path, with the header
+// when the file is new, so the runs of several scenarios line up.
+func writeBenchCSV(path string, s benchScenario, r *benchResult) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	w := csv.NewWriter(f)
+	if info.Size() == 0 {
+		w.Write(benchCSVHeader())
+	}
+	report := newBenchReport(s, r)
+	num := func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) }
+	p := report.Process
+	for _, g := range report.Groups {
+		row := []string{
+			report.Scenario, report.Started.Format(time.RFC3339), num(report.ElapsedSeconds), num(report.Rate),
+			report.Receiver.Latency, strconv.Itoa(report.Sent), strconv.FormatUint(report.Stored, 10),
+			g.Name, strconv.Itoa(g.Consumers), num(g.PollSeconds), strconv.Itoa(g.Batch), num(g.Capacity),
+			strconv.FormatUint(g.Delivered, 10), num(g.EventsPerSecond), strconv.Itoa(g.Calls), strconv.Itoa(g.FailedCalls),
+			num(g.PendingAvg), strconv.FormatUint(g.PendingMax, 10), num(g.OldestPendingSeconds),
+			num(g.LatencyP50Seconds), num(g.LatencyP90Seconds), num(g.LatencyP99Seconds), num(g.LatencyMaxSeconds),
+			strconv.FormatUint(report.PeakPending, 10), strconv.Itoa(report.Rejected), strconv.FormatInt(p.PeakRSSBytes, 10),
+			num(p.PeakCPUPercent), strconv.Itoa(report.NATS.Connections), strconv.FormatInt(report.NATS.SlowConsumers, 10),
+			strconv.FormatInt(p.BaselineRSSBytes, 10), strconv.FormatUint(p.PeakHeapBytes, 10), strconv.Itoa(p.PeakGoroutines),
+			strconv.FormatUint(p.StreamBytes, 10), strconv.FormatInt(p.ConsumerMemoryBytes, 10), num(p.ConsumersPerGiB),
+		}
+		for _, c := range p.Components {
+			row = append(row, num(c.CPUSeconds), strconv.Itoa(c.PeakGoroutines))
+		}
+		w.Write(row)
+	}
+	w.Flush()
+	return w.Error()
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"runtime"
+	"runtime/metrics"
+	"runtime/pprof"
+	"slices"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/nats-io/nats-server/v2/server"
+)
+
+// componentLabel is the profiler label naming the bench component a
+// goroutine works for. Goroutines inherit it from the one starting them, so
+// NATS client and HTTP goroutines count for the component that owns them.
+const componentLabel = "component"
+
+const (
+	componentNATS      = "nats"
+	componentRelay     = "fake-relay"
+	componentBench     = "bench"
+	componentUnlabeled = "runtime"
+)
+
+// benchComponents are the components usage is reported for, in order;
+// runtime is what carries no label: the runtime's own work, like the
+// garbage collector, and goroutines that inherit none, like timer callbacks.
+var benchComponents = []string{componentNATS, componentRelay, "ingest", "consume", "receive", componentBench, componentUnlabeled}
+
+// resourceUsage is what the bench process used. The components share the
+// process, so memory is only known for all of them; CPU and goroutines come
+// from profiles, by component.
+type resourceUsage struct {
+	// BaselineRSS is the resident memory before the consumers started
+	BaselineRSS int64
+	PeakRSS     int64
+	// PeakCPU is the process's CPU usage in percent of a core
+	PeakCPU        float64
+	PeakHeap       uint64
+	PeakGoroutines int
+	// BaselineFDs and PeakFDs are the open files, sockets included, before
+	// the consumers started and at the peak; zero where /proc/self/fd
+	// doesn't exist. Each NATS connection counts twice, for the client and
+	// the embedded server.
+	BaselineFDs int
+	PeakFDs     int
+	// StreamBytes is the size of the firehose stream at the end; it is
+	// kept in memory
+	StreamBytes uint64
+	Components  []componentUsage
+}
+
+// componentUsage is what a component used during the run.
+type componentUsage struct {
+	Name string
+	// CPU is the CPU time profiled while measuring
+	CPU            time.Duration
+	PeakGoroutines int
+}
+
+// ConsumerMemory is about how much resident memory the consumers took: the
+// peak above the baseline, less the stream the shuffler filled meanwhile.
+func (u resourceUsage) ConsumerMemory() int64 {
+	return max(u.PeakRSS-u.BaselineRSS-int64(u.StreamBytes), 0)
+}
+
+// usageSampler follows the process while a bench run measures.
+type usageSampler struct {
+	ns         *server.Server
+	usage      resourceUsage
+	goroutines map[string]int
+	cpu        bytes.Buffer
+	profiling  bool
+	metrics    []metrics.Sample
+}
+
+func newUsageSampler(ns *server.Server) *usageSampler {
+	return &usageSampler{
+		ns:         ns,
+		goroutines: make(map[string]int),
+		metrics:    []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}},
+	}
+}
+
+// baseline records the resident memory before the consumers start.
+func (u *usageSampler) baseline() {
+	if v, err := u.ns.Varz(nil); err == nil {
+		u.usage.BaselineRSS = v.Mem
+	}
+	u.usage.BaselineFDs = openFDs()
+}
+
+// start profiles the CPU until stop. Without it, when another CPU profile
+// runs, there is no CPU time by component.
+func (u *usageSampler) start() {
+	u.profiling = pprof.StartCPUProfile(&u.cpu) == nil
+}
+
+func (u *usageSampler) sample() {
+	if v, err := u.ns.Varz(nil); err == nil {
+		u.usage.PeakRSS = max(u.usage.PeakRSS, v.Mem)
+		u.usage.PeakCPU = max(u.usage.PeakCPU, v.CPU)
+	}
+	metrics.Read(u.metrics)
+	if u.metrics[0].Value.Kind() == metrics.KindUint64 {
+		u.usage.PeakHeap = max(u.usage.PeakHeap, u.metrics[0].Value.Uint64())
+	}
+	u.usage.PeakGoroutines = max(u.usage.PeakGoroutines, runtime.NumGoroutine())
+	u.usage.PeakFDs = max(u.usage.PeakFDs, openFDs())
+
+	var buf bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&buf, 0); err != nil {
+		return
+	}
+	p, err := profile.Parse(&buf)
+	if err != nil {
+		return
+	}
+	counts := make(map[string]int)
+	for _, s := range p.Sample {
+		counts[sampleComponent(s)] += int(s.Value[0])
+	}
+	for name, n := range counts {
+		u.goroutines[name] = max(u.goroutines[name], n)
+	}
+}
+
+// stop ends the CPU profile and returns the usage.
+func (u *usageSampler) stop(streamBytes uint64) resourceUsage {
+	u.sample()
+	cpu := make(map[string]time.Duration)
+	if u.profiling {
+		pprof.StopCPUProfile()
+		if p, err := profile.Parse(&u.cpu); err == nil {
+			i := slices.IndexFunc(p.SampleType, func(t *profile.ValueType) bool { return t.Type == "cpu" })
+			for _, s := range p.Sample {
+				if i >= 0 {
+					cpu[sampleComponent(s)] += time.Duration(s.Value[i])
+				}
+			}
+		}
+	}
+	u.usage.StreamBytes = streamBytes
+	for _, name := range benchComponents {
+		u.usage.Components = append(u.usage.Components, componentUsage{Name: name, CPU: cpu[name], PeakGoroutines: u.goroutines[name]})
+	}
+	return u.usage
+}
+
+func sampleComponent(s *profile.Sample) string {
+	if c := s.Label[componentLabel]; len(c) > 0 {
+		return c[0]
+	}
+	return componentUnlabeled
+}
+
+// openFDs counts the open files of the process, on Linux.
+func openFDs() int {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return 0
+	}
+	// Less the one reading the directory
+	return len(entries) - 1
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/internal/pkg/bootstrap"
+	"github.com/eurosky/firehose-processor-aas/internal/pkg/service"
+	"github.com/eurosky/firehose-processor-aas/pkg/firehose"
+	"github.com/nats-io/nats.go"
+	"github.com/urfave/cli/v2"
+)
+
+func bootstrapCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "bootstrap",
+		Usage: "create the streams and KV buckets of the pipeline and exit",
+		Description: "Provisions ATPROTO_FIREHOSE, optionally ATPROTO_EVENTS, the FPAAS_DELIVERIES delivery log,\n" +
+			"FPAAS_AUDIT and the KV buckets of ingest, consume and the registry, so the components don't\n" +
+			"race to create them at cold start. Runs hold a lock in the fpaas_bootstrap bucket, so several\n" +
+			"can start at once; each step is retried while NATS isn't ready. Running it again is harmless:\n" +
+			"what exists is kept, and the streams are updated to the flags.",
+		Action: runBootstrap,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "nats-url",
+				Usage:   "NATS server URL",
+				Value:   "nats://localhost:4222",
+				EnvVars: []string{"NATS_URL"},
+			},
+			&cli.BoolFlag{
+				Name:    "events-stream",
+				Usage:   "also create ATPROTO_EVENTS, the stream of fpaas route, with the same stream settings",
+				EnvVars: []string{"EVENTS_STREAM"},
+			},
+			&cli.BoolFlag{
+				Name:    "watch-stream",
+				Usage:   "also create FPAAS_WATCHED, the stream of fpaas index, with the same stream settings",
+				EnvVars: []string{"WATCH_STREAM"},
+			},
+			&cli.DurationFlag{
+				Name:    "stream-max-age",
+				Usage:   "how long the streams keep frames",
+				Value:   firehose.DefaultStreamOptions.MaxAge,
+				EnvVars: []string{"STREAM_MAX_AGE"},
+			},
+			&cli.StringFlag{
+				Name:    "stream-storage",
+				Usage:   "stream storage (memory, file); only applies when a stream is created",
+				Value:   "memory",
+				EnvVars: []string{"STREAM_STORAGE"},
+			},
+			&cli.IntFlag{
+				Name:    "stream-replicas",
+				Usage:   "stream replicas in a NATS cluster",
+				Value:   firehose.DefaultStreamOptions.Replicas,
+				EnvVars: []string{"STREAM_REPLICAS"},
+			},
+			&cli.DurationFlag{
+				Name:    "stream-duplicate-window",
+				Usage:   "how long the streams drop frames published twice",
+				Value:   firehose.DefaultStreamOptions.DuplicateWindow,
+				EnvVars: []string{"STREAM_DUPLICATE_WINDOW"},
+			},
+			&cli.DurationFlag{
+				Name:    "ingest-lease-ttl",
+				Usage:   "ingest --lease-ttl, the TTL of the leader lease bucket",
+				Value:   10 * time.Second,
+				EnvVars: []string{"INGEST_LEASE_TTL"},
+			},
+			&cli.DurationFlag{
+				Name:    "consumer-lease-ttl",
+				Usage:   "consume --lease-ttl, the TTL of the consumer lease bucket",
+				Value:   10 * time.Second,
+				EnvVars: []string{"CONSUMER_LEASE_TTL"},
+			},
+			&cli.DurationFlag{
+				Name:    "lock-ttl",
+				Usage:   "how long the lock of a run that died blocks the others",
+				Value:   30 * time.Second,
+				EnvVars: []string{"BOOTSTRAP_LOCK_TTL"},
+			},
+			&cli.IntFlag{
+				Name:    "retries",
+				Usage:   "times a failed step is tried again, backing off up to 5s",
+				Value:   10,
+				EnvVars: []string{"BOOTSTRAP_RETRIES"},
+			},
+			&cli.DurationFlag{
+				Name:    "timeout",
+				Usage:   "how long to wait for NATS and the lock before giving up",
+				Value:   2 * time.Minute,
+				EnvVars: []string{"BOOTSTRAP_TIMEOUT"},
+			},
+			service.LogLevelFlag("info"),
+		},
+	}
+}
+
+func runBootstrap(cctx *cli.Context) error {
+	instance, _ := os.Hostname()
+	opts := bootstrap.Options{
+		Stream: firehose.StreamOptions{
+			MaxAge:          cctx.Duration("stream-max-age"),
+			Replicas:        cctx.Int("stream-replicas"),
+			DuplicateWindow: cctx.Duration("stream-duplicate-window"),
+		},
+		Events:           cctx.Bool("events-stream"),
+		Watched:          cctx.Bool("watch-stream"),
+		IngestLeaseTTL:   cctx.Duration("ingest-lease-ttl"),
+		ConsumerLeaseTTL: cctx.Duration("consumer-lease-ttl"),
+		Instance:         fmt.Sprintf("%s/%d", instance, os.Getpid()),
+		LockTTL:          cctx.Duration("lock-ttl"),
+		Retries:          cctx.Int("retries"),
+	}
+	switch cctx.String("stream-storage") {
+	case "memory":
+		opts.Stream.Storage = nats.MemoryStorage
+	case "file":
+		opts.Stream.Storage = nats.FileStorage
+	default:
+		return fmt.Errorf("stream-storage must be memory or file, got %q", cctx.String("stream-storage"))
+	}
+	if s := opts.Stream; s.MaxAge <= 0 || s.DuplicateWindow <= 0 || s.DuplicateWindow > s.MaxAge {
+		return errors.New("stream-max-age and stream-duplicate-window must be positive, with the window no longer than the max age")
+	}
+	if opts.Stream.Replicas < 1 || opts.Stream.Replicas > 5 {
+		return errors.New("stream-replicas must be between 1 and 5")
+	}
+	if opts.IngestLeaseTTL < 3*time.Second || opts.ConsumerLeaseTTL < 3*time.Second {
+		return errors.New("ingest-lease-ttl and consumer-lease-ttl must be at least 3s")
+	}
+	if opts.LockTTL < time.Second || opts.Retries < 0 {
+		return errors.New("lock-ttl must be at least 1s and retries must not be negative")
+	}
+
+	logger := service.Logger(cctx)
+	ctx, cancel := service.SignalContext(cctx.Context, logger)
+	defer cancel()
+	ctx, cancelTimeout := context.WithTimeout(ctx, cctx.Duration("timeout"))
+	defer cancelTimeout()
+
+	// Started alongside NATS, so the first connection may fail
+	nc, err := nats.Connect(cctx.String("nats-url"), nats.RetryOnFailedConnect(true), nats.MaxReconnects(-1))
+	if err != nil {
+		return fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+	defer nc.Close()
+	js, err := nc.JetStream()
+	if err != nil {
+		return fmt.Errorf("failed to create JetStream context: %w", err)
+	}
+
+	start := time.Now()
+	if err := bootstrap.Run(ctx, js, opts, logger); err != nil {
+		return err
+	}
+	logger.Info("bootstrap complete", "took", time.Since(start).Round(time.Millisecond))
+	return nil
+}
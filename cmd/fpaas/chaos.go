@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/internal/pkg/chaos"
+	"github.com/eurosky/firehose-processor-aas/internal/pkg/fakerelay"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/urfave/cli/v2"
+)
+
+// publishDelay is how long ingest's writes to NATS wait during a
+// publish-delay fault.
+const publishDelay = 100 * time.Millisecond
+
+func chaosFlags() []cli.Flag {
+	kinds := make([]string, len(chaos.Kinds))
+	for i, k := range chaos.Kinds {
+		kinds[i] = string(k)
+	}
+	return []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "chaos",
+			Usage: "inject faults while the relay sends; then only loss and duplicates fail the run",
+		},
+		&cli.Uint64Flag{
+			Name:  "chaos-seed",
+			Usage: "seed of the fault schedule, or of the --soak restarts, printed with the report to rerun it (0 picks one)",
+		},
+		&cli.StringFlag{
+			Name:  "chaos-faults",
+			Usage: "faults to inject: " + strings.Join(kinds, ", "),
+			Value: strings.Join(kinds, ","),
+		},
+		&cli.DurationFlag{
+			Name:  "chaos-interval",
+			Usage: "average time between faults",
+			Value: 2 * time.Second,
+		},
+		&cli.DurationFlag{
+			Name:  "chaos-max-duration",
+			Usage: "longest publish delay or webhook failure",
+			Value: 3 * time.Second,
+		},
+		&cli.Float64Flag{
+			Name:  "max-duplicates",
+			Usage: "largest fraction of the frames a consumer may deliver more than once with --chaos or --soak",
+			Value: 0.2,
+		},
+	}
+}
+
+// chaosRun holds what the faults are injected into: a proxy between ingest
+// and NATS, a gate in front of the receiver, the NATS server and the relay.
+type chaosRun struct {
+	seed    uint64
+	faults  []chaos.Fault
+	ns      *server.Server
+	relay   *fakerelay.Relay
+	proxy   *chaos.Proxy
+	gate    *chaos.Gate
+	gateSrv *http.Server
+	gateURL string
+}
+
+func newChaosRun(cctx *cli.Context, ns *server.Server, relay *fakerelay.Relay, receiverURL string) (*chaosRun, error) {
+	kinds, err := chaos.ParseKinds(cctx.String("chaos-faults"))
+	if err != nil {
+		return nil, err
+	}
+	if cctx.Duration("chaos-interval") <= 0 || cctx.Duration("chaos-max-duration") <= 0 {
+		return nil, errors.New("chaos-interval and chaos-max-duration must be positive")
+	}
+	seed := cctx.Uint64("chaos-seed")
+	if seed == 0 {
+		seed = rand.Uint64()
+	}
+	span := time.Duration(float64(cctx.Int("frames")) / cctx.Float64("rate") * float64(time.Second))
+
+	target, err := url.Parse(receiverURL)
+	if err != nil {
+		return nil, err
+	}
+	proxy, err := chaos.NewProxy(strings.TrimPrefix(ns.ClientURL(), "nats://"), publishDelay)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		proxy.Close()
+		return nil, err
+	}
+	gate := chaos.NewGate(httputil.NewSingleHostReverseProxy(target))
+	c := &chaosRun{
+		seed:    seed,
+		faults:  chaos.NewSchedule(seed, kinds, span, cctx.Duration("chaos-interval"), cctx.Duration("chaos-max-duration")),
+		ns:      ns,
+		relay:   relay,
+		proxy:   proxy,
+		gate:    gate,
+		gateSrv: &http.Server{Handler: gate},
+		gateURL: "http://" + ln.Addr().String(),
+	}
+	go c.gateSrv.Serve(ln)
+	return c, nil
+}
+
+// natsURL is where ingest connects, through the proxy.
+func (c *chaosRun) natsURL() string {
+	return "nats://" + c.proxy.Addr()
+}
+
+// run injects the faults from now on; call it when the relay starts.
+func (c *chaosRun) run(ctx context.Context, logger *slog.Logger) {
+	chaos.Run(ctx, c.faults, c.inject, logger)
+}
+
+func (c *chaosRun) inject(f chaos.Fault) {
+	switch f.Kind {
+	case chaos.NATSDisconnect:
+		connz, err := c.ns.Connz(&server.ConnzOptions{Limit: 1024})
+		if err != nil {
+			return
+		}
+		for _, conn := range connz.Conns {
+			c.ns.DisconnectClientByID(conn.Cid)
+		}
+	case chaos.PublishDelay:
+		c.proxy.Slow(f.Duration)
+	case chaos.WebhookFailure:
+		c.gate.Fail(f.Duration)
+	case chaos.RelayDrop:
+		c.relay.DropConnections()
+	}
+}
+
+func (c *chaosRun) report(w io.Writer) {
+	fmt.Fprintf(w, "chaos seed %d: %d faults, %d webhook calls failed\n", c.seed, len(c.faults), c.gate.Failed())
+	for _, f := range c.faults {
+		fmt.Fprintf(w, "  %s\n", f)
+	}
+}
+
+func (c *chaosRun) close() {
+	c.gateSrv.Close()
+	c.proxy.Close()
+}
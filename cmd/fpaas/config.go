@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/eurosky/firehose-processor-aas/internal/app/analyze"
+	"github.com/eurosky/firehose-processor-aas/internal/app/consume"
+	"github.com/eurosky/firehose-processor-aas/internal/app/control"
+	"github.com/eurosky/firehose-processor-aas/internal/app/index"
+	"github.com/eurosky/firehose-processor-aas/internal/app/ingest"
+	"github.com/eurosky/firehose-processor-aas/internal/app/receive"
+	"github.com/eurosky/firehose-processor-aas/internal/app/route"
+	"github.com/eurosky/firehose-processor-aas/internal/pkg/service"
+	"github.com/urfave/cli/v2"
+)
+
+func configCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "config",
+		Usage: "work with YAML/TOML config files",
+		Subcommands: []*cli.Command{
+			{
+				Name: "validate",
+				Usage: "check a config file: keys must be flags of the command owning the section, " +
+					"and each command with a section must pass its own validate (only consume for files without sections)",
+				Flags:  []cli.Flag{service.ConfigFlag()},
+				Action: validateConfig,
+			},
+		},
+	}
+}
+
+func validateConfig(cctx *cli.Context) error {
+	path := cctx.String("config")
+	if path == "" {
+		return errors.New("--config is required")
+	}
+	f, err := service.ReadConfigFile(path)
+	if err != nil {
+		return err
+	}
+
+	commands := []*cli.Command{ingest.Command(), consume.Command(), receive.Command(), control.Command(), analyze.Command(), route.Command(), index.Command()}
+
+	var all []cli.Flag
+	for _, cmd := range commands {
+		all = append(all, cmd.Flags...)
+	}
+	if unknown := service.UnknownKeys(f.TopLevel(), all); len(unknown) > 0 {
+		return fmt.Errorf("unknown top-level keys %v", unknown)
+	}
+	for _, cmd := range commands {
+		if unknown := service.UnknownKeys(f.SectionValues(cmd.Name), cmd.Flags, "consumers"); len(unknown) > 0 {
+			return fmt.Errorf("unknown keys in %s: %v", cmd.Name, unknown)
+		}
+	}
+
+	// A file without sections is a flat consumer config
+	noSections := !slices.ContainsFunc(service.Sections, f.Has)
+
+	var errs []error
+	for _, cmd := range commands {
+		if !f.Has(cmd.Name) && !(noSections && cmd.Name == "consume") {
+			continue
+		}
+		i := slices.IndexFunc(cmd.Subcommands, func(c *cli.Command) bool { return c.Name == "validate" })
+		fmt.Fprintf(os.Stdout, "%s: ", cmd.Name)
+		if err := service.App(cmd.Name, cmd.Subcommands[i]).RunContext(cctx.Context, []string{cmd.Name, "--config", path}); err != nil {
+			fmt.Fprintln(os.Stdout, "invalid")
+			errs = append(errs, fmt.Errorf("%s: %w", cmd.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
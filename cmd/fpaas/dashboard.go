@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/eurosky/firehose-processor-aas/internal/pkg/dashboard"
+	"github.com/urfave/cli/v2"
+)
+
+func dashboardCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "dashboard",
+		Usage: "work with the Grafana dashboard for the fpaas metrics",
+		Subcommands: []*cli.Command{
+			{
+				Name:  "export",
+				Usage: "print the dashboard JSON (ingest rate and lag, consumer backlog, delivery success rate and latency)",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Usage:   "file to write instead of stdout",
+					},
+				},
+				Action: exportDashboard,
+			},
+		},
+	}
+}
+
+func exportDashboard(cctx *cli.Context) error {
+	b, err := dashboard.JSON()
+	if err != nil {
+		return err
+	}
+	if path := cctx.String("output"); path != "" {
+		if err := os.WriteFile(path, b, 0o644); err != nil {
+			return fmt.Errorf("failed to write dashboard: %w", err)
+		}
+		return nil
+	}
+	_, err = os.Stdout.Write(b)
+	return err
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/internal/pkg/doctor"
+	"github.com/eurosky/firehose-processor-aas/pkg/firehose"
+	"github.com/nats-io/nats.go"
+	"github.com/urfave/cli/v2"
+)
+
+func doctorCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "doctor",
+		Usage: "check NATS, JetStream, the streams, the relay, the webhook and the clock, and print a report",
+		Description: "Connects to NATS and checks its credentials and JetStream, compares the streams to the\n" +
+			"--stream-* flags, subscribes to --relay-host until its first frame, resolves and connects to\n" +
+			"--webhook-url without sending anything, and compares the clock to the relay's. It changes\n" +
+			"nothing, and exits with an error when a check fails; warnings are drift worth a look.",
+		Action: runDoctor,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "nats-url",
+				Usage:   "NATS server URL",
+				Value:   "nats://localhost:4222",
+				EnvVars: []string{"NATS_URL"},
+			},
+			&cli.StringFlag{
+				Name:    "relay-host",
+				Usage:   "relay to check, e.g. wss://bsky.network; also the clock's reference. Empty skips both",
+				EnvVars: []string{"RELAY_HOST"},
+			},
+			&cli.StringFlag{
+				Name:    "webhook-url",
+				Usage:   "webhook to check; empty skips it",
+				EnvVars: []string{"WEBHOOK_URL"},
+			},
+			&cli.DurationFlag{
+				Name:    "stream-max-age",
+				Usage:   "expected max age of the streams",
+				Value:   firehose.DefaultStreamOptions.MaxAge,
+				EnvVars: []string{"STREAM_MAX_AGE"},
+			},
+			&cli.StringFlag{
+				Name:    "stream-storage",
+				Usage:   "expected stream storage (memory, file)",
+				Value:   "memory",
+				EnvVars: []string{"STREAM_STORAGE"},
+			},
+			&cli.IntFlag{
+				Name:    "stream-replicas",
+				Usage:   "expected stream replicas",
+				Value:   firehose.DefaultStreamOptions.Replicas,
+				EnvVars: []string{"STREAM_REPLICAS"},
+			},
+			&cli.DurationFlag{
+				Name:    "stream-duplicate-window",
+				Usage:   "expected duplicate window of the streams",
+				Value:   firehose.DefaultStreamOptions.DuplicateWindow,
+				EnvVars: []string{"STREAM_DUPLICATE_WINDOW"},
+			},
+			&cli.DurationFlag{
+				Name:  "timeout",
+				Usage: "how long each network check may take",
+				Value: 10 * time.Second,
+			},
+			&cli.BoolFlag{
+				Name:  "json",
+				Usage: "print the report as JSON",
+			},
+		},
+	}
+}
+
+func runDoctor(cctx *cli.Context) error {
+	opts := doctor.Options{
+		NATSURL: cctx.String("nats-url"),
+		Stream: firehose.StreamOptions{
+			MaxAge:          cctx.Duration("stream-max-age"),
+			Replicas:        cctx.Int("stream-replicas"),
+			DuplicateWindow: cctx.Duration("stream-duplicate-window"),
+		},
+		RelayHost:  cctx.String("relay-host"),
+		WebhookURL: cctx.String("webhook-url"),
+		Timeout:    cctx.Duration("timeout"),
+	}
+	switch cctx.String("stream-storage") {
+	case "memory":
+		opts.Stream.Storage = nats.MemoryStorage
+	case "file":
+		opts.Stream.Storage = nats.FileStorage
+	default:
+		return fmt.Errorf("stream-storage must be memory or file, got %q", cctx.String("stream-storage"))
+	}
+	if opts.Timeout <= 0 {
+		return errors.New("timeout must be positive")
+	}
+
+	report := doctor.Run(cctx.Context, opts)
+	if cctx.Bool("json") {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+	} else {
+		for _, c := range report.Checks {
+			fmt.Fprintf(os.Stdout, "%-24s %-4s %s\n", c.Name, c.Status, c.Detail)
+		}
+	}
+	if report.Failed() {
+		return errors.New("doctor found problems")
+	}
+	return nil
+}
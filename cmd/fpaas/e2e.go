@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/internal/app/consume"
+	"github.com/eurosky/firehose-processor-aas/internal/app/ingest"
+	"github.com/eurosky/firehose-processor-aas/internal/app/receive"
+	"github.com/eurosky/firehose-processor-aas/internal/pkg/fakerelay"
+	"github.com/eurosky/firehose-processor-aas/internal/pkg/service"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/urfave/cli/v2"
+)
+
+func e2eCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "e2e",
+		Usage: "run the whole pipeline against a fake relay and check what the receiver gets",
+		Description: "Starts an embedded NATS server, a relay generating synthetic frames, ingest, consume and the\n" +
+			"webhook receiver in one process, then checks that every consumer delivers every frame once, in\n" +
+			"stream order, within --max-latency at the 99th percentile. Exits non-zero when a check fails.\n" +
+			"With --chaos, NATS disconnects, slow publishes, webhook failures and relay drops are injected on a\n" +
+			"seeded schedule; every frame must still be delivered, with at most --max-duplicates delivered again.\n" +
+			"With --soak, the pipeline runs for that long instead, restarting a component every so often, and\n" +
+			"every frame must be delivered within --soak-grace; violations are logged with their seq ranges.\n" +
+			"With --redact, every webhook body is also checked for the records and fields the rules remove.\n" +
+			"Env vars of the components still apply to them.",
+		Action: e2e,
+		Flags: append([]cli.Flag{
+			&cli.IntFlag{
+				Name:  "frames",
+				Usage: "number of frames the relay sends",
+				Value: 2000,
+			},
+			&cli.Float64Flag{
+				Name:  "rate",
+				Usage: "frames per second the relay sends",
+				Value: 200,
+			},
+			&cli.IntFlag{
+				Name:  "dids",
+				Usage: "number of distinct repos in the frames",
+				Value: 100,
+			},
+			&cli.IntFlag{
+				Name:  "consumers",
+				Usage: "number of consumers, each delivering the whole stream",
+				Value: 1,
+			},
+			&cli.IntFlag{
+				Name:  "batch-size",
+				Usage: "consume --batch-size",
+				Value: 500,
+			},
+			&cli.IntFlag{
+				Name:  "poll-interval",
+				Usage: "consume --poll-interval in seconds",
+				Value: 1,
+			},
+			&cli.DurationFlag{
+				Name:  "max-latency",
+				Usage: "largest 99th percentile latency from the relay to the receiver",
+				Value: 5 * time.Second,
+			},
+			&cli.DurationFlag{
+				Name:  "timeout",
+				Usage: "how long to wait for the deliveries after the last frame is sent",
+				Value: 30 * time.Second,
+			},
+			service.LogLevelFlag("warn"),
+		}, slices.Concat(chaosFlags(), soakFlags(), redactionFlags())...),
+	}
+}
+
+func e2e(cctx *cli.Context) error {
+	if cctx.Duration("soak") > 0 {
+		return soak(cctx)
+	}
+	frames := cctx.Int("frames")
+	if frames < 1 {
+		return errors.New("frames must be positive")
+	}
+	if cctx.Float64("rate") <= 0 {
+		return errors.New("rate must be positive")
+	}
+	if cctx.Int("consumers") < 1 {
+		return errors.New("consumers must be positive")
+	}
+	logger := service.Logger(cctx)
+	ctx, cancel := service.SignalContext(cctx.Context, logger)
+	defer cancel()
+
+	ns, shutdown, err := embeddedNATS("fpaas-e2e-")
+	if err != nil {
+		return err
+	}
+	defer shutdown()
+	natsURL := ns.ClientURL()
+
+	rules := cctx.StringSlice("redact")
+	relay := fakerelay.New(fakerelay.Options{Frames: frames, Rate: cctx.Float64("rate"), DIDs: cctx.Int("dids"), Records: len(rules) > 0})
+	defer relay.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	relayServer := &http.Server{Handler: relay}
+	go relayServer.Serve(ln)
+	defer relayServer.Close()
+
+	port, err := freePort()
+	if err != nil {
+		return err
+	}
+	receiverURL := "http://127.0.0.1:" + port
+	level := cctx.String("log-level")
+
+	ingestArgs := []string{"--relay-host", "ws://" + ln.Addr().String(), "--nats-url", natsURL, "--metrics-addr", "", "--log-level", level}
+	webhookURL := receiverURL + "/webhook"
+	var chaosRun *chaosRun
+	if cctx.Bool("chaos") {
+		if chaosRun, err = newChaosRun(cctx, ns, relay, receiverURL); err != nil {
+			return err
+		}
+		defer chaosRun.close()
+		// Ingest resumes from its saved cursor after failures only with
+		// leader election; without it, it exits
+		ingestArgs = []string{"--relay-host", "ws://" + ln.Addr().String(), "--nats-url", chaosRun.natsURL(), "--metrics-addr", "", "--log-level", level,
+			"--leader-election", "--instance-id", "e2e", "--lease-ttl", "3s"}
+		webhookURL = chaosRun.gateURL + "/webhook"
+	}
+	var redaction *redactionCheck
+	consumeArgs := []string{
+		"--nats-url", natsURL, "--metrics-addr", "", "--log-level", level,
+		"--count", strconv.Itoa(cctx.Int("consumers")),
+		"--batch-size", strconv.Itoa(cctx.Int("batch-size")),
+		"--poll-interval", strconv.Itoa(cctx.Int("poll-interval")),
+	}
+	if len(rules) > 0 {
+		if redaction, err = newRedactionCheck(rules, webhookURL); err != nil {
+			return err
+		}
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return err
+		}
+		checkServer := &http.Server{Handler: redaction}
+		go checkServer.Serve(ln)
+		defer checkServer.Close()
+		webhookURL = "http://" + ln.Addr().String() + "/webhook"
+		for _, rule := range rules {
+			consumeArgs = append(consumeArgs, "--redact", rule)
+		}
+	}
+
+	errc := make(chan error, 3)
+	running := 0
+	launch := func(c component) {
+		running++
+		go func() {
+			err := service.App(c.cmd.Name, c.cmd).RunContext(ctx, append([]string{c.cmd.Name}, c.args...))
+			if err != nil {
+				err = fmt.Errorf("%s: %w", c.cmd.Name, err)
+			}
+			errc <- err
+		}()
+	}
+	stop := func(err error) error {
+		cancel()
+		return errors.Join(err, drain(errc, running))
+	}
+
+	launch(component{receive.Command(), []string{"--port", port, "--log-level", level}})
+	launch(component{ingest.Command(), ingestArgs})
+	if err := waitForStream(natsURL); err != nil {
+		return stop(err)
+	}
+	launch(component{consume.Command(), append(consumeArgs, "--use-webhook", "--webhook-url", webhookURL)})
+	// Consumers only get the frames published once they exist
+	if err := waitForConsumers(natsURL, cctx.Int("consumers")); err != nil {
+		return stop(err)
+	}
+	calls, err := tailCalls(ctx, receiverURL)
+	if err != nil {
+		return stop(err)
+	}
+
+	logger.Info("pipeline started, sending frames", "frames", frames, "rate", cctx.Float64("rate"))
+	relay.Start()
+	checks := e2eChecks{frames: frames, maxLatency: cctx.Duration("max-latency"), strict: chaosRun == nil}
+	if chaosRun != nil {
+		go chaosRun.run(ctx, logger)
+		checks.maxRedelivered = int(cctx.Float64("max-duplicates") * float64(frames))
+	}
+	results, err := collect(ctx, relay, calls, cctx.Int("consumers"), frames, cctx.Duration("timeout"), errc)
+	if err != nil {
+		return stop(err)
+	}
+	failed := report(os.Stdout, results, checks)
+	if chaosRun != nil {
+		chaosRun.report(os.Stdout)
+	}
+	leaked := redaction != nil && redaction.report(os.Stdout)
+	if err := stop(nil); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d consumers failed the checks", failed, len(results.consumers))
+	}
+	if leaked {
+		return errors.New("redaction check failed")
+	}
+	return nil
+}
+
+// embeddedNATS starts a JetStream server storing in a new temporary
+// directory, removed by shutdown.
+func embeddedNATS(prefix string) (*server.Server, func(), error) {
+	dir, err := os.MkdirTemp("", prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+	ns, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: server.RANDOM_PORT, JetStream: true, StoreDir: dir, NoSigs: true})
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, nil, fmt.Errorf("failed to create NATS server: %w", err)
+	}
+	go ns.Start()
+	shutdown := func() {
+		ns.Shutdown()
+		ns.WaitForShutdown()
+		os.RemoveAll(dir)
+	}
+	if !ns.ReadyForConnections(10 * time.Second) {
+		shutdown()
+		return nil, nil, errors.New("NATS server didn't start")
+	}
+	return ns, shutdown, nil
+}
+
+func freePort() (string, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer ln.Close()
+	return strconv.Itoa(ln.Addr().(*net.TCPAddr).Port), nil
+}
+
+func waitForConsumers(natsURL string, n int) error {
+	nc, err := nats.Connect(natsURL)
+	if err != nil {
+		return fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+	defer nc.Close()
+	js, err := nc.JetStream()
+	if err != nil {
+		return fmt.Errorf("failed to create JetStream context: %w", err)
+	}
+	stream, err := js.StreamNameBySubject("atproto.firehose.>")
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(streamWaitTimeout)
+	for {
+		info, err := js.StreamInfo(stream)
+		if err == nil && info.State.Consumers >= n {
+			return nil
+		} else if time.Now().After(deadline) {
+			return fmt.Errorf("%d consumers weren't created", n)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// tailCall is the part of the receiver's /tail summaries the checks use.
+type tailCall struct {
+	Time     time.Time `json:"time"`
+	Status   string    `json:"status"`
+	Consumer string    `json:"consumer"`
+	Events   int       `json:"events"`
+	FirstSeq uint64    `json:"first_seq"`
+	LastSeq  uint64    `json:"last_seq"`
+	Reason   string    `json:"reason"`
+}
+
+// tailCalls follows the receiver's /tail until ctx is done. It returns once
+// the receiver streams, so no call is missed from then on.
+func tailCalls(ctx context.Context, receiverURL string) (<-chan tailCall, error) {
+	var resp *http.Response
+	deadline := time.Now().Add(streamWaitTimeout)
+	for {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, receiverURL+"/tail", nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err = http.DefaultClient.Do(req)
+		if err == nil && resp.StatusCode == http.StatusOK {
+			break
+		}
+		if err == nil {
+			resp.Body.Close()
+			err = errors.New(resp.Status)
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("failed to follow the receiver's calls: %w", err)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	calls := make(chan tailCall, 1024)
+	go func() {
+		defer resp.Body.Close()
+		defer close(calls)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+			if !ok {
+				continue
+			}
+			var c tailCall
+			if json.Unmarshal([]byte(data), &c) == nil {
+				calls <- c
+			}
+		}
+	}()
+	return calls, nil
+}
+
+// consumerResult is what a consumer delivered to the receiver.
+type consumerResult struct {
+	name       string
+	calls      int
+	failed     int
+	duplicates int
+	delivered  int
+	// redelivered counts the frames delivered again in accepted calls
+	redelivered int
+	highest     uint64
+	seen        []bool // by seq
+	anomalies   map[string]int
+	latencies   []time.Duration
+}
+
+// add checks an accepted call against the previous ones, the way the
+// receiver's sequence checks do, and records the latency of the frames it
+// delivers for the first time. The relay's seq n is the stream's seq n, as
+// the stream is new.
+func (r *consumerResult) add(c tailCall, relay *fakerelay.Relay) {
+	r.calls++
+	switch {
+	case !strings.HasPrefix(c.Status, "2"):
+		r.failed++
+		return
+	case c.Reason != "":
+		r.duplicates++
+		return
+	case c.FirstSeq == 0 || c.LastSeq < c.FirstSeq:
+		return
+	case c.LastSeq <= r.highest:
+		r.anomalies["out_of_order"]++
+	case c.FirstSeq <= r.highest:
+		r.anomalies["overlap"]++
+	case c.FirstSeq > r.highest+1:
+		r.anomalies["gap"]++
+	}
+	for seq := c.FirstSeq; seq <= min(c.LastSeq, uint64(len(r.seen)-1)); seq++ {
+		if r.seen[seq] {
+			r.redelivered++
+			continue
+		}
+		r.seen[seq] = true
+		r.delivered++
+		if sent, ok := relay.SentAt(int64(seq)); ok {
+			r.latencies = append(r.latencies, c.Time.Sub(sent))
+		}
+	}
+	r.highest = max(r.highest, c.LastSeq)
+}
+
+// collect follows the calls until every consumer has delivered every
+// frame, or until timeout after the relay has sent it.
+func collect(ctx context.Context, relay *fakerelay.Relay, calls <-chan tailCall, consumers, frames int, timeout time.Duration, errc chan error) (*e2eResults, error) {
+	res := &e2eResults{}
+	byName := make(map[string]*consumerResult)
+	for i := range consumers {
+		name := fmt.Sprintf("consumer-%d", i)
+		byName[name] = &consumerResult{name: name, seen: make([]bool, frames+1), anomalies: make(map[string]int)}
+	}
+	done := func() bool {
+		for _, r := range byName {
+			if r.delivered < frames {
+				return false
+			}
+		}
+		return true
+	}
+
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	var deadline time.Time
+	for !done() {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case err := <-errc:
+			errc <- err
+			return nil, errors.New("a component stopped before the end of the run")
+		case c, ok := <-calls:
+			if !ok {
+				return nil, errors.New("the receiver stopped streaming its calls")
+			}
+			if r, ok := byName[c.Consumer]; ok {
+				r.add(c, relay)
+			} else if c.Consumer == "" {
+				// Rejected before the payload was read, such as the
+				// receiver's injected faults
+				res.rejected++
+			}
+		case <-tick.C:
+			if deadline.IsZero() && relay.Sent() == frames {
+				deadline = time.Now().Add(timeout)
+			}
+			if !deadline.IsZero() && time.Now().After(deadline) {
+				return res.sorted(byName), nil
+			}
+		}
+	}
+	return res.sorted(byName), nil
+}
+
+// e2eResults is what the receiver got during a run.
+type e2eResults struct {
+	consumers []*consumerResult
+	// rejected counts the calls failed without knowing their consumer
+	rejected int
+}
+
+func (res *e2eResults) sorted(byName map[string]*consumerResult) *e2eResults {
+	for _, r := range byName {
+		res.consumers = append(res.consumers, r)
+	}
+	slices.SortFunc(res.consumers, func(a, b *consumerResult) int { return strings.Compare(a.name, b.name) })
+	return res
+}
+
+// e2eChecks are what a run must meet.
+type e2eChecks struct {
+	frames int
+	// strict also fails on ordering anomalies, latency and redeliveries,
+	// which faults cause
+	strict         bool
+	maxLatency     time.Duration
+	maxRedelivered int
+}
+
+// report prints a line per consumer and returns how many failed.
+func report(w io.Writer, results *e2eResults, checks e2eChecks) int {
+	failed := 0
+	fmt.Fprintf(w, "%d frames sent, %d calls rejected before reading their consumer\n", checks.frames, results.rejected)
+	for _, r := range results.consumers {
+		slices.Sort(r.latencies)
+		p50, p99, worst := percentile(r.latencies, 0.5), percentile(r.latencies, 0.99), percentile(r.latencies, 1)
+
+		var problems []string
+		if r.delivered != checks.frames {
+			problems = append(problems, fmt.Sprintf("delivered %d of %d frames", r.delivered, checks.frames))
+		}
+		if checks.strict {
+			for _, kind := range []string{"gap", "overlap", "out_of_order"} {
+				if n := r.anomalies[kind]; n > 0 {
+					problems = append(problems, fmt.Sprintf("%d %s", n, kind))
+				}
+			}
+			if p99 > checks.maxLatency {
+				problems = append(problems, fmt.Sprintf("p99 latency above %s", checks.maxLatency))
+			}
+		}
+		if r.redelivered > checks.maxRedelivered {
+			problems = append(problems, fmt.Sprintf("more than %d frames delivered again", checks.maxRedelivered))
+		}
+		status := "ok"
+		if len(problems) > 0 {
+			status = "FAIL: " + strings.Join(problems, ", ")
+			failed++
+		}
+		fmt.Fprintf(w, "%s: %d delivered in %d calls (%d failed, %d duplicates, %d frames again, %d sequence anomalies), latency p50 %s p99 %s max %s: %s\n",
+			r.name, r.delivered, r.calls, r.failed, r.duplicates, r.redelivered,
+			r.anomalies["gap"]+r.anomalies["overlap"]+r.anomalies["out_of_order"],
+			p50.Round(time.Millisecond), p99.Round(time.Millisecond), worst.Round(time.Millisecond), status)
+	}
+	return failed
+}
+
+// percentile returns the q quantile of the sorted durations.
+func percentile(sorted []time.Duration, q float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[min(int(q*float64(len(sorted))), len(sorted)-1)]
+}
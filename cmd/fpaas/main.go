@@ -0,0 +1,46 @@
+// Command fpaas runs every component of the firehose processor from one
+// binary: fpaas ingest, route, index, consume, receive, control-plane,
+// analyze, fake-relay, all-in-one, bootstrap, maintenance, doctor, e2e,
+// bench, config, dashboard and schema.
+package main
+
+import (
+	"github.com/carlmjohnson/versioninfo"
+	"github.com/eurosky/firehose-processor-aas/internal/app/analyze"
+	"github.com/eurosky/firehose-processor-aas/internal/app/consume"
+	"github.com/eurosky/firehose-processor-aas/internal/app/control"
+	"github.com/eurosky/firehose-processor-aas/internal/app/index"
+	"github.com/eurosky/firehose-processor-aas/internal/app/ingest"
+	"github.com/eurosky/firehose-processor-aas/internal/app/receive"
+	"github.com/eurosky/firehose-processor-aas/internal/app/relay"
+	"github.com/eurosky/firehose-processor-aas/internal/app/route"
+	"github.com/eurosky/firehose-processor-aas/internal/pkg/service"
+	"github.com/urfave/cli/v2"
+)
+
+func main() {
+	service.Main(&cli.App{
+		Name:    "fpaas",
+		Usage:   "ATProto firehose processor",
+		Version: versioninfo.Short(),
+		Commands: []*cli.Command{
+			ingest.Command(),
+			route.Command(),
+			index.Command(),
+			consume.Command(),
+			receive.Command(),
+			control.Command(),
+			analyze.Command(),
+			relay.Command(),
+			allInOneCommand(),
+			bootstrapCommand(),
+			maintenanceCommand(),
+			doctorCommand(),
+			e2eCommand(),
+			benchCommand(),
+			configCommand(),
+			dashboardCommand(),
+			schemaCommand(),
+		},
+	})
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/pkg/consumer"
+	"github.com/nats-io/nats.go"
+	"github.com/urfave/cli/v2"
+)
+
+func maintenanceCommand() *cli.Command {
+	natsURL := &cli.StringFlag{
+		Name:    "nats-url",
+		Usage:   "NATS server URL",
+		Value:   "nats://localhost:4222",
+		EnvVars: []string{"NATS_URL"},
+	}
+	return &cli.Command{
+		Name:  "maintenance",
+		Usage: "pause or resume delivery of every consumer of the cluster, e.g. around NATS upgrades",
+		Description: "Sets or clears the maintenance switch in the fpaas_maintenance bucket. Consumers watch it:\n" +
+			"while it is set, they stop pulling and report paused, and their durables keep their position.",
+		Subcommands: []*cli.Command{
+			{
+				Name:  "on",
+				Usage: "pause delivery",
+				Flags: []cli.Flag{
+					natsURL,
+					&cli.StringFlag{
+						Name:  "reason",
+						Usage: "why delivery is paused, shown in the consumers' logs and /readyz",
+					},
+				},
+				Action: func(cctx *cli.Context) error {
+					return withMaintenanceBucket(cctx, func(kv nats.KeyValue) error {
+						if err := consumer.SetMaintenance(kv, consumer.Maintenance{Reason: cctx.String("reason"), Since: time.Now().UTC()}); err != nil {
+							return fmt.Errorf("failed to set maintenance mode: %w", err)
+						}
+						fmt.Println("maintenance mode on: consumers pause after their current batch")
+						return nil
+					})
+				},
+			},
+			{
+				Name:  "off",
+				Usage: "resume delivery",
+				Flags: []cli.Flag{natsURL},
+				Action: func(cctx *cli.Context) error {
+					return withMaintenanceBucket(cctx, func(kv nats.KeyValue) error {
+						if err := consumer.ClearMaintenance(kv); err != nil {
+							return fmt.Errorf("failed to clear maintenance mode: %w", err)
+						}
+						fmt.Println("maintenance mode off: consumers resume from their durables")
+						return nil
+					})
+				},
+			},
+			{
+				Name:  "status",
+				Usage: "print whether delivery is paused",
+				Flags: []cli.Flag{natsURL},
+				Action: func(cctx *cli.Context) error {
+					return withMaintenanceBucket(cctx, func(kv nats.KeyValue) error {
+						m, err := consumer.GetMaintenance(kv)
+						if err != nil {
+							return err
+						}
+						if m == nil {
+							fmt.Println("maintenance mode off")
+							return nil
+						}
+						fmt.Printf("maintenance mode on since %s (%s ago)", m.Since.Format(time.RFC3339), time.Since(m.Since).Round(time.Second))
+						if m.Reason != "" {
+							fmt.Printf(": %s", m.Reason)
+						}
+						fmt.Println()
+						return nil
+					})
+				},
+			},
+		},
+	}
+}
+
+// withMaintenanceBucket runs fn with the maintenance bucket of --nats-url.
+func withMaintenanceBucket(cctx *cli.Context, fn func(kv nats.KeyValue) error) error {
+	nc, err := nats.Connect(cctx.String("nats-url"))
+	if err != nil {
+		return fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+	defer nc.Close()
+	js, err := nc.JetStream()
+	if err != nil {
+		return fmt.Errorf("failed to create JetStream context: %w", err)
+	}
+	kv, err := consumer.EnsureMaintenanceBucket(js)
+	if err != nil {
+		return fmt.Errorf("failed to open maintenance bucket: %w", err)
+	}
+	return fn(kv)
+}
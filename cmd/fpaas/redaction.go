@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/eurosky/firehose-processor-aas/pkg/events"
+	"github.com/eurosky/firehose-processor-aas/pkg/firehose"
+	"github.com/urfave/cli/v2"
+)
+
+func redactionFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringSliceFlag{
+			Name: "redact",
+			Usage: "consume --redact rules; the relay's commits then carry records, posts with an embed and a chat declaration, " +
+				"and every webhook body is checked for what the rules remove",
+		},
+	}
+}
+
+// redactionCheck sits in front of the receiver and checks that no webhook
+// body carries a record the rules drop or a field they strip.
+type redactionCheck struct {
+	redaction *firehose.Redaction
+	next      http.Handler
+
+	mu sync.Mutex
+	// checked counts the commit ops delivered
+	checked int
+	leaks   int
+	example string
+}
+
+func newRedactionCheck(rules []string, target string) (*redactionCheck, error) {
+	redaction, err := firehose.ParseRedaction(rules)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = ""
+	return &redactionCheck{redaction: redaction, next: httputil.NewSingleHostReverseProxy(u)}, nil
+}
+
+func (c *redactionCheck) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	// The consumers send the default JSON payloads
+	var payload struct {
+		events.Batch
+		Event []byte `json:"event"`
+	}
+	if json.Unmarshal(body, &payload) == nil {
+		frames := payload.Events
+		if payload.Event != nil {
+			frames = [][]byte{payload.Event}
+		}
+		for _, frame := range frames {
+			c.check(frame)
+		}
+	}
+	c.next.ServeHTTP(w, r)
+}
+
+func (c *redactionCheck) check(frame []byte) {
+	evt, err := firehose.DecodeFrame(frame)
+	if err != nil {
+		c.leak(fmt.Sprintf("undecodable frame: %v", err))
+		return
+	}
+	for _, op := range evt.Ops {
+		c.mu.Lock()
+		c.checked++
+		c.mu.Unlock()
+		for _, rule := range c.redaction.Rules() {
+			if !rule.Matches(op.Collection) {
+				continue
+			}
+			if rule.Drop {
+				c.leak(fmt.Sprintf("seq %d carries %s/%s", evt.Seq, op.Collection, op.Rkey))
+				continue
+			}
+			var rec map[string]any
+			if op.Record == nil || json.Unmarshal(op.Record, &rec) != nil {
+				continue
+			}
+			if hasField(rec, rule.Field) {
+				c.leak(fmt.Sprintf("seq %d carries %s in %s/%s", evt.Seq, strings.Join(rule.Field, "."), op.Collection, op.Rkey))
+			}
+		}
+	}
+}
+
+func (c *redactionCheck) leak(example string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.leaks++
+	if c.example == "" {
+		c.example = example
+	}
+}
+
+func hasField(obj map[string]any, path []string) bool {
+	for _, key := range path[:len(path)-1] {
+		next, ok := obj[key].(map[string]any)
+		if !ok {
+			return false
+		}
+		obj = next
+	}
+	_, ok := obj[path[len(path)-1]]
+	return ok
+}
+
+// report prints the outcome and returns whether the check failed: content
+// the rules remove was delivered, or no commit was.
+func (c *redactionCheck) report(w io.Writer) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	status := "ok"
+	switch {
+	case c.leaks > 0:
+		status = fmt.Sprintf("FAIL: %d leaks, e.g. %s", c.leaks, c.example)
+	case c.checked == 0:
+		status = "FAIL: no commit was delivered"
+	}
+	fmt.Fprintf(w, "redaction: %d rules, %d ops checked: %s\n", len(c.redaction.Rules()), c.checked, status)
+	return status != "ok"
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/eurosky/firehose-processor-aas/pkg/events"
+	"github.com/urfave/cli/v2"
+)
+
+func schemaCommand() *cli.Command {
+	var names []string
+	for _, s := range events.Schemas {
+		names = append(names, s.Name)
+	}
+	return &cli.Command{
+		Name:  "schema",
+		Usage: "work with the JSON Schemas of the emitted payloads",
+		Subcommands: []*cli.Command{
+			{
+				Name:      "export",
+				Usage:     "print the JSON Schema of a payload (" + strings.Join(names, ", ") + "), or write them all to --dir",
+				ArgsUsage: "[name]",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "dir",
+						Usage: "directory to write <name>.schema.json files to",
+					},
+				},
+				Action: exportSchema,
+			},
+		},
+	}
+}
+
+func exportSchema(cctx *cli.Context) error {
+	if dir := cctx.String("dir"); dir != "" {
+		for _, s := range events.Schemas {
+			b, err := events.JSONSchema(s.Name)
+			if err != nil {
+				return err
+			}
+			if err := os.WriteFile(filepath.Join(dir, s.Name+".schema.json"), append(b, '\n'), 0o644); err != nil {
+				return fmt.Errorf("failed to write schema: %w", err)
+			}
+		}
+		return nil
+	}
+
+	if cctx.NArg() != 1 {
+		return fmt.Errorf("expected a schema name or --dir")
+	}
+	b, err := events.JSONSchema(cctx.Args().First())
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(os.Stdout, string(b))
+	return err
+}
@@ -0,0 +1,634 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/internal/pkg/fakerelay"
+	"github.com/eurosky/firehose-processor-aas/internal/pkg/service"
+	"github.com/eurosky/firehose-processor-aas/pkg/webhookclient"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	// soakStreamMaxAge bounds the in-memory stream of a run lasting hours.
+	soakStreamMaxAge = 30 * time.Minute
+	// soakProgressInterval is how often progress is printed.
+	soakProgressInterval = time.Minute
+)
+
+// soakKillable are the components a soak run restarts.
+var soakKillable = []string{"ingest", "consume", "receive"}
+
+func soakFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.DurationFlag{
+			Name:  "soak",
+			Usage: "run for this long instead of sending --frames, restarting components and checking continuously",
+		},
+		&cli.StringFlag{
+			Name:  "soak-components",
+			Usage: "components to restart: " + strings.Join(soakKillable, ", "),
+			Value: strings.Join(soakKillable, ","),
+		},
+		&cli.DurationFlag{
+			Name:  "soak-restart-interval",
+			Usage: "average time between component restarts",
+			Value: 5 * time.Minute,
+		},
+		&cli.DurationFlag{
+			Name:  "soak-downtime",
+			Usage: "how long a killed component stays down",
+			Value: 5 * time.Second,
+		},
+		&cli.DurationFlag{
+			Name:  "soak-grace",
+			Usage: "how long after being sent a frame must have been delivered",
+			Value: 2 * time.Minute,
+		},
+		&cli.DurationFlag{
+			Name:  "soak-check-interval",
+			Usage: "how often the invariants are checked",
+			Value: 10 * time.Second,
+		},
+	}
+}
+
+// soakCall is a webhook call answered by the receiver, as seen in front of
+// it: the relay seqs of its frames.
+type soakCall struct {
+	consumer string
+	seqs     []uint64
+}
+
+// soakTap records the calls passing through to the receiver. Unlike the
+// receiver's /tail, it stays up while the receiver restarts and never drops
+// a call. It reads the frames themselves: after a nak, a batch mixes
+// redelivered frames with new ones, so its seq headers are only a range.
+type soakTap struct {
+	next http.Handler
+
+	mu    sync.Mutex
+	calls []soakCall
+}
+
+func (t *soakTap) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	t.next.ServeHTTP(rec, r)
+	if rec.status/100 != 2 {
+		return
+	}
+	decoder := &webhookclient.Handler{OnDelivery: func(_ context.Context, d *webhookclient.Delivery) error {
+		frames, err := d.Frames()
+		if err != nil {
+			return err
+		}
+		c := soakCall{consumer: d.Consumer}
+		if i := strings.LastIndex(d.IdempotencyKey, "/"); c.consumer == "" && i >= 0 {
+			c.consumer = d.IdempotencyKey[:i]
+		}
+		for _, f := range frames {
+			c.seqs = append(c.seqs, uint64(f.Seq()))
+		}
+		t.mu.Lock()
+		t.calls = append(t.calls, c)
+		t.mu.Unlock()
+		return nil
+	}}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	decoder.ServeHTTP(discardResponse{}, r)
+}
+
+// drain returns the calls recorded since the last drain.
+func (t *soakTap) drain() []soakCall {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	calls := t.calls
+	t.calls = nil
+	return calls
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// discardResponse answers the tap's decoder, the receiver having answered
+// already.
+type discardResponse struct{}
+
+func (discardResponse) Header() http.Header         { return http.Header{} }
+func (discardResponse) Write(b []byte) (int, error) { return len(b), nil }
+func (discardResponse) WriteHeader(int)             {}
+
+// soakTracker follows what a consumer delivered: every seq up to low, and
+// the ones in above.
+type soakTracker struct {
+	low   uint64
+	above map[uint64]bool
+	// lost are the ranges reported lost; frames of them delivered later
+	// are late, not duplicates
+	lost        []seqRange
+	delivered   int
+	redelivered int
+	late        int
+	// duplicates are the seqs delivered again since the last check
+	duplicates []uint64
+}
+
+type seqRange struct {
+	first, last uint64
+}
+
+func (r seqRange) String() string {
+	if r.first == r.last {
+		return strconv.FormatUint(r.first, 10)
+	}
+	return fmt.Sprintf("%d-%d", r.first, r.last)
+}
+
+// addRange appends seq to ranges, extending the last one when adjacent.
+func addRange(ranges []seqRange, seq uint64) []seqRange {
+	if n := len(ranges); n > 0 && ranges[n-1].last+1 == seq {
+		ranges[n-1].last = seq
+		return ranges
+	}
+	return append(ranges, seqRange{seq, seq})
+}
+
+// toRanges returns the ranges of seqs, in any order and repeated.
+func toRanges(seqs []uint64) []seqRange {
+	seqs = slices.Compact(slices.Sorted(slices.Values(seqs)))
+	var ranges []seqRange
+	for _, seq := range seqs {
+		ranges = addRange(ranges, seq)
+	}
+	return ranges
+}
+
+func (t *soakTracker) add(c soakCall) {
+	for _, seq := range c.seqs {
+		switch {
+		case seq <= t.low && slices.ContainsFunc(t.lost, func(r seqRange) bool { return r.first <= seq && seq <= r.last }):
+			t.late++
+		case seq <= t.low || t.above[seq]:
+			t.redelivered++
+			t.duplicates = append(t.duplicates, seq)
+		default:
+			t.above[seq] = true
+			t.delivered++
+		}
+	}
+	for t.above[t.low+1] {
+		delete(t.above, t.low+1)
+		t.low++
+	}
+}
+
+// missing returns the ranges up to cutoff not delivered, and from then on
+// counts them as lost.
+func (t *soakTracker) missing(cutoff uint64) []seqRange {
+	var gaps []seqRange
+	for seq := t.low + 1; seq <= cutoff; seq++ {
+		if t.above[seq] {
+			delete(t.above, seq)
+		} else {
+			gaps = addRange(gaps, seq)
+		}
+	}
+	t.low = max(t.low, cutoff)
+	t.lost = append(t.lost, gaps...)
+	return gaps
+}
+
+// soakViolation is an invariant broken during a soak run.
+type soakViolation struct {
+	at       time.Duration
+	kind     string
+	consumer string
+	ranges   []seqRange
+	frames   int
+	detail   string
+}
+
+// soakProcess is a component a soak run kills and starts again. It runs as
+// a child process, so it is killed the way a crash would: with no chance to
+// save its state or ack what it delivered.
+type soakProcess struct {
+	name string
+	args []string
+	gen  int
+	cmd  *exec.Cmd
+}
+
+type soakExit struct {
+	p   *soakProcess
+	gen int
+	err error
+}
+
+// start runs the component; it is asked to stop gracefully when ctx is done.
+func (p *soakProcess) start(ctx context.Context, exe string, exits chan<- soakExit) error {
+	cmd := exec.CommandContext(ctx, exe, append([]string{p.name}, p.args...)...)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	cmd.Cancel = func() error { return cmd.Process.Signal(syscall.SIGTERM) }
+	cmd.WaitDelay = 30 * time.Second
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("%s: %w", p.name, err)
+	}
+	p.gen++
+	p.cmd = cmd
+	gen := p.gen
+	go func() {
+		exits <- soakExit{p, gen, cmd.Wait()}
+	}()
+	return nil
+}
+
+// soak runs the pipeline for --soak, restarting a component now and then,
+// and checks throughout that every consumer delivers every frame within
+// --soak-grace, with at most --max-duplicates of them delivered again.
+func soak(cctx *cli.Context) error {
+	if cctx.Bool("chaos") {
+		return errors.New("--soak and --chaos can't be combined")
+	}
+	duration, grace, check := cctx.Duration("soak"), cctx.Duration("soak-grace"), cctx.Duration("soak-check-interval")
+	restartEvery, downtime := cctx.Duration("soak-restart-interval"), cctx.Duration("soak-downtime")
+	if grace <= 0 || check <= 0 || restartEvery <= 0 || downtime < 0 {
+		return errors.New("soak-grace, soak-check-interval and soak-restart-interval must be positive")
+	}
+	if grace+downtime >= soakStreamMaxAge {
+		return fmt.Errorf("soak-grace and soak-downtime must add up to less than %s", soakStreamMaxAge)
+	}
+	var killable []string
+	for _, name := range strings.Split(cctx.String("soak-components"), ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if !slices.Contains(soakKillable, name) {
+			return fmt.Errorf("unknown component %q, want one of %s", name, strings.Join(soakKillable, ", "))
+		}
+		killable = append(killable, name)
+	}
+	rate, consumers := cctx.Float64("rate"), cctx.Int("consumers")
+	if rate <= 0 || consumers < 1 {
+		return errors.New("rate and consumers must be positive")
+	}
+	seed := cctx.Uint64("chaos-seed")
+	if seed == 0 {
+		seed = rand.Uint64()
+	}
+	rng := rand.New(rand.NewPCG(seed, seed))
+	logger := service.Logger(cctx)
+	ctx, cancel := service.SignalContext(cctx.Context, logger)
+	defer cancel()
+
+	ns, shutdown, err := embeddedNATS("fpaas-soak-")
+	if err != nil {
+		return err
+	}
+	defer shutdown()
+	natsURL := ns.ClientURL()
+
+	// The backlog covers ingest resuming after its downtime
+	backlog := int(rate * (downtime + time.Minute).Seconds())
+	relay := fakerelay.New(fakerelay.Options{Rate: rate, DIDs: cctx.Int("dids"), Backlog: max(backlog, 10000)})
+	defer relay.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	relayServer := &http.Server{Handler: relay}
+	go relayServer.Serve(ln)
+	defer relayServer.Close()
+
+	port, err := freePort()
+	if err != nil {
+		return err
+	}
+	target, err := url.Parse("http://127.0.0.1:" + port)
+	if err != nil {
+		return err
+	}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	// The receiver being down is expected; the consumers log it
+	proxy.ErrorLog = log.New(io.Discard, "", 0)
+	tap := &soakTap{next: proxy}
+	tapLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	tapServer := &http.Server{Handler: tap}
+	go tapServer.Serve(tapLn)
+	defer tapServer.Close()
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	level := cctx.String("log-level")
+	procs := map[string]*soakProcess{
+		"receive": {name: "receive", args: []string{"--port", port, "--log-level", level}},
+		// Ingest resumes from its saved cursor after a restart only with
+		// leader election
+		"ingest": {name: "ingest", args: []string{"--relay-host", "ws://" + ln.Addr().String(), "--nats-url", natsURL,
+			"--metrics-addr", "", "--log-level", level, "--leader-election", "--instance-id", "soak", "--lease-ttl", "3s",
+			"--stream-max-age", soakStreamMaxAge.String()}},
+		"consume": {name: "consume", args: []string{
+			"--nats-url", natsURL, "--metrics-addr", "", "--log-level", level,
+			"--use-webhook", "--webhook-url", "http://" + tapLn.Addr().String() + "/webhook",
+			"--count", strconv.Itoa(consumers),
+			"--batch-size", strconv.Itoa(cctx.Int("batch-size")),
+			"--poll-interval", strconv.Itoa(cctx.Int("poll-interval")),
+		}},
+	}
+	exits := make(chan soakExit, len(procs))
+	running := 0
+	stopAll := func(err error) error {
+		cancel()
+		errs := []error{err}
+		for range running {
+			// A component stopped by the cancel exits with its error
+			if e := <-exits; e.err != nil && !errors.Is(e.err, context.Canceled) {
+				errs = append(errs, fmt.Errorf("%s: %w", e.p.name, e.err))
+			}
+		}
+		return errors.Join(errs...)
+	}
+	launch := func(name string) error {
+		if err := procs[name].start(ctx, exe, exits); err != nil {
+			return err
+		}
+		running++
+		return nil
+	}
+
+	for _, name := range []string{"receive", "ingest"} {
+		if err := launch(name); err != nil {
+			return stopAll(err)
+		}
+	}
+	if err := waitForStream(natsURL); err != nil {
+		return stopAll(err)
+	}
+	if err := launch("consume"); err != nil {
+		return stopAll(err)
+	}
+	if err := waitForConsumers(natsURL, consumers); err != nil {
+		return stopAll(err)
+	}
+
+	trackers := make(map[string]*soakTracker)
+	for i := range consumers {
+		trackers[fmt.Sprintf("consumer-%d", i)] = &soakTracker{above: make(map[uint64]bool)}
+	}
+	var violations []soakViolation
+	restarts := make(map[string]int)
+	// sentAt are the frames sent at each check, to find the ones sent
+	// before the grace period
+	type sentSample struct {
+		at   time.Time
+		sent int
+	}
+	var sentAt []sentSample
+	maxDuplicates := cctx.Float64("max-duplicates")
+
+	fmt.Fprintf(os.Stdout, "soak seed %d: %s at %g frames/s, restarting %s about every %s\n",
+		seed, duration, rate, strings.Join(killable, ", "), restartEvery)
+	relay.Start()
+	start := time.Now()
+	violate := func(v soakViolation) {
+		v.at = time.Since(start).Round(time.Second)
+		violations = append(violations, v)
+		logger.Error("soak invariant violated", "kind", v.kind, "consumer", v.consumer, "frames", v.frames,
+			"ranges", formatRanges(v.ranges), "detail", v.detail, "at", v.at)
+	}
+	record := func() {
+		for _, c := range tap.drain() {
+			if t := trackers[c.consumer]; t != nil {
+				t.add(c)
+			}
+		}
+	}
+	checkAll := func(cutoff uint64) {
+		record()
+		for name, t := range trackers {
+			if gaps := t.missing(cutoff); len(gaps) > 0 {
+				n := 0
+				for _, g := range gaps {
+					n += int(g.last - g.first + 1)
+				}
+				violate(soakViolation{kind: "loss", consumer: name, ranges: gaps, frames: n,
+					detail: fmt.Sprintf("not delivered within %s", grace)})
+			}
+			if len(t.duplicates) > 0 && t.delivered > 0 && float64(t.redelivered)/float64(t.delivered) > maxDuplicates {
+				violate(soakViolation{kind: "duplicates", consumer: name, ranges: toRanges(t.duplicates), frames: len(t.duplicates),
+					detail: fmt.Sprintf("%.1f%% of the frames delivered again, above %.1f%%",
+						100*float64(t.redelivered)/float64(t.delivered), 100*maxDuplicates)})
+			}
+			t.duplicates = nil
+		}
+	}
+	// cutoffAt is the last seq sent before t; the relay's frames have seqs
+	// from 1
+	cutoffAt := func(t time.Time) uint64 {
+		cutoff := 0
+		for _, s := range sentAt {
+			if s.at.After(t) {
+				break
+			}
+			cutoff = s.sent
+		}
+		return uint64(cutoff)
+	}
+
+	nextRestart := func() <-chan time.Time {
+		if len(killable) == 0 {
+			return nil
+		}
+		return time.After(time.Duration((0.5 + rng.Float64()) * float64(restartEvery)))
+	}
+	restartC := nextRestart()
+	var down *soakProcess
+	var upC <-chan time.Time
+	end := time.After(duration)
+	tick := time.NewTicker(check)
+	defer tick.Stop()
+	progress := time.NewTicker(soakProgressInterval)
+	defer progress.Stop()
+	record1s := time.NewTicker(time.Second)
+	defer record1s.Stop()
+
+	// kill kills p, waiting for it while recording the calls
+	kill := func(p *soakProcess) error {
+		if err := p.cmd.Process.Kill(); err != nil {
+			return err
+		}
+		for {
+			select {
+			case e := <-exits:
+				running--
+				if e.p == p && e.gen == p.gen {
+					return nil
+				}
+				return fmt.Errorf("%s stopped on its own: %v", e.p.name, e.err)
+			case <-record1s.C:
+				record()
+			}
+		}
+	}
+
+	for soaking := true; soaking; {
+		select {
+		case <-ctx.Done():
+			return stopAll(ctx.Err())
+		case e := <-exits:
+			running--
+			return stopAll(fmt.Errorf("%s stopped on its own: %v", e.p.name, e.err))
+		case <-record1s.C:
+			record()
+		case now := <-tick.C:
+			sentAt = append(sentAt, sentSample{now, relay.Sent()})
+			checkAll(cutoffAt(now.Add(-grace)))
+			// Older samples are no longer needed
+			if i := slices.IndexFunc(sentAt, func(s sentSample) bool { return s.at.After(now.Add(-grace)) }); i > 1 {
+				sentAt = slices.Delete(sentAt, 0, i-1)
+			}
+		case <-progress.C:
+			fmt.Fprintf(os.Stdout, "%s: %d frames sent, %d restarts, %d violations\n",
+				time.Since(start).Round(time.Second), relay.Sent(), sum(restarts), len(violations))
+		case <-restartC:
+			name := killable[rng.IntN(len(killable))]
+			down = procs[name]
+			logger.Info("killing component", "component", name, "downtime", downtime)
+			if err := kill(down); err != nil {
+				return stopAll(err)
+			}
+			restarts[name]++
+			upC = time.After(downtime)
+			restartC = nil
+		case <-upC:
+			if err := launch(down.name); err != nil {
+				return stopAll(err)
+			}
+			logger.Info("restarted component", "component", down.name)
+			down, upC = nil, nil
+			restartC = nextRestart()
+		case <-end:
+			soaking = false
+		}
+	}
+
+	// Everything sent until now must still arrive within the grace period
+	if down != nil {
+		if err := launch(down.name); err != nil {
+			return stopAll(err)
+		}
+	}
+	last := uint64(relay.Sent())
+	settle := time.After(grace)
+	for settling := true; settling; {
+		select {
+		case <-ctx.Done():
+			return stopAll(ctx.Err())
+		case e := <-exits:
+			running--
+			return stopAll(fmt.Errorf("%s stopped on its own: %v", e.p.name, e.err))
+		case <-record1s.C:
+			record()
+		case <-settle:
+			settling = false
+		}
+	}
+	checkAll(last)
+
+	soakReport(os.Stdout, seed, trackers, restarts, violations)
+	if err := stopAll(nil); err != nil {
+		return err
+	}
+	if len(violations) > 0 {
+		return fmt.Errorf("%d invariant violations", len(violations))
+	}
+	return nil
+}
+
+func soakReport(w io.Writer, seed uint64, trackers map[string]*soakTracker, restarts map[string]int, violations []soakViolation) {
+	names := make([]string, 0, len(trackers))
+	for name := range trackers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		t := trackers[name]
+		lost := 0
+		for _, r := range t.lost {
+			lost += int(r.last - r.first + 1)
+		}
+		rate := 0.0
+		if t.delivered > 0 {
+			rate = 100 * float64(t.redelivered) / float64(t.delivered)
+		}
+		fmt.Fprintf(w, "%s: %d delivered, %d again (%.2f%%), %d lost, %d late\n", name, t.delivered, t.redelivered, rate, lost-t.late, t.late)
+	}
+	var kinds []string
+	for _, name := range soakKillable {
+		if n := restarts[name]; n > 0 {
+			kinds = append(kinds, fmt.Sprintf("%s %d", name, n))
+		}
+	}
+	fmt.Fprintf(w, "soak seed %d: %d restarts (%s), %d violations\n", seed, sum(restarts), strings.Join(kinds, ", "), len(violations))
+	for _, v := range violations {
+		fmt.Fprintf(w, "  %s at %s: %s, %d frames, seq %s: %s\n", v.kind, v.at, v.consumer, v.frames, formatRanges(v.ranges), v.detail)
+	}
+}
+
+// formatRanges lists the first ranges, so a long run of violations stays
+// readable.
+func formatRanges(ranges []seqRange) string {
+	const shown = 10
+	parts := make([]string, 0, min(len(ranges), shown))
+	for _, r := range ranges[:min(len(ranges), shown)] {
+		parts = append(parts, r.String())
+	}
+	s := strings.Join(parts, ",")
+	if len(ranges) > shown {
+		s += fmt.Sprintf(" and %d more", len(ranges)-shown)
+	}
+	return s
+}
+
+func sum(m map[string]int) int {
+	n := 0
+	for _, v := range m {
+		n += v
+	}
+	return n
+}
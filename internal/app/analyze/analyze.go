@@ -0,0 +1,604 @@
+// Package analyze is the stream analyzer: it reads every frame of the NATS
+// stream, reports who is generating the traffic, window by window, alerts
+// when the throughput stalls or spikes, evaluates alerting rules and,
+// optionally, detects clusters of duplicate posts and bursts of records.
+package analyze
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/internal/pkg/service"
+	"github.com/eurosky/firehose-processor-aas/pkg/events"
+	"github.com/eurosky/firehose-processor-aas/pkg/firehose"
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/urfave/cli/v2"
+	"github.com/urfave/cli/v2/altsrc"
+)
+
+// TopNSubject is where a events.TopN is published at the end of every window.
+const TopNSubject = "atproto.stats.topn"
+
+// Command is the analyzer command, "fpaas analyze".
+func Command() *cli.Command {
+	return &cli.Command{
+		Name:   "analyze",
+		Usage:  "Report the most active DIDs and collections of the stream and alert on throughput anomalies",
+		Before: service.LoadConfig("analyze"),
+		Action: run,
+		Flags:  flags(),
+		Subcommands: []*cli.Command{
+			{
+				Name:   "validate",
+				Usage:  "check the configuration and exit",
+				Flags:  flags(),
+				Before: service.LoadConfig("analyze"),
+				Action: validate,
+			},
+		},
+	}
+}
+
+func flags() []cli.Flag {
+	return []cli.Flag{
+		service.ConfigFlag(),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    "nats-url",
+			Usage:   "NATS server URL",
+			Value:   "nats://localhost:4222",
+			EnvVars: []string{"NATS_URL"},
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:    "window",
+			Usage:   "length of the windows the reports cover",
+			Value:   time.Minute,
+			EnvVars: []string{"WINDOW"},
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:    "top",
+			Usage:   "DIDs and collections listed per window",
+			Value:   10,
+			EnvVars: []string{"TOP"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    "group",
+			Usage:   "analyzers of a group share a durable consumer and split the frames, so their reports add up; without it every instance reads every frame",
+			EnvVars: []string{"ANALYZE_GROUP"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    "instance-id",
+			Usage:   "instance name in the reports and alerts (default: hostname)",
+			EnvVars: []string{"INSTANCE_ID"},
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:    "alert-interval",
+			Usage:   "how often the throughput is sampled for alerts",
+			Value:   10 * time.Second,
+			EnvVars: []string{"ALERT_INTERVAL"},
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:    "alert-baseline",
+			Usage:   "how far back the moving average of the expected throughput looks",
+			Value:   10 * time.Minute,
+			EnvVars: []string{"ALERT_BASELINE"},
+		}),
+		altsrc.NewFloat64Flag(&cli.Float64Flag{
+			Name:    "alert-threshold",
+			Usage:   "standard deviations above the expected throughput that make a spike; 0 disables alerts",
+			Value:   4,
+			EnvVars: []string{"ALERT_THRESHOLD"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    "alert-webhook-url",
+			Usage:   "also POST alerts as JSON here, e.g. a Slack incoming webhook",
+			EnvVars: []string{"ALERT_WEBHOOK_URL"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    "rules",
+			Usage:   "YAML file of alerting rules over consumer backlogs, delivery failures and the stream rate",
+			EnvVars: []string{"RULES_FILE"},
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:    "rules-interval",
+			Usage:   "how often the --rules are evaluated",
+			Value:   15 * time.Second,
+			EnvVars: []string{"RULES_INTERVAL"},
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:    "duplicates",
+			Usage:   "cluster posts by the simhash of their text and publish the clusters of near-duplicates, likely spam, on " + DuplicatesSubject + " in the " + firehose.AnalysisStream + " stream",
+			EnvVars: []string{"DUPLICATES"},
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:    "duplicates-cache",
+			Usage:   "post fingerprints kept to match new posts against; the least recently matched are forgotten past it",
+			Value:   100000,
+			EnvVars: []string{"DUPLICATES_CACHE"},
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:    "duplicates-distance",
+			Usage:   "bits by which the fingerprint of a post may differ from a cluster's to join it (0 to 7)",
+			Value:   6,
+			EnvVars: []string{"DUPLICATES_DISTANCE"},
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:    "duplicates-min-words",
+			Usage:   "words a post needs to be clustered; shorter posts are alike by chance",
+			Value:   5,
+			EnvVars: []string{"DUPLICATES_MIN_WORDS"},
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:    "duplicates-min-posts",
+			Usage:   "posts a cluster needs to be reported; it is reported again every time it doubles",
+			Value:   5,
+			EnvVars: []string{"DUPLICATES_MIN_POSTS"},
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:    "duplicates-min-dids",
+			Usage:   "distinct DIDs a cluster needs to be reported; 1 also reports accounts repeating themselves",
+			Value:   2,
+			EnvVars: []string{"DUPLICATES_MIN_DIDS"},
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:    "bursts",
+			Usage:   "count the records each DID creates and publish the bursts of those creating them faster than --bursts-threshold, likely bots, on " + BurstsSubject + " in the " + firehose.AnalysisStream + " stream",
+			EnvVars: []string{"BURSTS"},
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:    "bursts-threshold",
+			Usage:   "records a DID must create within --bursts-window to start a burst; the burst ends under half of it",
+			Value:   30,
+			EnvVars: []string{"BURSTS_THRESHOLD"},
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:    "bursts-window",
+			Usage:   "length of the sliding window rates are measured over",
+			Value:   time.Minute,
+			EnvVars: []string{"BURSTS_WINDOW"},
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:    "bursts-collections",
+			Usage:   "collections whose records count: NSIDs, prefixes such as 'app.bsky.graph.*' or '*' for every one",
+			Value:   cli.NewStringSlice("app.bsky.feed.post"),
+			EnvVars: []string{"BURSTS_COLLECTIONS"},
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:    "analysis-max-age",
+			Usage:   "how long the " + firehose.AnalysisStream + " stream keeps reports, for the consumers delivering them",
+			Value:   24 * time.Hour,
+			EnvVars: []string{"ANALYSIS_MAX_AGE"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    "listen",
+			Usage:   "listen address of /topn, /sizes, /metrics, /healthz and /readyz; empty disables it",
+			Value:   ":8086",
+			EnvVars: []string{"LISTEN_ADDR"},
+		}),
+		altsrc.NewStringFlag(service.LogLevelFlag("info")),
+	}
+}
+
+// checkConfig checks the flags shared by run and validate.
+func checkConfig(cctx *cli.Context) error {
+	if cctx.Duration("window") < time.Second {
+		return errors.New("window must be at least 1s")
+	}
+	if top := cctx.Int("top"); top < 1 || top > 1000 {
+		return fmt.Errorf("top must be between 1 and 1000, got %d", top)
+	}
+	if group := cctx.String("group"); strings.ContainsAny(group, ".*> \t") {
+		return fmt.Errorf("group must not contain '.', '*', '>' or spaces, got %q", group)
+	}
+	if cctx.Float64("alert-threshold") < 0 {
+		return errors.New("alert-threshold must not be negative")
+	}
+	if cctx.Duration("alert-interval") < time.Second || cctx.Duration("alert-baseline") < cctx.Duration("alert-interval") {
+		return errors.New("alert-interval must be at least 1s, and alert-baseline at least alert-interval")
+	}
+	if raw := cctx.String("alert-webhook-url"); raw != "" {
+		if u, err := url.Parse(raw); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("alert-webhook-url must be an http:// or https:// URL, got %q", raw)
+		}
+	}
+	if d := cctx.Int("duplicates-distance"); d < 0 || d > MaxDuplicateDistance {
+		return fmt.Errorf("duplicates-distance must be between 0 and %d, got %d", MaxDuplicateDistance, d)
+	}
+	if cctx.Int("duplicates-cache") < 1 || cctx.Int("duplicates-min-words") < 1 || cctx.Int("duplicates-min-posts") < 2 || cctx.Int("duplicates-min-dids") < 1 {
+		return errors.New("duplicates-cache, duplicates-min-words and duplicates-min-dids must be at least 1, and duplicates-min-posts at least 2")
+	}
+	if cctx.Int("bursts-threshold") < 2 {
+		return errors.New("bursts-threshold must be at least 2")
+	}
+	if cctx.Duration("bursts-window") < 10*time.Second {
+		return errors.New("bursts-window must be at least 10s")
+	}
+	collections := cctx.StringSlice("bursts-collections")
+	if len(collections) == 0 {
+		return errors.New("bursts-collections must list at least one collection")
+	}
+	for _, c := range collections {
+		if c == "" || (c != "*" && strings.Contains(strings.TrimSuffix(c, ".*"), "*")) {
+			return fmt.Errorf("invalid bursts collection %q", c)
+		}
+	}
+	if cctx.Duration("analysis-max-age") < firehose.DefaultStreamOptions.DuplicateWindow {
+		return fmt.Errorf("analysis-max-age must be at least %s", firehose.DefaultStreamOptions.DuplicateWindow)
+	}
+	if cctx.Duration("rules-interval") < time.Second {
+		return errors.New("rules-interval must be at least 1s")
+	}
+	if file := cctx.String("rules"); file != "" {
+		if _, err := loadRules(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validate(cctx *cli.Context) error {
+	if err := checkConfig(cctx); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stdout, "configuration is valid (window %s, top %d)\n", cctx.Duration("window"), cctx.Int("top"))
+	if file := cctx.String("rules"); file != "" {
+		rf, _ := loadRules(file)
+		fmt.Fprintf(os.Stdout, "  %d rule(s), %d notifier(s) in %s\n", len(rf.Rules), len(rf.Notifiers), file)
+	}
+	return nil
+}
+
+func run(cctx *cli.Context) error {
+	if err := checkConfig(cctx); err != nil {
+		return err
+	}
+
+	rt := service.NewRuntime(cctx, "analyze", cctx.String("listen"))
+	logger := rt.Logger
+	service.WatchConfig(rt.Context(), cctx, "analyze", flags, logger, nil)
+
+	nc, err := nats.Connect(cctx.String("nats-url"))
+	if err != nil {
+		return fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+	rt.OnStop(func(context.Context) error {
+		nc.Close()
+		return nil
+	})
+	rt.ReadinessCheck("nats", service.NATSCheck(nc))
+
+	js, err := nc.JetStream()
+	if err != nil {
+		return fmt.Errorf("failed to create JetStream context: %w", err)
+	}
+
+	instance := cctx.String("instance-id")
+	if instance == "" {
+		instance, _ = os.Hostname()
+	}
+	group := cctx.String("group")
+	a := newAnalyzer(cctx.Int("top"), instance, group)
+	if cctx.Bool("duplicates") || cctx.Bool("bursts") {
+		stream := firehose.DefaultStreamOptions
+		stream.MaxAge = cctx.Duration("analysis-max-age")
+		if err := firehose.EnsureAnalysisStream(js, stream, logger); err != nil {
+			return err
+		}
+		a.publish = func(subject string, report any) {
+			b, err := json.Marshal(report)
+			if err != nil {
+				return
+			}
+			if _, err := js.Publish(subject, b, nats.AckWait(5*time.Second)); err != nil {
+				logger.Error("failed to publish analysis report", "subject", subject, "error", err)
+			}
+		}
+	}
+	if cctx.Bool("duplicates") {
+		a.duplicates = newDuplicateDetector(duplicateOptions{
+			cache:    cctx.Int("duplicates-cache"),
+			distance: cctx.Int("duplicates-distance"),
+			minWords: cctx.Int("duplicates-min-words"),
+			minPosts: int64(cctx.Int("duplicates-min-posts")),
+			minDIDs:  cctx.Int("duplicates-min-dids"),
+		}, instance, group)
+	}
+	if cctx.Bool("bursts") {
+		window := cctx.Duration("bursts-window")
+		a.bursts = newBurstDetector(burstOptions{
+			threshold:   int64(cctx.Int("bursts-threshold")),
+			window:      window,
+			collections: cctx.StringSlice("bursts-collections"),
+		}, instance, group, time.Now().UTC())
+		// Bursts end a tenth of a window after the rate falls
+		rt.Go(func(ctx context.Context) error {
+			ticker := time.NewTicker(window / 10)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return nil
+				case now := <-ticker.C:
+					for _, r := range a.bursts.sweep(now.UTC()) {
+						a.publish(BurstsSubject, r)
+					}
+				}
+			}
+		})
+	}
+
+	var sub *nats.Subscription
+	if group == "" {
+		// An ordered consumer is ephemeral: it keeps no state on the server
+		// and goes away with the analyzer
+		sub, err = js.Subscribe("atproto.firehose.>", a.observe, nats.OrderedConsumer(), nats.DeliverNew())
+	} else {
+		// The instances of a group take turns on the frames of one durable
+		// consumer; it is deleted an hour after the last one leaves
+		sub, err = js.QueueSubscribe("atproto.firehose.>", group, a.observe,
+			nats.Durable("analyze-"+group),
+			nats.DeliverNew(),
+			nats.InactiveThreshold(time.Hour),
+		)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to the stream (is ingest running?): %w", err)
+	}
+	rt.OnStop(func(context.Context) error {
+		return sub.Unsubscribe()
+	})
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		framesAnalyzed, undecodableFrames, frameSize,
+		throughputRate, throughputExpected, alertsFired, ruleAlerts,
+		duplicateClusters, duplicateFingerprints,
+		burstsStarted, burstingDIDs,
+	)
+	rt.Mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	rt.Mux.HandleFunc("GET /topn", a.serveWindow(func(r windowReports) any { return r.topN }))
+	rt.Mux.HandleFunc("GET /sizes", a.serveWindow(func(r windowReports) any { return r.sizes }))
+
+	window := cctx.Duration("window")
+	rt.Go(func(ctx context.Context) error {
+		ticker := time.NewTicker(window)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-ticker.C:
+			}
+			reports := a.rotate()
+			for subject, report := range map[string]any{TopNSubject: reports.topN, SizesSubject: reports.sizes} {
+				b, err := json.Marshal(report)
+				if err != nil {
+					return err
+				}
+				if err := nc.Publish(subject, b); err != nil {
+					logger.Error("failed to publish window report", "subject", subject, "error", err)
+				}
+			}
+			topN, sizes := reports.topN, reports.sizes
+			args := []any{"events", topN.Events, "bytes", sizes.Bytes, "p95_bytes", sizes.P95, "max_bytes", sizes.Max}
+			if len(topN.DIDs) > 0 {
+				args = append(args, "top_did", topN.DIDs[0].Key, "top_did_events", topN.DIDs[0].Count)
+			}
+			if len(topN.Collections) > 0 {
+				args = append(args, "top_collection", topN.Collections[0].Key, "top_collection_events", topN.Collections[0].Count)
+			}
+			logger.Info("window stats", args...)
+		}
+	})
+
+	if threshold := cctx.Float64("alert-threshold"); threshold > 0 {
+		interval := cctx.Duration("alert-interval")
+		detector := newThroughputDetector(interval, cctx.Duration("alert-baseline"), threshold)
+		alerts := &alerter{
+			nc:       nc,
+			url:      cctx.String("alert-webhook-url"),
+			client:   &http.Client{Timeout: 10 * time.Second},
+			logger:   logger,
+			instance: instance,
+			group:    group,
+		}
+		rt.Go(func(ctx context.Context) error {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			last := a.total.Load()
+			for {
+				select {
+				case <-ctx.Done():
+					return nil
+				case now := <-ticker.C:
+					total := a.total.Load()
+					rate := float64(total-last) / interval.Seconds()
+					last = total
+					if alert := detector.observe(rate, now); alert != nil {
+						alerts.fire(ctx, alert)
+					}
+				}
+			}
+		})
+	}
+
+	if file := cctx.String("rules"); file != "" {
+		rf, err := loadRules(file)
+		if err != nil {
+			return err
+		}
+		engine := newRuleEngine(rf, cctx.Duration("rules-interval"), nc, js, a.total.Load, instance, logger)
+		rt.Go(engine.run)
+		logger.Info("alerting rules loaded", "file", file, "rules", len(rf.Rules))
+	}
+
+	subjects := []string{TopNSubject, SizesSubject}
+	if a.duplicates != nil {
+		subjects = append(subjects, DuplicatesSubject)
+	}
+	if a.bursts != nil {
+		subjects = append(subjects, BurstsSubject)
+	}
+	logger.Info("analyzer started", "window", window, "top", cctx.Int("top"), "subjects", subjects, "instance", instance, "group", group)
+	return rt.Run(nil)
+}
+
+var (
+	framesAnalyzed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "analyze_frames_total",
+		Help: "Frames read from the stream by the analyzer",
+	})
+	undecodableFrames = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "analyze_undecodable_frames_total",
+		Help: "Frames the analyzer couldn't decode, counted in the window but not by DID or collection",
+	})
+)
+
+// analyzer keeps the heavy hitters and frame sizes of the current window and
+// the reports of the last one.
+type analyzer struct {
+	top      int
+	instance string
+	group    string
+	// total counts every frame, for the throughput alerts
+	total atomic.Int64
+
+	mu          sync.Mutex
+	start       time.Time
+	events      int64
+	dids        *heavyHitters
+	collections *heavyHitters
+	sizes       *sizeHistogram
+	last        *windowReports
+
+	// duplicates, when set, clusters the posts and bursts counts the
+	// records of the DIDs; publish sends their reports to the analysis
+	// stream
+	duplicates *duplicateDetector
+	bursts     *burstDetector
+	publish    func(subject string, report any)
+}
+
+// windowReports are the reports published at the end of a window.
+type windowReports struct {
+	topN  events.TopN
+	sizes events.FrameSizes
+}
+
+func newAnalyzer(top int, instance, group string) *analyzer {
+	a := &analyzer{top: top, instance: instance, group: group}
+	a.reset(time.Now())
+	return a
+}
+
+func (a *analyzer) reset(start time.Time) {
+	a.start = start
+	a.events = 0
+	a.dids = newHeavyHitters(a.top)
+	a.collections = newHeavyHitters(a.top)
+	a.sizes = newSizeHistogram()
+}
+
+func (a *analyzer) observe(msg *nats.Msg) {
+	framesAnalyzed.Inc()
+	a.total.Add(1)
+	info, err := firehose.InspectFrame(msg.Data)
+	if err != nil {
+		undecodableFrames.Inc()
+		info.Type = "undecodable"
+	} else {
+		now := time.Now().UTC()
+		if a.duplicates != nil {
+			for _, r := range a.duplicates.observe(info, msg.Data, now) {
+				duplicateClusters.Inc()
+				a.publish(DuplicatesSubject, r)
+			}
+		}
+		if a.bursts != nil {
+			if r, ok := a.bursts.observe(info, now); ok {
+				a.publish(BurstsSubject, r)
+			}
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.events++
+	a.sizes.add(info.Type, len(msg.Data))
+	if info.DID != "" {
+		a.dids.add(info.DID)
+	}
+	for _, c := range info.Collections {
+		a.collections.add(c)
+	}
+}
+
+// reports must be called with a.mu held.
+func (a *analyzer) reports(end time.Time) windowReports {
+	r := windowReports{
+		topN: events.TopN{
+			Start:       a.start,
+			End:         end,
+			Events:      a.events,
+			DIDs:        a.dids.entries(),
+			Collections: a.collections.entries(),
+			Instance:    a.instance,
+			Group:       a.group,
+		},
+		sizes: events.FrameSizes{Start: a.start, End: end, Instance: a.instance, Group: a.group},
+	}
+	a.sizes.report(&r.sizes)
+	return r
+}
+
+// rotate ends the current window and returns its reports.
+func (a *analyzer) rotate() windowReports {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	r := a.reports(now)
+	a.last = &r
+	a.reset(now)
+	return r
+}
+
+// serveWindow answers a report of the last window, or with ?window=current
+// of the one in progress.
+func (a *analyzer) serveWindow(report func(windowReports) any) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		a.mu.Lock()
+		var reports *windowReports
+		switch r.URL.Query().Get("window") {
+		case "", "last":
+			reports = a.last
+		case "current":
+			current := a.reports(time.Now())
+			reports = &current
+		default:
+			a.mu.Unlock()
+			http.Error(w, "window must be last or current", http.StatusBadRequest)
+			return
+		}
+		a.mu.Unlock()
+
+		if reports == nil {
+			http.Error(w, "no window has ended yet; try ?window=current", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report(*reports))
+	}
+}
@@ -0,0 +1,191 @@
+package analyze
+
+import (
+	"maps"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/pkg/events"
+	"github.com/eurosky/firehose-processor-aas/pkg/firehose"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// BurstsSubject is where a events.Burst is published, in the
+// ATPROTO_ANALYSIS stream, when a DID starts and stops creating records
+// faster than the threshold.
+var BurstsSubject = firehose.AnalysisSubject("bursts")
+
+var (
+	burstsStarted = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "analyze_bursts_total",
+		Help: "Bursts of DIDs creating records faster than --bursts-threshold",
+	})
+	burstingDIDs = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "analyze_bursting_dids",
+		Help: "DIDs whose burst hasn't ended",
+	})
+)
+
+// burstOptions tunes a burstDetector.
+type burstOptions struct {
+	// threshold is the records per window that make a burst
+	threshold int64
+	window    time.Duration
+	// collections are the collections whose records count: NSIDs, NSID
+	// prefixes ending in ".*" or "*" for every one
+	collections []string
+}
+
+// burstDetector counts the records each DID creates in fixed windows and
+// estimates its rate over the last window from the current and previous
+// ones, weighting the previous by how much of it the last window overlaps.
+// A DID's burst starts when the estimate reaches opts.threshold and ends
+// when it falls under half of it, so a rate hovering about the threshold
+// doesn't start one burst after another.
+type burstDetector struct {
+	opts     burstOptions
+	instance string
+	group    string
+
+	mu    sync.Mutex
+	start time.Time
+	// current and previous count the records of the DIDs by window
+	current  map[string]int64
+	previous map[string]int64
+	bursts   map[string]*events.Burst
+}
+
+func newBurstDetector(opts burstOptions, instance, group string, now time.Time) *burstDetector {
+	return &burstDetector{
+		opts:     opts,
+		instance: instance,
+		group:    group,
+		start:    now,
+		current:  make(map[string]int64),
+		previous: make(map[string]int64),
+		bursts:   make(map[string]*events.Burst),
+	}
+}
+
+// observe counts the records a frame creates and returns the report of the
+// DID's burst when it starts.
+func (d *burstDetector) observe(info firehose.FrameInfo, now time.Time) (events.Burst, bool) {
+	if info.DID == "" {
+		return events.Burst{}, false
+	}
+	var created map[string]int64
+	for i, path := range info.Paths {
+		collection, _, _ := strings.Cut(path, "/")
+		if info.Actions[i] != "create" || !d.counts(collection) {
+			continue
+		}
+		if created == nil {
+			created = make(map[string]int64)
+		}
+		created[collection]++
+	}
+	if created == nil {
+		return events.Burst{}, false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.rotate(now)
+	for _, n := range created {
+		d.current[info.DID] += n
+	}
+	rate := d.rate(info.DID, now)
+	b, bursting := d.bursts[info.DID]
+	if !bursting {
+		if rate < float64(d.opts.threshold) {
+			return events.Burst{}, false
+		}
+		b = &events.Burst{
+			DID:           info.DID,
+			Start:         now,
+			Collections:   make(map[string]int64),
+			Threshold:     d.opts.threshold,
+			WindowSeconds: int64(d.opts.window / time.Second),
+			Instance:      d.instance,
+			Group:         d.group,
+		}
+		d.bursts[info.DID] = b
+		burstsStarted.Inc()
+		burstingDIDs.Set(float64(len(d.bursts)))
+	}
+	for collection, n := range created {
+		b.Records += n
+		b.Collections[collection] += n
+	}
+	b.Rate, b.Peak = rate, max(b.Peak, rate)
+	if bursting {
+		return events.Burst{}, false
+	}
+	return d.report(b, events.BurstStarted, now), true
+}
+
+// sweep ends the bursts whose rate fell under half the threshold and
+// returns their reports. It runs on a ticker: the DIDs that stopped creating
+// records have no frame to end their bursts.
+func (d *burstDetector) sweep(now time.Time) []events.Burst {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.rotate(now)
+	var reports []events.Burst
+	for did, b := range d.bursts {
+		rate := d.rate(did, now)
+		if rate >= float64(d.opts.threshold)/2 {
+			continue
+		}
+		b.Rate = rate
+		reports = append(reports, d.report(b, events.BurstEnded, now))
+		delete(d.bursts, did)
+	}
+	burstingDIDs.Set(float64(len(d.bursts)))
+	return reports
+}
+
+// rotate starts a new window when the current one is over. It must be
+// called with d.mu held.
+func (d *burstDetector) rotate(now time.Time) {
+	if elapsed := now.Sub(d.start); elapsed >= d.opts.window {
+		// The windows follow each other, unless a whole one went by unseen
+		if elapsed >= 2*d.opts.window {
+			d.previous = make(map[string]int64)
+			d.start = now
+		} else {
+			d.previous = d.current
+			d.start = d.start.Add(d.opts.window)
+		}
+		d.current = make(map[string]int64, len(d.previous))
+	}
+}
+
+// rate estimates the records the DID created in the last window. It must be
+// called with d.mu held.
+func (d *burstDetector) rate(did string, now time.Time) float64 {
+	overlap := 1 - float64(now.Sub(d.start))/float64(d.opts.window)
+	return float64(d.current[did]) + max(overlap, 0)*float64(d.previous[did])
+}
+
+// report returns a copy of the burst with the status.
+func (d *burstDetector) report(b *events.Burst, status string, now time.Time) events.Burst {
+	r := *b
+	r.Status = status
+	r.Time = now
+	r.Collections = maps.Clone(b.Collections)
+	return r
+}
+
+func (d *burstDetector) counts(collection string) bool {
+	for _, pattern := range d.opts.collections {
+		if pattern == "*" || collection == pattern {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(pattern, ".*"); ok && strings.HasPrefix(collection, prefix+".") {
+			return true
+		}
+	}
+	return false
+}
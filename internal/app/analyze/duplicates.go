@@ -0,0 +1,280 @@
+package analyze
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"math/bits"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/eurosky/firehose-processor-aas/pkg/events"
+	"github.com/eurosky/firehose-processor-aas/pkg/firehose"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DuplicatesSubject is where a events.DuplicateCluster is published, in the
+// ATPROTO_ANALYSIS stream, when a cluster of near-duplicate posts gets large
+// enough and every time it doubles.
+var DuplicatesSubject = firehose.AnalysisSubject("duplicates")
+
+const (
+	// MaxDuplicateDistance is the most bits fingerprints may differ by:
+	// fingerprints are indexed by eight 8-bit blocks, and two within 7 bits
+	// of each other share one.
+	MaxDuplicateDistance = 7
+
+	clusterMaxDIDs    = 10000
+	clusterMaxSamples = 10
+	clusterTextLength = 300
+)
+
+var (
+	duplicateClusters = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "analyze_duplicate_clusters_total",
+		Help: "Reports of clusters of near-duplicate posts published, counting a cluster again every time it doubles",
+	})
+	duplicateFingerprints = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "analyze_duplicate_fingerprints",
+		Help: "Post fingerprints kept to match new posts against, at most --duplicates-cache",
+	})
+)
+
+// duplicateOptions tunes a duplicateDetector.
+type duplicateOptions struct {
+	// cache is how many fingerprints are kept
+	cache int
+	// distance is the most bits a post's fingerprint may differ by from one
+	// of a cluster's to join it
+	distance int
+	// minWords leaves out shorter posts, which are alike by chance
+	minWords int
+	// minPosts and minDIDs are what a cluster needs to be reported
+	minPosts int64
+	minDIDs  int
+}
+
+// duplicateDetector clusters posts by the simhash of their text's 3-grams,
+// which moves a bit or two for every word changed. A post
+// whose fingerprint is within opts.distance bits of a known one joins that
+// fingerprint's cluster; any other starts a cluster of its own. Only the
+// fingerprints starting clusters are kept, in an LRU of opts.cache that
+// the posts matching them refresh, so a cluster lives as long as it grows.
+type duplicateDetector struct {
+	opts     duplicateOptions
+	instance string
+	group    string
+
+	mu  sync.Mutex
+	lru *list.List
+	// index lists the fingerprints by the value of each of their 8-bit
+	// blocks
+	index [8]map[uint8][]*list.Element
+}
+
+// fingerprint is an element of the LRU.
+type fingerprint struct {
+	hash    uint64
+	cluster *duplicateCluster
+}
+
+type duplicateCluster struct {
+	report events.DuplicateCluster
+	dids   map[string]struct{}
+	// next is the size of the next report
+	next int64
+}
+
+func newDuplicateDetector(opts duplicateOptions, instance, group string) *duplicateDetector {
+	d := &duplicateDetector{opts: opts, instance: instance, group: group, lru: list.New()}
+	for i := range d.index {
+		d.index[i] = make(map[uint8][]*list.Element)
+	}
+	return d
+}
+
+// observe clusters the posts a frame creates and returns the reports of the
+// clusters they made large enough.
+func (d *duplicateDetector) observe(info firehose.FrameInfo, data []byte, now time.Time) []events.DuplicateCluster {
+	posts := false
+	for i, path := range info.Paths {
+		if strings.HasPrefix(path, "app.bsky.feed.post/") && info.Actions[i] == "create" {
+			posts = true
+		}
+	}
+	if !posts {
+		return nil
+	}
+	evt, err := firehose.DecodeFrame(data)
+	if err != nil {
+		return nil
+	}
+	var reports []events.DuplicateCluster
+	for _, op := range evt.Ops {
+		if op.Collection != "app.bsky.feed.post" || op.Action != "create" {
+			continue
+		}
+		var post struct {
+			Text string `json:"text"`
+		}
+		if json.Unmarshal(op.Record, &post) != nil {
+			continue
+		}
+		words := postWords(post.Text)
+		if len(words) < d.opts.minWords {
+			continue
+		}
+		uri := "at://" + evt.DID + "/" + op.Collection + "/" + op.Rkey
+		if r, ok := d.add(simhash(trigrams(words)), evt.DID, uri, post.Text, now); ok {
+			reports = append(reports, r)
+		}
+	}
+	return reports
+}
+
+// add counts a post in its cluster and returns the cluster's report when it
+// is due.
+func (d *duplicateDetector) add(hash uint64, did, uri, text string, now time.Time) (events.DuplicateCluster, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var c *duplicateCluster
+	if e := d.match(hash); e != nil {
+		d.lru.MoveToFront(e)
+		c = e.Value.(*fingerprint).cluster
+	} else {
+		if runes := []rune(text); len(runes) > clusterTextLength {
+			text = string(runes[:clusterTextLength])
+		}
+		c = &duplicateCluster{
+			report: events.DuplicateCluster{
+				ID:          fmt.Sprintf("%016x", hash),
+				FirstSeen:   now,
+				Text:        text,
+				MaxDistance: d.opts.distance,
+				Instance:    d.instance,
+				Group:       d.group,
+			},
+			dids: make(map[string]struct{}),
+			next: d.opts.minPosts,
+		}
+		d.insert(&fingerprint{hash: hash, cluster: c})
+	}
+
+	r := &c.report
+	r.Posts++
+	r.LastSeen = now
+	if len(r.Samples) < clusterMaxSamples {
+		r.Samples = append(r.Samples, uri)
+	}
+	if _, ok := c.dids[did]; !ok && len(c.dids) < clusterMaxDIDs {
+		c.dids[did] = struct{}{}
+		if len(r.SampleDIDs) < clusterMaxSamples {
+			r.SampleDIDs = append(r.SampleDIDs, did)
+		}
+	}
+	r.DIDs = len(c.dids)
+	if r.Posts < c.next || r.DIDs < d.opts.minDIDs {
+		return events.DuplicateCluster{}, false
+	}
+	c.next = 2 * r.Posts
+	report := *r
+	report.Samples = append([]string(nil), r.Samples...)
+	report.SampleDIDs = append([]string(nil), r.SampleDIDs...)
+	return report, true
+}
+
+// match returns the closest fingerprint within opts.distance bits of hash,
+// or nil.
+func (d *duplicateDetector) match(hash uint64) *list.Element {
+	var best *list.Element
+	bestDistance := d.opts.distance + 1
+	for i := range d.index {
+		for _, e := range d.index[i][block(hash, i)] {
+			if distance := bits.OnesCount64(hash ^ e.Value.(*fingerprint).hash); distance < bestDistance {
+				best, bestDistance = e, distance
+			}
+		}
+	}
+	return best
+}
+
+// insert adds f to the LRU and the index, forgetting the least recently
+// matched fingerprint past opts.cache.
+func (d *duplicateDetector) insert(f *fingerprint) {
+	e := d.lru.PushFront(f)
+	for i := range d.index {
+		b := block(f.hash, i)
+		d.index[i][b] = append(d.index[i][b], e)
+	}
+	if d.lru.Len() > d.opts.cache {
+		oldest := d.lru.Back()
+		d.lru.Remove(oldest)
+		hash := oldest.Value.(*fingerprint).hash
+		for i := range d.index {
+			b := block(hash, i)
+			bucket := d.index[i][b]
+			for j, other := range bucket {
+				if other == oldest {
+					bucket = append(bucket[:j], bucket[j+1:]...)
+					break
+				}
+			}
+			if len(bucket) == 0 {
+				delete(d.index[i], b)
+			} else {
+				d.index[i][b] = bucket
+			}
+		}
+	}
+	duplicateFingerprints.Set(float64(d.lru.Len()))
+}
+
+func block(hash uint64, i int) uint8 {
+	return uint8(hash >> (8 * i))
+}
+
+// postWords splits a post's text into lowercase words.
+func postWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// trigrams returns the runs of three characters of the words, joined by
+// spaces.
+func trigrams(words []string) []string {
+	text := []rune(strings.Join(words, " "))
+	grams := make([]string, 0, max(len(text)-2, 0))
+	for i := 0; i+3 <= len(text); i++ {
+		grams = append(grams, string(text[i:i+3]))
+	}
+	return grams
+}
+
+// simhash fingerprints features so that texts sharing most of theirs get
+// fingerprints differing by few bits: every bit is the majority vote of the
+// features' hashes.
+func simhash(features []string) uint64 {
+	var votes [64]int
+	for _, f := range features {
+		h := xxhash.Sum64String(f)
+		for i := range votes {
+			if h&(1<<i) != 0 {
+				votes[i]++
+			} else {
+				votes[i]--
+			}
+		}
+	}
+	var hash uint64
+	for i, v := range votes {
+		if v > 0 {
+			hash |= 1 << i
+		}
+	}
+	return hash
+}
@@ -0,0 +1,140 @@
+package analyze
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/pkg/events"
+	"github.com/nats-io/nats.go"
+)
+
+// notifierConfig is a notifier of the --rules file: exactly one of a
+// webhook URL, an SMTP server or a NATS subject.
+type notifierConfig struct {
+	Name    string      `yaml:"name"`
+	Webhook string      `yaml:"webhook"`
+	SMTP    *smtpConfig `yaml:"smtp"`
+	NATS    string      `yaml:"nats"`
+}
+
+type smtpConfig struct {
+	// Addr is host:port; the connection is upgraded with STARTTLS when the
+	// server offers it
+	Addr     string   `yaml:"addr"`
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password"`
+	From     string   `yaml:"from"`
+	To       []string `yaml:"to"`
+}
+
+func (c *notifierConfig) check() error {
+	if c.Name == "" {
+		return errors.New("every notifier needs a name")
+	}
+	set := 0
+	for _, ok := range []bool{c.Webhook != "", c.SMTP != nil, c.NATS != ""} {
+		if ok {
+			set++
+		}
+	}
+	if set != 1 {
+		return fmt.Errorf("notifier %s: set one of webhook, smtp or nats", c.Name)
+	}
+	if c.Webhook != "" && !strings.HasPrefix(c.Webhook, "http://") && !strings.HasPrefix(c.Webhook, "https://") {
+		return fmt.Errorf("notifier %s: webhook must be an http:// or https:// URL", c.Name)
+	}
+	if c.SMTP != nil {
+		if _, _, err := net.SplitHostPort(c.SMTP.Addr); err != nil {
+			return fmt.Errorf("notifier %s: smtp addr must be host:port", c.Name)
+		}
+		if c.SMTP.From == "" || len(c.SMTP.To) == 0 {
+			return fmt.Errorf("notifier %s: smtp needs from and to", c.Name)
+		}
+	}
+	if strings.ContainsAny(c.NATS, "*> \t") {
+		return fmt.Errorf("notifier %s: nats must be a subject without wildcards", c.Name)
+	}
+	return nil
+}
+
+// notifier sends a rule alert; body is the alert as JSON.
+type notifier interface {
+	notify(ctx context.Context, alert events.RuleAlert, body []byte) error
+}
+
+func (c *notifierConfig) notifier(nc *nats.Conn) notifier {
+	switch {
+	case c.Webhook != "":
+		return webhookNotifier{url: c.Webhook, client: &http.Client{Timeout: 10 * time.Second}}
+	case c.SMTP != nil:
+		return smtpNotifier{c.SMTP}
+	default:
+		return natsNotifier{nc: nc, subject: c.NATS}
+	}
+}
+
+// webhookNotifier POSTs the alert as JSON, which Slack incoming webhooks
+// show by its text.
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (n webhookNotifier) notify(ctx context.Context, _ events.RuleAlert, body []byte) error {
+	return postJSON(ctx, n.client, n.url, body)
+}
+
+func postJSON(ctx context.Context, client *http.Client, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+type natsNotifier struct {
+	nc      *nats.Conn
+	subject string
+}
+
+func (n natsNotifier) notify(_ context.Context, _ events.RuleAlert, body []byte) error {
+	return n.nc.Publish(n.subject, body)
+}
+
+// smtpNotifier mails the alert's text, with the JSON below it.
+type smtpNotifier struct {
+	*smtpConfig
+}
+
+func (n smtpNotifier) notify(_ context.Context, alert events.RuleAlert, body []byte) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", n.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(n.To, ", "))
+	fmt.Fprintf(&msg, "Subject: [fpaas] %s %s\r\n", alert.Rule, alert.Status)
+	fmt.Fprintf(&msg, "Date: %s\r\n", alert.Time.Format(time.RFC1123Z))
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "%s\r\n\r\n%s\r\n", alert.Text, body)
+
+	var auth smtp.Auth
+	if n.Username != "" {
+		host, _, _ := net.SplitHostPort(n.Addr)
+		auth = smtp.PlainAuth("", n.Username, n.Password, host)
+	}
+	return smtp.SendMail(n.Addr, auth, n.From, n.To, msg.Bytes())
+}
@@ -0,0 +1,449 @@
+package analyze
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/pkg/consumer"
+	"github.com/eurosky/firehose-processor-aas/pkg/events"
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v3"
+)
+
+// RuleAlertSubject is where every events.RuleAlert is published, besides
+// the notifiers of its rule.
+const RuleAlertSubject = "atproto.alerts.rules"
+
+// Metrics the rules can check.
+const (
+	// metricConsumerPending is the messages of the stream a consumer
+	// hasn't delivered yet
+	metricConsumerPending = "consumer_pending"
+	// metricConsumerAckPending is the messages delivered but not acked yet
+	metricConsumerAckPending = "consumer_ack_pending"
+	// metricDeliveryFailures is the failed delivery attempts over the
+	// rule's "over", from the delivery log
+	metricDeliveryFailures = "delivery_failures"
+	// metricDeliveryFailureRatio is the share of failed delivery attempts
+	// over the rule's "over"
+	metricDeliveryFailureRatio = "delivery_failure_ratio"
+	// metricStreamRate is the frames per second read by the analyzer
+	metricStreamRate = "stream_frames_per_second"
+)
+
+// defaultOver is the window of the delivery metrics of rules without "over".
+const defaultOver = 5 * time.Minute
+
+var ruleAlerts = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "analyze_rule_alerts_total",
+	Help: "Notifications of the --rules alerting rules, by rule and status (firing, resolved)",
+}, []string{"rule", "status"})
+
+// rulesFile is the YAML file of --rules. ${VAR} references are replaced by
+// environment variables, to keep secrets such as SMTP passwords out of it.
+type rulesFile struct {
+	Rules     []rule           `yaml:"rules"`
+	Notifiers []notifierConfig `yaml:"notifiers"`
+}
+
+// rule fires when its metric stays above or below a value for a while: once
+// per consumer for consumer and delivery metrics.
+type rule struct {
+	Name   string `yaml:"name"`
+	Metric string `yaml:"metric"`
+	// Consumer is a glob of the consumers checked; all of them when empty
+	Consumer string        `yaml:"consumer"`
+	Above    *float64      `yaml:"above"`
+	Below    *float64      `yaml:"below"`
+	For      time.Duration `yaml:"for"`
+	Over     time.Duration `yaml:"over"`
+	Notify   []string      `yaml:"notify"`
+}
+
+func (r *rule) check(notifiers []notifierConfig) error {
+	if r.Name == "" {
+		return errors.New("every rule needs a name")
+	}
+	switch r.Metric {
+	case metricConsumerPending, metricConsumerAckPending:
+	case metricDeliveryFailures, metricDeliveryFailureRatio:
+		if r.Over == 0 {
+			r.Over = defaultOver
+		}
+	case metricStreamRate:
+		if r.Consumer != "" {
+			return fmt.Errorf("rule %s: %s is not by consumer", r.Name, r.Metric)
+		}
+	default:
+		return fmt.Errorf("rule %s: unknown metric %q", r.Name, r.Metric)
+	}
+	if _, err := path.Match(r.Consumer, ""); err != nil {
+		return fmt.Errorf("rule %s: invalid consumer pattern %q", r.Name, r.Consumer)
+	}
+	if (r.Above == nil) == (r.Below == nil) {
+		return fmt.Errorf("rule %s: set either above or below", r.Name)
+	}
+	if r.For < 0 || r.Over < 0 {
+		return fmt.Errorf("rule %s: for and over must not be negative", r.Name)
+	}
+	if r.Over > 0 && r.Metric != metricDeliveryFailures && r.Metric != metricDeliveryFailureRatio {
+		return fmt.Errorf("rule %s: over only applies to the delivery metrics", r.Name)
+	}
+	for _, name := range r.Notify {
+		if !slices.ContainsFunc(notifiers, func(n notifierConfig) bool { return n.Name == name }) {
+			return fmt.Errorf("rule %s: unknown notifier %q", r.Name, name)
+		}
+	}
+	return nil
+}
+
+func (r *rule) holds(v float64) bool {
+	if r.Above != nil {
+		return v > *r.Above
+	}
+	return v < *r.Below
+}
+
+func (r *rule) condition() string {
+	var c string
+	if r.Above != nil {
+		c = "> " + formatValue(*r.Above)
+	} else {
+		c = "< " + formatValue(*r.Below)
+	}
+	if r.For > 0 {
+		c += " for " + r.For.String()
+	}
+	return c
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// loadRules reads and checks a --rules file.
+func loadRules(file string) (*rulesFile, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rules: %w", err)
+	}
+	var rf rulesFile
+	if err := yaml.Unmarshal([]byte(os.ExpandEnv(string(data))), &rf); err != nil {
+		return nil, fmt.Errorf("failed to parse rules %s: %w", file, err)
+	}
+	if len(rf.Rules) == 0 {
+		return nil, fmt.Errorf("no rules in %s", file)
+	}
+	for i := range rf.Notifiers {
+		if err := rf.Notifiers[i].check(); err != nil {
+			return nil, err
+		}
+	}
+	for i := range rf.Rules {
+		if err := rf.Rules[i].check(rf.Notifiers); err != nil {
+			return nil, err
+		}
+	}
+	return &rf, nil
+}
+
+// ruleState is a rule's condition holding for one consumer.
+type ruleState struct {
+	since  time.Time
+	firing bool
+	value  float64
+	seen   bool
+}
+
+type stateKey struct {
+	rule     int
+	consumer string
+}
+
+// ruleEngine evaluates the rules every interval.
+type ruleEngine struct {
+	rules      []rule
+	notifiers  map[string]notifier
+	interval   time.Duration
+	js         nats.JetStreamContext
+	nc         *nats.Conn
+	frames     func() int64
+	deliveries *deliveryTracker
+	instance   string
+	logger     *slog.Logger
+
+	states     map[stateKey]*ruleState
+	lastFrames int64
+	lastTime   time.Time
+}
+
+func newRuleEngine(rf *rulesFile, interval time.Duration, nc *nats.Conn, js nats.JetStreamContext, frames func() int64, instance string, logger *slog.Logger) *ruleEngine {
+	e := &ruleEngine{
+		rules:     rf.Rules,
+		notifiers: make(map[string]notifier, len(rf.Notifiers)),
+		interval:  interval,
+		js:        js,
+		nc:        nc,
+		frames:    frames,
+		instance:  instance,
+		logger:    logger,
+		states:    make(map[stateKey]*ruleState),
+	}
+	for _, n := range rf.Notifiers {
+		e.notifiers[n.Name] = n.notifier(nc)
+	}
+	var over time.Duration
+	for _, r := range rf.Rules {
+		over = max(over, r.Over)
+	}
+	if over > 0 {
+		e.deliveries = newDeliveryTracker(interval, over)
+	}
+	return e
+}
+
+// run evaluates the rules until ctx is done.
+func (e *ruleEngine) run(ctx context.Context) error {
+	if e.deliveries != nil {
+		sub, err := e.nc.Subscribe(consumer.DeliveryLogSubjectPrefix+">", e.deliveries.record)
+		if err != nil {
+			return fmt.Errorf("failed to subscribe to the delivery log: %w", err)
+		}
+		defer sub.Unsubscribe()
+	}
+	e.lastFrames, e.lastTime = e.frames(), time.Now()
+
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-ticker.C:
+			e.evaluate(ctx, now)
+		}
+	}
+}
+
+func (e *ruleEngine) evaluate(ctx context.Context, now time.Time) {
+	samples := e.collect(now)
+	for i := range e.rules {
+		r := &e.rules[i]
+		values, ok := samples[r.Metric]
+		if !ok {
+			if r.Metric == metricDeliveryFailures || r.Metric == metricDeliveryFailureRatio {
+				values = e.deliveries.window(r.Over, r.Metric == metricDeliveryFailureRatio)
+			} else {
+				// Not collected this time; keep the states as they are
+				continue
+			}
+		}
+		for name, v := range values {
+			if match, _ := path.Match(r.Consumer, name); r.Consumer != "" && !match {
+				continue
+			}
+			key := stateKey{rule: i, consumer: name}
+			st := e.states[key]
+			if !r.holds(v) {
+				continue
+			}
+			if st == nil {
+				st = &ruleState{since: now}
+				e.states[key] = st
+			}
+			st.value, st.seen = v, true
+			if !st.firing && now.Sub(st.since) >= r.For {
+				st.firing = true
+				e.notify(ctx, r, events.RuleFiring, name, v, now)
+			}
+		}
+		// Resolve the consumers the condition no longer holds for, or
+		// that are gone
+		for key, st := range e.states {
+			if key.rule != i {
+				continue
+			}
+			if st.seen {
+				st.seen = false
+				continue
+			}
+			if st.firing {
+				v := st.value
+				if current, ok := values[key.consumer]; ok {
+					v = current
+				}
+				e.notify(ctx, r, events.RuleResolved, key.consumer, v, now)
+			}
+			delete(e.states, key)
+		}
+	}
+}
+
+// collect samples the consumer and stream metrics the rules use.
+func (e *ruleEngine) collect(now time.Time) map[string]map[string]float64 {
+	samples := make(map[string]map[string]float64)
+	uses := func(metric string) bool {
+		return slices.ContainsFunc(e.rules, func(r rule) bool { return r.Metric == metric })
+	}
+
+	if uses(metricConsumerPending) || uses(metricConsumerAckPending) {
+		if pending, ackPending, err := e.consumerState(); err != nil {
+			e.logger.Warn("failed to read the consumers for the rules", "error", err)
+		} else {
+			samples[metricConsumerPending] = pending
+			samples[metricConsumerAckPending] = ackPending
+		}
+	}
+	if e.deliveries != nil {
+		e.deliveries.rotate()
+	}
+
+	frames := e.frames()
+	if elapsed := now.Sub(e.lastTime).Seconds(); elapsed > 0 {
+		// Stream metrics have a single series, named ""
+		samples[metricStreamRate] = map[string]float64{"": float64(frames-e.lastFrames) / elapsed}
+	}
+	e.lastFrames, e.lastTime = frames, now
+	return samples
+}
+
+func (e *ruleEngine) consumerState() (pending, ackPending map[string]float64, err error) {
+	stream, err := e.js.StreamNameBySubject("atproto.firehose.>")
+	if err != nil {
+		return nil, nil, err
+	}
+	pending, ackPending = make(map[string]float64), make(map[string]float64)
+	for ci := range e.js.ConsumersInfo(stream) {
+		pending[ci.Name] = float64(ci.NumPending)
+		ackPending[ci.Name] = float64(ci.NumAckPending)
+	}
+	return pending, ackPending, nil
+}
+
+func (e *ruleEngine) notify(ctx context.Context, r *rule, status, consumerName string, value float64, now time.Time) {
+	alert := events.RuleAlert{
+		Time:      now,
+		Rule:      r.Name,
+		Status:    status,
+		Metric:    r.Metric,
+		Consumer:  consumerName,
+		Value:     value,
+		Condition: r.condition(),
+		Instance:  e.instance,
+	}
+	subject := r.Metric
+	if consumerName != "" {
+		subject = fmt.Sprintf("%s of %s", r.Metric, consumerName)
+	}
+	alert.Text = fmt.Sprintf("%s %s: %s is %s (%s)", r.Name, status, subject, formatValue(value), alert.Condition)
+
+	ruleAlerts.WithLabelValues(r.Name, status).Inc()
+	e.logger.Warn("rule "+status, "rule", r.Name, "metric", r.Metric, "consumer", consumerName, "value", value, "condition", alert.Condition)
+
+	b, err := json.Marshal(alert)
+	if err != nil {
+		e.logger.Error("failed to encode rule alert", "error", err)
+		return
+	}
+	if err := e.nc.Publish(RuleAlertSubject, b); err != nil {
+		e.logger.Error("failed to publish rule alert", "error", err)
+	}
+	for _, name := range r.Notify {
+		n := e.notifiers[name]
+		// A slow notifier must not hold up the evaluation
+		go func() {
+			if err := n.notify(ctx, alert, b); err != nil {
+				e.logger.Error("failed to notify", "notifier", name, "rule", r.Name, "error", err)
+			}
+		}()
+	}
+}
+
+// deliveryTracker counts the delivery attempts of the delivery log by
+// consumer, in one bucket per evaluation interval.
+type deliveryTracker struct {
+	interval time.Duration
+
+	mu      sync.Mutex
+	current map[string]deliveryCount
+	history []map[string]deliveryCount
+	keep    int
+}
+
+type deliveryCount struct {
+	attempts, failed int
+}
+
+// newDeliveryTracker keeps the buckets of the longest over of the rules.
+func newDeliveryTracker(interval, over time.Duration) *deliveryTracker {
+	t := &deliveryTracker{interval: interval, current: make(map[string]deliveryCount)}
+	t.keep = t.buckets(over)
+	return t
+}
+
+// buckets is how many intervals cover over.
+func (t *deliveryTracker) buckets(over time.Duration) int {
+	return max(1, int((over+t.interval-1)/t.interval))
+}
+
+func (t *deliveryTracker) record(msg *nats.Msg) {
+	var rec events.DeliveryRecord
+	if json.Unmarshal(msg.Data, &rec) != nil || rec.Consumer == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c := t.current[rec.Consumer]
+	c.attempts++
+	if rec.Status == events.DeliveryFailed {
+		c.failed++
+	}
+	t.current[rec.Consumer] = c
+}
+
+// rotate closes the current bucket.
+func (t *deliveryTracker) rotate() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.history = append(t.history, t.current)
+	if len(t.history) > t.keep {
+		t.history = t.history[len(t.history)-t.keep:]
+	}
+	t.current = make(map[string]deliveryCount)
+}
+
+// window returns the failures, or their share of the attempts, of the
+// buckets covering over, by consumer. Consumers without attempts have none.
+func (t *deliveryTracker) window(over time.Duration, ratio bool) map[string]float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := min(len(t.history), t.buckets(over))
+	sums := make(map[string]deliveryCount)
+	for _, bucket := range t.history[len(t.history)-n:] {
+		for name, c := range bucket {
+			s := sums[name]
+			s.attempts += c.attempts
+			s.failed += c.failed
+			sums[name] = s
+		}
+	}
+	values := make(map[string]float64, len(sums))
+	for name, s := range sums {
+		if ratio {
+			values[name] = float64(s.failed) / float64(s.attempts)
+		} else {
+			values[name] = float64(s.failed)
+		}
+	}
+	return values
+}
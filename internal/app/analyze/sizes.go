@@ -0,0 +1,88 @@
+package analyze
+
+import (
+	"github.com/eurosky/firehose-processor-aas/pkg/events"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// SizesSubject is where a events.FrameSizes is published at the end of every
+// window.
+const SizesSubject = "atproto.stats.sizes"
+
+// sizeBounds are the upper bounds of the size buckets, 256B to 2MB, which
+// covers the NATS default max payload of 1MB.
+var sizeBounds = prometheus.ExponentialBuckets(256, 2, 14)
+
+var frameSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "analyze_frame_size_bytes",
+	Help:    "Size of the frames read from the stream, by frame type",
+	Buckets: sizeBounds,
+}, []string{"type"})
+
+// sizeHistogram is the size distribution of the frames of a window.
+type sizeHistogram struct {
+	counts []int64 // one per bound, then the frames above them all
+	total  events.SizeSummary
+	types  map[string]*events.SizeSummary
+}
+
+func newSizeHistogram() *sizeHistogram {
+	return &sizeHistogram{
+		counts: make([]int64, len(sizeBounds)+1),
+		types:  make(map[string]*events.SizeSummary),
+	}
+}
+
+func (h *sizeHistogram) add(frameType string, size int) {
+	frameSize.WithLabelValues(frameType).Observe(float64(size))
+	i := 0
+	for i < len(sizeBounds) && float64(size) > sizeBounds[i] {
+		i++
+	}
+	h.counts[i]++
+
+	t, ok := h.types[frameType]
+	if !ok {
+		t = &events.SizeSummary{}
+		h.types[frameType] = t
+	}
+	for _, s := range []*events.SizeSummary{&h.total, t} {
+		s.Frames++
+		s.Bytes += int64(size)
+		s.Max = max(s.Max, int64(size))
+	}
+}
+
+// report fills in the sizes of r, all but its window.
+func (h *sizeHistogram) report(r *events.FrameSizes) {
+	r.Frames, r.Bytes, r.Max = h.total.Frames, h.total.Bytes, h.total.Max
+	r.P50, r.P95, r.P99 = h.quantile(0.5), h.quantile(0.95), h.quantile(0.99)
+	r.Buckets = make([]events.SizeBucket, len(h.counts))
+	for i, c := range h.counts {
+		r.Buckets[i].Count = c
+		if i < len(sizeBounds) {
+			r.Buckets[i].LE = int64(sizeBounds[i])
+		}
+	}
+	r.Types = make(map[string]events.SizeSummary, len(h.types))
+	for t, s := range h.types {
+		r.Types[t] = *s
+	}
+}
+
+// quantile returns the bound of the bucket holding the q quantile, or the
+// largest frame when it's in the last bucket or below that bound.
+func (h *sizeHistogram) quantile(q float64) int64 {
+	if h.total.Frames == 0 {
+		return 0
+	}
+	rank := int64(q * float64(h.total.Frames))
+	var seen int64
+	for i, c := range h.counts {
+		seen += c
+		if seen > rank && i < len(sizeBounds) {
+			return min(int64(sizeBounds[i]), h.total.Max)
+		}
+	}
+	return h.total.Max
+}
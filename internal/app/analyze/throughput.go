@@ -0,0 +1,150 @@
+package analyze
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/pkg/events"
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// AlertSubject is where a events.Alert is published when the throughput
+// stalls, spikes or recovers.
+const AlertSubject = "atproto.alerts"
+
+// alertWarmup is how many intervals the detector learns before alerting.
+const alertWarmup = 6
+
+var (
+	throughputRate = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "analyze_throughput_frames_per_second",
+		Help: "Frames per second over the last --alert-interval",
+	})
+	throughputExpected = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "analyze_throughput_expected_frames_per_second",
+		Help: "Frames per second expected from the moving average over --alert-baseline",
+	})
+	alertsFired = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "analyze_alerts_total",
+		Help: "Throughput alerts fired, by kind (stalled, spike, recovered)",
+	}, []string{"kind"})
+)
+
+// throughputDetector keeps an exponentially weighted moving average and
+// standard deviation of the frame rate, and alerts once when the rate drops
+// to zero or spikes beyond threshold standard deviations, then once more
+// when it is back to normal.
+type throughputDetector struct {
+	alpha     float64
+	threshold float64
+	interval  time.Duration
+
+	samples  int
+	mean     float64
+	variance float64
+	// state is the alert in progress, stalled or spike, or empty
+	state string
+}
+
+func newThroughputDetector(interval, baseline time.Duration, threshold float64) *throughputDetector {
+	return &throughputDetector{
+		alpha:     min(1, interval.Seconds()/baseline.Seconds()),
+		threshold: threshold,
+		interval:  interval,
+	}
+}
+
+// observe takes the rate of the last interval and returns the alert it
+// fires, if any.
+func (d *throughputDetector) observe(rate float64, now time.Time) *events.Alert {
+	d.samples++
+	throughputRate.Set(rate)
+	throughputExpected.Set(d.mean)
+	if d.samples <= alertWarmup {
+		d.learn(rate)
+		return nil
+	}
+
+	// Random arrivals alone vary by about the square root of the count,
+	// which keeps a very steady stream from alerting on noise
+	stddev := max(math.Sqrt(d.variance), math.Sqrt(d.mean/d.interval.Seconds()))
+	kind := ""
+	switch {
+	case rate == 0 && d.mean*d.interval.Seconds() >= 1:
+		kind = events.AlertStalled
+	case rate > d.mean+d.threshold*stddev:
+		kind = events.AlertSpike
+	}
+
+	alert := &events.Alert{Time: now, Rate: rate, Expected: d.mean, StdDev: stddev}
+	switch {
+	case kind == d.state:
+		alert = nil
+	case kind == "":
+		alert.Kind = events.AlertRecovered
+		alert.Text = fmt.Sprintf("firehose throughput recovered: %.1f frames/s, expected %.1f", rate, d.mean)
+	case kind == events.AlertStalled:
+		alert.Kind = kind
+		alert.Text = fmt.Sprintf("firehose stalled: no frames for %s, expected %.1f frames/s", d.interval, d.mean)
+	default:
+		alert.Kind = kind
+		alert.Text = fmt.Sprintf("firehose throughput spike: %.1f frames/s, expected %.1f±%.1f", rate, d.mean, stddev)
+	}
+	d.state = kind
+
+	// Anomalies would drag the baseline along, and hide how long they last
+	if kind == "" {
+		d.learn(rate)
+	}
+	return alert
+}
+
+func (d *throughputDetector) learn(rate float64) {
+	// A plain average until there are enough samples for the moving one
+	alpha := max(d.alpha, 1/float64(d.samples))
+	delta := rate - d.mean
+	d.mean += alpha * delta
+	d.variance = (1 - alpha) * (d.variance + alpha*delta*delta)
+}
+
+// alerter publishes alerts on AlertSubject and, when url is set, posts them
+// to a webhook such as a Slack incoming webhook.
+type alerter struct {
+	nc     *nats.Conn
+	url    string
+	client *http.Client
+	logger *slog.Logger
+	// instance and group label the alerts
+	instance string
+	group    string
+}
+
+func (a *alerter) fire(ctx context.Context, alert *events.Alert) {
+	alert.Instance, alert.Group = a.instance, a.group
+	alertsFired.WithLabelValues(alert.Kind).Inc()
+	a.logger.Warn("throughput alert", "kind", alert.Kind, "rate", alert.Rate, "expected", alert.Expected, "stddev", alert.StdDev)
+
+	b, err := json.Marshal(alert)
+	if err != nil {
+		a.logger.Error("failed to encode alert", "error", err)
+		return
+	}
+	if err := a.nc.Publish(AlertSubject, b); err != nil {
+		a.logger.Error("failed to publish alert", "error", err)
+	}
+	if a.url == "" {
+		return
+	}
+	// The webhook must not hold up the next samples
+	go func() {
+		if err := postJSON(ctx, a.client, a.url, b); err != nil {
+			a.logger.Error("failed to post alert", "url", a.url, "error", err)
+		}
+	}()
+}
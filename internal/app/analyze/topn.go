@@ -0,0 +1,111 @@
+package analyze
+
+import (
+	"cmp"
+	"container/heap"
+	"hash/maphash"
+	"slices"
+	"strings"
+
+	"github.com/eurosky/firehose-processor-aas/pkg/events"
+)
+
+// Count-min sketch dimensions: estimates overcount by at most e/sketchWidth
+// (about 0.13%) of the window's frames, with probability 1-e^-sketchDepth.
+const (
+	sketchWidth = 2048
+	sketchDepth = 4
+)
+
+// heavyHitters finds the most frequent keys of a window in bounded memory: a
+// count-min sketch estimates every key's count, and a min-heap keeps the k
+// keys with the highest estimates.
+type heavyHitters struct {
+	seeds  [sketchDepth]maphash.Seed
+	counts [sketchDepth][sketchWidth]uint64
+	top    topHeap
+	index  map[string]*topItem
+	k      int
+}
+
+func newHeavyHitters(k int) *heavyHitters {
+	h := &heavyHitters{index: make(map[string]*topItem, k), k: k}
+	for i := range h.seeds {
+		h.seeds[i] = maphash.MakeSeed()
+	}
+	return h
+}
+
+// add counts one occurrence of key.
+func (h *heavyHitters) add(key string) {
+	estimate := ^uint64(0)
+	for i := range h.seeds {
+		c := &h.counts[i][maphash.String(h.seeds[i], key)%sketchWidth]
+		*c++
+		estimate = min(estimate, *c)
+	}
+
+	if item, ok := h.index[key]; ok {
+		item.count = estimate
+		heap.Fix(&h.top, item.pos)
+		return
+	}
+	if len(h.top) < h.k {
+		item := &topItem{key: key, count: estimate}
+		h.index[key] = item
+		heap.Push(&h.top, item)
+		return
+	}
+	// Evict the least frequent key once another one overtakes it
+	if least := h.top[0]; estimate > least.count {
+		delete(h.index, least.key)
+		least.key, least.count = key, estimate
+		h.index[key] = least
+		heap.Fix(&h.top, 0)
+	}
+}
+
+// entries returns the top keys, most frequent first.
+func (h *heavyHitters) entries() []events.TopEntry {
+	entries := make([]events.TopEntry, 0, len(h.top))
+	for _, item := range h.top {
+		entries = append(entries, events.TopEntry{Key: item.key, Count: item.count})
+	}
+	slices.SortFunc(entries, func(a, b events.TopEntry) int {
+		if c := cmp.Compare(b.Count, a.Count); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Key, b.Key)
+	})
+	return entries
+}
+
+type topItem struct {
+	key   string
+	count uint64
+	pos   int
+}
+
+// topHeap is a min-heap of counts, for container/heap.
+type topHeap []*topItem
+
+func (h topHeap) Len() int           { return len(h) }
+func (h topHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+
+func (h topHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].pos, h[j].pos = i, j
+}
+
+func (h *topHeap) Push(x any) {
+	item := x.(*topItem)
+	item.pos = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *topHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
@@ -0,0 +1,191 @@
+package consume
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/internal/app/receive"
+	"github.com/eurosky/firehose-processor-aas/internal/pkg/controlplane"
+	"github.com/eurosky/firehose-processor-aas/internal/pkg/service"
+	"github.com/eurosky/firehose-processor-aas/pkg/consumer"
+	"github.com/nats-io/nats.go"
+	"github.com/urfave/cli/v2"
+)
+
+func auditCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "audit",
+		Usage: "check that every event of a stream range was delivered at least once, against the delivery log and a receiver",
+		Description: "Reads the stream range, keeps the events each consumer's filters deliver, and looks them up in the\n" +
+			"successful attempts of the delivery log (consumers run with --delivery-log) and, with --receiver-store or\n" +
+			"--receiver-url, in the calls kept by fpaas receive --store. Every run of missing events is reported with\n" +
+			"its stream and firehose sequences, ready for --redeliver. Exits with an error when events are missing.",
+		Flags: append(consumerFlags(),
+			&cli.Uint64Flag{
+				Name:  "from",
+				Usage: "first stream seq to check (default: the stream's first)",
+			},
+			&cli.Uint64Flag{
+				Name:  "to",
+				Usage: "last stream seq to check (default: each consumer's ack floor)",
+			},
+			&cli.StringFlag{
+				Name:  "consumer",
+				Usage: "only audit this consumer (consumer-0); by default every consumer of --count or the config's groups",
+			},
+			&cli.StringFlag{
+				Name:  "receiver-store",
+				Usage: "payload store written by fpaas receive --store",
+			},
+			&cli.StringFlag{
+				Name:  "receiver-url",
+				Usage: "URL of a running receiver with a store, instead of --receiver-store (http://localhost:8090)",
+			},
+			&cli.BoolFlag{
+				Name:  "redeliver",
+				Usage: "ask the running consumers to deliver the missing events again",
+			},
+		),
+		Before: loadConfigFile,
+		Action: audit,
+	}
+}
+
+func audit(cctx *cli.Context) error {
+	logger := service.Logger(cctx)
+	ctx, cancel := service.SignalContext(cctx.Context, logger)
+	defer cancel()
+
+	groups, err := consumerGroups(cctx)
+	if err != nil {
+		return err
+	}
+	var cfgs []consumer.Config
+	for _, g := range groups {
+		for i := range g.count {
+			cfg := g.cfg
+			cfg.Name = fmt.Sprintf("%s-%d", g.name, i)
+			if only := cctx.String("consumer"); only == "" || only == cfg.Name {
+				cfgs = append(cfgs, cfg)
+			}
+		}
+	}
+	if len(cfgs) == 0 {
+		return fmt.Errorf("no consumer named %s", cctx.String("consumer"))
+	}
+
+	// The receiver's calls, by consumer
+	var received map[string][]consumer.SeqRange
+	unranged := make(map[string]int)
+	if path, url := cctx.String("receiver-store"), cctx.String("receiver-url"); path != "" || url != "" {
+		if path != "" && url != "" {
+			return errors.New("set only one of --receiver-store and --receiver-url")
+		}
+		received = make(map[string][]consumer.SeqRange)
+		err := receive.ListReceived(ctx, path, url, func(r receive.Received) error {
+			if r.FirstSeq == 0 {
+				unranged[r.Consumer]++
+				return nil
+			}
+			received[r.Consumer] = append(received[r.Consumer], consumer.SeqRange{First: r.FirstSeq, Last: r.LastSeq})
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to read the receiver's calls: %w", err)
+		}
+	}
+
+	var redeliverer *controlplane.Redeliverer
+	if cctx.Bool("redeliver") {
+		nc, err := nats.Connect(cctx.String("nats-url"), nats.Timeout(5*time.Second))
+		if err != nil {
+			return fmt.Errorf("failed to connect to NATS: %w", err)
+		}
+		defer nc.Close()
+		redeliverer = controlplane.NewRedeliverer(nc)
+	}
+
+	missed, gaps := 0, 0
+	for _, cfg := range cfgs {
+		opts := consumer.AuditOptions{From: cctx.Uint64("from"), To: cctx.Uint64("to")}
+		if received != nil {
+			// Non-nil, so a consumer without calls is checked too
+			opts.Received = append([]consumer.SeqRange{}, received[cfg.Name]...)
+		}
+		report, err := consumer.Audit(ctx, cfg, opts)
+		if err != nil {
+			return fmt.Errorf("%s: %w", cfg.Name, err)
+		}
+		printAudit(report, received != nil, unranged[cfg.Name])
+
+		for _, g := range report.Gaps {
+			if redeliverer == nil {
+				missed += g.Events
+				gaps++
+				continue
+			}
+			rec, err := redeliverer.Redeliver(ctx, consumer.DeliveryRecord{Consumer: cfg.Name, FirstSeq: g.FirstSeq, LastSeq: g.LastSeq})
+			switch {
+			case err != nil:
+				fmt.Fprintf(os.Stdout, "    redelivery of seq %d to %d failed: %v\n", g.FirstSeq, g.LastSeq, err)
+			case rec.Status != consumer.DeliveryDelivered:
+				fmt.Fprintf(os.Stdout, "    redelivery of seq %d to %d failed: %s\n", g.FirstSeq, g.LastSeq, rec.Error)
+			default:
+				fmt.Fprintf(os.Stdout, "    redelivered seq %d to %d: %d events (delivery %s)\n", g.FirstSeq, g.LastSeq, rec.Events, rec.ID)
+				continue
+			}
+			missed += g.Events
+			gaps++
+		}
+		if len(report.Gaps) > 0 && redeliverer == nil {
+			fmt.Fprintf(os.Stdout, "  deliver them again with --redeliver, or RedeliverRequests on %s%s\n", consumer.RedeliverSubjectPrefix, cfg.Name)
+		}
+	}
+	if missed > 0 {
+		return fmt.Errorf("%d events in %d ranges were not delivered", missed, gaps)
+	}
+	return nil
+}
+
+func printAudit(r consumer.AuditReport, withReceiver bool, unranged int) {
+	w := os.Stdout
+	fmt.Fprintf(w, "%s: stream %s seq %d to %d, %d events, %d passing the filters\n",
+		r.Consumer, r.Stream, r.From, r.To, r.Events, r.Expected)
+	if r.Unretained > 0 {
+		fmt.Fprintf(w, "  %d sequences are no longer retained by the stream and weren't checked\n", r.Unretained)
+	}
+	if r.DeliveryLog {
+		fmt.Fprintf(w, "  %-12s %d of %d events, in %d delivered attempts\n",
+			consumer.AuditDeliveryLog+":", r.Covered[consumer.AuditDeliveryLog], r.Expected, r.Logged)
+	} else {
+		fmt.Fprintf(w, "  %-12s none, the consumers run without --delivery-log\n", consumer.AuditDeliveryLog+":")
+	}
+	if withReceiver {
+		fmt.Fprintf(w, "  %-12s %d of %d events", consumer.AuditReceiver+":", r.Covered[consumer.AuditReceiver], r.Expected)
+		if unranged > 0 {
+			fmt.Fprintf(w, " (%d calls without X-Stream-Seq headers ignored)", unranged)
+		}
+		fmt.Fprintln(w)
+	}
+	if len(r.Gaps) == 0 {
+		fmt.Fprintf(w, "  every event was delivered at least once\n")
+		return
+	}
+	fmt.Fprintf(w, "  %d events missing in %d ranges:\n", r.Missed(), len(r.Gaps))
+	for _, g := range r.Gaps {
+		fmt.Fprintf(w, "  seq %d to %d: %d events, firehose seq %s, stored %s to %s, missing from the %s\n",
+			g.FirstSeq, g.LastSeq, g.Events, firehoseRange(g), g.FirstTime.UTC().Format(time.RFC3339),
+			g.LastTime.UTC().Format(time.RFC3339), strings.Join(g.Missing, " and the "))
+	}
+}
+
+func firehoseRange(g consumer.AuditGap) string {
+	if g.FirstFirehoseSeq == 0 {
+		return "unknown"
+	}
+	return strconv.FormatInt(g.FirstFirehoseSeq, 10) + " to " + strconv.FormatInt(g.LastFirehoseSeq, 10)
+}
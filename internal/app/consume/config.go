@@ -0,0 +1,305 @@
+package consume
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/internal/pkg/service"
+	"github.com/eurosky/firehose-processor-aas/pkg/consumer"
+	"github.com/urfave/cli/v2"
+)
+
+// consumerConfig builds the settings shared by all consumer instances; the
+// caller fills in the per-instance Name.
+func consumerConfig(cctx *cli.Context) consumer.Config {
+	return consumer.Config{
+		NATSURL:          cctx.String("nats-url"),
+		PollInterval:     time.Duration(cctx.Int("poll-interval")) * time.Second,
+		BatchSize:        cctx.Int("batch-size"),
+		WebhookURL:       cctx.String("webhook-url"),
+		UseWebhook:       cctx.Bool("use-webhook"),
+		WebhookSecret:    cctx.String("webhook-secret"),
+		JWEPublicKeyFile: cctx.String("jwe-public-key"),
+		JWEKeyID:         cctx.String("jwe-key-id"),
+		WebhookHTTP: consumer.HTTPOptions{
+			MaxIdleConnsPerHost: cctx.Int("webhook-max-idle-conns-per-host"),
+			HTTP2:               cctx.Bool("webhook-http2"),
+			DialTimeout:         cctx.Duration("webhook-dial-timeout"),
+			TLSHandshakeTimeout: cctx.Duration("webhook-tls-handshake-timeout"),
+			KeepAlive:           cctx.Duration("webhook-keep-alive"),
+			IdleConnTimeout:     cctx.Duration("webhook-idle-conn-timeout"),
+		},
+		WebhookTimeout:          cctx.Duration("webhook-timeout"),
+		RedeliveryHeaders:       cctx.Bool("redelivery-headers"),
+		WebhookRoutes:           cctx.StringSlice("webhook-route"),
+		AggregateWindow:         cctx.Duration("aggregate-window"),
+		DeliveryGranularity:     consumer.DeliveryGranularity(cctx.String("delivery-granularity")),
+		DeliveryConcurrency:     deliveryConcurrency(cctx),
+		AckAll:                  cctx.Bool("ack-all"),
+		PayloadFormat:           consumer.PayloadFormat(cctx.String("payload-format")),
+		SchemaRegistryURL:       cctx.String("schema-registry-url"),
+		Target:                  consumer.Target(cctx.String("target")),
+		SQSQueueURL:             cctx.String("sqs-queue-url"),
+		SNSTopicARN:             cctx.String("sns-topic-arn"),
+		PubSubProject:           cctx.String("pubsub-project"),
+		PubSubTopic:             cctx.String("pubsub-topic"),
+		PubSubAttributes:        cctx.StringSlice("pubsub-attributes"),
+		PostgresDSN:             cctx.String("postgres-dsn"),
+		PostgresTable:           cctx.String("postgres-table"),
+		PostgresColumns:         cctx.StringSlice("postgres-columns"),
+		ClickHouseURL:           cctx.String("clickhouse-url"),
+		ClickHouseTable:         cctx.String("clickhouse-table"),
+		ClickHouseTargetLatency: cctx.Duration("clickhouse-target-latency"),
+		MQTTBrokerURL:           cctx.String("mqtt-broker-url"),
+		MQTTTopicPrefix:         cctx.String("mqtt-topic-prefix"),
+		MQTTQoS:                 cctx.Int("mqtt-qos"),
+		ChatWebhookURL:          cctx.String("chat-webhook-url"),
+		ChatTemplate:            cctx.String("chat-template"),
+		ChatRate:                cctx.Float64("chat-rate"),
+		EmailTo:                 cctx.StringSlice("email-to"),
+		EmailFrom:               cctx.String("email-from"),
+		SMTPURL:                 cctx.String("smtp-url"),
+		EmailTemplate:           cctx.String("email-template"),
+		DigestInterval:          cctx.Duration("digest-interval"),
+		Analysis:                consumer.Analysis(cctx.String("analysis")),
+		TestMode:                cctx.Bool("test-mode"),
+		TestRate:                cctx.Float64("test-rate"),
+		FrameTypes:              cctx.StringSlice("filter-types"),
+		Collections:             cctx.StringSlice("filter-collections"),
+		Languages:               cctx.StringSlice("filter-languages"),
+		DetectLanguages:         cctx.Bool("detect-languages"),
+		TombstoneStatuses:       cctx.StringSlice("tombstone-account-statuses"),
+		Redaction:               cctx.StringSlice("redact"),
+		ExcludeLabels:           cctx.StringSlice("exclude-labels"),
+		AnnotateLabels:          cctx.StringSlice("annotate-labels"),
+		ThreadContext:           cctx.Bool("thread-context"),
+		AppViewURL:              cctx.String("appview-url"),
+		Threads:                 consumer.NewThreadResolver(cctx.String("appview-url"), cctx.Int("thread-context-cache"), cctx.Float64("thread-context-rate")),
+		Blobs:                   cctx.Bool("blobs"),
+		FetchBlobs:              cctx.Bool("fetch-blobs"),
+		BlobBaseURL:             cctx.String("blob-base-url"),
+		BlobURLSecret:           cctx.String("blob-url-secret"),
+		BlobMaxSize:             cctx.Int64("blob-max-size"),
+		BlobURLTTL:              cctx.Duration("blob-url-ttl"),
+		DeliveryLog:             cctx.Bool("delivery-log"),
+		InactiveThreshold:       inactiveThreshold(cctx),
+		Autotune:                cctx.Bool("autotune"),
+		AutotuneBounds:          autotuneBounds(cctx),
+	}
+}
+
+// deliveryConcurrency is --delivery-concurrency, sized from the CPUs when 0.
+// It is resolved at run time, after service.Main set GOMAXPROCS from the
+// CPU quota, which a flag default is not.
+func deliveryConcurrency(cctx *cli.Context) int {
+	if n := cctx.Int("delivery-concurrency"); n > 0 {
+		return n
+	}
+	return consumer.DefaultDeliveryConcurrency()
+}
+
+// autotuneBounds are the --autotune-* bounds. Zero ones are resolved per
+// consumer, as subscriptions set their own batch size and poll interval.
+func autotuneBounds(cctx *cli.Context) consumer.AutotuneBounds {
+	return consumer.AutotuneBounds{
+		MinBatchSize:    cctx.Int("autotune-min-batch-size"),
+		MaxBatchSize:    cctx.Int("autotune-max-batch-size"),
+		MinPollInterval: cctx.Duration("autotune-min-poll-interval"),
+		MaxPollInterval: cctx.Duration("autotune-max-poll-interval"),
+	}
+}
+
+// natsConnections is --nats-connections, one per CPU when 0, like
+// deliveryConcurrency.
+func natsConnections(cctx *cli.Context) int {
+	if n := cctx.Int("nats-connections"); n > 0 {
+		return n
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+func inactiveThreshold(cctx *cli.Context) time.Duration {
+	if !cctx.Bool("ephemeral") {
+		return 0
+	}
+	return cctx.Duration("inactive-threshold")
+}
+
+// consumerGroup is a set of identically configured static consumers, named
+// <name>-0, <name>-1 and so on.
+type consumerGroup struct {
+	name  string
+	count int
+	cfg   consumer.Config
+}
+
+// consumerGroups returns the consume.consumers groups of the --config file.
+// Each entry holds a name and any consumer flags, layered over the consume
+// section; quota and control plane settings stay shared. Without entries
+// there is a single "consumer" group made of the flags.
+func consumerGroups(cctx *cli.Context) ([]consumerGroup, error) {
+	var items []map[string]any
+	if path := cctx.String("config"); path != "" {
+		f, err := service.ReadConfigFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if items, err = f.List("consume", "consumers"); err != nil {
+			return nil, err
+		}
+	}
+	if len(items) == 0 {
+		return []consumerGroup{{name: "consumer", count: cctx.Int("count"), cfg: consumerConfig(cctx)}}, nil
+	}
+
+	groups := make([]consumerGroup, 0, len(items))
+	seen := make(map[string]bool)
+	for i, item := range items {
+		name, _ := item["name"].(string)
+		if name == "" {
+			return nil, fmt.Errorf("consume.consumers[%d]: name is required", i)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("consume.consumers[%d]: duplicate name %q", i, name)
+		}
+		seen[name] = true
+		delete(item, "name")
+
+		flags := consumerFlags()
+		if unknown := service.UnknownKeys(item, flags); len(unknown) > 0 {
+			return nil, fmt.Errorf("consume.consumers[%d] (%s): unknown keys %v", i, name, unknown)
+		}
+		gctx, err := service.OverlayContext(cctx, "consume", item, flags)
+		if err != nil {
+			return nil, fmt.Errorf("consume.consumers[%d] (%s): %w", i, name, err)
+		}
+		groups = append(groups, consumerGroup{name: name, count: gctx.Int("count"), cfg: consumerConfig(gctx)})
+	}
+	return groups, nil
+}
+
+func consumerQuota(cctx *cli.Context) consumer.Quota {
+	return consumer.Quota{
+		Tenant:             cctx.String("tenant"),
+		MaxConsumers:       cctx.Int("max-consumers"),
+		MaxEventsPerDay:    cctx.Int64("max-events-per-day"),
+		MaxWebhookRate:     cctx.Float64("max-webhook-rate"),
+		MaxBlobBytesPerDay: cctx.Int64("max-blob-bytes-per-day"),
+	}
+}
+
+func validate(cctx *cli.Context) error {
+	groups, err := consumerGroups(cctx)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	total := 0
+	for _, g := range groups {
+		if g.count < 1 {
+			return fmt.Errorf("%s: count must be at least 1, got %d", g.name, g.count)
+		}
+		cfg := g.cfg
+		cfg.Name = g.name + "-0"
+		if err := cfg.Validate(); err != nil {
+			return fmt.Errorf("invalid configuration: %s: %w", g.name, err)
+		}
+		total += g.count
+	}
+	if quota := consumerQuota(cctx); quota.MaxConsumers > 0 && total > quota.MaxConsumers {
+		return fmt.Errorf("invalid configuration: count %d exceeds the tenant's max consumers %d", total, quota.MaxConsumers)
+	}
+
+	if len(groups) == 1 {
+		fmt.Fprintf(os.Stdout, "configuration is valid (%d consumer(s), target %s)\n", total, groups[0].cfg.Target)
+		return nil
+	}
+	fmt.Fprintf(os.Stdout, "configuration is valid (%d consumer(s) in %d groups)\n", total, len(groups))
+	for _, g := range groups {
+		fmt.Fprintf(os.Stdout, "  %-20s %d consumer(s), target %s\n", g.name, g.count, g.cfg.Target)
+	}
+	return nil
+}
+
+func dryRun(cctx *cli.Context, g consumerGroup, logger *slog.Logger) error {
+	// Inspect the first instance of the first group; a group's instances
+	// share the configuration
+	cfg := g.cfg
+	cfg.Name = g.name + "-0"
+
+	logger.Info("starting dry run", "consumer", cfg.Name, "send_webhook", cctx.Bool("dry-run-webhook"))
+	report := consumer.DryRun(cctx.Context, cfg, cctx.Bool("dry-run-webhook"))
+
+	for _, check := range report.Checks {
+		status := "ok"
+		if !check.OK {
+			status = "FAIL"
+		}
+		fmt.Fprintf(os.Stdout, "%-10s %-4s %s\n", check.Name, status, check.Detail)
+	}
+
+	if report.Failed() {
+		return fmt.Errorf("dry run failed")
+	}
+	return nil
+}
+
+// backfillUnsupported names the setting of cfg or quota a backfill can't
+// honour, if any: it reads the stream once through a temporary consumer,
+// without the synthetic frames, rollups, delivery log or quotas of a
+// running one.
+func backfillUnsupported(cfg consumer.Config, quota consumer.Quota) string {
+	switch {
+	case cfg.TestMode:
+		return "--test-mode"
+	case cfg.AggregateWindow != 0:
+		return "--aggregate-window"
+	case cfg.DeliveryLog:
+		return "--delivery-log"
+	case quota.MaxEventsPerDay > 0 || quota.MaxWebhookRate > 0 || quota.MaxBlobBytesPerDay > 0:
+		return "the --max-* quotas"
+	}
+	return ""
+}
+
+func backfill(cctx *cli.Context) error {
+	logger := service.Logger(cctx)
+
+	// The consumer backfilled, whose name the payloads carry, with the
+	// settings of its group
+	groups, err := consumerGroups(cctx)
+	if err != nil {
+		return err
+	}
+	name := cctx.String("consumer")
+	var cfg consumer.Config
+	for _, g := range groups {
+		for i := range g.count {
+			if n := fmt.Sprintf("%s-%d", g.name, i); cfg.Name == "" && (name == "" || name == n) {
+				cfg = g.cfg
+				cfg.Name = n
+			}
+		}
+	}
+	if cfg.Name == "" {
+		return fmt.Errorf("no consumer named %s", name)
+	}
+	if s := backfillUnsupported(cfg, consumerQuota(cctx)); s != "" {
+		return fmt.Errorf("%s: backfill can't honour %s", cfg.Name, s)
+	}
+
+	var to time.Time
+	if t := cctx.Timestamp("to"); t != nil {
+		to = *t
+	}
+
+	ctx, cancel := service.SignalContext(cctx.Context, logger)
+	defer cancel()
+
+	p, err := consumer.Backfill(ctx, cfg, *cctx.Timestamp("from"), to, logger)
+	logger.Info("backfill finished", "delivered", p.Delivered, "skipped", p.Skipped, "last_time", p.LastTime)
+	return err
+}
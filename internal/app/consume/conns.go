@@ -0,0 +1,105 @@
+package consume
+
+import (
+	"sync"
+
+	"github.com/nats-io/nats.go"
+)
+
+// connPool shares a few NATS connections between the consumers of a
+// process, rather than one per consumer: each consumer gets its own
+// JetStream context on the least used one. Connections are per URL, so a
+// reloaded --nats-url takes effect for consumers restarted by it.
+type connPool struct {
+	// size is the number of connections per URL
+	size int
+
+	mu    sync.Mutex
+	conns map[string][]*pooledConn
+}
+
+type pooledConn struct {
+	nc    *nats.Conn
+	users int
+}
+
+func newConnPool(size int) *connPool {
+	return &connPool{size: size, conns: make(map[string][]*pooledConn)}
+}
+
+// acquire returns a connection to url and the func releasing it. Until the
+// pool is full, it connects rather than share; closed connections, which
+// gave up reconnecting, are replaced.
+func (p *connPool) acquire(url string) (*nats.Conn, func(), error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	conns := p.conns[url][:0]
+	for _, c := range p.conns[url] {
+		if !c.nc.IsClosed() {
+			conns = append(conns, c)
+		}
+	}
+	p.conns[url] = conns
+
+	var least *pooledConn
+	for _, c := range conns {
+		if least == nil || c.users < least.users {
+			least = c
+		}
+	}
+	if least == nil || (least.users > 0 && len(conns) < p.size) {
+		nc, err := nats.Connect(url)
+		if err != nil {
+			return nil, nil, err
+		}
+		least = &pooledConn{nc: nc}
+		p.conns[url] = append(conns, least)
+	}
+
+	least.users++
+	return least.nc, func() { p.release(url, least) }, nil
+}
+
+// release closes a connection once nothing uses it.
+func (p *connPool) release(url string, c *pooledConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	c.users--
+	if c.users > 0 {
+		return
+	}
+	for i, other := range p.conns[url] {
+		if other == c {
+			p.conns[url] = append(p.conns[url][:i], p.conns[url][i+1:]...)
+			break
+		}
+	}
+	c.nc.Close()
+}
+
+// count returns the number of connections open.
+func (p *connPool) count() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	n := 0
+	for _, conns := range p.conns {
+		n += len(conns)
+	}
+	return n
+}
+
+// close closes every connection, once the consumers stopped.
+func (p *connPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for url, conns := range p.conns {
+		for _, c := range conns {
+			c.nc.Close()
+		}
+		delete(p.conns, url)
+	}
+}
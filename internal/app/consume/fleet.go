@@ -0,0 +1,466 @@
+package consume
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/internal/pkg/controlplane"
+	"github.com/eurosky/firehose-processor-aas/internal/pkg/registry"
+	"github.com/eurosky/firehose-processor-aas/pkg/consumer"
+	"github.com/eurosky/firehose-processor-aas/pkg/events"
+	"github.com/eurosky/firehose-processor-aas/pkg/firehose"
+	"github.com/nats-io/nats.go"
+)
+
+// fleet runs a set of named consumers that can be started and stopped
+// individually.
+type fleet struct {
+	ctx    context.Context
+	logger *slog.Logger
+
+	mu      sync.Mutex
+	running map[string]*instance
+	// processed counts the messages of consumers that have stopped
+	processed int64
+
+	// quota holds the per-tenant limits in reconcile mode
+	quota  consumer.Quota
+	quotas map[string]*consumer.QuotaTracker
+
+	// leases, when set, run each consumer only while the replica holds its
+	// lease
+	leases *consumer.Leases
+
+	// conns, when set, are the NATS connections the consumers share
+	conns *connPool
+
+	// labels are the label indexes the consumers filtering on labels share,
+	// one per NATS URL
+	labelsMu sync.Mutex
+	labels   map[string]*firehose.LabelIndex
+
+	// maintenance is the maintenance switch the consumers follow
+	maintenance *consumer.MaintenanceSwitch
+
+	// id names the replica to the control plane, which hands each replay
+	// to one replica
+	id      string
+	replays map[string]context.CancelFunc
+}
+
+type instance struct {
+	version  int64
+	consumer *consumer.PullConsumer
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+func newFleet(ctx context.Context, logger *slog.Logger) *fleet {
+	return &fleet{ctx: ctx, logger: logger, running: make(map[string]*instance), replays: make(map[string]context.CancelFunc)}
+}
+
+func (f *fleet) start(cfg consumer.Config, version int64) {
+	ctx, cancel := context.WithCancel(f.ctx)
+	inst := &instance{version: version, cancel: cancel, done: make(chan struct{})}
+
+	f.mu.Lock()
+	f.running[cfg.Name] = inst
+	f.mu.Unlock()
+
+	go func() {
+		defer close(inst.done)
+		if f.leases != nil {
+			f.leases.Run(ctx, cfg.Name, func(ctx context.Context) { f.run(ctx, cfg, inst) })
+			return
+		}
+		f.run(ctx, cfg, inst)
+	}()
+}
+
+// run runs the consumer of inst until ctx is done.
+func (f *fleet) run(ctx context.Context, cfg consumer.Config, inst *instance) {
+	l := f.logger.With("consumer", cfg.Name)
+
+	cfg, release, err := f.share(cfg)
+	if err != nil {
+		l.Error("consumer failed to start", "error", err)
+		return
+	}
+	defer release()
+
+	c, err := consumer.NewPullConsumer(cfg, l)
+	if err != nil {
+		l.Error("consumer failed to start", "error", err)
+		return
+	}
+	defer c.Close()
+
+	f.mu.Lock()
+	inst.consumer = c
+	f.mu.Unlock()
+
+	if err := c.Run(ctx); err != nil {
+		l.Error("consumer error", "error", err)
+	}
+
+	f.mu.Lock()
+	f.processed += c.GetTotalCount()
+	inst.consumer = nil
+	f.mu.Unlock()
+}
+
+// share returns cfg with the fleet's shared NATS connection, label index and
+// maintenance switch, and a function releasing them.
+func (f *fleet) share(cfg consumer.Config) (consumer.Config, func(), error) {
+	release := func() {}
+	if cfg.Maintenance == nil {
+		cfg.Maintenance = f.maintenance
+	}
+	if f.conns != nil {
+		nc, r, err := f.conns.acquire(cfg.NATSURL)
+		if err != nil {
+			return cfg, nil, fmt.Errorf("failed to connect to NATS: %w", err)
+		}
+		cfg.Conn, release = nc, r
+	}
+
+	if cfg.Labels == nil && (len(cfg.ExcludeLabels) > 0 || len(cfg.AnnotateLabels) > 0) {
+		labels, err := f.labelIndex(cfg.NATSURL)
+		if err != nil {
+			release()
+			return cfg, nil, err
+		}
+		cfg.Labels = labels
+	}
+	return cfg, release, nil
+}
+
+// labelIndex returns the label index of url, loading it when no consumer
+// used it yet. It follows the label bucket until the fleet's context is
+// done.
+func (f *fleet) labelIndex(url string) (*firehose.LabelIndex, error) {
+	f.labelsMu.Lock()
+	defer f.labelsMu.Unlock()
+
+	if idx, ok := f.labels[url]; ok {
+		return idx, nil
+	}
+	nc, err := nats.Connect(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+	js, err := nc.JetStream()
+	if err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("failed to create JetStream context: %w", err)
+	}
+	idx, err := firehose.WatchLabels(js, f.logger)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	context.AfterFunc(f.ctx, func() {
+		idx.Stop()
+		nc.Close()
+	})
+	f.logger.Info("loaded labels", "subjects", idx.Len())
+
+	if f.labels == nil {
+		f.labels = make(map[string]*firehose.LabelIndex)
+	}
+	f.labels[url] = idx
+	return idx, nil
+}
+
+func (f *fleet) stop(name string) {
+	f.mu.Lock()
+	inst, ok := f.running[name]
+	delete(f.running, name)
+	f.mu.Unlock()
+
+	if ok {
+		inst.cancel()
+		<-inst.done
+	}
+}
+
+// wait blocks until every consumer has stopped, once the fleet's context is
+// done, or until ctx is.
+func (f *fleet) wait(ctx context.Context) error {
+	f.mu.Lock()
+	running := make([]*instance, 0, len(f.running))
+	for _, inst := range f.running {
+		running = append(running, inst)
+	}
+	f.mu.Unlock()
+
+	for _, inst := range running {
+		select {
+		case <-inst.done:
+		case <-ctx.Done():
+			return fmt.Errorf("consumers still running: %w", ctx.Err())
+		}
+	}
+	return nil
+}
+
+// healthy fails when a consumer exited or isn't making progress. A fleet
+// without consumers, e.g. before the first subscription, is healthy.
+func (f *fleet) healthy(context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var errs []error
+	for name, inst := range f.running {
+		switch {
+		case exited(inst):
+			errs = append(errs, fmt.Errorf("%s exited", name))
+		case inst.consumer == nil:
+			// Still starting
+		default:
+			if err := inst.consumer.Healthy(); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// registryEntries returns the state of the consumers running here.
+func (f *fleet) registryEntries() registry.Entries {
+	entries := registry.Entries{}
+	for _, st := range f.statuses() {
+		entries.Add(st)
+	}
+	return entries
+}
+
+// statuses returns the state of the running consumers, by name.
+func (f *fleet) statuses() []events.ConsumerStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var statuses []events.ConsumerStatus
+	for _, inst := range f.running {
+		if inst.consumer != nil {
+			st := inst.consumer.Status()
+			st.Instance = f.id
+			statuses = append(statuses, st)
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// totalProcessed counts the messages processed by all consumers, including
+// stopped ones.
+func (f *fleet) totalProcessed() int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	total := f.processed
+	for _, inst := range f.running {
+		if inst.consumer != nil {
+			total += inst.consumer.GetTotalCount()
+		}
+	}
+	return total
+}
+
+func (f *fleet) size() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.running)
+}
+
+// reconcile runs one consumer per enabled control plane subscription until
+// ctx is done. A consumer is restarted when its subscription's version
+// changes or when it exited; consumers of removed subscriptions are stopped.
+// Durables are named after the subscription, so restarts resume where the
+// previous consumer stopped. Requested replays run alongside.
+func (f *fleet) reconcile(ctx context.Context, client *controlplane.Client, base consumer.Config, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		f.reconcileOnce(ctx, client, base)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (f *fleet) reconcileOnce(ctx context.Context, client *controlplane.Client, base consumer.Config) {
+	subs, err := client.FleetSubscriptions(ctx)
+	if err != nil {
+		// Keep running what we have until the control plane is back
+		f.logger.Warn("failed to fetch subscriptions", "error", err)
+		return
+	}
+
+	wanted := make(map[string]controlplane.Subscription, len(subs))
+	for _, sub := range subs {
+		wanted[sub.ConsumerName()] = sub
+	}
+
+	f.mu.Lock()
+	var stale []string
+	for name, inst := range f.running {
+		sub, ok := wanted[name]
+		if !ok || sub.Version != inst.version || exited(inst) {
+			stale = append(stale, name)
+		}
+	}
+	f.mu.Unlock()
+
+	for _, name := range stale {
+		f.logger.Info("stopping consumer", "consumer", name)
+		f.stop(name)
+	}
+
+	for name, sub := range wanted {
+		f.mu.Lock()
+		_, ok := f.running[name]
+		f.mu.Unlock()
+		if ok {
+			continue
+		}
+
+		f.logger.Info("starting consumer for subscription",
+			"consumer", name,
+			"tenant", sub.TenantID,
+			"subscription", sub.Name,
+			"version", sub.Version,
+			"target", sub.Target,
+		)
+		cfg := sub.Apply(base)
+		cfg.Quota = f.tenantQuota(sub.TenantID)
+		f.start(cfg, sub.Version)
+	}
+
+	f.reconcileReplays(ctx, client, base)
+}
+
+// configure runs the consumers of the static groups. Like reconcile, it
+// restarts consumers whose configuration changed or that exited and stops
+// those no longer wanted, after their current batch.
+func (f *fleet) configure(groups []consumerGroup, quota *consumer.QuotaTracker) {
+	wanted := make(map[string]consumer.Config)
+	var names []string
+	for _, g := range groups {
+		for i := 0; i < g.count; i++ {
+			cfg := g.cfg
+			cfg.Name = fmt.Sprintf("%s-%d", g.name, i)
+			wanted[cfg.Name] = cfg
+			names = append(names, cfg.Name)
+		}
+	}
+
+	f.mu.Lock()
+	var stale []string
+	for name, inst := range f.running {
+		cfg, ok := wanted[name]
+		if !ok || configVersion(cfg) != inst.version || exited(inst) {
+			stale = append(stale, name)
+		}
+	}
+	f.mu.Unlock()
+
+	for _, name := range stale {
+		f.logger.Info("stopping consumer", "consumer", name)
+		f.stop(name)
+	}
+
+	for _, name := range names {
+		f.mu.Lock()
+		_, ok := f.running[name]
+		f.mu.Unlock()
+		if ok {
+			continue
+		}
+
+		cfg := wanted[name]
+		f.logger.Info("starting consumer", "consumer", name, "target", cfg.Target)
+		version := configVersion(cfg)
+		cfg.Quota = quota
+		f.start(cfg, version)
+	}
+}
+
+// configVersion identifies a static consumer's configuration, so configure
+// can tell which consumers changed.
+func configVersion(cfg consumer.Config) int64 {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%#v", cfg)
+	return int64(h.Sum64())
+}
+
+func (f *fleet) tenantQuota(tenant string) *consumer.QuotaTracker {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	t, ok := f.quotas[tenant]
+	if !ok {
+		q := f.quota
+		q.Tenant = tenant
+		t = consumer.NewQuotaTracker(q)
+		f.quotas[tenant] = t
+	}
+	return t
+}
+
+func exited(inst *instance) bool {
+	select {
+	case <-inst.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// serveQuotas serves the quota state of every tenant seen in reconcile mode.
+func (f *fleet) serveQuotas(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	states := make([]consumer.QuotaState, 0, len(f.quotas))
+	for _, t := range f.quotas {
+		states = append(states, t.State())
+	}
+	f.mu.Unlock()
+
+	sort.Slice(states, func(i, j int) bool { return states[i].Tenant < states[j].Tenant })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(states)
+}
+
+// serveRecommendations serves the tuning report of every running consumer,
+// or of the one ?consumer= names.
+func (f *fleet) serveRecommendations(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("consumer")
+	f.mu.Lock()
+	reports := make([]consumer.TuningReport, 0, len(f.running))
+	for n, inst := range f.running {
+		if inst.consumer != nil && (name == "" || n == name) {
+			reports = append(reports, inst.consumer.Recommend())
+		}
+	}
+	f.mu.Unlock()
+
+	if name != "" && len(reports) == 0 {
+		http.Error(w, "consumer not running here", http.StatusNotFound)
+		return
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Consumer < reports[j].Consumer })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reports)
+}
@@ -0,0 +1,106 @@
+package consume
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/carlmjohnson/versioninfo"
+	"github.com/eurosky/firehose-processor-aas/pkg/events"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+)
+
+// microName is the NATS micro service consume processes register as, so
+// "nats micro ls fpaas-consume" lists the fleet.
+const microName = "fpaas-consume"
+
+// microStats is the data of the service's status endpoint in STATS
+// responses, and what the endpoint answers.
+type microStats struct {
+	Instance string `json:"instance"`
+	// Processed counts the messages of every consumer the process ran
+	Processed int64                   `json:"processed"`
+	Consumers []events.ConsumerStatus `json:"consumers"`
+	Stream    *streamStats            `json:"stream,omitempty"`
+}
+
+// streamStats is the state of the firehose stream the consumers read.
+type streamStats struct {
+	Name      string `json:"name"`
+	Messages  uint64 `json:"messages"`
+	Bytes     uint64 `json:"bytes"`
+	FirstSeq  uint64 `json:"first_seq"`
+	LastSeq   uint64 `json:"last_seq"`
+	Consumers int    `json:"consumers"`
+}
+
+// serveMicro registers the process as an instance of microName on nc until
+// ctx is done. Besides PING, INFO and STATS, its status endpoint answers
+// with the microStats of the instance on fpaas.consume.<service id>.status.
+func (f *fleet) serveMicro(ctx context.Context, nc *nats.Conn, tenant string) error {
+	js, err := nc.JetStream()
+	if err != nil {
+		return err
+	}
+	svc, err := micro.AddService(nc, micro.Config{
+		Name:        microName,
+		Version:     microVersion(),
+		Description: "Firehose consumers delivering to webhooks and other targets",
+		Metadata: map[string]string{
+			"instance": f.id,
+			"tenant":   tenant,
+		},
+		StatsHandler: func(*micro.Endpoint) any { return f.microStats(js) },
+	})
+	if err != nil {
+		return fmt.Errorf("failed to register NATS micro service: %w", err)
+	}
+	err = svc.AddEndpoint("status", micro.HandlerFunc(func(req micro.Request) {
+		req.RespondJSON(f.microStats(js))
+	}), micro.WithEndpointSubject("fpaas.consume."+svc.Info().ID+".status"))
+	if err != nil {
+		svc.Stop()
+		return fmt.Errorf("failed to register NATS micro service: %w", err)
+	}
+
+	<-ctx.Done()
+	return svc.Stop()
+}
+
+func (f *fleet) microStats(js nats.JetStreamContext) microStats {
+	st := microStats{
+		Instance:  f.id,
+		Processed: f.totalProcessed(),
+		Consumers: f.statuses(),
+	}
+	if st.Consumers == nil {
+		st.Consumers = []events.ConsumerStatus{}
+	}
+	// Answered while the tooling waits, so a slow lookup leaves it out
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if name, err := js.StreamNameBySubject("atproto.firehose.>", nats.Context(ctx)); err == nil {
+		if info, err := js.StreamInfo(name, nats.Context(ctx)); err == nil {
+			st.Stream = &streamStats{
+				Name:      name,
+				Messages:  info.State.Msgs,
+				Bytes:     info.State.Bytes,
+				FirstSeq:  info.State.FirstSeq,
+				LastSeq:   info.State.LastSeq,
+				Consumers: info.State.Consumers,
+			}
+		}
+	}
+	return st
+}
+
+// microVersion is the module version as micro wants it, semver without the
+// "v"; builds outside a tagged module are 0.0.0-devel.
+func microVersion() string {
+	if v, ok := strings.CutPrefix(versioninfo.Version, "v"); ok {
+		return v
+	}
+	return "0.0.0-devel"
+}
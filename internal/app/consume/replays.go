@@ -0,0 +1,184 @@
+package consume
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/internal/pkg/controlplane"
+	"github.com/eurosky/firehose-processor-aas/pkg/consumer"
+)
+
+// replayHeartbeat is how often a running replay reports its progress, well
+// within controlplane.ReplayStaleAfter.
+const replayHeartbeat = 10 * time.Second
+
+// reconcileReplays starts the replays the replica manages to claim: pending
+// ones, and those their replica stopped reporting on. Replays running here
+// that are no longer active, e.g. cancelled, are stopped.
+func (f *fleet) reconcileReplays(ctx context.Context, client *controlplane.Client, base consumer.Config) {
+	replays, err := client.FleetReplays(ctx)
+	if err != nil {
+		f.logger.Warn("failed to fetch replays", "error", err)
+		return
+	}
+
+	active := make(map[string]bool, len(replays))
+	for _, r := range replays {
+		active[r.ID] = true
+	}
+	f.mu.Lock()
+	for id, cancel := range f.replays {
+		if !active[id] {
+			f.logger.Info("stopping replay", "replay", id)
+			cancel()
+		}
+	}
+	f.mu.Unlock()
+
+	for _, r := range replays {
+		f.mu.Lock()
+		_, ok := f.replays[r.ID]
+		f.mu.Unlock()
+		if ok {
+			continue
+		}
+
+		claimed, err := client.ReportReplay(ctx, r.ID, f.replayReport(controlplane.ReplayRunning, r.Replay))
+		if err != nil {
+			f.logger.Warn("failed to claim replay", "replay", r.ID, "error", err)
+			continue
+		}
+		if claimed.State != controlplane.ReplayRunning || claimed.Instance != f.id {
+			continue
+		}
+
+		f.startReplay(client, r.Subscription.Apply(base), claimed)
+	}
+}
+
+func (f *fleet) startReplay(client *controlplane.Client, cfg consumer.Config, r controlplane.Replay) {
+	ctx, cancel := context.WithCancel(f.ctx)
+	f.mu.Lock()
+	f.replays[r.ID] = cancel
+	f.mu.Unlock()
+
+	go func() {
+		defer func() {
+			f.mu.Lock()
+			delete(f.replays, r.ID)
+			f.mu.Unlock()
+			cancel()
+		}()
+		f.runReplay(ctx, cancel, client, cfg, r)
+	}()
+}
+
+// runReplay runs r, resuming after the last sequence a previous run handled,
+// and reports its progress until it ends or the control plane says to stop.
+// A replay interrupted by the replica stopping resumes on the replica that
+// claims it next.
+func (f *fleet) runReplay(ctx context.Context, cancel context.CancelFunc, client *controlplane.Client, cfg consumer.Config, r controlplane.Replay) {
+	l := f.logger.With("consumer", cfg.Name, "replay", r.ID)
+
+	if r.EndSeq > 0 && r.LastSeq >= r.EndSeq {
+		// The previous run got to the end without reporting it
+		f.finishReplay(ctx, client, l, controlplane.ReplayDone, r)
+		return
+	}
+
+	cfg, release, err := f.share(cfg)
+	if err != nil {
+		r.Error = err.Error()
+		f.finishReplay(ctx, client, l, controlplane.ReplayFailed, r)
+		return
+	}
+	defer release()
+
+	var mu sync.Mutex
+	latest := r
+	heartbeatCtx, stopHeartbeat := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(replayHeartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-heartbeatCtx.Done():
+				return
+			case <-ticker.C:
+			}
+			mu.Lock()
+			rep := f.replayReport(controlplane.ReplayRunning, latest)
+			mu.Unlock()
+			got, err := client.ReportReplay(heartbeatCtx, r.ID, rep)
+			switch {
+			case errors.Is(err, controlplane.ErrNotFound):
+				l.Info("replay deleted; stopping")
+				cancel()
+				return
+			case err != nil:
+				l.Warn("failed to report replay progress", "error", err)
+			case got.State != controlplane.ReplayRunning || got.Instance != f.id:
+				l.Info("replay stopped by the control plane", "state", got.State, "instance", got.Instance)
+				cancel()
+				return
+			}
+		}
+	}()
+
+	p, err := consumer.Replay(ctx, cfg, r.ID, r.Window(), func(p consumer.ReplayProgress) {
+		mu.Lock()
+		latest = progressed(r, p)
+		mu.Unlock()
+	}, f.logger)
+	stopHeartbeat()
+	wg.Wait()
+	if ctx.Err() != nil {
+		// Cancelled, or the replica is stopping
+		return
+	}
+
+	latest = progressed(r, p)
+	if err != nil {
+		latest.Error = err.Error()
+		f.finishReplay(ctx, client, l, controlplane.ReplayFailed, latest)
+		return
+	}
+	f.finishReplay(ctx, client, l, controlplane.ReplayDone, latest)
+}
+
+func (f *fleet) finishReplay(ctx context.Context, client *controlplane.Client, l *slog.Logger, state string, r controlplane.Replay) {
+	if _, err := client.ReportReplay(ctx, r.ID, f.replayReport(state, r)); err != nil {
+		l.Warn("failed to report replay", "state", state, "error", err)
+		return
+	}
+	l.Info("replay "+state, "delivered", r.Delivered, "skipped", r.Skipped, "last_seq", r.LastSeq, "error", r.Error)
+}
+
+func (f *fleet) replayReport(state string, r controlplane.Replay) controlplane.ReplayReport {
+	return controlplane.ReplayReport{
+		Instance:  f.id,
+		State:     state,
+		Delivered: r.Delivered,
+		Skipped:   r.Skipped,
+		LastSeq:   r.LastSeq,
+		EndSeq:    r.EndSeq,
+		Error:     r.Error,
+	}
+}
+
+// progressed returns r with the progress of a run that resumed it added.
+func progressed(r controlplane.Replay, p consumer.ReplayProgress) controlplane.Replay {
+	r.Delivered += p.Delivered
+	r.Skipped += p.Skipped
+	r.LastSeq = max(r.LastSeq, p.LastSeq)
+	if p.EndSeq > 0 {
+		r.EndSeq = p.EndSeq
+	}
+	return r
+}
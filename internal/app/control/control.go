@@ -0,0 +1,274 @@
+// Package control is the control plane service: the tenant, API key and
+// subscription API and the self-service dashboard.
+package control
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/internal/pkg/auth"
+	"github.com/eurosky/firehose-processor-aas/internal/pkg/controlplane"
+	"github.com/eurosky/firehose-processor-aas/internal/pkg/service"
+	"github.com/nats-io/nats.go"
+	"github.com/urfave/cli/v2"
+	"github.com/urfave/cli/v2/altsrc"
+)
+
+// Command is the control plane command, "fpaas control-plane".
+func Command() *cli.Command {
+	return &cli.Command{
+		Name:   "control-plane",
+		Usage:  "Tenant, API key and subscription management API for the consumer fleet",
+		Before: service.LoadConfig("control-plane"),
+		Action: run,
+		Flags:  flags(),
+		Subcommands: []*cli.Command{
+			{
+				Name:   "validate",
+				Usage:  "check the configuration and exit",
+				Flags:  flags(),
+				Before: service.LoadConfig("control-plane"),
+				Action: validate,
+			},
+		},
+	}
+}
+
+func flags() []cli.Flag {
+	return []cli.Flag{
+		service.ConfigFlag(),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    "listen",
+			Usage:   "HTTP listen address",
+			Value:   ":8084",
+			EnvVars: []string{"LISTEN_ADDR"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    "db",
+			Usage:   "path of the SQLite database",
+			Value:   "control-plane.db",
+			EnvVars: []string{"CONTROL_PLANE_DB"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    "admin-token",
+			Usage:   "bearer token with the admin scope (required, at least 16 characters)",
+			EnvVars: []string{"ADMIN_TOKEN"},
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:    "api-key",
+			Usage:   "additional operator key as name:key:scope,scope (e.g. fleet:<key>:fleet for the consumer fleet)",
+			EnvVars: []string{"API_KEYS"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    "jwt-secret",
+			Usage:   "accept HS256 JWTs signed with this secret (claims: sub, exp, tenant, scope)",
+			EnvVars: []string{"JWT_SECRET"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    "jwt-issuer",
+			Usage:   "required JWT issuer",
+			EnvVars: []string{"JWT_ISSUER"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    "jwt-audience",
+			Usage:   "required JWT audience",
+			EnvVars: []string{"JWT_AUDIENCE"},
+		}),
+		altsrc.NewFloat64Flag(&cli.Float64Flag{
+			Name:    "rate-limit",
+			Usage:   "requests per second allowed per key (0 = unlimited)",
+			Value:   10,
+			EnvVars: []string{"RATE_LIMIT"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    "nats-url",
+			Usage:   "NATS server URL; enables delivery history (from consumers running with --delivery-log), manual redelivery, the audit stream, the pipeline topology, keyword queries and watchlists",
+			EnvVars: []string{"NATS_URL"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    "nats-account-seed",
+			Usage:   "seed of the fleet's NATS account, or of one of its signing keys; enables NATS credentials for tenants",
+			EnvVars: []string{"NATS_ACCOUNT_SEED"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    "nats-account",
+			Usage:   "public key of the NATS account, required when --nats-account-seed is a signing key",
+			EnvVars: []string{"NATS_ACCOUNT"},
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:    "nats-credentials-ttl",
+			Usage:   "how long tenant NATS credentials are valid",
+			Value:   24 * time.Hour,
+			EnvVars: []string{"NATS_CREDENTIALS_TTL"},
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:    "skip-webhook-verification",
+			Usage:   "accept webhook URLs without the verification handshake (development only)",
+			EnvVars: []string{"SKIP_WEBHOOK_VERIFICATION"},
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:    "allowed-destination",
+			Usage:   "where tenants may point subscriptions of the sqs, sns, pubsub, postgres, clickhouse and mqtt targets, as target=destination: a queue URL, topic ARN or topic ID prefix, or a host or host:port (e.g. sns=arn:aws:sns:eu-west-1:123456789012:tenant-, postgres=db.internal); targets without one are closed to tenants",
+			EnvVars: []string{"ALLOWED_DESTINATIONS"},
+		}),
+		altsrc.NewStringFlag(service.LogLevelFlag("info")),
+	}
+}
+
+// checkConfig checks the flags shared by run and validate.
+func checkConfig(cctx *cli.Context) error {
+	if len(cctx.String("admin-token")) < 16 {
+		return errors.New("admin token must be at least 16 characters")
+	}
+	for _, s := range cctx.StringSlice("api-key") {
+		if _, err := auth.ParseStaticKey(s); err != nil {
+			return fmt.Errorf("invalid --api-key: %w", err)
+		}
+	}
+	if cctx.String("jwt-secret") == "" && (cctx.String("jwt-issuer") != "" || cctx.String("jwt-audience") != "") {
+		return errors.New("jwt-issuer and jwt-audience require jwt-secret")
+	}
+	if cctx.Float64("rate-limit") < 0 {
+		return errors.New("rate-limit must not be negative")
+	}
+	if cctx.String("db") == "" {
+		return errors.New("db is required")
+	}
+	if _, err := credentialsIssuer(cctx); err != nil {
+		return err
+	}
+	if _, err := controlplane.ParseDestinations(cctx.StringSlice("allowed-destination")); err != nil {
+		return fmt.Errorf("invalid --allowed-destination: %w", err)
+	}
+	return nil
+}
+
+// credentialsIssuer returns nil without --nats-account-seed.
+func credentialsIssuer(cctx *cli.Context) (*controlplane.CredentialsIssuer, error) {
+	seed := cctx.String("nats-account-seed")
+	if seed == "" {
+		if cctx.String("nats-account") != "" {
+			return nil, errors.New("nats-account requires nats-account-seed")
+		}
+		return nil, nil
+	}
+	return controlplane.NewCredentialsIssuer(seed, cctx.String("nats-account"), cctx.Duration("nats-credentials-ttl"))
+}
+
+func validate(cctx *cli.Context) error {
+	if err := checkConfig(cctx); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stdout, "configuration is valid (listen %s, db %s)\n", cctx.String("listen"), cctx.String("db"))
+	return nil
+}
+
+func run(cctx *cli.Context) error {
+	if err := checkConfig(cctx); err != nil {
+		return err
+	}
+
+	rt := service.NewRuntime(cctx, "control-plane", cctx.String("listen"))
+	logger := rt.Logger
+	service.WatchConfig(rt.Context(), cctx, "control-plane", flags, logger, nil)
+
+	store, err := controlplane.OpenStore(cctx.String("db"))
+	if err != nil {
+		return err
+	}
+	rt.OnStop(func(context.Context) error {
+		return store.Close()
+	})
+	rt.ReadinessCheck("database", store.Ping)
+
+	authn, err := authenticator(cctx, store, logger)
+	if err != nil {
+		return err
+	}
+
+	var redeliver *controlplane.Redeliverer
+	var js nats.JetStreamContext
+	if natsURL := cctx.String("nats-url"); natsURL != "" {
+		nc, err := nats.Connect(natsURL)
+		if err != nil {
+			return fmt.Errorf("failed to connect to NATS: %w", err)
+		}
+		rt.OnStop(func(context.Context) error {
+			nc.Close()
+			return nil
+		})
+		rt.ReadinessCheck("nats", service.NATSCheck(nc))
+
+		js, err = nc.JetStream()
+		if err != nil {
+			return fmt.Errorf("failed to create JetStream context: %w", err)
+		}
+		rt.Go(func(ctx context.Context) error {
+			if err := controlplane.IngestDeliveries(ctx, js, store, logger); err != nil {
+				logger.Error("delivery log ingest failed", "error", err)
+			}
+			return nil
+		})
+		rt.Go(func(ctx context.Context) error {
+			if err := controlplane.ForwardAudit(ctx, js, store, logger); err != nil {
+				logger.Error("audit log forwarding failed", "error", err)
+			}
+			return nil
+		})
+		redeliver = controlplane.NewRedeliverer(nc)
+	}
+
+	verifier := controlplane.NewVerifier()
+	if cctx.Bool("skip-webhook-verification") {
+		logger.Warn("webhook verification disabled")
+		verifier = nil
+	}
+
+	creds, err := credentialsIssuer(cctx)
+	if err != nil {
+		return err
+	}
+	if creds != nil {
+		logger.Info("issuing nats credentials to tenants", "ttl", cctx.Duration("nats-credentials-ttl"))
+	}
+
+	dests, err := controlplane.ParseDestinations(cctx.StringSlice("allowed-destination"))
+	if err != nil {
+		return err
+	}
+
+	rt.Mux.Handle("/", controlplane.NewServer(store, authn, redeliver, verifier, creds, dests, js, logger))
+
+	logger.Info("control plane started", "listen", cctx.String("listen"), "db", cctx.String("db"))
+	return rt.Run(nil)
+}
+
+func authenticator(cctx *cli.Context, store *controlplane.Store, logger *slog.Logger) (*auth.Authenticator, error) {
+	keys := auth.StaticKeys{{Name: "admin", Key: cctx.String("admin-token"), Scopes: []auth.Scope{auth.ScopeAdmin}}}
+	for _, s := range cctx.StringSlice("api-key") {
+		k, err := auth.ParseStaticKey(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --api-key: %w", err)
+		}
+		keys = append(keys, k)
+	}
+
+	authn := &auth.Authenticator{
+		Keys:      []auth.KeyResolver{keys, store},
+		RateLimit: cctx.Float64("rate-limit"),
+		Audit:     logger.With("audit", true),
+		Cookie:    controlplane.SessionCookie,
+	}
+	if secret := cctx.String("jwt-secret"); secret != "" {
+		authn.JWT = &auth.JWTValidator{
+			Secret:   []byte(secret),
+			Issuer:   cctx.String("jwt-issuer"),
+			Audience: cctx.String("jwt-audience"),
+		}
+	}
+	return authn, nil
+}
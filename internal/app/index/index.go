@@ -0,0 +1,212 @@
+// Package index is the indexer: it reads the raw frames ingest publishes and
+// copies those of the DIDs in consumers' watchlists to the subjects of the
+// FPAAS_WATCHED stream the consumers read.
+package index
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/eurosky/firehose-processor-aas/internal/pkg/service"
+	"github.com/eurosky/firehose-processor-aas/pkg/firehose"
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/urfave/cli/v2"
+	"github.com/urfave/cli/v2/altsrc"
+)
+
+// Command is the indexer command, "fpaas index".
+func Command() *cli.Command {
+	return &cli.Command{
+		Name:   "index",
+		Usage:  "Copy the firehose frames of the DIDs in consumers' watchlists to the streams they read",
+		Before: service.LoadConfig("index"),
+		Action: run,
+		Flags:  flags(),
+		Subcommands: []*cli.Command{
+			{
+				Name:   "validate",
+				Usage:  "check the configuration and exit",
+				Flags:  flags(),
+				Before: service.LoadConfig("index"),
+				Action: validate,
+			},
+		},
+	}
+}
+
+func flags() []cli.Flag {
+	return []cli.Flag{
+		service.ConfigFlag(),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    "nats-url",
+			Usage:   "NATS server URL",
+			Value:   "nats://localhost:4222",
+			EnvVars: []string{"NATS_URL"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    "durable",
+			Usage:   "durable consumer of the raw frames; indexers with the same one split the frames",
+			Value:   "indexer",
+			EnvVars: []string{"INDEXER_DURABLE"},
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:    "workers",
+			Usage:   "batches matched and copied concurrently (default: one per CPU)",
+			EnvVars: []string{"WORKERS"},
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:    "batch-size",
+			Usage:   "frames fetched per batch",
+			Value:   500,
+			EnvVars: []string{"BATCH_SIZE"},
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:    "stream-max-age",
+			Usage:   "how long the FPAAS_WATCHED stream keeps frames",
+			Value:   firehose.DefaultStreamOptions.MaxAge,
+			EnvVars: []string{"STREAM_MAX_AGE"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    "stream-storage",
+			Usage:   "stream storage (memory, file); only applies when the stream is created",
+			Value:   "memory",
+			EnvVars: []string{"STREAM_STORAGE"},
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:    "stream-replicas",
+			Usage:   "stream replicas in a NATS cluster",
+			Value:   firehose.DefaultStreamOptions.Replicas,
+			EnvVars: []string{"STREAM_REPLICAS"},
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:    "stream-duplicate-window",
+			Usage:   "how long the stream drops frames copied twice",
+			Value:   firehose.DefaultStreamOptions.DuplicateWindow,
+			EnvVars: []string{"STREAM_DUPLICATE_WINDOW"},
+		}),
+		altsrc.NewStringFlag(service.MetricsAddrFlag(":8089")),
+		altsrc.NewStringFlag(service.LogLevelFlag("info")),
+	}
+}
+
+// indexerOptions checks the flags shared by run and validate.
+func indexerOptions(cctx *cli.Context) (firehose.IndexerOptions, error) {
+	opts := firehose.IndexerOptions{
+		Durable:   cctx.String("durable"),
+		Workers:   cctx.Int("workers"),
+		BatchSize: cctx.Int("batch-size"),
+		Stream: firehose.StreamOptions{
+			MaxAge:          cctx.Duration("stream-max-age"),
+			Replicas:        cctx.Int("stream-replicas"),
+			DuplicateWindow: cctx.Duration("stream-duplicate-window"),
+		},
+	}
+	// Resolved at run time, after service.Main set GOMAXPROCS from the CPU
+	// quota
+	if opts.Workers == 0 {
+		opts.Workers = runtime.GOMAXPROCS(0)
+	}
+	if opts.Durable == "" || strings.ContainsAny(opts.Durable, ".*> \t") {
+		return opts, fmt.Errorf("durable must be set and not contain '.', '*', '>' or spaces, got %q", opts.Durable)
+	}
+	if opts.Workers < 0 || opts.BatchSize < 1 {
+		return opts, errors.New("workers must not be negative and batch-size must be at least 1")
+	}
+	switch cctx.String("stream-storage") {
+	case "memory":
+		opts.Stream.Storage = nats.MemoryStorage
+	case "file":
+		opts.Stream.Storage = nats.FileStorage
+	default:
+		return opts, fmt.Errorf("stream-storage must be memory or file, got %q", cctx.String("stream-storage"))
+	}
+	if s := opts.Stream; s.MaxAge <= 0 || s.DuplicateWindow <= 0 || s.DuplicateWindow > s.MaxAge {
+		return opts, errors.New("stream-max-age and stream-duplicate-window must be positive, with the window no longer than the max age")
+	}
+	if opts.Stream.Replicas < 1 || opts.Stream.Replicas > 5 {
+		return opts, errors.New("stream-replicas must be between 1 and 5")
+	}
+	return opts, nil
+}
+
+func validate(cctx *cli.Context) error {
+	opts, err := indexerOptions(cctx)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stdout, "configuration is valid (%d worker(s))\n", opts.Workers)
+	return nil
+}
+
+func run(cctx *cli.Context) error {
+	opts, err := indexerOptions(cctx)
+	if err != nil {
+		return err
+	}
+
+	rt := service.NewRuntime(cctx, "index", cctx.String("metrics-addr"))
+	logger := rt.Logger
+
+	nc, err := nats.Connect(cctx.String("nats-url"))
+	if err != nil {
+		return fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+	rt.OnStop(func(context.Context) error {
+		nc.Close()
+		return nil
+	})
+	rt.ReadinessCheck("nats", service.NATSCheck(nc))
+
+	js, err := nc.JetStream()
+	if err != nil {
+		return fmt.Errorf("failed to create JetStream context: %w", err)
+	}
+	x, err := firehose.NewIndexer(js, opts, logger)
+	if err != nil {
+		return err
+	}
+	rt.OnStop(func(context.Context) error {
+		return x.Close()
+	})
+
+	service.WatchConfig(rt.Context(), cctx, "index", flags, logger, func(rctx *cli.Context) error {
+		if _, err := indexerOptions(rctx); err != nil {
+			return err
+		}
+		logger.Warn("indexer settings apply on restart")
+		return nil
+	})
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "indexer_frames_indexed_total",
+			Help: "Frames matched against the watchlists",
+		}, func() float64 { return float64(x.GetIndexedFrames()) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "indexer_frames_copied_total",
+			Help: "Copies of frames published to the FPAAS_WATCHED stream, one per consumer watching a DID they concern",
+		}, func() float64 { return float64(x.GetCopiedFrames()) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "indexer_publish_failures_total",
+			Help: "Frames whose copies failed, which are indexed again",
+		}, func() float64 { return float64(x.GetFailedFrames()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "indexer_watched_dids",
+			Help: "Distinct DIDs in the watchlists",
+		}, func() float64 { return float64(x.GetWatchedDIDs()) }),
+	)
+	rt.Mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+
+	logger.Info("indexer started", "durable", opts.Durable, "workers", opts.Workers, "batch_size", opts.BatchSize, "watched_dids", x.GetWatchedDIDs(), "stream", firehose.WatchStream)
+	return rt.Run(x.Run)
+}
@@ -0,0 +1,317 @@
+// Package ingest is the shuffler: it reads the ATProto firehose from a relay
+// and publishes every frame to the NATS stream.
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/internal/pkg/registry"
+	"github.com/eurosky/firehose-processor-aas/internal/pkg/service"
+	"github.com/eurosky/firehose-processor-aas/internal/pkg/tracing"
+	"github.com/eurosky/firehose-processor-aas/pkg/events"
+	"github.com/eurosky/firehose-processor-aas/pkg/firehose"
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/urfave/cli/v2"
+	"github.com/urfave/cli/v2/altsrc"
+)
+
+// Command is the shuffler command, "fpaas ingest".
+func Command() *cli.Command {
+	return &cli.Command{
+		Name:   "ingest",
+		Usage:  "ATProto firehose to NATS shuffler service",
+		Before: service.LoadConfig("ingest"),
+		Action: run,
+		Flags:  flags(),
+		Subcommands: []*cli.Command{
+			{
+				Name:   "validate",
+				Usage:  "check the configuration and exit",
+				Flags:  flags(),
+				Before: service.LoadConfig("ingest"),
+				Action: validate,
+			},
+		},
+	}
+}
+
+func flags() []cli.Flag {
+	return []cli.Flag{
+		service.ConfigFlag(),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    "relay-host",
+			Usage:   "firehose relay host (e.g., wss://bsky.network); required",
+			EnvVars: []string{"RELAY_HOST"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    "nats-url",
+			Usage:   "NATS server URL",
+			Value:   "nats://localhost:4222",
+			EnvVars: []string{"NATS_URL"},
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:    "stream-max-age",
+			Usage:   "how long the stream keeps frames",
+			Value:   firehose.DefaultStreamOptions.MaxAge,
+			EnvVars: []string{"STREAM_MAX_AGE"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    "stream-storage",
+			Usage:   "stream storage (memory, file); only applies when the stream is created",
+			Value:   "memory",
+			EnvVars: []string{"STREAM_STORAGE"},
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:    "stream-replicas",
+			Usage:   "stream replicas in a NATS cluster",
+			Value:   firehose.DefaultStreamOptions.Replicas,
+			EnvVars: []string{"STREAM_REPLICAS"},
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:    "stream-duplicate-window",
+			Usage:   "how long the stream drops frames published twice",
+			Value:   firehose.DefaultStreamOptions.DuplicateWindow,
+			EnvVars: []string{"STREAM_DUPLICATE_WINDOW"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    "dedup-id",
+			Usage:   "how the stream tells frames published twice apart: hash them with sha256 or xxhash, or use the relay's seq",
+			Value:   string(firehose.DefaultStreamOptions.DedupID),
+			EnvVars: []string{"DEDUP_ID"},
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:    "purge-account-statuses",
+			Usage:   "on an #account frame with one of these statuses (deleted, takendown, deactivated, ...), delete the account's earlier frames from the stream",
+			EnvVars: []string{"PURGE_ACCOUNT_STATUSES"},
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:    "labelers",
+			Usage:   "labeler hosts (e.g., wss://mod.bsky.app) whose labels are kept in NATS KV for consumers filtering on labels",
+			EnvVars: []string{"LABELERS"},
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:    "leader-election",
+			Usage:   "run active/standby: only the instance holding the lease in NATS KV reads from the relay",
+			EnvVars: []string{"LEADER_ELECTION"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    "instance-id",
+			Usage:   "unique instance name for leader election and the pipeline registry (default: hostname)",
+			EnvVars: []string{"INSTANCE_ID"},
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:    "lease-ttl",
+			Usage:   "leader lease TTL; a standby takes over at most this long after the leader dies",
+			Value:   10 * time.Second,
+			EnvVars: []string{"LEASE_TTL"},
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:    "handoff",
+			Usage:   "on start, take over from the running instance at the cursor it stops at; exit once a new instance took over",
+			EnvVars: []string{"HANDOFF"},
+		}),
+		altsrc.NewStringFlag(service.MetricsAddrFlag(":8080")),
+		altsrc.NewStringFlag(service.LogLevelFlag("debug")),
+	}
+}
+
+// streamOptions checks the flags shared by run and validate.
+func streamOptions(cctx *cli.Context) (firehose.StreamOptions, error) {
+	if cctx.String("relay-host") == "" {
+		return firehose.StreamOptions{}, errors.New("relay-host is required")
+	}
+	u, err := url.Parse(cctx.String("relay-host"))
+	if err != nil || (u.Scheme != "ws" && u.Scheme != "wss") {
+		return firehose.StreamOptions{}, fmt.Errorf("relay-host must be a ws:// or wss:// URL, got %q", cctx.String("relay-host"))
+	}
+	if cctx.Bool("leader-election") && cctx.Duration("lease-ttl") < 3*time.Second {
+		return firehose.StreamOptions{}, errors.New("lease-ttl must be at least 3s")
+	}
+
+	opts := firehose.StreamOptions{
+		MaxAge:               cctx.Duration("stream-max-age"),
+		Replicas:             cctx.Int("stream-replicas"),
+		DuplicateWindow:      cctx.Duration("stream-duplicate-window"),
+		PurgeAccountStatuses: cctx.StringSlice("purge-account-statuses"),
+		Labelers:             cctx.StringSlice("labelers"),
+	}
+	if opts.DedupID, err = firehose.ParseDedupID(cctx.String("dedup-id")); err != nil {
+		return opts, err
+	}
+	switch cctx.String("stream-storage") {
+	case "memory":
+		opts.Storage = nats.MemoryStorage
+	case "file":
+		opts.Storage = nats.FileStorage
+	default:
+		return opts, fmt.Errorf("stream-storage must be memory or file, got %q", cctx.String("stream-storage"))
+	}
+	if opts.MaxAge <= 0 || opts.DuplicateWindow <= 0 || opts.DuplicateWindow > opts.MaxAge {
+		return opts, errors.New("stream-max-age and stream-duplicate-window must be positive, with the window no longer than the max age")
+	}
+	if opts.Replicas < 1 || opts.Replicas > 5 {
+		return opts, errors.New("stream-replicas must be between 1 and 5")
+	}
+	if slices.Contains(opts.PurgeAccountStatuses, "") {
+		return opts, errors.New("purge-account-statuses must not contain an empty status")
+	}
+	for _, host := range opts.Labelers {
+		if u, err := url.Parse(host); err != nil || (u.Scheme != "ws" && u.Scheme != "wss") {
+			return opts, fmt.Errorf("labelers must be ws:// or wss:// URLs, got %q", host)
+		}
+	}
+	return opts, nil
+}
+
+func validate(cctx *cli.Context) error {
+	if _, err := streamOptions(cctx); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stdout, "configuration is valid (relay %s)\n", cctx.String("relay-host"))
+	return nil
+}
+
+func run(cctx *cli.Context) error {
+	rt := service.NewRuntime(cctx, "ingest", cctx.String("metrics-addr"))
+	logger := rt.Logger
+	relayHost := cctx.String("relay-host")
+	natsURL := cctx.String("nats-url")
+
+	opts, err := streamOptions(cctx)
+	if err != nil {
+		return err
+	}
+
+	// Registered first so spans are flushed after everything else stopped
+	shutdownTracing, err := tracing.Setup(rt.Context(), "fpaas-ingest")
+	if err != nil {
+		return err
+	}
+	rt.OnStop(shutdownTracing)
+
+	s, err := firehose.NewSimpleSubscriber(relayHost, natsURL, opts, logger)
+	if err != nil {
+		logger.Error("failed to create subscriber", "error", err)
+		return err
+	}
+	rt.OnStop(func(context.Context) error {
+		s.Close()
+		return nil
+	})
+	rt.ReadinessCheck("stream", s.Healthy)
+
+	service.WatchConfig(rt.Context(), cctx, "ingest", flags, logger, func(rctx *cli.Context) error {
+		opts, err := streamOptions(rctx)
+		if err != nil {
+			return err
+		}
+		for _, name := range []string{"relay-host", "nats-url", "dedup-id", "leader-election", "instance-id", "lease-ttl", "handoff"} {
+			if rctx.Value(name) != cctx.Value(name) {
+				logger.Warn("setting changes apply on restart", "setting", name)
+			}
+		}
+		for _, name := range []string{"purge-account-statuses", "labelers"} {
+			if !slices.Equal(rctx.StringSlice(name), cctx.StringSlice(name)) {
+				logger.Warn("setting changes apply on restart", "setting", name)
+			}
+		}
+		// The relay connection is left alone
+		return s.ConfigureStream(opts)
+	})
+
+	// Prometheus metrics endpoint, on its own registry so ingest and consume
+	// can share a process
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "firehose_messages_read_total",
+			Help: "Total number of messages read from the ATProto firehose",
+		}, func() float64 { return float64(s.GetTotalEvents()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "firehose_cursor_position",
+			Help: "Current cursor position (sequence number) in the firehose",
+		}, func() float64 { return float64(s.GetLastCursor()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "firehose_event_lag_seconds",
+			Help: "Time since the relay event time of the last published frame",
+		}, func() float64 {
+			t := s.GetLastEventTime()
+			if t.IsZero() {
+				return 0
+			}
+			return time.Since(t).Seconds()
+		}),
+	)
+	if len(opts.PurgeAccountStatuses) > 0 {
+		reg.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "firehose_purged_frames_total",
+			Help: "Total number of frames deleted from the stream because their account was purged",
+		}, func() float64 { return float64(s.GetPurgedFrames()) }))
+	}
+	if len(opts.Labelers) > 0 {
+		reg.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "firehose_labels_applied_total",
+			Help: "Total number of labels read from the labelers",
+		}, func() float64 { return float64(s.GetAppliedLabels()) }))
+	}
+	if cctx.Bool("leader-election") {
+		reg.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "shuffler_leader",
+			Help: "Whether this instance holds the leader lease",
+		}, func() float64 {
+			if s.IsLeader() {
+				return 1
+			}
+			return 0
+		}))
+	}
+	rt.Mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+
+	id := cctx.String("instance-id")
+	if id == "" {
+		id, _ = os.Hostname()
+	}
+	rt.Go(func(ctx context.Context) error {
+		err := registry.Publish(ctx, s.JetStream(), func() registry.Entries {
+			return registry.Ingest(events.IngestStatus{
+				Instance:      id,
+				Relay:         relayHost,
+				Connected:     s.IsConnected(),
+				Leader:        !cctx.Bool("leader-election") || s.IsLeader(),
+				Cursor:        s.GetLastCursor(),
+				Frames:        s.GetTotalEvents(),
+				LastEventTime: s.GetLastEventTime(),
+				Updated:       time.Now().UTC(),
+			})
+		}, logger)
+		if err != nil {
+			logger.Warn("failed to register in the pipeline registry", "error", err)
+		}
+		return nil
+	})
+
+	return rt.Run(func(ctx context.Context) error {
+		if cctx.Bool("leader-election") {
+			return s.RunWithLeaderElection(ctx, firehose.LeaderConfig{
+				InstanceID: id,
+				LeaseTTL:   cctx.Duration("lease-ttl"),
+				Handoff:    cctx.Bool("handoff"),
+			})
+		}
+		if cctx.Bool("handoff") {
+			return s.RunWithHandoff(ctx, id)
+		}
+		return s.Run(ctx)
+	})
+}
@@ -0,0 +1,95 @@
+package receive
+
+import (
+	"fmt"
+	"math/rand"
+	"slices"
+	"strconv"
+
+	"github.com/eurosky/firehose-processor-aas/pkg/events"
+	"github.com/eurosky/firehose-processor-aas/pkg/webhookclient"
+	"github.com/urfave/cli/v2"
+	"github.com/urfave/cli/v2/altsrc"
+)
+
+func ackFlags() []cli.Flag {
+	return []cli.Flag{
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:    "ack",
+			Usage:   "answer every delivery with a JSON body listing the accepted and rejected events (see schema/json/ack.schema.json)",
+			EnvVars: []string{"ACK"},
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:    "reject-seqs",
+			Usage:   "reject the events with these relay sequence numbers in the ack body (implies --ack)",
+			EnvVars: []string{"REJECT_SEQS"},
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:    "reject-types",
+			Usage:   "reject the events of these frame types (#commit, #identity, ...) in the ack body (implies --ack)",
+			EnvVars: []string{"REJECT_TYPES"},
+		}),
+		altsrc.NewFloat64Flag(&cli.Float64Flag{
+			Name:    "reject-rate",
+			Usage:   "reject this fraction of events (0-1) in the ack body (implies --ack)",
+			EnvVars: []string{"REJECT_RATE"},
+		}),
+	}
+}
+
+// acker builds the ack body of deliveries, rejecting the events the flags
+// select. A nil acker answers without a body.
+type acker struct {
+	seqs  []int64
+	types []string
+	rate  float64
+}
+
+func newAcker(cctx *cli.Context) (*acker, error) {
+	a := &acker{types: cctx.StringSlice("reject-types"), rate: cctx.Float64("reject-rate")}
+	for _, s := range cctx.StringSlice("reject-seqs") {
+		seq, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sequence %q in reject-seqs", s)
+		}
+		a.seqs = append(a.seqs, seq)
+	}
+	if a.rate < 0 || a.rate > 1 {
+		return nil, fmt.Errorf("reject-rate must be between 0 and 1, got %g", a.rate)
+	}
+	if !cctx.Bool("ack") && len(a.seqs) == 0 && len(a.types) == 0 && a.rate == 0 {
+		return nil, nil
+	}
+	return a, nil
+}
+
+// ack lists every event of d as accepted or rejected. Frames that don't
+// decode are rejected.
+func (a *acker) ack(d *webhookclient.Delivery) events.Ack {
+	ack := events.Ack{Accepted: []events.AckEvent{}, Rejected: []events.AckEvent{}}
+	for i := range d.Len() {
+		e := events.AckEvent{Index: i}
+		f, err := d.Frame(i)
+		if err == nil {
+			e.Seq = f.Seq()
+		}
+		switch {
+		case err != nil:
+			e.Reason = "invalid frame"
+		case slices.Contains(a.seqs, e.Seq):
+			e.Reason = "rejected sequence"
+		case slices.Contains(a.types, f.Type):
+			e.Reason = "rejected frame type " + f.Type
+		case a.rate > 0 && rand.Float64() < a.rate:
+			e.Reason = "rejected at random"
+		}
+		if e.Reason == "" {
+			ack.Accepted = append(ack.Accepted, e)
+		} else {
+			ack.Rejected = append(ack.Rejected, e)
+		}
+	}
+	ackedEvents.WithLabelValues("accepted").Add(float64(len(ack.Accepted)))
+	ackedEvents.WithLabelValues("rejected").Add(float64(len(ack.Rejected)))
+	return ack
+}
@@ -0,0 +1,148 @@
+package receive
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/internal/pkg/service"
+	"github.com/urfave/cli/v2"
+	"github.com/urfave/cli/v2/altsrc"
+)
+
+// restarts is how many times the counters were restored from --counters-file.
+var restarts int64
+
+func counterFlags() []cli.Flag {
+	return []cli.Flag{
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    "counters-file",
+			Usage:   "JSON file the call and event counters and each consumer's highest sequence are saved to, and restored from on start, so benchmarks can span restarts",
+			EnvVars: []string{"COUNTERS_FILE"},
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:    "counters-interval",
+			Usage:   "how often --counters-file is written, besides on shutdown",
+			Value:   10 * time.Second,
+			EnvVars: []string{"COUNTERS_INTERVAL"},
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:    "reset",
+			Usage:   "start from zero rather than the counters in --counters-file, which are overwritten",
+			EnvVars: []string{"RESET"},
+		}),
+	}
+}
+
+// savedCounters is the content of --counters-file.
+type savedCounters struct {
+	SavedAt   time.Time                `json:"saved_at"`
+	Restarts  int64                    `json:"restarts"`
+	Calls     int64                    `json:"calls"`
+	Events    int64                    `json:"events"`
+	Consumers map[string]savedConsumer `json:"consumers"`
+}
+
+type savedConsumer struct {
+	Calls    int64 `json:"calls"`
+	Events   int64 `json:"events"`
+	MaxBatch int   `json:"max_batch"`
+	// HighestSeq lets the sequence checks go on across restarts
+	HighestSeq uint64 `json:"highest_seq,omitempty"`
+}
+
+// persistCounters restores the counters saved in path, unless reset, and
+// saves them every interval and once the server stopped.
+func persistCounters(rt *service.Runtime, path string, reset bool, interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("counters-interval must be positive, got %s", interval)
+	}
+	if reset {
+		rt.Logger.Info("counters reset", "file", path)
+	} else {
+		saved, err := restoreCounters(path)
+		if err != nil {
+			return err
+		}
+		if !saved.SavedAt.IsZero() {
+			rt.Logger.Info("counters restored", "file", path, "saved_at", saved.SavedAt,
+				"webhook_calls", saved.Calls, "total_events", saved.Events, "restarts", saved.Restarts+1)
+		}
+	}
+	// Saved right away, so --reset takes effect even if the receiver dies
+	if err := saveCounters(path); err != nil {
+		return err
+	}
+
+	rt.Go(func(ctx context.Context) error {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-ticker.C:
+				if err := saveCounters(path); err != nil {
+					rt.Logger.Warn("failed to save counters", "error", err)
+				}
+			}
+		}
+	})
+	rt.OnStop(func(context.Context) error {
+		return saveCounters(path)
+	})
+	return nil
+}
+
+// restoreCounters loads the counters saved in path, if any, and counts the
+// restart.
+func restoreCounters(path string) (savedCounters, error) {
+	var saved savedCounters
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return saved, nil
+	}
+	if err != nil {
+		return saved, fmt.Errorf("failed to read counters: %w", err)
+	}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return saved, fmt.Errorf("invalid counters file %s (start with --reset to overwrite it): %w", path, err)
+	}
+
+	atomic.StoreInt64(&totalWebhookCalls, saved.Calls)
+	atomic.StoreInt64(&totalEvents, saved.Events)
+	atomic.StoreInt64(&restarts, saved.Restarts+1)
+	consumers.restore(saved.Consumers)
+	sequences.restore(saved.Consumers)
+	return saved, nil
+}
+
+// saveCounters writes the counters to path, through a temporary file so a
+// crash midway leaves the previous ones.
+func saveCounters(path string) error {
+	saved := savedCounters{
+		SavedAt:  time.Now().UTC(),
+		Restarts: atomic.LoadInt64(&restarts),
+		Calls:    atomic.LoadInt64(&totalWebhookCalls),
+		Events:   atomic.LoadInt64(&totalEvents),
+	}
+	saved.Consumers = consumers.snapshot()
+	sequences.snapshot(saved.Consumers)
+
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("failed to save counters: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to save counters: %w", err)
+	}
+	return nil
+}
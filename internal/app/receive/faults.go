@@ -0,0 +1,179 @@
+package receive
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"github.com/urfave/cli/v2/altsrc"
+)
+
+func faultFlags() []cli.Flag {
+	return []cli.Flag{
+		altsrc.NewFloat64Flag(&cli.Float64Flag{
+			Name:    "error-rate",
+			Usage:   "fraction of webhook calls (0-1) answered with 500",
+			EnvVars: []string{"ERROR_RATE"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    "latency",
+			Usage:   "delay before answering a webhook call, with optional uniform jitter (500ms, 500ms±200ms or 500ms+-200ms)",
+			EnvVars: []string{"LATENCY"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    "status-sequence",
+			Usage:   "statuses answered in turn, repeating (500,500,200); a 2xx processes the call normally",
+			EnvVars: []string{"STATUS_SEQUENCE"},
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:    "drop-connections",
+			Usage:   "close the connection without answering instead of returning the injected error status",
+			EnvVars: []string{"DROP_CONNECTIONS"},
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:    "rate-limit-after",
+			Usage:   "answer 429 with Retry-After to the calls beyond this many per second (0 disables)",
+			EnvVars: []string{"RATE_LIMIT_AFTER"},
+		}),
+	}
+}
+
+// faults makes the receiver misbehave so the consumer's retries, circuit
+// breaker and backoff can be tested end to end. The zero value injects
+// nothing.
+type faults struct {
+	errorRate      float64
+	latency        time.Duration
+	jitter         time.Duration
+	statuses       []int
+	drop           bool
+	rateLimitAfter int
+
+	mu          sync.Mutex
+	calls       int
+	window      time.Time
+	windowCalls int
+}
+
+func newFaults(cctx *cli.Context) (*faults, error) {
+	f := &faults{
+		errorRate:      cctx.Float64("error-rate"),
+		drop:           cctx.Bool("drop-connections"),
+		rateLimitAfter: cctx.Int("rate-limit-after"),
+	}
+	if f.errorRate < 0 || f.errorRate > 1 {
+		return nil, fmt.Errorf("error-rate must be between 0 and 1, got %g", f.errorRate)
+	}
+	if f.rateLimitAfter < 0 {
+		return nil, fmt.Errorf("rate-limit-after must not be negative, got %d", f.rateLimitAfter)
+	}
+
+	if s := cctx.String("latency"); s != "" {
+		base, jitter, found := strings.Cut(strings.ReplaceAll(s, "+-", "±"), "±")
+		var err error
+		if f.latency, err = time.ParseDuration(strings.TrimSpace(base)); err != nil {
+			return nil, fmt.Errorf("invalid latency %q: %w", s, err)
+		}
+		if found {
+			if f.jitter, err = time.ParseDuration(strings.TrimSpace(jitter)); err != nil {
+				return nil, fmt.Errorf("invalid latency jitter %q: %w", s, err)
+			}
+		}
+		if f.latency < 0 || f.jitter < 0 {
+			return nil, fmt.Errorf("latency must not be negative, got %q", s)
+		}
+	}
+
+	if s := cctx.String("status-sequence"); s != "" {
+		for _, part := range strings.Split(s, ",") {
+			status, err := strconv.Atoi(strings.TrimSpace(part))
+			if err != nil || status < 200 || status > 599 {
+				return nil, fmt.Errorf("invalid status %q in status-sequence", part)
+			}
+			f.statuses = append(f.statuses, status)
+		}
+	}
+	return f, nil
+}
+
+// wrap applies the faults to the requests before next sees them. The latency
+// comes first, then the rate limit, the status sequence and the error rate.
+func (f *faults) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if d := f.delay(); d > 0 {
+			select {
+			case <-time.After(d):
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		inject := func(kind string) {
+			injectedFaults.WithLabelValues(kind).Inc()
+			setReason(r.Context(), "injected_"+kind)
+		}
+
+		limited, status := f.next()
+		switch {
+		case limited:
+			inject("rate_limit")
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "rate limited", http.StatusTooManyRequests)
+			return
+		case status == 0 && f.errorRate > 0 && rand.Float64() < f.errorRate:
+			status = http.StatusInternalServerError
+		case status < 300:
+			status = 0
+		}
+		if status == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if f.drop {
+			if conn, _, err := http.NewResponseController(w).Hijack(); err == nil {
+				inject("drop")
+				conn.Close()
+				return
+			}
+		}
+		inject("status_" + strconv.Itoa(status))
+		http.Error(w, "injected failure", status)
+	})
+}
+
+func (f *faults) delay() time.Duration {
+	if f.jitter == 0 {
+		return f.latency
+	}
+	d := f.latency + time.Duration(rand.Int63n(int64(2*f.jitter)+1)) - f.jitter
+	return max(d, 0)
+}
+
+// next counts the call and reports whether it exceeds the rate limit, or
+// else its status from the sequence (0 without one). Rate-limited calls don't
+// advance the sequence.
+func (f *faults) next() (limited bool, status int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.rateLimitAfter > 0 {
+		now := time.Now().Truncate(time.Second)
+		if !now.Equal(f.window) {
+			f.window, f.windowCalls = now, 0
+		}
+		f.windowCalls++
+		if f.windowCalls > f.rateLimitAfter {
+			return true, 0
+		}
+	}
+	if len(f.statuses) > 0 {
+		status = f.statuses[f.calls%len(f.statuses)]
+		f.calls++
+	}
+	return false, status
+}
@@ -0,0 +1,233 @@
+package receive
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/pkg/events"
+	"github.com/eurosky/firehose-processor-aas/pkg/webhookclient"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+// registry holds the receiver metrics, apart from the default registry used
+// by consume so all-in-one serves each on its own port.
+var registry = prometheus.NewRegistry()
+
+var (
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "webhook_request_duration_seconds",
+		Help:    "Time to answer webhook calls, injected latency included, by consumer and status",
+		Buckets: []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	}, []string{"consumer", "status"})
+	requestBodySize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "webhook_request_body_bytes",
+		Help:    "Size of webhook bodies as sent, by consumer and status",
+		Buckets: prometheus.ExponentialBuckets(256, 4, 10),
+	}, []string{"consumer", "status"})
+	batchSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "webhook_consumer_batch_size",
+		Help:    "Events per webhook call, by consumer",
+		Buckets: []float64{1, 5, 10, 25, 50, 100, 250, 500, 1000},
+	}, []string{"consumer"})
+	interArrival = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "webhook_consumer_interarrival_seconds",
+		Help:    "Time between two webhook calls of a consumer",
+		Buckets: []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"consumer"})
+	consumerCalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_consumer_calls_total",
+		Help: "Webhook calls received, by consumer",
+	}, []string{"consumer"})
+	redeliveredCalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_consumer_redelivered_calls_total",
+		Help: "Webhook calls flagged X-Redelivered, by consumer",
+	}, []string{"consumer"})
+	consumerEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_consumer_events_total",
+		Help: "Events received, by consumer",
+	}, []string{"consumer"})
+	eventRate = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "webhook_consumer_events_per_second",
+		Help: "Events received per second over the last " + rateInterval.String() + ", by consumer",
+	}, []string{"consumer"})
+
+	formatCalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_format_calls_total",
+		Help: "Webhook calls decoded, by payload format (json, ndjson, cloudevents, protobuf, avro)",
+	}, []string{"format"})
+	formatEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_format_events_total",
+		Help: "Events received, by payload format",
+	}, []string{"format"})
+
+	invalidPayloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_invalid_payloads_total",
+		Help: "Payloads answered with an error, by reason",
+	}, []string{"reason"})
+	injectedFaults = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_injected_faults_total",
+		Help: "Webhook calls failed on purpose by the failure injection flags, by kind",
+	}, []string{"kind"})
+	sequenceAnomalies = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_sequence_anomalies_total",
+		Help: "Deliveries whose stream range isn't right after the consumer's previous one, by consumer and type (gap, duplicate, overlap, out_of_order)",
+	}, []string{"consumer", "type"})
+	ackedEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_acked_events_total",
+		Help: "Events listed in ack bodies (--ack), by result (accepted, rejected)",
+	}, []string{"result"})
+	shedRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "webhook_shed_requests_total",
+		Help: "Webhook calls answered 503 because the --max-concurrent slots and the queue were full",
+	})
+	// Duplicate deliveries are skipped, and not counted, once verified
+	signatures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_signatures_total",
+		Help: "Webhook calls checked against --secret, by result (valid, invalid)",
+	}, []string{"result"})
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "webhook_calls_total",
+			Help: "Total number of webhook HTTP calls received",
+		}, func() float64 { return float64(atomic.LoadInt64(&totalWebhookCalls)) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "webhook_events_total",
+			Help: "Total number of events received in webhook calls",
+		}, func() float64 { return float64(atomic.LoadInt64(&totalEvents)) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "webhook_restarted_total",
+			Help: "Times the receiver restarted with the counters of --counters-file",
+		}, func() float64 { return float64(atomic.LoadInt64(&restarts)) }),
+		requestDuration, requestBodySize, batchSize, interArrival,
+		consumerCalls, redeliveredCalls, consumerEvents, eventRate, formatCalls, formatEvents,
+		invalidPayloads, injectedFaults, signatures, sequenceAnomalies, ackedEvents, shedRequests,
+	)
+}
+
+type requestInfoKey struct{}
+
+// requestInfo is filled in while handling a call, for its metrics and its
+// summary on /tail.
+type requestInfo struct {
+	delivery *webhookclient.Delivery
+	reason   string
+}
+
+func (i *requestInfo) consumer() string {
+	if i.delivery == nil {
+		return ""
+	}
+	return i.delivery.Consumer
+}
+
+// setDelivery labels the call's metrics with the payload's consumer.
+func setDelivery(ctx context.Context, d *webhookclient.Delivery) {
+	if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+		info.delivery = d
+	}
+}
+
+// setReason records why the call was rejected.
+func setReason(ctx context.Context, reason string) {
+	if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+		info.reason = reason
+	}
+}
+
+// instrument records the duration and body size of the calls to next, and
+// publishes them on /tail. Connections dropped without an answer have the
+// status "dropped".
+func instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		info := &requestInfo{}
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		sw := &statusWriter{ResponseWriter: w}
+
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)))
+
+		status := "dropped"
+		if sw.status != 0 {
+			status = strconv.Itoa(sw.status)
+		}
+		duration := time.Since(start)
+		requestDuration.WithLabelValues(info.consumer(), status).Observe(duration.Seconds())
+		size := body.n
+		if size == 0 && r.ContentLength > 0 {
+			// Failed before the body was read
+			size = r.ContentLength
+		}
+		requestBodySize.WithLabelValues(info.consumer(), status).Observe(float64(size))
+
+		c := call{
+			Time:        start,
+			Status:      status,
+			ContentType: r.Header.Get("Content-Type"),
+			Bytes:       size,
+			DurationMs:  float64(duration.Microseconds()) / 1000,
+			Reason:      info.reason,
+		}
+		if d := info.delivery; d != nil {
+			c.Consumer = d.Consumer
+			c.Format = d.Format
+			c.Events = d.Len()
+			c.FirstSeq, c.LastSeq = d.FirstSeq, d.LastSeq
+			c.IdempotencyKey = d.IdempotencyKey
+			c.Attempt = d.Attempt
+			if c.Redelivered = len(d.Redelivered) > 0; c.Redelivered {
+				redeliveredCalls.WithLabelValues(d.Consumer).Inc()
+			}
+			if ack, ok := d.Response.(events.Ack); ok {
+				c.Rejected = len(ack.Rejected)
+			}
+		}
+		tail.publish(c)
+	})
+}
+
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// statusWriter remembers the status; Unwrap keeps http.ResponseController
+// working for the dropped connections.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
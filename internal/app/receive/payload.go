@@ -0,0 +1,39 @@
+package receive
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/eurosky/firehose-processor-aas/pkg/webhookclient"
+)
+
+// validatePayload checks what a strict receiver relies on: the envelope's
+// count matches its events and the X-Event-Count header, and every event is a
+// firehose frame. Undecodable bodies and bad base64 are already rejected by
+// webhookclient.
+func validatePayload(d *webhookclient.Delivery) error {
+	invalid := func(reason, format string, args ...any) error {
+		return &webhookclient.Error{Status: http.StatusBadRequest, Reason: reason, Err: fmt.Errorf(format, args...)}
+	}
+
+	if d.Consumer == "" {
+		return invalid("missing_consumer", "payload has no consumer")
+	}
+	if d.Len() == 0 {
+		return invalid("empty", "payload has no events")
+	}
+	if d.Count != d.Len() {
+		return invalid("count_mismatch", "count is %d but the payload has %d events", d.Count, d.Len())
+	}
+	header := d.Header.Get(webhookclient.EventCountHeader)
+	if n, err := strconv.Atoi(header); err != nil || n != d.Len() {
+		return invalid("event_count_header", "X-Event-Count is %q but the payload has %d events", header, d.Len())
+	}
+	for i := range d.Len() {
+		if _, err := d.Frame(i); err != nil {
+			return invalid("invalid_event", "event %d: %v", i, err)
+		}
+	}
+	return nil
+}
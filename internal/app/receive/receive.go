@@ -0,0 +1,357 @@
+// Package receive is the webhook receiver used to test consumer webhooks.
+package receive
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/internal/pkg/service"
+	"github.com/eurosky/firehose-processor-aas/pkg/webhookclient"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/urfave/cli/v2"
+	"github.com/urfave/cli/v2/altsrc"
+)
+
+var (
+	totalWebhookCalls int64
+	totalEvents       int64
+)
+
+// Command is the webhook receiver command, "fpaas receive".
+func Command() *cli.Command {
+	return &cli.Command{
+		Name:   "receive",
+		Usage:  "Simple webhook receiver for testing consumer webhooks",
+		Before: service.LoadConfig("receive"),
+		Action: run,
+		Flags:  flags(),
+		Subcommands: []*cli.Command{
+			{
+				Name:   "validate",
+				Usage:  "check the configuration and exit",
+				Flags:  flags(),
+				Before: service.LoadConfig("receive"),
+				Action: validate,
+			},
+			replayCommand(),
+		},
+	}
+}
+
+func flags() []cli.Flag {
+	return append([]cli.Flag{
+		service.ConfigFlag(),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    "port",
+			Usage:   "HTTP server port",
+			Value:   "8090",
+			EnvVars: []string{"PORT"},
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:    "validate",
+			Usage:   "check every payload (count field, X-Event-Count, decodable frames) and answer 400 to invalid ones; see webhook_invalid_payloads_total",
+			EnvVars: []string{"VALIDATE"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    "secret",
+			Usage:   "reject webhook calls without a valid X-Signature for this secret (consume --webhook-secret); see webhook_signatures_total",
+			EnvVars: []string{"WEBHOOK_SECRET"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    "store",
+			Usage:   "SQLite file to keep every accepted payload in, listed on GET /payloads and replayed by fpaas receive replay",
+			EnvVars: []string{"STORE_PATH"},
+		}),
+		altsrc.NewStringFlag(service.LogLevelFlag("info")),
+	}, slices.Concat(faultFlags(), shedFlags(), ackFlags(), counterFlags())...)
+}
+
+func validate(cctx *cli.Context) error {
+	if p, err := strconv.Atoi(cctx.String("port")); err != nil || p < 1 || p > 65535 {
+		return fmt.Errorf("port must be a number between 1 and 65535, got %q", cctx.String("port"))
+	}
+	if _, err := newFaults(cctx); err != nil {
+		return err
+	}
+	if _, err := newAcker(cctx); err != nil {
+		return err
+	}
+	if _, err := newShedder(cctx); err != nil {
+		return err
+	}
+	if cctx.Duration("counters-interval") <= 0 {
+		return fmt.Errorf("counters-interval must be positive, got %s", cctx.Duration("counters-interval"))
+	}
+	fmt.Fprintf(os.Stdout, "configuration is valid (port %s)\n", cctx.String("port"))
+	return nil
+}
+
+func run(cctx *cli.Context) error {
+	port := cctx.String("port")
+	faults, err := newFaults(cctx)
+	if err != nil {
+		return err
+	}
+	acker, err := newAcker(cctx)
+	if err != nil {
+		return err
+	}
+	shedder, err := newShedder(cctx)
+	if err != nil {
+		return err
+	}
+	if shedder != nil {
+		shedder.register()
+	}
+	rt := service.NewRuntime(cctx, "receive", ":"+port)
+	rt.Server.ReadTimeout = 10 * time.Second
+	rt.Server.WriteTimeout = 10 * time.Second
+	logger := rt.Logger
+	service.WatchConfig(rt.Context(), cctx, "receive", flags, logger, nil)
+
+	mux := rt.Mux
+
+	var st *store
+	if path := cctx.String("store"); path != "" {
+		if st, err = openStore(path); err != nil {
+			return err
+		}
+		rt.OnStop(func(context.Context) error { return st.Close() })
+	}
+	if path := cctx.String("counters-file"); path != "" {
+		if err := persistCounters(rt, path, cctx.Bool("reset"), cctx.Duration("counters-interval")); err != nil {
+			return err
+		}
+	}
+	mux.HandleFunc("GET /payloads", servePayloads(st))
+	mux.HandleFunc("GET /tail", serveTail(rt.Context()))
+
+	// Webhook endpoint
+	strict := cctx.Bool("validate")
+	secret := []byte(cctx.String("secret"))
+	webhook := instrument(shedder.wrap(faults.wrap(&webhookclient.Handler{
+		Secret:      secret,
+		Idempotency: webhookclient.NewMemoryStore(10000),
+		Logger:      logger,
+		OnReject: func(r *http.Request, err *webhookclient.Error) {
+			setReason(r.Context(), err.Reason)
+			invalidPayloads.WithLabelValues(err.Reason).Inc()
+			if err.Reason == webhookclient.ReasonSignature {
+				signatures.WithLabelValues("invalid").Inc()
+			}
+		},
+		OnDuplicate: func(ctx context.Context, d *webhookclient.Delivery) {
+			setDelivery(ctx, d)
+			setReason(ctx, anomalyDuplicate)
+			recordAnomaly(logger, anomalyDuplicate, 0, d)
+		},
+		OnDelivery: func(ctx context.Context, d *webhookclient.Delivery) error {
+			setDelivery(ctx, d)
+			if len(secret) > 0 {
+				signatures.WithLabelValues("valid").Inc()
+			}
+			if strict {
+				if err := validatePayload(d); err != nil {
+					reason := err.(*webhookclient.Error).Reason
+					invalidPayloads.WithLabelValues(reason).Inc()
+					setReason(ctx, reason)
+					logger.Warn("invalid payload", "consumer", d.Consumer, "error", err)
+					return err
+				}
+			}
+			if st != nil {
+				if err := st.insert(ctx, d); err != nil {
+					return err
+				}
+			}
+			if acker != nil {
+				d.Response = acker.ack(d)
+			}
+			anomaly, highest := sequences.observe(d)
+			recordAnomaly(logger, anomaly, highest, d)
+			consumers.record(d.Consumer, d.Len(), time.Now())
+			formatCalls.WithLabelValues(d.Format).Inc()
+			formatEvents.WithLabelValues(d.Format).Add(float64(d.Len()))
+			calls := atomic.AddInt64(&totalWebhookCalls, 1)
+			events := atomic.AddInt64(&totalEvents, int64(d.Len()))
+
+			// Log at debug level (to avoid spam)
+			logger.Debug("webhook received",
+				"webhook_call", calls,
+				"consumer", d.Consumer,
+				"batch_size", d.Len(),
+				"total_events", events,
+				"format", d.Format,
+			)
+			return nil
+		},
+	})))
+	// Paths under /webhook take the events of routed consumers
+	mux.Handle("/webhook", webhook)
+	mux.Handle("/webhook/", webhook)
+
+	// Health check endpoint
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "OK")
+	})
+
+	// Metrics endpoint (Prometheus format)
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+
+	// Root endpoint with stats
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		calls := atomic.LoadInt64(&totalWebhookCalls)
+		events := atomic.LoadInt64(&totalEvents)
+		avgBatchSize := float64(0)
+		if calls > 0 {
+			avgBatchSize = float64(events) / float64(calls)
+		}
+
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>Webhook Receiver</title>
+    <style>
+        body { font-family: monospace; padding: 20px; background: #1a1a1a; color: #e0e0e0; }
+        .stats { font-size: 20px; margin: 20px 0; }
+        .stat-item {
+            background: #2a2a2a;
+            padding: 15px;
+            margin: 10px 0;
+            border-left: 4px solid #4a9eff;
+            border-radius: 4px;
+        }
+        .stat-value {
+            color: #4a9eff;
+            font-size: 32px;
+            font-weight: bold;
+        }
+        .stat-label {
+            color: #888;
+            font-size: 14px;
+            text-transform: uppercase;
+        }
+        .endpoint {
+            background: #2a2a2a;
+            padding: 10px;
+            margin: 10px 0;
+            border-radius: 4px;
+        }
+        table { border-collapse: collapse; margin: 10px 0; }
+        th, td { padding: 8px 16px; text-align: right; border-bottom: 1px solid #333; }
+        th { color: #888; font-size: 14px; text-transform: uppercase; }
+        td:first-child, th:first-child { text-align: left; color: #4a9eff; }
+        #tail { background: #111; padding: 10px; border-radius: 4px; max-height: 400px; overflow-y: auto; font-size: 13px; }
+        #tail div { white-space: pre; }
+        #tail .failed { color: #ff6b6b; }
+        #tail .duplicate { color: #e0c070; }
+        h1 { color: #4a9eff; }
+        h2 { color: #888; font-size: 18px; margin-top: 30px; }
+    </style>
+</head>
+<body>
+    <h1>📡 Webhook Receiver</h1>
+    <div id="live">
+    <div class="stats">
+        <div class="stat-item">
+            <div class="stat-label">Webhook Calls</div>
+            <div class="stat-value">%d</div>
+        </div>
+        <div class="stat-item">
+            <div class="stat-label">Total Events</div>
+            <div class="stat-value">%d</div>
+        </div>
+        <div class="stat-item">
+            <div class="stat-label">Avg Batch Size</div>
+            <div class="stat-value">%.1f</div>
+        </div>
+        <div class="stat-item">
+            <div class="stat-label">Uptime</div>
+            <div class="stat-value">%s</div>
+        </div>
+    </div>
+    <h2>Consumers:</h2>
+`, calls, events, avgBatchSize, time.Since(startTime).Round(time.Second))
+		consumers.writeHTML(w, time.Now())
+		fmt.Fprint(w, `    </div>
+    <h2>Live Tail:</h2>
+    <div id="tail"><div style="color: #666;">Waiting for webhook calls...</div></div>
+    <h2>Endpoints:</h2>
+    <div class="endpoint">POST /webhook - Receive webhook payloads (JSON, NDJSON, CloudEvents, protobuf or Avro)</div>
+    <div class="endpoint">GET /payloads?since= - Stored payloads (with --store)</div>
+    <div class="endpoint">GET /tail - Server-sent events summarizing every webhook call</div>
+    <div class="endpoint">GET /metrics - Prometheus metrics</div>
+    <div class="endpoint">GET /health - Health check</div>
+    <p><small style="color: #666;">Stats refresh every 5 seconds, the tail as calls arrive</small></p>
+    <script>
+        const tail = document.getElementById("tail");
+        let waiting = true;
+        new EventSource("/tail").onmessage = (e) => {
+            const c = JSON.parse(e.data);
+            if (waiting) { tail.innerHTML = ""; waiting = false; }
+            const row = document.createElement("div");
+            const seq = c.first_seq ? " seq " + c.first_seq + "-" + c.last_seq : "";
+            row.textContent = c.time.slice(11, 23) + "  " + c.status.padEnd(7) + (c.consumer || "-").padEnd(20) +
+                String(c.events).padStart(5) + " events " + String(c.bytes).padStart(8) + " B " +
+                c.duration_ms.toFixed(1).padStart(8) + " ms" + seq + (c.reason ? "  " + c.reason : "");
+            if (c.reason === "duplicate") row.className = "duplicate";
+            else if (c.status !== "200") row.className = "failed";
+            tail.prepend(row);
+            while (tail.childElementCount > 200) tail.lastChild.remove();
+        };
+        setInterval(async () => {
+            const page = new DOMParser().parseFromString(await (await fetch("/")).text(), "text/html");
+            document.getElementById("live").innerHTML = page.getElementById("live").innerHTML;
+        }, 5000);
+    </script>
+</body>
+</html>
+`)
+	})
+
+	rt.Go(func(ctx context.Context) error {
+		ticker := time.NewTicker(rateInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-ticker.C:
+				consumers.updateRates(rateInterval)
+			}
+		}
+	})
+
+	// Start periodic stats logging
+	rt.Go(func(ctx context.Context) error {
+		ticker := time.NewTicker(30 * time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-ticker.C:
+				calls := atomic.LoadInt64(&totalWebhookCalls)
+				events := atomic.LoadInt64(&totalEvents)
+				logger.Info("webhook stats",
+					"webhook_calls", calls,
+					"total_events", events)
+			}
+		}
+	})
+
+	logger.Info("webhook receiver started", "port", port)
+	return rt.Run(nil)
+}
+
+var startTime = time.Now()
@@ -0,0 +1,284 @@
+package receive
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/internal/pkg/service"
+	"github.com/eurosky/firehose-processor-aas/internal/pkg/signature"
+	"github.com/eurosky/firehose-processor-aas/pkg/webhookclient"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	defaultPayloadLimit = 100
+	maxPayloadLimit     = 1000
+)
+
+// servePayloads lists the stored payloads, oldest first. Query parameters:
+// since (RFC 3339), after (a payload ID, to page) and limit. Without a store
+// it answers 404.
+func servePayloads(st *store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if st == nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "payloads are only kept with --store"})
+			return
+		}
+		q, err := parsePayloadQuery(r.URL.Query())
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		payloads, err := st.list(r.Context(), q)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, payloads)
+	}
+}
+
+func parsePayloadQuery(v url.Values) (payloadQuery, error) {
+	q := payloadQuery{Limit: defaultPayloadLimit}
+	if since := v.Get("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			return payloadQuery{}, errors.New("since must be an RFC 3339 timestamp")
+		}
+		q.Since = t
+	}
+	if after := v.Get("after"); after != "" {
+		n, err := strconv.ParseInt(after, 10, 64)
+		if err != nil {
+			return payloadQuery{}, errors.New("after must be a payload ID")
+		}
+		q.After = n
+	}
+	if limit := v.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxPayloadLimit {
+			return payloadQuery{}, fmt.Errorf("limit must be between 1 and %d", maxPayloadLimit)
+		}
+		q.Limit = n
+	}
+	return q, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func replayCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "replay",
+		Usage: "re-POST stored payloads to another webhook, oldest first",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "store",
+				Usage: "payload store written by fpaas receive --store",
+			},
+			&cli.StringFlag{
+				Name:  "from",
+				Usage: "URL of a running receiver with a store, instead of --store (http://localhost:8090)",
+			},
+			&cli.StringFlag{
+				Name:     "to",
+				Usage:    "webhook URL to POST the payloads to",
+				Required: true,
+			},
+			&cli.TimestampFlag{
+				Name:   "since",
+				Usage:  "only replay payloads received at or after this time (RFC 3339)",
+				Layout: time.RFC3339,
+			},
+			&cli.Int64Flag{
+				Name:  "after",
+				Usage: "only replay payloads with a greater ID",
+			},
+			&cli.StringFlag{
+				Name:  "secret",
+				Usage: "re-sign the bodies with this secret; by default X-Signature is replayed as received",
+			},
+			&cli.DurationFlag{
+				Name:  "timeout",
+				Usage: "timeout of each request",
+				Value: 10 * time.Second,
+			},
+		},
+		Action: replay,
+	}
+}
+
+func replay(cctx *cli.Context) error {
+	logger := service.Logger(cctx)
+	ctx, stop := service.SignalContext(cctx.Context, logger)
+	defer stop()
+
+	if (cctx.String("from") == "") == (cctx.String("store") == "") {
+		return errors.New("set exactly one of --store and --from")
+	}
+	list, closeList, err := openPayloads(cctx.String("store"), cctx.String("from"))
+	if err != nil {
+		return err
+	}
+	defer closeList()
+
+	q := payloadQuery{After: cctx.Int64("after"), Limit: defaultPayloadLimit}
+	if since := cctx.Timestamp("since"); since != nil {
+		q.Since = *since
+	}
+	client := &http.Client{Timeout: cctx.Duration("timeout")}
+	to, secret := cctx.String("to"), cctx.String("secret")
+
+	var replayed, failed int
+	for {
+		payloads, err := list(ctx, q)
+		if err != nil {
+			return err
+		}
+		for _, p := range payloads {
+			if err := post(ctx, client, to, secret, p); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				logger.Warn("failed to replay payload", "id", p.ID, "consumer", p.Consumer, "error", err)
+				failed++
+			} else {
+				logger.Debug("replayed payload", "id", p.ID, "consumer", p.Consumer, "events", p.Events)
+				replayed++
+			}
+			q.After = p.ID
+		}
+		if len(payloads) < q.Limit {
+			break
+		}
+	}
+
+	logger.Info("replay finished", "replayed", replayed, "failed", failed)
+	if failed > 0 {
+		return fmt.Errorf("%d of %d payloads failed to replay", failed, replayed+failed)
+	}
+	return nil
+}
+
+// post sends a payload the way it was received.
+func post(ctx context.Context, client *http.Client, to, secret string, p payload) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, to, bytes.NewReader(p.Body))
+	if err != nil {
+		return err
+	}
+	for k, v := range p.Header {
+		req.Header[k] = v
+	}
+	if secret != "" {
+		req.Header.Set(signature.Header, signature.Sign([]byte(secret), p.Body))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("webhook returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// fetchPayloads lists the payloads of a running receiver.
+func fetchPayloads(ctx context.Context, base string, q payloadQuery) ([]payload, error) {
+	v := url.Values{}
+	v.Set("after", strconv.FormatInt(q.After, 10))
+	v.Set("limit", strconv.Itoa(q.Limit))
+	if !q.Since.IsZero() {
+		v.Set("since", q.Since.Format(time.RFC3339))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(base, "/")+"/payloads?"+v.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list payloads: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("failed to list payloads: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var payloads []payload
+	if err := json.NewDecoder(resp.Body).Decode(&payloads); err != nil {
+		return nil, fmt.Errorf("failed to list payloads: %w", err)
+	}
+	return payloads, nil
+}
+
+// openPayloads lists the payloads of the store at path, or of the running
+// receiver at from when path is empty. The returned func closes the store.
+func openPayloads(path, from string) (func(context.Context, payloadQuery) ([]payload, error), func() error, error) {
+	if path == "" {
+		list := func(ctx context.Context, q payloadQuery) ([]payload, error) {
+			return fetchPayloads(ctx, from, q)
+		}
+		return list, func() error { return nil }, nil
+	}
+	st, err := openStore(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return st.list, st.Close, nil
+}
+
+// Received is a payload kept by a receiver, without its body.
+type Received struct {
+	ID         int64
+	ReceivedAt time.Time
+	Consumer   string
+	Events     int
+	// FirstSeq and LastSeq are the stream range the consumer sent in
+	// X-Stream-Seq-First and X-Stream-Seq-Last, zero without them.
+	FirstSeq, LastSeq uint64
+}
+
+// ListReceived calls fn with the payloads of the store written by fpaas
+// receive --store at path, or of the running receiver at from when path is
+// empty, oldest first.
+func ListReceived(ctx context.Context, path, from string, fn func(Received) error) error {
+	list, closeList, err := openPayloads(path, from)
+	if err != nil {
+		return err
+	}
+	defer closeList()
+
+	q := payloadQuery{Limit: maxPayloadLimit}
+	for {
+		payloads, err := list(ctx, q)
+		if err != nil {
+			return err
+		}
+		for _, p := range payloads {
+			r := Received{ID: p.ID, ReceivedAt: p.ReceivedAt, Consumer: p.Consumer, Events: p.Events}
+			r.FirstSeq, _ = strconv.ParseUint(p.Header.Get(webhookclient.StreamSeqFirstHeader), 10, 64)
+			r.LastSeq, _ = strconv.ParseUint(p.Header.Get(webhookclient.StreamSeqLastHeader), 10, 64)
+			if err := fn(r); err != nil {
+				return err
+			}
+			q.After = p.ID
+		}
+		if len(payloads) < q.Limit {
+			return nil
+		}
+	}
+}
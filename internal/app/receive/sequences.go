@@ -0,0 +1,94 @@
+package receive
+
+import (
+	"log/slog"
+	"sync"
+
+	"github.com/eurosky/firehose-processor-aas/pkg/webhookclient"
+)
+
+// Sequence anomalies, the type label of webhook_sequence_anomalies_total.
+const (
+	anomalyGap        = "gap"
+	anomalyDuplicate  = "duplicate"
+	anomalyOverlap    = "overlap"
+	anomalyOutOfOrder = "out_of_order"
+)
+
+// sequences checks the stream ranges of each consumer's deliveries: they
+// should follow each other without holes, repeats or reordering. Events
+// filtered out by the consumer show up as gaps, so only unfiltered consumers
+// make a clean oracle.
+var sequences = sequenceTracker{highest: make(map[string]uint64)}
+
+type sequenceTracker struct {
+	mu sync.Mutex
+	// highest is the highest stream sequence delivered per consumer
+	highest map[string]uint64
+}
+
+// observe checks an accepted delivery against the previous ones and returns
+// the anomaly, if any, with the highest sequence before it. Deliveries without
+// a range are ignored.
+func (t *sequenceTracker) observe(d *webhookclient.Delivery) (anomaly string, highest uint64) {
+	if d.FirstSeq == 0 || d.LastSeq < d.FirstSeq {
+		return "", 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	highest, seen := t.highest[d.Consumer]
+	t.highest[d.Consumer] = max(highest, d.LastSeq)
+	switch {
+	case !seen:
+		// Consumers may start anywhere in the stream
+	case d.LastSeq <= highest:
+		anomaly = anomalyOutOfOrder
+	case d.FirstSeq <= highest:
+		anomaly = anomalyOverlap
+	case d.FirstSeq > highest+1:
+		anomaly = anomalyGap
+	}
+	return anomaly, highest
+}
+
+// restore sets the highest sequences saved by a previous run.
+func (t *sequenceTracker) restore(saved map[string]savedConsumer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for name, sc := range saved {
+		if sc.HighestSeq > 0 {
+			t.highest[name] = sc.HighestSeq
+		}
+	}
+}
+
+// snapshot adds the highest sequence of each consumer to saved.
+func (t *sequenceTracker) snapshot(saved map[string]savedConsumer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for name, highest := range t.highest {
+		sc := saved[name]
+		sc.HighestSeq = highest
+		saved[name] = sc
+	}
+}
+
+// recordAnomaly counts and logs an anomaly of a delivery; highest is the
+// consumer's highest sequence before it, zero when unknown.
+func recordAnomaly(logger *slog.Logger, anomaly string, highest uint64, d *webhookclient.Delivery) {
+	if anomaly == "" {
+		return
+	}
+	sequenceAnomalies.WithLabelValues(d.Consumer, anomaly).Inc()
+	args := []any{
+		"type", anomaly,
+		"consumer", d.Consumer,
+		"first_seq", d.FirstSeq,
+		"last_seq", d.LastSeq,
+		"idempotency_key", d.IdempotencyKey,
+	}
+	if highest > 0 {
+		args = append(args, "highest_seq", highest)
+	}
+	logger.Warn("sequence anomaly", args...)
+}
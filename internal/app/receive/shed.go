@@ -0,0 +1,107 @@
+package receive
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/urfave/cli/v2"
+	"github.com/urfave/cli/v2/altsrc"
+)
+
+func shedFlags() []cli.Flag {
+	return []cli.Flag{
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:    "max-concurrent",
+			Usage:   "webhook calls handled at once; more wait in the queue or get 503 (0 is unlimited)",
+			EnvVars: []string{"MAX_CONCURRENT"},
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:    "queue-depth",
+			Usage:   "webhook calls waiting for a slot with --max-concurrent before the next ones get 503",
+			EnvVars: []string{"QUEUE_DEPTH"},
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:    "retry-after",
+			Usage:   "Retry-After of the 503 answered to shed webhook calls",
+			Value:   time.Second,
+			EnvVars: []string{"RETRY_AFTER"},
+		}),
+	}
+}
+
+// shedder bounds the webhook calls in flight, answering 503 with Retry-After
+// once the slots and the queue are full, like a saturated service would.
+type shedder struct {
+	slots      chan struct{}
+	queueDepth int64
+	retryAfter string
+	queued     atomic.Int64
+}
+
+// newShedder returns nil when --max-concurrent is unset.
+func newShedder(cctx *cli.Context) (*shedder, error) {
+	concurrent, depth := cctx.Int("max-concurrent"), cctx.Int("queue-depth")
+	if concurrent < 0 || depth < 0 {
+		return nil, fmt.Errorf("max-concurrent and queue-depth must not be negative")
+	}
+	if concurrent == 0 {
+		if depth > 0 {
+			return nil, fmt.Errorf("queue-depth needs max-concurrent")
+		}
+		return nil, nil
+	}
+	// Retry-After is in whole seconds
+	retryAfter := int((cctx.Duration("retry-after") + time.Second - 1) / time.Second)
+	return &shedder{
+		slots:      make(chan struct{}, concurrent),
+		queueDepth: int64(depth),
+		retryAfter: strconv.Itoa(max(retryAfter, 1)),
+	}, nil
+}
+
+func (s *shedder) wrap(next http.Handler) http.Handler {
+	if s == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case s.slots <- struct{}{}:
+		default:
+			if s.queued.Add(1) > s.queueDepth {
+				s.queued.Add(-1)
+				shedRequests.Inc()
+				setReason(r.Context(), "shed")
+				w.Header().Set("Retry-After", s.retryAfter)
+				http.Error(w, "overloaded", http.StatusServiceUnavailable)
+				return
+			}
+			select {
+			case s.slots <- struct{}{}:
+				s.queued.Add(-1)
+			case <-r.Context().Done():
+				s.queued.Add(-1)
+				return
+			}
+		}
+		defer func() { <-s.slots }()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// register adds the gauges of the slots and the queue to the metrics.
+func (s *shedder) register() {
+	registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "webhook_inflight_requests",
+			Help: "Webhook calls holding one of the --max-concurrent slots",
+		}, func() float64 { return float64(len(s.slots)) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "webhook_queued_requests",
+			Help: "Webhook calls waiting for a slot",
+		}, func() float64 { return float64(s.queued.Load()) }),
+	)
+}
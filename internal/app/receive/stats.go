@@ -0,0 +1,128 @@
+package receive
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// rateInterval is how often webhook_consumer_events_per_second is updated.
+const rateInterval = 10 * time.Second
+
+// consumers breaks the received calls down by the payload's consumer, for
+// the metrics and the stats page.
+var consumers = consumerStats{byName: make(map[string]*consumerStat)}
+
+type consumerStats struct {
+	mu     sync.Mutex
+	byName map[string]*consumerStat
+}
+
+type consumerStat struct {
+	calls, events int64
+	maxBatch      int
+	intervals     int64
+	intervalSum   time.Duration
+	last          time.Time
+	// events at the last rate update, and the resulting rate
+	rateEvents int64
+	rate       float64
+}
+
+func (s *consumerStats) record(consumer string, events int, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.byName[consumer]
+	if !ok {
+		c = &consumerStat{}
+		s.byName[consumer] = c
+	}
+	if !c.last.IsZero() {
+		d := now.Sub(c.last)
+		c.intervals++
+		c.intervalSum += d
+		interArrival.WithLabelValues(consumer).Observe(d.Seconds())
+	}
+	c.calls++
+	c.events += int64(events)
+	c.maxBatch = max(c.maxBatch, events)
+	c.last = now
+
+	consumerCalls.WithLabelValues(consumer).Inc()
+	consumerEvents.WithLabelValues(consumer).Add(float64(events))
+	batchSize.WithLabelValues(consumer).Observe(float64(events))
+}
+
+// restore sets the counters of the consumers saved by a previous run.
+func (s *consumerStats) restore(saved map[string]savedConsumer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, sc := range saved {
+		if sc.Calls == 0 {
+			continue
+		}
+		s.byName[name] = &consumerStat{calls: sc.Calls, events: sc.Events, maxBatch: sc.MaxBatch, rateEvents: sc.Events}
+		consumerCalls.WithLabelValues(name).Add(float64(sc.Calls))
+		consumerEvents.WithLabelValues(name).Add(float64(sc.Events))
+	}
+}
+
+// snapshot returns the counters of every consumer, to be saved.
+func (s *consumerStats) snapshot() map[string]savedConsumer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	saved := make(map[string]savedConsumer, len(s.byName))
+	for name, c := range s.byName {
+		saved[name] = savedConsumer{Calls: c.calls, Events: c.events, MaxBatch: c.maxBatch}
+	}
+	return saved
+}
+
+// updateRates sets the events per second of every consumer over the elapsed
+// time since the previous update.
+func (s *consumerStats) updateRates(elapsed time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, c := range s.byName {
+		c.rate = float64(c.events-c.rateEvents) / elapsed.Seconds()
+		c.rateEvents = c.events
+		eventRate.WithLabelValues(name).Set(c.rate)
+	}
+}
+
+// writeHTML prints a table row per consumer for the stats page.
+func (s *consumerStats) writeHTML(w io.Writer, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.byName) == 0 {
+		fmt.Fprintf(w, "    <p style=\"color: #666;\">No deliveries yet</p>\n")
+		return
+	}
+	names := make([]string, 0, len(s.byName))
+	for name := range s.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(w, "    <table>\n")
+	fmt.Fprintf(w, "        <tr><th>Consumer</th><th>Calls</th><th>Events</th><th>Events/s</th><th>Avg Batch</th><th>Max Batch</th><th>Avg Interval</th><th>Last Call</th></tr>\n")
+	for _, name := range names {
+		c := s.byName[name]
+		interval := "-"
+		if c.intervals > 0 {
+			interval = (c.intervalSum / time.Duration(c.intervals)).Round(time.Millisecond).String()
+		}
+		// Consumers restored from --counters-file have no call since
+		last := "-"
+		if !c.last.IsZero() {
+			last = now.Sub(c.last).Round(time.Second).String() + " ago"
+		}
+		fmt.Fprintf(w, "        <tr><td>%s</td><td>%d</td><td>%d</td><td>%.1f</td><td>%.1f</td><td>%d</td><td>%s</td><td>%s</td></tr>\n",
+			html.EscapeString(name), c.calls, c.events, c.rate, float64(c.events)/float64(c.calls), c.maxBatch,
+			interval, last)
+	}
+	fmt.Fprintf(w, "    </table>\n")
+}
@@ -0,0 +1,118 @@
+package receive
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/pkg/webhookclient"
+	_ "modernc.org/sqlite"
+)
+
+const storeSchema = `
+CREATE TABLE IF NOT EXISTS payloads (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	received_at TEXT NOT NULL,
+	consumer TEXT NOT NULL,
+	events INTEGER NOT NULL,
+	idempotency_key TEXT NOT NULL,
+	header TEXT NOT NULL,
+	body BLOB NOT NULL
+);
+CREATE INDEX IF NOT EXISTS payloads_received_at ON payloads (received_at);
+`
+
+// timeLayout has a fixed width, so stored times compare as strings.
+const timeLayout = "2006-01-02T15:04:05.000000000Z07:00"
+
+// Headers that describe the connection rather than the payload.
+var skipHeaders = []string{"Accept-Encoding", "Connection", "Content-Length", "User-Agent"}
+
+// payload is a received webhook call, stored as sent so it can be replayed.
+type payload struct {
+	ID             int64       `json:"id"`
+	ReceivedAt     time.Time   `json:"received_at"`
+	Consumer       string      `json:"consumer"`
+	Events         int         `json:"events"`
+	IdempotencyKey string      `json:"idempotency_key,omitempty"`
+	Header         http.Header `json:"header"`
+	Body           []byte      `json:"body"`
+}
+
+// store persists the payloads in SQLite.
+type store struct {
+	db *sql.DB
+}
+
+func openStore(path string) (*store, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open payload store: %w", err)
+	}
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(storeSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate payload store: %w", err)
+	}
+	return &store{db: db}, nil
+}
+
+func (s *store) Close() error {
+	return s.db.Close()
+}
+
+func (s *store) insert(ctx context.Context, d *webhookclient.Delivery) error {
+	header := d.Header.Clone()
+	for _, h := range skipHeaders {
+		header.Del(h)
+	}
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `INSERT INTO payloads
+		(received_at, consumer, events, idempotency_key, header, body) VALUES (?, ?, ?, ?, ?, ?)`,
+		time.Now().UTC().Format(timeLayout), d.Consumer, d.Len(), d.IdempotencyKey, string(headerJSON), d.RawBody)
+	if err != nil {
+		return fmt.Errorf("failed to store payload: %w", err)
+	}
+	return nil
+}
+
+// payloadQuery selects payloads, oldest first. Zero fields match everything.
+type payloadQuery struct {
+	Since time.Time
+	// After pages through the results: only payloads with a greater ID match.
+	After int64
+	Limit int
+}
+
+func (s *store) list(ctx context.Context, q payloadQuery) ([]payload, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, received_at, consumer, events, idempotency_key, header, body
+		FROM payloads WHERE id > ? AND received_at >= ? ORDER BY id LIMIT ?`,
+		q.After, q.Since.UTC().Format(timeLayout), q.Limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list payloads: %w", err)
+	}
+	defer rows.Close()
+
+	payloads := []payload{}
+	for rows.Next() {
+		var (
+			p                  payload
+			receivedAt, header string
+		)
+		if err := rows.Scan(&p.ID, &receivedAt, &p.Consumer, &p.Events, &p.IdempotencyKey, &header, &p.Body); err != nil {
+			return nil, fmt.Errorf("failed to list payloads: %w", err)
+		}
+		p.ReceivedAt, _ = time.Parse(time.RFC3339Nano, receivedAt)
+		if err := json.Unmarshal([]byte(header), &p.Header); err != nil {
+			return nil, fmt.Errorf("payload %d: invalid header: %w", p.ID, err)
+		}
+		payloads = append(payloads, p)
+	}
+	return payloads, rows.Err()
+}
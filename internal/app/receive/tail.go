@@ -0,0 +1,113 @@
+package receive
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// tailBuffer is how many calls a slow /tail client may lag behind before it
+// misses some.
+const tailBuffer = 256
+
+// call is the summary of a webhook call streamed on /tail.
+type call struct {
+	Time           time.Time `json:"time"`
+	Status         string    `json:"status"`
+	Consumer       string    `json:"consumer,omitempty"`
+	Events         int       `json:"events"`
+	FirstSeq       uint64    `json:"first_seq,omitempty"`
+	LastSeq        uint64    `json:"last_seq,omitempty"`
+	IdempotencyKey string    `json:"idempotency_key,omitempty"`
+	Format         string    `json:"format,omitempty"`
+	ContentType    string    `json:"content_type,omitempty"`
+	Bytes          int64     `json:"bytes"`
+	DurationMs     float64   `json:"duration_ms"`
+	// Attempt and Redelivered come from consumers with --redelivery-headers
+	Attempt     int  `json:"attempt,omitempty"`
+	Redelivered bool `json:"redelivered,omitempty"`
+	// Rejected counts the events rejected in the ack body (--ack)
+	Rejected int `json:"rejected,omitempty"`
+	// Reason is why the call was rejected, or "duplicate"
+	Reason string `json:"reason,omitempty"`
+}
+
+// tail fans the calls out to the /tail clients.
+var tail = &callTail{clients: make(map[chan call]struct{})}
+
+type callTail struct {
+	mu      sync.Mutex
+	clients map[chan call]struct{}
+}
+
+// publish never blocks: clients that fall behind miss calls.
+func (t *callTail) publish(c call) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for ch := range t.clients {
+		select {
+		case ch <- c:
+		default:
+		}
+	}
+}
+
+func (t *callTail) subscribe() chan call {
+	ch := make(chan call, tailBuffer)
+	t.mu.Lock()
+	t.clients[ch] = struct{}{}
+	t.mu.Unlock()
+	return ch
+}
+
+func (t *callTail) unsubscribe(ch chan call) {
+	t.mu.Lock()
+	delete(t.clients, ch)
+	t.mu.Unlock()
+}
+
+// serveTail streams a JSON summary of every webhook call as server-sent
+// events, until the client leaves or the receiver stops.
+func serveTail(stop context.Context) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		// The server's write timeout would cut the stream
+		if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+			http.Error(w, "streaming not supported", http.StatusInternalServerError)
+			return
+		}
+		ch := tail.subscribe()
+		defer tail.unsubscribe(ch)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		rc.Flush()
+
+		// Keeps proxies from closing an idle stream
+		heartbeat := time.NewTicker(15 * time.Second)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-stop.Done():
+				return
+			case <-heartbeat.C:
+				fmt.Fprint(w, ": heartbeat\n\n")
+			case c := <-ch:
+				b, err := json.Marshal(c)
+				if err != nil {
+					continue
+				}
+				fmt.Fprintf(w, "data: %s\n\n", b)
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,261 @@
+// Package relay is the fake ATProto relay, serving synthetic or recorded
+// frames so the pipeline runs without the public network.
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/bluesky-social/indigo/events"
+	"github.com/eurosky/firehose-processor-aas/internal/pkg/fakerelay"
+	"github.com/eurosky/firehose-processor-aas/internal/pkg/service"
+	"github.com/eurosky/firehose-processor-aas/pkg/firehose"
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/urfave/cli/v2"
+)
+
+// Command is the fake relay command, "fpaas fake-relay".
+func Command() *cli.Command {
+	return &cli.Command{
+		Name:  "fake-relay",
+		Usage: "Serve com.atproto.sync.subscribeRepos with synthetic or recorded frames",
+		Description: "Generates commits, identity and account frames from seq 1 at --rate, or replays a --replay\n" +
+			"recording made by fpaas fake-relay record. Clients resume after their cursor, as with a real relay.\n" +
+			"Point ingest at it with --relay-host ws://localhost:8092.",
+		Action: run,
+		Flags:  flags(),
+		Subcommands: []*cli.Command{
+			recordCommand(),
+		},
+	}
+}
+
+func flags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    "listen",
+			Usage:   "address of the relay, with /metrics, /healthz and /readyz",
+			Value:   ":8092",
+			EnvVars: []string{"LISTEN_ADDR"},
+		},
+		&cli.Float64Flag{
+			Name:    "rate",
+			Usage:   "frames per second",
+			Value:   100,
+			EnvVars: []string{"RATE"},
+		},
+		&cli.IntFlag{
+			Name:    "frames",
+			Usage:   "synthetic frames to send before going idle (0 for no limit)",
+			EnvVars: []string{"FRAMES"},
+		},
+		&cli.IntFlag{
+			Name:    "dids",
+			Usage:   "distinct repos in the synthetic frames",
+			Value:   1000,
+			EnvVars: []string{"DIDS"},
+		},
+		&cli.IntFlag{
+			Name:    "backlog",
+			Usage:   "synthetic frames kept for clients resuming from a cursor; older cursors start at the oldest after an OutdatedCursor info frame",
+			Value:   100000,
+			EnvVars: []string{"BACKLOG"},
+		},
+		&cli.StringFlag{
+			Name:    "replay",
+			Usage:   "recording to replay (fpaas fake-relay record) instead of synthetic frames",
+			EnvVars: []string{"REPLAY_FILE"},
+		},
+		service.LogLevelFlag("info"),
+	}
+}
+
+func run(cctx *cli.Context) error {
+	if cctx.Float64("rate") <= 0 {
+		return errors.New("rate must be positive")
+	}
+	if cctx.Int("frames") < 0 || cctx.Int("backlog") < 0 {
+		return errors.New("frames and backlog can't be negative")
+	}
+
+	var relay *fakerelay.Relay
+	source := "synthetic"
+	if path := cctx.String("replay"); path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		frames, err := fakerelay.ReadRecording(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		if len(frames) == 0 {
+			return fmt.Errorf("%s has no frames", path)
+		}
+		relay = fakerelay.NewReplay(frames, cctx.Float64("rate"))
+		source = fmt.Sprintf("%s (%d frames, seq %d to %d)", path, len(frames), frames[0].Seq, frames[len(frames)-1].Seq)
+	} else {
+		relay = fakerelay.New(fakerelay.Options{
+			Frames:  cctx.Int("frames"),
+			Rate:    cctx.Float64("rate"),
+			DIDs:    cctx.Int("dids"),
+			Backlog: cctx.Int("backlog"),
+		})
+	}
+
+	rt := service.NewRuntime(cctx, "fake-relay", cctx.String("listen"))
+	logger := rt.Logger
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "relay_frames_sent_total",
+			Help: "Frames added to the stream",
+		}, func() float64 { return float64(relay.Sent()) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "relay_frames_written_total",
+			Help: "Frames written to the clients, counting each client's copy",
+		}, func() float64 { return float64(relay.Written()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "relay_connections",
+			Help: "Connected clients",
+		}, func() float64 { return float64(relay.Connections()) }),
+	)
+	rt.Mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	rt.Mux.Handle(fakerelay.Path, relay)
+
+	relay.Start()
+	rt.OnStop(func(context.Context) error {
+		relay.Close()
+		return nil
+	})
+	logger.Info("relay started", "addr", cctx.String("listen"), "source", source, "rate", cctx.Float64("rate"))
+	return rt.Run(nil)
+}
+
+func recordCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "record",
+		Usage: "record frames of a relay to replay them with fpaas fake-relay --replay",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "relay-host",
+				Usage:    "relay to record (wss://bsky.network)",
+				Required: true,
+				EnvVars:  []string{"RELAY_HOST"},
+			},
+			&cli.StringFlag{
+				Name:     "out",
+				Usage:    "file to write the recording to",
+				Required: true,
+			},
+			&cli.IntFlag{
+				Name:  "frames",
+				Usage: "frames to record",
+				Value: 10000,
+			},
+			&cli.Int64Flag{
+				Name:  "cursor",
+				Usage: "start after this seq instead of at the live tip",
+			},
+			service.LogLevelFlag("info"),
+		},
+		Action: record,
+	}
+}
+
+// record writes frames until it has enough or is stopped; an interrupted
+// recording is still complete up to its last frame.
+func record(cctx *cli.Context) error {
+	logger := service.Logger(cctx)
+	ctx, cancel := service.SignalContext(cctx.Context, logger)
+	defer cancel()
+
+	u, err := url.Parse(cctx.String("relay-host"))
+	if err != nil {
+		return fmt.Errorf("invalid relay host URI: %w", err)
+	}
+	u.Path = fakerelay.Path
+	if cursor := cctx.Int64("cursor"); cursor > 0 {
+		u.RawQuery = url.Values{"cursor": {strconv.FormatInt(cursor, 10)}}.Encode()
+	}
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, u.String(), http.Header{
+		"User-Agent": []string{"fpaas-fake-relay-recorder/1.0"},
+	})
+	if err != nil {
+		return fmt.Errorf("subscribing to firehose failed: %w", err)
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	f, err := os.Create(cctx.String("out"))
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+
+	frames := cctx.Int("frames")
+	progress := time.NewTicker(5 * time.Second)
+	defer progress.Stop()
+	n := 0
+	for n < frames {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if ctx.Err() == nil {
+				logger.Warn("relay connection failed", "error", err)
+			}
+			break
+		}
+		if err := errorFrame(data); err != nil {
+			f.Close()
+			return err
+		}
+		if err := fakerelay.WriteFrame(w, data); err != nil {
+			f.Close()
+			return err
+		}
+		n++
+		select {
+		case <-progress.C:
+			logger.Info("recording", "frames", n)
+		default:
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	logger.Info("recording written", "path", cctx.String("out"), "frames", n)
+	return nil
+}
+
+// errorFrame returns the error of an error frame, such as FutureCursor, and
+// nil for the other frames.
+func errorFrame(data []byte) error {
+	if info, err := firehose.InspectFrame(data); err != nil || info.Type != firehose.TypeError {
+		return nil
+	}
+	var evt events.XRPCStreamEvent
+	if err := evt.Deserialize(bytes.NewReader(data)); err != nil || evt.Error == nil {
+		return nil
+	}
+	return fmt.Errorf("relay answered %s: %s", evt.Error.Error, evt.Error.Message)
+}
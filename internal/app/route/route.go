@@ -0,0 +1,218 @@
+// Package route is the router: it reads the raw frames ingest publishes,
+// decodes them and republishes them to the subjects of the ATPROTO_EVENTS
+// stream, per partition, frame type and collection.
+package route
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/eurosky/firehose-processor-aas/internal/pkg/service"
+	"github.com/eurosky/firehose-processor-aas/pkg/firehose"
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/urfave/cli/v2"
+	"github.com/urfave/cli/v2/altsrc"
+)
+
+// Command is the router command, "fpaas route".
+func Command() *cli.Command {
+	return &cli.Command{
+		Name:   "route",
+		Usage:  "Republish the raw firehose frames to subjects per partition, frame type and collection",
+		Before: service.LoadConfig("route"),
+		Action: run,
+		Flags:  flags(),
+		Subcommands: []*cli.Command{
+			{
+				Name:   "validate",
+				Usage:  "check the configuration and exit",
+				Flags:  flags(),
+				Before: service.LoadConfig("route"),
+				Action: validate,
+			},
+		},
+	}
+}
+
+func flags() []cli.Flag {
+	return []cli.Flag{
+		service.ConfigFlag(),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    "nats-url",
+			Usage:   "NATS server URL",
+			Value:   "nats://localhost:4222",
+			EnvVars: []string{"NATS_URL"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    "durable",
+			Usage:   "durable consumer of the raw frames; routers with the same one split the frames",
+			Value:   "router",
+			EnvVars: []string{"ROUTER_DURABLE"},
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:    "partitions",
+			Usage:   "partitions the frames are hashed into by DID; changing it moves repos to other partitions",
+			Value:   16,
+			EnvVars: []string{"PARTITIONS"},
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:    "workers",
+			Usage:   "batches decoded and republished concurrently (default: one per CPU)",
+			EnvVars: []string{"WORKERS"},
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:    "batch-size",
+			Usage:   "frames fetched per batch",
+			Value:   500,
+			EnvVars: []string{"BATCH_SIZE"},
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:    "stream-max-age",
+			Usage:   "how long the ATPROTO_EVENTS stream keeps frames",
+			Value:   firehose.DefaultStreamOptions.MaxAge,
+			EnvVars: []string{"STREAM_MAX_AGE"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    "stream-storage",
+			Usage:   "stream storage (memory, file); only applies when the stream is created",
+			Value:   "memory",
+			EnvVars: []string{"STREAM_STORAGE"},
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:    "stream-replicas",
+			Usage:   "stream replicas in a NATS cluster",
+			Value:   firehose.DefaultStreamOptions.Replicas,
+			EnvVars: []string{"STREAM_REPLICAS"},
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:    "stream-duplicate-window",
+			Usage:   "how long the stream drops frames republished twice",
+			Value:   firehose.DefaultStreamOptions.DuplicateWindow,
+			EnvVars: []string{"STREAM_DUPLICATE_WINDOW"},
+		}),
+		altsrc.NewStringFlag(service.MetricsAddrFlag(":8088")),
+		altsrc.NewStringFlag(service.LogLevelFlag("info")),
+	}
+}
+
+// routerOptions checks the flags shared by run and validate.
+func routerOptions(cctx *cli.Context) (firehose.RouterOptions, error) {
+	opts := firehose.RouterOptions{
+		Durable:    cctx.String("durable"),
+		Partitions: cctx.Int("partitions"),
+		Workers:    cctx.Int("workers"),
+		BatchSize:  cctx.Int("batch-size"),
+		Stream: firehose.StreamOptions{
+			MaxAge:          cctx.Duration("stream-max-age"),
+			Replicas:        cctx.Int("stream-replicas"),
+			DuplicateWindow: cctx.Duration("stream-duplicate-window"),
+		},
+	}
+	// Resolved at run time, after service.Main set GOMAXPROCS from the CPU
+	// quota
+	if opts.Workers == 0 {
+		opts.Workers = runtime.GOMAXPROCS(0)
+	}
+	if opts.Durable == "" || strings.ContainsAny(opts.Durable, ".*> \t") {
+		return opts, fmt.Errorf("durable must be set and not contain '.', '*', '>' or spaces, got %q", opts.Durable)
+	}
+	if opts.Partitions < 1 || opts.Partitions > 1024 {
+		return opts, fmt.Errorf("partitions must be between 1 and 1024, got %d", opts.Partitions)
+	}
+	if opts.Workers < 0 || opts.BatchSize < 1 {
+		return opts, errors.New("workers must not be negative and batch-size must be at least 1")
+	}
+	switch cctx.String("stream-storage") {
+	case "memory":
+		opts.Stream.Storage = nats.MemoryStorage
+	case "file":
+		opts.Stream.Storage = nats.FileStorage
+	default:
+		return opts, fmt.Errorf("stream-storage must be memory or file, got %q", cctx.String("stream-storage"))
+	}
+	if s := opts.Stream; s.MaxAge <= 0 || s.DuplicateWindow <= 0 || s.DuplicateWindow > s.MaxAge {
+		return opts, errors.New("stream-max-age and stream-duplicate-window must be positive, with the window no longer than the max age")
+	}
+	if opts.Stream.Replicas < 1 || opts.Stream.Replicas > 5 {
+		return opts, errors.New("stream-replicas must be between 1 and 5")
+	}
+	return opts, nil
+}
+
+func validate(cctx *cli.Context) error {
+	opts, err := routerOptions(cctx)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stdout, "configuration is valid (%d partitions, %d worker(s))\n", opts.Partitions, opts.Workers)
+	return nil
+}
+
+func run(cctx *cli.Context) error {
+	opts, err := routerOptions(cctx)
+	if err != nil {
+		return err
+	}
+
+	rt := service.NewRuntime(cctx, "route", cctx.String("metrics-addr"))
+	logger := rt.Logger
+
+	nc, err := nats.Connect(cctx.String("nats-url"))
+	if err != nil {
+		return fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+	rt.OnStop(func(context.Context) error {
+		nc.Close()
+		return nil
+	})
+	rt.ReadinessCheck("nats", service.NATSCheck(nc))
+
+	js, err := nc.JetStream()
+	if err != nil {
+		return fmt.Errorf("failed to create JetStream context: %w", err)
+	}
+	r, err := firehose.NewRouter(js, opts, logger)
+	if err != nil {
+		return err
+	}
+	rt.OnStop(func(context.Context) error {
+		return r.Close()
+	})
+
+	service.WatchConfig(rt.Context(), cctx, "route", flags, logger, func(rctx *cli.Context) error {
+		if _, err := routerOptions(rctx); err != nil {
+			return err
+		}
+		logger.Warn("router settings apply on restart")
+		return nil
+	})
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "router_frames_routed_total",
+			Help: "Frames republished to the ATPROTO_EVENTS stream",
+		}, func() float64 { return float64(r.GetRoutedFrames()) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "router_undecodable_frames_total",
+			Help: "Frames routed to atproto.events.0.undecodable because they didn't decode",
+		}, func() float64 { return float64(r.GetUndecodableFrames()) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "router_publish_failures_total",
+			Help: "Frames whose republishing failed, which are routed again",
+		}, func() float64 { return float64(r.GetFailedFrames()) }),
+	)
+	rt.Mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+
+	logger.Info("router started", "durable", opts.Durable, "partitions", opts.Partitions, "workers", opts.Workers, "batch_size", opts.BatchSize, "stream", firehose.EventsStream)
+	return rt.Run(r.Run)
+}
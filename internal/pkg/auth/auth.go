@@ -0,0 +1,264 @@
+// Package auth authenticates requests to the management endpoints of all
+// services: API keys with scopes, optionally HS256 JWTs, per-key rate limits
+// and an audit log of state-changing requests.
+//
+// Credentials are sent as "Authorization: Bearer <key or jwt>".
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+type Scope string
+
+const (
+	// ScopeAdmin grants every scope.
+	ScopeAdmin Scope = "admin"
+	// ScopeFleet lets the consumer fleet read the subscriptions to run.
+	ScopeFleet Scope = "fleet"
+	// ScopeSubscriptions lets a tenant manage its own subscriptions.
+	ScopeSubscriptions Scope = "subscriptions"
+	// ScopeRead grants read access to management state such as quotas.
+	ScopeRead Scope = "read"
+)
+
+// ParseScopes parses a comma or space separated scope list.
+func ParseScopes(s string) ([]Scope, error) {
+	var scopes []Scope
+	for _, f := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' }) {
+		switch sc := Scope(f); sc {
+		case ScopeAdmin, ScopeFleet, ScopeSubscriptions, ScopeRead:
+			scopes = append(scopes, sc)
+		default:
+			return nil, fmt.Errorf("unknown scope %q", f)
+		}
+	}
+	return scopes, nil
+}
+
+// Principal is an authenticated caller.
+type Principal struct {
+	// ID identifies the key or JWT subject; rate limits and audit entries
+	// are keyed on it.
+	ID string
+	// Tenant is empty for operator credentials.
+	Tenant string
+	Scopes []Scope
+}
+
+// Has reports whether p was granted scope.
+func (p Principal) Has(scope Scope) bool {
+	return slices.Contains(p.Scopes, ScopeAdmin) || slices.Contains(p.Scopes, scope)
+}
+
+var (
+	// ErrUnknownKey is returned by a KeyResolver that doesn't know the key.
+	ErrUnknownKey = errors.New("unknown api key")
+	errNoToken    = errors.New("credentials required")
+)
+
+// KeyResolver maps an API key to its principal.
+type KeyResolver interface {
+	ResolveKey(ctx context.Context, key string) (Principal, error)
+}
+
+// StaticKeys are API keys from configuration.
+type StaticKeys []StaticKey
+
+type StaticKey struct {
+	Name   string
+	Key    string
+	Scopes []Scope
+}
+
+// ParseStaticKey parses "name:key:scope,scope".
+func ParseStaticKey(s string) (StaticKey, error) {
+	parts := strings.SplitN(s, ":", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" {
+		return StaticKey{}, errors.New("static key must look like name:key:scope,scope")
+	}
+	scopes, err := ParseScopes(parts[2])
+	if err != nil {
+		return StaticKey{}, err
+	}
+	return StaticKey{Name: parts[0], Key: parts[1], Scopes: scopes}, nil
+}
+
+// ResolveKey compares key against every configured key in constant time.
+func (keys StaticKeys) ResolveKey(_ context.Context, key string) (Principal, error) {
+	found := -1
+	for i, k := range keys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(k.Key)) == 1 {
+			found = i
+		}
+	}
+	if found < 0 {
+		return Principal{}, ErrUnknownKey
+	}
+	return Principal{ID: keys[found].Name, Scopes: keys[found].Scopes}, nil
+}
+
+// Authenticator is the shared auth middleware.
+type Authenticator struct {
+	// Keys are tried in order.
+	Keys []KeyResolver
+	// JWT, when set, also accepts JWTs.
+	JWT *JWTValidator
+	// RateLimit bounds requests per second per principal; zero disables it.
+	RateLimit float64
+	Burst     int
+	// Audit, when set, receives an entry for every state-changing request.
+	Audit *slog.Logger
+	// Cookie, when set, names a cookie carrying the credentials for browser
+	// sessions. The Authorization header takes precedence.
+	Cookie string
+
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+type principalKey struct{}
+
+// FromContext returns the principal of an authenticated request.
+func FromContext(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(Principal)
+	return p, ok
+}
+
+// DenyFunc writes the response for a rejected request.
+type DenyFunc func(w http.ResponseWriter, r *http.Request, status int, msg string)
+
+func denyPlain(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="fpaas"`)
+	}
+	http.Error(w, msg, status)
+}
+
+// Require wraps h so it only runs for callers granted scope.
+func (a *Authenticator) Require(scope Scope, h http.Handler) http.Handler {
+	return a.RequireWith(scope, h, nil)
+}
+
+// RequireWith is Require with a custom response for rejected requests, such
+// as a redirect to a login page.
+func (a *Authenticator) RequireWith(scope Scope, h http.Handler, deny DenyFunc) http.Handler {
+	if deny == nil {
+		deny = denyPlain
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := a.Authenticate(r)
+		if err != nil {
+			deny(w, r, http.StatusUnauthorized, err.Error())
+			return
+		}
+		if !p.Has(scope) {
+			deny(w, r, http.StatusForbidden, fmt.Sprintf("missing scope %q", scope))
+			return
+		}
+		if !a.allow(p.ID) {
+			w.Header().Set("Retry-After", "1")
+			deny(w, r, http.StatusTooManyRequests, "rate limit exceeded")
+			return
+		}
+
+		r = r.WithContext(context.WithValue(r.Context(), principalKey{}, p))
+		if a.Audit == nil || r.Method == http.MethodGet || r.Method == http.MethodHead {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		h.ServeHTTP(rec, r)
+		a.Audit.Info("admin action",
+			"principal", p.ID,
+			"tenant", p.Tenant,
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"remote", r.RemoteAddr,
+			"duration", time.Since(start),
+		)
+	})
+}
+
+// RequireFunc is Require for handler functions.
+func (a *Authenticator) RequireFunc(scope Scope, h http.HandlerFunc) http.HandlerFunc {
+	return a.Require(scope, h).ServeHTTP
+}
+
+// Authenticate resolves the credentials of r.
+func (a *Authenticator) Authenticate(r *http.Request) (Principal, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	token = strings.TrimSpace(token)
+	if !ok && a.Cookie != "" {
+		if c, err := r.Cookie(a.Cookie); err == nil {
+			token, ok = c.Value, true
+		}
+	}
+	if !ok || token == "" {
+		return Principal{}, errNoToken
+	}
+	return a.AuthenticateToken(r.Context(), token)
+}
+
+// AuthenticateToken resolves an API key or JWT.
+func (a *Authenticator) AuthenticateToken(ctx context.Context, token string) (Principal, error) {
+	if a.JWT != nil && strings.Count(token, ".") == 2 {
+		return a.JWT.Validate(token)
+	}
+
+	for _, k := range a.Keys {
+		p, err := k.ResolveKey(ctx, token)
+		if errors.Is(err, ErrUnknownKey) {
+			continue
+		}
+		return p, err
+	}
+	return Principal{}, ErrUnknownKey
+}
+
+func (a *Authenticator) allow(id string) bool {
+	if a.RateLimit <= 0 {
+		return true
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.limiters == nil {
+		a.limiters = make(map[string]*rate.Limiter)
+	}
+	l, ok := a.limiters[id]
+	if !ok {
+		burst := a.Burst
+		if burst < 1 {
+			burst = max(1, int(a.RateLimit))
+		}
+		l = rate.NewLimiter(rate.Limit(a.RateLimit), burst)
+		a.limiters[id] = l
+	}
+	return l.Allow()
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+// JWTValidator accepts HS256 JWTs signed with a shared secret. The "sub"
+// claim becomes the principal ID, "tenant" its tenant and the space separated
+// "scope" claim its scopes.
+type JWTValidator struct {
+	Secret []byte
+	// Issuer and Audience are checked when set.
+	Issuer   string
+	Audience string
+}
+
+type jwtClaims struct {
+	Tenant string `json:"tenant"`
+	Scope  string `json:"scope"`
+}
+
+func (v *JWTValidator) Validate(token string) (Principal, error) {
+	tok, err := jwt.ParseSigned(token, []jose.SignatureAlgorithm{jose.HS256})
+	if err != nil {
+		return Principal{}, fmt.Errorf("invalid jwt: %w", err)
+	}
+
+	var std jwt.Claims
+	var custom jwtClaims
+	if err := tok.Claims(v.Secret, &std, &custom); err != nil {
+		return Principal{}, fmt.Errorf("invalid jwt: %w", err)
+	}
+	if std.Expiry == nil {
+		return Principal{}, errors.New("invalid jwt: exp claim is required")
+	}
+
+	expected := jwt.Expected{Issuer: v.Issuer, Time: time.Now()}
+	if v.Audience != "" {
+		expected.AnyAudience = jwt.Audience{v.Audience}
+	}
+	if err := std.ValidateWithLeeway(expected, 30*time.Second); err != nil {
+		return Principal{}, fmt.Errorf("invalid jwt: %w", err)
+	}
+	if std.Subject == "" {
+		return Principal{}, errors.New("invalid jwt: sub claim is required")
+	}
+
+	scopes, err := ParseScopes(custom.Scope)
+	if err != nil {
+		return Principal{}, fmt.Errorf("invalid jwt: %w", err)
+	}
+	return Principal{ID: "jwt:" + std.Subject, Tenant: custom.Tenant, Scopes: scopes}, nil
+}
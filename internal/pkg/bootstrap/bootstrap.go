@@ -0,0 +1,188 @@
+// Package bootstrap provisions the JetStream streams and KV buckets of the
+// pipeline in one go. Runs take a lock in LockBucket, so components and
+// bootstrap runs racing at cold start don't conflict, and retry each step
+// while NATS isn't ready yet, e.g. a cluster electing its JetStream leader.
+//
+// Every step is idempotent: running it again creates what's missing and
+// updates the streams to Options, leaving the rest as it was.
+package bootstrap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/internal/pkg/controlplane"
+	"github.com/eurosky/firehose-processor-aas/internal/pkg/registry"
+	"github.com/eurosky/firehose-processor-aas/pkg/consumer"
+	"github.com/eurosky/firehose-processor-aas/pkg/firehose"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// LockBucket holds the lock of the run provisioning the pipeline.
+	LockBucket = "fpaas_bootstrap"
+	lockKey    = "lock"
+)
+
+// Options configures Run.
+type Options struct {
+	// Stream configures ATPROTO_FIREHOSE and, with Events, the router's
+	// ATPROTO_EVENTS and, with Watched, the indexer's FPAAS_WATCHED.
+	Stream  firehose.StreamOptions
+	Events  bool
+	Watched bool
+	// IngestLeaseTTL and ConsumerLeaseTTL are how long the leases of the
+	// ingest leader and of the consumers last, fixed when their buckets are
+	// created.
+	IngestLeaseTTL   time.Duration
+	ConsumerLeaseTTL time.Duration
+	// Instance is stored in the lock, so a stuck run can be told apart.
+	Instance string
+	// LockTTL is how long the lock of a run that died is held; it should
+	// exceed how long provisioning takes.
+	LockTTL time.Duration
+	// Retries is how many times a failed step is tried again, backing off
+	// from half a second to 5s.
+	Retries int
+}
+
+// Step is a resource Run provisions.
+type Step struct {
+	Name   string
+	Ensure func(nats.JetStreamContext) error
+}
+
+// Steps returns the resources to provision with opts, in order.
+func Steps(opts Options, logger *slog.Logger) []Step {
+	steps := []Step{
+		{"stream ATPROTO_FIREHOSE", func(js nats.JetStreamContext) error {
+			return firehose.EnsureFirehoseStream(js, opts.Stream, logger)
+		}},
+	}
+	if opts.Events {
+		steps = append(steps, Step{"stream " + firehose.EventsStream, func(js nats.JetStreamContext) error {
+			return firehose.EnsureEventsStream(js, opts.Stream, logger)
+		}})
+	}
+	if opts.Watched {
+		steps = append(steps, Step{"stream " + firehose.WatchStream, func(js nats.JetStreamContext) error {
+			return firehose.EnsureWatchStream(js, opts.Stream, logger)
+		}})
+	}
+	return append(steps,
+		// Failed deliveries are recorded there, with their payload for
+		// redelivery; the pipeline has no other dead letter subject
+		Step{"stream " + consumer.DeliveryLogStream, consumer.EnsureDeliveryLogStream},
+		Step{"stream " + controlplane.AuditStream, controlplane.EnsureAuditStream},
+		Step{"stream " + firehose.SyntheticStream, func(js nats.JetStreamContext) error {
+			return firehose.EnsureSyntheticStream(js, logger)
+		}},
+		Step{"buckets " + firehose.LabelBucket + ", " + firehose.LeaseBucket + ", " + firehose.StateBucket, func(js nats.JetStreamContext) error {
+			return firehose.EnsureBuckets(js, opts.IngestLeaseTTL)
+		}},
+		Step{"bucket " + consumer.LeaseBucket, func(js nats.JetStreamContext) error {
+			_, err := consumer.EnsureLeaseBucket(js, opts.ConsumerLeaseTTL)
+			return err
+		}},
+		Step{"bucket " + consumer.DigestBucket, func(js nats.JetStreamContext) error {
+			_, err := consumer.EnsureDigestBucket(js)
+			return err
+		}},
+		Step{"bucket " + consumer.RollupBucket, func(js nats.JetStreamContext) error {
+			_, err := consumer.EnsureRollupBucket(js)
+			return err
+		}},
+		Step{"bucket " + consumer.KeywordBucket, func(js nats.JetStreamContext) error {
+			_, err := consumer.EnsureKeywordBucket(js)
+			return err
+		}},
+		Step{"bucket " + consumer.BlobBucket, func(js nats.JetStreamContext) error {
+			_, err := consumer.EnsureBlobBucket(js)
+			return err
+		}},
+		Step{"bucket " + consumer.MaintenanceBucket, func(js nats.JetStreamContext) error {
+			_, err := consumer.EnsureMaintenanceBucket(js)
+			return err
+		}},
+		Step{"bucket " + firehose.WatchBucket, func(js nats.JetStreamContext) error {
+			_, err := firehose.EnsureWatchBucket(js)
+			return err
+		}},
+		Step{"bucket " + registry.Bucket, registry.Ensure},
+	)
+}
+
+// Run provisions the Steps of opts while holding the lock, waiting for the
+// lock as long as ctx allows.
+func Run(ctx context.Context, js nats.JetStreamContext, opts Options, logger *slog.Logger) error {
+	var lock nats.KeyValue
+	err := retry(ctx, opts.Retries, logger, "lock bucket", func() error {
+		var err error
+		lock, err = firehose.OpenKeyValue(js, &nats.KeyValueConfig{Bucket: LockBucket, TTL: opts.LockTTL, History: 1})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to open lock bucket: %w", err)
+	}
+	revision, err := acquire(ctx, lock, opts, logger)
+	if err != nil {
+		return err
+	}
+	defer lock.Delete(lockKey, nats.LastRevision(revision))
+
+	for _, step := range Steps(opts, logger) {
+		start := time.Now()
+		if err := retry(ctx, opts.Retries, logger, step.Name, func() error { return step.Ensure(js) }); err != nil {
+			return fmt.Errorf("failed to provision %s: %w", step.Name, err)
+		}
+		logger.Info("provisioned", "resource", step.Name, "took", time.Since(start).Round(time.Millisecond))
+	}
+	return nil
+}
+
+// acquire waits for the lock and returns the revision it took it at.
+func acquire(ctx context.Context, lock nats.KeyValue, opts Options, logger *slog.Logger) (uint64, error) {
+	logged := false
+	for {
+		revision, err := lock.Create(lockKey, []byte(opts.Instance))
+		if err == nil {
+			return revision, nil
+		}
+		if !errors.Is(err, nats.ErrKeyExists) {
+			logger.Warn("failed to take bootstrap lock", "error", err)
+		} else if !logged {
+			holder := "unknown"
+			if e, err := lock.Get(lockKey); err == nil {
+				holder = string(e.Value())
+			}
+			logger.Info("waiting for bootstrap lock", "holder", holder, "lock_ttl", opts.LockTTL)
+			logged = true
+		}
+		select {
+		case <-ctx.Done():
+			return 0, fmt.Errorf("bootstrap lock not taken: %w", ctx.Err())
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
+
+// retry calls fn until it succeeds, at most retries more times.
+func retry(ctx context.Context, retries int, logger *slog.Logger, name string, fn func() error) error {
+	backoff := 500 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= retries {
+			return err
+		}
+		logger.Warn("bootstrap step failed, retrying", "resource", name, "attempt", attempt+1, "backoff", backoff, "error", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, 5*time.Second)
+	}
+}
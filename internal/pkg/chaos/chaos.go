@@ -0,0 +1,143 @@
+// Package chaos injects faults into the pipeline on a seeded schedule, to
+// check that it keeps its delivery guarantees through them.
+package chaos
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Kind is a kind of fault.
+type Kind string
+
+// Fault kinds. Disconnects and drops are instant; the others last for the
+// fault's duration.
+const (
+	// NATSDisconnect closes the NATS connections of every component.
+	NATSDisconnect Kind = "nats-disconnect"
+	// PublishDelay slows ingest's traffic to NATS down.
+	PublishDelay Kind = "publish-delay"
+	// WebhookFailure answers the webhook calls with 503.
+	WebhookFailure Kind = "webhook-failure"
+	// RelayDrop closes the relay connections.
+	RelayDrop Kind = "relay-drop"
+)
+
+// Kinds are all the fault kinds.
+var Kinds = []Kind{NATSDisconnect, PublishDelay, WebhookFailure, RelayDrop}
+
+// ParseKinds parses a comma-separated list of fault kinds.
+func ParseKinds(s string) ([]Kind, error) {
+	var kinds []Kind
+	for _, name := range strings.Split(s, ",") {
+		k := Kind(strings.TrimSpace(name))
+		if !slices.Contains(Kinds, k) {
+			return nil, fmt.Errorf("unknown fault %q, want one of %v", k, Kinds)
+		}
+		if !slices.Contains(kinds, k) {
+			kinds = append(kinds, k)
+		}
+	}
+	return kinds, nil
+}
+
+// Fault is a fault of a schedule.
+type Fault struct {
+	// At is when the fault starts, from the start of the schedule.
+	At       time.Duration
+	Kind     Kind
+	Duration time.Duration
+}
+
+func (f Fault) String() string {
+	if f.Duration == 0 {
+		return fmt.Sprintf("%s at %s", f.Kind, f.At.Round(time.Millisecond))
+	}
+	return fmt.Sprintf("%s at %s for %s", f.Kind, f.At.Round(time.Millisecond), f.Duration.Round(time.Millisecond))
+}
+
+// NewSchedule returns the faults of the given kinds over span, one every
+// interval on average. Lasting faults take between a third of maxDuration
+// and maxDuration. The same seed gives the same schedule.
+func NewSchedule(seed uint64, kinds []Kind, span, interval, maxDuration time.Duration) []Fault {
+	rng := rand.New(rand.NewPCG(seed, seed))
+	var faults []Fault
+	at := time.Duration(0)
+	for {
+		// Exponential gaps, as for independent failures
+		at += time.Duration(rng.ExpFloat64() * float64(interval))
+		if at >= span {
+			return faults
+		}
+		f := Fault{At: at, Kind: kinds[rng.IntN(len(kinds))]}
+		if f.Kind == PublishDelay || f.Kind == WebhookFailure {
+			f.Duration = maxDuration/3 + time.Duration(rng.Int64N(int64(maxDuration-maxDuration/3)+1))
+		}
+		faults = append(faults, f)
+	}
+}
+
+// Run calls inject for every fault at its time, from now until ctx is done.
+func Run(ctx context.Context, faults []Fault, inject func(Fault), logger *slog.Logger) {
+	start := time.Now()
+	for _, f := range faults {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(start.Add(f.At))):
+		}
+		logger.Info("injecting fault", "fault", f.String())
+		inject(f)
+	}
+}
+
+// window is a span of time in which a fault is active.
+type window struct {
+	until atomic.Int64 // UnixNano
+}
+
+func (w *window) open(d time.Duration) {
+	w.until.Store(time.Now().Add(d).UnixNano())
+}
+
+func (w *window) active() bool {
+	return time.Now().UnixNano() < w.until.Load()
+}
+
+// Gate passes webhook calls on to a handler, except while failing.
+type Gate struct {
+	next   http.Handler
+	fail   window
+	failed atomic.Int64
+}
+
+// NewGate returns a gate in front of next.
+func NewGate(next http.Handler) *Gate {
+	return &Gate{next: next}
+}
+
+// Fail answers the calls with 503 for d.
+func (g *Gate) Fail(d time.Duration) {
+	g.fail.open(d)
+}
+
+// Failed returns how many calls were failed.
+func (g *Gate) Failed() int64 {
+	return g.failed.Load()
+}
+
+func (g *Gate) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if g.fail.active() {
+		g.failed.Add(1)
+		http.Error(w, "chaos: injected failure", http.StatusServiceUnavailable)
+		return
+	}
+	g.next.ServeHTTP(w, r)
+}
@@ -0,0 +1,123 @@
+package chaos
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Proxy forwards TCP connections to a target, delaying the client's traffic
+// while slowed down. Closing either side of a connection closes the other,
+// so the client sees the target's disconnects.
+type Proxy struct {
+	target string
+	delay  time.Duration
+	ln     net.Listener
+	slow   window
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+// NewProxy listens on a free local port for connections to target. While
+// slowed down, every write of the clients waits for delay first.
+func NewProxy(target string, delay time.Duration) (*Proxy, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	p := &Proxy{target: target, delay: delay, ln: ln, conns: make(map[net.Conn]struct{})}
+	go p.serve()
+	return p, nil
+}
+
+// Addr is the address clients connect to.
+func (p *Proxy) Addr() string {
+	return p.ln.Addr().String()
+}
+
+// Slow delays the clients' traffic for d.
+func (p *Proxy) Slow(d time.Duration) {
+	p.slow.open(d)
+}
+
+// Close stops listening and closes the connections.
+func (p *Proxy) Close() error {
+	err := p.ln.Close()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for c := range p.conns {
+		c.Close()
+	}
+	return err
+}
+
+func (p *Proxy) serve() {
+	for {
+		client, err := p.ln.Accept()
+		if err != nil {
+			return
+		}
+		go p.forward(client)
+	}
+}
+
+func (p *Proxy) forward(client net.Conn) {
+	target, err := net.Dial("tcp", p.target)
+	if err != nil {
+		client.Close()
+		return
+	}
+	p.track(client, target)
+	defer p.untrack(client, target)
+
+	done := make(chan struct{}, 2)
+	go func() {
+		p.copySlow(target, client)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(client, target)
+		done <- struct{}{}
+	}()
+	<-done
+	client.Close()
+	target.Close()
+	<-done
+}
+
+// copySlow copies src to dst, waiting before each write while slowed down.
+func (p *Proxy) copySlow(dst io.Writer, src io.Reader) {
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if p.slow.active() {
+				time.Sleep(p.delay)
+			}
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (p *Proxy) track(conns ...net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range conns {
+		p.conns[c] = struct{}{}
+	}
+}
+
+func (p *Proxy) untrack(conns ...net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range conns {
+		delete(p.conns, c)
+	}
+}
@@ -0,0 +1,252 @@
+package controlplane
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/internal/pkg/auth"
+	"github.com/nats-io/nats.go"
+)
+
+// The audit log is append-only: triggers reject changes to past entries, and
+// the stream it is forwarded to denies deletes and purges.
+const auditSchema = `
+CREATE TABLE IF NOT EXISTS audit_log (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	time TEXT NOT NULL,
+	principal TEXT NOT NULL,
+	action TEXT NOT NULL,
+	tenant_id TEXT NOT NULL,
+	resource TEXT NOT NULL,
+	before TEXT NOT NULL,
+	after TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS audit_log_time ON audit_log (time);
+CREATE TRIGGER IF NOT EXISTS audit_log_no_update BEFORE UPDATE ON audit_log
+BEGIN SELECT RAISE(ABORT, 'audit log is append-only'); END;
+CREATE TRIGGER IF NOT EXISTS audit_log_no_delete BEFORE DELETE ON audit_log
+BEGIN SELECT RAISE(ABORT, 'audit log is append-only'); END;
+`
+
+const (
+	// AuditStream holds the audit entries forwarded from the store.
+	AuditStream = "FPAAS_AUDIT"
+	// AuditSubjectPrefix is followed by the action, e.g.
+	// fpaas.audit.subscription.update.
+	AuditSubjectPrefix = "fpaas.audit."
+
+	auditIDHeader  = "Fpaas-Audit-Id"
+	auditBatchSize = 500
+)
+
+// AuditEntry records a change made through the API or the dashboard: who
+// made it, to what, and the resource before and after, secrets left out.
+type AuditEntry struct {
+	ID   int64     `json:"id"`
+	Time time.Time `json:"time"`
+	// Principal is the API key, token subject or operator key that acted
+	Principal string `json:"principal"`
+	// Action is the resource type and verb, e.g. subscription.update
+	Action string `json:"action"`
+	// TenantID is the tenant the resource belongs to, empty for none
+	TenantID string          `json:"tenant_id,omitempty"`
+	Resource string          `json:"resource"`
+	Before   json.RawMessage `json:"before,omitempty"`
+	After    json.RawMessage `json:"after,omitempty"`
+}
+
+// AuditQuery selects audit entries, oldest first: those after the entry
+// with ID After, in [Since, Until) and of TenantID when set.
+type AuditQuery struct {
+	After    int64
+	Since    time.Time
+	Until    time.Time
+	TenantID string
+	Limit    int
+}
+
+// AppendAudit stores the entry and returns it with its ID and time.
+func (s *Store) AppendAudit(ctx context.Context, e AuditEntry) (AuditEntry, error) {
+	e.Time = time.Now().UTC()
+	err := s.db.QueryRowContext(ctx, `INSERT INTO audit_log (time, principal, action, tenant_id, resource, before, after)
+		VALUES (?, ?, ?, ?, ?, ?, ?) RETURNING id`,
+		formatTime(e.Time), e.Principal, e.Action, e.TenantID, e.Resource, string(e.Before), string(e.After)).Scan(&e.ID)
+	if err != nil {
+		return AuditEntry{}, storeError("append audit entry", err)
+	}
+	return e, nil
+}
+
+// ListAudit returns up to q.Limit entries matching q. Until defaults to now.
+func (s *Store) ListAudit(ctx context.Context, q AuditQuery) ([]AuditEntry, error) {
+	until := q.Until
+	if until.IsZero() {
+		until = time.Now().Add(time.Hour)
+	}
+	rows, err := s.db.QueryContext(ctx, `SELECT id, time, principal, action, tenant_id, resource, before, after
+		FROM audit_log WHERE id > ? AND time >= ? AND time < ? AND (? = '' OR tenant_id = ?)
+		ORDER BY id LIMIT ?`,
+		q.After, formatTime(q.Since), formatTime(until), q.TenantID, q.TenantID, q.Limit)
+	if err != nil {
+		return nil, storeError("list audit entries", err)
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var e AuditEntry
+		var ts, before, after string
+		if err := rows.Scan(&e.ID, &ts, &e.Principal, &e.Action, &e.TenantID, &e.Resource, &before, &after); err != nil {
+			return nil, storeError("list audit entries", err)
+		}
+		e.Time = parseTime(ts)
+		if before != "" {
+			e.Before = json.RawMessage(before)
+		}
+		if after != "" {
+			e.After = json.RawMessage(after)
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// audit records a change by the request's principal. before and after are
+// the resource as the API shows it, nil when it didn't exist. The change
+// already happened, so a failure is logged rather than returned.
+func (s *Server) audit(ctx context.Context, action, tenantID, resource string, before, after any) {
+	p, _ := auth.FromContext(ctx)
+	e := AuditEntry{Principal: p.ID, Action: action, TenantID: tenantID, Resource: resource}
+	var err error
+	if e.Before, err = auditJSON(before); err == nil {
+		e.After, err = auditJSON(after)
+	}
+	if err == nil {
+		_, err = s.store.AppendAudit(ctx, e)
+	}
+	if err != nil {
+		s.logger.Error("failed to record audit entry", "action", action, "resource", resource, "principal", p.ID, "error", err)
+	}
+}
+
+func auditJSON(v any) (json.RawMessage, error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case Subscription:
+		v.Secret = ""
+		v.URL = maskPassword(v.URL)
+		return json.Marshal(v)
+	case APIKey:
+		v.Key = ""
+		return json.Marshal(v)
+	case NATSCredentials:
+		v.Creds = ""
+		return json.Marshal(v)
+	default:
+		return json.Marshal(v)
+	}
+}
+
+// dsnPassword matches the password of a key=value Postgres DSN, quoted or
+// not.
+var dsnPassword = regexp.MustCompile(`(password\s*=\s*)('(?:[^'\\]|\\.)*'|\S+)`)
+
+// maskPassword hides the password of a subscription's URL, which the audit
+// log would keep for good: that of a Postgres DSN, URL or key=value, of a
+// ClickHouse URL or of an MQTT broker URL.
+func maskPassword(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme == "" {
+		return dsnPassword.ReplaceAllString(raw, "${1}xxxxx")
+	}
+	if q := u.Query(); q.Has("password") {
+		q.Set("password", "xxxxx")
+		u.RawQuery = q.Encode()
+	}
+	return u.Redacted()
+}
+
+// ForwardAudit publishes the audit entries of the store to AuditStream, in
+// order, until ctx is done. It resumes after the last entry of the stream,
+// and entries are deduplicated on their ID, so each is stored once.
+func ForwardAudit(ctx context.Context, js nats.JetStreamContext, store *Store, logger *slog.Logger) error {
+	if err := EnsureAuditStream(js); err != nil {
+		return err
+	}
+	last, err := lastForwardedAudit(js)
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		entries, err := store.ListAudit(ctx, AuditQuery{After: last, Limit: auditBatchSize})
+		if err != nil && ctx.Err() == nil {
+			logger.Warn("failed to read audit entries", "error", err)
+		}
+		for _, e := range entries {
+			data, _ := json.Marshal(e)
+			msg := nats.NewMsg(AuditSubjectPrefix + e.Action)
+			msg.Data = data
+			msg.Header.Set(nats.MsgIdHdr, strconv.FormatInt(e.ID, 10))
+			msg.Header.Set(auditIDHeader, strconv.FormatInt(e.ID, 10))
+			if _, err := js.PublishMsg(msg, nats.Context(ctx)); err != nil {
+				if ctx.Err() == nil {
+					logger.Warn("failed to forward audit entry", "id", e.ID, "error", err)
+				}
+				break
+			}
+			last = e.ID
+		}
+
+		if len(entries) == auditBatchSize {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// EnsureAuditStream creates AuditStream if it doesn't exist. Its entries can't
+// be deleted or purged.
+func EnsureAuditStream(js nats.JetStreamContext) error {
+	_, err := js.AddStream(&nats.StreamConfig{
+		Name:       AuditStream,
+		Subjects:   []string{AuditSubjectPrefix + ">"},
+		Storage:    nats.FileStorage,
+		DenyDelete: true,
+		DenyPurge:  true,
+	})
+	if err != nil && !errors.Is(err, nats.ErrStreamNameAlreadyInUse) {
+		return fmt.Errorf("failed to create audit stream: %w", err)
+	}
+	return nil
+}
+
+// lastForwardedAudit returns the ID of the stream's last entry, 0 if none.
+func lastForwardedAudit(js nats.JetStreamContext) (int64, error) {
+	info, err := js.StreamInfo(AuditStream)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read audit stream: %w", err)
+	}
+	if info.State.Msgs == 0 {
+		return 0, nil
+	}
+	msg, err := js.GetMsg(AuditStream, info.State.LastSeq)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read the last audit entry: %w", err)
+	}
+	return strconv.ParseInt(msg.Header.Get(auditIDHeader), 10, 64)
+}
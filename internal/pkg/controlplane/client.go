@@ -0,0 +1,97 @@
+package controlplane
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Client is the consumer fleet's view of the control plane.
+type Client struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+}
+
+func NewClient(baseURL, token string) *Client {
+	return &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		token:      token,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// FleetSubscriptions returns the subscriptions the fleet should be running.
+func (c *Client) FleetSubscriptions(ctx context.Context) ([]Subscription, error) {
+	var subs []Subscription
+	if err := c.do(ctx, http.MethodGet, "/v1/fleet/subscriptions", nil, &subs); err != nil {
+		return nil, err
+	}
+	return subs, nil
+}
+
+// FleetReplays returns the active replays of the subscriptions the fleet
+// delivers to.
+func (c *Client) FleetReplays(ctx context.Context) ([]FleetReplay, error) {
+	var replays []FleetReplay
+	if err := c.do(ctx, http.MethodGet, "/v1/fleet/replays", nil, &replays); err != nil {
+		return nil, err
+	}
+	return replays, nil
+}
+
+// ReportReplay reports the progress of a replay and returns it as the
+// control plane has it, e.g. cancelled or claimed by another replica. It
+// returns ErrNotFound once the replay or its subscription was deleted.
+func (c *Client) ReportReplay(ctx context.Context, id string, rep ReplayReport) (Replay, error) {
+	var r Replay
+	if err := c.do(ctx, http.MethodPut, "/v1/fleet/replays/"+url.PathEscape(id), rep, &r); err != nil {
+		return Replay{}, err
+	}
+	return r, nil
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body, v any) error {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, r)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach control plane: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return ErrNotFound
+	default:
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("control plane returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
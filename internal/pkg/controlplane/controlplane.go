@@ -0,0 +1,278 @@
+// Package controlplane holds the tenants, API keys and subscriptions of a
+// hosted deployment. The control-plane service serves them over HTTP and the
+// consumer fleet reconciles its running consumers against them.
+package controlplane
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/internal/pkg/auth"
+	"github.com/eurosky/firehose-processor-aas/pkg/consumer"
+)
+
+var (
+	ErrNotFound = errors.New("not found")
+	ErrConflict = errors.New("already exists")
+)
+
+type Tenant struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	// Redaction holds the rules applied to whatever the tenant's
+	// subscriptions deliver (see firehose.Redaction). Only admins set them.
+	Redaction []string `json:"redaction"`
+	// EmailDomains are the domains the tenant's email subscriptions may send
+	// to, which the operator checked the tenant owns. Only admins set them.
+	EmailDomains []string `json:"email_domains"`
+}
+
+// APIKey authenticates a tenant. Only a hash of the key is stored; Key is set
+// once, in the response that creates it.
+type APIKey struct {
+	ID        string       `json:"id"`
+	TenantID  string       `json:"tenant_id"`
+	Prefix    string       `json:"prefix"`
+	Key       string       `json:"key,omitempty"`
+	Scopes    []auth.Scope `json:"scopes"`
+	CreatedAt time.Time    `json:"created_at"`
+}
+
+// Subscription describes what a tenant wants delivered and where.
+type Subscription struct {
+	ID       string `json:"id"`
+	TenantID string `json:"tenant_id"`
+	Name     string `json:"name"`
+	Enabled  bool   `json:"enabled"`
+	// Version increases on every update; the fleet restarts a subscription's
+	// consumer when it changes.
+	Version   int64     `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Verified is set once the webhook endpoint passed the verification
+	// handshake for its current URL; the fleet doesn't run unverified
+	// subscriptions. Other targets are always verified: Validate limits
+	// where they deliver.
+	Verified bool `json:"verified"`
+	// VerificationError says why the last handshake failed.
+	VerificationError string `json:"verification_error,omitempty"`
+	// Redaction is the tenant's redaction rules, which the subscription
+	// can't change.
+	Redaction []string `json:"redaction,omitempty"`
+
+	SubscriptionSpec
+
+	verifiedURL string
+}
+
+// SubscriptionSpec is the tenant editable part of a Subscription.
+type SubscriptionSpec struct {
+	Filter Filter `json:"filter"`
+	// Analysis makes the subscription deliver, instead of events, the
+	// reports of an analysis of the firehose, duplicates or bursts (see
+	// consumer.Config.Analysis). Filter must then be empty.
+	Analysis consumer.Analysis `json:"analysis,omitempty"`
+	// TestMode delivers synthetic events of made-up DIDs instead of the
+	// firehose's (see consumer.Config.TestMode), at the fleet's test rate,
+	// so the tenant can integrate before switching the subscription to live
+	// data by updating it without.
+	TestMode bool `json:"test_mode,omitempty"`
+	// ThreadContext passes the parent and root posts of the replies
+	// delivered on in the payloads (see consumer.Config.ThreadContext),
+	// fetched from the fleet's AppView.
+	ThreadContext bool `json:"thread_context,omitempty"`
+	// Blobs lists the blobs the records delivered reference in the
+	// payloads, and FetchBlobs gives each a URL of the fleet's copy (see
+	// consumer.Config.Blobs), within the tenant's quota. Fetching needs the
+	// fleet's --blob-base-url.
+	Blobs      bool            `json:"blobs,omitempty"`
+	FetchBlobs bool            `json:"fetch_blobs,omitempty"`
+	Target     consumer.Target `json:"target"`
+	// URL is the destination of the target: the webhook URL, SQS queue URL,
+	// SNS topic ARN, Pub/Sub topic, Postgres DSN, ClickHouse URL, MQTT
+	// broker URL, Slack or Discord incoming webhook URL, or the recipients
+	// of an email subscription, mailto:a@example.com,b@example.com.
+	URL string `json:"url"`
+	// Secret signs webhook bodies. It's generated when left empty and only
+	// returned when the subscription is created.
+	Secret      string                       `json:"secret,omitempty"`
+	Format      consumer.PayloadFormat       `json:"format,omitempty"`
+	Granularity consumer.DeliveryGranularity `json:"granularity,omitempty"`
+	// Routes send some events of a webhook subscription to paths under URL
+	// (see consumer.WebhookRoute), e.g. "app.bsky.graph.* /graph". They
+	// can't name other endpoints, which weren't verified.
+	Routes []string `json:"routes,omitempty"`
+	// Template renders the messages of a slack or discord subscription (see
+	// consumer.ChatEvent), or the digests of an email one (see
+	// consumer.Digest), the fleet's when empty.
+	Template string   `json:"template,omitempty"`
+	Schedule Schedule `json:"schedule"`
+}
+
+type Filter struct {
+	Types       []string `json:"types,omitempty"`
+	Collections []string `json:"collections,omitempty"`
+	// ExcludeLabels and AnnotateLabels filter on the labels of the events'
+	// accounts and records (see consumer.Config), on top of the fleet's.
+	ExcludeLabels  []string `json:"exclude_labels,omitempty"`
+	AnnotateLabels []string `json:"annotate_labels,omitempty"`
+	// Keywords delivers only the posts matching the subscription's keyword
+	// queries, registered at /v1/subscriptions/{id}/queries (see
+	// consumer.KeywordQuery).
+	Keywords bool `json:"keywords,omitempty"`
+	// Languages delivers only the posts in these languages, ISO 639 codes
+	// (see consumer.Config.Languages).
+	Languages []string `json:"languages,omitempty"`
+	// Watchlist delivers only the events of the DIDs registered at
+	// /v1/subscriptions/{id}/dids: those they author and the posts
+	// mentioning or replying to them, which fpaas index copies from the
+	// firehose. The other filters apply on top.
+	Watchlist bool `json:"watchlist,omitempty"`
+}
+
+// Schedule controls how often and how much a subscription's consumer pulls,
+// and how long a webhook call may take. Zero values keep the fleet's
+// defaults.
+type Schedule struct {
+	PollIntervalSeconds int `json:"poll_interval_seconds,omitempty"`
+	BatchSize           int `json:"batch_size,omitempty"`
+	TimeoutSeconds      int `json:"timeout_seconds,omitempty"`
+	// AggregateSeconds makes a webhook subscription receive, instead of the
+	// events, a rollup of every window of that many seconds (see
+	// consumer.Config.AggregateWindow).
+	AggregateSeconds int `json:"aggregate_seconds,omitempty"`
+}
+
+// ConsumerName is the durable consumer name of the subscription.
+func (s Subscription) ConsumerName() string {
+	return "sub-" + s.ID
+}
+
+func (s Subscription) verified() bool {
+	return !s.isWebhook() || (s.verifiedURL != "" && s.verifiedURL == s.URL)
+}
+
+// Apply returns base with the subscription's settings on top. base carries
+// the fleet-wide settings, such as the NATS URL or Pub/Sub project.
+func (s Subscription) Apply(base consumer.Config) consumer.Config {
+	cfg := base
+	cfg.Name = s.ConsumerName()
+	cfg.FrameTypes = s.Filter.Types
+	cfg.Collections = s.Filter.Collections
+	cfg.Redaction = append(slices.Clip(base.Redaction), s.Redaction...)
+	cfg.ExcludeLabels = append(slices.Clip(base.ExcludeLabels), s.Filter.ExcludeLabels...)
+	cfg.AnnotateLabels = append(slices.Clip(base.AnnotateLabels), s.Filter.AnnotateLabels...)
+	cfg.KeywordQueries = s.Filter.Keywords
+	cfg.Languages = s.Filter.Languages
+	cfg.Watchlist = s.Filter.Watchlist
+	cfg.Analysis = s.Analysis
+	cfg.TestMode = s.TestMode
+	cfg.ThreadContext = s.ThreadContext
+	cfg.Blobs = s.Blobs
+	cfg.FetchBlobs = s.FetchBlobs
+	cfg.Target = s.Target
+	// Not on top of the fleet's routes, which point at its own webhook
+	cfg.WebhookRoutes = s.Routes
+	if s.Format != "" {
+		cfg.PayloadFormat = s.Format
+	}
+	if s.Granularity != "" {
+		cfg.DeliveryGranularity = s.Granularity
+	}
+	if s.Schedule.PollIntervalSeconds > 0 {
+		cfg.PollInterval = time.Duration(s.Schedule.PollIntervalSeconds) * time.Second
+	}
+	if s.Schedule.BatchSize > 0 {
+		cfg.BatchSize = s.Schedule.BatchSize
+	}
+	if s.Schedule.TimeoutSeconds != 0 {
+		cfg.WebhookTimeout = time.Duration(s.Schedule.TimeoutSeconds) * time.Second
+	}
+	if s.Schedule.AggregateSeconds > 0 {
+		cfg.AggregateWindow = time.Duration(s.Schedule.AggregateSeconds) * time.Second
+	}
+
+	switch s.Target {
+	case "", consumer.TargetWebhook:
+		cfg.UseWebhook = true
+		cfg.WebhookURL = s.URL
+		cfg.WebhookSecret = s.Secret
+	case consumer.TargetSQS:
+		cfg.SQSQueueURL = s.URL
+	case consumer.TargetSNS:
+		cfg.SNSTopicARN = s.URL
+	case consumer.TargetPubSub:
+		cfg.PubSubTopic = s.URL
+	case consumer.TargetPostgres:
+		cfg.PostgresDSN = s.URL
+	case consumer.TargetClickHouse:
+		cfg.ClickHouseURL = s.URL
+	case consumer.TargetMQTT:
+		cfg.MQTTBrokerURL = s.URL
+	case consumer.TargetSlack, consumer.TargetDiscord:
+		cfg.ChatWebhookURL = s.URL
+		if s.Template != "" {
+			cfg.ChatTemplate = s.Template
+		}
+	case consumer.TargetEmail:
+		to, _ := strings.CutPrefix(s.URL, "mailto:")
+		cfg.EmailTo = nil
+		for _, addr := range strings.Split(to, ",") {
+			cfg.EmailTo = append(cfg.EmailTo, strings.TrimSpace(addr))
+		}
+		if s.Template != "" {
+			cfg.EmailTemplate = s.Template
+		}
+	}
+	return cfg
+}
+
+func (s SubscriptionSpec) isWebhook() bool {
+	return s.Target == "" || s.Target == consumer.TargetWebhook
+}
+
+// Validate checks the spec with the same rules the consumer applies.
+func (s SubscriptionSpec) Validate() error {
+	if s.URL == "" {
+		return errors.New("url is required")
+	}
+	routes, err := consumer.ParseWebhookRoutes(s.Routes)
+	if err != nil {
+		return err
+	}
+	for _, r := range routes {
+		if r.URL != "" {
+			return fmt.Errorf("route destination %s must be a path under the subscription's url", r.URL)
+		}
+	}
+	sub := Subscription{ID: "validate", SubscriptionSpec: s}
+	cfg := sub.Apply(consumer.Config{
+		NATSURL:      "nats://validate",
+		PollInterval: time.Second,
+		BatchSize:    1,
+		// Fleet-wide settings the spec can't provide
+		PubSubProject: "validate",
+		SMTPURL:       "smtp://validate",
+		EmailFrom:     "validate@localhost",
+		BlobBaseURL:   "https://validate",
+	})
+	return cfg.Validate()
+}
+
+func newID(prefix string) string {
+	return prefix + randomHex(8)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("crypto/rand failed: %v", err))
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,351 @@
+package controlplane
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/internal/pkg/auth"
+	"github.com/eurosky/firehose-processor-aas/pkg/consumer"
+)
+
+// SessionCookie carries the API key of a dashboard session.
+const SessionCookie = "fpaas_session"
+
+const (
+	sessionMaxAge   = 12 * time.Hour
+	statsWindow     = 24 * time.Hour
+	recentAttempts  = 50
+	dashboardPrefix = "/ui"
+	// topologyRefresh is how often, in seconds, the topology page reloads
+	topologyRefresh = 10
+)
+
+//go:embed templates/*.html
+var templateFS embed.FS
+
+var templates = template.Must(template.New("").Funcs(template.FuncMap{
+	"percent": func(f float64) string { return fmt.Sprintf("%.1f%%", f*100) },
+	"join":    strings.Join,
+	"short":   shortError,
+	"since": func(t time.Time) string {
+		return time.Since(t).Round(time.Second).String() + " ago"
+	},
+}).ParseFS(templateFS, "templates/*.html"))
+
+type subscriptionRow struct {
+	Subscription
+	Stats DeliveryStats
+}
+
+type pageData struct {
+	Title   string
+	Tenant  string
+	Message string
+	Error   string
+	// Secret is shown once after creation or rotation
+	Secret        string
+	Subscriptions []subscriptionRow
+	Subscription  *subscriptionRow
+	Deliveries    []consumer.DeliveryRecord
+	Status        string
+	Redelivery    bool
+	Topology      *Topology
+	// Refresh reloads the page every Refresh seconds
+	Refresh int
+}
+
+// registerDashboard serves the tenant self-service UI under /ui, and the
+// pipeline topology to operators. Sessions reuse the API key, kept in an
+// HttpOnly SameSite=Strict cookie.
+func (s *Server) registerDashboard(authn *auth.Authenticator) {
+	toLogin := func(w http.ResponseWriter, r *http.Request, status int, msg string) {
+		if status == http.StatusUnauthorized {
+			http.Redirect(w, r, dashboardPrefix+"/login", http.StatusSeeOther)
+			return
+		}
+		s.render(w, status, "login.html", pageData{Title: "Sign in", Error: msg})
+	}
+	ui := func(h http.HandlerFunc) http.Handler {
+		return authn.RequireWith(auth.ScopeSubscriptions, requireTenant(h), toLogin)
+	}
+
+	s.mux.HandleFunc("GET "+dashboardPrefix+"/login", func(w http.ResponseWriter, r *http.Request) {
+		s.render(w, http.StatusOK, "login.html", pageData{Title: "Sign in"})
+	})
+	s.mux.HandleFunc("POST "+dashboardPrefix+"/login", func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimSpace(r.PostFormValue("api_key"))
+		p, err := authn.AuthenticateToken(r.Context(), key)
+		operator := err == nil && operatorSession(p)
+		if !operator && (err != nil || p.Tenant == "" || !p.Has(auth.ScopeSubscriptions)) {
+			s.render(w, http.StatusUnauthorized, "login.html", pageData{Title: "Sign in", Error: "invalid API key"})
+			return
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     SessionCookie,
+			Value:    key,
+			Path:     dashboardPrefix,
+			MaxAge:   int(sessionMaxAge.Seconds()),
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteStrictMode,
+		})
+		if operator {
+			http.Redirect(w, r, dashboardPrefix+"/topology", http.StatusSeeOther)
+			return
+		}
+		http.Redirect(w, r, dashboardPrefix+"/", http.StatusSeeOther)
+	})
+	s.mux.HandleFunc("POST "+dashboardPrefix+"/logout", func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: SessionCookie, Path: dashboardPrefix, MaxAge: -1})
+		http.Redirect(w, r, dashboardPrefix+"/login", http.StatusSeeOther)
+	})
+
+	s.mux.Handle("GET "+dashboardPrefix+"/{$}", ui(s.uiIndex))
+	s.mux.Handle("POST "+dashboardPrefix+"/subscriptions", ui(s.uiCreate))
+	s.mux.Handle("GET "+dashboardPrefix+"/subscriptions/{id}", ui(s.uiSubscription))
+	s.mux.Handle("POST "+dashboardPrefix+"/subscriptions/{id}/toggle", ui(s.uiToggle))
+	s.mux.Handle("POST "+dashboardPrefix+"/subscriptions/{id}/rotate-secret", ui(s.uiRotate))
+	s.mux.Handle("POST "+dashboardPrefix+"/subscriptions/{id}/verify", ui(s.uiVerify))
+	s.mux.Handle("POST "+dashboardPrefix+"/deliveries/{id}/redeliver", ui(s.uiRedeliver))
+	s.mux.Handle("GET "+dashboardPrefix+"/topology", authn.RequireWith(auth.ScopeRead, requireOperator(s.uiTopology), toLogin))
+}
+
+func (s *Server) uiIndex(w http.ResponseWriter, r *http.Request) {
+	tenant := tenantFrom(r.Context()).ID
+	data := pageData{Title: "Subscriptions", Tenant: tenant, Message: r.URL.Query().Get("msg")}
+
+	subs, err := s.store.ListSubscriptions(r.Context(), tenant)
+	if err != nil {
+		s.uiError(w, err)
+		return
+	}
+	for _, sub := range subs {
+		row, err := s.subscriptionRow(r.Context(), sub)
+		if err != nil {
+			s.uiError(w, err)
+			return
+		}
+		data.Subscriptions = append(data.Subscriptions, row)
+	}
+	s.render(w, http.StatusOK, "index.html", data)
+}
+
+func (s *Server) uiCreate(w http.ResponseWriter, r *http.Request) {
+	tenant := tenantFrom(r.Context()).ID
+	req := subscriptionRequest{
+		Name: strings.TrimSpace(r.PostFormValue("name")),
+		SubscriptionSpec: SubscriptionSpec{
+			Target:      consumer.Target(r.PostFormValue("target")),
+			URL:         strings.TrimSpace(r.PostFormValue("url")),
+			Format:      consumer.PayloadFormat(r.PostFormValue("format")),
+			Granularity: consumer.DeliveryGranularity(r.PostFormValue("granularity")),
+			Filter: Filter{
+				Types:       formList(r.PostFormValue("types")),
+				Collections: formList(r.PostFormValue("collections")),
+				Keywords:    r.PostFormValue("keywords") != "",
+				Languages:   formList(r.PostFormValue("languages")),
+				Watchlist:   r.PostFormValue("watchlist") != "",
+			},
+			Analysis:      consumer.Analysis(r.PostFormValue("analysis")),
+			TestMode:      r.PostFormValue("test_mode") != "",
+			ThreadContext: r.PostFormValue("thread_context") != "",
+			Blobs:         r.PostFormValue("blobs") != "",
+			FetchBlobs:    r.PostFormValue("fetch_blobs") != "",
+			Routes:        formRules(r.PostFormValue("routes")),
+			Template:      strings.TrimSpace(r.PostFormValue("template")),
+		},
+	}
+	req.Schedule.PollIntervalSeconds, _ = strconv.Atoi(r.PostFormValue("poll_interval_seconds"))
+	req.Schedule.BatchSize, _ = strconv.Atoi(r.PostFormValue("batch_size"))
+	req.Schedule.TimeoutSeconds, _ = strconv.Atoi(r.PostFormValue("timeout_seconds"))
+	req.Schedule.AggregateSeconds, _ = strconv.Atoi(r.PostFormValue("aggregate_seconds"))
+
+	sub, err := s.newSubscription(r.Context(), tenant, req)
+	var bad badRequest
+	if errors.As(err, &bad) || errors.Is(err, ErrConflict) {
+		http.Redirect(w, r, dashboardPrefix+"/?msg="+url.QueryEscape("could not create subscription: "+err.Error()), http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		s.uiError(w, err)
+		return
+	}
+	msg := "subscription created"
+	if !sub.Verified {
+		msg += "; webhook verification failed, it won't receive events until verified: " + sub.VerificationError
+	}
+	s.renderSubscription(w, r, sub, msg, sub.Secret)
+}
+
+func (s *Server) uiSubscription(w http.ResponseWriter, r *http.Request) {
+	sub, err := s.store.GetSubscription(r.Context(), tenantFrom(r.Context()).ID, r.PathValue("id"))
+	if err != nil {
+		s.uiError(w, err)
+		return
+	}
+	s.renderSubscription(w, r, sub, r.URL.Query().Get("msg"), "")
+}
+
+func (s *Server) renderSubscription(w http.ResponseWriter, r *http.Request, sub Subscription, msg, secret string) {
+	row, err := s.subscriptionRow(r.Context(), sub)
+	if err != nil {
+		s.uiError(w, err)
+		return
+	}
+	row.Secret = ""
+
+	status := r.URL.Query().Get("status")
+	deliveries, err := s.store.ListDeliveries(r.Context(), DeliveryQuery{
+		Consumer: sub.ConsumerName(),
+		Status:   status,
+		Limit:    recentAttempts,
+	})
+	if err != nil {
+		s.uiError(w, err)
+		return
+	}
+
+	s.render(w, http.StatusOK, "subscription.html", pageData{
+		Title:        sub.Name,
+		Tenant:       sub.TenantID,
+		Message:      msg,
+		Secret:       secret,
+		Subscription: &row,
+		Deliveries:   deliveries,
+		Status:       status,
+		Redelivery:   s.redeliver != nil,
+	})
+}
+
+func (s *Server) uiToggle(w http.ResponseWriter, r *http.Request) {
+	tenant := tenantFrom(r.Context()).ID
+	sub, err := s.store.GetSubscription(r.Context(), tenant, r.PathValue("id"))
+	if err != nil {
+		s.uiError(w, err)
+		return
+	}
+	before := sub
+	sub.Enabled = !sub.Enabled
+	after, err := s.store.UpdateSubscription(r.Context(), sub)
+	if err != nil {
+		s.uiError(w, err)
+		return
+	}
+	s.logger.Info("subscription updated", "tenant", tenant, "subscription", sub.ID, "enabled", sub.Enabled)
+	s.audit(r.Context(), "subscription.update", tenant, sub.ID, before, after)
+	http.Redirect(w, r, dashboardPrefix+"/subscriptions/"+sub.ID, http.StatusSeeOther)
+}
+
+func (s *Server) uiRotate(w http.ResponseWriter, r *http.Request) {
+	sub, err := s.rotateSecret(r.Context(), tenantFrom(r.Context()).ID, r.PathValue("id"))
+	if err != nil {
+		s.uiError(w, err)
+		return
+	}
+	s.renderSubscription(w, r, sub, "secret rotated; consumers switch to it within a reconcile interval", sub.Secret)
+}
+
+func (s *Server) uiVerify(w http.ResponseWriter, r *http.Request) {
+	sub, err := s.store.GetSubscription(r.Context(), tenantFrom(r.Context()).ID, r.PathValue("id"))
+	if err == nil {
+		sub, err = s.verify(r.Context(), sub)
+	}
+	if err != nil {
+		s.uiError(w, err)
+		return
+	}
+	msg := "webhook verified"
+	if !sub.Verified {
+		msg = "verification failed: " + sub.VerificationError
+	}
+	http.Redirect(w, r, dashboardPrefix+"/subscriptions/"+sub.ID+"?msg="+url.QueryEscape(msg), http.StatusSeeOther)
+}
+
+func (s *Server) uiRedeliver(w http.ResponseWriter, r *http.Request) {
+	rec, sub, err := s.tenantDelivery(r.Context(), tenantFrom(r.Context()).ID, r.PathValue("id"))
+	if err != nil {
+		s.uiError(w, err)
+		return
+	}
+
+	msg := "redelivered"
+	if s.redeliver == nil {
+		msg = "redelivery is not enabled on this control plane"
+	} else if retry, err := s.redeliver.Redeliver(r.Context(), rec); err != nil {
+		msg = "redelivery failed: " + err.Error()
+	} else {
+		s.audit(r.Context(), "delivery.redeliver", sub.TenantID, rec.ID, rec, retry)
+		if retry.Status != consumer.DeliveryDelivered {
+			msg = "redelivery attempted but failed: " + retry.Error
+		}
+	}
+	http.Redirect(w, r, dashboardPrefix+"/subscriptions/"+sub.ID+"?msg="+url.QueryEscape(msg), http.StatusSeeOther)
+}
+
+// tenantDelivery returns a delivery record and its subscription, if it
+// belongs to the tenant.
+func (s *Server) tenantDelivery(ctx context.Context, tenantID, id string) (consumer.DeliveryRecord, Subscription, error) {
+	rec, err := s.store.GetDelivery(ctx, id)
+	if err != nil {
+		return consumer.DeliveryRecord{}, Subscription{}, err
+	}
+	subID, ok := strings.CutPrefix(rec.Consumer, "sub-")
+	if !ok {
+		return consumer.DeliveryRecord{}, Subscription{}, ErrNotFound
+	}
+	sub, err := s.store.GetSubscription(ctx, tenantID, subID)
+	if err != nil {
+		return consumer.DeliveryRecord{}, Subscription{}, err
+	}
+	return rec, sub, nil
+}
+
+func (s *Server) subscriptionRow(ctx context.Context, sub Subscription) (subscriptionRow, error) {
+	stats, err := s.store.DeliveryStats(ctx, sub.ConsumerName(), time.Now().Add(-statsWindow))
+	if err != nil {
+		return subscriptionRow{}, err
+	}
+	return subscriptionRow{Subscription: sub, Stats: stats}, nil
+}
+
+func (s *Server) render(w http.ResponseWriter, status int, name string, data pageData) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; style-src 'unsafe-inline'")
+	w.WriteHeader(status)
+	if err := templates.ExecuteTemplate(w, name, data); err != nil {
+		s.logger.Error("failed to render template", "template", name, "error", err)
+	}
+}
+
+func (s *Server) uiError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrNotFound) {
+		s.render(w, http.StatusNotFound, "error.html", pageData{Title: "Not found", Error: "not found"})
+		return
+	}
+	s.logger.Error("dashboard request failed", "error", err)
+	s.render(w, http.StatusInternalServerError, "error.html", pageData{Title: "Error", Error: "internal error"})
+}
+
+func formList(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' || r == '\n' || r == '\r' })
+}
+
+// formRules splits comma separated rules, whose words are separated by
+// spaces.
+func formRules(s string) []string {
+	var rules []string
+	for _, rule := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '\n' || r == '\r' }) {
+		if rule = strings.TrimSpace(rule); rule != "" {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
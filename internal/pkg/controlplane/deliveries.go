@@ -0,0 +1,232 @@
+package controlplane
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/pkg/consumer"
+	"github.com/eurosky/firehose-processor-aas/pkg/events"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	deliveryRetention = 7 * 24 * time.Hour
+	ingestBatchSize   = 500
+)
+
+const deliveriesSchema = `
+CREATE TABLE IF NOT EXISTS deliveries (
+	id TEXT PRIMARY KEY,
+	consumer TEXT NOT NULL,
+	target TEXT NOT NULL,
+	status TEXT NOT NULL,
+	error TEXT NOT NULL,
+	events INTEGER NOT NULL,
+	first_seq INTEGER NOT NULL,
+	last_seq INTEGER NOT NULL,
+	duration_ms INTEGER NOT NULL,
+	redelivery_of TEXT NOT NULL,
+	time TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS deliveries_consumer_time ON deliveries (consumer, time);
+`
+
+// DeliveryStats summarizes the delivery attempts of a consumer.
+type DeliveryStats = events.DeliveryStats
+
+// InsertDelivery stores a delivery record. Records are idempotent on ID, as
+// the ingest may see a record twice.
+func (s *Store) InsertDelivery(ctx context.Context, rec consumer.DeliveryRecord) error {
+	_, err := s.db.ExecContext(ctx, `INSERT OR IGNORE INTO deliveries
+		(id, consumer, target, status, error, events, first_seq, last_seq, duration_ms, redelivery_of, time)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		rec.ID, rec.Consumer, rec.Target, rec.Status, rec.Error, rec.Events,
+		int64(rec.FirstSeq), int64(rec.LastSeq), rec.DurationMs, rec.RedeliveryOf, formatTime(rec.Time))
+	if err != nil {
+		return storeError("insert delivery", err)
+	}
+	return nil
+}
+
+func (s *Store) GetDelivery(ctx context.Context, id string) (consumer.DeliveryRecord, error) {
+	recs, err := s.queryDeliveries(ctx, `WHERE id = ?`, 1, id)
+	if err != nil {
+		return consumer.DeliveryRecord{}, err
+	}
+	if len(recs) == 0 {
+		return consumer.DeliveryRecord{}, ErrNotFound
+	}
+	return recs[0], nil
+}
+
+// DeliveryQuery selects delivery records. Zero fields match everything.
+type DeliveryQuery struct {
+	Consumer string
+	Status   string
+	// Seq matches the attempts whose stream range covers the sequence.
+	Seq   uint64
+	Since time.Time
+	Limit int
+}
+
+// ListDeliveries returns the latest attempts matching q, newest first.
+func (s *Store) ListDeliveries(ctx context.Context, q DeliveryQuery) ([]consumer.DeliveryRecord, error) {
+	where := `WHERE consumer = ? AND (? = '' OR status = ?) AND (? = 0 OR ? BETWEEN first_seq AND last_seq) AND time >= ?`
+	seq := int64(q.Seq)
+	return s.queryDeliveries(ctx, where, q.Limit, q.Consumer, q.Status, q.Status, seq, seq, formatTime(q.Since))
+}
+
+func (s *Store) DeliveryStats(ctx context.Context, consumerName string, since time.Time) (DeliveryStats, error) {
+	var st DeliveryStats
+	var events sql.NullInt64
+	err := s.db.QueryRowContext(ctx, `SELECT
+			COUNT(*),
+			COUNT(*) FILTER (WHERE status = ?),
+			COUNT(*) FILTER (WHERE status = ?),
+			SUM(events) FILTER (WHERE status = ?)
+		FROM deliveries WHERE consumer = ? AND time >= ?`,
+		consumer.DeliveryDelivered, consumer.DeliveryFailed, consumer.DeliveryDelivered,
+		consumerName, formatTime(since)).Scan(&st.Attempts, &st.Delivered, &st.Failed, &events)
+	if err != nil {
+		return DeliveryStats{}, storeError("get delivery stats", err)
+	}
+	st.Events = events.Int64
+	return st, nil
+}
+
+// PruneDeliveries deletes records older than before.
+func (s *Store) PruneDeliveries(ctx context.Context, before time.Time) (int64, error) {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM deliveries WHERE time < ?`, formatTime(before))
+	if err != nil {
+		return 0, storeError("prune deliveries", err)
+	}
+	return res.RowsAffected()
+}
+
+func (s *Store) queryDeliveries(ctx context.Context, where string, limit int, args ...any) ([]consumer.DeliveryRecord, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, consumer, target, status, error, events, first_seq, last_seq, duration_ms, redelivery_of, time
+		FROM deliveries `+where+` ORDER BY time DESC LIMIT ?`, append(args, limit)...)
+	if err != nil {
+		return nil, storeError("list deliveries", err)
+	}
+	defer rows.Close()
+
+	recs := []consumer.DeliveryRecord{}
+	for rows.Next() {
+		var rec consumer.DeliveryRecord
+		var target, ts string
+		var first, last int64
+		if err := rows.Scan(&rec.ID, &rec.Consumer, &target, &rec.Status, &rec.Error, &rec.Events,
+			&first, &last, &rec.DurationMs, &rec.RedeliveryOf, &ts); err != nil {
+			return nil, storeError("list deliveries", err)
+		}
+		rec.Target = target
+		rec.FirstSeq, rec.LastSeq = uint64(first), uint64(last)
+		rec.Time = parseTime(ts)
+		recs = append(recs, rec)
+	}
+	return recs, rows.Err()
+}
+
+// IngestDeliveries copies the delivery records consumers publish into the
+// store until ctx is done, and prunes records past the retention.
+func IngestDeliveries(ctx context.Context, js nats.JetStreamContext, store *Store, logger *slog.Logger) error {
+	if err := consumer.EnsureDeliveryLogStream(js); err != nil {
+		return fmt.Errorf("failed to create delivery log stream: %w", err)
+	}
+	sub, err := js.PullSubscribe(consumer.DeliveryLogSubjectPrefix+">", "control-plane",
+		nats.BindStream(consumer.DeliveryLogStream),
+		nats.AckExplicit(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to delivery log: %w", err)
+	}
+	defer sub.Unsubscribe()
+
+	lastPrune := time.Time{}
+	for ctx.Err() == nil {
+		if time.Since(lastPrune) > time.Hour {
+			if n, err := store.PruneDeliveries(ctx, time.Now().Add(-deliveryRetention)); err != nil {
+				logger.Warn("failed to prune deliveries", "error", err)
+			} else if n > 0 {
+				logger.Info("pruned delivery records", "count", n)
+			}
+			lastPrune = time.Now()
+		}
+
+		// A context rather than nats.MaxWait, so shutdown ends the wait
+		fetchCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		msgs, err := sub.Fetch(ingestBatchSize, nats.Context(fetchCtx))
+		cancel()
+		if ctx.Err() == nil && (errors.Is(err, nats.ErrTimeout) || errors.Is(err, context.DeadlineExceeded)) {
+			continue
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			logger.Warn("delivery log fetch error", "error", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		for _, msg := range msgs {
+			var rec consumer.DeliveryRecord
+			if err := json.Unmarshal(msg.Data, &rec); err != nil || rec.ID == "" {
+				logger.Warn("dropping malformed delivery record", "subject", msg.Subject)
+				msg.Term()
+				continue
+			}
+			if err := store.InsertDelivery(ctx, rec); err != nil {
+				logger.Warn("failed to store delivery record", "error", err)
+				msg.NakWithDelay(5 * time.Second)
+				continue
+			}
+			msg.Ack()
+		}
+	}
+	return nil
+}
+
+// Redeliverer asks the consumer that made a delivery attempt to retry it.
+type Redeliverer struct {
+	nc      *nats.Conn
+	timeout time.Duration
+}
+
+func NewRedeliverer(nc *nats.Conn) *Redeliverer {
+	return &Redeliverer{nc: nc, timeout: 60 * time.Second}
+}
+
+// Redeliver retries rec and returns the record of the new attempt, which may
+// itself have failed.
+func (r *Redeliverer) Redeliver(ctx context.Context, rec consumer.DeliveryRecord) (consumer.DeliveryRecord, error) {
+	if rec.FirstSeq == 0 {
+		return consumer.DeliveryRecord{}, errors.New("delivery has no stream range to redeliver")
+	}
+	data, _ := json.Marshal(consumer.RedeliverRequest{DeliveryID: rec.ID, FirstSeq: rec.FirstSeq, LastSeq: rec.LastSeq})
+
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	msg, err := r.nc.RequestWithContext(ctx, consumer.RedeliverSubjectPrefix+rec.Consumer, data)
+	if errors.Is(err, nats.ErrNoResponders) {
+		return consumer.DeliveryRecord{}, fmt.Errorf("consumer %s is not running", rec.Consumer)
+	}
+	if err != nil {
+		return consumer.DeliveryRecord{}, fmt.Errorf("redelivery request failed: %w", err)
+	}
+
+	var reply consumer.RedeliverReply
+	if err := json.Unmarshal(msg.Data, &reply); err != nil {
+		return consumer.DeliveryRecord{}, fmt.Errorf("invalid redelivery reply: %w", err)
+	}
+	if reply.Error != "" {
+		return consumer.DeliveryRecord{}, errors.New(reply.Error)
+	}
+	return reply.Record, nil
+}
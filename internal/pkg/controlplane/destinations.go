@@ -0,0 +1,147 @@
+package controlplane
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/eurosky/firehose-processor-aas/pkg/consumer"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Destinations are where the fleet lets tenants point subscriptions of the
+// sqs, sns, pubsub, postgres, clickhouse and mqtt targets, by target. The
+// fleet delivers to those with its own cloud credentials and from its own
+// network, and they have no verification handshake, so a tenant may only
+// name the queues, topics and servers its operator allowed:
+//
+//   - sqs: prefixes of queue URLs, e.g.
+//     https://sqs.eu-west-1.amazonaws.com/123456789012/tenant-
+//   - sns: prefixes of topic ARNs, e.g. arn:aws:sns:eu-west-1:123456789012:
+//   - pubsub: prefixes of topic IDs, in the fleet's project
+//   - postgres, clickhouse and mqtt: server hosts, host or host:port
+//
+// A target without entries is closed to tenants.
+type Destinations map[consumer.Target][]string
+
+// destinationKinds tells how each target's entries match.
+var destinationKinds = map[consumer.Target]string{
+	consumer.TargetSQS:        "url",
+	consumer.TargetSNS:        "prefix",
+	consumer.TargetPubSub:     "prefix",
+	consumer.TargetPostgres:   "host",
+	consumer.TargetClickHouse: "host",
+	consumer.TargetMQTT:       "host",
+}
+
+// ParseDestinations parses entries of the form target=destination.
+func ParseDestinations(entries []string) (Destinations, error) {
+	d := make(Destinations)
+	for _, e := range entries {
+		name, dest, ok := strings.Cut(e, "=")
+		target := consumer.Target(strings.TrimSpace(name))
+		dest = strings.TrimSpace(dest)
+		kind := destinationKinds[target]
+		if !ok || dest == "" || kind == "" {
+			return nil, fmt.Errorf("destination %q must look like target=destination, with a target of sqs, sns, pubsub, postgres, clickhouse or mqtt", e)
+		}
+		if kind == "url" {
+			u, err := url.Parse(dest)
+			if err != nil || u.Scheme != "https" || u.Host == "" || u.User != nil {
+				return nil, fmt.Errorf("sqs destination %q must be an https URL prefix", e)
+			}
+		}
+		d[target] = append(d[target], dest)
+	}
+	return d, nil
+}
+
+// check returns an error unless the fleet allows the destination of spec.
+// Webhooks are verified instead, chat targets and email recipients are
+// checked elsewhere.
+func (d Destinations) check(spec SubscriptionSpec) error {
+	kind := destinationKinds[spec.Target]
+	if kind == "" {
+		return nil
+	}
+	allowed := d[spec.Target]
+	if len(allowed) == 0 {
+		return fmt.Errorf("the %s target is not available to subscriptions on this control plane", spec.Target)
+	}
+
+	switch kind {
+	case "url":
+		u, err := url.Parse(spec.URL)
+		if err != nil || u.User != nil || u.RawQuery != "" {
+			break
+		}
+		// As parsed, so neither userinfo nor a port gets through
+		parsed := u.Scheme + "://" + u.Host + u.EscapedPath()
+		for _, prefix := range allowed {
+			if strings.HasPrefix(parsed, prefix) {
+				return nil
+			}
+		}
+	case "prefix":
+		for _, prefix := range allowed {
+			if strings.HasPrefix(spec.URL, prefix) {
+				return nil
+			}
+		}
+	case "host":
+		hosts, err := destinationHosts(spec.Target, spec.URL)
+		if err != nil {
+			return err
+		}
+		if allowedHosts(hosts, allowed) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s destination %s is not one the fleet allows: %s", spec.Target, maskPassword(spec.URL), strings.Join(allowed, ", "))
+}
+
+// destinationHosts returns the host:port of every server a postgres,
+// clickhouse or mqtt destination connects to. A Postgres DSN may list
+// several, and its query parameters override the host of its URL.
+func destinationHosts(target consumer.Target, dest string) ([]string, error) {
+	if target == consumer.TargetPostgres {
+		cfg, err := pgconn.ParseConfig(dest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid postgres DSN: %v", err)
+		}
+		hosts := []string{net.JoinHostPort(cfg.Host, strconv.Itoa(int(cfg.Port)))}
+		for _, fb := range cfg.Fallbacks {
+			hosts = append(hosts, net.JoinHostPort(fb.Host, strconv.Itoa(int(fb.Port))))
+		}
+		return hosts, nil
+	}
+	u, err := url.Parse(dest)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid %s URL %s", target, maskPassword(dest))
+	}
+	return []string{u.Host}, nil
+}
+
+// allowedHosts reports whether every host:port of hosts is allowed, by an
+// entry naming its host, or its host and port.
+func allowedHosts(hosts, allowed []string) bool {
+	for _, h := range hosts {
+		host, port, err := net.SplitHostPort(h)
+		if err != nil {
+			host, port = h, ""
+		}
+		ok := false
+		for _, a := range allowed {
+			if strings.EqualFold(a, host) || (port != "" && strings.EqualFold(a, net.JoinHostPort(host, port))) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
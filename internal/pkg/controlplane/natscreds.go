@@ -0,0 +1,123 @@
+package controlplane
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/pkg/consumer"
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nkeys"
+)
+
+// CredentialsIssuer signs NATS user credentials for tenants, as nsc would,
+// with a key of the account the fleet runs in. Tenants share that account,
+// which holds the stream, so their isolation rests on subject permissions:
+// a user may only pull from and ack the durables of its tenant's
+// subscriptions, on the stream each reads, and read their delivery records.
+// Replies come on an inbox prefix of its own, as _INBOX.> would show other
+// users' replies.
+type CredentialsIssuer struct {
+	key nkeys.KeyPair
+	// account is the account's public key when key is one of its signing
+	// keys, empty when key is the account's own
+	account string
+	ttl     time.Duration
+}
+
+// NATSCredentials is a user of the fleet's NATS account for one tenant.
+type NATSCredentials struct {
+	User      string    `json:"user"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// InboxPrefix must be set as the client's custom inbox prefix
+	InboxPrefix string   `json:"inbox_prefix"`
+	Publish     []string `json:"publish"`
+	Subscribe   []string `json:"subscribe"`
+	// Creds is the .creds file, the JWT and the user's seed
+	Creds string `json:"creds"`
+}
+
+// NewCredentialsIssuer signs with seed, an account seed or the seed of one
+// of its signing keys. A signing key needs the account's public key too.
+func NewCredentialsIssuer(seed, account string, ttl time.Duration) (*CredentialsIssuer, error) {
+	kp, err := nkeys.FromSeed([]byte(seed))
+	if err != nil {
+		return nil, fmt.Errorf("invalid nats account seed: %w", err)
+	}
+	pub, err := kp.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+	if !nkeys.IsValidPublicAccountKey(pub) {
+		return nil, errors.New("nats account seed must be an account or account signing key seed (SA...)")
+	}
+	if account == pub {
+		account = ""
+	}
+	if account != "" && !nkeys.IsValidPublicAccountKey(account) {
+		return nil, errors.New("nats account must be an account public key (A...)")
+	}
+	if ttl <= 0 {
+		return nil, errors.New("nats credentials ttl must be positive")
+	}
+	return &CredentialsIssuer{key: kp, account: account, ttl: ttl}, nil
+}
+
+// Issue creates a user for the tenant, allowed the given subscriptions.
+// Permissions are fixed in the JWT, so subscriptions created later need new
+// credentials.
+func (c *CredentialsIssuer) Issue(tenantID string, subs []Subscription) (NATSCredentials, error) {
+	user, err := nkeys.CreateUser()
+	if err != nil {
+		return NATSCredentials{}, err
+	}
+	userPub, err := user.PublicKey()
+	if err != nil {
+		return NATSCredentials{}, err
+	}
+	userSeed, err := user.Seed()
+	if err != nil {
+		return NATSCredentials{}, err
+	}
+
+	creds := NATSCredentials{
+		User:        userPub,
+		ExpiresAt:   time.Now().Add(c.ttl).UTC().Truncate(time.Second),
+		InboxPrefix: "_INBOX_" + tenantID,
+		Publish:     []string{},
+	}
+	creds.Subscribe = []string{creds.InboxPrefix + ".>"}
+	for _, sub := range subs {
+		name := sub.ConsumerName()
+		stream, _ := consumer.Source(sub.Apply(consumer.Config{}))
+		creds.Publish = append(creds.Publish,
+			fmt.Sprintf("$JS.API.CONSUMER.INFO.%s.%s", stream, name),
+			fmt.Sprintf("$JS.API.CONSUMER.MSG.NEXT.%s.%s", stream, name),
+			fmt.Sprintf("$JS.ACK.%s.%s.>", stream, name),
+		)
+		creds.Subscribe = append(creds.Subscribe, consumer.DeliveryLogSubjectPrefix+name)
+	}
+
+	claims := jwt.NewUserClaims(userPub)
+	claims.Name = tenantID
+	claims.IssuerAccount = c.account
+	claims.Expires = creds.ExpiresAt.Unix()
+	claims.Tags.Add("tenant:" + tenantID)
+	claims.Pub.Allow.Add(creds.Publish...)
+	claims.Sub.Allow.Add(creds.Subscribe...)
+	if len(creds.Publish) == 0 {
+		// An empty allow list allows everything
+		claims.Pub.Deny.Add(">")
+	}
+
+	token, err := claims.Encode(c.key)
+	if err != nil {
+		return NATSCredentials{}, fmt.Errorf("failed to sign user jwt: %w", err)
+	}
+	file, err := jwt.FormatUserConfig(token, userSeed)
+	if err != nil {
+		return NATSCredentials{}, err
+	}
+	creds.Creds = string(file)
+	return creds, nil
+}
@@ -0,0 +1,177 @@
+package controlplane
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/pkg/consumer"
+	"github.com/nats-io/nats.go"
+)
+
+// MaxKeywordQueries is how many keyword queries a subscription may hold.
+const MaxKeywordQueries = 1000
+
+var (
+	errNoKeywords  = errors.New("keyword queries need the control plane to run with --nats-url")
+	errNotKeywords = errors.New("the subscription doesn't filter on keyword queries; set filter.keywords")
+)
+
+// keywordQueries returns the queries of the subscription's consumer, oldest
+// first.
+func keywordQueries(kv nats.KeyValue, sub Subscription) ([]consumer.KeywordQuery, error) {
+	w, err := kv.Watch(consumer.KeywordKey(sub.ConsumerName(), "*"), nats.IgnoreDeletes())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list keyword queries: %w", err)
+	}
+	defer w.Stop()
+	queries := []consumer.KeywordQuery{}
+	for entry := range w.Updates() {
+		if entry == nil {
+			break
+		}
+		var q consumer.KeywordQuery
+		if json.Unmarshal(entry.Value(), &q) == nil {
+			queries = append(queries, q)
+		}
+	}
+	slices.SortFunc(queries, func(a, b consumer.KeywordQuery) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	return queries, nil
+}
+
+// dropKeywordQueries removes the queries of deleted subscriptions, which no
+// consumer reads anymore. Failures are only logged.
+func (s *Server) dropKeywordQueries(subs ...Subscription) {
+	if s.js == nil {
+		return
+	}
+	kv, err := consumer.EnsureKeywordBucket(s.js)
+	if err != nil {
+		s.logger.Warn("failed to open keyword bucket", "error", err)
+		return
+	}
+	for _, sub := range subs {
+		if !sub.Filter.Keywords {
+			continue
+		}
+		queries, err := keywordQueries(kv, sub)
+		if err != nil {
+			s.logger.Warn("failed to delete keyword queries", "subscription", sub.ID, "error", err)
+			continue
+		}
+		for _, q := range queries {
+			if err := kv.Delete(consumer.KeywordKey(sub.ConsumerName(), q.ID)); err != nil {
+				s.logger.Warn("failed to delete keyword query", "subscription", sub.ID, "query", q.ID, "error", err)
+			}
+		}
+	}
+}
+
+// keywordSubscription returns the tenant's subscription of the request and
+// the keyword bucket, or writes the error.
+func (s *Server) keywordSubscription(w http.ResponseWriter, r *http.Request) (Subscription, nats.KeyValue, bool) {
+	if s.js == nil {
+		writeError(w, http.StatusServiceUnavailable, errNoKeywords)
+		return Subscription{}, nil, false
+	}
+	sub, err := s.store.GetSubscription(r.Context(), tenantFrom(r.Context()).ID, r.PathValue("id"))
+	if err != nil {
+		s.storeError(w, err)
+		return Subscription{}, nil, false
+	}
+	kv, err := consumer.EnsureKeywordBucket(s.js)
+	if err != nil {
+		s.internalError(w, err)
+		return Subscription{}, nil, false
+	}
+	return sub, kv, true
+}
+
+func (s *Server) createKeywordQuery(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Query string `json:"query"`
+	}
+	if !decode(w, r, &req) {
+		return
+	}
+	q := consumer.KeywordQuery{
+		ID:        newID("kwq_"),
+		Query:     strings.TrimSpace(req.Query),
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := q.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	sub, kv, ok := s.keywordSubscription(w, r)
+	if !ok {
+		return
+	}
+	if !sub.Filter.Keywords {
+		writeError(w, http.StatusConflict, errNotKeywords)
+		return
+	}
+	queries, err := keywordQueries(kv, sub)
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+	if len(queries) >= MaxKeywordQueries {
+		writeError(w, http.StatusConflict, fmt.Errorf("the subscription already has %d keyword queries", MaxKeywordQueries))
+		return
+	}
+
+	value, _ := json.Marshal(q)
+	if _, err := kv.Create(consumer.KeywordKey(sub.ConsumerName(), q.ID), value); err != nil {
+		s.internalError(w, err)
+		return
+	}
+	tenant := tenantFrom(r.Context())
+	s.logger.Info("keyword query registered", "tenant", tenant.ID, "subscription", sub.ID, "query", q.ID)
+	s.audit(r.Context(), "keyword_query.create", tenant.ID, q.ID, nil, q)
+	writeJSON(w, http.StatusCreated, q)
+}
+
+func (s *Server) listKeywordQueries(w http.ResponseWriter, r *http.Request) {
+	sub, kv, ok := s.keywordSubscription(w, r)
+	if !ok {
+		return
+	}
+	queries, err := keywordQueries(kv, sub)
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, queries)
+}
+
+func (s *Server) deleteKeywordQuery(w http.ResponseWriter, r *http.Request) {
+	sub, kv, ok := s.keywordSubscription(w, r)
+	if !ok {
+		return
+	}
+	key := consumer.KeywordKey(sub.ConsumerName(), r.PathValue("query"))
+	entry, err := kv.Get(key)
+	if errors.Is(err, nats.ErrKeyNotFound) || errors.Is(err, nats.ErrInvalidKey) {
+		writeError(w, http.StatusNotFound, ErrNotFound)
+		return
+	}
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+	if err := kv.Delete(key); err != nil {
+		s.internalError(w, err)
+		return
+	}
+	var before consumer.KeywordQuery
+	json.Unmarshal(entry.Value(), &before)
+	tenant := tenantFrom(r.Context())
+	s.logger.Info("keyword query unregistered", "tenant", tenant.ID, "subscription", sub.ID, "query", before.ID)
+	s.audit(r.Context(), "keyword_query.delete", tenant.ID, before.ID, before, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,390 @@
+package controlplane
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/pkg/consumer"
+)
+
+// ReplayStaleAfter is how long a running replay may go without a progress
+// report before another replica takes it over.
+const ReplayStaleAfter = time.Minute
+
+const replaysSchema = `
+CREATE TABLE IF NOT EXISTS replays (
+	id TEXT PRIMARY KEY,
+	subscription_id TEXT NOT NULL REFERENCES subscriptions(id) ON DELETE CASCADE,
+	tenant_id TEXT NOT NULL,
+	state TEXT NOT NULL,
+	from_seq INTEGER NOT NULL,
+	to_seq INTEGER NOT NULL,
+	from_time TEXT NOT NULL,
+	to_time TEXT NOT NULL,
+	instance TEXT NOT NULL DEFAULT '',
+	delivered INTEGER NOT NULL DEFAULT 0,
+	skipped INTEGER NOT NULL DEFAULT 0,
+	last_seq INTEGER NOT NULL DEFAULT 0,
+	end_seq INTEGER NOT NULL DEFAULT 0,
+	error TEXT NOT NULL DEFAULT '',
+	created_at TEXT NOT NULL,
+	updated_at TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS replays_subscription ON replays (subscription_id, created_at);
+CREATE INDEX IF NOT EXISTS replays_state ON replays (state);
+`
+
+// Replay states. A replay is pending until a fleet replica claims it, and
+// active while pending or running.
+const (
+	ReplayPending   = "pending"
+	ReplayRunning   = "running"
+	ReplayDone      = "done"
+	ReplayFailed    = "failed"
+	ReplayCancelled = "cancelled"
+)
+
+var (
+	errReplayActive   = errors.New("the subscription already has a replay in progress")
+	errReplayFinished = errors.New("the replay has already finished")
+)
+
+// ReplayRequest is the window of the stream a replay delivers: the sequences
+// FromSeq to ToSeq, or the events stored from From until To. Without an end
+// it runs to the end of the stream as it is when the replay starts.
+type ReplayRequest struct {
+	FromSeq uint64     `json:"from_seq,omitempty"`
+	ToSeq   uint64     `json:"to_seq,omitempty"`
+	From    *time.Time `json:"from,omitempty"`
+	To      *time.Time `json:"to,omitempty"`
+}
+
+func (r ReplayRequest) Validate() error {
+	switch {
+	case r.FromSeq > 0 && r.From != nil:
+		return errors.New("from_seq and from are mutually exclusive")
+	case r.FromSeq > 0 && r.To != nil, r.From != nil && r.ToSeq > 0:
+		return errors.New("a window is either sequences or times")
+	case r.FromSeq == 0 && r.From == nil:
+		return errors.New("from_seq or from is required")
+	case r.ToSeq > 0 && r.ToSeq < r.FromSeq:
+		return errors.New("to_seq is before from_seq")
+	case r.To != nil && !r.From.Before(*r.To):
+		return errors.New("to must be after from")
+	}
+	return nil
+}
+
+// Replay re-delivers a window of the stream to a subscription through its
+// consumer's pipeline, on whichever fleet replica claims it.
+type Replay struct {
+	ID             string `json:"id"`
+	SubscriptionID string `json:"subscription_id"`
+	TenantID       string `json:"tenant_id"`
+	State          string `json:"state"`
+
+	ReplayRequest
+
+	// Instance is the fleet replica running the replay
+	Instance string `json:"instance,omitempty"`
+	// Delivered and Skipped count the events so far; LastSeq is the last
+	// stream sequence handled and EndSeq the last one the replay reaches
+	Delivered int64  `json:"delivered"`
+	Skipped   int64  `json:"skipped"`
+	LastSeq   uint64 `json:"last_seq"`
+	EndSeq    uint64 `json:"end_seq"`
+	// Error says why a failed replay stopped
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Window returns the part of the stream left to replay: all of it, or what
+// follows LastSeq when another run already handled some.
+func (r Replay) Window() consumer.ReplayWindow {
+	w := consumer.ReplayWindow{FromSeq: r.FromSeq, ToSeq: r.ToSeq}
+	if r.From != nil {
+		w.From = *r.From
+	}
+	if r.To != nil {
+		w.To = *r.To
+	}
+	if r.LastSeq > 0 {
+		w.FromSeq, w.From = r.LastSeq+1, time.Time{}
+		if w.ToSeq == 0 {
+			w.ToSeq = r.EndSeq
+		}
+	}
+	return w
+}
+
+// ReplayReport is the progress a fleet replica reports for a replay: running
+// to claim it or keep it, done or failed when it stopped.
+type ReplayReport struct {
+	Instance  string `json:"instance"`
+	State     string `json:"state"`
+	Delivered int64  `json:"delivered"`
+	Skipped   int64  `json:"skipped"`
+	LastSeq   uint64 `json:"last_seq"`
+	EndSeq    uint64 `json:"end_seq"`
+	Error     string `json:"error,omitempty"`
+}
+
+// FleetReplay is an active replay with the subscription it delivers to.
+type FleetReplay struct {
+	Replay
+	Subscription Subscription `json:"subscription"`
+}
+
+// CreateReplay queues a replay for sub. A subscription runs one replay at a
+// time.
+func (s *Store) CreateReplay(ctx context.Context, sub Subscription, req ReplayRequest) (Replay, error) {
+	now := time.Now().UTC()
+	r := Replay{
+		ID:             newID("rpl_"),
+		SubscriptionID: sub.ID,
+		TenantID:       sub.TenantID,
+		State:          ReplayPending,
+		ReplayRequest:  req,
+		CreatedAt:      now,
+		UpdatedAt:      now,
+	}
+
+	var active int
+	if err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM replays WHERE subscription_id = ? AND state IN (?, ?)`,
+		sub.ID, ReplayPending, ReplayRunning).Scan(&active); err != nil {
+		return Replay{}, storeError("create replay", err)
+	}
+	if active > 0 {
+		return Replay{}, errReplayActive
+	}
+	_, err := s.db.ExecContext(ctx, `INSERT INTO replays
+		(id, subscription_id, tenant_id, state, from_seq, to_seq, from_time, to_time, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		r.ID, r.SubscriptionID, r.TenantID, r.State, int64(r.FromSeq), int64(r.ToSeq),
+		formatOptionalTime(r.From), formatOptionalTime(r.To), formatTime(now), formatTime(now))
+	if err != nil {
+		return Replay{}, storeError("create replay", err)
+	}
+	return r, nil
+}
+
+// GetReplay returns a replay of the tenant's subscription. Empty tenantID
+// and subscriptionID match any.
+func (s *Store) GetReplay(ctx context.Context, tenantID, subscriptionID, id string) (Replay, error) {
+	replays, err := s.queryReplays(ctx, `WHERE id = ? AND (? = '' OR tenant_id = ?) AND (? = '' OR subscription_id = ?)`,
+		id, tenantID, tenantID, subscriptionID, subscriptionID)
+	if err != nil {
+		return Replay{}, err
+	}
+	if len(replays) == 0 {
+		return Replay{}, ErrNotFound
+	}
+	return replays[0], nil
+}
+
+// ListReplays lists the replays of a subscription, newest first.
+func (s *Store) ListReplays(ctx context.Context, subscriptionID string) ([]Replay, error) {
+	return s.queryReplays(ctx, `WHERE subscription_id = ? ORDER BY created_at DESC LIMIT 100`, subscriptionID)
+}
+
+// ActiveReplays lists the pending and running replays.
+func (s *Store) ActiveReplays(ctx context.Context) ([]Replay, error) {
+	return s.queryReplays(ctx, `WHERE state IN (?, ?) ORDER BY created_at`, ReplayPending, ReplayRunning)
+}
+
+// CancelReplay cancels an active replay; the replica running it stops at its
+// next progress report.
+func (s *Store) CancelReplay(ctx context.Context, r Replay) (Replay, error) {
+	r.UpdatedAt = time.Now().UTC()
+	err := s.exec(ctx, "cancel replay", `UPDATE replays SET state = ?, updated_at = ? WHERE id = ? AND state IN (?, ?)`,
+		ReplayCancelled, formatTime(r.UpdatedAt), r.ID, ReplayPending, ReplayRunning)
+	if errors.Is(err, ErrNotFound) {
+		return Replay{}, errReplayFinished
+	}
+	if err != nil {
+		return Replay{}, err
+	}
+	r.State = ReplayCancelled
+	return r, nil
+}
+
+// ReportReplay records a replica's report and returns the replay as stored.
+// Only the replica running the replay may report, unless the replay is
+// pending or went ReplayStaleAfter without a report, which lets another one
+// claim it. The replay returned tells the replica whether to carry on.
+func (s *Store) ReportReplay(ctx context.Context, id string, rep ReplayReport) (Replay, error) {
+	now := time.Now().UTC()
+	_, err := s.db.ExecContext(ctx, `UPDATE replays
+		SET state = ?, instance = ?, delivered = ?, skipped = ?, last_seq = ?, end_seq = ?, error = ?, updated_at = ?
+		WHERE id = ? AND (state = ? OR (state = ? AND (instance = ? OR updated_at < ?)))`,
+		rep.State, rep.Instance, rep.Delivered, rep.Skipped, int64(rep.LastSeq), int64(rep.EndSeq), rep.Error, formatTime(now),
+		id, ReplayPending, ReplayRunning, rep.Instance, formatTime(now.Add(-ReplayStaleAfter)))
+	if err != nil {
+		return Replay{}, storeError("report replay", err)
+	}
+	return s.GetReplay(ctx, "", "", id)
+}
+
+func (s *Store) queryReplays(ctx context.Context, where string, args ...any) ([]Replay, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, subscription_id, tenant_id, state, from_seq, to_seq, from_time, to_time,
+			instance, delivered, skipped, last_seq, end_seq, error, created_at, updated_at
+		FROM replays `+where, args...)
+	if err != nil {
+		return nil, storeError("list replays", err)
+	}
+	defer rows.Close()
+
+	replays := []Replay{}
+	for rows.Next() {
+		var r Replay
+		var fromSeq, toSeq, lastSeq, endSeq int64
+		var from, to, created, updated string
+		if err := rows.Scan(&r.ID, &r.SubscriptionID, &r.TenantID, &r.State, &fromSeq, &toSeq, &from, &to,
+			&r.Instance, &r.Delivered, &r.Skipped, &lastSeq, &endSeq, &r.Error, &created, &updated); err != nil {
+			return nil, storeError("list replays", err)
+		}
+		r.FromSeq, r.ToSeq, r.LastSeq, r.EndSeq = uint64(fromSeq), uint64(toSeq), uint64(lastSeq), uint64(endSeq)
+		r.From, r.To = parseOptionalTime(from), parseOptionalTime(to)
+		r.CreatedAt = parseTime(created)
+		r.UpdatedAt = parseTime(updated)
+		replays = append(replays, r)
+	}
+	return replays, rows.Err()
+}
+
+func formatOptionalTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return formatTime(*t)
+}
+
+func parseOptionalTime(s string) *time.Time {
+	if s == "" {
+		return nil
+	}
+	t := parseTime(s)
+	return &t
+}
+
+func (s *Server) createReplay(w http.ResponseWriter, r *http.Request) {
+	var req ReplayRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	if err := req.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	tenant := tenantFrom(r.Context())
+	sub, err := s.store.GetSubscription(r.Context(), tenant.ID, r.PathValue("id"))
+	if err != nil {
+		s.storeError(w, err)
+		return
+	}
+	if !sub.Verified {
+		writeError(w, http.StatusConflict, errors.New("the subscription's webhook URL is not verified"))
+		return
+	}
+	rp, err := s.store.CreateReplay(r.Context(), sub, req)
+	if err != nil {
+		s.storeError(w, err)
+		return
+	}
+	s.logger.Info("replay requested", "tenant", tenant.ID, "subscription", sub.ID, "replay", rp.ID)
+	s.audit(r.Context(), "replay.create", tenant.ID, rp.ID, nil, rp)
+	writeJSON(w, http.StatusAccepted, rp)
+}
+
+func (s *Server) listReplays(w http.ResponseWriter, r *http.Request) {
+	sub, err := s.store.GetSubscription(r.Context(), tenantFrom(r.Context()).ID, r.PathValue("id"))
+	if err != nil {
+		s.storeError(w, err)
+		return
+	}
+	replays, err := s.store.ListReplays(r.Context(), sub.ID)
+	if err != nil {
+		s.storeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, replays)
+}
+
+func (s *Server) getReplay(w http.ResponseWriter, r *http.Request) {
+	rp, err := s.store.GetReplay(r.Context(), tenantFrom(r.Context()).ID, r.PathValue("id"), r.PathValue("replay"))
+	if err != nil {
+		s.storeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, rp)
+}
+
+func (s *Server) cancelReplay(w http.ResponseWriter, r *http.Request) {
+	tenant := tenantFrom(r.Context())
+	before, err := s.store.GetReplay(r.Context(), tenant.ID, r.PathValue("id"), r.PathValue("replay"))
+	if err != nil {
+		s.storeError(w, err)
+		return
+	}
+	rp, err := s.store.CancelReplay(r.Context(), before)
+	if err != nil {
+		s.storeError(w, err)
+		return
+	}
+	s.logger.Info("replay cancelled", "tenant", tenant.ID, "subscription", rp.SubscriptionID, "replay", rp.ID)
+	s.audit(r.Context(), "replay.cancel", tenant.ID, rp.ID, before, rp)
+	writeJSON(w, http.StatusOK, rp)
+}
+
+// fleetReplays lists the active replays of verified subscriptions.
+func (s *Server) fleetReplays(w http.ResponseWriter, r *http.Request) {
+	replays, err := s.store.ActiveReplays(r.Context())
+	if err != nil {
+		s.storeError(w, err)
+		return
+	}
+	fleet := []FleetReplay{}
+	for _, rp := range replays {
+		sub, err := s.store.GetSubscription(r.Context(), "", rp.SubscriptionID)
+		if err != nil {
+			s.storeError(w, err)
+			return
+		}
+		if sub.Verified {
+			fleet = append(fleet, FleetReplay{Replay: rp, Subscription: sub})
+		}
+	}
+	writeJSON(w, http.StatusOK, fleet)
+}
+
+func (s *Server) reportReplay(w http.ResponseWriter, r *http.Request) {
+	var rep ReplayReport
+	if !decode(w, r, &rep) {
+		return
+	}
+	switch {
+	case rep.Instance == "":
+		writeError(w, http.StatusBadRequest, errors.New("instance is required"))
+		return
+	case rep.State != ReplayRunning && rep.State != ReplayDone && rep.State != ReplayFailed:
+		writeError(w, http.StatusBadRequest, errors.New("state must be running, done or failed"))
+		return
+	}
+
+	rp, err := s.store.ReportReplay(r.Context(), r.PathValue("replay"), rep)
+	if err != nil {
+		s.storeError(w, err)
+		return
+	}
+	// A replay cancelled, finished or run by another replica is returned as
+	// it is, for the reporting replica to stop
+	if rp.State == rep.State && rp.Instance == rep.Instance && rep.State != ReplayRunning {
+		s.logger.Info("replay "+rep.State, "tenant", rp.TenantID, "subscription", rp.SubscriptionID, "replay", rp.ID,
+			"delivered", rp.Delivered, "skipped", rp.Skipped, "error", rp.Error)
+	}
+	writeJSON(w, http.StatusOK, rp)
+}
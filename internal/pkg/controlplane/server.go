@@ -0,0 +1,849 @@
+package controlplane
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/internal/pkg/auth"
+	"github.com/eurosky/firehose-processor-aas/pkg/consumer"
+	"github.com/eurosky/firehose-processor-aas/pkg/firehose"
+	"github.com/nats-io/nats.go"
+)
+
+const maxBodySize = 1 << 20
+
+// Server is the control plane HTTP API. Tenant management requires the admin
+// scope, the fleet endpoint the fleet scope, the topology an operator
+// credential with the read scope and subscription endpoints a tenant
+// credential with the subscriptions scope (see package auth).
+type Server struct {
+	store     *Store
+	redeliver *Redeliverer
+	verifier  *Verifier
+	creds     *CredentialsIssuer
+	dests     Destinations
+	js        nats.JetStreamContext
+	logger    *slog.Logger
+	mux       *http.ServeMux
+}
+
+// NewServer serves the API and the dashboard with authn, which should resolve
+// tenant API keys through store in addition to any operator credentials, and
+// accept the SessionCookie for the dashboard. redeliver may be nil, which
+// disables manual redelivery. verifier may be nil, which accepts webhook URLs
+// without the verification handshake. creds may be nil, which disables NATS
+// credentials for tenants. dests are where tenants may point subscriptions of
+// targets without a handshake; a nil one closes those targets. js may be nil,
+// which disables the topology view, keyword queries and watchlists.
+func NewServer(store *Store, authn *auth.Authenticator, redeliver *Redeliverer, verifier *Verifier, creds *CredentialsIssuer, dests Destinations, js nats.JetStreamContext, logger *slog.Logger) *Server {
+	s := &Server{
+		store:     store,
+		redeliver: redeliver,
+		verifier:  verifier,
+		creds:     creds,
+		dests:     dests,
+		js:        js,
+		logger:    logger,
+		mux:       http.NewServeMux(),
+	}
+
+	s.mux.HandleFunc("GET /health", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+	})
+
+	admin := func(h http.HandlerFunc) http.HandlerFunc { return authn.RequireFunc(auth.ScopeAdmin, h) }
+	tenant := func(h http.HandlerFunc) http.HandlerFunc {
+		return authn.RequireFunc(auth.ScopeSubscriptions, requireTenant(h))
+	}
+
+	s.mux.HandleFunc("POST /v1/tenants", admin(s.createTenant))
+	s.mux.HandleFunc("GET /v1/tenants", admin(s.listTenants))
+	s.mux.HandleFunc("GET /v1/tenants/{tenant}", admin(s.getTenant))
+	s.mux.HandleFunc("DELETE /v1/tenants/{tenant}", admin(s.deleteTenant))
+	s.mux.HandleFunc("PUT /v1/tenants/{tenant}/redaction", admin(s.setRedaction))
+	s.mux.HandleFunc("PUT /v1/tenants/{tenant}/email-domains", admin(s.setEmailDomains))
+	s.mux.HandleFunc("POST /v1/tenants/{tenant}/keys", admin(s.createAPIKey))
+	s.mux.HandleFunc("GET /v1/tenants/{tenant}/keys", admin(s.listAPIKeys))
+	s.mux.HandleFunc("DELETE /v1/tenants/{tenant}/keys/{key}", admin(s.deleteAPIKey))
+	s.mux.HandleFunc("POST /v1/tenants/{tenant}/nats-credentials", admin(s.issueNATSCredentials))
+	s.mux.HandleFunc("GET /v1/audit", admin(s.listAudit))
+
+	s.mux.HandleFunc("GET /v1/subscriptions", tenant(s.listSubscriptions))
+	s.mux.HandleFunc("POST /v1/subscriptions", tenant(s.createSubscription))
+	s.mux.HandleFunc("GET /v1/subscriptions/{id}", tenant(s.getSubscription))
+	s.mux.HandleFunc("PUT /v1/subscriptions/{id}", tenant(s.updateSubscription))
+	s.mux.HandleFunc("DELETE /v1/subscriptions/{id}", tenant(s.deleteSubscription))
+	s.mux.HandleFunc("POST /v1/subscriptions/{id}/rotate-secret", tenant(s.rotateSecretHandler))
+	s.mux.HandleFunc("POST /v1/subscriptions/{id}/verify", tenant(s.verifyHandler))
+	s.mux.HandleFunc("POST /v1/subscriptions/{id}/replay", tenant(s.createReplay))
+	s.mux.HandleFunc("GET /v1/subscriptions/{id}/replays", tenant(s.listReplays))
+	s.mux.HandleFunc("GET /v1/subscriptions/{id}/replays/{replay}", tenant(s.getReplay))
+	s.mux.HandleFunc("POST /v1/subscriptions/{id}/replays/{replay}/cancel", tenant(s.cancelReplay))
+	s.mux.HandleFunc("POST /v1/subscriptions/{id}/queries", tenant(s.createKeywordQuery))
+	s.mux.HandleFunc("GET /v1/subscriptions/{id}/queries", tenant(s.listKeywordQueries))
+	s.mux.HandleFunc("DELETE /v1/subscriptions/{id}/queries/{query}", tenant(s.deleteKeywordQuery))
+	s.mux.HandleFunc("POST /v1/subscriptions/{id}/dids", tenant(s.addWatchedDIDs))
+	s.mux.HandleFunc("GET /v1/subscriptions/{id}/dids", tenant(s.listWatchedDIDs))
+	s.mux.HandleFunc("DELETE /v1/subscriptions/{id}/dids/{did}", tenant(s.deleteWatchedDID))
+	s.mux.HandleFunc("POST /v1/nats-credentials", tenant(s.issueNATSCredentials))
+
+	// Operators with the admin scope may inspect any consumer, tenants only
+	// the consumers of their subscriptions
+	deliveries := func(h http.HandlerFunc) http.HandlerFunc { return authn.RequireFunc(auth.ScopeSubscriptions, h) }
+	s.mux.HandleFunc("GET /v1/consumers/{name}/deliveries", deliveries(s.listDeliveries))
+	s.mux.HandleFunc("GET /v1/deliveries/{id}", deliveries(s.getDelivery))
+	s.mux.HandleFunc("POST /v1/deliveries/{id}/redeliver", deliveries(s.redeliverHandler))
+
+	s.mux.HandleFunc("GET /v1/topology", authn.RequireFunc(auth.ScopeRead, requireOperator(s.topology)))
+
+	s.mux.HandleFunc("GET /v1/fleet/subscriptions", authn.RequireFunc(auth.ScopeFleet, s.fleetSubscriptions))
+	s.mux.HandleFunc("GET /v1/fleet/replays", authn.RequireFunc(auth.ScopeFleet, s.fleetReplays))
+	s.mux.HandleFunc("PUT /v1/fleet/replays/{replay}", authn.RequireFunc(auth.ScopeFleet, s.reportReplay))
+
+	s.registerDashboard(authn)
+
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// requireTenant rejects operator credentials, which don't belong to a tenant.
+func requireTenant(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if tenantFrom(r.Context()).ID == "" {
+			writeError(w, http.StatusForbidden, errors.New("tenant credentials required"))
+			return
+		}
+		h(w, r)
+	}
+}
+
+func tenantFrom(ctx context.Context) Tenant {
+	p, _ := auth.FromContext(ctx)
+	return Tenant{ID: p.Tenant}
+}
+
+func (s *Server) createTenant(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	if !decode(w, r, &req) {
+		return
+	}
+	if req.Name == "" {
+		writeError(w, http.StatusBadRequest, errors.New("name is required"))
+		return
+	}
+
+	t, err := s.store.CreateTenant(r.Context(), req.Name)
+	if err != nil {
+		s.storeError(w, err)
+		return
+	}
+	s.logger.Info("tenant created", "tenant", t.ID, "name", t.Name)
+	s.audit(r.Context(), "tenant.create", t.ID, t.ID, nil, t)
+	writeJSON(w, http.StatusCreated, t)
+}
+
+func (s *Server) listTenants(w http.ResponseWriter, r *http.Request) {
+	tenants, err := s.store.ListTenants(r.Context())
+	if err != nil {
+		s.storeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, tenants)
+}
+
+func (s *Server) getTenant(w http.ResponseWriter, r *http.Request) {
+	t, err := s.store.GetTenant(r.Context(), r.PathValue("tenant"))
+	if err != nil {
+		s.storeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, t)
+}
+
+func (s *Server) deleteTenant(w http.ResponseWriter, r *http.Request) {
+	t, err := s.store.GetTenant(r.Context(), r.PathValue("tenant"))
+	if err != nil {
+		s.storeError(w, err)
+		return
+	}
+	subs, err := s.store.ListSubscriptions(r.Context(), t.ID)
+	if err != nil {
+		s.storeError(w, err)
+		return
+	}
+	if err := s.store.DeleteTenant(r.Context(), t.ID); err != nil {
+		s.storeError(w, err)
+		return
+	}
+	s.dropKeywordQueries(subs...)
+	s.dropWatchlists(subs...)
+	s.logger.Info("tenant deleted", "tenant", t.ID)
+	s.audit(r.Context(), "tenant.delete", t.ID, t.ID, t, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setRedaction replaces the redaction rules of the tenant's subscriptions.
+func (s *Server) setRedaction(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Rules []string `json:"rules"`
+	}
+	if !decode(w, r, &req) {
+		return
+	}
+	if _, err := firehose.ParseRedaction(req.Rules); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Rules == nil {
+		req.Rules = []string{}
+	}
+	before, err := s.store.GetTenant(r.Context(), r.PathValue("tenant"))
+	if err != nil {
+		s.storeError(w, err)
+		return
+	}
+
+	t, err := s.store.SetRedaction(r.Context(), before.ID, req.Rules)
+	if err != nil {
+		s.storeError(w, err)
+		return
+	}
+	s.logger.Info("tenant redaction rules set", "tenant", t.ID, "rules", len(t.Redaction))
+	s.audit(r.Context(), "tenant.set_redaction", t.ID, t.ID, before, t)
+	writeJSON(w, http.StatusOK, t)
+}
+
+// setEmailDomains replaces the domains the tenant's email subscriptions may
+// send to.
+func (s *Server) setEmailDomains(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Domains []string `json:"domains"`
+	}
+	if !decode(w, r, &req) {
+		return
+	}
+	domains := []string{}
+	for _, d := range req.Domains {
+		d = strings.ToLower(strings.TrimSpace(d))
+		if !strings.Contains(d, ".") || strings.ContainsAny(d, "@/: ") {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid email domain %q", d))
+			return
+		}
+		domains = append(domains, d)
+	}
+	before, err := s.store.GetTenant(r.Context(), r.PathValue("tenant"))
+	if err != nil {
+		s.storeError(w, err)
+		return
+	}
+
+	t, err := s.store.SetEmailDomains(r.Context(), before.ID, domains)
+	if err != nil {
+		s.storeError(w, err)
+		return
+	}
+	s.logger.Info("tenant email domains set", "tenant", t.ID, "domains", len(t.EmailDomains))
+	s.audit(r.Context(), "tenant.set_email_domains", t.ID, t.ID, before, t)
+	writeJSON(w, http.StatusOK, t)
+}
+
+// createAPIKey issues a tenant key. Tenant keys are limited to the
+// subscriptions and read scopes and default to subscriptions.
+func (s *Server) createAPIKey(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Scopes []auth.Scope `json:"scopes"`
+	}
+	if r.ContentLength != 0 && !decode(w, r, &req) {
+		return
+	}
+	if len(req.Scopes) == 0 {
+		req.Scopes = []auth.Scope{auth.ScopeSubscriptions}
+	}
+	for _, sc := range req.Scopes {
+		if sc != auth.ScopeSubscriptions && sc != auth.ScopeRead {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("scope %q can't be granted to tenant keys", sc))
+			return
+		}
+	}
+
+	k, err := s.store.CreateAPIKey(r.Context(), r.PathValue("tenant"), req.Scopes)
+	if err != nil {
+		s.storeError(w, err)
+		return
+	}
+	s.logger.Info("api key created", "tenant", k.TenantID, "key", k.ID, "scopes", k.Scopes)
+	s.audit(r.Context(), "api_key.create", k.TenantID, k.ID, nil, k)
+	writeJSON(w, http.StatusCreated, k)
+}
+
+func (s *Server) listAPIKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := s.store.ListAPIKeys(r.Context(), r.PathValue("tenant"))
+	if err != nil {
+		s.storeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, keys)
+}
+
+func (s *Server) deleteAPIKey(w http.ResponseWriter, r *http.Request) {
+	keys, err := s.store.ListAPIKeys(r.Context(), r.PathValue("tenant"))
+	if err != nil {
+		s.storeError(w, err)
+		return
+	}
+	var before any
+	for _, k := range keys {
+		if k.ID == r.PathValue("key") {
+			before = k
+		}
+	}
+	if err := s.store.DeleteAPIKey(r.Context(), r.PathValue("tenant"), r.PathValue("key")); err != nil {
+		s.storeError(w, err)
+		return
+	}
+	s.logger.Info("api key deleted", "tenant", r.PathValue("tenant"), "key", r.PathValue("key"))
+	s.audit(r.Context(), "api_key.delete", r.PathValue("tenant"), r.PathValue("key"), before, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type subscriptionRequest struct {
+	Name    string `json:"name"`
+	Enabled *bool  `json:"enabled"`
+	SubscriptionSpec
+}
+
+func (s *Server) listSubscriptions(w http.ResponseWriter, r *http.Request) {
+	subs, err := s.store.ListSubscriptions(r.Context(), tenantFrom(r.Context()).ID)
+	if err != nil {
+		s.storeError(w, err)
+		return
+	}
+	for i := range subs {
+		subs[i].Secret = ""
+	}
+	writeJSON(w, http.StatusOK, subs)
+}
+
+func (s *Server) createSubscription(w http.ResponseWriter, r *http.Request) {
+	var req subscriptionRequest
+	if !decode(w, r, &req) {
+		return
+	}
+
+	sub, err := s.newSubscription(r.Context(), tenantFrom(r.Context()).ID, req)
+	if err != nil {
+		s.storeError(w, err)
+		return
+	}
+	// The only response that carries the secret, besides rotation
+	writeJSON(w, http.StatusCreated, sub)
+}
+
+// badRequest marks errors caused by the request rather than the server.
+type badRequest struct{ error }
+
+// checkRecipients returns a badRequest unless every recipient of an email
+// subscription is at one of its tenant's email domains. The fleet's SMTP
+// relay sends the digests, so tenants may only mail addresses they own.
+func (s *Server) checkRecipients(ctx context.Context, tenantID string, spec SubscriptionSpec) error {
+	if spec.Target != consumer.TargetEmail {
+		return nil
+	}
+	t, err := s.store.GetTenant(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+	if len(t.EmailDomains) == 0 {
+		return badRequest{errors.New("the tenant has no email domains; an admin sets them with PUT /v1/tenants/{tenant}/email-domains")}
+	}
+	for _, to := range (Subscription{SubscriptionSpec: spec}).Apply(consumer.Config{}).EmailTo {
+		a, err := mail.ParseAddress(to)
+		if err != nil {
+			return badRequest{fmt.Errorf("invalid email recipient %q: %w", to, err)}
+		}
+		domain := strings.ToLower(a.Address[strings.LastIndex(a.Address, "@")+1:])
+		if !slices.Contains(t.EmailDomains, domain) {
+			return badRequest{fmt.Errorf("email recipient %s is not at one of the tenant's domains: %s", a.Address, strings.Join(t.EmailDomains, ", "))}
+		}
+	}
+	return nil
+}
+
+func (s *Server) newSubscription(ctx context.Context, tenantID string, req subscriptionRequest) (Subscription, error) {
+	if req.Name == "" {
+		return Subscription{}, badRequest{errors.New("name is required")}
+	}
+	if err := req.SubscriptionSpec.Validate(); err != nil {
+		return Subscription{}, badRequest{err}
+	}
+	if err := s.dests.check(req.SubscriptionSpec); err != nil {
+		return Subscription{}, badRequest{err}
+	}
+	if err := s.checkRecipients(ctx, tenantID, req.SubscriptionSpec); err != nil {
+		return Subscription{}, err
+	}
+	if req.isWebhook() && req.Secret == "" {
+		req.Secret = newSecret()
+	}
+	enabled := req.Enabled == nil || *req.Enabled
+
+	sub, err := s.store.CreateSubscription(ctx, tenantID, req.Name, enabled, req.SubscriptionSpec)
+	if err != nil {
+		return Subscription{}, err
+	}
+	s.logger.Info("subscription created", "tenant", tenantID, "subscription", sub.ID, "target", sub.Target)
+	s.audit(ctx, "subscription.create", tenantID, sub.ID, nil, sub)
+	return s.verify(ctx, sub)
+}
+
+// verify runs the verification handshake for an unverified webhook
+// subscription. A failed handshake is recorded on the subscription rather
+// than returned, so the caller can show it.
+func (s *Server) verify(ctx context.Context, sub Subscription) (Subscription, error) {
+	if sub.Verified {
+		return sub, nil
+	}
+	var verr string
+	if s.verifier != nil {
+		if err := s.verifier.Verify(ctx, sub); err != nil {
+			verr = err.Error()
+		}
+	}
+	before := sub
+	sub, err := s.store.SetVerification(ctx, sub, sub.URL, verr)
+	if err != nil {
+		return Subscription{}, err
+	}
+	s.audit(ctx, "subscription.verify", sub.TenantID, sub.ID, before, sub)
+	if verr != "" {
+		s.logger.Info("webhook verification failed", "tenant", sub.TenantID, "subscription", sub.ID, "error", verr)
+	} else {
+		s.logger.Info("webhook verified", "tenant", sub.TenantID, "subscription", sub.ID)
+	}
+	return sub, nil
+}
+
+// verifyHandler retries the verification handshake. The verified field of
+// the response tells whether it passed.
+func (s *Server) verifyHandler(w http.ResponseWriter, r *http.Request) {
+	sub, err := s.store.GetSubscription(r.Context(), tenantFrom(r.Context()).ID, r.PathValue("id"))
+	if err != nil {
+		s.storeError(w, err)
+		return
+	}
+	sub, err = s.verify(r.Context(), sub)
+	if err != nil {
+		s.storeError(w, err)
+		return
+	}
+	sub.Secret = ""
+	writeJSON(w, http.StatusOK, sub)
+}
+
+// rotateSecretHandler replaces the webhook secret and returns the new one.
+// The fleet picks it up on its next reconcile.
+func (s *Server) rotateSecretHandler(w http.ResponseWriter, r *http.Request) {
+	sub, err := s.rotateSecret(r.Context(), tenantFrom(r.Context()).ID, r.PathValue("id"))
+	if err != nil {
+		s.storeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, sub)
+}
+
+func (s *Server) rotateSecret(ctx context.Context, tenantID, id string) (Subscription, error) {
+	sub, err := s.store.GetSubscription(ctx, tenantID, id)
+	if err != nil {
+		return Subscription{}, err
+	}
+	before := sub
+	sub.Secret = newSecret()
+	sub, err = s.store.UpdateSubscription(ctx, sub)
+	if err != nil {
+		return Subscription{}, err
+	}
+	s.logger.Info("subscription secret rotated", "tenant", tenantID, "subscription", sub.ID, "version", sub.Version)
+	s.audit(ctx, "subscription.rotate_secret", tenantID, sub.ID, before, sub)
+	return sub, nil
+}
+
+// issueNATSCredentials creates a NATS user limited to the subscriptions the
+// tenant has now: the tenant's own, or the one in the path for admins.
+func (s *Server) issueNATSCredentials(w http.ResponseWriter, r *http.Request) {
+	if s.creds == nil {
+		writeError(w, http.StatusNotImplemented, errors.New("nats credentials are not enabled on this control plane"))
+		return
+	}
+	tenantID := tenantFrom(r.Context()).ID
+	if tenantID == "" {
+		tenantID = r.PathValue("tenant")
+		if _, err := s.store.GetTenant(r.Context(), tenantID); err != nil {
+			s.storeError(w, err)
+			return
+		}
+	}
+
+	subs, err := s.store.ListSubscriptions(r.Context(), tenantID)
+	if err != nil {
+		s.storeError(w, err)
+		return
+	}
+	creds, err := s.creds.Issue(tenantID, subs)
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+	p, _ := auth.FromContext(r.Context())
+	s.logger.Info("nats credentials issued", "principal", p.ID, "tenant", tenantID, "user", creds.User, "subscriptions", len(subs), "expires_at", creds.ExpiresAt)
+	s.audit(r.Context(), "nats_credentials.issue", tenantID, creds.User, nil, creds)
+	writeJSON(w, http.StatusCreated, creds)
+}
+
+func newSecret() string {
+	return "whsec_" + randomHex(24)
+}
+
+func (s *Server) getSubscription(w http.ResponseWriter, r *http.Request) {
+	sub, err := s.store.GetSubscription(r.Context(), tenantFrom(r.Context()).ID, r.PathValue("id"))
+	if err != nil {
+		s.storeError(w, err)
+		return
+	}
+	sub.Secret = ""
+	writeJSON(w, http.StatusOK, sub)
+}
+
+// updateSubscription replaces the subscription. An empty secret keeps the
+// current one. The fleet restarts the consumer on the same durable, which
+// resumes at its ack floor with the new spec.
+func (s *Server) updateSubscription(w http.ResponseWriter, r *http.Request) {
+	tenant := tenantFrom(r.Context())
+	sub, err := s.store.GetSubscription(r.Context(), tenant.ID, r.PathValue("id"))
+	if err != nil {
+		s.storeError(w, err)
+		return
+	}
+
+	var req subscriptionRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	before := sub
+	if req.Secret == "" {
+		req.Secret = sub.Secret
+	}
+	if err := req.SubscriptionSpec.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := s.dests.check(req.SubscriptionSpec); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := s.checkRecipients(r.Context(), tenant.ID, req.SubscriptionSpec); err != nil {
+		s.storeError(w, err)
+		return
+	}
+	if req.Name != "" {
+		sub.Name = req.Name
+	}
+	if req.Enabled != nil {
+		sub.Enabled = *req.Enabled
+	}
+	sub.SubscriptionSpec = req.SubscriptionSpec
+
+	sub, err = s.store.UpdateSubscription(r.Context(), sub)
+	if err != nil {
+		s.storeError(w, err)
+		return
+	}
+	s.logger.Info("subscription updated", "tenant", tenant.ID, "subscription", sub.ID, "version", sub.Version)
+	s.audit(r.Context(), "subscription.update", tenant.ID, sub.ID, before, sub)
+	if sub, err = s.verify(r.Context(), sub); err != nil {
+		s.storeError(w, err)
+		return
+	}
+	sub.Secret = ""
+	writeJSON(w, http.StatusOK, sub)
+}
+
+func (s *Server) deleteSubscription(w http.ResponseWriter, r *http.Request) {
+	tenant := tenantFrom(r.Context())
+	sub, err := s.store.GetSubscription(r.Context(), tenant.ID, r.PathValue("id"))
+	if err != nil {
+		s.storeError(w, err)
+		return
+	}
+	if err := s.store.DeleteSubscription(r.Context(), tenant.ID, sub.ID); err != nil {
+		s.storeError(w, err)
+		return
+	}
+	s.dropKeywordQueries(sub)
+	s.dropWatchlists(sub)
+	s.logger.Info("subscription deleted", "tenant", tenant.ID, "subscription", sub.ID)
+	s.audit(r.Context(), "subscription.delete", tenant.ID, sub.ID, sub, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// fleetSubscriptions lists the enabled subscriptions, secrets included, for
+// the consumer fleet to reconcile against.
+func (s *Server) fleetSubscriptions(w http.ResponseWriter, r *http.Request) {
+	subs, err := s.store.EnabledSubscriptions(r.Context())
+	if err != nil {
+		s.storeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, subs)
+}
+
+const (
+	defaultDeliveryLimit = 100
+	maxDeliveryLimit     = 1000
+)
+
+// listDeliveries returns the delivery attempts of a consumer, newest first.
+// Query parameters: status (delivered or failed), seq (attempts covering a
+// stream sequence), since (RFC 3339) and limit.
+func (s *Server) listDeliveries(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if err := s.canInspect(r.Context(), name); err != nil {
+		s.storeError(w, err)
+		return
+	}
+
+	q, err := deliveryQuery(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	q.Consumer = name
+
+	recs, err := s.store.ListDeliveries(r.Context(), q)
+	if err != nil {
+		s.storeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, recs)
+}
+
+func deliveryQuery(v url.Values) (DeliveryQuery, error) {
+	q := DeliveryQuery{Status: v.Get("status"), Limit: defaultDeliveryLimit}
+	switch q.Status {
+	case "", consumer.DeliveryDelivered, consumer.DeliveryFailed:
+	default:
+		return DeliveryQuery{}, fmt.Errorf("status must be %q or %q", consumer.DeliveryDelivered, consumer.DeliveryFailed)
+	}
+	if seq := v.Get("seq"); seq != "" {
+		n, err := strconv.ParseUint(seq, 10, 64)
+		if err != nil {
+			return DeliveryQuery{}, errors.New("seq must be a stream sequence")
+		}
+		q.Seq = n
+	}
+	if since := v.Get("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			return DeliveryQuery{}, errors.New("since must be an RFC 3339 timestamp")
+		}
+		q.Since = t
+	}
+	if limit := v.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxDeliveryLimit {
+			return DeliveryQuery{}, fmt.Errorf("limit must be between 1 and %d", maxDeliveryLimit)
+		}
+		q.Limit = n
+	}
+	return q, nil
+}
+
+// listAudit returns audit entries, oldest first. Query parameters: after
+// (an entry ID, to page), since and until (RFC 3339), tenant and limit. With
+// format=ndjson it exports every matching entry, one per line, and ignores
+// limit.
+func (s *Server) listAudit(w http.ResponseWriter, r *http.Request) {
+	q, err := auditQuery(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if r.URL.Query().Get("format") != "ndjson" {
+		entries, err := s.store.ListAudit(r.Context(), q)
+		if err != nil {
+			s.storeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, entries)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	q.Limit = maxDeliveryLimit
+	for {
+		entries, err := s.store.ListAudit(r.Context(), q)
+		if err != nil {
+			// Headers are out; the truncated export is all we can signal
+			s.logger.Error("audit export failed", "error", err)
+			return
+		}
+		for _, e := range entries {
+			enc.Encode(e)
+		}
+		if len(entries) < q.Limit {
+			return
+		}
+		q.After = entries[len(entries)-1].ID
+	}
+}
+
+func auditQuery(v url.Values) (AuditQuery, error) {
+	q := AuditQuery{TenantID: v.Get("tenant"), Limit: defaultDeliveryLimit}
+	if after := v.Get("after"); after != "" {
+		n, err := strconv.ParseInt(after, 10, 64)
+		if err != nil {
+			return AuditQuery{}, errors.New("after must be an audit entry ID")
+		}
+		q.After = n
+	}
+	for name, t := range map[string]*time.Time{"since": &q.Since, "until": &q.Until} {
+		if s := v.Get(name); s != "" {
+			parsed, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				return AuditQuery{}, fmt.Errorf("%s must be an RFC 3339 timestamp", name)
+			}
+			*t = parsed
+		}
+	}
+	if limit := v.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxDeliveryLimit {
+			return AuditQuery{}, fmt.Errorf("limit must be between 1 and %d", maxDeliveryLimit)
+		}
+		q.Limit = n
+	}
+	return q, nil
+}
+
+func (s *Server) getDelivery(w http.ResponseWriter, r *http.Request) {
+	rec, err := s.inspectDelivery(r.Context(), r.PathValue("id"))
+	if err != nil {
+		s.storeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, rec)
+}
+
+// redeliverHandler asks the consumer to deliver the attempt's stream range
+// again and returns the record of the new attempt. A failed retry is still a
+// 200; its status says how it went.
+func (s *Server) redeliverHandler(w http.ResponseWriter, r *http.Request) {
+	if s.redeliver == nil {
+		writeError(w, http.StatusNotImplemented, errors.New("redelivery is not enabled on this control plane"))
+		return
+	}
+	rec, err := s.inspectDelivery(r.Context(), r.PathValue("id"))
+	if err != nil {
+		s.storeError(w, err)
+		return
+	}
+
+	retry, err := s.redeliver.Redeliver(r.Context(), rec)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	p, _ := auth.FromContext(r.Context())
+	s.logger.Info("manual redelivery", "principal", p.ID, "consumer", rec.Consumer, "delivery", rec.ID, "retry", retry.ID, "status", retry.Status)
+	s.audit(r.Context(), "delivery.redeliver", p.Tenant, rec.ID, rec, retry)
+	writeJSON(w, http.StatusOK, retry)
+}
+
+// inspectDelivery returns a delivery record if the caller may see it.
+func (s *Server) inspectDelivery(ctx context.Context, id string) (consumer.DeliveryRecord, error) {
+	if tenant := tenantFrom(ctx).ID; tenant != "" {
+		rec, _, err := s.tenantDelivery(ctx, tenant, id)
+		return rec, err
+	}
+	if err := s.canInspect(ctx, ""); err != nil {
+		return consumer.DeliveryRecord{}, err
+	}
+	return s.store.GetDelivery(ctx, id)
+}
+
+// canInspect checks the caller may see the deliveries of a consumer: admins
+// any of them, tenants those of their subscriptions. Other consumers are
+// reported as not found to tenants.
+func (s *Server) canInspect(ctx context.Context, consumerName string) error {
+	p, _ := auth.FromContext(ctx)
+	if p.Tenant == "" {
+		if !p.Has(auth.ScopeAdmin) {
+			return errForbidden
+		}
+		return nil
+	}
+	subID, ok := strings.CutPrefix(consumerName, "sub-")
+	if !ok {
+		return ErrNotFound
+	}
+	_, err := s.store.GetSubscription(ctx, p.Tenant, subID)
+	return err
+}
+
+var errForbidden = errors.New("admin or tenant credentials required")
+
+func (s *Server) storeError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		writeError(w, http.StatusNotFound, err)
+	case errors.Is(err, ErrConflict), errors.Is(err, errReplayActive), errors.Is(err, errReplayFinished):
+		writeError(w, http.StatusConflict, err)
+	case errors.Is(err, errForbidden):
+		writeError(w, http.StatusForbidden, err)
+	case errors.As(err, new(badRequest)):
+		writeError(w, http.StatusBadRequest, err)
+	default:
+		s.internalError(w, err)
+	}
+}
+
+func (s *Server) internalError(w http.ResponseWriter, err error) {
+	s.logger.Error("request failed", "error", err)
+	writeError(w, http.StatusInternalServerError, errors.New("internal error"))
+}
+
+func decode(w http.ResponseWriter, r *http.Request, v any) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err := dec.Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,475 @@
+package controlplane
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/internal/pkg/auth"
+	_ "modernc.org/sqlite"
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS tenants (
+	id TEXT PRIMARY KEY,
+	name TEXT NOT NULL UNIQUE,
+	created_at TEXT NOT NULL,
+	redaction TEXT NOT NULL DEFAULT '[]',
+	email_domains TEXT NOT NULL DEFAULT '[]'
+);
+CREATE TABLE IF NOT EXISTS api_keys (
+	id TEXT PRIMARY KEY,
+	tenant_id TEXT NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+	hash TEXT NOT NULL UNIQUE,
+	prefix TEXT NOT NULL,
+	scopes TEXT NOT NULL DEFAULT 'subscriptions',
+	created_at TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS subscriptions (
+	id TEXT PRIMARY KEY,
+	tenant_id TEXT NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+	name TEXT NOT NULL,
+	enabled INTEGER NOT NULL,
+	version INTEGER NOT NULL,
+	spec TEXT NOT NULL,
+	created_at TEXT NOT NULL,
+	updated_at TEXT NOT NULL,
+	verified_url TEXT NOT NULL DEFAULT '',
+	verification_error TEXT NOT NULL DEFAULT '',
+	UNIQUE (tenant_id, name)
+);
+`
+
+// Store persists the control plane state in SQLite.
+type Store struct {
+	db *sql.DB
+}
+
+// OpenStore opens (creating if needed) the SQLite database at path.
+func OpenStore(path string) (*Store, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	// SQLite serializes writers anyway; one connection avoids busy errors
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(schema + deliveriesSchema + auditSchema + replaysSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
+	}
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
+	}
+	return &Store{db: db}, nil
+}
+
+// migrate upgrades databases created by older versions.
+func migrate(db *sql.DB) error {
+	if _, err := addColumn(db, "api_keys", "scopes", `TEXT NOT NULL DEFAULT 'subscriptions'`); err != nil {
+		return err
+	}
+	added, err := addColumn(db, "subscriptions", "verified_url", `TEXT NOT NULL DEFAULT ''`)
+	if err != nil {
+		return err
+	}
+	if added {
+		// Subscriptions from before the verification handshake keep running
+		if _, err := db.Exec(`UPDATE subscriptions SET verified_url = json_extract(spec, '$.url')`); err != nil {
+			return err
+		}
+	}
+	if _, err = addColumn(db, "subscriptions", "verification_error", `TEXT NOT NULL DEFAULT ''`); err != nil {
+		return err
+	}
+	if _, err = addColumn(db, "tenants", "redaction", `TEXT NOT NULL DEFAULT '[]'`); err != nil {
+		return err
+	}
+	_, err = addColumn(db, "tenants", "email_domains", `TEXT NOT NULL DEFAULT '[]'`)
+	return err
+}
+
+// addColumn adds a column to tables created by an older version, as SQLite
+// has no ADD COLUMN IF NOT EXISTS. It reports whether the column was added.
+func addColumn(db *sql.DB, table, column, decl string) (bool, error) {
+	rows, err := db.Query(`SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return false, err
+		}
+		if name == column {
+			return false, nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+	rows.Close()
+
+	_, err = db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, decl))
+	return err == nil, err
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Ping checks that the database is reachable.
+func (s *Store) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *Store) CreateTenant(ctx context.Context, name string) (Tenant, error) {
+	t := Tenant{ID: newID("ten_"), Name: name, CreatedAt: time.Now().UTC(), Redaction: []string{}, EmailDomains: []string{}}
+	_, err := s.db.ExecContext(ctx, `INSERT INTO tenants (id, name, created_at) VALUES (?, ?, ?)`,
+		t.ID, t.Name, formatTime(t.CreatedAt))
+	if err != nil {
+		return Tenant{}, storeError("create tenant", err)
+	}
+	return t, nil
+}
+
+const tenantColumns = `id, name, created_at, redaction, email_domains`
+
+// scanTenant scans a row of tenantColumns for op.
+func scanTenant(op string, row interface{ Scan(...any) error }) (Tenant, error) {
+	var t Tenant
+	var created, redaction, domains string
+	if err := row.Scan(&t.ID, &t.Name, &created, &redaction, &domains); err != nil {
+		return Tenant{}, storeError(op, err)
+	}
+	t.CreatedAt = parseTime(created)
+	if err := json.Unmarshal([]byte(redaction), &t.Redaction); err != nil {
+		return Tenant{}, fmt.Errorf("tenant %s has corrupt redaction rules: %w", t.ID, err)
+	}
+	if err := json.Unmarshal([]byte(domains), &t.EmailDomains); err != nil {
+		return Tenant{}, fmt.Errorf("tenant %s has corrupt email domains: %w", t.ID, err)
+	}
+	return t, nil
+}
+
+func (s *Store) GetTenant(ctx context.Context, id string) (Tenant, error) {
+	return scanTenant("get tenant", s.db.QueryRowContext(ctx, `SELECT `+tenantColumns+` FROM tenants WHERE id = ?`, id))
+}
+
+func (s *Store) ListTenants(ctx context.Context) ([]Tenant, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+tenantColumns+` FROM tenants ORDER BY created_at`)
+	if err != nil {
+		return nil, storeError("list tenants", err)
+	}
+	defer rows.Close()
+
+	tenants := []Tenant{}
+	for rows.Next() {
+		t, err := scanTenant("list tenants", rows)
+		if err != nil {
+			return nil, err
+		}
+		tenants = append(tenants, t)
+	}
+	return tenants, rows.Err()
+}
+
+// SetRedaction replaces the tenant's redaction rules and bumps the version
+// of its subscriptions, so the fleet restarts their consumers with them.
+func (s *Store) SetRedaction(ctx context.Context, tenantID string, rules []string) (Tenant, error) {
+	raw, err := json.Marshal(rules)
+	if err != nil {
+		return Tenant{}, err
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Tenant{}, storeError("set redaction", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `UPDATE tenants SET redaction = ? WHERE id = ?`, string(raw), tenantID)
+	if err != nil {
+		return Tenant{}, storeError("set redaction", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return Tenant{}, ErrNotFound
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE subscriptions SET version = version + 1, updated_at = ? WHERE tenant_id = ?`,
+		formatTime(time.Now().UTC()), tenantID)
+	if err != nil {
+		return Tenant{}, storeError("set redaction", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return Tenant{}, storeError("set redaction", err)
+	}
+	return s.GetTenant(ctx, tenantID)
+}
+
+// SetEmailDomains replaces the domains the tenant's email subscriptions may
+// send to. Subscriptions already created keep their recipients.
+func (s *Store) SetEmailDomains(ctx context.Context, tenantID string, domains []string) (Tenant, error) {
+	raw, err := json.Marshal(domains)
+	if err != nil {
+		return Tenant{}, err
+	}
+	if err := s.exec(ctx, "set email domains", `UPDATE tenants SET email_domains = ? WHERE id = ?`, string(raw), tenantID); err != nil {
+		return Tenant{}, err
+	}
+	return s.GetTenant(ctx, tenantID)
+}
+
+func (s *Store) DeleteTenant(ctx context.Context, id string) error {
+	return s.exec(ctx, "delete tenant", `DELETE FROM tenants WHERE id = ?`, id)
+}
+
+// CreateAPIKey issues a new key for the tenant. The returned APIKey is the
+// only place the plain key is ever available.
+func (s *Store) CreateAPIKey(ctx context.Context, tenantID string, scopes []auth.Scope) (APIKey, error) {
+	if _, err := s.GetTenant(ctx, tenantID); err != nil {
+		return APIKey{}, err
+	}
+
+	plain := "fpk_" + randomHex(24)
+	k := APIKey{
+		ID:        newID("key_"),
+		TenantID:  tenantID,
+		Prefix:    plain[:12],
+		Key:       plain,
+		Scopes:    scopes,
+		CreatedAt: time.Now().UTC(),
+	}
+	_, err := s.db.ExecContext(ctx, `INSERT INTO api_keys (id, tenant_id, hash, prefix, scopes, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		k.ID, k.TenantID, hashKey(plain), k.Prefix, formatScopes(scopes), formatTime(k.CreatedAt))
+	if err != nil {
+		return APIKey{}, storeError("create api key", err)
+	}
+	return k, nil
+}
+
+func (s *Store) ListAPIKeys(ctx context.Context, tenantID string) ([]APIKey, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, tenant_id, prefix, scopes, created_at FROM api_keys WHERE tenant_id = ? ORDER BY created_at`, tenantID)
+	if err != nil {
+		return nil, storeError("list api keys", err)
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		var k APIKey
+		var scopes, created string
+		if err := rows.Scan(&k.ID, &k.TenantID, &k.Prefix, &scopes, &created); err != nil {
+			return nil, storeError("list api keys", err)
+		}
+		k.Scopes, _ = auth.ParseScopes(scopes)
+		k.CreatedAt = parseTime(created)
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+func (s *Store) DeleteAPIKey(ctx context.Context, tenantID, id string) error {
+	return s.exec(ctx, "delete api key", `DELETE FROM api_keys WHERE id = ? AND tenant_id = ?`, id, tenantID)
+}
+
+// ResolveKey implements auth.KeyResolver for tenant API keys. Keys are looked
+// up by hash, so the plain key is never compared byte by byte.
+func (s *Store) ResolveKey(ctx context.Context, key string) (auth.Principal, error) {
+	var id, tenant, scopes string
+	err := s.db.QueryRowContext(ctx, `SELECT id, tenant_id, scopes FROM api_keys WHERE hash = ?`, hashKey(key)).
+		Scan(&id, &tenant, &scopes)
+	if errors.Is(err, sql.ErrNoRows) {
+		return auth.Principal{}, auth.ErrUnknownKey
+	}
+	if err != nil {
+		return auth.Principal{}, storeError("look up api key", err)
+	}
+	parsed, err := auth.ParseScopes(scopes)
+	if err != nil {
+		return auth.Principal{}, fmt.Errorf("api key %s has invalid scopes: %w", id, err)
+	}
+	return auth.Principal{ID: id, Tenant: tenant, Scopes: parsed}, nil
+}
+
+func (s *Store) CreateSubscription(ctx context.Context, tenantID, name string, enabled bool, spec SubscriptionSpec) (Subscription, error) {
+	now := time.Now().UTC()
+	sub := Subscription{
+		ID:               newID("sub_"),
+		TenantID:         tenantID,
+		Name:             name,
+		Enabled:          enabled,
+		Version:          1,
+		CreatedAt:        now,
+		UpdatedAt:        now,
+		SubscriptionSpec: spec,
+	}
+
+	raw, err := json.Marshal(spec)
+	if err != nil {
+		return Subscription{}, err
+	}
+	_, err = s.db.ExecContext(ctx, `INSERT INTO subscriptions (id, tenant_id, name, enabled, version, spec, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		sub.ID, sub.TenantID, sub.Name, sub.Enabled, sub.Version, string(raw), formatTime(now), formatTime(now))
+	if err != nil {
+		return Subscription{}, storeError("create subscription", err)
+	}
+	sub.Verified = sub.verified()
+	return sub, nil
+}
+
+// UpdateSubscription replaces the subscription's name, enabled flag and spec
+// and bumps its version. A new webhook URL needs verifying again.
+func (s *Store) UpdateSubscription(ctx context.Context, sub Subscription) (Subscription, error) {
+	raw, err := json.Marshal(sub.SubscriptionSpec)
+	if err != nil {
+		return Subscription{}, err
+	}
+	sub.UpdatedAt = time.Now().UTC()
+
+	err = s.db.QueryRowContext(ctx, `UPDATE subscriptions
+		SET name = ?, enabled = ?, spec = ?, version = version + 1, updated_at = ?
+		WHERE id = ? AND tenant_id = ?
+		RETURNING version`,
+		sub.Name, sub.Enabled, string(raw), formatTime(sub.UpdatedAt), sub.ID, sub.TenantID).Scan(&sub.Version)
+	if err != nil {
+		return Subscription{}, storeError("update subscription", err)
+	}
+	sub.Verified = sub.verified()
+	return sub, nil
+}
+
+// SetVerification records the outcome of a verification handshake against
+// url: verified when verr is empty.
+func (s *Store) SetVerification(ctx context.Context, sub Subscription, url, verr string) (Subscription, error) {
+	query := `UPDATE subscriptions SET verification_error = ? WHERE id = ?`
+	args := []any{verr, sub.ID}
+	if verr == "" {
+		query = `UPDATE subscriptions SET verified_url = ?, verification_error = '' WHERE id = ?`
+		args = []any{url, sub.ID}
+		sub.verifiedURL = url
+	}
+	if err := s.exec(ctx, "update subscription verification", query, args...); err != nil {
+		return Subscription{}, err
+	}
+	sub.VerificationError = verr
+	sub.Verified = sub.verified()
+	return sub, nil
+}
+
+// GetSubscription returns the tenant's subscription. An empty tenantID
+// matches any tenant.
+func (s *Store) GetSubscription(ctx context.Context, tenantID, id string) (Subscription, error) {
+	subs, err := s.querySubscriptions(ctx, `WHERE id = ? AND (? = '' OR tenant_id = ?)`, id, tenantID, tenantID)
+	if err != nil {
+		return Subscription{}, err
+	}
+	if len(subs) == 0 {
+		return Subscription{}, ErrNotFound
+	}
+	return subs[0], nil
+}
+
+// ListSubscriptions lists the tenant's subscriptions. An empty tenantID lists
+// all of them.
+func (s *Store) ListSubscriptions(ctx context.Context, tenantID string) ([]Subscription, error) {
+	return s.querySubscriptions(ctx, `WHERE ? = '' OR tenant_id = ?`, tenantID, tenantID)
+}
+
+// EnabledSubscriptions lists the subscriptions the fleet should be running:
+// enabled and verified.
+func (s *Store) EnabledSubscriptions(ctx context.Context) ([]Subscription, error) {
+	subs, err := s.querySubscriptions(ctx, `WHERE enabled = 1`)
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(subs, func(sub Subscription) bool { return !sub.Verified }), nil
+}
+
+func (s *Store) DeleteSubscription(ctx context.Context, tenantID, id string) error {
+	return s.exec(ctx, "delete subscription", `DELETE FROM subscriptions WHERE id = ? AND tenant_id = ?`, id, tenantID)
+}
+
+func (s *Store) querySubscriptions(ctx context.Context, where string, args ...any) ([]Subscription, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, tenant_id, name, enabled, version, spec, created_at, updated_at, verified_url, verification_error,
+			(SELECT redaction FROM tenants WHERE tenants.id = subscriptions.tenant_id)
+		FROM subscriptions `+where+` ORDER BY created_at`, args...)
+	if err != nil {
+		return nil, storeError("list subscriptions", err)
+	}
+	defer rows.Close()
+
+	subs := []Subscription{}
+	for rows.Next() {
+		var sub Subscription
+		var spec, created, updated, redaction string
+		if err := rows.Scan(&sub.ID, &sub.TenantID, &sub.Name, &sub.Enabled, &sub.Version, &spec, &created, &updated,
+			&sub.verifiedURL, &sub.VerificationError, &redaction); err != nil {
+			return nil, storeError("list subscriptions", err)
+		}
+		if err := json.Unmarshal([]byte(spec), &sub.SubscriptionSpec); err != nil {
+			return nil, fmt.Errorf("subscription %s has a corrupt spec: %w", sub.ID, err)
+		}
+		if err := json.Unmarshal([]byte(redaction), &sub.Redaction); err != nil {
+			return nil, fmt.Errorf("tenant %s has corrupt redaction rules: %w", sub.TenantID, err)
+		}
+		sub.CreatedAt = parseTime(created)
+		sub.UpdatedAt = parseTime(updated)
+		sub.Verified = sub.verified()
+		subs = append(subs, sub)
+	}
+	return subs, rows.Err()
+}
+
+func (s *Store) exec(ctx context.Context, op, query string, args ...any) error {
+	res, err := s.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return storeError(op, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func storeError(op string, err error) error {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return ErrNotFound
+	case strings.Contains(err.Error(), "UNIQUE constraint failed"):
+		return ErrConflict
+	case strings.Contains(err.Error(), "FOREIGN KEY constraint failed"):
+		return ErrNotFound
+	}
+	return fmt.Errorf("failed to %s: %w", op, err)
+}
+
+func formatScopes(scopes []auth.Scope) string {
+	parts := make([]string, len(scopes))
+	for i, sc := range scopes {
+		parts[i] = string(sc)
+	}
+	return strings.Join(parts, ",")
+}
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func parseTime(s string) time.Time {
+	t, _ := time.Parse(time.RFC3339Nano, s)
+	return t
+}
@@ -0,0 +1,210 @@
+package controlplane
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/internal/pkg/auth"
+	"github.com/eurosky/firehose-processor-aas/internal/pkg/registry"
+	"github.com/eurosky/firehose-processor-aas/pkg/events"
+	"github.com/nats-io/nats.go"
+)
+
+var errNoTopology = errors.New("the topology needs the control plane to run with --nats-url")
+
+// Topology is the state of the pipeline: the ingest instances and the relays
+// they read, the stream, and the consumers with their durables.
+type Topology struct {
+	Time      time.Time             `json:"time"`
+	Ingest    []events.IngestStatus `json:"ingest"`
+	Stream    StreamState           `json:"stream"`
+	Consumers []ConsumerTopology    `json:"consumers"`
+}
+
+type StreamState struct {
+	Name      string    `json:"name"`
+	Messages  uint64    `json:"messages"`
+	Bytes     uint64    `json:"bytes"`
+	FirstSeq  uint64    `json:"first_seq"`
+	LastSeq   uint64    `json:"last_seq"`
+	FirstTime time.Time `json:"first_time"`
+	LastTime  time.Time `json:"last_time"`
+	Consumers int       `json:"consumers"`
+}
+
+// ConsumerTopology is a consumer as the registry and JetStream show it.
+type ConsumerTopology struct {
+	Name string `json:"name"`
+	// TenantID and SubscriptionID are set for the consumers of
+	// subscriptions
+	TenantID       string `json:"tenant_id,omitempty"`
+	SubscriptionID string `json:"subscription_id,omitempty"`
+	// Status is nil when no replica runs the consumer
+	Status *events.ConsumerStatus `json:"status,omitempty"`
+	// ErrorRate is the share of failed delivery attempts over the last 5
+	// minutes
+	ErrorRate float64 `json:"error_rate"`
+	// Durable is nil for a consumer whose durable is gone
+	Durable *DurableState `json:"durable,omitempty"`
+}
+
+// DurableState is the position of a consumer's durable in the stream.
+type DurableState struct {
+	// Pending is the events not delivered to the consumer yet, AckPending
+	// those delivered but not acked; their sum is the consumer's lag
+	Pending     uint64     `json:"pending"`
+	AckPending  int        `json:"ack_pending"`
+	Redelivered int        `json:"redelivered"`
+	AckFloor    uint64     `json:"ack_floor"`
+	LastActive  *time.Time `json:"last_active,omitempty"`
+}
+
+// Lag is the number of events the consumer has yet to deliver.
+func (d DurableState) Lag() uint64 {
+	return d.Pending + uint64(d.AckPending)
+}
+
+// loadTopology assembles the topology from the registry and the stream's
+// consumers.
+func (s *Server) loadTopology(ctx context.Context) (Topology, error) {
+	if s.js == nil {
+		return Topology{}, errNoTopology
+	}
+	t := Topology{Time: time.Now().UTC(), Ingest: []events.IngestStatus{}, Consumers: []ConsumerTopology{}}
+
+	ingest, running, err := registry.Load(s.js)
+	if err != nil {
+		return Topology{}, err
+	}
+	t.Ingest = append(t.Ingest, ingest...)
+
+	stream, err := s.js.StreamNameBySubject("atproto.firehose.>", nats.Context(ctx))
+	if err != nil && !errors.Is(err, nats.ErrStreamNotFound) {
+		return Topology{}, fmt.Errorf("failed to find stream: %w", err)
+	}
+	durables := map[string]*DurableState{}
+	if stream != "" {
+		si, err := s.js.StreamInfo(stream, nats.Context(ctx))
+		if err != nil {
+			return Topology{}, fmt.Errorf("failed to get stream info: %w", err)
+		}
+		t.Stream = StreamState{
+			Name:      stream,
+			Messages:  si.State.Msgs,
+			Bytes:     si.State.Bytes,
+			FirstSeq:  si.State.FirstSeq,
+			LastSeq:   si.State.LastSeq,
+			FirstTime: si.State.FirstTime,
+			LastTime:  si.State.LastTime,
+			Consumers: si.State.Consumers,
+		}
+		for ci := range s.js.ConsumersInfo(stream, nats.Context(ctx)) {
+			d := &DurableState{
+				Pending:     ci.NumPending,
+				AckPending:  ci.NumAckPending,
+				Redelivered: ci.NumRedelivered,
+				AckFloor:    ci.AckFloor.Stream,
+				LastActive:  ci.Delivered.Last,
+			}
+			durables[ci.Name] = d
+		}
+	}
+
+	subs, err := s.store.ListSubscriptions(ctx, "")
+	if err != nil {
+		return Topology{}, err
+	}
+	bySubscription := make(map[string]Subscription, len(subs))
+	for _, sub := range subs {
+		bySubscription[sub.ConsumerName()] = sub
+	}
+
+	consumers := map[string]*ConsumerTopology{}
+	entry := func(name string) *ConsumerTopology {
+		c, ok := consumers[name]
+		if !ok {
+			c = &ConsumerTopology{Name: name}
+			if sub, ok := bySubscription[name]; ok {
+				c.TenantID, c.SubscriptionID = sub.TenantID, sub.ID
+			}
+			consumers[name] = c
+		}
+		return c
+	}
+	for _, st := range running {
+		c := entry(st.Name)
+		c.Status = &st
+		if st.Attempts > 0 {
+			c.ErrorRate = float64(st.Failures) / float64(st.Attempts)
+		}
+	}
+	for name, d := range durables {
+		entry(name).Durable = d
+	}
+	for _, c := range consumers {
+		t.Consumers = append(t.Consumers, *c)
+	}
+	sort.Slice(t.Consumers, func(i, j int) bool { return t.Consumers[i].Name < t.Consumers[j].Name })
+	return t, nil
+}
+
+// requireOperator rejects tenant credentials: the topology spans every
+// tenant.
+func requireOperator(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if tenantFrom(r.Context()).ID != "" {
+			writeError(w, http.StatusForbidden, errors.New("operator credentials required"))
+			return
+		}
+		h(w, r)
+	}
+}
+
+func (s *Server) topology(w http.ResponseWriter, r *http.Request) {
+	t, err := s.loadTopology(r.Context())
+	if errors.Is(err, errNoTopology) {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	if err != nil {
+		s.storeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, t)
+}
+
+func (s *Server) uiTopology(w http.ResponseWriter, r *http.Request) {
+	p, _ := auth.FromContext(r.Context())
+	data := pageData{Title: "Pipeline", Tenant: p.ID, Refresh: topologyRefresh}
+
+	t, err := s.loadTopology(r.Context())
+	switch {
+	case errors.Is(err, errNoTopology):
+		data.Error = err.Error()
+	case err != nil:
+		s.uiError(w, err)
+		return
+	default:
+		data.Topology = &t
+	}
+	s.render(w, http.StatusOK, "topology.html", data)
+}
+
+// operatorSession returns whether a dashboard key belongs to an operator
+// allowed to see the topology rather than to a tenant.
+func operatorSession(p auth.Principal) bool {
+	return p.Tenant == "" && p.Has(auth.ScopeRead)
+}
+
+// shortError keeps table cells readable.
+func shortError(s string) string {
+	if len(s) <= 120 {
+		return s
+	}
+	return strings.TrimSpace(s[:120]) + "…"
+}
@@ -0,0 +1,93 @@
+package controlplane
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/internal/pkg/signature"
+)
+
+const (
+	// VerificationEventHeader is set to VerificationEvent on challenge
+	// requests, so receivers can tell them from deliveries without parsing
+	// the body.
+	VerificationEventHeader = "X-Webhook-Event"
+	VerificationEvent       = "url_verification"
+
+	verificationTimeout = 10 * time.Second
+	maxChallengeReply   = 4 << 10
+)
+
+// VerificationChallenge is the body of a challenge request. The endpoint
+// proves it wants the subscription's traffic by answering 2xx with the
+// challenge, either as the plain body or as {"challenge": "..."}.
+type VerificationChallenge struct {
+	Type           string `json:"type"`
+	Challenge      string `json:"challenge"`
+	SubscriptionID string `json:"subscription_id"`
+}
+
+// Verifier runs the webhook verification handshake, which keeps tenants from
+// pointing the firehose at URLs that never asked for it.
+type Verifier struct {
+	client *http.Client
+}
+
+func NewVerifier() *Verifier {
+	return &Verifier{client: &http.Client{
+		Timeout: verificationTimeout,
+		// A redirect would verify a different URL than the one delivered to
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}}
+}
+
+// Verify sends a challenge to the subscription's URL, signed with its secret
+// like a delivery, and checks the answer.
+func (v *Verifier) Verify(ctx context.Context, sub Subscription) error {
+	challenge := randomHex(16)
+	body, _ := json.Marshal(VerificationChallenge{
+		Type:           VerificationEvent,
+		Challenge:      challenge,
+		SubscriptionID: sub.ID,
+	})
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("invalid webhook url: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(VerificationEventHeader, VerificationEvent)
+	if sub.Secret != "" {
+		req.Header.Set(signature.Header, signature.Sign([]byte(sub.Secret), body))
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("challenge request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	reply, _ := io.ReadAll(io.LimitReader(resp.Body, maxChallengeReply))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("endpoint answered the challenge with status %d", resp.StatusCode)
+	}
+	if strings.TrimSpace(string(reply)) == challenge {
+		return nil
+	}
+	var echoed struct {
+		Challenge string `json:"challenge"`
+	}
+	if json.Unmarshal(reply, &echoed) == nil && echoed.Challenge == challenge {
+		return nil
+	}
+	return errors.New("endpoint did not echo the challenge")
+}
@@ -0,0 +1,201 @@
+package controlplane
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/eurosky/firehose-processor-aas/pkg/firehose"
+	"github.com/nats-io/nats.go"
+)
+
+// MaxWatchlistDIDs is how many DIDs a subscription's watchlist may hold.
+const MaxWatchlistDIDs = 10000
+
+var (
+	errNoWatchlists = errors.New("watchlists need the control plane to run with --nats-url")
+	errNotWatchlist = errors.New("the subscription doesn't read a watchlist; set filter.watchlist")
+)
+
+// watchlist returns the DIDs of the subscription's consumer, oldest first.
+func watchlist(kv nats.KeyValue, sub Subscription) ([]firehose.WatchedDID, error) {
+	w, err := kv.Watch(sub.ConsumerName()+".*", nats.IgnoreDeletes())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list watchlist: %w", err)
+	}
+	defer w.Stop()
+	dids := []firehose.WatchedDID{}
+	for entry := range w.Updates() {
+		if entry == nil {
+			break
+		}
+		var d firehose.WatchedDID
+		if json.Unmarshal(entry.Value(), &d) == nil {
+			dids = append(dids, d)
+		}
+	}
+	slices.SortFunc(dids, func(a, b firehose.WatchedDID) int {
+		if c := a.AddedAt.Compare(b.AddedAt); c != 0 {
+			return c
+		}
+		return strings.Compare(a.DID, b.DID)
+	})
+	return dids, nil
+}
+
+// dropWatchlists removes the watchlists of deleted subscriptions, which the
+// indexer would otherwise go on copying events for. Failures are only
+// logged.
+func (s *Server) dropWatchlists(subs ...Subscription) {
+	if s.js == nil {
+		return
+	}
+	kv, err := firehose.EnsureWatchBucket(s.js)
+	if err != nil {
+		s.logger.Warn("failed to open watchlist bucket", "error", err)
+		return
+	}
+	for _, sub := range subs {
+		if !sub.Filter.Watchlist {
+			continue
+		}
+		dids, err := watchlist(kv, sub)
+		if err != nil {
+			s.logger.Warn("failed to delete watchlist", "subscription", sub.ID, "error", err)
+			continue
+		}
+		for _, d := range dids {
+			if err := kv.Delete(firehose.WatchKey(sub.ConsumerName(), d.DID)); err != nil {
+				s.logger.Warn("failed to delete watched DID", "subscription", sub.ID, "did", d.DID, "error", err)
+			}
+		}
+	}
+}
+
+// watchlistSubscription returns the tenant's subscription of the request and
+// the watchlist bucket, or writes the error.
+func (s *Server) watchlistSubscription(w http.ResponseWriter, r *http.Request) (Subscription, nats.KeyValue, bool) {
+	if s.js == nil {
+		writeError(w, http.StatusServiceUnavailable, errNoWatchlists)
+		return Subscription{}, nil, false
+	}
+	sub, err := s.store.GetSubscription(r.Context(), tenantFrom(r.Context()).ID, r.PathValue("id"))
+	if err != nil {
+		s.storeError(w, err)
+		return Subscription{}, nil, false
+	}
+	kv, err := firehose.EnsureWatchBucket(s.js)
+	if err != nil {
+		s.internalError(w, err)
+		return Subscription{}, nil, false
+	}
+	return sub, kv, true
+}
+
+// addWatchedDIDs adds DIDs to the watchlist and answers those it didn't have.
+func (s *Server) addWatchedDIDs(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		DIDs []string `json:"dids"`
+	}
+	if !decode(w, r, &req) {
+		return
+	}
+	if len(req.DIDs) == 0 {
+		writeError(w, http.StatusBadRequest, errors.New("dids must list at least one DID"))
+		return
+	}
+	var dids []string
+	for _, raw := range req.DIDs {
+		did, err := syntax.ParseDID(strings.TrimSpace(raw))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if !slices.Contains(dids, did.String()) {
+			dids = append(dids, did.String())
+		}
+	}
+	sub, kv, ok := s.watchlistSubscription(w, r)
+	if !ok {
+		return
+	}
+	if !sub.Filter.Watchlist {
+		writeError(w, http.StatusConflict, errNotWatchlist)
+		return
+	}
+	current, err := watchlist(kv, sub)
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+	dids = slices.DeleteFunc(dids, func(did string) bool {
+		return slices.ContainsFunc(current, func(d firehose.WatchedDID) bool { return d.DID == did })
+	})
+	if len(current)+len(dids) > MaxWatchlistDIDs {
+		writeError(w, http.StatusConflict, fmt.Errorf("a watchlist holds at most %d DIDs, the subscription has %d", MaxWatchlistDIDs, len(current)))
+		return
+	}
+
+	now := time.Now().UTC()
+	added := []firehose.WatchedDID{}
+	for _, did := range dids {
+		d := firehose.WatchedDID{DID: did, AddedAt: now}
+		value, _ := json.Marshal(d)
+		if _, err := kv.Create(firehose.WatchKey(sub.ConsumerName(), did), value); err != nil && !errors.Is(err, nats.ErrKeyExists) {
+			s.internalError(w, err)
+			return
+		}
+		added = append(added, d)
+	}
+	tenant := tenantFrom(r.Context())
+	s.logger.Info("watched DIDs added", "tenant", tenant.ID, "subscription", sub.ID, "added", len(added))
+	if len(added) > 0 {
+		s.audit(r.Context(), "watchlist.add", tenant.ID, sub.ID, nil, added)
+	}
+	writeJSON(w, http.StatusCreated, added)
+}
+
+func (s *Server) listWatchedDIDs(w http.ResponseWriter, r *http.Request) {
+	sub, kv, ok := s.watchlistSubscription(w, r)
+	if !ok {
+		return
+	}
+	dids, err := watchlist(kv, sub)
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, dids)
+}
+
+func (s *Server) deleteWatchedDID(w http.ResponseWriter, r *http.Request) {
+	sub, kv, ok := s.watchlistSubscription(w, r)
+	if !ok {
+		return
+	}
+	key := firehose.WatchKey(sub.ConsumerName(), r.PathValue("did"))
+	entry, err := kv.Get(key)
+	if errors.Is(err, nats.ErrKeyNotFound) || errors.Is(err, nats.ErrInvalidKey) {
+		writeError(w, http.StatusNotFound, ErrNotFound)
+		return
+	}
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+	if err := kv.Delete(key); err != nil {
+		s.internalError(w, err)
+		return
+	}
+	var before firehose.WatchedDID
+	json.Unmarshal(entry.Value(), &before)
+	tenant := tenantFrom(r.Context())
+	s.logger.Info("watched DID removed", "tenant", tenant.ID, "subscription", sub.ID, "did", before.DID)
+	s.audit(r.Context(), "watchlist.remove", tenant.ID, sub.ID, before, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
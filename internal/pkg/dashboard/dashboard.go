@@ -0,0 +1,231 @@
+// Package dashboard builds the Grafana dashboard for the fpaas metrics:
+// ingest rate and lag, consumer backlog, delivery success rate and latency.
+// The JSON is generated rather than hand-edited so panels stay in step with
+// the metric names; fpaas dashboard export writes it out for provisioning or
+// for import into Grafana.
+package dashboard
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// UID is the dashboard's stable uid, so re-imports replace it.
+const UID = "fpaas"
+
+// Dashboard is the subset of the Grafana dashboard model fpaas uses.
+type Dashboard struct {
+	UID           string    `json:"uid"`
+	Title         string    `json:"title"`
+	Tags          []string  `json:"tags"`
+	Timezone      string    `json:"timezone"`
+	SchemaVersion int       `json:"schemaVersion"`
+	Refresh       string    `json:"refresh"`
+	Time          TimeRange `json:"time"`
+	Editable      bool      `json:"editable"`
+	Templating    struct {
+		List []Variable `json:"list"`
+	} `json:"templating"`
+	Panels []Panel `json:"panels"`
+}
+
+// TimeRange is the default time range.
+type TimeRange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// Variable is a dashboard template variable.
+type Variable struct {
+	Name       string      `json:"name"`
+	Label      string      `json:"label"`
+	Type       string      `json:"type"`
+	Query      any         `json:"query"`
+	Datasource *Datasource `json:"datasource,omitempty"`
+	Refresh    int         `json:"refresh,omitempty"`
+	IncludeAll bool        `json:"includeAll,omitempty"`
+	Multi      bool        `json:"multi,omitempty"`
+	AllValue   string      `json:"allValue,omitempty"`
+	Current    any         `json:"current"`
+}
+
+// Datasource references a data source, here always the $datasource variable.
+type Datasource struct {
+	Type string `json:"type"`
+	UID  string `json:"uid"`
+}
+
+// Panel is a time series, stat or row panel.
+type Panel struct {
+	ID          int          `json:"id"`
+	Type        string       `json:"type"`
+	Title       string       `json:"title"`
+	Description string       `json:"description,omitempty"`
+	GridPos     GridPos      `json:"gridPos"`
+	Datasource  *Datasource  `json:"datasource,omitempty"`
+	Targets     []Target     `json:"targets,omitempty"`
+	FieldConfig *FieldConfig `json:"fieldConfig,omitempty"`
+	Collapsed   *bool        `json:"collapsed,omitempty"`
+	Panels      []any        `json:"panels,omitempty"`
+}
+
+// FieldConfig holds a panel's display defaults.
+type FieldConfig struct {
+	Defaults struct {
+		Unit string `json:"unit,omitempty"`
+	} `json:"defaults"`
+	Overrides []any `json:"overrides"`
+}
+
+// GridPos places a panel on the 24 column grid.
+type GridPos struct {
+	H int `json:"h"`
+	W int `json:"w"`
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+// Target is a Prometheus query.
+type Target struct {
+	RefID        string      `json:"refId"`
+	Expr         string      `json:"expr"`
+	LegendFormat string      `json:"legendFormat"`
+	Datasource   *Datasource `json:"datasource"`
+}
+
+var prometheus = &Datasource{Type: "prometheus", UID: "${datasource}"}
+
+// Build returns the fpaas dashboard.
+func Build() Dashboard {
+	d := Dashboard{
+		UID:           UID,
+		Title:         "Firehose Processor",
+		Tags:          []string{"fpaas", "firehose"},
+		Timezone:      "browser",
+		SchemaVersion: 39,
+		Refresh:       "30s",
+		Time:          TimeRange{From: "now-1h", To: "now"},
+		Editable:      true,
+	}
+	d.Templating.List = []Variable{
+		{
+			Name:    "datasource",
+			Label:   "Data source",
+			Type:    "datasource",
+			Query:   "prometheus",
+			Current: map[string]any{},
+		},
+		{
+			Name:       "consumer",
+			Label:      "Consumer",
+			Type:       "query",
+			Query:      map[string]string{"query": "label_values(consumer_deliveries_total, consumer)", "refId": "consumer"},
+			Datasource: prometheus,
+			Refresh:    2,
+			IncludeAll: true,
+			Multi:      true,
+			AllValue:   ".*",
+			Current:    map[string]any{"text": "All", "value": "$__all"},
+		},
+	}
+
+	l := layout{}
+	l.row("Ingest")
+	l.timeseries("Ingest rate", "Frames read from the relay per second.", "ops",
+		query("rate(firehose_messages_read_total[$__rate_interval])", "{{instance}}"))
+	l.timeseries("Ingest lag", "Time between the last published event and now; grows when ingest falls behind or the relay stalls.", "s",
+		query("firehose_event_lag_seconds", "{{instance}}"))
+
+	l.row("Consumers")
+	l.timeseries("Consumer backlog", "Messages in the stream not yet fetched, as of each consumer's last fetch.", "short",
+		query(`consumer_pending_messages{consumer=~"$consumer"}`, "{{consumer}}"))
+	l.timeseries("Messages processed", "Messages acknowledged per second by each consume process.", "ops",
+		query("rate(consumer_messages_processed_total[$__rate_interval])", "{{instance}}"))
+	l.timeseries("Quota paused", "1 while a tenant's delivery is paused because a quota is exhausted.", "short",
+		query("consumer_quota_paused", "{{tenant}}"))
+
+	l.row("Delivery")
+	l.timeseries("Delivery success rate", "Share of delivery attempts that succeeded.", "percentunit",
+		query(`sum by (consumer) (rate(consumer_deliveries_total{consumer=~"$consumer",result="success"}[$__rate_interval])) / sum by (consumer) (rate(consumer_deliveries_total{consumer=~"$consumer"}[$__rate_interval]))`, "{{consumer}}"))
+	l.timeseries("Delivery attempts", "Delivery attempts per second by result.", "ops",
+		query(`sum by (consumer, result) (rate(consumer_deliveries_total{consumer=~"$consumer"}[$__rate_interval]))`, "{{consumer}} {{result}}"))
+	l.timeseries("Delivery duration", "Time the target took to answer a delivery attempt.", "s",
+		quantiles("consumer_delivery_duration_seconds", `consumer=~"$consumer"`, "consumer")...)
+	l.timeseries("End-to-end latency", "Time from ingest publishing an event to its delivery.", "s",
+		quantiles("e2e_delivery_latency_seconds", `consumer=~"$consumer"`, "consumer")...)
+
+	d.Panels = l.panels
+	return d
+}
+
+// JSON returns the dashboard as indented JSON.
+func JSON() ([]byte, error) {
+	b, err := json.MarshalIndent(Build(), "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode dashboard: %w", err)
+	}
+	return append(b, '\n'), nil
+}
+
+func query(expr, legend string) Target {
+	return Target{Expr: expr, LegendFormat: legend, Datasource: prometheus}
+}
+
+// quantiles queries p50, p95 and p99 of a histogram per label.
+func quantiles(histogram, selector, by string) []Target {
+	var targets []Target
+	for _, p := range []int{50, 95, 99} {
+		targets = append(targets, query(
+			fmt.Sprintf("histogram_quantile(%.2f, sum by (%s, le) (rate(%s_bucket{%s}[$__rate_interval])))", float64(p)/100, by, histogram, selector),
+			fmt.Sprintf("{{%s}} p%d", by, p)))
+	}
+	return targets
+}
+
+// layout places panels two per row under collapsible rows.
+type layout struct {
+	panels []Panel
+	y, x   int
+}
+
+func (l *layout) row(title string) {
+	if l.x != 0 {
+		l.y += 8
+		l.x = 0
+	}
+	collapsed := false
+	l.panels = append(l.panels, Panel{
+		ID:        len(l.panels) + 1,
+		Type:      "row",
+		Title:     title,
+		GridPos:   GridPos{H: 1, W: 24, Y: l.y},
+		Collapsed: &collapsed,
+		Panels:    []any{},
+	})
+	l.y++
+}
+
+func (l *layout) timeseries(title, description, unit string, targets ...Target) {
+	p := Panel{
+		ID:          len(l.panels) + 1,
+		Type:        "timeseries",
+		Title:       title,
+		Description: description,
+		GridPos:     GridPos{H: 8, W: 12, X: l.x, Y: l.y},
+		Datasource:  prometheus,
+	}
+	for i := range targets {
+		targets[i].RefID = string(rune('A' + i))
+	}
+	p.Targets = targets
+	p.FieldConfig = &FieldConfig{Overrides: []any{}}
+	p.FieldConfig.Defaults.Unit = unit
+	l.panels = append(l.panels, p)
+
+	if l.x == 0 {
+		l.x = 12
+	} else {
+		l.x = 0
+		l.y += 8
+	}
+}
@@ -0,0 +1,298 @@
+// Package doctor checks the environment the pipeline runs in: NATS and
+// JetStream, the streams and how their settings drifted from the expected
+// ones, the relay, the webhook and the clock. Most support requests are a
+// misconfiguration one of the checks names.
+package doctor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/pkg/consumer"
+	"github.com/eurosky/firehose-processor-aas/pkg/firehose"
+	"github.com/gorilla/websocket"
+	"github.com/nats-io/nats.go"
+)
+
+// Statuses of a Check.
+const (
+	StatusOK   = "ok"
+	StatusWarn = "warn"
+	StatusFail = "fail"
+)
+
+const (
+	// SkewWarn and SkewFail are the clock offsets from the relay that make
+	// the clock check warn and fail: event times, quota days and signed
+	// URL expiries go by the local clock.
+	SkewWarn = 2 * time.Second
+	SkewFail = 30 * time.Second
+
+	// subscribePath is where relays serve the firehose.
+	subscribePath = "/xrpc/com.atproto.sync.subscribeRepos"
+)
+
+// Options configures Run.
+type Options struct {
+	NATSURL string
+	// Stream is the expected configuration of ATPROTO_FIREHOSE and, when
+	// they exist, ATPROTO_EVENTS and FPAAS_WATCHED.
+	Stream firehose.StreamOptions
+	// RelayHost and WebhookURL, when set, are checked too.
+	RelayHost  string
+	WebhookURL string
+	// Timeout bounds each network check.
+	Timeout time.Duration
+}
+
+// Check is the outcome of one check.
+type Check struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail"`
+}
+
+// Report lists the checks in the order they ran.
+type Report struct {
+	Checks []Check `json:"checks"`
+}
+
+// Failed reports whether any check failed.
+func (r Report) Failed() bool {
+	for _, c := range r.Checks {
+		if c.Status == StatusFail {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Report) add(name, status, format string, args ...any) {
+	r.Checks = append(r.Checks, Check{Name: name, Status: status, Detail: fmt.Sprintf(format, args...)})
+}
+
+// Run runs the checks of opts. Checks needing NATS are left out when it
+// can't be reached; the others still run.
+func Run(ctx context.Context, opts Options) Report {
+	var r Report
+	checkNATS(&r, opts)
+	if opts.RelayHost != "" {
+		checkRelay(ctx, &r, opts)
+	}
+	if opts.WebhookURL != "" {
+		checkWebhook(ctx, &r, opts)
+	}
+	return r
+}
+
+func checkNATS(r *Report, opts Options) {
+	nc, err := nats.Connect(opts.NATSURL, nats.Timeout(opts.Timeout), nats.Name("fpaas-doctor"))
+	switch {
+	case errors.Is(err, nats.ErrAuthorization):
+		r.add("nats", StatusFail, "%s rejected the credentials: check the user and password or token in the URL", redactURL(opts.NATSURL))
+		return
+	case err != nil:
+		r.add("nats", StatusFail, "can't reach %s: %v", redactURL(opts.NATSURL), err)
+		return
+	}
+	defer nc.Close()
+	rtt, _ := nc.RTT()
+	r.add("nats", StatusOK, "connected to %s, server %s, rtt %s", nc.ConnectedUrlRedacted(), nc.ConnectedServerVersion(), rtt.Round(time.Microsecond))
+
+	js, err := nc.JetStream(nats.MaxWait(opts.Timeout))
+	if err != nil {
+		r.add("jetstream", StatusFail, "%v", err)
+		return
+	}
+	info, err := js.AccountInfo()
+	if err != nil {
+		r.add("jetstream", StatusFail, "not available: %v", err)
+		return
+	}
+	r.add("jetstream", StatusOK, "enabled, %d streams, %d consumers, %d memory and %d storage bytes used", info.Streams, info.Consumers, info.Memory, info.Store)
+
+	checkStream(r, js, "ATPROTO_FIREHOSE", "atproto.firehose.>", opts.Stream, "run fpaas bootstrap or ingest")
+	checkStream(r, js, firehose.EventsStream, firehose.EventsSubjects, opts.Stream, "")
+	checkStream(r, js, firehose.WatchStream, firehose.WatchSubjects, opts.Stream, "")
+	checkMaintenance(r, js)
+}
+
+// checkStream compares the stream to opts. Streams created without a hint
+// are optional and only checked when they exist.
+func checkStream(r *Report, js nats.JetStreamContext, name, subjects string, opts firehose.StreamOptions, hint string) {
+	check := "stream " + name
+	info, err := js.StreamInfo(name)
+	switch {
+	case errors.Is(err, nats.ErrStreamNotFound) && hint == "":
+		r.add(check, StatusOK, "not created, its component isn't used")
+		return
+	case errors.Is(err, nats.ErrStreamNotFound):
+		r.add(check, StatusFail, "missing: %s", hint)
+		return
+	case err != nil:
+		r.add(check, StatusFail, "%v", err)
+		return
+	}
+
+	cfg := info.Config
+	if len(cfg.Subjects) != 1 || cfg.Subjects[0] != subjects {
+		r.add(check, StatusFail, "holds %s rather than %s: components won't find their messages", strings.Join(cfg.Subjects, " "), subjects)
+		return
+	}
+	var drift []string
+	if cfg.MaxAge != opts.MaxAge {
+		drift = append(drift, fmt.Sprintf("max age %s, expected %s", cfg.MaxAge, opts.MaxAge))
+	}
+	if cfg.Storage != opts.Storage {
+		drift = append(drift, fmt.Sprintf("%s storage, expected %s", cfg.Storage, opts.Storage))
+	}
+	if cfg.Replicas != opts.Replicas {
+		drift = append(drift, fmt.Sprintf("%d replicas, expected %d", cfg.Replicas, opts.Replicas))
+	}
+	if cfg.Duplicates != opts.DuplicateWindow {
+		drift = append(drift, fmt.Sprintf("duplicate window %s, expected %s", cfg.Duplicates, opts.DuplicateWindow))
+	}
+	state := fmt.Sprintf("%d messages, %d bytes, seq %d..%d", info.State.Msgs, info.State.Bytes, info.State.FirstSeq, info.State.LastSeq)
+	if drift != nil {
+		r.add(check, StatusWarn, "%s; drifted: %s (fpaas bootstrap updates all but the storage)", state, strings.Join(drift, ", "))
+		return
+	}
+	r.add(check, StatusOK, "%s", state)
+}
+
+func checkMaintenance(r *Report, js nats.JetStreamContext) {
+	kv, err := js.KeyValue(consumer.MaintenanceBucket)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		r.add("maintenance", StatusOK, "off")
+		return
+	}
+	var m *consumer.Maintenance
+	if err == nil {
+		m, err = consumer.GetMaintenance(kv)
+	}
+	switch {
+	case err != nil:
+		r.add("maintenance", StatusWarn, "can't read the switch: %v", err)
+	case m != nil:
+		r.add("maintenance", StatusWarn, "on since %s, consumers are paused: %s (fpaas maintenance off resumes them)", m.Since.Format(time.RFC3339), m.Reason)
+	default:
+		r.add("maintenance", StatusOK, "off")
+	}
+}
+
+// checkRelay subscribes to the relay until its first frame, and estimates
+// the clock's offset from the Date of the handshake's response.
+func checkRelay(ctx context.Context, r *Report, opts Options) {
+	u, err := url.Parse(opts.RelayHost)
+	if err != nil || (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" {
+		r.add("relay", StatusFail, "relay host must be a ws:// or wss:// URL, got %q", opts.RelayHost)
+		return
+	}
+	u.Path = subscribePath
+	ctx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+
+	sent := time.Now()
+	con, resp, err := websocket.DefaultDialer.DialContext(ctx, u.String(), http.Header{"User-Agent": []string{"fpaas-doctor/1.0"}})
+	received := time.Now()
+	if err != nil {
+		if resp != nil {
+			err = fmt.Errorf("%w (status %d)", err, resp.StatusCode)
+		}
+		r.add("relay", StatusFail, "can't subscribe to %s: %v", u.Host, err)
+		return
+	}
+	defer con.Close()
+	stop := context.AfterFunc(ctx, func() { con.Close() })
+	defer stop()
+
+	if _, frame, err := con.ReadMessage(); err != nil {
+		r.add("relay", StatusFail, "subscribed to %s but got no frame within %s: %v", u.Host, opts.Timeout, err)
+	} else if info, err := firehose.InspectFrame(frame); err != nil {
+		r.add("relay", StatusWarn, "subscribed to %s, but its first frame is undecodable: %v", u.Host, err)
+	} else {
+		r.add("relay", StatusOK, "subscribed to %s, first frame %s seq %d", u.Host, info.Type, info.Seq)
+	}
+	checkClock(r, u.Host, resp.Header.Get("Date"), sent, received)
+}
+
+// checkClock compares date, the time of a response sent between sent and
+// received, to the local clock. Dates have a resolution of a second, so the
+// offset is only told within that and the round trip.
+func checkClock(r *Report, host, date string, sent, received time.Time) {
+	if date == "" {
+		r.add("clock", StatusWarn, "%s sent no Date to compare the clock with", host)
+		return
+	}
+	remote, err := http.ParseTime(date)
+	if err != nil {
+		r.add("clock", StatusWarn, "%s sent an invalid Date %q", host, date)
+		return
+	}
+	// Date truncates to the second, so the remote time is in the second
+	// after it
+	local := sent.Add(received.Sub(sent) / 2)
+	offset := local.Sub(remote.Add(500 * time.Millisecond)).Round(time.Millisecond)
+	margin := received.Sub(sent)/2 + 500*time.Millisecond
+	way, skew := "ahead of", offset
+	if offset < 0 {
+		way, skew = "behind", -offset
+	}
+	detail := fmt.Sprintf("%s %s %s's, ±%s", skew, way, host, margin.Round(time.Millisecond))
+	switch skew -= margin; {
+	case skew > SkewFail:
+		r.add("clock", StatusFail, "%s: sync it with NTP", detail)
+	case skew > SkewWarn:
+		r.add("clock", StatusWarn, "%s", detail)
+	default:
+		r.add("clock", StatusOK, "%s", detail)
+	}
+}
+
+// checkWebhook resolves the webhook's host and connects to its port, without
+// sending a request.
+func checkWebhook(ctx context.Context, r *Report, opts Options) {
+	u, err := url.Parse(opts.WebhookURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		r.add("webhook", StatusFail, "webhook url must be an http:// or https:// URL, got %q", opts.WebhookURL)
+		return
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+
+	addrs, err := net.DefaultResolver.LookupHost(ctx, u.Hostname())
+	if err != nil {
+		r.add("webhook", StatusFail, "can't resolve %s: %v", u.Hostname(), err)
+		return
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		r.add("webhook", StatusFail, "%s resolves to %s, but port %s is unreachable: %v", u.Hostname(), strings.Join(addrs, " "), port, err)
+		return
+	}
+	conn.Close()
+	r.add("webhook", StatusOK, "%s resolves to %s, port %s reachable", u.Hostname(), strings.Join(addrs, " "), port)
+}
+
+// redactURL hides the password of a NATS URL.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,403 @@
+// Package fakerelay is a relay serving com.atproto.sync.subscribeRepos with
+// synthetic or recorded frames, to run the pipeline without the real network.
+package fakerelay
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/atproto/data"
+	"github.com/bluesky-social/indigo/events"
+	"github.com/bluesky-social/indigo/lex/util"
+	"github.com/gorilla/websocket"
+	"github.com/ipfs/go-cid"
+	gocar "github.com/ipld/go-car"
+	carutil "github.com/ipld/go-car/util"
+)
+
+// Path is where relays serve the firehose.
+const Path = "/xrpc/com.atproto.sync.subscribeRepos"
+
+// Collections are the collections the synthetic commits write to, in turn.
+var Collections = []string{"app.bsky.feed.post", "app.bsky.feed.like", "app.bsky.graph.follow", "app.bsky.feed.repost"}
+
+// DeclarationCollection is the collection of the chat declaration records
+// commits also write with Options.Records.
+const DeclarationCollection = "chat.bsky.actor.declaration"
+
+// commitCID stands for the commit and record CIDs; frames carry no blocks
+// unless Options.Records is set.
+var commitCID = cid.MustParse("bafyreie5737gdxlw5i64vzichcalba3z2v5n6icifvx5xytvske7mr3hpm")
+
+// Options configure a relay of synthetic frames.
+type Options struct {
+	// Frames is how many frames to send; zero is no limit.
+	Frames int
+	// Rate is how many frames per second to send.
+	Rate float64
+	// DIDs is the number of distinct repos in the frames.
+	DIDs int
+	// Backlog is how many frames are kept for clients resuming from a
+	// cursor; zero keeps them all.
+	Backlog int
+	// Records makes commits carry their records, posts with an external
+	// embed, and also write the repo's chat declaration, to exercise what
+	// reads records rather than only routes frames.
+	Records bool
+}
+
+// Relay sends its frames at a steady rate once started. Every connection
+// gets the frames after its cursor, or the ones sent from then on without
+// one, and then waits for new ones. Like a real relay, a cursor older than
+// the backlog starts at its oldest frame after an OutdatedCursor info frame,
+// and a cursor ahead of the stream gets a FutureCursor error.
+type Relay struct {
+	limit   int
+	rate    float64
+	backlog int
+	// seq and frame are the sequence and raw frame of the i-th frame, sent
+	// at the given time
+	seq   func(i int) int64
+	frame func(i int, at time.Time) []byte
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	sent    []time.Time // send time of frame base+j
+	base    int
+	started bool
+	closed  bool
+	conns   map[*websocket.Conn]struct{}
+
+	written atomic.Int64
+}
+
+// New returns a relay of synthetic frames, from seq 1: mostly commits,
+// cycling through Collections, with an identity and an account frame every
+// ten.
+func New(opts Options) *Relay {
+	dids := int64(max(opts.DIDs, 1))
+	r := &Relay{
+		limit:   opts.Frames,
+		rate:    opts.Rate,
+		backlog: opts.Backlog,
+		seq:     func(i int) int64 { return int64(i) + 1 },
+	}
+	r.frame = func(i int, at time.Time) []byte { return Synthetic(r.seq(i), dids, at, opts.Records) }
+	r.cond = sync.NewCond(&r.mu)
+	r.conns = make(map[*websocket.Conn]struct{})
+	return r
+}
+
+// NewReplay returns a relay sending recorded frames, with their own
+// sequences, at rate per second.
+func NewReplay(frames []Recorded, rate float64) *Relay {
+	r := &Relay{
+		limit: len(frames),
+		rate:  rate,
+		seq:   func(i int) int64 { return frames[i].Seq },
+		frame: func(i int, _ time.Time) []byte { return frames[i].Data },
+		conns: make(map[*websocket.Conn]struct{}),
+	}
+	r.cond = sync.NewCond(&r.mu)
+	return r
+}
+
+// Start starts sending frames; connections made before wait for them.
+func (r *Relay) Start() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.started {
+		return
+	}
+	r.started = true
+	go r.generate()
+}
+
+// Close stops the relay and ends the connections.
+func (r *Relay) Close() {
+	r.mu.Lock()
+	r.closed = true
+	r.mu.Unlock()
+	r.cond.Broadcast()
+}
+
+func (r *Relay) generate() {
+	start := time.Now()
+	for i := 0; r.limit == 0 || i < r.limit; i++ {
+		if d := time.Until(start.Add(time.Duration(float64(i) / r.rate * float64(time.Second)))); d > 0 {
+			time.Sleep(d)
+		}
+		r.mu.Lock()
+		if r.closed {
+			r.mu.Unlock()
+			return
+		}
+		r.sent = append(r.sent, time.Now())
+		if r.backlog > 0 && len(r.sent) >= 2*r.backlog {
+			// Trimmed in bulk so appends stay cheap
+			drop := len(r.sent) - r.backlog
+			r.sent = append(r.sent[:0], r.sent[drop:]...)
+			r.base += drop
+		}
+		r.mu.Unlock()
+		r.cond.Broadcast()
+	}
+}
+
+// DropConnections closes the connections of the clients without a close
+// frame, as when the network fails; it returns how many there were.
+func (r *Relay) DropConnections() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for conn := range r.conns {
+		conn.NetConn().Close()
+	}
+	return len(r.conns)
+}
+
+// Sent returns how many frames have been sent.
+func (r *Relay) Sent() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.base + len(r.sent)
+}
+
+// Connections returns the number of connected clients.
+func (r *Relay) Connections() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.conns)
+}
+
+// Written returns how many frames have been written to clients, counting
+// each client's copy.
+func (r *Relay) Written() int64 { return r.written.Load() }
+
+// SentAt returns when the frame with sequence seq was sent, if it still is
+// in the backlog.
+func (r *Relay) SentAt(seq int64) (time.Time, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := r.index(seq)
+	if i < r.base || i >= r.base+len(r.sent) || r.seq(i) != seq {
+		return time.Time{}, false
+	}
+	return r.sent[i-r.base], true
+}
+
+// index returns the index of the first frame with a sequence of at least
+// seq among the sent ones, or Sent() when there is none. r.mu is held.
+func (r *Relay) index(seq int64) int {
+	return r.base + sort.Search(len(r.sent), func(j int) bool { return r.seq(r.base+j) >= seq })
+}
+
+// next waits for frame i and returns it with its index, which is past i
+// when frame i has been trimmed from the backlog, or nil once the relay is
+// closed.
+func (r *Relay) next(i int) ([]byte, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for !r.closed && i >= r.base+len(r.sent) {
+		r.cond.Wait()
+	}
+	if r.closed {
+		return nil, i
+	}
+	i = max(i, r.base)
+	return r.frame(i, r.sent[i-r.base]), i
+}
+
+// start returns the index of the first frame after cursor, whether frames
+// after it were trimmed from the backlog, or an error frame for a cursor
+// ahead of the stream.
+func (r *Relay) start(cursor int64) (i int, outdated bool, errFrame []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var head int64
+	if n := r.base + len(r.sent); n > 0 {
+		head = r.seq(n - 1)
+	}
+	if cursor > head {
+		return 0, false, futureCursor()
+	}
+	if r.base > 0 && cursor < r.seq(r.base-1) {
+		return r.base, true, nil
+	}
+	return r.index(cursor + 1), false, nil
+}
+
+// ServeHTTP serves the firehose on any path.
+func (r *Relay) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var i int
+	var outdated bool
+	var errFrame []byte
+	if cursor := req.URL.Query().Get("cursor"); cursor != "" {
+		seq, err := strconv.ParseInt(cursor, 10, 64)
+		if err != nil || seq < 0 {
+			http.Error(w, "invalid cursor", http.StatusBadRequest)
+			return
+		}
+		i, outdated, errFrame = r.start(seq)
+	} else {
+		i = r.Sent()
+	}
+	up := websocket.Upgrader{}
+	conn, err := up.Upgrade(w, req, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	r.mu.Lock()
+	r.conns[conn] = struct{}{}
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.conns, conn)
+		r.mu.Unlock()
+	}()
+	if errFrame != nil {
+		conn.WriteMessage(websocket.BinaryMessage, errFrame)
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, ""))
+		return
+	}
+
+	// Reads only to notice the client leaving
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		frame, n := r.next(i)
+		if frame == nil {
+			return
+		}
+		select {
+		case <-gone:
+			return
+		default:
+		}
+		if outdated || n > i {
+			// The client missed frames, either before connecting or by
+			// falling behind the backlog
+			if err := conn.WriteMessage(websocket.BinaryMessage, outdatedCursor()); err != nil {
+				return
+			}
+			outdated = false
+		}
+		if err := conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+			return
+		}
+		r.written.Add(1)
+		i = n + 1
+	}
+}
+
+// Synthetic returns the synthetic frame of seq, sent at the given time, of
+// one of dids repos: a commit of one of Collections, in turn, or an identity
+// or account frame every ten. With records, commits carry them as with
+// Options.Records.
+func Synthetic(seq, dids int64, at time.Time, records bool) []byte {
+	did := fmt.Sprintf("did:plc:fake%d", seq%dids)
+	ts := at.UTC().Format(time.RFC3339Nano)
+	var evt events.XRPCStreamEvent
+	switch seq % 10 {
+	case 0:
+		evt.RepoIdentity = &comatproto.SyncSubscribeRepos_Identity{Seq: seq, Did: did, Time: ts}
+	case 5:
+		evt.RepoAccount = &comatproto.SyncSubscribeRepos_Account{Seq: seq, Did: did, Time: ts, Active: true}
+	default:
+		collection := Collections[int(seq)%len(Collections)]
+		evt.RepoCommit = &comatproto.SyncSubscribeRepos_Commit{
+			Seq:    seq,
+			Repo:   did,
+			Rev:    strconv.FormatInt(seq, 36),
+			Time:   ts,
+			Commit: util.LexLink(commitCID),
+			Blobs:  []util.LexLink{},
+			Ops: []*comatproto.SyncSubscribeRepos_RepoOp{{
+				Action: "create",
+				Path:   collection + "/" + strconv.FormatInt(seq, 36),
+				Cid:    (*util.LexLink)(&commitCID),
+			}},
+		}
+		if records {
+			withRecords(evt.RepoCommit, ts)
+		}
+	}
+	return serialize(&evt)
+}
+
+// withRecords adds the records of the commit's op, and a chat declaration,
+// in a CAR of blocks.
+func withRecords(c *comatproto.SyncSubscribeRepos_Commit, ts string) {
+	op := c.Ops[0]
+	collection, rkey, _ := strings.Cut(op.Path, "/")
+	rec := map[string]any{"$type": collection, "createdAt": ts}
+	switch collection {
+	case "app.bsky.feed.post":
+		rec["text"] = "post " + rkey
+		rec["embed"] = map[string]any{
+			"$type":    "app.bsky.embed.external",
+			"external": map[string]any{"uri": "https://example.com/" + rkey, "title": "link " + rkey, "description": ""},
+		}
+	case "app.bsky.graph.follow":
+		rec["subject"] = "did:plc:fake0"
+	default:
+		rec["subject"] = map[string]any{"uri": fmt.Sprintf("at://%s/app.bsky.feed.post/%s", c.Repo, rkey), "cid": commitCID.String()}
+	}
+	decl := map[string]any{"$type": DeclarationCollection, "allowIncoming": "following"}
+
+	var car bytes.Buffer
+	if err := gocar.WriteHeader(&gocar.CarHeader{Roots: []cid.Cid{commitCID}, Version: 1}, &car); err != nil {
+		panic(err)
+	}
+	c.Ops = append(c.Ops, &comatproto.SyncSubscribeRepos_RepoOp{Action: "update", Path: DeclarationCollection + "/self"})
+	for i, r := range []map[string]any{rec, decl} {
+		b, err := data.MarshalCBOR(r)
+		if err != nil {
+			// The records are made of strings and maps only
+			panic(err)
+		}
+		recCID, err := commitCID.Prefix().Sum(b)
+		if err != nil {
+			panic(err)
+		}
+		c.Ops[i].Cid = (*util.LexLink)(&recCID)
+		if err := carutil.LdWrite(&car, recCID.Bytes(), b); err != nil {
+			panic(err)
+		}
+	}
+	c.Blocks = car.Bytes()
+}
+
+func outdatedCursor() []byte {
+	msg := "Requested cursor exceeded limit. Possibly missing events"
+	return serialize(&events.XRPCStreamEvent{RepoInfo: &comatproto.SyncSubscribeRepos_Info{Name: "OutdatedCursor", Message: &msg}})
+}
+
+func futureCursor() []byte {
+	return serialize(&events.XRPCStreamEvent{Error: &events.ErrorFrame{Error: "FutureCursor", Message: "Cursor in the future."}})
+}
+
+func serialize(evt *events.XRPCStreamEvent) []byte {
+	var buf bytes.Buffer
+	if err := evt.Serialize(&buf); err != nil {
+		// Only fails on writes, and buf doesn't
+		panic(err)
+	}
+	return buf.Bytes()
+}
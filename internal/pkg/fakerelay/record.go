@@ -0,0 +1,65 @@
+package fakerelay
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/eurosky/firehose-processor-aas/pkg/firehose"
+)
+
+// maxFrameSize bounds the frames read from a recording, well above the
+// relays' own limits.
+const maxFrameSize = 16 << 20
+
+// Recorded is a frame of a recording.
+type Recorded struct {
+	Seq  int64
+	Data []byte
+}
+
+// WriteFrame appends a raw frame to a recording: the frames of a firehose,
+// each preceded by its length as a uvarint.
+func WriteFrame(w io.Writer, frame []byte) error {
+	if _, err := w.Write(binary.AppendUvarint(nil, uint64(len(frame)))); err != nil {
+		return err
+	}
+	_, err := w.Write(frame)
+	return err
+}
+
+// ReadRecording reads the frames of a recording. Frames without a sequence,
+// such as #info, are dropped; the others must be in increasing order.
+func ReadRecording(r io.Reader) ([]Recorded, error) {
+	br := bufio.NewReader(r)
+	var frames []Recorded
+	for n := 1; ; n++ {
+		size, err := binary.ReadUvarint(br)
+		if errors.Is(err, io.EOF) {
+			return frames, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("frame %d: %w", n, err)
+		}
+		if size > maxFrameSize {
+			return nil, fmt.Errorf("frame %d: %d bytes is too large", n, size)
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(br, data); err != nil {
+			return nil, fmt.Errorf("frame %d: %w", n, err)
+		}
+		info, err := firehose.InspectFrame(data)
+		if err != nil {
+			return nil, fmt.Errorf("frame %d: %w", n, err)
+		}
+		if info.Seq <= 0 {
+			continue
+		}
+		if len(frames) > 0 && info.Seq <= frames[len(frames)-1].Seq {
+			return nil, fmt.Errorf("frame %d: seq %d is not after %d", n, info.Seq, frames[len(frames)-1].Seq)
+		}
+		frames = append(frames, Recorded{Seq: info.Seq, Data: data})
+	}
+}
@@ -0,0 +1,143 @@
+// Package registry keeps the state of the running ingest instances and
+// consumers in a NATS KV bucket, where the control plane reads the pipeline
+// topology from. Every component rewrites its entries every few seconds;
+// the entries of a component that died expire with the bucket's TTL.
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/pkg/events"
+	"github.com/eurosky/firehose-processor-aas/pkg/firehose"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// Bucket holds an entry per ingest instance (ingest.<instance>) and per
+	// running consumer (consumer.<name>).
+	Bucket = "fpaas_registry"
+
+	ingestPrefix   = "ingest."
+	consumerPrefix = "consumer."
+
+	interval = 10 * time.Second
+	ttl      = 3 * interval
+)
+
+// Entries are the entries a component keeps, by key.
+type Entries map[string]any
+
+// Ingest returns the entry of an ingest instance.
+func Ingest(st events.IngestStatus) Entries {
+	return Entries{ingestPrefix + st.Instance: st}
+}
+
+// Add adds the entry of a consumer.
+func (e Entries) Add(st events.ConsumerStatus) {
+	e[consumerPrefix+st.Name] = st
+}
+
+// Publish writes the entries entries returns every few seconds until ctx is
+// done, then deletes them. Entries that are no longer returned are deleted
+// as well.
+func Publish(ctx context.Context, js nats.JetStreamContext, entries func() Entries, logger *slog.Logger) error {
+	kv, err := open(js)
+	if err != nil {
+		return err
+	}
+
+	written := map[string]bool{}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		current := entries()
+		for key, v := range current {
+			data, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			if _, err := kv.Put(key, data); err != nil {
+				logger.Warn("failed to update registry", "key", key, "error", err)
+				continue
+			}
+			written[key] = true
+		}
+		for key := range written {
+			if _, ok := current[key]; !ok {
+				kv.Delete(key)
+				delete(written, key)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			for key := range written {
+				kv.Delete(key)
+			}
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Load returns the current entries of the registry, sorted by key.
+func Load(js nats.JetStreamContext) ([]events.IngestStatus, []events.ConsumerStatus, error) {
+	kv, err := open(js)
+	if err != nil {
+		return nil, nil, err
+	}
+	keys, err := kv.Keys()
+	if errors.Is(err, nats.ErrNoKeysFound) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list registry: %w", err)
+	}
+	sort.Strings(keys)
+
+	var ingest []events.IngestStatus
+	var consumers []events.ConsumerStatus
+	for _, key := range keys {
+		e, err := kv.Get(key)
+		if errors.Is(err, nats.ErrKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read registry: %w", err)
+		}
+		switch {
+		case strings.HasPrefix(key, ingestPrefix):
+			var st events.IngestStatus
+			if json.Unmarshal(e.Value(), &st) == nil {
+				ingest = append(ingest, st)
+			}
+		case strings.HasPrefix(key, consumerPrefix):
+			var st events.ConsumerStatus
+			if json.Unmarshal(e.Value(), &st) == nil {
+				consumers = append(consumers, st)
+			}
+		}
+	}
+	return ingest, consumers, nil
+}
+
+// Ensure creates Bucket if it doesn't exist.
+func Ensure(js nats.JetStreamContext) error {
+	_, err := open(js)
+	return err
+}
+
+func open(js nats.JetStreamContext) (nats.KeyValue, error) {
+	kv, err := firehose.OpenKeyValue(js, &nats.KeyValueConfig{Bucket: Bucket, TTL: ttl, History: 1})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open registry bucket: %w", err)
+	}
+	return kv, nil
+}
@@ -0,0 +1,279 @@
+package service
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/urfave/cli/v2"
+	"github.com/urfave/cli/v2/altsrc"
+	"gopkg.in/yaml.v3"
+)
+
+// Sections are the top-level config file keys holding the settings of one
+// command.
+var Sections = []string{"ingest", "consume", "receive", "control-plane", "analyze", "route", "index"}
+
+// ConfigFile is a YAML or TOML file (by extension) with the settings of
+// every command. Keys are flag names:
+//
+//   - top-level keys apply to every command with that flag,
+//   - a section named after the command overrides them for that command,
+//   - nested maps are flattened with "-", so stream: {max-age: 1h} sets
+//     --stream-max-age,
+//   - lists of maps, such as consume.consumers, are left to the command.
+//
+// Command line flags and env vars take precedence over the file.
+type ConfigFile struct {
+	Path   string
+	values map[string]any
+}
+
+// ConfigFlag is the --config flag every command takes.
+func ConfigFlag() *cli.StringFlag {
+	return &cli.StringFlag{
+		Name:    "config",
+		Usage:   "YAML or TOML config file; keys are flag names, see fpaas config validate",
+		EnvVars: []string{"CONFIG_FILE"},
+	}
+}
+
+func ReadConfigFile(path string) (*ConfigFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var values map[string]any
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		err = toml.Unmarshal(data, &values)
+	default:
+		err = yaml.Unmarshal(data, &values)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	return &ConfigFile{Path: path, values: values}, nil
+}
+
+// Has reports whether the file has a section for the command.
+func (f *ConfigFile) Has(section string) bool {
+	_, ok := f.values[section].(map[string]any)
+	return ok
+}
+
+// Values returns the settings of a command: the top-level keys with its
+// section on top, flattened.
+func (f *ConfigFile) Values(section string) map[string]any {
+	values := make(map[string]any)
+	for k, v := range f.values {
+		if !slices.Contains(Sections, k) {
+			flatten(values, k, v)
+		}
+	}
+	if s, ok := f.values[section].(map[string]any); ok {
+		for k, v := range s {
+			flatten(values, k, v)
+		}
+	}
+	return values
+}
+
+// TopLevel returns the flattened keys outside of the sections.
+func (f *ConfigFile) TopLevel() map[string]any {
+	values := make(map[string]any)
+	for k, v := range f.values {
+		if !slices.Contains(Sections, k) {
+			flatten(values, k, v)
+		}
+	}
+	return values
+}
+
+// SectionValues returns only the flattened keys of a section.
+func (f *ConfigFile) SectionValues(section string) map[string]any {
+	values := make(map[string]any)
+	s, _ := f.values[section].(map[string]any)
+	for k, v := range s {
+		flatten(values, k, v)
+	}
+	return values
+}
+
+// List returns a list of maps in a section, each flattened.
+func (f *ConfigFile) List(section, key string) ([]map[string]any, error) {
+	s, _ := f.values[section].(map[string]any)
+	raw, ok := s[key]
+	if !ok {
+		return nil, nil
+	}
+	items, ok := normalize(raw).([]any)
+	if !ok {
+		return nil, fmt.Errorf("%s.%s must be a list", section, key)
+	}
+
+	list := make([]map[string]any, len(items))
+	for i, item := range items {
+		m, ok := item.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("%s.%s[%d] must be a map", section, key, i)
+		}
+		list[i] = make(map[string]any)
+		for k, v := range m {
+			flatten(list[i], k, v)
+		}
+	}
+	return list, nil
+}
+
+func flatten(dst map[string]any, key string, v any) {
+	if m, ok := v.(map[string]any); ok {
+		for k, v := range m {
+			flatten(dst, key+"-"+k, v)
+		}
+		return
+	}
+	dst[key] = normalize(v)
+}
+
+// normalize converts decoded values to the types altsrc expects.
+func normalize(v any) any {
+	switch v := v.(type) {
+	case int64:
+		return int(v)
+	case []any:
+		for i := range v {
+			v[i] = normalize(v[i])
+		}
+		return v
+	case []map[string]any:
+		// TOML arrays of tables
+		list := make([]any, len(v))
+		for i := range v {
+			list[i] = v[i]
+		}
+		return list
+	}
+	return v
+}
+
+// UnknownKeys returns the keys of values that aren't flags, sorted.
+func UnknownKeys(values map[string]any, flags []cli.Flag, allowed ...string) []string {
+	names := make(map[string]bool)
+	for _, f := range flags {
+		for _, n := range f.Names() {
+			names[n] = true
+		}
+	}
+	for _, n := range allowed {
+		names[n] = true
+	}
+
+	var unknown []string
+	for k := range values {
+		if !names[k] {
+			unknown = append(unknown, k)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// source wraps altsrc's map source, accepting whole numbers for float flags.
+type source struct {
+	*altsrc.MapInputSource
+	values map[string]any
+}
+
+func newSource(path string, values map[string]any) *source {
+	m := make(map[interface{}]interface{}, len(values))
+	for k, v := range values {
+		m[k] = v
+	}
+	return &source{MapInputSource: altsrc.NewMapInputSource(path, m), values: values}
+}
+
+func (s *source) Float64(name string) (float64, error) {
+	if v, ok := s.values[name].(int); ok {
+		return float64(v), nil
+	}
+	return s.MapInputSource.Float64(name)
+}
+
+const explicitFlagsKey = "fpaas.explicit-flags"
+
+// LoadConfig returns a cli.BeforeFunc that applies the command's section of
+// the --config file to the flags not set on the command line or in the env.
+func LoadConfig(section string) cli.BeforeFunc {
+	return func(cctx *cli.Context) error {
+		// Remembered for OverlayContext; nothing but the command line has
+		// set flags yet
+		if cctx.App.Metadata == nil {
+			cctx.App.Metadata = make(map[string]interface{})
+		}
+		cctx.App.Metadata[explicitFlagsKey] = cctx.LocalFlagNames()
+
+		path := cctx.String("config")
+		if path == "" {
+			return nil
+		}
+		f, err := ReadConfigFile(path)
+		if err != nil {
+			return err
+		}
+		return altsrc.ApplyInputSourceValues(cctx, newSource(path, f.Values(section)), cctx.Command.Flags)
+	}
+}
+
+// OverlayContext evaluates a fresh set of flags with values layered between
+// the env and the config file: command line flags and env vars of parent
+// win, then values, then parent's config file section and the defaults. It
+// lets one file configure several instances of a command, such as the
+// consume.consumers groups.
+func OverlayContext(parent *cli.Context, section string, values map[string]any, flags []cli.Flag) (*cli.Context, error) {
+	set := flag.NewFlagSet(section, flag.ContinueOnError)
+	for _, f := range flags {
+		if err := f.Apply(set); err != nil {
+			return nil, err
+		}
+	}
+	ctx := cli.NewContext(parent.App, set, nil)
+	ctx.Context = parent.Context
+
+	explicit, _ := parent.App.Metadata[explicitFlagsKey].([]string)
+	for _, name := range explicit {
+		if set.Lookup(name) == nil {
+			continue
+		}
+		switch v := parent.Value(name).(type) {
+		case cli.StringSlice:
+			for _, e := range v.Value() {
+				set.Set(name, e)
+			}
+		default:
+			if err := set.Set(name, fmt.Sprint(v)); err != nil {
+				return nil, fmt.Errorf("failed to apply --%s: %w", name, err)
+			}
+		}
+	}
+
+	if err := altsrc.ApplyInputSourceValues(ctx, newSource("", values), flags); err != nil {
+		return nil, err
+	}
+	if path := parent.String("config"); path != "" {
+		f, err := ReadConfigFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := altsrc.ApplyInputSourceValues(ctx, newSource(path, f.Values(section)), flags); err != nil {
+			return nil, err
+		}
+	}
+	return ctx, nil
+}
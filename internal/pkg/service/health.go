@@ -0,0 +1,96 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// checkTimeout bounds each readiness check.
+const checkTimeout = 2 * time.Second
+
+// Check reports whether a dependency is usable; nil means ready.
+type Check func(ctx context.Context) error
+
+// Note describes a state worth showing on /readyz that doesn't make the
+// process unready, such as delivery being paused; empty when there is none.
+type Note func() string
+
+type namedCheck struct {
+	name  string
+	check Check
+	note  Note
+}
+
+// ReadinessCheck adds a check to /readyz.
+func (r *Runtime) ReadinessCheck(name string, check Check) {
+	r.checks = append(r.checks, namedCheck{name: name, check: check})
+}
+
+// ReadinessNote adds a line to /readyz that never fails it: "[+]name" and
+// the note, or ok while it's empty.
+func (r *Runtime) ReadinessNote(name string, note Note) {
+	r.checks = append(r.checks, namedCheck{name: name, note: note})
+}
+
+// NATSCheck fails while nc isn't connected.
+func NATSCheck(nc *nats.Conn) Check {
+	return func(context.Context) error {
+		if status := nc.Status(); status != nats.CONNECTED {
+			return fmt.Errorf("nats connection is %s", status)
+		}
+		return nil
+	}
+}
+
+// serveHealthz answers liveness probes: the process is up and not shutting
+// down.
+func (r *Runtime) serveHealthz(w http.ResponseWriter, req *http.Request) {
+	if r.ctx.Err() != nil {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// serveReadyz answers readiness probes by running every check, listing each
+// one like Kubernetes components do ("[+]nats ok", "[-]nats failed: ...").
+func (r *Runtime) serveReadyz(w http.ResponseWriter, req *http.Request) {
+	status := http.StatusOK
+	var body string
+	if r.ctx.Err() != nil {
+		status = http.StatusServiceUnavailable
+		body += "[-]shutdown failed: shutting down\n"
+	}
+	for _, c := range r.checks {
+		if c.note != nil {
+			note := c.note()
+			if note == "" {
+				note = "ok"
+			}
+			body += fmt.Sprintf("[+]%s %s\n", c.name, note)
+			continue
+		}
+		ctx, cancel := context.WithTimeout(req.Context(), checkTimeout)
+		err := c.check(ctx)
+		cancel()
+		if err != nil {
+			status = http.StatusServiceUnavailable
+			body += fmt.Sprintf("[-]%s failed: %v\n", c.name, err)
+		} else {
+			body += fmt.Sprintf("[+]%s ok\n", c.name)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	if status == http.StatusOK {
+		body += "ok\n"
+	} else {
+		body += "not ready\n"
+	}
+	fmt.Fprint(w, body)
+}
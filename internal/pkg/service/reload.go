@@ -0,0 +1,89 @@
+package service
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// configPollInterval is how often WatchConfig checks the --config file for
+// changes.
+const configPollInterval = 2 * time.Second
+
+// ReloadFunc applies the settings re-read by WatchConfig. cctx holds the
+// flags evaluated as at startup, against the current file.
+type ReloadFunc func(cctx *cli.Context) error
+
+// WatchConfig re-reads the --config file on SIGHUP and when the file changes,
+// until ctx is done. The log level is applied for every command; reload
+// applies the rest and may be nil. When the file fails to load or reload
+// fails, the error is logged and the running settings are kept.
+func WatchConfig(ctx context.Context, cctx *cli.Context, section string, flags func() []cli.Flag, logger *slog.Logger, reload ReloadFunc) {
+	path := cctx.String("config")
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		defer signal.Stop(hup)
+
+		ticker := time.NewTicker(configPollInterval)
+		defer ticker.Stop()
+		last := stat(path)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				logger.Info("received SIGHUP")
+			case <-ticker.C:
+				if path == "" {
+					continue
+				}
+				current := stat(path)
+				if current == last {
+					continue
+				}
+				last = current
+				logger.Info("config file changed", "path", path)
+			}
+			if path == "" {
+				logger.Info("no config file to reload")
+				continue
+			}
+
+			rctx, err := OverlayContext(cctx, section, nil, flags())
+			if err != nil {
+				logger.Error("failed to reload config, keeping the running settings", "path", path, "error", err)
+				continue
+			}
+			SetLogLevel(rctx.String("log-level"))
+			if reload != nil {
+				if err := reload(rctx); err != nil {
+					logger.Error("failed to apply reloaded config", "path", path, "error", err)
+					continue
+				}
+			}
+			logger.Info("reloaded config", "path", path, "log_level", rctx.String("log-level"))
+		}
+	}()
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func stat(path string) fileStamp {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{modTime: fi.ModTime(), size: fi.Size()}
+}
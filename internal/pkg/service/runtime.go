@@ -0,0 +1,128 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// ShutdownTimeout bounds the HTTP server shutdown and the stop hooks.
+const ShutdownTimeout = 5 * time.Second
+
+// Runtime is the lifecycle shared by the long-running commands: logger,
+// signal handling, the HTTP server for metrics, /healthz, /readyz and the
+// command's own endpoints, background workers and graceful shutdown.
+//
+// A command creates it with NewRuntime, registers handlers on Mux, workers
+// with Go and cleanup with OnStop, then calls Run.
+type Runtime struct {
+	Logger *slog.Logger
+	// Mux is served by Server.
+	Mux *http.ServeMux
+	// Server may be adjusted (e.g. its timeouts) before Run; it is nil when
+	// the runtime has no address.
+	Server *http.Server
+
+	name    string
+	ctx     context.Context
+	cancel  context.CancelCauseFunc
+	stop    context.CancelFunc
+	workers sync.WaitGroup
+	onStop  []func(context.Context) error
+	checks  []namedCheck
+}
+
+// NewRuntime configures the logger from --log-level and starts handling
+// shutdown signals. addr is where Mux is served; empty disables the server.
+func NewRuntime(cctx *cli.Context, name, addr string) *Runtime {
+	logger := Logger(cctx)
+	sigCtx, stop := SignalContext(cctx.Context, logger)
+	ctx, cancel := context.WithCancelCause(sigCtx)
+
+	r := &Runtime{
+		Logger: logger,
+		Mux:    http.NewServeMux(),
+		name:   name,
+		ctx:    ctx,
+		cancel: cancel,
+		stop:   stop,
+	}
+	if addr != "" {
+		r.Server = &http.Server{Addr: addr, Handler: r.Mux, ReadHeaderTimeout: 10 * time.Second}
+	}
+	r.Mux.HandleFunc("GET /healthz", r.serveHealthz)
+	r.Mux.HandleFunc("GET /readyz", r.serveReadyz)
+	return r
+}
+
+// Context is done when the runtime starts shutting down.
+func (r *Runtime) Context() context.Context {
+	return r.ctx
+}
+
+// OnStop registers a hook run at shutdown, after the server and workers have
+// stopped. Hooks run in reverse order of registration.
+func (r *Runtime) OnStop(hook func(ctx context.Context) error) {
+	r.onStop = append(r.onStop, hook)
+}
+
+// Go runs fn in the background until the runtime's context is done. An error
+// from fn shuts the runtime down and is returned by Run.
+func (r *Runtime) Go(fn func(ctx context.Context) error) {
+	r.workers.Add(1)
+	go func() {
+		defer r.workers.Done()
+		if err := fn(r.ctx); err != nil && r.ctx.Err() == nil {
+			r.cancel(err)
+		}
+	}()
+}
+
+// Run starts the server, then runs main, or waits for a signal when main is
+// nil. Once main returns, a worker fails or a signal arrives, it shuts the
+// server down, waits for the workers and runs the stop hooks.
+func (r *Runtime) Run(main func(ctx context.Context) error) error {
+	defer r.stop()
+	defer r.cancel(nil)
+
+	server := r.Server
+	if server != nil {
+		r.Go(func(context.Context) error {
+			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				return fmt.Errorf("http server failed: %w", err)
+			}
+			return nil
+		})
+	}
+
+	var err error
+	if main != nil {
+		err = main(r.ctx)
+	} else {
+		<-r.ctx.Done()
+	}
+	if cause := context.Cause(r.ctx); err == nil && cause != nil && cause != context.Canceled {
+		err = cause
+	}
+	r.Logger.Info("shutting down", "service", r.name)
+	r.cancel(nil)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+
+	var errs []error
+	if server != nil {
+		errs = append(errs, server.Shutdown(shutdownCtx))
+	}
+	r.workers.Wait()
+	for i := len(r.onStop) - 1; i >= 0; i-- {
+		errs = append(errs, r.onStop[i](shutdownCtx))
+	}
+	return errors.Join(append([]error{err}, errs...)...)
+}
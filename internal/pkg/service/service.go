@@ -0,0 +1,121 @@
+// Package service holds the boilerplate shared by every fpaas command: the
+// log level and config flags, logger setup, signal handling, the Runtime
+// lifecycle and turning a command into a standalone binary.
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/carlmjohnson/versioninfo"
+	"github.com/urfave/cli/v2"
+	"go.uber.org/automaxprocs/maxprocs"
+)
+
+// LogLevelFlag is the --log-level flag every command takes.
+func LogLevelFlag(value string) *cli.StringFlag {
+	return &cli.StringFlag{
+		Name:    "log-level",
+		Usage:   "log verbosity level (error, warn, info, debug)",
+		Value:   value,
+		EnvVars: []string{"LOG_LEVEL"},
+	}
+}
+
+// logLevel is shared by every logger, so a config reload changes the level
+// of the whole process.
+var logLevel slog.LevelVar
+
+// MetricsAddrFlag is the --metrics-addr flag of commands whose HTTP server
+// only serves metrics and health checks.
+func MetricsAddrFlag(value string) *cli.StringFlag {
+	return &cli.StringFlag{
+		Name:    "metrics-addr",
+		Usage:   "listen address of the /metrics, /healthz and /readyz server; empty disables it",
+		Value:   value,
+		EnvVars: []string{"METRICS_ADDR"},
+	}
+}
+
+// Logger configures the default slog logger from --log-level.
+func Logger(cctx *cli.Context) *slog.Logger {
+	SetLogLevel(cctx.String("log-level"))
+
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: &logLevel}))
+	slog.SetDefault(logger)
+	return logger
+}
+
+// SetLogLevel changes the level of the loggers returned by Logger.
+func SetLogLevel(level string) {
+	switch strings.ToLower(level) {
+	case "error":
+		logLevel.Set(slog.LevelError)
+	case "warn":
+		logLevel.Set(slog.LevelWarn)
+	case "info":
+		logLevel.Set(slog.LevelInfo)
+	case "debug":
+		logLevel.Set(slog.LevelDebug)
+	default:
+		logLevel.Set(slog.LevelInfo)
+	}
+}
+
+type signalKey struct{}
+
+// SignalContext returns a context cancelled on SIGINT or SIGTERM, or when
+// parent is done. Commands run inside another one share its handler.
+func SignalContext(parent context.Context, logger *slog.Logger) (context.Context, context.CancelFunc) {
+	if parent.Value(signalKey{}) != nil {
+		return context.WithCancel(parent)
+	}
+	ctx, cancel := context.WithCancel(context.WithValue(parent, signalKey{}, true))
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		defer signal.Stop(sigCh)
+		select {
+		case <-sigCh:
+			logger.Info("received shutdown signal")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// App turns cmd into a standalone binary called name, for the single-purpose
+// images built from cmd/.
+func App(name string, cmd *cli.Command) *cli.App {
+	return &cli.App{
+		Name:     name,
+		Usage:    cmd.Usage,
+		Version:  versioninfo.Short(),
+		Flags:    cmd.Flags,
+		Before:   cmd.Before,
+		Action:   cmd.Action,
+		Commands: cmd.Subcommands,
+	}
+}
+
+// Main runs app with the process arguments and exits non-zero on error.
+// GOMAXPROCS is first set to the container's CPU quota, unless the
+// GOMAXPROCS env var sets it: with one P per host core, a CPU-limited pod
+// gets throttled and its latency spikes.
+func Main(app *cli.App) {
+	maxprocs.Set(maxprocs.Logger(func(format string, args ...any) {
+		slog.Debug(fmt.Sprintf(format, args...))
+	}))
+	if err := app.Run(os.Args); err != nil {
+		slog.Error("application failed", "error", err)
+		os.Exit(1)
+	}
+}
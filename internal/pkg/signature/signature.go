@@ -0,0 +1,39 @@
+// Package signature implements the HMAC-SHA256 webhook signatures sent by
+// consumers in the X-Signature header and checked by receivers.
+package signature
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// Header is the HTTP header carrying the signature.
+const Header = "X-Signature"
+
+const prefix = "sha256="
+
+// Sign returns the X-Signature value for body: "sha256=" followed by the hex
+// encoded HMAC-SHA256 of the exact request body bytes.
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return prefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify reports whether header is a valid signature of body. The comparison
+// is constant-time.
+func Verify(secret, body []byte, header string) bool {
+	sig, ok := strings.CutPrefix(header, prefix)
+	if !ok {
+		return false
+	}
+	got, err := hex.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
@@ -0,0 +1,100 @@
+// Package tracing sets up OpenTelemetry tracing from the standard OTEL_*
+// env vars and carries trace context in NATS message headers, so a consumer's
+// spans link back to the ingest span that published the frame.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Enabled reports whether the env asks for traces to be exported: an OTLP
+// endpoint is set and neither OTEL_SDK_DISABLED nor OTEL_TRACES_EXPORTER=none
+// turn it off.
+func Enabled() bool {
+	if strings.EqualFold(os.Getenv("OTEL_SDK_DISABLED"), "true") || os.Getenv("OTEL_TRACES_EXPORTER") == "none" {
+		return false
+	}
+	return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+}
+
+// Setup installs an OTLP/HTTP tracer provider configured by the OTEL_* env
+// vars (endpoint, headers, sampler, resource attributes). service is used
+// unless OTEL_SERVICE_NAME is set. When tracing isn't enabled the global
+// no-op provider stays in place. The returned func flushes pending spans.
+func Setup(ctx context.Context, service string) (func(context.Context) error, error) {
+	if !Enabled() {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP trace exporter: %w", err)
+	}
+	res, err := resource.Merge(
+		resource.NewSchemaless(attribute.String("service.name", service)),
+		resource.Environment(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build trace resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
+
+// Header adapts NATS message headers to a propagation.TextMapCarrier.
+type Header nats.Header
+
+func (h Header) Get(key string) string { return nats.Header(h).Get(key) }
+
+func (h Header) Set(key, value string) { nats.Header(h).Set(key, value) }
+
+func (h Header) Keys() []string {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// Inject writes the span context of ctx into msg's headers.
+func Inject(ctx context.Context, msg *nats.Msg) {
+	if msg.Header == nil {
+		msg.Header = nats.Header{}
+	}
+	otel.GetTextMapPropagator().Inject(ctx, Header(msg.Header))
+}
+
+// Links returns a link to the span that published each message, skipping
+// messages without trace context.
+func Links(msgs []*nats.Msg) []trace.Link {
+	var links []trace.Link
+	propagator := otel.GetTextMapPropagator()
+	for _, msg := range msgs {
+		if msg.Header == nil {
+			continue
+		}
+		sc := trace.SpanContextFromContext(propagator.Extract(context.Background(), Header(msg.Header)))
+		if sc.IsValid() {
+			links = append(links, trace.Link{SpanContext: sc})
+		}
+	}
+	return links
+}
@@ -0,0 +1,122 @@
+package consumer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/eurosky/firehose-processor-aas/pkg/events"
+	"github.com/nats-io/nats.go"
+)
+
+// maxAckBody bounds the part of a webhook answer read for an events.Ack.
+const maxAckBody = 1 << 20
+
+// PartialDeliveryError is returned by a Deliverer when the target processed
+// only some messages of a batch. The messages at the indexes in Accepted are
+// acked, the others redelivered.
+type PartialDeliveryError struct {
+	Accepted []int
+	Err      error
+}
+
+func (e *PartialDeliveryError) Error() string {
+	return fmt.Sprintf("%d events accepted, the others not: %v", len(e.Accepted), e.Err)
+}
+
+func (e *PartialDeliveryError) Unwrap() error {
+	return e.Err
+}
+
+// partialDelivery returns err, as a *PartialDeliveryError when the events
+// at the accepted indexes got through.
+func partialDelivery(accepted []int, err error) error {
+	if len(accepted) == 0 {
+		return err
+	}
+	return &PartialDeliveryError{Accepted: accepted, Err: err}
+}
+
+// splitAccepted returns the msgs a delivery that returned err got through,
+// and the others. None got through a failed delivery, unless it is a
+// *PartialDeliveryError.
+func splitAccepted(msgs []*nats.Msg, err error) (accepted, rest []*nats.Msg) {
+	if err == nil {
+		return msgs, nil
+	}
+	var partial *PartialDeliveryError
+	if !errors.As(err, &partial) {
+		return nil, msgs
+	}
+	ok := make([]bool, len(msgs))
+	for _, i := range partial.Accepted {
+		if i >= 0 && i < len(msgs) {
+			ok[i] = true
+		}
+	}
+	for i, msg := range msgs {
+		if ok[i] {
+			accepted = append(accepted, msg)
+		} else {
+			rest = append(rest, msg)
+		}
+	}
+	return accepted, rest
+}
+
+// ackResult turns a webhook answer to a delivery of n events into the
+// delivery's outcome. Without an events.Ack body, a 200 delivers every event
+// and any other status none. With one, a 200 delivers every event but those
+// rejected, and another status only those accepted, e.g. by a receiver that
+// timed out or failed midway through the batch.
+func ackResult(status int, body io.Reader, n int) error {
+	var statusErr error
+	if status != http.StatusOK {
+		statusErr = fmt.Errorf("webhook returned non-OK status: %d", status)
+	}
+
+	var ack events.Ack
+	if err := json.NewDecoder(io.LimitReader(body, maxAckBody)).Decode(&ack); err != nil || (ack.Accepted == nil && ack.Rejected == nil) {
+		return statusErr
+	}
+
+	// A 200 delivers the events not rejected, another status those accepted
+	delivered := make([]bool, n)
+	listed, reason := ack.Accepted, ""
+	if statusErr == nil {
+		for i := range delivered {
+			delivered[i] = true
+		}
+		listed = ack.Rejected
+	}
+	for _, e := range listed {
+		if e.Index >= 0 && e.Index < n {
+			delivered[e.Index] = statusErr != nil
+			if reason == "" {
+				reason = e.Reason
+			}
+		}
+	}
+	var accepted []int
+	for i, ok := range delivered {
+		if ok {
+			accepted = append(accepted, i)
+		}
+	}
+
+	if statusErr == nil {
+		if len(accepted) == n {
+			return nil
+		}
+		statusErr = fmt.Errorf("receiver rejected %d events", n-len(accepted))
+		if reason != "" {
+			statusErr = fmt.Errorf("%w, e.g. %s", statusErr, reason)
+		}
+	}
+	if len(accepted) == 0 {
+		return statusErr
+	}
+	return &PartialDeliveryError{Accepted: accepted, Err: statusErr}
+}
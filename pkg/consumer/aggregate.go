@@ -0,0 +1,473 @@
+package consumer
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"math"
+	"math/bits"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/eurosky/firehose-processor-aas/pkg/events"
+	"github.com/eurosky/firehose-processor-aas/pkg/firehose"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// MinAggregateWindow and MaxAggregateWindow bound
+	// Config.AggregateWindow.
+	MinAggregateWindow = 10 * time.Second
+	MaxAggregateWindow = 24 * time.Hour
+
+	// RollupBucket holds the window in progress and the rollups not yet
+	// delivered of each consumer with an aggregation window, so they
+	// survive restarts and replicas taking the consumer over.
+	RollupBucket = "fpaas_rollups"
+
+	// RollupHashtags is how many hashtags a rollup lists.
+	RollupHashtags = 10
+	// rollupTrackedHashtags is how many hashtags a window counts; a new one
+	// takes the place of the least used past it (the space-saving
+	// algorithm), so the most used are counted within the uses of those
+	// evicted.
+	rollupTrackedHashtags = 100
+	// rollupMaxPending is how many rollups wait for the webhook; the
+	// oldest are dropped past it.
+	rollupMaxPending = 100
+
+	// hllPrecision sizes the sketch of a window's DIDs: 2^12 registers of
+	// a byte, for a standard error of 1.6%.
+	hllPrecision = 12
+)
+
+// rollupWindow is the window in progress of a consumer, as kept in
+// RollupBucket, or what a batch adds to it.
+type rollupWindow struct {
+	Start       time.Time        `json:"start"`
+	Events      int64            `json:"events,omitempty"`
+	Types       map[string]int64 `json:"types,omitempty"`
+	Collections map[string]int64 `json:"collections,omitempty"`
+	DIDs        hyperLogLog      `json:"dids,omitempty"`
+	Hashtags    map[string]int64 `json:"hashtags,omitempty"`
+	FirstSeq    uint64           `json:"first_seq,omitempty"`
+	LastSeq     uint64           `json:"last_seq,omitempty"`
+}
+
+// rollupState is what RollupBucket holds for a consumer.
+type rollupState struct {
+	Window  rollupWindow    `json:"window"`
+	Pending []events.Rollup `json:"pending,omitempty"`
+}
+
+// hyperLogLog is a HyperLogLog sketch counting distinct strings, nil until
+// the first is added.
+type hyperLogLog []byte
+
+func (h *hyperLogLog) add(s string) {
+	if *h == nil {
+		*h = make(hyperLogLog, 1<<hllPrecision)
+	}
+	x := xxhash.Sum64String(s)
+	// The first bits pick the register, which keeps the longest run of
+	// zeros of the rest
+	i := x >> (64 - hllPrecision)
+	rank := uint8(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1)) + 1)
+	(*h)[i] = max((*h)[i], rank)
+}
+
+func (h *hyperLogLog) merge(o hyperLogLog) {
+	if len(o) != 1<<hllPrecision {
+		return
+	}
+	if *h == nil {
+		*h = slices.Clone(o)
+		return
+	}
+	for i, rank := range o {
+		(*h)[i] = max((*h)[i], rank)
+	}
+}
+
+func (h hyperLogLog) count() int64 {
+	if len(h) == 0 {
+		return 0
+	}
+	m := float64(len(h))
+	sum, zeros := 0.0, 0
+	for _, rank := range h {
+		sum += math.Ldexp(1, -int(rank))
+		if rank == 0 {
+			zeros++
+		}
+	}
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	// Small cardinalities are counted better by the empty registers
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return int64(math.Round(estimate))
+}
+
+// add counts a frame in the window.
+func (w *rollupWindow) add(msg *nats.Msg) {
+	info, err := firehose.InspectFrame(msg.Data)
+	if err != nil {
+		return
+	}
+	w.Events++
+	inc(&w.Types, info.Type, 1)
+	if info.DID != "" {
+		w.DIDs.add(info.DID)
+	}
+	posts := false
+	for i, path := range info.Paths {
+		collection, _, _ := strings.Cut(path, "/")
+		inc(&w.Collections, collection, 1)
+		if collection == "app.bsky.feed.post" && info.Actions[i] == "create" {
+			posts = true
+		}
+	}
+	if seq := streamSeq(msg); seq > 0 {
+		if w.FirstSeq == 0 || seq < w.FirstSeq {
+			w.FirstSeq = seq
+		}
+		w.LastSeq = max(w.LastSeq, seq)
+	}
+
+	// Only frames creating posts are decoded in full, for their hashtags
+	if !posts {
+		return
+	}
+	evt, err := firehose.DecodeFrame(msg.Data)
+	if err != nil {
+		return
+	}
+	for _, op := range evt.Ops {
+		if op.Collection == "app.bsky.feed.post" && op.Action == "create" {
+			for _, tag := range postHashtags(op.Record) {
+				w.addHashtag(tag, 1)
+			}
+		}
+	}
+}
+
+// postHashtags returns the distinct hashtags of a post record, from its tag
+// facets and its tags, lowercase and without the #.
+func postHashtags(record json.RawMessage) []string {
+	var post struct {
+		Tags   []string `json:"tags"`
+		Facets []struct {
+			Features []struct {
+				Type string `json:"$type"`
+				Tag  string `json:"tag"`
+			} `json:"features"`
+		} `json:"facets"`
+	}
+	if len(record) == 0 || json.Unmarshal(record, &post) != nil {
+		return nil
+	}
+	tags := post.Tags
+	for _, facet := range post.Facets {
+		for _, feature := range facet.Features {
+			if feature.Type == "app.bsky.richtext.facet#tag" {
+				tags = append(tags, feature.Tag)
+			}
+		}
+	}
+	var hashtags []string
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(tag), "#"))
+		if tag != "" && !slices.Contains(hashtags, tag) {
+			hashtags = append(hashtags, tag)
+		}
+	}
+	return hashtags
+}
+
+func (w *rollupWindow) addHashtag(tag string, n int64) {
+	if _, ok := w.Hashtags[tag]; ok || len(w.Hashtags) < rollupTrackedHashtags {
+		inc(&w.Hashtags, tag, n)
+		return
+	}
+	// The least used gives its place, and its count, to tag
+	least := ""
+	for t, c := range w.Hashtags {
+		if least == "" || c < w.Hashtags[least] || (c == w.Hashtags[least] && t < least) {
+			least = t
+		}
+	}
+	n += w.Hashtags[least]
+	delete(w.Hashtags, least)
+	w.Hashtags[tag] = n
+}
+
+// merge adds what o counted to the window.
+func (w *rollupWindow) merge(o rollupWindow) {
+	w.Events += o.Events
+	for k, n := range o.Types {
+		inc(&w.Types, k, n)
+	}
+	for k, n := range o.Collections {
+		inc(&w.Collections, k, n)
+	}
+	w.DIDs.merge(o.DIDs)
+	for _, tag := range slices.Sorted(maps.Keys(o.Hashtags)) {
+		w.addHashtag(tag, o.Hashtags[tag])
+	}
+	if o.FirstSeq > 0 && (w.FirstSeq == 0 || o.FirstSeq < w.FirstSeq) {
+		w.FirstSeq = o.FirstSeq
+	}
+	w.LastSeq = max(w.LastSeq, o.LastSeq)
+}
+
+// rollup is what the window sums up to once it is over.
+func (w *rollupWindow) rollup(consumer string, window time.Duration) events.Rollup {
+	r := events.Rollup{
+		Consumer:    consumer,
+		Start:       w.Start,
+		End:         w.Start.Add(window),
+		Events:      w.Events,
+		Types:       make(map[string]int64, len(w.Types)),
+		Collections: make(map[string]int64, len(w.Collections)),
+		UniqueDIDs:  w.DIDs.count(),
+		Hashtags:    []events.HashtagCount{},
+		FirstSeq:    w.FirstSeq,
+		LastSeq:     w.LastSeq,
+	}
+	maps.Copy(r.Types, w.Types)
+	maps.Copy(r.Collections, w.Collections)
+	for tag, n := range w.Hashtags {
+		r.Hashtags = append(r.Hashtags, events.HashtagCount{Tag: tag, Count: n})
+	}
+	slices.SortFunc(r.Hashtags, func(a, b events.HashtagCount) int {
+		return cmp.Or(cmp.Compare(b.Count, a.Count), strings.Compare(a.Tag, b.Tag))
+	})
+	r.Hashtags = r.Hashtags[:min(len(r.Hashtags), RollupHashtags)]
+	return r
+}
+
+func inc(m *map[string]int64, key string, n int64) {
+	if *m == nil {
+		*m = make(map[string]int64)
+	}
+	(*m)[key] += n
+}
+
+// rotate closes the window in progress once now is past it, queueing its
+// rollup, and starts the window now is in. Windows are aligned on multiples
+// of their length, so those the consumer was stopped through are left out.
+// It returns how many rollups were dropped from a full queue.
+func (s *rollupState) rotate(consumer string, window time.Duration, now time.Time) int {
+	if now.Before(s.Window.Start.Add(window)) {
+		return 0
+	}
+	s.Pending = append(s.Pending, s.Window.rollup(consumer, window))
+	s.Window = rollupWindow{Start: now.Truncate(window)}
+	dropped := max(0, len(s.Pending)-rollupMaxPending)
+	s.Pending = s.Pending[dropped:]
+	return dropped
+}
+
+// EnsureRollupBucket opens RollupBucket, creating it if it doesn't exist.
+func EnsureRollupBucket(js nats.JetStreamContext) (nats.KeyValue, error) {
+	return firehose.OpenKeyValue(js, &nats.KeyValueConfig{
+		Bucket:  RollupBucket,
+		History: 1,
+		TTL:     MaxAggregateWindow + 24*time.Hour,
+	})
+}
+
+// aggregateDeliverer counts the events of a consumer with an aggregation
+// window in its window in RollupBucket, acking them once they are counted
+// there, and posts the rollup of every window to the webhook once it is
+// over. Empty windows get a rollup too, so the receiver can tell a quiet
+// window from a stopped consumer.
+type aggregateDeliverer struct {
+	webhook  *webhookDeliverer
+	consumer string
+	window   time.Duration
+
+	kv     nats.KeyValue
+	logger *slog.Logger
+	stop   context.CancelFunc
+	done   chan struct{}
+	// mu orders the updates of the state made by the process
+	mu sync.Mutex
+}
+
+// bind opens RollupBucket and starts posting rollups until Close.
+func (d *aggregateDeliverer) bind(js nats.JetStreamContext, logger *slog.Logger) error {
+	kv, err := EnsureRollupBucket(js)
+	if err != nil {
+		return fmt.Errorf("failed to open rollup bucket: %w", err)
+	}
+	d.kv = kv
+	d.logger = logger
+	ctx, stop := context.WithCancel(context.Background())
+	d.stop = stop
+	d.done = make(chan struct{})
+	go d.run(ctx)
+	return nil
+}
+
+// Close stops posting rollups. The window in progress and the rollups not
+// yet delivered stay in RollupBucket for the consumer's next run.
+func (d *aggregateDeliverer) Close() error {
+	if d.stop != nil {
+		d.stop()
+		<-d.done
+	}
+	return nil
+}
+
+func (d *aggregateDeliverer) DeliverBatch(ctx context.Context, consumer string, msgs []*nats.Msg) error {
+	var delta rollupWindow
+	for _, msg := range msgs {
+		delta.add(msg)
+	}
+	return d.count(delta)
+}
+
+func (d *aggregateDeliverer) DeliverEvent(ctx context.Context, consumer string, msg *nats.Msg) error {
+	var delta rollupWindow
+	delta.add(msg)
+	return d.count(delta)
+}
+
+// count adds delta to the window in progress.
+func (d *aggregateDeliverer) count(delta rollupWindow) error {
+	if delta.Events == 0 {
+		return nil
+	}
+	if d.kv == nil {
+		return errors.New("aggregation window is not bound to NATS")
+	}
+	return d.update(func(s *rollupState) { s.Window.merge(delta) })
+}
+
+// update rotates the window and applies fn to the state, retrying when
+// another replica changed it in between.
+func (d *aggregateDeliverer) update(fn func(*rollupState)) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for attempt := 0; ; attempt++ {
+		s, revision, err := d.state()
+		if err != nil {
+			return err
+		}
+		dropped := s.rotate(d.consumer, d.window, time.Now().UTC())
+		fn(&s)
+		value, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		if revision == 0 {
+			_, err = d.kv.Create(d.consumer, value)
+		} else {
+			_, err = d.kv.Update(d.consumer, value, revision)
+		}
+		if err == nil || attempt >= 3 {
+			if err != nil {
+				return fmt.Errorf("failed to store rollup: %w", err)
+			}
+			if dropped > 0 {
+				d.logger.Warn("dropped undelivered rollups", "rollups", dropped)
+			}
+			return nil
+		}
+	}
+}
+
+// state reads the state and its revision, zero when there is none yet.
+func (d *aggregateDeliverer) state() (rollupState, uint64, error) {
+	entry, err := d.kv.Get(d.consumer)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return rollupState{Window: rollupWindow{Start: time.Now().UTC().Truncate(d.window)}}, 0, nil
+	}
+	if err != nil {
+		return rollupState{}, 0, fmt.Errorf("failed to read rollup: %w", err)
+	}
+	var s rollupState
+	if err := json.Unmarshal(entry.Value(), &s); err != nil {
+		return rollupState{}, 0, fmt.Errorf("failed to decode rollup: %w", err)
+	}
+	return s, entry.Revision(), nil
+}
+
+// run posts the rollups once their window is over, checking every minute,
+// or tenth of the window if shorter.
+func (d *aggregateDeliverer) run(ctx context.Context) {
+	defer close(d.done)
+	ticker := time.NewTicker(min(d.window/10, time.Minute))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := d.flush(ctx); err != nil && ctx.Err() == nil {
+			// Kept for the next tick
+			d.logger.Warn("failed to deliver rollup", "error", err)
+		}
+	}
+}
+
+// flush closes the window in progress if it is over and posts the rollups
+// waiting, oldest first.
+func (d *aggregateDeliverer) flush(ctx context.Context) error {
+	d.mu.Lock()
+	s, _, err := d.state()
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if len(s.Pending) == 0 && time.Now().Before(s.Window.Start.Add(d.window)) {
+		return nil
+	}
+	if err := d.update(func(next *rollupState) { s = *next }); err != nil {
+		return err
+	}
+
+	for _, r := range s.Pending {
+		if err := d.webhook.postRollup(ctx, r); err != nil {
+			return err
+		}
+		d.logger.Info("delivered rollup", "start", r.Start, "events", r.Events)
+		// Another replica may have delivered it too; receivers tell by the
+		// Idempotency-Key
+		err := d.update(func(next *rollupState) {
+			next.Pending = slices.DeleteFunc(next.Pending, func(p events.Rollup) bool { return !p.Start.After(r.Start) })
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// postRollup sends r as the body of a call of its own. Its Idempotency-Key
+// names the window, and X-Schema-Type tells it apart from the envelopes of
+// events.
+func (d *webhookDeliverer) postRollup(ctx context.Context, r events.Rollup) error {
+	buf := bodyBuffers.Get().(*[]byte)
+	body, err := appendJSON((*buf)[:0], r)
+	*buf = body
+	if err != nil {
+		releaseBody(buf)
+		return fmt.Errorf("failed to encode rollup: %w", err)
+	}
+	headers := map[string]string{
+		"Idempotency-Key": fmt.Sprintf("%s/rollup/%d", r.Consumer, r.Start.Unix()),
+		"X-Schema-Type":   "rollup",
+	}
+	return d.post(ctx, d.url, buf, r.Consumer, 1, r.FirstSeq, r.LastSeq, headers)
+}
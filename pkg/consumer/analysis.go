@@ -0,0 +1,21 @@
+package consumer
+
+// Analysis names an analysis of the firehose whose reports a consumer can
+// deliver instead of its frames (see Config.Analysis).
+type Analysis string
+
+const (
+	// AnalysisDuplicates reports clusters of near-duplicate posts (see
+	// events.DuplicateCluster), published by fpaas analyze --duplicates.
+	AnalysisDuplicates Analysis = "duplicates"
+	// AnalysisBursts reports DIDs creating records faster than a threshold
+	// (see events.Burst), published by fpaas analyze --bursts.
+	AnalysisBursts Analysis = "bursts"
+)
+
+// analysisFlags names the analyzer flag publishing the reports of each
+// analysis.
+var analysisFlags = map[Analysis]string{
+	AnalysisDuplicates: "--duplicates",
+	AnalysisBursts:     "--bursts",
+}
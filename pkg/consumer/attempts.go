@@ -0,0 +1,87 @@
+package consumer
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Headers of webhook calls made with Config.RedeliveryHeaders.
+const (
+	// DeliveryAttemptHeader is the highest number of times JetStream has
+	// delivered one of the call's events, 1 on a first delivery. It is left
+	// out of manual redeliveries, whose events are loaded from the stream.
+	DeliveryAttemptHeader = "X-Delivery-Attempt"
+	// RedeliveredHeader is "true" when some of the call's events were
+	// delivered before.
+	RedeliveredHeader = "X-Redelivered"
+	// RedeliveredSeqHeader lists the stream sequences of those events as
+	// ranges, e.g. "12-40,55".
+	RedeliveredSeqHeader = "X-Redelivered-Stream-Seq"
+)
+
+// maxRedeliveredSeqHeader bounds RedeliveredSeqHeader. Longer lists, left by
+// partial deliveries, are sent as the range spanning them, which holds
+// events that weren't redelivered too.
+const maxRedeliveredSeqHeader = 1024
+
+// attemptHeaders returns the RedeliveryHeaders of a call delivering msgs,
+// added to headers.
+func attemptHeaders(headers map[string]string, msgs []*nats.Msg) map[string]string {
+	var attempt uint64
+	var seqs []uint64
+	for _, msg := range msgs {
+		meta, err := msg.Metadata()
+		if err != nil {
+			// Loaded for a manual redelivery
+			if seq := streamSeq(msg); seq > 0 {
+				seqs = append(seqs, seq)
+			}
+			continue
+		}
+		attempt = max(attempt, meta.NumDelivered)
+		if meta.NumDelivered > 1 {
+			seqs = append(seqs, meta.Sequence.Stream)
+		}
+	}
+
+	out := make(map[string]string, len(headers)+3)
+	for k, v := range headers {
+		out[k] = v
+	}
+	if attempt > 0 {
+		out[DeliveryAttemptHeader] = strconv.FormatUint(attempt, 10)
+	}
+	if len(seqs) > 0 {
+		out[RedeliveredHeader] = "true"
+		out[RedeliveredSeqHeader] = seqRanges(seqs)
+	}
+	return out
+}
+
+// seqRanges formats seqs as comma separated ranges of consecutive
+// sequences.
+func seqRanges(seqs []uint64) string {
+	var b strings.Builder
+	for i := 0; i < len(seqs); {
+		j := i
+		for j+1 < len(seqs) && seqs[j+1] == seqs[j]+1 {
+			j++
+		}
+		if b.Len() > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(strconv.FormatUint(seqs[i], 10))
+		if j > i {
+			b.WriteByte('-')
+			b.WriteString(strconv.FormatUint(seqs[j], 10))
+		}
+		if b.Len() > maxRedeliveredSeqHeader {
+			return strconv.FormatUint(slices.Min(seqs), 10) + "-" + strconv.FormatUint(slices.Max(seqs), 10)
+		}
+		i = j + 1
+	}
+	return b.String()
+}
@@ -0,0 +1,348 @@
+package consumer
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/pkg/firehose"
+	"github.com/nats-io/nats.go"
+)
+
+const auditFetchSize = 1000
+
+// Audit sources, as named in AuditGap.Missing.
+const (
+	AuditDeliveryLog = "delivery log"
+	AuditReceiver    = "receiver"
+)
+
+// SeqRange is an inclusive range of stream sequences.
+type SeqRange struct {
+	First, Last uint64
+}
+
+// AuditOptions select what Audit checks.
+type AuditOptions struct {
+	// From and To bound the stream range to check. Zero From is the first
+	// event stored after the consumer's durable was created, or the stream's
+	// first without one; zero To is the durable's ack floor, or the stream's
+	// last sequence.
+	From, To uint64
+	// Received are the stream ranges of the consumer's webhook calls kept by
+	// a receiver; nil skips the receiver check.
+	Received []SeqRange
+}
+
+// AuditReport is the outcome of an Audit.
+type AuditReport struct {
+	Consumer string
+	Stream   string
+	From, To uint64
+	// Unretained counts the sequences of the range the stream no longer
+	// holds, which can't be checked.
+	Unretained uint64
+	// Events are the events of the range the stream holds; Expected are the
+	// ones the consumer's filters deliver.
+	Events, Expected int
+	// DeliveryLog is false when there is no delivery log stream.
+	DeliveryLog bool
+	// Logged counts the successful delivery attempts in the log; Covered
+	// counts the expected events each source accounts for.
+	Logged  int
+	Covered map[string]int
+	Gaps    []AuditGap
+}
+
+// Missed returns how many expected events are in gaps.
+func (r AuditReport) Missed() int {
+	n := 0
+	for _, g := range r.Gaps {
+		n += g.Events
+	}
+	return n
+}
+
+// AuditGap is a run of expected events missing from the same sources. The
+// range is at most MaxRedeliverEvents long, so one RedeliverRequest covers
+// it.
+type AuditGap struct {
+	FirstSeq, LastSeq uint64
+	Events            int
+	// FirstFirehoseSeq and LastFirehoseSeq are the relay sequences of the
+	// first and last events, to resume a relay from.
+	FirstFirehoseSeq, LastFirehoseSeq int64
+	// FirstTime and LastTime are when the stream stored them.
+	FirstTime, LastTime time.Time
+	Missing             []string
+}
+
+// coverage tells whether sequences fall in a set of ranges, for sequences
+// asked in increasing order.
+type coverage struct {
+	ranges []SeqRange // sorted and disjoint
+	next   int
+}
+
+func newCoverage(ranges []SeqRange) *coverage {
+	ranges = slices.Clone(ranges)
+	slices.SortFunc(ranges, func(a, b SeqRange) int { return cmp.Compare(a.First, b.First) })
+	// Redelivered batches overlap the first attempts
+	merged := ranges[:0]
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && r.First <= merged[n-1].Last+1 {
+			merged[n-1].Last = max(merged[n-1].Last, r.Last)
+		} else {
+			merged = append(merged, r)
+		}
+	}
+	return &coverage{ranges: merged}
+}
+
+func (c *coverage) covers(seq uint64) bool {
+	for c.next < len(c.ranges) && c.ranges[c.next].Last < seq {
+		c.next++
+	}
+	return c.next < len(c.ranges) && c.ranges[c.next].First <= seq
+}
+
+// Audit checks that every event of a stream range that cfg's filters deliver
+// was delivered at least once by the consumer cfg.Name, according to the
+// successful attempts of the delivery log and, when given, a receiver's
+// records. A delivery or a received call accounts for every event of its
+// range: batches carry their lowest and highest sequences, and filtered
+// events leave holes in them. History is limited to what the stream still
+// retains, and the delivery log only keeps a week.
+//
+// Audit reads the streams with temporary consumers and never touches the
+// position of the consumer's durable.
+func Audit(ctx context.Context, cfg Config, opts AuditOptions) (AuditReport, error) {
+	report := AuditReport{Consumer: cfg.Name, Covered: make(map[string]int)}
+
+	nc, err := nats.Connect(cfg.NATSURL, nats.Timeout(5*time.Second))
+	if err != nil {
+		return report, fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+	defer nc.Close()
+	js, err := nc.JetStream()
+	if err != nil {
+		return report, fmt.Errorf("failed to create JetStream context: %w", err)
+	}
+
+	stream, err := js.StreamNameBySubject("atproto.firehose.>")
+	if err != nil {
+		return report, fmt.Errorf("failed to find stream: %w", err)
+	}
+	si, err := js.StreamInfo(stream)
+	if err != nil {
+		return report, fmt.Errorf("failed to get stream info: %w", err)
+	}
+	report.Stream = stream
+
+	ci, err := js.ConsumerInfo(stream, cfg.Name)
+	if errors.Is(err, nats.ErrConsumerNotFound) {
+		ci = nil
+	} else if err != nil {
+		return report, fmt.Errorf("failed to get consumer info: %w", err)
+	}
+	report.From, report.To = opts.From, opts.To
+	if report.To == 0 {
+		report.To = si.State.LastSeq
+		if ci != nil {
+			report.To = ci.AckFloor.Stream
+		}
+	}
+	// Without From, the range starts with the first event stored after the
+	// durable was created, as consumers start with new events
+	startOpt := nats.StartSequence(max(report.From, si.State.FirstSeq))
+	switch {
+	case report.From > 0:
+		if report.From < si.State.FirstSeq {
+			report.Unretained = min(si.State.FirstSeq, report.To+1) - report.From
+		}
+	case ci != nil:
+		startOpt = nats.StartTime(ci.Created)
+	default:
+		report.From = si.State.FirstSeq
+	}
+	if report.From > 0 && report.To < report.From {
+		return report, fmt.Errorf("nothing to audit: seq %d is after %d", report.From, report.To)
+	}
+
+	logged, err := loggedDeliveries(js, cfg.Name)
+	switch {
+	case errors.Is(err, nats.ErrStreamNotFound):
+	case err != nil:
+		return report, err
+	default:
+		report.DeliveryLog = true
+		report.Logged = len(logged)
+	}
+	if !report.DeliveryLog && opts.Received == nil {
+		return report, errors.New("no delivery log and no receiver to check against; run the consumers with --delivery-log")
+	}
+
+	if report.To < si.State.FirstSeq || si.State.Msgs == 0 {
+		return report, nil
+	}
+
+	var sources []string
+	covers := make(map[string]*coverage)
+	if report.DeliveryLog {
+		sources = append(sources, AuditDeliveryLog)
+		covers[AuditDeliveryLog] = newCoverage(logged)
+	}
+	if opts.Received != nil {
+		sources = append(sources, AuditReceiver)
+		covers[AuditReceiver] = newCoverage(opts.Received)
+	}
+
+	subOpts := []nats.SubOpt{
+		nats.BindStream(stream),
+		startOpt,
+		nats.AckNone(),
+		nats.InactiveThreshold(time.Minute),
+	}
+	if len(cfg.Collections) == 0 && len(cfg.Redaction) == 0 && len(cfg.ExcludeLabels) == 0 {
+		// The frame type header is enough to filter on
+		subOpts = append(subOpts, nats.HeadersOnly())
+	}
+	filter := newEventFilter(cfg.FrameTypes, cfg.Collections, cfg.TombstoneStatuses)
+	redaction, err := firehose.ParseRedaction(cfg.Redaction)
+	if err != nil {
+		return report, err
+	}
+	// Labels are checked as they are now, not as they were at delivery
+	var labels *labelFilter
+	if len(cfg.ExcludeLabels) > 0 {
+		index := cfg.Labels
+		if index == nil {
+			if index, err = firehose.WatchLabels(js, slog.Default()); err != nil {
+				return report, err
+			}
+			defer index.Stop()
+		}
+		labels = newLabelFilter(index, cfg.ExcludeLabels, nil)
+	}
+
+	var gap *AuditGap
+	closeGap := func() {
+		if gap != nil {
+			report.Gaps = append(report.Gaps, *gap)
+			gap = nil
+		}
+	}
+	err = readRange(ctx, js, "atproto.firehose.>", subOpts, func(msg *nats.Msg, meta *nats.MsgMetadata) bool {
+		seq := meta.Sequence.Stream
+		if seq > report.To {
+			return false
+		}
+		if report.From == 0 {
+			report.From = seq
+		}
+		report.Events++
+		if !filter.matches(msg) {
+			return true
+		}
+		if _, ok := redaction.Apply(msg.Data); !ok {
+			// Redacted away, so acked without delivery
+			return true
+		}
+		if labels.excludes(msg) {
+			return true
+		}
+		report.Expected++
+
+		var missing []string
+		for _, name := range sources {
+			if covers[name].covers(seq) {
+				report.Covered[name]++
+			} else {
+				missing = append(missing, name)
+			}
+		}
+		if len(missing) == 0 {
+			closeGap()
+			return true
+		}
+		if gap != nil && (!slices.Equal(gap.Missing, missing) || seq-gap.FirstSeq >= MaxRedeliverEvents) {
+			closeGap()
+		}
+		firehoseSeq, _ := strconv.ParseInt(msg.Header.Get(firehose.HeaderSeq), 10, 64)
+		if gap == nil {
+			gap = &AuditGap{FirstSeq: seq, FirstFirehoseSeq: firehoseSeq, FirstTime: meta.Timestamp, Missing: missing}
+		}
+		gap.LastSeq, gap.LastFirehoseSeq, gap.LastTime = seq, firehoseSeq, meta.Timestamp
+		gap.Events++
+		return true
+	})
+	closeGap()
+	return report, err
+}
+
+// loggedDeliveries returns the ranges of the consumer's successful delivery
+// attempts, or nats.ErrStreamNotFound without a delivery log.
+func loggedDeliveries(js nats.JetStreamContext, consumerName string) ([]SeqRange, error) {
+	if _, err := js.StreamInfo(DeliveryLogStream); err != nil {
+		return nil, err
+	}
+	ranges := []SeqRange{}
+	err := readRange(context.Background(), js, DeliveryLogSubjectPrefix+consumerName, []nats.SubOpt{
+		nats.BindStream(DeliveryLogStream),
+		nats.DeliverAll(),
+		nats.AckNone(),
+		nats.InactiveThreshold(time.Minute),
+	}, func(msg *nats.Msg, _ *nats.MsgMetadata) bool {
+		var rec DeliveryRecord
+		if json.Unmarshal(msg.Data, &rec) == nil && rec.Status == DeliveryDelivered && rec.FirstSeq > 0 {
+			ranges = append(ranges, SeqRange{First: rec.FirstSeq, Last: rec.LastSeq})
+		}
+		return true
+	})
+	return ranges, err
+}
+
+// readRange calls fn with the messages of a temporary consumer until fn
+// returns false or the consumer has caught up with the stream.
+func readRange(ctx context.Context, js nats.JetStreamContext, subject string, opts []nats.SubOpt, fn func(*nats.Msg, *nats.MsgMetadata) bool) error {
+	sub, err := js.PullSubscribe(subject, "", opts...)
+	if err != nil {
+		return fmt.Errorf("failed to subscribe: %w", err)
+	}
+	defer sub.Unsubscribe()
+
+	// An empty range would only end with a fetch timeout
+	if ci, err := sub.ConsumerInfo(); err == nil && ci.NumPending == 0 {
+		return nil
+	}
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		msgs, err := fetch(ctx, sub, auditFetchSize)
+		if errors.Is(err, nats.ErrTimeout) {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			return fmt.Errorf("fetch failed: %w", err)
+		}
+		for _, msg := range msgs {
+			meta, err := msg.Metadata()
+			if err != nil {
+				return fmt.Errorf("failed to read message metadata: %w", err)
+			}
+			if !fn(msg, meta) || meta.NumPending == 0 {
+				return nil
+			}
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package consumer
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// autotuneGrowth bounds how much one step raises the batch size or
+	// shortens the poll interval, so the delivery latency of the larger
+	// batches is measured before going further.
+	autotuneGrowth = 4
+	// autotuneRelax is how much spare capacity a consumer keeps when its
+	// settings are relaxed again, so a step back doesn't leave it behind.
+	autotuneRelax = 2
+)
+
+var (
+	tunedBatchSize = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "consumer_batch_size",
+		Help: "Batch size an autotuned consumer fetches with",
+	}, []string{"consumer"})
+	tunedPollInterval = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "consumer_poll_interval_seconds",
+		Help: "Poll interval of an autotuned consumer",
+	}, []string{"consumer"})
+)
+
+func init() {
+	prometheus.MustRegister(tunedBatchSize, tunedPollInterval)
+}
+
+// AutotuneBounds are the settings Config.Autotune keeps a consumer within.
+// Zero minimum and maximum batch sizes and a zero maximum poll interval are
+// the configured BatchSize and PollInterval; the poll interval stays at
+// least a second when MinPollInterval is zero.
+type AutotuneBounds struct {
+	MinBatchSize    int
+	MaxBatchSize    int
+	MinPollInterval time.Duration
+	MaxPollInterval time.Duration
+}
+
+// resolve fills in the zero bounds from the consumer's settings.
+func (b AutotuneBounds) resolve(batchSize int, poll time.Duration) AutotuneBounds {
+	if b.MinBatchSize == 0 {
+		b.MinBatchSize = min(batchSize, max(b.MaxBatchSize, 1))
+	}
+	if b.MaxBatchSize == 0 {
+		b.MaxBatchSize = max(batchSize, b.MinBatchSize)
+	}
+	if b.MinPollInterval == 0 {
+		b.MinPollInterval = min(time.Second, poll)
+	}
+	if b.MaxPollInterval == 0 {
+		b.MaxPollInterval = max(poll, b.MinPollInterval)
+	}
+	return b
+}
+
+func (b AutotuneBounds) validate(cfg Config) error {
+	switch {
+	case b.MinBatchSize < 0 || b.MaxBatchSize < 0 || b.MinPollInterval < 0 || b.MaxPollInterval < 0:
+		return fmt.Errorf("autotune bounds must not be negative")
+	case b.MaxBatchSize > 0 && b.MinBatchSize > b.MaxBatchSize:
+		return fmt.Errorf("autotune min batch size %d is above the max %d", b.MinBatchSize, b.MaxBatchSize)
+	case b.MaxPollInterval > 0 && b.MinPollInterval > b.MaxPollInterval:
+		return fmt.Errorf("autotune min poll interval %s is above the max %s", b.MinPollInterval, b.MaxPollInterval)
+	case cfg.InactiveThreshold > 0 && cfg.InactiveThreshold < 2*b.MaxPollInterval:
+		return fmt.Errorf("inactive threshold must be at least twice the autotune max poll interval, got %s", cfg.InactiveThreshold)
+	}
+	return nil
+}
+
+// autotuner adjusts a consumer's batch size and poll interval. It measures
+// the current settings with the recommendations of Recommend: while the
+// consumer falls behind, it grows the batch and then shortens the poll
+// interval, and once the consumer caught up with capacity to spare it
+// lengthens the interval and then shrinks the batch back, towards the
+// cheapest settings that keep up.
+type autotuner struct {
+	consumer string
+	logger   *slog.Logger
+	bounds   AutotuneBounds
+	// bound is set while only more consumers or concurrent calls would help,
+	// which is logged once
+	bound bool
+
+	mu        sync.Mutex
+	batchSize int
+	poll      time.Duration
+	// since is when the settings last changed
+	since time.Time
+}
+
+func newAutotuner(consumer string, bounds AutotuneBounds, batchSize int, poll time.Duration, logger *slog.Logger) *autotuner {
+	b := bounds.resolve(batchSize, poll)
+	t := &autotuner{
+		consumer:  consumer,
+		logger:    logger,
+		bounds:    b,
+		batchSize: min(max(batchSize, b.MinBatchSize), b.MaxBatchSize),
+		poll:      min(max(poll, b.MinPollInterval), b.MaxPollInterval),
+		since:     time.Now(),
+	}
+	t.observe()
+	return t
+}
+
+func (t *autotuner) settings() (int, time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.batchSize, t.poll
+}
+
+// measured keeps the samples fetched with the current settings.
+func (t *autotuner) measured(samples []fetchSample) []fetchSample {
+	t.mu.Lock()
+	since := t.since
+	t.mu.Unlock()
+	for i, s := range samples {
+		if !s.at.Before(since) {
+			return samples[i:]
+		}
+	}
+	return nil
+}
+
+// restart discards the measurements of the current settings, e.g. those of
+// failing deliveries.
+func (t *autotuner) restart() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.since = time.Now()
+}
+
+// adjust changes the settings, once the current ones were measured long
+// enough.
+func (t *autotuner) adjust(s tuningSettings, samples []fetchSample) {
+	r := recommend(s, t.measured(samples))
+	batch, poll, reason := t.next(r, s)
+	if batch == s.batchSize && poll == s.poll {
+		return
+	}
+
+	t.mu.Lock()
+	t.batchSize, t.poll, t.since = batch, poll, time.Now()
+	t.mu.Unlock()
+	t.observe()
+	t.logger.Info("autotuned consumer",
+		"consumer", t.consumer,
+		"batch_size", batch,
+		"poll_interval", poll,
+		"previous_batch_size", s.batchSize,
+		"previous_poll_interval", s.poll,
+		"reason", reason,
+	)
+}
+
+// next returns the settings following r.
+func (t *autotuner) next(r TuningReport, s tuningSettings) (int, time.Duration, string) {
+	b := t.bounds
+	switch {
+	case r.Status == TuningBehind:
+		for _, rec := range r.Recommendations {
+			if rec.Setting == "partition" || rec.Setting == "delivery-concurrency" {
+				if !t.bound {
+					t.bound = true
+					t.logger.Warn("autotuned consumer can't keep up", "consumer", t.consumer, "recommended", rec.Setting, "value", rec.Recommended, "reason", rec.Reason)
+				}
+				return s.batchSize, s.poll, ""
+			}
+		}
+		t.bound = false
+		target := neededRate(r)
+		reason := fmt.Sprintf("%d pending, %.0f/s needed of %.0f/s capacity", r.Pending, target, r.Capacity)
+		if s.batchSize < b.MaxBatchSize {
+			batch := min(max(niceCeil(target*s.poll.Seconds()), s.batchSize+1), s.batchSize*autotuneGrowth, b.MaxBatchSize)
+			return batch, s.poll, reason
+		}
+		if s.poll > b.MinPollInterval {
+			poll := time.Duration(float64(s.batchSize) / target * float64(time.Second))
+			poll = min(max(poll.Round(time.Millisecond), s.poll/autotuneGrowth, b.MinPollInterval), s.poll)
+			return s.batchSize, poll, reason
+		}
+	case r.Status == TuningOK && r.Pending <= uint64(s.batchSize):
+		t.bound = false
+		spare := r.Inflow * tuningHeadroom * autotuneRelax
+		reason := fmt.Sprintf("caught up, %.0f/s needed of %.0f/s capacity", r.Inflow*tuningHeadroom, r.Capacity)
+		// Whole steps, so the settings don't drift with the inflow
+		if poll := min(s.poll*autotuneRelax, b.MaxPollInterval); poll > s.poll && float64(s.batchSize) >= spare*poll.Seconds() && r.CycleSeconds < poll.Seconds() {
+			return s.batchSize, poll, reason
+		}
+		if batch := max(s.batchSize/autotuneRelax, b.MinBatchSize); batch < s.batchSize && float64(batch) >= spare*s.poll.Seconds() {
+			return batch, s.poll, reason
+		}
+	}
+	return s.batchSize, s.poll, ""
+}
+
+// settings returns the batch size and poll interval the consumer fetches
+// with.
+func (c *PullConsumer) settings() (int, time.Duration) {
+	if c.tuner == nil {
+		return c.batchSize, c.jitteredPoll
+	}
+	return c.tuner.settings()
+}
+
+// autotune adjusts the settings after a fetch with batchSize every poll,
+// resetting ticker to a new poll interval, and returns those of the next
+// fetch.
+func (c *PullConsumer) autotune(ticker *time.Ticker, batchSize int, poll time.Duration) (int, time.Duration) {
+	if c.tuner == nil {
+		return batchSize, poll
+	}
+	if c.Status().ConsecutiveFailures > 0 {
+		// The backlog is the failures', which no setting clears
+		c.tuner.restart()
+		return batchSize, poll
+	}
+	c.tuner.adjust(tuningSettings{batchSize: batchSize, poll: poll, granularity: c.granularity, concurrency: c.deliveryConcurrency}, c.fetches.snapshot())
+	next, tuned := c.tuner.settings()
+	if tuned != poll {
+		ticker.Reset(tuned)
+	}
+	return next, tuned
+}
+
+func (t *autotuner) observe() {
+	batch, poll := t.settings()
+	tunedBatchSize.WithLabelValues(t.consumer).Set(float64(batch))
+	tunedPollInterval.WithLabelValues(t.consumer).Set(poll.Seconds())
+}
+
+func (t *autotuner) stop() {
+	tunedBatchSize.DeleteLabelValues(t.consumer)
+	tunedPollInterval.DeleteLabelValues(t.consumer)
+}
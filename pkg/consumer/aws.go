@@ -0,0 +1,257 @@
+package consumer
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	snstypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// awsMaxBatchEntries and awsMaxBatchBytes are the SendMessageBatch /
+	// PublishBatch limits shared by SQS and SNS.
+	awsMaxBatchEntries = 10
+	awsMaxBatchBytes   = 256 * 1024
+
+	awsRequestTimeout = 10 * time.Second
+)
+
+// expandConsumerName substitutes {consumer} in a target address so every
+// consumer instance can be pointed at its own queue or topic.
+func expandConsumerName(s, consumer string) string {
+	return strings.ReplaceAll(s, "{consumer}", consumer)
+}
+
+// awsMessage is one event prepared for SQS/SNS. Both services only accept
+// text bodies, so binary payload formats are base64 encoded.
+type awsMessage struct {
+	// index is the position of the event in the batch delivered
+	index      int
+	body       string
+	attributes map[string]string
+}
+
+func (m awsMessage) size() int {
+	n := len(m.body)
+	for k, v := range m.attributes {
+		// Attribute names, values and data types all count towards the limit
+		n += len(k) + len(v) + len("String")
+	}
+	return n
+}
+
+func newAWSMessages(consumer string, msgs []*nats.Msg, encoder payloadEncoder) ([]awsMessage, error) {
+	out := make([]awsMessage, 0, len(msgs))
+	for i, msg := range msgs {
+		body, err := encoder.encodeEvent(nil, consumer, msg.Data, annotationsOf(msg))
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode payload: %w", err)
+		}
+
+		attrs := map[string]string{
+			"content-type":   encoder.contentType(),
+			"consumer":       consumer,
+			"schema-version": PayloadSchemaVersion,
+		}
+		for k, v := range encoder.headers(false) {
+			attrs[strings.ToLower(k)] = v
+		}
+
+		m := awsMessage{index: i, attributes: attrs}
+		if encoder.contentType() == "application/json" {
+			m.body = string(body)
+		} else {
+			m.body = base64.StdEncoding.EncodeToString(body)
+			attrs["content-encoding"] = "base64"
+		}
+
+		if m.size() > awsMaxBatchBytes {
+			return nil, fmt.Errorf("event of %d bytes exceeds the %d byte message limit", m.size(), awsMaxBatchBytes)
+		}
+		out = append(out, m)
+	}
+	return out, nil
+}
+
+// splitAWSBatches groups messages into request batches that respect both the
+// entry count and the total payload size limits.
+func splitAWSBatches(msgs []awsMessage) [][]awsMessage {
+	var batches [][]awsMessage
+	var current []awsMessage
+	size := 0
+
+	for _, m := range msgs {
+		if len(current) == awsMaxBatchEntries || (len(current) > 0 && size+m.size() > awsMaxBatchBytes) {
+			batches = append(batches, current)
+			current, size = nil, 0
+		}
+		current = append(current, m)
+		size += m.size()
+	}
+	if len(current) > 0 {
+		batches = append(batches, current)
+	}
+	return batches
+}
+
+type sqsDeliverer struct {
+	queueURL string
+	encoder  payloadEncoder
+	client   *sqs.Client
+}
+
+func newSQSDeliverer(queueURL string, encoder payloadEncoder) (*sqsDeliverer, error) {
+	if queueURL == "" {
+		return nil, fmt.Errorf("sqs target requires a queue URL")
+	}
+
+	// Standard AWS credential chain (env, shared config, IAM role, ...)
+	awsCfg, err := awsconfig.LoadDefaultConfig(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+
+	return &sqsDeliverer{
+		queueURL: queueURL,
+		encoder:  encoder,
+		client:   sqs.NewFromConfig(awsCfg),
+	}, nil
+}
+
+func (d *sqsDeliverer) DeliverBatch(ctx context.Context, consumer string, msgs []*nats.Msg) error {
+	prepared, err := newAWSMessages(consumer, msgs, d.encoder)
+	if err != nil {
+		return err
+	}
+
+	// Events of the requests sent, and the entries SQS took of the last
+	var accepted []int
+	for _, batch := range splitAWSBatches(prepared) {
+		entries := make([]sqstypes.SendMessageBatchRequestEntry, len(batch))
+		for i, m := range batch {
+			attrs := make(map[string]sqstypes.MessageAttributeValue, len(m.attributes))
+			for k, v := range m.attributes {
+				attrs[k] = sqstypes.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(v)}
+			}
+			entries[i] = sqstypes.SendMessageBatchRequestEntry{
+				Id:                aws.String(strconv.Itoa(i)),
+				MessageBody:       aws.String(m.body),
+				MessageAttributes: attrs,
+			}
+		}
+
+		sendCtx, cancel := context.WithTimeout(ctx, awsRequestTimeout)
+		out, err := d.client.SendMessageBatch(sendCtx, &sqs.SendMessageBatchInput{
+			QueueUrl: aws.String(d.queueURL),
+			Entries:  entries,
+		})
+		cancel()
+		if err != nil {
+			return partialDelivery(accepted, fmt.Errorf("failed to send SQS batch: %w", err))
+		}
+		failed := make(map[string]bool, len(out.Failed))
+		for _, f := range out.Failed {
+			failed[aws.ToString(f.Id)] = true
+		}
+		for i, m := range batch {
+			if !failed[strconv.Itoa(i)] {
+				accepted = append(accepted, m.index)
+			}
+		}
+		if len(out.Failed) > 0 {
+			return partialDelivery(accepted, fmt.Errorf("SQS rejected %d of %d messages: %s", len(out.Failed), len(entries), aws.ToString(out.Failed[0].Message)))
+		}
+	}
+
+	return nil
+}
+
+func (d *sqsDeliverer) DeliverEvent(ctx context.Context, consumer string, msg *nats.Msg) error {
+	return d.DeliverBatch(ctx, consumer, []*nats.Msg{msg})
+}
+
+type snsDeliverer struct {
+	topicARN string
+	encoder  payloadEncoder
+	client   *sns.Client
+}
+
+func newSNSDeliverer(topicARN string, encoder payloadEncoder) (*snsDeliverer, error) {
+	if topicARN == "" {
+		return nil, fmt.Errorf("sns target requires a topic ARN")
+	}
+
+	// Standard AWS credential chain (env, shared config, IAM role, ...)
+	awsCfg, err := awsconfig.LoadDefaultConfig(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+
+	return &snsDeliverer{
+		topicARN: topicARN,
+		encoder:  encoder,
+		client:   sns.NewFromConfig(awsCfg),
+	}, nil
+}
+
+func (d *snsDeliverer) DeliverBatch(ctx context.Context, consumer string, msgs []*nats.Msg) error {
+	prepared, err := newAWSMessages(consumer, msgs, d.encoder)
+	if err != nil {
+		return err
+	}
+
+	// Events of the requests sent, and the entries SNS took of the last
+	var accepted []int
+	for _, batch := range splitAWSBatches(prepared) {
+		entries := make([]snstypes.PublishBatchRequestEntry, len(batch))
+		for i, m := range batch {
+			attrs := make(map[string]snstypes.MessageAttributeValue, len(m.attributes))
+			for k, v := range m.attributes {
+				attrs[k] = snstypes.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(v)}
+			}
+			entries[i] = snstypes.PublishBatchRequestEntry{
+				Id:                aws.String(strconv.Itoa(i)),
+				Message:           aws.String(m.body),
+				MessageAttributes: attrs,
+			}
+		}
+
+		publishCtx, cancel := context.WithTimeout(ctx, awsRequestTimeout)
+		out, err := d.client.PublishBatch(publishCtx, &sns.PublishBatchInput{
+			TopicArn:                   aws.String(d.topicARN),
+			PublishBatchRequestEntries: entries,
+		})
+		cancel()
+		if err != nil {
+			return partialDelivery(accepted, fmt.Errorf("failed to publish SNS batch: %w", err))
+		}
+		failed := make(map[string]bool, len(out.Failed))
+		for _, f := range out.Failed {
+			failed[aws.ToString(f.Id)] = true
+		}
+		for i, m := range batch {
+			if !failed[strconv.Itoa(i)] {
+				accepted = append(accepted, m.index)
+			}
+		}
+		if len(out.Failed) > 0 {
+			return partialDelivery(accepted, fmt.Errorf("SNS rejected %d of %d messages: %s", len(out.Failed), len(entries), aws.ToString(out.Failed[0].Message)))
+		}
+	}
+
+	return nil
+}
+
+func (d *snsDeliverer) DeliverEvent(ctx context.Context, consumer string, msg *nats.Msg) error {
+	return d.DeliverBatch(ctx, consumer, []*nats.Msg{msg})
+}
@@ -0,0 +1,69 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// BackfillHeader marks webhook calls made by Backfill.
+const BackfillHeader = "X-Backfill"
+
+const backfillMaxAttempts = 5
+
+// Backfill re-delivers the events stored in the stream from from until to
+// through cfg's pipeline, as Replay does, with webhook calls carrying
+// X-Backfill: true. A zero to is now. The LastTime of the progress returned
+// is the from time to resume an interrupted backfill at.
+func Backfill(ctx context.Context, cfg Config, from, to time.Time, logger *slog.Logger) (ReplayProgress, error) {
+	if to.IsZero() {
+		to = time.Now()
+	}
+	if !from.Before(to) {
+		return ReplayProgress{}, fmt.Errorf("backfill window is empty: from %s is not before to %s", from, to)
+	}
+
+	if cfg.Target == "" || cfg.Target == TargetWebhook {
+		headers := map[string]string{BackfillHeader: "true"}
+		for k, v := range cfg.WebhookHeaders {
+			headers[k] = v
+		}
+		cfg.WebhookHeaders = headers
+	}
+	return Replay(ctx, cfg, "", ReplayWindow{From: from, To: to}, nil, logger)
+}
+
+// retryBatch delivers msgs as a batch with retryDelivery. After a partial
+// delivery, only the events not delivered are tried again.
+func retryBatch(ctx context.Context, deliverer Deliverer, name string, msgs []*nats.Msg) error {
+	return retryDelivery(ctx, func() error {
+		err := deliverer.DeliverBatch(ctx, name, msgs)
+		_, msgs = splitAccepted(msgs, err)
+		return err
+	})
+}
+
+// retryDelivery calls deliver until it succeeds, up to backfillMaxAttempts
+// times with exponential backoff.
+func retryDelivery(ctx context.Context, deliver func() error) error {
+	backoff := time.Second
+	var err error
+	for attempt := 1; attempt <= backfillMaxAttempts; attempt++ {
+		if err = deliver(); err == nil {
+			return nil
+		}
+		if attempt == backfillMaxAttempts {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+	return err
+}
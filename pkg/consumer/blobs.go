@@ -0,0 +1,454 @@
+package consumer
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/eurosky/firehose-processor-aas/pkg/events"
+	"github.com/eurosky/firehose-processor-aas/pkg/firehose"
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/ipfs/go-cid"
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// BlobBucket is the object store the blobs consumers fetch are copied
+	// to (see Config.FetchBlobs), named by CID.
+	BlobBucket = "fpaas_blobs"
+	// BlobRetention is how long BlobBucket keeps a blob, and so the longest
+	// a blob URL may be valid.
+	BlobRetention = 24 * time.Hour
+
+	// DefaultBlobMaxSize and DefaultBlobURLTTL are the largest blob fetched
+	// and how long its URL is valid, when left unset.
+	DefaultBlobMaxSize = 5 << 20
+	DefaultBlobURLTTL  = time.Hour
+
+	// blobFetchBudget bounds the time a batch waits on PDSes; the blobs not
+	// in by then are delivered without a URL.
+	blobFetchBudget = 20 * time.Second
+	// blobFetchConcurrency is how many blobs a consumer fetches at once.
+	blobFetchConcurrency = 4
+	// blobCacheSize is how many CIDs a consumer remembers BlobBucket has,
+	// saving a lookup for blobs referenced again.
+	blobCacheSize = 10000
+
+	// headerBlobs carries, on the messages a consumer annotates, the JSON
+	// object of the blob references of their records. It is set after the
+	// fetch, never in the stream.
+	headerBlobs = "Fpaas-Blobs"
+)
+
+var blobFetches = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "consumer_blobs_total",
+	Help: "Blobs consumers fetching blobs handled, by result (stored, fetched, too_large, over_quota, failed)",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(blobFetches)
+}
+
+// EnsureBlobBucket opens BlobBucket, creating it if it doesn't exist.
+func EnsureBlobBucket(js nats.JetStreamContext) (nats.ObjectStore, error) {
+	store, err := js.ObjectStore(BlobBucket)
+	if !errors.Is(err, nats.ErrStreamNotFound) && !errors.Is(err, nats.ErrBucketNotFound) {
+		return store, err
+	}
+	store, err = js.CreateObjectStore(&nats.ObjectStoreConfig{
+		Bucket:      BlobBucket,
+		Description: "Blobs fetched by fpaas consumers",
+		TTL:         BlobRetention,
+		Storage:     nats.FileStorage,
+	})
+	if errors.Is(err, nats.ErrStreamNameAlreadyInUse) {
+		return js.ObjectStore(BlobBucket)
+	}
+	return store, err
+}
+
+// blobEnricher annotates the records a consumer delivers with the blobs
+// they reference, fetching those it may into BlobBucket.
+type blobEnricher struct {
+	logger *slog.Logger
+	// store is nil when the consumer only extracts references
+	store     nats.ObjectStore
+	baseURL   string
+	secret    []byte
+	maxSize   int64
+	urlTTL    time.Duration
+	quota     *QuotaTracker
+	directory identity.Directory
+	client    *http.Client
+	// stored are when the CIDs known to be in store were put there
+	stored *lru.Cache[string, time.Time]
+}
+
+// newBlobEnricher returns the enricher of cfg, nil when it extracts no
+// blob references, opening BlobBucket when it fetches blobs.
+func newBlobEnricher(js nats.JetStreamContext, cfg Config, logger *slog.Logger) (*blobEnricher, error) {
+	if !cfg.Blobs && !cfg.FetchBlobs {
+		return nil, nil
+	}
+	e := &blobEnricher{logger: logger}
+	if !cfg.FetchBlobs {
+		return e, nil
+	}
+	store, err := EnsureBlobBucket(js)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open blob bucket: %w", err)
+	}
+	e.store = store
+	e.baseURL = strings.TrimSuffix(cfg.BlobBaseURL, "/")
+	e.secret = []byte(cfg.BlobURLSecret)
+	e.maxSize = cfg.BlobMaxSize
+	if e.maxSize == 0 {
+		e.maxSize = DefaultBlobMaxSize
+	}
+	e.urlTTL = cfg.BlobURLTTL
+	if e.urlTTL == 0 {
+		e.urlTTL = DefaultBlobURLTTL
+	}
+	e.quota = cfg.Quota
+	e.directory = handles()
+	e.client = &http.Client{Timeout: blobFetchBudget}
+	// Only fails on a size under 1
+	e.stored, _ = lru.New[string, time.Time](blobCacheSize)
+	return e, nil
+}
+
+// blobOwner is a blob to fetch and the DID whose PDS has it.
+type blobOwner struct {
+	did, cid string
+}
+
+// annotate returns msgs with those whose records reference blobs replaced
+// by annotated copies. Fetching blobs is best effort: the references of
+// those it skipped or failed to fetch are delivered without a URL. It is
+// safe to call on a nil enricher.
+func (e *blobEnricher) annotate(ctx context.Context, msgs []*nats.Msg) []*nats.Msg {
+	if e == nil {
+		return msgs
+	}
+	blobs := make([]map[string][]events.BlobRef, len(msgs))
+	owned := make(map[blobOwner]events.BlobRef)
+	for i, msg := range msgs {
+		var did string
+		did, blobs[i] = messageBlobRefs(msg.Data)
+		for _, refs := range blobs[i] {
+			for _, ref := range refs {
+				owned[blobOwner{did: did, cid: ref.CID}] = ref
+			}
+		}
+	}
+	if len(owned) == 0 {
+		return msgs
+	}
+	if e.store != nil {
+		urls := e.fetch(ctx, owned)
+		for _, refs := range blobs {
+			for _, list := range refs {
+				for j := range list {
+					list[j].URL = urls[list[j].CID]
+				}
+			}
+		}
+	}
+
+	annotated := slices.Clone(msgs)
+	for i, refs := range blobs {
+		if refs == nil {
+			continue
+		}
+		data, _ := json.Marshal(refs)
+		msg := *msgs[i]
+		msg.Header = maps.Clone(msgs[i].Header)
+		if msg.Header == nil {
+			msg.Header = nats.Header{}
+		}
+		msg.Header.Set(headerBlobs, string(data))
+		annotated[i] = &msg
+	}
+	return annotated
+}
+
+// fetch copies the blobs to the store, blobFetchConcurrency at a time, and
+// returns the URLs of those it has, by CID.
+func (e *blobEnricher) fetch(ctx context.Context, blobs map[blobOwner]events.BlobRef) map[string]string {
+	ctx, cancel := context.WithTimeout(ctx, blobFetchBudget)
+	defer cancel()
+	var (
+		mu   sync.Mutex
+		urls = make(map[string]string, len(blobs))
+		wg   sync.WaitGroup
+		sem  = make(chan struct{}, blobFetchConcurrency)
+	)
+	for blob, ref := range blobs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			result, err := e.ensure(ctx, blob, ref)
+			blobFetches.WithLabelValues(result).Inc()
+			switch {
+			case err != nil:
+				e.logger.Warn("failed to fetch blob, delivering its reference without a URL", "did", blob.did, "cid", blob.cid, "error", err)
+			case result == "stored" || result == "fetched":
+				mu.Lock()
+				urls[blob.cid] = BlobURL(e.baseURL, string(e.secret), blob.cid, time.Now().Add(e.urlTTL))
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return urls
+}
+
+// ensure copies a blob to the store unless it is there already, and
+// returns the result to count it under. A copy expiring before the URL
+// would is fetched again.
+func (e *blobEnricher) ensure(ctx context.Context, blob blobOwner, ref events.BlobRef) (string, error) {
+	fresh := func(put time.Time) bool {
+		return time.Since(put)+e.urlTTL < BlobRetention
+	}
+	if put, ok := e.stored.Get(blob.cid); ok && fresh(put) {
+		return "stored", nil
+	}
+	info, err := e.store.GetInfo(blob.cid, nats.Context(ctx))
+	switch {
+	case err == nil && fresh(info.ModTime):
+		e.stored.Add(blob.cid, info.ModTime)
+		return "stored", nil
+	case err != nil && !errors.Is(err, nats.ErrObjectNotFound):
+		return "failed", fmt.Errorf("failed to look up blob: %w", err)
+	}
+	if ref.Size > e.maxSize {
+		return "too_large", nil
+	}
+	if !e.quota.reserveBlob(ref.Size) {
+		return "over_quota", nil
+	}
+	data, mimeType, err := e.download(ctx, blob)
+	if err != nil {
+		return "failed", err
+	}
+	if mimeType == "" || mimeType == "application/octet-stream" {
+		mimeType = ref.MimeType
+	}
+	meta := &nats.ObjectMeta{Name: blob.cid, Headers: nats.Header{"Content-Type": []string{mimeType}}}
+	if _, err := e.store.Put(meta, bytes.NewReader(data), nats.Context(ctx)); err != nil {
+		return "failed", fmt.Errorf("failed to store blob: %w", err)
+	}
+	e.stored.Add(blob.cid, time.Now())
+	return "fetched", nil
+}
+
+// download fetches a blob from its owner's PDS with
+// com.atproto.sync.getBlob, checking it hashes to its CID.
+func (e *blobEnricher) download(ctx context.Context, blob blobOwner) ([]byte, string, error) {
+	did, err := syntax.ParseDID(blob.did)
+	if err != nil {
+		return nil, "", err
+	}
+	c, err := cid.Decode(blob.cid)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid blob CID: %w", err)
+	}
+	ident, err := e.directory.LookupDID(ctx, did)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to resolve DID: %w", err)
+	}
+	pds := ident.PDSEndpoint()
+	if pds == "" {
+		return nil, "", errors.New("DID document names no PDS")
+	}
+	query := url.Values{"did": {blob.did}, "cid": {blob.cid}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(pds, "/")+"/xrpc/com.atproto.sync.getBlob?"+query.Encode(), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		answer, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, "", fmt.Errorf("PDS returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(answer)))
+	}
+	// A PDS may serve more than the record declared
+	data, err := io.ReadAll(io.LimitReader(resp.Body, e.maxSize+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(len(data)) > e.maxSize {
+		return nil, "", fmt.Errorf("blob is larger than %d bytes", e.maxSize)
+	}
+	sum, err := c.Prefix().Sum(data)
+	if err != nil || !sum.Equals(c) {
+		return nil, "", errors.New("blob doesn't match its CID")
+	}
+	return data, resp.Header.Get("Content-Type"), nil
+}
+
+// BlobURL returns the URL of a blob of BlobBucket under baseURL, as
+// BlobHandler serves it. With a secret, the URL is signed and valid until
+// expires.
+func BlobURL(baseURL, secret, cid string, expires time.Time) string {
+	u := strings.TrimSuffix(baseURL, "/") + "/blobs/" + cid
+	if secret == "" {
+		return u
+	}
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return u + "?expires=" + exp + "&sig=" + blobSignature(secret, cid, exp)
+}
+
+func blobSignature(secret, cid, expires string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(cid + "." + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// BlobHandler serves the blobs of store at GET /blobs/{cid}, checking the
+// signature and expiry of their URL when secret is set (see BlobURL).
+func BlobHandler(store nats.ObjectStore, secret string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("cid")
+		if secret != "" {
+			exp := r.URL.Query().Get("expires")
+			expires, err := strconv.ParseInt(exp, 10, 64)
+			sig := r.URL.Query().Get("sig")
+			if err != nil || !hmac.Equal([]byte(sig), []byte(blobSignature(secret, name, exp))) {
+				http.Error(w, "invalid signature", http.StatusForbidden)
+				return
+			}
+			if time.Now().Unix() > expires {
+				http.Error(w, "URL expired", http.StatusForbidden)
+				return
+			}
+		}
+		obj, err := store.Get(name, nats.Context(r.Context()))
+		if errors.Is(err, nats.ErrObjectNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer obj.Close()
+		info, err := obj.Info()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		if mimeType := info.Headers.Get("Content-Type"); mimeType != "" {
+			w.Header().Set("Content-Type", mimeType)
+		}
+		w.Header().Set("Content-Length", strconv.FormatUint(info.Size, 10))
+		// Named by CID, a blob never changes
+		w.Header().Set("Cache-Control", "public, max-age=86400, immutable")
+		io.Copy(w, obj)
+	})
+}
+
+// messageBlobRefs returns the DID of a commit and the blobs its records
+// reference, by the records' at:// URIs, or nil when they reference none.
+func messageBlobRefs(data []byte) (string, map[string][]events.BlobRef) {
+	evt, err := firehose.DecodeFrame(data)
+	if err != nil {
+		return "", nil
+	}
+	var blobs map[string][]events.BlobRef
+	for _, op := range evt.Ops {
+		if op.Record == nil {
+			continue
+		}
+		var record any
+		if json.Unmarshal(op.Record, &record) != nil {
+			continue
+		}
+		var refs []events.BlobRef
+		walkBlobs(record, "", &refs)
+		if refs == nil {
+			continue
+		}
+		if blobs == nil {
+			blobs = make(map[string][]events.BlobRef)
+		}
+		blobs["at://"+evt.DID+"/"+op.Collection+"/"+op.Rkey] = refs
+	}
+	return evt.DID, blobs
+}
+
+// walkBlobs appends the blobs found in v, at path, to refs.
+func walkBlobs(v any, path string, refs *[]events.BlobRef) {
+	switch v := v.(type) {
+	case map[string]any:
+		if v["$type"] == "blob" {
+			ref, _ := v["ref"].(map[string]any)
+			link, _ := ref["$link"].(string)
+			if link == "" {
+				return
+			}
+			mimeType, _ := v["mimeType"].(string)
+			size, _ := v["size"].(float64)
+			*refs = append(*refs, events.BlobRef{CID: link, MimeType: mimeType, Size: int64(size), Path: path})
+			return
+		}
+		// Sorted, so refs come in the same order every time
+		for _, key := range slices.Sorted(maps.Keys(v)) {
+			walkBlobs(v[key], joinPath(path, key), refs)
+		}
+	case []any:
+		for i, item := range v {
+			walkBlobs(item, joinPath(path, strconv.Itoa(i)), refs)
+		}
+	}
+}
+
+func joinPath(path, field string) string {
+	if path == "" {
+		return field
+	}
+	return path + "." + field
+}
+
+// MessageBlobs merges the blob references of msgs (see Config.Blobs), nil
+// when there are none. Custom Deliverers read them with it.
+func MessageBlobs(msgs ...*nats.Msg) map[string][]events.BlobRef {
+	var blobs map[string][]events.BlobRef
+	for _, msg := range msgs {
+		h := msg.Header.Get(headerBlobs)
+		if h == "" {
+			continue
+		}
+		var m map[string][]events.BlobRef
+		if json.Unmarshal([]byte(h), &m) != nil {
+			continue
+		}
+		if blobs == nil {
+			blobs = make(map[string][]events.BlobRef, len(m))
+		}
+		maps.Copy(blobs, m)
+	}
+	return blobs
+}
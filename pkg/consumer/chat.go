@@ -0,0 +1,338 @@
+package consumer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+	"unicode/utf8"
+
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/eurosky/firehose-processor-aas/pkg/firehose"
+	"github.com/nats-io/nats.go"
+	"golang.org/x/time/rate"
+)
+
+// DefaultChatTemplate renders commits as e.g. "@alice.bsky.social created
+// app.bsky.feed.post: hello" and other frames as their type and account.
+const DefaultChatTemplate = `{{if .Action}}@{{handle .DID}} {{.Action}}d {{.Collection}}{{with .Text}}: {{truncate 300 .}}{{end}}{{else}}{{.Type}} from @{{handle .DID}}{{end}}`
+
+// DefaultChatRate is how many messages per second the slack and discord
+// targets post when Config.ChatRate is zero, within what both allow an
+// incoming webhook.
+const DefaultChatRate = 1.0
+
+// chatBatchBudget bounds the time spent on a batch, well within the 30s
+// JetStream waits for its acks; the messages left are redelivered.
+const chatBatchBudget = 20 * time.Second
+
+// discordContentLimit is the longest message content Discord accepts.
+const discordContentLimit = 2000
+
+// ChatEvent is what the template of a slack or discord consumer renders:
+// each op of a commit in the consumer's Collections, or a frame of another
+// type. A template rendering
+// nothing but spaces skips the event, one rendering a JSON object is posted
+// as is, e.g. with Slack blocks or Discord embeds.
+//
+// Besides the text/template builtins, templates can call handle, which
+// resolves a DID to its handle (the DID itself when that fails), truncate,
+// which cuts a string to at most n characters, link, which returns the
+// bsky.app URL of a post or profile, and json, which quotes a value for
+// templates rendering JSON.
+type ChatEvent struct {
+	Consumer string
+	Seq      int64
+	// Type is the frame type, e.g. #commit or #identity.
+	Type string
+	DID  string
+	Time string
+	// Action (create, update or delete), Collection, Rkey and URI (at://...)
+	// name the op of a commit.
+	Action     string
+	Collection string
+	Rkey       string
+	URI        string
+	// Text is the record's text field, escaped so it can't mention people
+	// or channels. Values read from Record aren't escaped.
+	Text string
+	// Record is the op's record, nil for deletes, and Body the other frames.
+	Record map[string]any
+	Body   map[string]any
+}
+
+// handles resolves the DIDs of chat templates, shared by all consumers so
+// their lookups are cached once.
+var handles = sync.OnceValue(identity.DefaultDirectory)
+
+// chatDeliverer posts events, rendered through a template, as messages to
+// a Slack or Discord incoming webhook.
+type chatDeliverer struct {
+	target Target
+	url    string
+	tmpl   *template.Template
+	// collections, when set, leaves out the ops of other collections than
+	// the consumer's filter
+	collections *eventFilter
+	limiter     *rate.Limiter
+	timeout     time.Duration
+	httpClient  *http.Client
+}
+
+func newChatDeliverer(target Target, url, text string, perSecond float64, collections []string, timeout time.Duration, httpOpts HTTPOptions) (*chatDeliverer, error) {
+	if url == "" {
+		return nil, fmt.Errorf("%s target requires an incoming webhook URL", target)
+	}
+	tmpl, err := parseChatTemplate(text)
+	if err != nil {
+		return nil, err
+	}
+	if perSecond == 0 {
+		perSecond = DefaultChatRate
+	}
+	if timeout == 0 {
+		timeout = DefaultWebhookTimeout
+	}
+	return &chatDeliverer{
+		target:      target,
+		url:         url,
+		tmpl:        tmpl,
+		collections: newEventFilter(nil, collections, nil),
+		limiter:     rate.NewLimiter(rate.Limit(perSecond), max(1, int(perSecond))),
+		timeout:     timeout,
+		httpClient:  &http.Client{Transport: sharedTransport(httpOpts)},
+	}, nil
+}
+
+// parseChatTemplate parses text, DefaultChatTemplate when empty.
+func parseChatTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		text = DefaultChatTemplate
+	}
+	tmpl, err := template.New("chat").Funcs(template.FuncMap{
+		"handle":   resolveHandle,
+		"truncate": truncate,
+		"link":     bskyLink,
+		"json":     jsonString,
+	}).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid chat template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// DeliverBatch posts the messages of msgs in order until one fails or the
+// batch took chatBatchBudget; those posted in full are accepted.
+func (d *chatDeliverer) DeliverBatch(ctx context.Context, consumer string, msgs []*nats.Msg) error {
+	ctx, cancel := context.WithTimeout(ctx, chatBatchBudget)
+	defer cancel()
+
+	var accepted []int
+	for i, msg := range msgs {
+		if err := d.deliver(ctx, consumer, msg); err != nil {
+			if len(accepted) == 0 {
+				return err
+			}
+			return &PartialDeliveryError{Accepted: accepted, Err: err}
+		}
+		accepted = append(accepted, i)
+	}
+	return nil
+}
+
+func (d *chatDeliverer) DeliverEvent(ctx context.Context, consumer string, msg *nats.Msg) error {
+	ctx, cancel := context.WithTimeout(ctx, chatBatchBudget)
+	defer cancel()
+	return d.deliver(ctx, consumer, msg)
+}
+
+func (d *chatDeliverer) deliver(ctx context.Context, consumer string, msg *nats.Msg) error {
+	bodies, err := d.render(consumer, msg.Data)
+	if err != nil {
+		return err
+	}
+	for _, body := range bodies {
+		if err := d.limiter.Wait(ctx); err != nil {
+			return fmt.Errorf("rate limited: %w", err)
+		}
+		if err := d.post(ctx, body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// render returns the webhook bodies of a frame: one per commit op, or one
+// for other frames, leaving out those the template skips.
+func (d *chatDeliverer) render(consumer string, data []byte) ([][]byte, error) {
+	evt, err := firehose.DecodeFrame(data)
+	if err != nil {
+		// Nothing to show of a frame that doesn't decode
+		return nil, nil
+	}
+	base := ChatEvent{Consumer: consumer, Seq: evt.Seq, Type: evt.Type, DID: evt.DID, Time: evt.Time}
+	var events []ChatEvent
+	if len(evt.Ops) == 0 {
+		base.Body = jsonObject(evt.Body)
+		events = append(events, base)
+	}
+	for _, op := range evt.Ops {
+		if d.collections != nil && !d.collections.matchCollection(op.Collection) {
+			continue
+		}
+		e := base
+		e.Action = op.Action
+		e.Collection = op.Collection
+		e.Rkey = op.Rkey
+		e.URI = "at://" + evt.DID + "/" + op.Collection + "/" + op.Rkey
+		e.Record = jsonObject(op.Record)
+		if text, ok := e.Record["text"].(string); ok {
+			e.Text = d.escape(text)
+		}
+		events = append(events, e)
+	}
+
+	var bodies [][]byte
+	var buf bytes.Buffer
+	for _, e := range events {
+		buf.Reset()
+		if err := d.tmpl.Execute(&buf, e); err != nil {
+			return nil, fmt.Errorf("failed to render chat template: %w", err)
+		}
+		text := strings.TrimSpace(buf.String())
+		if text == "" {
+			continue
+		}
+		body, err := d.payload(text)
+		if err != nil {
+			return nil, err
+		}
+		bodies = append(bodies, body)
+	}
+	return bodies, nil
+}
+
+// escape keeps text from mentioning anyone: Slack treats <!channel> and
+// <@U123> as mentions, Discord's are disabled in payload.
+func (d *chatDeliverer) escape(text string) string {
+	if d.target != TargetSlack {
+		return text
+	}
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(text)
+}
+
+// payload wraps a rendered message in the target's webhook body.
+func (d *chatDeliverer) payload(text string) ([]byte, error) {
+	if strings.HasPrefix(text, "{") && json.Valid([]byte(text)) {
+		return []byte(text), nil
+	}
+	if d.target == TargetDiscord {
+		return json.Marshal(map[string]any{
+			"content":          truncate(discordContentLimit, text),
+			"allowed_mentions": map[string]any{"parse": []string{}},
+		})
+	}
+	return json.Marshal(map[string]string{"text": text})
+}
+
+// post sends body, waiting out a 429 answer while ctx allows.
+func (d *chatDeliverer) post(ctx context.Context, body []byte) error {
+	for {
+		retryAfter, err := d.postOnce(ctx, body)
+		if err == nil || retryAfter == 0 {
+			return err
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < retryAfter {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(retryAfter):
+		}
+	}
+}
+
+// postOnce sends body once. A 429 answer returns how long to wait before
+// sending it again.
+func (d *chatDeliverer) postOnce(ctx context.Context, body []byte) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := d.httpClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+	answer, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return 0, nil
+	}
+	err = fmt.Errorf("%s webhook returned status %d: %s", d.target, resp.StatusCode, bytes.TrimSpace(answer))
+	if resp.StatusCode != http.StatusTooManyRequests {
+		return 0, err
+	}
+	wait := time.Second
+	if s, perr := strconv.ParseFloat(resp.Header.Get("Retry-After"), 64); perr == nil && s > 0 {
+		wait = time.Duration(s * float64(time.Second))
+	}
+	return wait, err
+}
+
+func jsonObject(raw json.RawMessage) map[string]any {
+	var m map[string]any
+	if len(raw) > 0 {
+		_ = json.Unmarshal(raw, &m)
+	}
+	return m
+}
+
+func jsonString(v any) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// resolveHandle returns the handle of did, or did when it has none that
+// checks out.
+func resolveHandle(did string) string {
+	parsed, err := syntax.ParseDID(did)
+	if err != nil {
+		return did
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	ident, err := handles().LookupDID(ctx, parsed)
+	if err != nil || ident.Handle == syntax.HandleInvalid {
+		return did
+	}
+	return ident.Handle.String()
+}
+
+// truncate cuts s to n characters, the last an ellipsis.
+func truncate(n int, s string) string {
+	if n < 1 || utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n-1]) + "…"
+}
+
+// bskyLink returns the bsky.app URL of a post, or of the account of other
+// records and frames.
+func bskyLink(e ChatEvent) string {
+	if e.Collection == "app.bsky.feed.post" && e.Action != "delete" {
+		return "https://bsky.app/profile/" + e.DID + "/post/" + e.Rkey
+	}
+	return "https://bsky.app/profile/" + e.DID
+}
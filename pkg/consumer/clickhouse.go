@@ -0,0 +1,214 @@
+package consumer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/pkg/firehose"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	clickhouseTimeout = 60 * time.Second
+	// clickhouseMaxBackoff caps the delay added in front of an insert when
+	// ClickHouse is slower than the target latency.
+	clickhouseMaxBackoff = 30 * time.Second
+)
+
+// clickhouseSchema is the default table for commit ops. ORDER BY matches the
+// common "what happened in collection X" query shape.
+const clickhouseSchema = `CREATE TABLE IF NOT EXISTS %s (
+	seq UInt64,
+	did String,
+	time DateTime64(3, 'UTC'),
+	rev String,
+	action LowCardinality(String),
+	collection LowCardinality(String),
+	rkey String,
+	cid String,
+	record String,
+	consumer LowCardinality(String),
+	inserted_at DateTime DEFAULT now()
+) ENGINE = MergeTree
+PARTITION BY toYYYYMMDD(time)
+ORDER BY (collection, did, seq)`
+
+// clickhouseDeliverer inserts commit ops over the ClickHouse HTTP interface.
+// Inserts use server-side async inserts (the server buffers and merges small
+// inserts) while still waiting for the flush, so acked messages are durable.
+type clickhouseDeliverer struct {
+	endpoint      string
+	table         string
+	targetLatency time.Duration
+	httpClient    *http.Client
+
+	mu      sync.Mutex
+	backoff time.Duration
+}
+
+type clickhouseRow struct {
+	Seq        int64  `json:"seq"`
+	DID        string `json:"did"`
+	Time       string `json:"time"`
+	Rev        string `json:"rev"`
+	Action     string `json:"action"`
+	Collection string `json:"collection"`
+	Rkey       string `json:"rkey"`
+	CID        string `json:"cid"`
+	Record     string `json:"record"`
+	Consumer   string `json:"consumer"`
+}
+
+func newClickHouseDeliverer(endpoint, table string, targetLatency time.Duration) (*clickhouseDeliverer, error) {
+	if endpoint == "" {
+		return nil, fmt.Errorf("clickhouse target requires an HTTP endpoint URL")
+	}
+	if table == "" {
+		table = "firehose_commits"
+	}
+
+	d := &clickhouseDeliverer{
+		endpoint:      strings.TrimRight(endpoint, "/"),
+		table:         table,
+		targetLatency: targetLatency,
+		httpClient:    &http.Client{Timeout: clickhouseTimeout},
+	}
+
+	if err := d.exec(context.Background(), fmt.Sprintf(clickhouseSchema, table), nil, nil); err != nil {
+		return nil, fmt.Errorf("failed to create clickhouse table: %w", err)
+	}
+
+	return d, nil
+}
+
+func (d *clickhouseDeliverer) DeliverBatch(ctx context.Context, consumer string, msgs []*nats.Msg) error {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	rows := 0
+
+	for _, msg := range msgs {
+		evt, err := firehose.DecodeFrame(msg.Data)
+		if err != nil || evt.Type != firehose.TypeCommit {
+			// The default schema only holds commit ops
+			continue
+		}
+
+		// DateTime64 parses "YYYY-MM-DD hh:mm:ss.sss"
+		ts := ""
+		if t, err := time.Parse(time.RFC3339, evt.Time); err == nil {
+			ts = t.UTC().Format("2006-01-02 15:04:05.000")
+		}
+		for _, op := range evt.Ops {
+			if err := enc.Encode(clickhouseRow{
+				Seq:        evt.Seq,
+				DID:        evt.DID,
+				Time:       ts,
+				Rev:        evt.Rev,
+				Action:     op.Action,
+				Collection: op.Collection,
+				Rkey:       op.Rkey,
+				CID:        op.CID,
+				Record:     string(op.Record),
+				Consumer:   consumer,
+			}); err != nil {
+				return fmt.Errorf("failed to encode clickhouse row: %w", err)
+			}
+			rows++
+		}
+	}
+
+	if rows == 0 {
+		return nil
+	}
+
+	if err := d.waitBackoff(ctx); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	err := d.exec(ctx, "INSERT INTO "+d.table+" FORMAT JSONEachRow", url.Values{
+		"async_insert":          {"1"},
+		"wait_for_async_insert": {"1"},
+		// Records can carry fields the default schema doesn't know about
+		"input_format_skip_unknown_fields": {"1"},
+	}, &body)
+	d.observeLatency(time.Since(start))
+
+	return err
+}
+
+func (d *clickhouseDeliverer) DeliverEvent(ctx context.Context, consumer string, msg *nats.Msg) error {
+	return d.DeliverBatch(ctx, consumer, []*nats.Msg{msg})
+}
+
+// waitBackoff delays the next insert while ClickHouse is slower than the
+// target latency. Because the consumer loop waits for delivery before the
+// next fetch, this throttles pulling from JetStream as well.
+func (d *clickhouseDeliverer) waitBackoff(ctx context.Context) error {
+	d.mu.Lock()
+	wait := d.backoff
+	d.mu.Unlock()
+
+	if wait > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+	return nil
+}
+
+func (d *clickhouseDeliverer) observeLatency(latency time.Duration) {
+	if d.targetLatency <= 0 {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if latency > d.targetLatency {
+		// Back off by the overshoot, growing while inserts stay slow
+		d.backoff += latency - d.targetLatency
+		if d.backoff > clickhouseMaxBackoff {
+			d.backoff = clickhouseMaxBackoff
+		}
+	} else {
+		d.backoff /= 2
+	}
+}
+
+func (d *clickhouseDeliverer) exec(ctx context.Context, query string, params url.Values, body io.Reader) error {
+	if params == nil {
+		params = url.Values{}
+	}
+	params.Set("query", query)
+
+	if body == nil {
+		body = http.NoBody
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.endpoint+"/?"+params.Encode(), body)
+	if err != nil {
+		return fmt.Errorf("failed to create clickhouse request: %w", err)
+	}
+
+	resp, err := d.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send clickhouse request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("clickhouse returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
@@ -0,0 +1,322 @@
+package consumer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/internal/pkg/signature"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/nats-io/nats.go"
+)
+
+// Target selects where a consumer delivers its events.
+type Target string
+
+const (
+	TargetWebhook    Target = "webhook"
+	TargetSQS        Target = "sqs"
+	TargetSNS        Target = "sns"
+	TargetPubSub     Target = "pubsub"
+	TargetPostgres   Target = "postgres"
+	TargetClickHouse Target = "clickhouse"
+	TargetMQTT       Target = "mqtt"
+	TargetSlack      Target = "slack"
+	TargetDiscord    Target = "discord"
+	TargetEmail      Target = "email"
+)
+
+// Deliverer hands fetched messages to a downstream target. A non-nil error
+// means none of the messages may be considered delivered; they are NAKed and
+// redelivered by JetStream. A *PartialDeliveryError names those that were,
+// which are acked. Deliveries stop when ctx is done, e.g. on shutdown.
+// Deliverers holding connections may also implement io.Closer.
+type Deliverer interface {
+	// DeliverBatch delivers all messages of a fetched batch.
+	DeliverBatch(ctx context.Context, consumer string, msgs []*nats.Msg) error
+	// DeliverEvent delivers a single message on its own.
+	DeliverEvent(ctx context.Context, consumer string, msg *nats.Msg) error
+}
+
+// DefaultWebhookTimeout bounds a webhook call when Config.WebhookTimeout is
+// zero.
+const DefaultWebhookTimeout = 10 * time.Second
+
+// newDeliverer builds the Deliverer for cfg, or returns nil if the consumer
+// has no delivery target configured and should just ack what it pulls.
+func newDeliverer(cfg Config, encoder payloadEncoder) (Deliverer, error) {
+	switch cfg.Target {
+	case "", TargetWebhook:
+		if !cfg.UseWebhook || cfg.WebhookURL == "" {
+			return nil, nil
+		}
+		timeout := cfg.WebhookTimeout
+		if timeout == 0 {
+			timeout = DefaultWebhookTimeout
+		}
+		router, err := newWebhookRouter(cfg.WebhookURL, cfg.WebhookRoutes)
+		if err != nil {
+			return nil, err
+		}
+		d := &webhookDeliverer{
+			url:        cfg.WebhookURL,
+			router:     router,
+			secret:     []byte(cfg.WebhookSecret),
+			headers:    cfg.WebhookHeaders,
+			encoder:    encoder,
+			timeout:    timeout,
+			httpClient: &http.Client{Transport: sharedTransport(cfg.WebhookHTTP)},
+			attempts:   cfg.RedeliveryHeaders,
+		}
+		if cfg.JWEPublicKeyFile != "" {
+			enc, err := newJWEEncrypter(cfg.JWEPublicKeyFile, cfg.JWEKeyID)
+			if err != nil {
+				return nil, err
+			}
+			d.encrypter = enc
+		}
+		if cfg.AggregateWindow > 0 {
+			return &aggregateDeliverer{webhook: d, consumer: cfg.Name, window: cfg.AggregateWindow}, nil
+		}
+		return d, nil
+	case TargetSQS:
+		return newSQSDeliverer(expandConsumerName(cfg.SQSQueueURL, cfg.Name), encoder)
+	case TargetSNS:
+		return newSNSDeliverer(expandConsumerName(cfg.SNSTopicARN, cfg.Name), encoder)
+	case TargetPubSub:
+		return newPubSubDeliverer(cfg.PubSubProject, expandConsumerName(cfg.PubSubTopic, cfg.Name), cfg.PubSubAttributes, encoder)
+	case TargetPostgres:
+		return newPostgresDeliverer(cfg.PostgresDSN, cfg.PostgresTable, cfg.PostgresColumns)
+	case TargetClickHouse:
+		return newClickHouseDeliverer(cfg.ClickHouseURL, cfg.ClickHouseTable, cfg.ClickHouseTargetLatency)
+	case TargetMQTT:
+		return newMQTTDeliverer(cfg.MQTTBrokerURL, "fpaas-"+cfg.Name, cfg.MQTTTopicPrefix, cfg.MQTTQoS, encoder)
+	case TargetSlack, TargetDiscord:
+		return newChatDeliverer(cfg.Target, cfg.ChatWebhookURL, cfg.ChatTemplate, cfg.ChatRate, cfg.Collections, cfg.WebhookTimeout, cfg.WebhookHTTP)
+	case TargetEmail:
+		return newEmailDeliverer(cfg.Name, cfg.EmailTo, cfg.EmailFrom, cfg.SMTPURL, cfg.EmailTemplate, cfg.DigestInterval, cfg.Collections)
+	default:
+		return nil, fmt.Errorf("unknown delivery target %q", cfg.Target)
+	}
+}
+
+// maxPooledBody bounds the body buffers kept for reuse, so a rare huge batch
+// doesn't stay allocated.
+const maxPooledBody = 8 << 20
+
+// bodyBuffers are the buffers webhook bodies are encoded into. A body is
+// done with once its request returns.
+var bodyBuffers = sync.Pool{New: func() any { return new([]byte) }}
+
+type webhookDeliverer struct {
+	url string
+	// router, when set, splits batches by the URL their events are routed to
+	router  *webhookRouter
+	secret  []byte
+	headers map[string]string
+	encoder payloadEncoder
+	// timeout bounds every call, from sending the request to reading the
+	// answer
+	timeout    time.Duration
+	httpClient *http.Client
+	// encrypter, when set, wraps every body in a compact JWE
+	encrypter jose.Encrypter
+	// attempts adds the RedeliveryHeaders to calls delivering events
+	attempts bool
+}
+
+func (d *webhookDeliverer) DeliverBatch(ctx context.Context, consumer string, msgs []*nats.Msg) error {
+	if d.router == nil {
+		return d.deliverBatch(ctx, d.url, consumer, msgs)
+	}
+	groups := d.router.split(msgs)
+	if len(groups) == 1 {
+		return d.deliverBatch(ctx, groups[0].url, consumer, msgs)
+	}
+
+	// Each URL gets its own call; the batch is delivered as far as they got
+	var accepted []int
+	var errs []error
+	for _, g := range groups {
+		err := d.deliverBatch(ctx, g.url, consumer, g.msgs)
+		if err == nil {
+			accepted = append(accepted, g.indexes...)
+			continue
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", g.url, err))
+		var partial *PartialDeliveryError
+		if errors.As(err, &partial) {
+			for _, i := range partial.Accepted {
+				if i >= 0 && i < len(g.indexes) {
+					accepted = append(accepted, g.indexes[i])
+				}
+			}
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	err := errors.Join(errs...)
+	if len(accepted) == 0 {
+		return err
+	}
+	return &PartialDeliveryError{Accepted: accepted, Err: err}
+}
+
+func (d *webhookDeliverer) deliverBatch(ctx context.Context, url, consumer string, msgs []*nats.Msg) error {
+	events := make([][]byte, len(msgs))
+	for i, msg := range msgs {
+		events[i] = msg.Data
+	}
+
+	buf := bodyBuffers.Get().(*[]byte)
+	body, err := d.encoder.encodeBatch((*buf)[:0], consumer, events, annotationsOf(msgs...))
+	*buf = body
+	if err != nil {
+		releaseBody(buf)
+		return fmt.Errorf("failed to encode payload: %w", err)
+	}
+
+	first, last := seqRange(msgs)
+	headers := d.encoder.headers(true)
+	if d.attempts {
+		headers = attemptHeaders(headers, msgs)
+	}
+	return d.post(ctx, url, buf, consumer, len(msgs), first, last, headers)
+}
+
+func (d *webhookDeliverer) DeliverEvent(ctx context.Context, consumer string, msg *nats.Msg) error {
+	buf := bodyBuffers.Get().(*[]byte)
+	body, err := d.encoder.encodeEvent((*buf)[:0], consumer, msg.Data, annotationsOf(msg))
+	*buf = body
+	if err != nil {
+		releaseBody(buf)
+		return fmt.Errorf("failed to encode payload: %w", err)
+	}
+
+	seq, _ := seqRange([]*nats.Msg{msg})
+	url := d.url
+	if d.router != nil {
+		url = d.router.route(msg)
+	}
+	headers := d.encoder.headers(false)
+	if d.attempts {
+		headers = attemptHeaders(headers, []*nats.Msg{msg})
+	}
+	return d.post(ctx, url, buf, consumer, 1, seq, seq, headers)
+}
+
+func releaseBody(buf *[]byte) {
+	if cap(*buf) <= maxPooledBody {
+		bodyBuffers.Put(buf)
+	}
+}
+
+// bodyReader reads a request body from a pooled buffer. The transport may
+// still be sending it after the response came back, when the receiver
+// answers early, so the buffer is only reused once it was read in full.
+type bodyReader struct {
+	r       *bytes.Reader
+	drained atomic.Bool
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if b.r.Len() == 0 {
+		b.drained.Store(true)
+	}
+	return n, err
+}
+
+// idempotencyKey names a delivery by the stream range it covers, which stays
+// the same when JetStream redelivers it.
+func idempotencyKey(consumer string, first, last uint64) string {
+	if first == last {
+		return fmt.Sprintf("%s/%d", consumer, first)
+	}
+	return fmt.Sprintf("%s/%d-%d", consumer, first, last)
+}
+
+// post sends the body in buf to url, a delivery covering the stream sequences first
+// to last, and then hands buf back to bodyBuffers. The call is cancelled when
+// ctx is done or it takes longer than d.timeout.
+func (d *webhookDeliverer) post(ctx context.Context, url string, buf *[]byte, consumer string, eventCount int, first, last uint64, headers map[string]string) error {
+	body := *buf
+	contentType := d.encoder.contentType()
+	if d.encrypter != nil {
+		var err error
+		body, err = encryptJWE(d.encrypter, body)
+		releaseBody(buf)
+		if err != nil {
+			return err
+		}
+		contentType = jweContentType
+		buf = nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+
+	// Create request
+	readers := []*bodyReader{{r: bytes.NewReader(body)}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, readers[0])
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.ContentLength = int64(len(body))
+	// Retries and redirects read the body again
+	req.GetBody = func() (io.ReadCloser, error) {
+		r := &bodyReader{r: bytes.NewReader(body)}
+		readers = append(readers, r)
+		return io.NopCloser(r), nil
+	}
+	if buf != nil {
+		defer func() {
+			for _, r := range readers {
+				if !r.drained.Load() {
+					return
+				}
+			}
+			releaseBody(buf)
+		}()
+	}
+
+	// Metadata headers stay in plaintext so receivers can route before decrypting
+	req.Header.Set("Content-Type", contentType)
+	if d.encrypter != nil {
+		req.Header.Set("X-Payload-Content-Type", d.encoder.contentType())
+	}
+	req.Header.Set("X-Event-Count", fmt.Sprintf("%d", eventCount))
+	req.Header.Set("X-Schema-Version", PayloadSchemaVersion)
+	req.Header.Set("Idempotency-Key", idempotencyKey(consumer, first, last))
+	// Lets receivers check for gaps and reordering
+	req.Header.Set("X-Stream-Seq-First", strconv.FormatUint(first, 10))
+	req.Header.Set("X-Stream-Seq-Last", strconv.FormatUint(last, 10))
+	for k, v := range d.headers {
+		req.Header.Set(k, v)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	// Signed last, over the exact bytes on the wire (after encryption)
+	if len(d.secret) > 0 {
+		req.Header.Set(signature.Header, signature.Sign(d.secret, body))
+	}
+
+	// Send request
+	resp, err := d.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// The receiver may ack the events one by one
+	return ackResult(resp.StatusCode, resp.Body, eventCount)
+}
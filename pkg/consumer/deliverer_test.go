@@ -0,0 +1,91 @@
+package consumer
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/internal/pkg/fakerelay"
+	"github.com/nats-io/nats.go"
+)
+
+// benchBatch is a webhook batch of fake relay frames.
+func benchBatch(n int) []*nats.Msg {
+	now := time.Now()
+	msgs := make([]*nats.Msg, n)
+	for i := range msgs {
+		msgs[i] = &nats.Msg{Subject: "atproto.firehose.commit", Data: fakerelay.Synthetic(int64(i+1), 100, now, true)}
+	}
+	return msgs
+}
+
+// BenchmarkEncodeBatch compares encoding a 500 event JSON batch into a
+// reused buffer, as the webhook target does, with a fresh one each time.
+func BenchmarkEncodeBatch(b *testing.B) {
+	msgs := benchBatch(500)
+	frames := make([][]byte, len(msgs))
+	for i, msg := range msgs {
+		frames[i] = msg.Data
+	}
+	enc, err := newPayloadEncoder(FormatJSON, "")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Run("reused", func(b *testing.B) {
+		var buf []byte
+		b.ReportAllocs()
+		for range b.N {
+			if buf, err = enc.encodeBatch(buf[:0], "bench", frames, annotations{}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("fresh", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			if _, err := enc.encodeBatch(nil, "bench", frames, annotations{}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkWebhookDeliverBatch delivers a 500 event JSON batch to a local
+// webhook. The body buffer goes back to the pool only once the transport
+// read it all, which answering before reading the body exercises.
+func BenchmarkWebhookDeliverBatch(b *testing.B) {
+	for _, tc := range []struct {
+		name  string
+		early bool
+	}{{"read", false}, {"early-answer", true}} {
+		b.Run(tc.name, func(b *testing.B) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tc.early {
+					w.WriteHeader(http.StatusOK)
+					w.(http.Flusher).Flush()
+				}
+				io.Copy(io.Discard, r.Body)
+			}))
+			defer srv.Close()
+			enc, err := newPayloadEncoder(FormatJSON, "")
+			if err != nil {
+				b.Fatal(err)
+			}
+			d, err := newDeliverer(Config{UseWebhook: true, WebhookURL: srv.URL, WebhookHTTP: DefaultHTTPOptions}, enc)
+			if err != nil {
+				b.Fatal(err)
+			}
+			msgs := benchBatch(500)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for range b.N {
+				if err := d.DeliverBatch(context.Background(), "bench", msgs); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,197 @@
+package consumer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/pkg/events"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+)
+
+const (
+	// DeliveryLogStream keeps the delivery attempt records published by
+	// consumers with Config.DeliveryLog set.
+	DeliveryLogStream = "FPAAS_DELIVERIES"
+	// DeliveryLogSubjectPrefix is followed by the consumer name.
+	DeliveryLogSubjectPrefix = "fpaas.deliveries."
+	// RedeliverSubjectPrefix is followed by the consumer name. Consumers
+	// answer RedeliverRequests on it.
+	RedeliverSubjectPrefix = "fpaas.redeliver."
+	// MaxRedeliverEvents bounds the stream range a single redelivery loads.
+	MaxRedeliverEvents = 100000
+
+	deliveryLogMaxAge = 7 * 24 * time.Hour
+)
+
+const (
+	DeliveryDelivered = events.DeliveryDelivered
+	DeliveryFailed    = events.DeliveryFailed
+)
+
+// DeliveryRecord is one delivery attempt: a batch, or a single event in
+// DeliverEvent mode.
+type DeliveryRecord = events.DeliveryRecord
+
+// RedeliverRequest asks a consumer to deliver a stream range again.
+type RedeliverRequest struct {
+	DeliveryID string `json:"delivery_id"`
+	FirstSeq   uint64 `json:"first_seq"`
+	LastSeq    uint64 `json:"last_seq"`
+}
+
+// RedeliverReply is the answer to a RedeliverRequest.
+type RedeliverReply struct {
+	Record DeliveryRecord `json:"record"`
+	Error  string         `json:"error,omitempty"`
+}
+
+// EnsureDeliveryLogStream creates the delivery log stream if it's missing.
+func EnsureDeliveryLogStream(js nats.JetStreamContext) error {
+	_, err := js.StreamInfo(DeliveryLogStream)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, nats.ErrStreamNotFound) {
+		return err
+	}
+	_, err = js.AddStream(&nats.StreamConfig{
+		Name:     DeliveryLogStream,
+		Subjects: []string{DeliveryLogSubjectPrefix + ">"},
+		Storage:  nats.FileStorage,
+		MaxAge:   deliveryLogMaxAge,
+	})
+	if errors.Is(err, nats.ErrStreamNameAlreadyInUse) {
+		return nil
+	}
+	return err
+}
+
+// logDelivery publishes a delivery record. Publishing is fire and forget, so
+// a slow or missing log never holds up delivery.
+func (c *PullConsumer) logDelivery(msgs []*nats.Msg, err error, took time.Duration, redeliveryOf string, first, last uint64) DeliveryRecord {
+	rec := DeliveryRecord{
+		ID:           nuid.Next(),
+		Consumer:     c.consumerName,
+		Target:       string(c.target),
+		Status:       DeliveryDelivered,
+		Events:       len(msgs),
+		FirstSeq:     first,
+		LastSeq:      last,
+		DurationMs:   took.Milliseconds(),
+		Time:         time.Now().UTC(),
+		RedeliveryOf: redeliveryOf,
+	}
+	if err != nil {
+		rec.Status = DeliveryFailed
+		rec.Error = err.Error()
+	}
+	if !c.deliveryLog {
+		return rec
+	}
+
+	data, _ := json.Marshal(rec)
+	if err := c.natsConn.Publish(DeliveryLogSubjectPrefix+c.consumerName, data); err != nil {
+		c.logger.Debug("failed to publish delivery record", "error", err)
+	}
+	return rec
+}
+
+// seqRange returns the lowest and highest stream sequence of msgs.
+func seqRange(msgs []*nats.Msg) (first, last uint64) {
+	for _, msg := range msgs {
+		seq := streamSeq(msg)
+		if seq == 0 {
+			continue
+		}
+		if first == 0 || seq < first {
+			first = seq
+		}
+		if seq > last {
+			last = seq
+		}
+	}
+	return first, last
+}
+
+// handleRedeliver loads the requested range from the stream, applies the
+// consumer's filter and delivers it as one batch. Ranges older than the
+// stream's retention can't be redelivered.
+func (c *PullConsumer) handleRedeliver(msg *nats.Msg) {
+	reply := func(r RedeliverReply) {
+		data, _ := json.Marshal(r)
+		if err := msg.Respond(data); err != nil {
+			c.logger.Warn("failed to answer redelivery request", "error", err)
+		}
+	}
+
+	var req RedeliverRequest
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		reply(RedeliverReply{Error: fmt.Sprintf("invalid request: %v", err)})
+		return
+	}
+	if req.FirstSeq == 0 || req.LastSeq < req.FirstSeq {
+		reply(RedeliverReply{Error: "invalid sequence range"})
+		return
+	}
+	if req.LastSeq-req.FirstSeq >= MaxRedeliverEvents {
+		reply(RedeliverReply{Error: fmt.Sprintf("range exceeds %d events", MaxRedeliverEvents)})
+		return
+	}
+
+	stream, err := c.js.StreamNameBySubject(c.subject)
+	if err != nil {
+		reply(RedeliverReply{Error: fmt.Sprintf("failed to find stream: %v", err)})
+		return
+	}
+
+	var msgs []*nats.Msg
+	for seq := req.FirstSeq; seq <= req.LastSeq; seq++ {
+		raw, err := c.js.GetMsg(stream, seq)
+		if errors.Is(err, nats.ErrMsgNotFound) {
+			continue
+		}
+		if err != nil {
+			reply(RedeliverReply{Error: fmt.Sprintf("failed to load seq %d: %v", seq, err)})
+			return
+		}
+		// Loaded messages have no JetStream metadata, so the sequence goes
+		// in a header, as with direct gets
+		header := raw.Header
+		if header == nil {
+			header = nats.Header{}
+		}
+		header.Set(nats.JSSequence, strconv.FormatUint(raw.Sequence, 10))
+		msgs = append(msgs, &nats.Msg{Subject: raw.Subject, Header: header, Data: raw.Data})
+	}
+	msgs, _ = c.filter.split(msgs)
+	msgs, _ = redact(c.redaction, msgs)
+	msgs, _ = c.labels.split(msgs)
+	msgs, _ = c.languages.split(msgs)
+	if len(msgs) == 0 {
+		reply(RedeliverReply{Error: "the events are no longer retained by the stream"})
+		return
+	}
+	msgs = c.threads.annotate(context.Background(), msgs)
+	msgs = c.blobs.annotate(context.Background(), msgs)
+
+	start := time.Now()
+	err = c.deliverer.DeliverBatch(context.Background(), c.consumerName, msgs)
+	rec := c.logDelivery(msgs, err, time.Since(start), req.DeliveryID, req.FirstSeq, req.LastSeq)
+	c.logger.Info("manual redelivery", "consumer", c.consumerName, "delivery", req.DeliveryID, "events", len(msgs), "status", rec.Status)
+	reply(RedeliverReply{Record: rec})
+}
+
+// streamSeq returns the stream sequence of a fetched message, or of one
+// loaded for a redelivery; zero when it has neither.
+func streamSeq(msg *nats.Msg) uint64 {
+	if meta, err := msg.Metadata(); err == nil {
+		return meta.Sequence.Stream
+	}
+	seq, _ := strconv.ParseUint(msg.Header.Get(nats.JSSequence), 10, 64)
+	return seq
+}
@@ -0,0 +1,169 @@
+package consumer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/events"
+	"github.com/nats-io/nats.go"
+)
+
+// DryRunCheck is the outcome of a single dry-run step.
+type DryRunCheck struct {
+	Name   string
+	OK     bool
+	Detail string
+}
+
+// DryRunReport lists the dry-run steps in the order they ran.
+type DryRunReport struct {
+	Checks []DryRunCheck
+}
+
+// Failed reports whether any check failed.
+func (r DryRunReport) Failed() bool {
+	for _, c := range r.Checks {
+		if !c.OK {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *DryRunReport) add(name string, err error, detail string) bool {
+	if err != nil {
+		detail = err.Error()
+	}
+	r.Checks = append(r.Checks, DryRunCheck{Name: name, OK: err == nil, Detail: detail})
+	return err == nil
+}
+
+// DryRun checks everything a consumer needs without changing any state: the
+// config, the NATS connection, the stream and the durable consumer. It does a
+// single fetch through a temporary no-ack consumer, so nothing is acked on the
+// real durable. With sendWebhook, a synthetic #info frame is delivered to
+// the configured webhook, signed like real deliveries. ctx cuts the fetch
+// and the delivery short.
+func DryRun(ctx context.Context, cfg Config, sendWebhook bool) DryRunReport {
+	var report DryRunReport
+
+	if !report.add("config", cfg.Validate(), "valid") {
+		return report
+	}
+
+	nc, err := nats.Connect(cfg.NATSURL, nats.Timeout(5*time.Second))
+	if !report.add("nats", err, fmt.Sprintf("connected to %s", cfg.NATSURL)) {
+		return report
+	}
+	defer nc.Close()
+
+	js, err := nc.JetStream()
+	if !report.add("jetstream", err, "enabled") {
+		return report
+	}
+
+	stream, err := js.StreamNameBySubject("atproto.firehose.>")
+	if err != nil {
+		report.add("stream", err, "")
+		return report
+	}
+	si, err := js.StreamInfo(stream)
+	if err != nil {
+		report.add("stream", err, "")
+		return report
+	}
+	report.add("stream", nil, fmt.Sprintf("%s: %d messages, %d bytes, seq %d..%d",
+		stream, si.State.Msgs, si.State.Bytes, si.State.FirstSeq, si.State.LastSeq))
+
+	ci, err := js.ConsumerInfo(stream, cfg.Name)
+	switch {
+	case errors.Is(err, nats.ErrConsumerNotFound):
+		report.add("consumer", nil, fmt.Sprintf("%s does not exist yet; it will be created delivering new messages", cfg.Name))
+	case err != nil:
+		report.add("consumer", err, "")
+	default:
+		report.add("consumer", nil, fmt.Sprintf("%s: %d pending, %d awaiting ack, ack floor %d",
+			cfg.Name, ci.NumPending, ci.NumAckPending, ci.AckFloor.Stream))
+	}
+
+	// Temporary consumer: AckNone and an inactivity threshold, so it
+	// disappears on its own and never touches the real durable's position
+	sub, err := js.PullSubscribe("atproto.firehose.>", "",
+		nats.BindStream(stream),
+		nats.DeliverLast(),
+		nats.AckNone(),
+		nats.InactiveThreshold(30*time.Second),
+	)
+	if err != nil {
+		report.add("fetch", err, "")
+	} else {
+		msgs, err := fetch(ctx, sub, cfg.BatchSize)
+		if errors.Is(err, nats.ErrTimeout) {
+			err = nil
+		}
+		size := 0
+		for _, m := range msgs {
+			size += len(m.Data)
+		}
+		report.add("fetch", err, fmt.Sprintf("fetched %d messages (%d bytes) without acking", len(msgs), size))
+		sub.Unsubscribe()
+	}
+
+	if !sendWebhook {
+		return report
+	}
+	if cfg.Target != "" && cfg.Target != TargetWebhook {
+		report.add("webhook", fmt.Errorf("target is %s, not webhook", cfg.Target), "")
+		return report
+	}
+
+	encoder, err := newPayloadEncoder(cfg.PayloadFormat, cfg.SchemaRegistryURL)
+	if err != nil {
+		report.add("webhook", err, "")
+		return report
+	}
+	// Force delivery even if use-webhook is off; that's what was asked for
+	cfg.UseWebhook = true
+	deliverer, err := newDeliverer(cfg, encoder)
+	if err != nil {
+		report.add("webhook", err, "")
+		return report
+	}
+
+	frame, err := syntheticFrame()
+	if err != nil {
+		report.add("webhook", err, "")
+		return report
+	}
+	msg := nats.NewMsg("atproto.firehose.raw")
+	msg.Data = frame
+
+	start := time.Now()
+	err = deliverer.DeliverBatch(ctx, cfg.Name, []*nats.Msg{msg})
+	report.add("webhook", err, fmt.Sprintf("synthetic event delivered to %s in %s (signed: %t)",
+		cfg.WebhookURL, time.Since(start).Round(time.Millisecond), cfg.WebhookSecret != ""))
+
+	return report
+}
+
+// syntheticFrame builds a well-formed #info frame, which real receivers
+// already have to tolerate.
+func syntheticFrame() ([]byte, error) {
+	msg := "fpaas consumer dry run"
+	evt := events.XRPCStreamEvent{
+		RepoInfo: &comatproto.SyncSubscribeRepos_Info{
+			Name:    "FpaasDryRun",
+			Message: &msg,
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := evt.Serialize(&buf); err != nil {
+		return nil, fmt.Errorf("failed to build synthetic frame: %w", err)
+	}
+	return buf.Bytes(), nil
+}
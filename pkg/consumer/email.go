@@ -0,0 +1,436 @@
+package consumer
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/pkg/firehose"
+	"github.com/nats-io/nats.go"
+)
+
+// DefaultDigestTemplate lists the events of a digest, linking the posts and
+// accounts on bsky.app.
+const DefaultDigestTemplate = `<p>{{len .Events}} events for {{.Consumer}} since {{.Since.Format "2 Jan 15:04 MST"}}{{with .Omitted}}, and {{.}} more left out{{end}}:</p>
+<ul>
+{{range .Events}}<li>{{if .Action}}<a href="{{link .}}">@{{handle .DID}} {{.Action}}d {{.Collection}}</a>{{with .Text}}: {{truncate 300 .}}{{end}}{{else}}<a href="{{link .}}">{{.Type}} from @{{handle .DID}}</a>{{end}}</li>
+{{end}}</ul>`
+
+const (
+	// DefaultDigestInterval is how often the email target mails a digest
+	// when Config.DigestInterval is zero.
+	DefaultDigestInterval = time.Hour
+	// MaxDigestInterval is the longest digest interval; digests of
+	// consumers that stopped expire from DigestBucket a day after it.
+	MaxDigestInterval = 7 * 24 * time.Hour
+	// DigestMaxEvents is how many events a digest lists; it counts the
+	// others that arrived in its interval.
+	DigestMaxEvents = 100
+
+	// DigestBucket holds the events accumulated for the next digest of
+	// each email consumer, so they survive restarts and replicas taking the
+	// consumer over.
+	DigestBucket = "fpaas_digests"
+
+	smtpTimeout = 30 * time.Second
+)
+
+// Digest is what the template of an email consumer renders: the events it
+// was delivered from Since until Until, in order, as ChatEvents. The
+// template can call handle, truncate and link, as chat templates do.
+type Digest struct {
+	Consumer string
+	Since    time.Time
+	Until    time.Time
+	Events   []ChatEvent
+	// Omitted counts the events left out past DigestMaxEvents.
+	Omitted int
+}
+
+// pendingDigest is the next digest of a consumer, as kept in DigestBucket.
+type pendingDigest struct {
+	Since   time.Time   `json:"since"`
+	Events  []ChatEvent `json:"events,omitempty"`
+	Omitted int         `json:"omitted,omitempty"`
+}
+
+// jsDeliverer is a Deliverer keeping state in JetStream, bound to the
+// consumer's connection once it is made.
+type jsDeliverer interface {
+	bind(js nats.JetStreamContext, logger *slog.Logger) error
+}
+
+// emailDeliverer accumulates events in DigestBucket, acking them once they
+// are stored there, and mails them as a digest every interval.
+type emailDeliverer struct {
+	consumer    string
+	to          []string
+	from        string
+	server      *url.URL
+	tmpl        *template.Template
+	interval    time.Duration
+	collections *eventFilter
+
+	kv     nats.KeyValue
+	logger *slog.Logger
+	stop   context.CancelFunc
+	done   chan struct{}
+	// mu orders the updates of the digest made by the process
+	mu sync.Mutex
+}
+
+func newEmailDeliverer(consumer string, to []string, from, smtpURL, text string, interval time.Duration, collections []string) (*emailDeliverer, error) {
+	if len(to) == 0 || from == "" {
+		return nil, errors.New("email target requires recipients and a sender address")
+	}
+	server, err := parseSMTPURL(smtpURL)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := parseDigestTemplate(text)
+	if err != nil {
+		return nil, err
+	}
+	if interval == 0 {
+		interval = DefaultDigestInterval
+	}
+	return &emailDeliverer{
+		consumer:    consumer,
+		to:          to,
+		from:        from,
+		server:      server,
+		tmpl:        tmpl,
+		interval:    interval,
+		collections: newEventFilter(nil, collections, nil),
+	}, nil
+}
+
+// parseSMTPURL checks an smtp:// (STARTTLS when offered) or smtps://
+// (implicit TLS) server URL, with optional user:password.
+func parseSMTPURL(raw string) (*url.URL, error) {
+	if raw == "" {
+		return nil, errors.New("email target requires an SMTP server URL")
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMTP server URL: %w", err)
+	}
+	if (u.Scheme != "smtp" && u.Scheme != "smtps") || u.Hostname() == "" {
+		return nil, fmt.Errorf("SMTP server URL must be smtp://host[:port] or smtps://host[:port], got %q", u.Redacted())
+	}
+	return u, nil
+}
+
+// parseDigestTemplate parses text, DefaultDigestTemplate when empty.
+func parseDigestTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		text = DefaultDigestTemplate
+	}
+	tmpl, err := template.New("digest").Funcs(template.FuncMap{
+		"handle":   resolveHandle,
+		"truncate": truncate,
+		"link":     bskyLink,
+	}).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid digest template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// EnsureDigestBucket opens DigestBucket, creating it if it doesn't exist.
+func EnsureDigestBucket(js nats.JetStreamContext) (nats.KeyValue, error) {
+	return firehose.OpenKeyValue(js, &nats.KeyValueConfig{
+		Bucket:  DigestBucket,
+		History: 1,
+		TTL:     MaxDigestInterval + 24*time.Hour,
+	})
+}
+
+// bind opens DigestBucket and starts mailing digests until Close.
+func (d *emailDeliverer) bind(js nats.JetStreamContext, logger *slog.Logger) error {
+	kv, err := EnsureDigestBucket(js)
+	if err != nil {
+		return fmt.Errorf("failed to open digest bucket: %w", err)
+	}
+	d.kv = kv
+	d.logger = logger
+	ctx, stop := context.WithCancel(context.Background())
+	d.stop = stop
+	d.done = make(chan struct{})
+	go d.run(ctx)
+	return nil
+}
+
+// Close stops mailing digests. The events accumulated stay in DigestBucket
+// for the consumer's next run.
+func (d *emailDeliverer) Close() error {
+	if d.stop != nil {
+		d.stop()
+		<-d.done
+	}
+	return nil
+}
+
+func (d *emailDeliverer) DeliverBatch(ctx context.Context, consumer string, msgs []*nats.Msg) error {
+	var events []ChatEvent
+	for _, msg := range msgs {
+		events = append(events, d.events(consumer, msg.Data)...)
+	}
+	return d.add(events)
+}
+
+func (d *emailDeliverer) DeliverEvent(ctx context.Context, consumer string, msg *nats.Msg) error {
+	return d.add(d.events(consumer, msg.Data))
+}
+
+// events returns the ChatEvents of a frame, as the chat targets render them.
+func (d *emailDeliverer) events(consumer string, data []byte) []ChatEvent {
+	evt, err := firehose.DecodeFrame(data)
+	if err != nil {
+		return nil
+	}
+	base := ChatEvent{Consumer: consumer, Seq: evt.Seq, Type: evt.Type, DID: evt.DID, Time: evt.Time}
+	if len(evt.Ops) == 0 {
+		base.Body = jsonObject(evt.Body)
+		return []ChatEvent{base}
+	}
+	var events []ChatEvent
+	for _, op := range evt.Ops {
+		if d.collections != nil && !d.collections.matchCollection(op.Collection) {
+			continue
+		}
+		e := base
+		e.Action = op.Action
+		e.Collection = op.Collection
+		e.Rkey = op.Rkey
+		e.URI = "at://" + evt.DID + "/" + op.Collection + "/" + op.Rkey
+		e.Record = jsonObject(op.Record)
+		// html/template escapes it
+		e.Text, _ = e.Record["text"].(string)
+		events = append(events, e)
+	}
+	return events
+}
+
+// add appends events to the pending digest.
+func (d *emailDeliverer) add(events []ChatEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	if d.kv == nil {
+		return errors.New("email target is not bound to NATS")
+	}
+	return d.update(func(p *pendingDigest) {
+		room := min(len(events), max(0, DigestMaxEvents-len(p.Events)))
+		p.Omitted += len(events) - room
+		p.Events = append(p.Events, events[:room]...)
+	})
+}
+
+// update applies fn to the pending digest, retrying when another replica
+// changed it in between.
+func (d *emailDeliverer) update(fn func(*pendingDigest)) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for attempt := 0; ; attempt++ {
+		p, revision, err := d.pending()
+		if err != nil {
+			return err
+		}
+		fn(&p)
+		value, err := json.Marshal(p)
+		if err != nil {
+			return err
+		}
+		if revision == 0 {
+			_, err = d.kv.Create(d.consumer, value)
+		} else {
+			_, err = d.kv.Update(d.consumer, value, revision)
+		}
+		if err == nil || attempt >= 3 {
+			if err != nil {
+				return fmt.Errorf("failed to store digest: %w", err)
+			}
+			return nil
+		}
+	}
+}
+
+// pending reads the pending digest and its revision, zero when there is
+// none yet.
+func (d *emailDeliverer) pending() (pendingDigest, uint64, error) {
+	entry, err := d.kv.Get(d.consumer)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return pendingDigest{Since: time.Now().UTC()}, 0, nil
+	}
+	if err != nil {
+		return pendingDigest{}, 0, fmt.Errorf("failed to read digest: %w", err)
+	}
+	var p pendingDigest
+	if err := json.Unmarshal(entry.Value(), &p); err != nil {
+		return pendingDigest{}, 0, fmt.Errorf("failed to decode digest: %w", err)
+	}
+	return p, entry.Revision(), nil
+}
+
+// run mails the digest once its interval is over, checking every minute,
+// or tenth of the interval if shorter.
+func (d *emailDeliverer) run(ctx context.Context) {
+	defer close(d.done)
+	ticker := time.NewTicker(min(d.interval/10, time.Minute))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := d.flush(); err != nil {
+			// Kept for the next tick
+			d.logger.Warn("failed to send email digest", "error", err)
+		}
+	}
+}
+
+// flush mails the pending digest if its interval is over and it has any
+// events, then starts the next one.
+func (d *emailDeliverer) flush() error {
+	d.mu.Lock()
+	p, revision, err := d.pending()
+	d.mu.Unlock()
+	if err != nil || revision == 0 {
+		return err
+	}
+	now := time.Now().UTC()
+	if now.Sub(p.Since) < d.interval || len(p.Events)+p.Omitted == 0 {
+		return nil
+	}
+
+	digest := Digest{Consumer: d.consumer, Since: p.Since, Until: now, Events: p.Events, Omitted: p.Omitted}
+	if err := d.send(digest); err != nil {
+		return err
+	}
+	d.logger.Info("sent email digest", "events", len(p.Events)+p.Omitted, "recipients", len(d.to))
+
+	// Events added while sending stay for the next digest
+	return d.update(func(next *pendingDigest) {
+		next.Events = next.Events[min(len(p.Events), len(next.Events)):]
+		next.Omitted = max(0, next.Omitted-p.Omitted)
+		next.Since = now
+	})
+}
+
+// send renders digest and mails it to the recipients.
+func (d *emailDeliverer) send(digest Digest) error {
+	var html bytes.Buffer
+	if err := d.tmpl.Execute(&html, digest); err != nil {
+		return fmt.Errorf("failed to render digest template: %w", err)
+	}
+	total := len(digest.Events) + digest.Omitted
+	subject := fmt.Sprintf("fpaas digest: %d events for %s", total, d.consumer)
+	if total == 1 {
+		subject = "fpaas digest: 1 event for " + d.consumer
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", d.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(d.to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", digest.Until.Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/html; charset=UTF-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	qp := quotedprintable.NewWriter(&msg)
+	qp.Write(html.Bytes())
+	qp.Close()
+
+	return d.mail(msg.Bytes())
+}
+
+// mail sends msg through the SMTP server, upgrading smtp:// connections to
+// TLS when the server offers STARTTLS.
+func (d *emailDeliverer) mail(msg []byte) error {
+	host := d.server.Hostname()
+	port := d.server.Port()
+	if port == "" {
+		port = "587"
+		if d.server.Scheme == "smtps" {
+			port = "465"
+		}
+	}
+	dialer := &net.Dialer{Timeout: smtpTimeout}
+	addr := net.JoinHostPort(host, port)
+	var conn net.Conn
+	var err error
+	if d.server.Scheme == "smtps" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: host})
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to connect to SMTP server: %w", err)
+	}
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to connect to SMTP server: %w", err)
+	}
+	defer c.Close()
+	if d.server.Scheme == "smtp" {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+				return fmt.Errorf("failed to start TLS: %w", err)
+			}
+		}
+	}
+	if user := d.server.User; user != nil {
+		password, _ := user.Password()
+		// Refuses to send the password unencrypted, but to localhost
+		if err := c.Auth(smtp.PlainAuth("", user.Username(), password, host)); err != nil {
+			return fmt.Errorf("SMTP authentication failed: %w", err)
+		}
+	}
+	if err := c.Mail(address(d.from)); err != nil {
+		return fmt.Errorf("SMTP server refused sender: %w", err)
+	}
+	for _, to := range d.to {
+		if err := c.Rcpt(address(to)); err != nil {
+			return fmt.Errorf("SMTP server refused recipient %s: %w", to, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("failed to send digest: %w", err)
+	}
+	if _, err := w.Write(msg); err != nil {
+		return fmt.Errorf("failed to send digest: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to send digest: %w", err)
+	}
+	return c.Quit()
+}
+
+// address returns the bare address of "Name <addr>", as SMTP wants it.
+func address(s string) string {
+	if a, err := mail.ParseAddress(s); err == nil {
+		return a.Address
+	}
+	return s
+}
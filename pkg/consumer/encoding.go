@@ -0,0 +1,473 @@
+package consumer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/pkg/events"
+	"github.com/eurosky/firehose-processor-aas/pkg/firehose"
+	"github.com/eurosky/firehose-processor-aas/schema"
+	"github.com/nats-io/nats.go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// PayloadFormat selects the wire encoding of webhook payloads.
+type PayloadFormat string
+
+const (
+	FormatJSON     PayloadFormat = "json"
+	FormatProtobuf PayloadFormat = "protobuf"
+	FormatAvro     PayloadFormat = "avro"
+)
+
+// PayloadSchemaVersion is sent as X-Schema-Version with every webhook call.
+// It tracks the published schemas in the schema package.
+const PayloadSchemaVersion = events.SchemaVersion
+
+// payloadEncoder turns batches and single events into webhook request bodies.
+// The encode methods append the body to dst, which may be nil, so callers
+// that don't keep the body can reuse their buffers. Only the JSON format
+// carries the annotations other than meta.
+type payloadEncoder interface {
+	contentType() string
+	encodeBatch(dst []byte, consumer string, events [][]byte, ann annotations) ([]byte, error)
+	encodeEvent(dst []byte, consumer string, event []byte, ann annotations) ([]byte, error)
+	// headers returns extra headers describing the encoding (e.g. schema IDs).
+	headers(batch bool) map[string]string
+}
+
+// annotations are what the consumer found out about the events it delivers,
+// from the headers set after the fetch: the label values of their subjects,
+// when it annotates them, the keyword queries their posts matched, their
+// posts' languages, the thread context of their replies and the blobs
+// their records reference; and from the header the indexer sets: the
+// watched DIDs they concern.
+type annotations struct {
+	labels  map[string][]string
+	matches map[string][]string
+	langs   map[string][]string
+	watched map[string][]string
+	threads map[string]events.ThreadContext
+	blobs   map[string][]events.BlobRef
+	// meta is the JetStream metadata of every event, in order
+	meta []events.EventMeta
+}
+
+func annotationsOf(msgs ...*nats.Msg) annotations {
+	return annotations{labels: MessageLabels(msgs...), matches: MessageMatches(msgs...), langs: MessageLanguages(msgs...), watched: MessageWatched(msgs...), threads: MessageThreads(msgs...), blobs: MessageBlobs(msgs...), meta: MessageMeta(msgs...)}
+}
+
+// MessageMeta returns the JetStream metadata of msgs, in order, or nil when
+// none of them came from a stream.
+func MessageMeta(msgs ...*nats.Msg) []events.EventMeta {
+	var meta []events.EventMeta
+	for i, msg := range msgs {
+		var m events.EventMeta
+		if md, err := msg.Metadata(); err == nil {
+			m = events.EventMeta{StreamSeq: md.Sequence.Stream, ConsumerSeq: md.Sequence.Consumer, Timestamp: md.Timestamp.UTC(), NumDelivered: md.NumDelivered}
+		} else if m.StreamSeq = streamSeq(msg); m.StreamSeq == 0 {
+			continue
+		}
+		if meta == nil {
+			meta = make([]events.EventMeta, len(msgs))
+		}
+		meta[i] = m
+	}
+	return meta
+}
+
+func newPayloadEncoder(format PayloadFormat, registryURL string) (payloadEncoder, error) {
+	switch format {
+	case "", FormatJSON:
+		return jsonEncoder{}, nil
+	case FormatProtobuf:
+		return protobufEncoder{}, nil
+	case FormatAvro:
+		enc := &avroEncoder{}
+		if registryURL == "" {
+			return enc, nil
+		}
+		registry := &schemaRegistry{
+			url:        registryURL,
+			httpClient: &http.Client{Timeout: 10 * time.Second},
+		}
+		var err error
+		if enc.batchSchemaID, err = registry.register("fpaas.webhook.v2.Batch", schema.WebhookBatchAvro); err != nil {
+			return nil, err
+		}
+		if enc.eventSchemaID, err = registry.register("fpaas.webhook.v2.Event", schema.WebhookEventAvro); err != nil {
+			return nil, err
+		}
+		enc.registered = true
+		return enc, nil
+	default:
+		return nil, fmt.Errorf("unknown payload format %q", format)
+	}
+}
+
+type jsonEncoder struct{}
+
+func (jsonEncoder) contentType() string { return "application/json" }
+
+func (jsonEncoder) encodeBatch(dst []byte, consumer string, frames [][]byte, ann annotations) ([]byte, error) {
+	// Build payload - array of base64 encoded messages
+	return appendJSON(dst, events.Batch{
+		Consumer:  consumer,
+		Events:    frames,
+		Count:     len(frames),
+		Labels:    ann.labels,
+		Matches:   ann.matches,
+		Languages: ann.langs,
+		Watched:   ann.watched,
+		Threads:   ann.threads,
+		Blobs:     ann.blobs,
+		Meta:      ann.meta,
+	})
+}
+
+func (jsonEncoder) encodeEvent(dst []byte, consumer string, event []byte, ann annotations) ([]byte, error) {
+	// Single event payload for receivers that can't parse batches
+	return appendJSON(dst, events.Event{
+		Consumer:  consumer,
+		Event:     event,
+		Labels:    ann.labels,
+		Matches:   ann.matches,
+		Languages: ann.langs,
+		Watched:   ann.watched,
+		Threads:   ann.threads,
+		Blobs:     ann.blobs,
+		Meta:      eventMeta(ann.meta),
+	})
+}
+
+// eventMeta returns the metadata of a single event.
+func eventMeta(meta []events.EventMeta) *events.EventMeta {
+	if len(meta) == 0 {
+		return nil
+	}
+	return &meta[0]
+}
+
+// appendJSON appends the JSON encoding of v to dst. Unlike json.Marshal, it
+// writes straight into dst instead of copying the result out.
+func appendJSON(dst []byte, v any) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		return dst, err
+	}
+	// Encode ends the value with a newline
+	b := buf.Bytes()
+	return b[:len(b)-1], nil
+}
+
+func (jsonEncoder) headers(bool) map[string]string { return nil }
+
+// protobufEncoder writes the messages defined in schema/webhook.proto by hand,
+// which keeps protoc out of the build for four small messages.
+type protobufEncoder struct{}
+
+func (protobufEncoder) contentType() string { return "application/x-protobuf" }
+
+func (protobufEncoder) encodeBatch(dst []byte, consumer string, events [][]byte, ann annotations) ([]byte, error) {
+	b := protowire.AppendTag(dst, 1, protowire.BytesType)
+	b = protowire.AppendString(b, consumer)
+	var frame []byte
+	for i, e := range events {
+		f, err := decodeTyped(e)
+		if err != nil {
+			return dst, fmt.Errorf("event %d: %w", i, err)
+		}
+		frame = appendProtoFrame(frame[:0], f)
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, frame)
+	}
+	b = protowire.AppendTag(b, 3, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(len(events)))
+	for _, m := range ann.meta {
+		b = protowire.AppendTag(b, 4, protowire.BytesType)
+		b = protowire.AppendBytes(b, appendProtoMeta(frame[:0], m))
+	}
+	return b, nil
+}
+
+func (protobufEncoder) encodeEvent(dst []byte, consumer string, event []byte, ann annotations) ([]byte, error) {
+	f, err := decodeTyped(event)
+	if err != nil {
+		return dst, err
+	}
+	b := protowire.AppendTag(dst, 1, protowire.BytesType)
+	b = protowire.AppendString(b, consumer)
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	b = protowire.AppendBytes(b, appendProtoFrame(nil, f))
+	if m := eventMeta(ann.meta); m != nil {
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendBytes(b, appendProtoMeta(nil, *m))
+	}
+	return b, nil
+}
+
+// appendProtoMeta appends the Meta message of m to b.
+func appendProtoMeta(b []byte, m events.EventMeta) []byte {
+	b = appendProtoVarint(b, 1, m.StreamSeq)
+	b = appendProtoVarint(b, 2, m.ConsumerSeq)
+	b = appendProtoString(b, 3, metaTimestamp(m))
+	return appendProtoVarint(b, 4, m.NumDelivered)
+}
+
+// metaTimestamp returns the RFC 3339 timestamp of m, empty when it has none,
+// as the metadata of a manual redelivery.
+func metaTimestamp(m events.EventMeta) string {
+	if m.Timestamp.IsZero() {
+		return ""
+	}
+	return m.Timestamp.Format(time.RFC3339Nano)
+}
+
+// typedFrame is a frame as the protobuf and Avro payloads carry it.
+type typedFrame struct {
+	firehose.Event
+	Handle string
+	Active bool
+	Status string
+}
+
+// decodeTyped decodes a raw frame for the protobuf and Avro payloads. The
+// fields of identity and account frames come from their JSON form.
+func decodeTyped(raw []byte) (typedFrame, error) {
+	evt, err := firehose.DecodeFrame(raw)
+	if err != nil {
+		return typedFrame{}, err
+	}
+	f := typedFrame{Event: evt}
+	if evt.Type == firehose.TypeIdentity || evt.Type == firehose.TypeAccount {
+		var body struct {
+			Handle string `json:"handle"`
+			Active bool   `json:"active"`
+			Status string `json:"status"`
+		}
+		if err := json.Unmarshal(evt.Body, &body); err != nil {
+			return typedFrame{}, fmt.Errorf("failed to decode %s frame: %w", evt.Type, err)
+		}
+		f.Handle, f.Active, f.Status = body.Handle, body.Active, body.Status
+	}
+	return f, nil
+}
+
+// appendProtoFrame appends the Frame message of f to b. Empty fields are left
+// out, as proto3 does.
+func appendProtoFrame(b []byte, f typedFrame) []byte {
+	b = appendProtoVarint(b, 1, uint64(f.Seq))
+	b = appendProtoString(b, 2, f.DID)
+	b = appendProtoString(b, 3, f.Time)
+	b = appendProtoString(b, 4, f.Type)
+	b = appendProtoString(b, 5, f.Rev)
+	for _, op := range f.Ops {
+		b = protowire.AppendTag(b, 6, protowire.BytesType)
+		b = protowire.AppendBytes(b, appendProtoOp(nil, op))
+	}
+	b = appendProtoString(b, 7, f.Handle)
+	if f.Active {
+		b = appendProtoVarint(b, 8, 1)
+	}
+	b = appendProtoString(b, 9, f.Status)
+	b = appendProtoString(b, 10, string(f.Body))
+	return b
+}
+
+func appendProtoOp(b []byte, op firehose.Op) []byte {
+	b = appendProtoString(b, 1, op.Action)
+	b = appendProtoString(b, 2, op.Collection)
+	b = appendProtoString(b, 3, op.Rkey)
+	b = appendProtoString(b, 4, op.CID)
+	return appendProtoString(b, 5, string(op.Record))
+}
+
+func appendProtoVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendProtoString(b []byte, num protowire.Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
+
+func (protobufEncoder) headers(batch bool) map[string]string {
+	if batch {
+		return map[string]string{"X-Schema-Type": "fpaas.webhook.v2.Batch"}
+	}
+	return map[string]string{"X-Schema-Type": "fpaas.webhook.v2.Event"}
+}
+
+// avroEncoder writes Avro binary for the records in schema/*.avsc. When a
+// schema registry is configured, bodies use the Confluent wire format (magic
+// byte + 4-byte schema ID) so standard deserializers can decode them.
+type avroEncoder struct {
+	registered    bool
+	batchSchemaID int
+	eventSchemaID int
+}
+
+func (e *avroEncoder) contentType() string { return "avro/binary" }
+
+func (e *avroEncoder) encodeBatch(dst []byte, consumer string, events [][]byte, ann annotations) ([]byte, error) {
+	b := e.prefix(dst, e.batchSchemaID)
+	b = appendAvroString(b, consumer)
+	if len(events) > 0 {
+		b = appendAvroLong(b, int64(len(events)))
+		for i, ev := range events {
+			f, err := decodeTyped(ev)
+			if err != nil {
+				return dst, fmt.Errorf("event %d: %w", i, err)
+			}
+			b = appendAvroFrame(b, f)
+		}
+	}
+	b = appendAvroLong(b, 0) // end of array
+	b = appendAvroLong(b, int64(len(events)))
+	if len(ann.meta) > 0 {
+		b = appendAvroLong(b, int64(len(ann.meta)))
+		for _, m := range ann.meta {
+			b = appendAvroMeta(b, m)
+		}
+	}
+	b = appendAvroLong(b, 0) // end of array
+	return b, nil
+}
+
+func (e *avroEncoder) encodeEvent(dst []byte, consumer string, event []byte, ann annotations) ([]byte, error) {
+	f, err := decodeTyped(event)
+	if err != nil {
+		return dst, err
+	}
+	b := e.prefix(dst, e.eventSchemaID)
+	b = appendAvroString(b, consumer)
+	b = appendAvroFrame(b, f)
+	// The union index of null or Meta
+	m := eventMeta(ann.meta)
+	if m == nil {
+		return appendAvroLong(b, 0), nil
+	}
+	b = appendAvroLong(b, 1)
+	return appendAvroMeta(b, *m), nil
+}
+
+// appendAvroMeta appends the Meta record of m to b.
+func appendAvroMeta(b []byte, m events.EventMeta) []byte {
+	b = appendAvroLong(b, int64(m.StreamSeq))
+	b = appendAvroLong(b, int64(m.ConsumerSeq))
+	b = appendAvroString(b, metaTimestamp(m))
+	return appendAvroLong(b, int64(m.NumDelivered))
+}
+
+// appendAvroFrame appends the Frame record of f to b.
+func appendAvroFrame(b []byte, f typedFrame) []byte {
+	b = appendAvroLong(b, f.Seq)
+	b = appendAvroString(b, f.DID)
+	b = appendAvroString(b, f.Time)
+	b = appendAvroString(b, f.Type)
+	b = appendAvroString(b, f.Rev)
+	if len(f.Ops) > 0 {
+		b = appendAvroLong(b, int64(len(f.Ops)))
+		for _, op := range f.Ops {
+			b = appendAvroString(b, op.Action)
+			b = appendAvroString(b, op.Collection)
+			b = appendAvroString(b, op.Rkey)
+			b = appendAvroString(b, op.CID)
+			b = appendAvroString(b, string(op.Record))
+		}
+	}
+	b = appendAvroLong(b, 0) // end of array
+	b = appendAvroString(b, f.Handle)
+	b = appendAvroBool(b, f.Active)
+	b = appendAvroString(b, f.Status)
+	return appendAvroString(b, string(f.Body))
+}
+
+func (e *avroEncoder) headers(batch bool) map[string]string {
+	h := map[string]string{"X-Schema-Type": "fpaas.webhook.v2.Event"}
+	id := e.eventSchemaID
+	if batch {
+		h["X-Schema-Type"] = "fpaas.webhook.v2.Batch"
+		id = e.batchSchemaID
+	}
+	if e.registered {
+		h["X-Schema-Id"] = fmt.Sprintf("%d", id)
+	}
+	return h
+}
+
+func (e *avroEncoder) prefix(dst []byte, schemaID int) []byte {
+	if !e.registered {
+		return dst
+	}
+	b := append(dst, 0)
+	return binary.BigEndian.AppendUint32(b, uint32(schemaID))
+}
+
+func appendAvroLong(b []byte, v int64) []byte {
+	return binary.AppendUvarint(b, uint64((v<<1)^(v>>63)))
+}
+
+func appendAvroBool(b []byte, v bool) []byte {
+	if v {
+		return append(b, 1)
+	}
+	return append(b, 0)
+}
+
+func appendAvroString(b []byte, v string) []byte {
+	b = appendAvroLong(b, int64(len(v)))
+	return append(b, v...)
+}
+
+// schemaRegistry is a minimal client for the Confluent schema registry REST API.
+type schemaRegistry struct {
+	url        string
+	httpClient *http.Client
+}
+
+// register registers the schema under subject (a no-op on the registry side
+// if it already exists) and returns its global ID.
+func (r *schemaRegistry) register(subject, avsc string) (int, error) {
+	body, err := json.Marshal(map[string]string{"schema": avsc})
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal schema: %w", err)
+	}
+
+	endpoint := fmt.Sprintf("%s/subjects/%s/versions", r.url, url.PathEscape(subject))
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("failed to create schema registry request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/vnd.schemaregistry.v1+json")
+
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to register schema %s: %w", subject, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("schema registry returned non-OK status for %s: %d", subject, resp.StatusCode)
+	}
+
+	var out struct {
+		ID int `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return 0, fmt.Errorf("failed to decode schema registry response: %w", err)
+	}
+	return out.ID, nil
+}
@@ -0,0 +1,117 @@
+package consumer
+
+import (
+	"strings"
+
+	"github.com/eurosky/firehose-processor-aas/pkg/firehose"
+	"github.com/nats-io/nats.go"
+)
+
+// eventFilter selects the messages a consumer delivers. Messages that don't
+// match are acked without being delivered.
+type eventFilter struct {
+	types       map[string]bool
+	collections []string
+	// tombstones are the account statuses of the #account frames that
+	// match whatever the types and collections
+	tombstones map[string]bool
+}
+
+// newEventFilter returns nil when nothing is filtered. Collections only
+// restrict #commit frames and may end in ".*" to match an NSID prefix.
+// #account frames with a tombstone status match unless the types only
+// let through #account or #info frames, which carry no account's data.
+func newEventFilter(types, collections, tombstones []string) *eventFilter {
+	if len(types) == 0 && len(collections) == 0 {
+		return nil
+	}
+
+	f := &eventFilter{collections: collections}
+	if len(types) > 0 {
+		f.types = make(map[string]bool, len(types))
+		for _, t := range types {
+			f.types[t] = true
+		}
+	}
+	if len(tombstones) > 0 && (f.types == nil || f.types[firehose.TypeCommit] || f.types[firehose.TypeSync] || f.types[firehose.TypeIdentity]) {
+		f.tombstones = make(map[string]bool, len(tombstones))
+		for _, s := range tombstones {
+			f.tombstones[s] = true
+		}
+	}
+	return f
+}
+
+// Matcher returns whether a consumer filtering on types and collections, as
+// with Config.FrameTypes and Config.Collections, delivers a message.
+func Matcher(types, collections []string) func(msg *nats.Msg) bool {
+	return newEventFilter(types, collections, nil).matches
+}
+
+// matches is match for a filter that may be nil.
+func (f *eventFilter) matches(msg *nats.Msg) bool {
+	return f == nil || f.match(msg)
+}
+
+// split partitions msgs into the ones to deliver and the ones to skip.
+func (f *eventFilter) split(msgs []*nats.Msg) (deliver, skip []*nats.Msg) {
+	if f == nil {
+		return msgs, nil
+	}
+	for _, msg := range msgs {
+		if f.match(msg) {
+			deliver = append(deliver, msg)
+		} else {
+			skip = append(skip, msg)
+		}
+	}
+	return deliver, skip
+}
+
+func (f *eventFilter) match(msg *nats.Msg) bool {
+	// The shuffler sets the frame type header, which saves decoding
+	frameType := msg.Header.Get(firehose.HeaderFrameType)
+	if frameType == firehose.TypeAccount && f.tombstones[msg.Header.Get(firehose.HeaderAccountStatus)] {
+		return true
+	}
+	if frameType != "" && f.types != nil && !f.types[frameType] {
+		return false
+	}
+	if frameType != "" && (len(f.collections) == 0 || frameType != firehose.TypeCommit) {
+		return true
+	}
+
+	info, err := firehose.InspectFrame(msg.Data)
+	if err != nil {
+		// Don't silently drop what we can't read
+		return true
+	}
+	if info.Type == firehose.TypeAccount && f.tombstones[info.Status] {
+		return true
+	}
+	if f.types != nil && !f.types[info.Type] {
+		return false
+	}
+	if len(f.collections) == 0 || info.Type != firehose.TypeCommit {
+		return true
+	}
+	for _, c := range info.Collections {
+		if f.matchCollection(c) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *eventFilter) matchCollection(collection string) bool {
+	for _, pattern := range f.collections {
+		if prefix, ok := strings.CutSuffix(pattern, ".*"); ok {
+			if strings.HasPrefix(collection, prefix+".") {
+				return true
+			}
+		} else if collection == pattern {
+			return true
+		}
+	}
+	return false
+}
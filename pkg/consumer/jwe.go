@@ -0,0 +1,67 @@
+package consumer
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+// jweContentType is the Content-Type of encrypted webhook bodies. The
+// original payload content type is sent in X-Payload-Content-Type.
+const jweContentType = "application/jose"
+
+// newJWEEncrypter loads a PEM encoded RSA or EC public key and returns an
+// encrypter producing compact JWE with A256GCM content encryption.
+func newJWEEncrypter(keyFile, keyID string) (jose.Encrypter, error) {
+	raw, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read JWE public key: %w", err)
+	}
+
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, fmt.Errorf("JWE public key %s is not PEM encoded", keyFile)
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse JWE public key: %w", err)
+	}
+
+	var alg jose.KeyAlgorithm
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		alg = jose.RSA_OAEP_256
+	case *ecdsa.PublicKey:
+		alg = jose.ECDH_ES_A256KW
+	default:
+		return nil, fmt.Errorf("unsupported JWE public key type %T", pub)
+	}
+
+	enc, err := jose.NewEncrypter(jose.A256GCM, jose.Recipient{
+		Algorithm: alg,
+		Key:       pub,
+		KeyID:     keyID,
+	}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create JWE encrypter: %w", err)
+	}
+	return enc, nil
+}
+
+func encryptJWE(enc jose.Encrypter, body []byte) ([]byte, error) {
+	obj, err := enc.Encrypt(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt payload: %w", err)
+	}
+	compact, err := obj.CompactSerialize()
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize JWE: %w", err)
+	}
+	return []byte(compact), nil
+}
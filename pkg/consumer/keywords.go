@@ -0,0 +1,325 @@
+package consumer
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/eurosky/firehose-processor-aas/pkg/firehose"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// KeywordBucket holds the keyword queries of the consumers that filter
+	// on them (see Config.KeywordQueries), keyed <consumer>.<query id>.
+	KeywordBucket = "fpaas_keyword_queries"
+
+	// MaxKeywordQueryLength and MaxKeywordQueryTerms bound a query.
+	MaxKeywordQueryLength = 256
+	MaxKeywordQueryTerms  = 8
+
+	// headerMatches carries, on the messages a keyword consumer delivers,
+	// the JSON object of the at:// URIs of their posts and the queries each
+	// matched. It is set after the fetch, never in the stream.
+	headerMatches = "Fpaas-Matches"
+)
+
+// KeywordQuery is a query a keyword consumer delivers the matching posts of.
+// Query is words a post's text must all contain, case-insensitively, and
+// "quoted phrases" whose words it must contain in order; a leading - leaves
+// out the posts containing a word or phrase. Words are runs of letters and
+// digits, so "#golang" matches the word golang and "e-mail" the phrase
+// "e mail".
+type KeywordQuery struct {
+	ID        string    `json:"id"`
+	Query     string    `json:"query"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Validate checks the query's syntax and size.
+func (q KeywordQuery) Validate() error {
+	_, err := parseKeywordQuery(q.Query)
+	return err
+}
+
+// KeywordKey is the key of a consumer's query in KeywordBucket.
+func KeywordKey(consumer, id string) string {
+	return consumer + "." + id
+}
+
+// EnsureKeywordBucket opens KeywordBucket, creating it if it doesn't exist.
+func EnsureKeywordBucket(js nats.JetStreamContext) (nats.KeyValue, error) {
+	return firehose.OpenKeyValue(js, &nats.KeyValueConfig{Bucket: KeywordBucket, History: 1})
+}
+
+// keywordQuery is a parsed KeywordQuery: the phrases, of one word or more,
+// a post must and must not contain.
+type keywordQuery struct {
+	include [][]string
+	exclude [][]string
+}
+
+func parseKeywordQuery(s string) (keywordQuery, error) {
+	var q keywordQuery
+	if utf8.RuneCountInString(s) > MaxKeywordQueryLength {
+		return q, fmt.Errorf("keyword query is longer than %d characters", MaxKeywordQueryLength)
+	}
+	rest := strings.TrimSpace(s)
+	for rest != "" {
+		negate := false
+		if r, ok := strings.CutPrefix(rest, "-"); ok {
+			negate, rest = true, r
+		}
+		var token string
+		if r, ok := strings.CutPrefix(rest, `"`); ok {
+			end := strings.IndexByte(r, '"')
+			if end < 0 {
+				return q, fmt.Errorf("unterminated phrase in keyword query %q", s)
+			}
+			token, rest = r[:end], r[end+1:]
+		} else {
+			token, rest, _ = strings.Cut(rest, " ")
+		}
+		rest = strings.TrimSpace(rest)
+		words := keywordWords(token)
+		if len(words) == 0 {
+			continue
+		}
+		if negate {
+			q.exclude = append(q.exclude, words)
+		} else {
+			q.include = append(q.include, words)
+		}
+	}
+	if len(q.include) == 0 {
+		return q, fmt.Errorf("keyword query %q has no word to match", s)
+	}
+	if len(q.include)+len(q.exclude) > MaxKeywordQueryTerms {
+		return q, fmt.Errorf("keyword query has more than %d words and phrases", MaxKeywordQueryTerms)
+	}
+	return q, nil
+}
+
+// keywordWords splits text into lowercase words.
+func keywordWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// indexTerm is the word the query is indexed under: its longest required
+// one, likely the rarest.
+func (q keywordQuery) indexTerm() string {
+	var term string
+	for _, phrase := range q.include {
+		for _, w := range phrase {
+			if len(w) > len(term) {
+				term = w
+			}
+		}
+	}
+	return term
+}
+
+func (q keywordQuery) matches(words []string) bool {
+	for _, phrase := range q.include {
+		if !containsPhrase(words, phrase) {
+			return false
+		}
+	}
+	for _, phrase := range q.exclude {
+		if containsPhrase(words, phrase) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsPhrase(words, phrase []string) bool {
+	for i := 0; i+len(phrase) <= len(words); i++ {
+		if slices.Equal(words[i:i+len(phrase)], phrase) {
+			return true
+		}
+	}
+	return false
+}
+
+// keywordFilter delivers the posts matching a consumer's keyword queries,
+// which it watches in KeywordBucket, and leaves out every other event. The
+// queries are indexed by a word each must contain, so a post is only checked
+// against the queries indexed under its words.
+type keywordFilter struct {
+	watcher nats.KeyWatcher
+	prefix  string
+	logger  *slog.Logger
+
+	mu      sync.RWMutex
+	queries map[string]keywordQuery
+	index   map[string][]string
+}
+
+// watchKeywords returns the filter of consumer's queries once it loaded
+// those stored.
+func watchKeywords(js nats.JetStreamContext, consumer string, logger *slog.Logger) (*keywordFilter, error) {
+	kv, err := EnsureKeywordBucket(js)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open keyword bucket: %w", err)
+	}
+	prefix := KeywordKey(consumer, "")
+	watcher, err := kv.Watch(prefix + "*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to watch keyword queries: %w", err)
+	}
+	f := &keywordFilter{
+		watcher: watcher,
+		prefix:  prefix,
+		logger:  logger,
+		queries: make(map[string]keywordQuery),
+		index:   make(map[string][]string),
+	}
+	// The stored queries come first, then nil
+	for entry := range watcher.Updates() {
+		if entry == nil {
+			break
+		}
+		f.apply(entry)
+	}
+	go func() {
+		for entry := range watcher.Updates() {
+			if entry != nil {
+				f.apply(entry)
+			}
+		}
+	}()
+	return f, nil
+}
+
+// Stop stops watching the queries.
+func (f *keywordFilter) Stop() {
+	if f != nil {
+		f.watcher.Stop()
+	}
+}
+
+func (f *keywordFilter) apply(entry nats.KeyValueEntry) {
+	id := strings.TrimPrefix(entry.Key(), f.prefix)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.queries, id)
+	if entry.Operation() == nats.KeyValuePut {
+		var kq KeywordQuery
+		q, err := keywordQuery{}, json.Unmarshal(entry.Value(), &kq)
+		if err == nil {
+			q, err = parseKeywordQuery(kq.Query)
+		}
+		if err != nil {
+			f.logger.Warn("ignoring invalid keyword query", "query", id, "error", err)
+		} else {
+			f.queries[id] = q
+		}
+	}
+	// Small next to the posts matched between changes, so rebuilt in full
+	f.index = make(map[string][]string, len(f.queries))
+	for id, q := range f.queries {
+		term := q.indexTerm()
+		f.index[term] = append(f.index[term], id)
+	}
+}
+
+// split returns the messages with a matching post, annotated with the
+// queries each matched, and the others to skip.
+func (f *keywordFilter) split(msgs []*nats.Msg) (deliver, skip []*nats.Msg) {
+	if f == nil {
+		return msgs, nil
+	}
+	for _, msg := range msgs {
+		matches := f.match(msg.Data)
+		if matches == nil {
+			skip = append(skip, msg)
+			continue
+		}
+		data, _ := json.Marshal(matches)
+		annotated := *msg
+		annotated.Header = maps.Clone(msg.Header)
+		if annotated.Header == nil {
+			annotated.Header = nats.Header{}
+		}
+		annotated.Header.Set(headerMatches, string(data))
+		deliver = append(deliver, &annotated)
+	}
+	return deliver, skip
+}
+
+// match returns the IDs of the queries the posts created or edited by a
+// frame match, by at:// URI, or nil when none does.
+func (f *keywordFilter) match(data []byte) map[string][]string {
+	evt, err := firehose.DecodeFrame(data)
+	if err != nil || len(evt.Ops) == 0 {
+		return nil
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	var matches map[string][]string
+	for _, op := range evt.Ops {
+		if op.Collection != "app.bsky.feed.post" || op.Action == "delete" {
+			continue
+		}
+		var record struct {
+			Text string `json:"text"`
+		}
+		if json.Unmarshal(op.Record, &record) != nil || record.Text == "" {
+			continue
+		}
+		words := keywordWords(record.Text)
+		var matched []string
+		seen := make(map[string]bool, len(words))
+		for _, w := range words {
+			if seen[w] {
+				continue
+			}
+			seen[w] = true
+			for _, id := range f.index[w] {
+				if f.queries[id].matches(words) {
+					matched = append(matched, id)
+				}
+			}
+		}
+		if len(matched) > 0 {
+			if matches == nil {
+				matches = make(map[string][]string)
+			}
+			slices.Sort(matched)
+			matches["at://"+evt.DID+"/"+op.Collection+"/"+op.Rkey] = matched
+		}
+	}
+	return matches
+}
+
+// MessageMatches merges the keyword matches of msgs (see
+// Config.KeywordQueries), nil when there are none. Custom Deliverers read
+// them with it.
+func MessageMatches(msgs ...*nats.Msg) map[string][]string {
+	var matches map[string][]string
+	for _, msg := range msgs {
+		h := msg.Header.Get(headerMatches)
+		if h == "" {
+			continue
+		}
+		var m map[string][]string
+		if json.Unmarshal([]byte(h), &m) != nil {
+			continue
+		}
+		if matches == nil {
+			matches = make(map[string][]string, len(m))
+		}
+		maps.Copy(matches, m)
+	}
+	return matches
+}
@@ -0,0 +1,126 @@
+package consumer
+
+import (
+	"encoding/json"
+	"maps"
+	"slices"
+
+	"github.com/eurosky/firehose-processor-aas/pkg/firehose"
+	"github.com/nats-io/nats.go"
+)
+
+// headerLabels carries, on the messages a consumer annotates, the JSON
+// object of their subjects' label values. It is set after the fetch, never
+// in the stream.
+const headerLabels = "Fpaas-Labels"
+
+// labelFilter leaves out the messages whose subjects carry an excluded label
+// and annotates the others with the labels to pass on.
+type labelFilter struct {
+	index    *firehose.LabelIndex
+	exclude  []string
+	annotate []string
+}
+
+// newLabelFilter returns nil when there is nothing to exclude or annotate.
+func newLabelFilter(index *firehose.LabelIndex, exclude, annotate []string) *labelFilter {
+	if len(exclude) == 0 && len(annotate) == 0 {
+		return nil
+	}
+	return &labelFilter{index: index, exclude: exclude, annotate: annotate}
+}
+
+// split returns the messages to deliver, copies of the originals when
+// annotated, and the ones to skip.
+func (f *labelFilter) split(msgs []*nats.Msg) (deliver, skip []*nats.Msg) {
+	if f == nil {
+		return msgs, nil
+	}
+	for _, msg := range msgs {
+		excluded, annotations := f.check(msg)
+		switch {
+		case excluded:
+			skip = append(skip, msg)
+		case annotations != nil:
+			data, _ := json.Marshal(annotations)
+			annotated := *msg
+			annotated.Header = maps.Clone(msg.Header)
+			if annotated.Header == nil {
+				annotated.Header = nats.Header{}
+			}
+			annotated.Header.Set(headerLabels, string(data))
+			deliver = append(deliver, &annotated)
+		default:
+			deliver = append(deliver, msg)
+		}
+	}
+	return deliver, skip
+}
+
+// excludes returns whether msg is left out. It is safe to call on a nil
+// filter, which excludes nothing.
+func (f *labelFilter) excludes(msg *nats.Msg) bool {
+	if f == nil || len(f.exclude) == 0 {
+		return false
+	}
+	excluded, _ := f.check(msg)
+	return excluded
+}
+
+// check returns whether msg is left out and, if not, the labels to annotate
+// it with, nil when there are none. Frames that can't be decoded are
+// delivered as they are.
+func (f *labelFilter) check(msg *nats.Msg) (bool, map[string][]string) {
+	info, err := firehose.InspectFrame(msg.Data)
+	if err != nil {
+		return false, nil
+	}
+	var annotations map[string][]string
+	for _, subject := range firehose.LabelSubjects(info) {
+		var passed []string
+		for _, val := range f.index.Labels(subject) {
+			if matchLabel(f.exclude, val) {
+				return true, nil
+			}
+			if matchLabel(f.annotate, val) {
+				passed = append(passed, val)
+			}
+		}
+		if len(passed) > 0 {
+			if annotations == nil {
+				annotations = make(map[string][]string)
+			}
+			annotations[subject] = passed
+		}
+	}
+	return false, annotations
+}
+
+// matchLabel returns whether val is one of patterns, or patterns hold "*".
+func matchLabel(patterns []string, val string) bool {
+	return slices.Contains(patterns, val) || slices.Contains(patterns, "*")
+}
+
+// MessageLabels merges the label annotations of msgs (see
+// Config.AnnotateLabels), nil when there are none. Custom Deliverers read
+// them with it.
+func MessageLabels(msgs ...*nats.Msg) map[string][]string {
+	var labels map[string][]string
+	for _, msg := range msgs {
+		h := msg.Header.Get(headerLabels)
+		if h == "" {
+			continue
+		}
+		var m map[string][]string
+		if json.Unmarshal([]byte(h), &m) != nil {
+			continue
+		}
+		if labels == nil {
+			labels = make(map[string][]string, len(m))
+		}
+		for subject, vals := range m {
+			labels[subject] = vals
+		}
+	}
+	return labels
+}
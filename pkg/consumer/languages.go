@@ -0,0 +1,201 @@
+package consumer
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/eurosky/firehose-processor-aas/pkg/firehose"
+	"github.com/nats-io/nats.go"
+	"github.com/pemistahl/lingua-go"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// headerLanguages carries, on the messages a consumer annotates, the JSON
+// object of the languages of their posts. It is set after the fetch, never
+// in the stream.
+const headerLanguages = "Fpaas-Languages"
+
+var postLanguages = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "consumer_post_languages_total",
+	Help: "Posts whose language consumers looked up, by source (tagged by the record's langs, detected from its text, unknown)",
+}, []string{"source"})
+
+func init() {
+	prometheus.MustRegister(postLanguages)
+}
+
+// languageDetector identifies the language of the posts without langs,
+// shared by all consumers so its models are loaded once. Low accuracy mode
+// only loads the trigram models, some 40MB rather than 700MB; the minimum
+// distance leaves the texts too short to tell, such as "lol", unknown
+// rather than guess.
+var languageDetector = sync.OnceValue(func() lingua.LanguageDetector {
+	return lingua.NewLanguageDetectorBuilder().
+		FromAllSpokenLanguages().
+		WithLowAccuracyMode().
+		WithMinimumRelativeDistance(0.05).
+		Build()
+})
+
+// languageFilter annotates the posts a consumer delivers with their
+// languages and, with languages set, restricts delivery to the posts in
+// them.
+type languageFilter struct {
+	// languages are ISO 639 codes, nil when the filter only annotates
+	languages []string
+}
+
+// newLanguageFilter returns the filter of cfg, nil when it neither filters
+// on nor annotates languages.
+func newLanguageFilter(cfg Config) *languageFilter {
+	if !cfg.DetectLanguages && len(cfg.Languages) == 0 {
+		return nil
+	}
+	f := &languageFilter{}
+	for _, lang := range cfg.Languages {
+		f.languages = append(f.languages, primaryLanguage(lang))
+	}
+	return f
+}
+
+// validateLanguages checks the codes of a language filter.
+func validateLanguages(languages []string) error {
+	for _, lang := range languages {
+		if len(lang) < 2 || len(lang) > 3 || strings.Trim(strings.ToLower(lang), "abcdefghijklmnopqrstuvwxyz") != "" {
+			return fmt.Errorf("languages must be ISO 639 codes, e.g. en or pt, got %q", lang)
+		}
+	}
+	return nil
+}
+
+// split annotates the messages whose posts have a known language, and sets
+// aside, when the filter has languages, those without a post in one of
+// them. It is safe to call on a nil filter.
+func (f *languageFilter) split(msgs []*nats.Msg) (deliver, skip []*nats.Msg) {
+	if f == nil {
+		return msgs, nil
+	}
+	for _, msg := range msgs {
+		langs := messageLanguages(msg.Data)
+		if f.languages != nil && !f.matches(langs) {
+			skip = append(skip, msg)
+			continue
+		}
+		if langs == nil {
+			deliver = append(deliver, msg)
+			continue
+		}
+		data, _ := json.Marshal(langs)
+		annotated := *msg
+		annotated.Header = maps.Clone(msg.Header)
+		if annotated.Header == nil {
+			annotated.Header = nats.Header{}
+		}
+		annotated.Header.Set(headerLanguages, string(data))
+		deliver = append(deliver, &annotated)
+	}
+	return deliver, skip
+}
+
+// matches reports whether one of the posts is in one of f.languages.
+func (f *languageFilter) matches(langs map[string][]string) bool {
+	for _, post := range langs {
+		for _, lang := range post {
+			if slices.Contains(f.languages, lang) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// messageLanguages returns the languages of the posts a frame creates or
+// edits, by the posts' at:// URIs, or nil when it has none. A post's
+// languages are those its langs tag, or else the one detected from its
+// text; posts whose language is unknown are left out.
+func messageLanguages(data []byte) map[string][]string {
+	info, err := firehose.InspectFrame(data)
+	if err != nil || !slices.Contains(info.Collections, "app.bsky.feed.post") {
+		return nil
+	}
+	evt, err := firehose.DecodeFrame(data)
+	if err != nil {
+		return nil
+	}
+	var langs map[string][]string
+	for _, op := range evt.Ops {
+		if op.Collection != "app.bsky.feed.post" || op.Action == "delete" {
+			continue
+		}
+		var record struct {
+			Text  string   `json:"text"`
+			Langs []string `json:"langs"`
+		}
+		if json.Unmarshal(op.Record, &record) != nil {
+			continue
+		}
+		post := postLanguage(record.Text, record.Langs)
+		if post == nil {
+			continue
+		}
+		if langs == nil {
+			langs = make(map[string][]string)
+		}
+		langs["at://"+evt.DID+"/"+op.Collection+"/"+op.Rkey] = post
+	}
+	return langs
+}
+
+// postLanguage returns the ISO 639 codes of a post's languages, from its
+// BCP 47 langs or, without any, detected from its text.
+func postLanguage(text string, tags []string) []string {
+	var langs []string
+	for _, tag := range tags {
+		if lang := primaryLanguage(tag); lang != "" && !slices.Contains(langs, lang) {
+			langs = append(langs, lang)
+		}
+	}
+	if langs != nil {
+		postLanguages.WithLabelValues("tagged").Inc()
+		return langs
+	}
+	if lang, ok := languageDetector().DetectLanguageOf(text); ok {
+		postLanguages.WithLabelValues("detected").Inc()
+		return []string{strings.ToLower(lang.IsoCode639_1().String())}
+	}
+	postLanguages.WithLabelValues("unknown").Inc()
+	return nil
+}
+
+// primaryLanguage returns the language subtag of a BCP 47 tag, lowercased:
+// en for en-US.
+func primaryLanguage(tag string) string {
+	lang, _, _ := strings.Cut(tag, "-")
+	return strings.ToLower(strings.TrimSpace(lang))
+}
+
+// MessageLanguages merges the post languages of msgs (see
+// Config.DetectLanguages), nil when there are none. Custom Deliverers read
+// them with it.
+func MessageLanguages(msgs ...*nats.Msg) map[string][]string {
+	var langs map[string][]string
+	for _, msg := range msgs {
+		h := msg.Header.Get(headerLanguages)
+		if h == "" {
+			continue
+		}
+		var m map[string][]string
+		if json.Unmarshal([]byte(h), &m) != nil {
+			continue
+		}
+		if langs == nil {
+			langs = make(map[string][]string, len(m))
+		}
+		maps.Copy(langs, m)
+	}
+	return langs
+}
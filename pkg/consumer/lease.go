@@ -0,0 +1,268 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/pkg/firehose"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// LeaseBucket holds the consumer leases and the instances sharing them.
+	// Its TTL is the lease TTL: an instance that stops renewing loses its
+	// leases when their entries expire.
+	LeaseBucket = "fpaas_consumer_leases"
+
+	leaseKeyPrefix  = "lease."
+	memberKeyPrefix = "member."
+)
+
+var errStopped = errors.New("consumer stopped")
+
+// LeaseConfig configures consumer leases.
+type LeaseConfig struct {
+	// InstanceID is stored in the leases; it must be unique per instance.
+	InstanceID string
+	LeaseTTL   time.Duration
+}
+
+// Leases share the consumers of a deployment between its instances: a
+// consumer only runs on the instance holding its lease in NATS KV, so
+// replicas never pull from the same durable. Instances announce themselves
+// in the bucket and hold at most their fair share of the consumers, handing
+// the others over as replicas join; the leases of an instance that dies
+// expire and are taken over by the others. Every instance must run the same
+// consumers.
+type Leases struct {
+	kv     nats.KeyValue
+	nc     *nats.Conn
+	id     string
+	ttl    time.Duration
+	logger *slog.Logger
+
+	mu       sync.Mutex
+	wanted   int // consumers run through Run
+	held     int
+	yielding int // held leases being handed over
+	members  atomic.Int64
+	stop     context.CancelFunc
+	done     chan struct{}
+}
+
+// NewLeases connects to NATS and starts announcing the instance until Close.
+func NewLeases(natsURL string, cfg LeaseConfig, logger *slog.Logger) (*Leases, error) {
+	if cfg.InstanceID == "" {
+		return nil, errors.New("instance id is required")
+	}
+	if cfg.LeaseTTL < 3*time.Second {
+		return nil, errors.New("lease ttl must be at least 3s")
+	}
+	nc, err := nats.Connect(natsURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+	js, err := nc.JetStream()
+	if err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("failed to create JetStream context: %w", err)
+	}
+	kv, err := EnsureLeaseBucket(js, cfg.LeaseTTL)
+	if err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("failed to open lease bucket: %w", err)
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	l := &Leases{kv: kv, nc: nc, id: cfg.InstanceID, ttl: cfg.LeaseTTL, logger: logger, stop: stop, done: make(chan struct{})}
+	l.members.Store(1)
+	l.announce()
+	go l.heartbeat(ctx)
+	return l, nil
+}
+
+// EnsureLeaseBucket opens LeaseBucket, creating it with leases of ttl if it
+// doesn't exist.
+func EnsureLeaseBucket(js nats.JetStreamContext, ttl time.Duration) (nats.KeyValue, error) {
+	return firehose.OpenKeyValue(js, &nats.KeyValueConfig{Bucket: LeaseBucket, TTL: ttl, History: 1})
+}
+
+// Close stops announcing the instance. Leases still held expire.
+func (l *Leases) Close() {
+	l.stop()
+	<-l.done
+	l.kv.Delete(memberKeyPrefix + l.id)
+	l.nc.Close()
+}
+
+// Members returns how many instances share the consumers.
+func (l *Leases) Members() int {
+	return int(l.members.Load())
+}
+
+// Held returns how many leases the instance holds.
+func (l *Leases) Held() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.held
+}
+
+func (l *Leases) heartbeat(ctx context.Context) {
+	defer close(l.done)
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			l.announce()
+		}
+	}
+}
+
+// announce renews the instance's membership and counts the members.
+func (l *Leases) announce() {
+	if _, err := l.kv.Put(memberKeyPrefix+l.id, []byte(l.id)); err != nil {
+		l.logger.Warn("failed to announce instance", "instance", l.id, "error", err)
+		return
+	}
+	keys, err := l.kv.Keys()
+	if err != nil {
+		l.logger.Warn("failed to count instances", "error", err)
+		return
+	}
+	n := 0
+	for _, k := range keys {
+		if strings.HasPrefix(k, memberKeyPrefix) {
+			n++
+		}
+	}
+	l.members.Store(int64(max(n, 1)))
+}
+
+// share is how many consumers the instance should hold. l.mu is held.
+func (l *Leases) share() int {
+	members := int(l.members.Load())
+	return max((l.wanted+members-1)/members, 1)
+}
+
+// Run runs the consumer name while the instance holds its lease, until ctx
+// is done or run returns on its own: run's context is canceled when the
+// lease is lost or handed over, and Run then waits for the lease again.
+func (l *Leases) Run(ctx context.Context, name string, run func(ctx context.Context)) {
+	l.mu.Lock()
+	l.wanted++
+	l.mu.Unlock()
+	defer func() {
+		l.mu.Lock()
+		l.wanted--
+		l.mu.Unlock()
+	}()
+
+	key := leaseKeyPrefix + name
+	for ctx.Err() == nil {
+		rev, err := l.acquire(ctx, key)
+		if err != nil {
+			return
+		}
+		l.logger.Info("acquired consumer lease", "consumer", name, "instance", l.id)
+
+		lctx, cancel := context.WithCancelCause(ctx)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			run(lctx)
+		}()
+		cause, yielded := l.hold(lctx, done, key, &rev)
+		cancel(cause)
+		<-done
+
+		l.mu.Lock()
+		l.held--
+		if yielded {
+			l.yielding--
+		}
+		l.mu.Unlock()
+		l.kv.Delete(key, nats.LastRevision(rev))
+		if ctx.Err() != nil || errors.Is(cause, errStopped) {
+			return
+		}
+		l.logger.Info("released consumer lease", "consumer", name, "instance", l.id, "reason", cause)
+	}
+}
+
+// acquire blocks until the instance holds the lease at key, with room in its
+// share, or ctx is done. A lease left by a previous run of the same instance
+// is taken over right away.
+func (l *Leases) acquire(ctx context.Context, key string) (uint64, error) {
+	for {
+		l.mu.Lock()
+		room := l.held < l.share()
+		if room {
+			// Reserved while trying, so concurrent Runs don't overshoot
+			l.held++
+		}
+		l.mu.Unlock()
+
+		if room {
+			rev, err := l.kv.Create(key, []byte(l.id))
+			if errors.Is(err, nats.ErrKeyExists) {
+				if e, gerr := l.kv.Get(key); gerr == nil && string(e.Value()) == l.id {
+					rev, err = l.kv.Update(key, []byte(l.id), e.Revision())
+				}
+			}
+			if err == nil {
+				return rev, nil
+			}
+			l.mu.Lock()
+			l.held--
+			l.mu.Unlock()
+		}
+
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(l.ttl / 3):
+		}
+	}
+}
+
+// hold renews the lease at key until ctx is done, the consumer stops, the
+// lease is lost, or the instance holds more than its share and hands it over.
+func (l *Leases) hold(ctx context.Context, stopped <-chan struct{}, key string, rev *uint64) (cause error, yielded bool) {
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return context.Cause(ctx), false
+		case <-stopped:
+			return errStopped, false
+		case <-ticker.C:
+		}
+
+		l.mu.Lock()
+		over := l.held-l.yielding > l.share()
+		if over {
+			// Counted now, so only the extra leases are handed over
+			l.yielding++
+		}
+		l.mu.Unlock()
+		if over {
+			return errors.New("handed over to another instance"), true
+		}
+
+		r, err := l.kv.Update(key, []byte(l.id), *rev)
+		if err != nil {
+			return fmt.Errorf("lost consumer lease: %w", err), false
+		}
+		*rev = r
+	}
+}
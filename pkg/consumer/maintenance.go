@@ -0,0 +1,158 @@
+package consumer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/pkg/firehose"
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// MaintenanceBucket holds the cluster-wide maintenance switch: while
+	// its key is set, every consumer following it stops pulling, leaving
+	// its durable where it is, and resumes once the key is deleted.
+	MaintenanceBucket = "fpaas_maintenance"
+	maintenanceKey    = "pause"
+)
+
+var maintenancePaused = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "consumer_maintenance_paused",
+	Help: "1 while delivery is paused by maintenance mode",
+})
+
+func init() {
+	prometheus.MustRegister(maintenancePaused)
+}
+
+// Maintenance is the value of the maintenance switch while it is set.
+type Maintenance struct {
+	Reason string    `json:"reason,omitempty"`
+	Since  time.Time `json:"since"`
+}
+
+// EnsureMaintenanceBucket opens MaintenanceBucket, creating it if it doesn't
+// exist.
+func EnsureMaintenanceBucket(js nats.JetStreamContext) (nats.KeyValue, error) {
+	return firehose.OpenKeyValue(js, &nats.KeyValueConfig{Bucket: MaintenanceBucket, History: 1})
+}
+
+// SetMaintenance pauses delivery cluster-wide.
+func SetMaintenance(kv nats.KeyValue, m Maintenance) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = kv.Put(maintenanceKey, data)
+	return err
+}
+
+// ClearMaintenance resumes delivery. Clearing an unset switch is a no-op.
+func ClearMaintenance(kv nats.KeyValue) error {
+	if err := kv.Delete(maintenanceKey); err != nil && !errors.Is(err, nats.ErrKeyNotFound) {
+		return err
+	}
+	return nil
+}
+
+// GetMaintenance returns the maintenance switch, nil when it isn't set.
+func GetMaintenance(kv nats.KeyValue) (*Maintenance, error) {
+	entry, err := kv.Get(maintenanceKey)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var m Maintenance
+	if err := json.Unmarshal(entry.Value(), &m); err != nil {
+		return nil, fmt.Errorf("failed to decode maintenance switch: %w", err)
+	}
+	return &m, nil
+}
+
+// MaintenanceSwitch follows the maintenance switch of MaintenanceBucket
+// (see Config.Maintenance). Consumers sharing one share its watch.
+type MaintenanceSwitch struct {
+	watcher nats.KeyWatcher
+	logger  *slog.Logger
+
+	mu      sync.RWMutex
+	current *Maintenance
+}
+
+// WatchMaintenance opens MaintenanceBucket, creating it if needed, and
+// returns a switch following it until Stop.
+func WatchMaintenance(js nats.JetStreamContext, logger *slog.Logger) (*MaintenanceSwitch, error) {
+	kv, err := EnsureMaintenanceBucket(js)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open maintenance bucket: %w", err)
+	}
+	watcher, err := kv.Watch(maintenanceKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to watch maintenance bucket: %w", err)
+	}
+	s := &MaintenanceSwitch{watcher: watcher, logger: logger}
+
+	// The watcher sends the current entry, if any, then nil
+	for entry := range watcher.Updates() {
+		if entry == nil {
+			break
+		}
+		s.update(entry)
+	}
+	go func() {
+		for entry := range watcher.Updates() {
+			if entry != nil {
+				s.update(entry)
+			}
+		}
+	}()
+	return s, nil
+}
+
+func (s *MaintenanceSwitch) update(entry nats.KeyValueEntry) {
+	var current *Maintenance
+	if entry.Operation() == nats.KeyValuePut {
+		var m Maintenance
+		if err := json.Unmarshal(entry.Value(), &m); err != nil {
+			// Paused all the same: whoever set it meant to
+			s.logger.Warn("maintenance switch is undecodable, pausing anyway", "error", err)
+		}
+		current = &m
+	}
+	s.mu.Lock()
+	s.current = current
+	s.mu.Unlock()
+	if current != nil {
+		maintenancePaused.Set(1)
+	} else {
+		maintenancePaused.Set(0)
+	}
+}
+
+// Paused returns the maintenance switch and whether it is set. It is safe to
+// call on a nil switch, which never is.
+func (s *MaintenanceSwitch) Paused() (Maintenance, bool) {
+	if s == nil {
+		return Maintenance{}, false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.current == nil {
+		return Maintenance{}, false
+	}
+	return *s.current, true
+}
+
+// Stop stops following the switch.
+func (s *MaintenanceSwitch) Stop() {
+	if s != nil {
+		s.watcher.Stop()
+	}
+}
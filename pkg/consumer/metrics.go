@@ -0,0 +1,84 @@
+package consumer
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/pkg/firehose"
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var e2eDeliveryLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name: "e2e_delivery_latency_seconds",
+	Help: "Time from the firehose event timestamp to successful delivery (webhook 200 or target ack)",
+	// Poll intervals are minutes long, so the tail matters more than the head
+	Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600},
+}, []string{"consumer"})
+
+var (
+	deliveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "consumer_deliveries_total",
+		Help: "Delivery attempts (of a batch, or of an event with event granularity) by result (success, partial, failure)",
+	}, []string{"consumer", "target", "result"})
+	deliveryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "consumer_delivery_duration_seconds",
+		Help:    "Duration of delivery attempts, from handing messages to the target to its answer",
+		Buckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	}, []string{"consumer", "target"})
+	pendingMessages = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "consumer_pending_messages",
+		Help: "Messages in the stream not yet fetched by the consumer, as of its last fetch",
+	}, []string{"consumer"})
+)
+
+func init() {
+	prometheus.MustRegister(e2eDeliveryLatency, deliveries, deliveryDuration, pendingMessages)
+}
+
+// observeDelivery records the outcome and duration of a delivery attempt.
+func (c *PullConsumer) observeDelivery(err error, d time.Duration) {
+	result := "success"
+	var partial *PartialDeliveryError
+	switch {
+	case errors.As(err, &partial):
+		result = "partial"
+	case err != nil:
+		result = "failure"
+	}
+	deliveries.WithLabelValues(c.consumerName, string(c.target), result).Inc()
+	deliveryDuration.WithLabelValues(c.consumerName, string(c.target)).Observe(d.Seconds())
+	c.health.record(err)
+}
+
+// observePending records the backlog reported by the last fetched message;
+// an empty fetch means there is none.
+func (c *PullConsumer) observePending(msgs []*nats.Msg) {
+	var pending uint64
+	if len(msgs) > 0 {
+		if meta, err := msgs[len(msgs)-1].Metadata(); err == nil {
+			pending = meta.NumPending
+		}
+	}
+	pendingMessages.WithLabelValues(c.consumerName).Set(float64(pending))
+	atomic.StoreUint64(&c.pending, pending)
+}
+
+// observeDelivered records the end-to-end latency of delivered messages that
+// carry the event time header set by the shuffler.
+func (c *PullConsumer) observeDelivered(msgs []*nats.Msg) {
+	now := time.Now()
+	hist := e2eDeliveryLatency.WithLabelValues(c.consumerName)
+	for _, msg := range msgs {
+		ts := msg.Header.Get(firehose.HeaderEventTime)
+		if ts == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, ts)
+		if err != nil {
+			continue
+		}
+		hist.Observe(now.Sub(t).Seconds())
+	}
+}
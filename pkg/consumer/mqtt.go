@@ -0,0 +1,112 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eurosky/firehose-processor-aas/pkg/firehose"
+	"github.com/nats-io/nats.go"
+)
+
+const mqttTimeout = 10 * time.Second
+
+// mqttDeliverer republishes events to per-collection MQTT topics:
+// <prefix>/<collection> for commits and <prefix>/<frame type> for all other
+// frames. A commit touching several collections is published to each of them.
+type mqttDeliverer struct {
+	client mqtt.Client
+	prefix string
+	qos    byte
+	// encoder produces the message payload of every published event
+	encoder payloadEncoder
+}
+
+func newMQTTDeliverer(brokerURL, clientID, prefix string, qos int, encoder payloadEncoder) (*mqttDeliverer, error) {
+	if brokerURL == "" {
+		return nil, fmt.Errorf("mqtt target requires a broker URL")
+	}
+	if qos < 0 || qos > 2 {
+		return nil, fmt.Errorf("invalid mqtt QoS %d", qos)
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(brokerURL).
+		SetClientID(clientID).
+		SetAutoReconnect(true).
+		SetConnectTimeout(mqttTimeout)
+
+	client := mqtt.NewClient(opts)
+	token := client.Connect()
+	if !token.WaitTimeout(mqttTimeout) {
+		return nil, fmt.Errorf("timed out connecting to MQTT broker")
+	}
+	if err := token.Error(); err != nil {
+		return nil, fmt.Errorf("failed to connect to MQTT broker: %w", err)
+	}
+
+	return &mqttDeliverer{
+		client:  client,
+		prefix:  strings.TrimRight(prefix, "/"),
+		qos:     byte(qos),
+		encoder: encoder,
+	}, nil
+}
+
+func (d *mqttDeliverer) DeliverBatch(ctx context.Context, consumer string, msgs []*nats.Msg) error {
+	var tokens []mqtt.Token
+	for _, msg := range msgs {
+		body, err := d.encoder.encodeEvent(nil, consumer, msg.Data, annotationsOf(msg))
+		if err != nil {
+			return fmt.Errorf("failed to encode payload: %w", err)
+		}
+
+		for _, topic := range d.topics(msg.Data) {
+			tokens = append(tokens, d.client.Publish(topic, d.qos, false, body))
+		}
+	}
+
+	// QoS 0 tokens complete immediately; QoS 1/2 wait for the broker
+	timeout := time.NewTimer(mqttTimeout)
+	defer timeout.Stop()
+	for _, t := range tokens {
+		select {
+		case <-t.Done():
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timeout.C:
+			return fmt.Errorf("timed out publishing to MQTT broker")
+		}
+		if err := t.Error(); err != nil {
+			return fmt.Errorf("failed to publish to MQTT broker: %w", err)
+		}
+	}
+	return nil
+}
+
+func (d *mqttDeliverer) DeliverEvent(ctx context.Context, consumer string, msg *nats.Msg) error {
+	return d.DeliverBatch(ctx, consumer, []*nats.Msg{msg})
+}
+
+func (d *mqttDeliverer) topics(data []byte) []string {
+	info, err := firehose.InspectFrame(data)
+	if err != nil {
+		return []string{d.prefix + "/unknown"}
+	}
+	if info.Type != firehose.TypeCommit || len(info.Collections) == 0 {
+		return []string{d.prefix + "/" + strings.TrimPrefix(info.Type, "#")}
+	}
+
+	topics := make([]string, len(info.Collections))
+	for i, c := range info.Collections {
+		topics[i] = d.prefix + "/" + c
+	}
+	return topics
+}
+
+func (d *mqttDeliverer) Close() error {
+	d.client.Disconnect(250)
+	return nil
+}
@@ -0,0 +1,202 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/pkg/firehose"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/nats-io/nats.go"
+)
+
+const postgresTimeout = 30 * time.Second
+
+// PostgresColumns lists every column of the sink table, in table order. A
+// consumer may insert only a subset of them.
+var PostgresColumns = []string{
+	"seq", "type", "did", "time", "rev", "action", "collection", "rkey", "cid", "record", "consumer",
+}
+
+var postgresColumnTypes = map[string]string{
+	"seq":        "BIGINT",
+	"type":       "TEXT",
+	"did":        "TEXT",
+	"time":       "TIMESTAMPTZ",
+	"rev":        "TEXT",
+	"action":     "TEXT",
+	"collection": "TEXT",
+	"rkey":       "TEXT",
+	"cid":        "TEXT",
+	"record":     "JSONB",
+	"consumer":   "TEXT",
+}
+
+// postgresDeliverer writes decoded events into a table, one row per commit
+// op (or per frame for non-commit frames), using COPY for each batch.
+type postgresDeliverer struct {
+	pool    *pgxpool.Pool
+	table   pgx.Identifier
+	columns []string
+}
+
+func newPostgresDeliverer(dsn, table string, columns []string) (*postgresDeliverer, error) {
+	if dsn == "" {
+		return nil, fmt.Errorf("postgres target requires a DSN")
+	}
+	if table == "" {
+		table = "firehose_events"
+	}
+	if len(columns) == 0 {
+		columns = PostgresColumns
+	}
+	for _, col := range columns {
+		if _, ok := postgresColumnTypes[col]; !ok {
+			return nil, fmt.Errorf("unknown postgres column %q", col)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), postgresTimeout)
+	defer cancel()
+
+	pool, err := pgxpool.New(ctx, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to postgres: %w", err)
+	}
+
+	d := &postgresDeliverer{
+		pool:    pool,
+		table:   pgx.Identifier(strings.Split(table, ".")),
+		columns: columns,
+	}
+	if err := d.migrate(ctx); err != nil {
+		pool.Close()
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// migrate creates the table and adds any column missing from an older
+// version of it. Both statements are idempotent, so every consumer runs them
+// on startup.
+func (d *postgresDeliverer) migrate(ctx context.Context) error {
+	table := d.table.Sanitize()
+
+	defs := []string{"id BIGSERIAL PRIMARY KEY"}
+	for _, col := range PostgresColumns {
+		defs = append(defs, pgx.Identifier{col}.Sanitize()+" "+postgresColumnTypes[col])
+	}
+	defs = append(defs, "inserted_at TIMESTAMPTZ NOT NULL DEFAULT now()")
+
+	stmts := []string{fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", table, strings.Join(defs, ", "))}
+	for _, col := range PostgresColumns {
+		stmts = append(stmts, fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s %s",
+			table, pgx.Identifier{col}.Sanitize(), postgresColumnTypes[col]))
+	}
+
+	indexBase := strings.ReplaceAll(strings.Join(d.table, "_"), `"`, "")
+	stmts = append(stmts,
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (did)", pgx.Identifier{indexBase + "_did_idx"}.Sanitize(), table),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (seq)", pgx.Identifier{indexBase + "_seq_idx"}.Sanitize(), table),
+	)
+
+	for _, stmt := range stmts {
+		if _, err := d.pool.Exec(ctx, stmt); err != nil {
+			return fmt.Errorf("failed to migrate postgres table: %w", err)
+		}
+	}
+	return nil
+}
+
+func (d *postgresDeliverer) DeliverBatch(ctx context.Context, consumer string, msgs []*nats.Msg) error {
+	var rows [][]any
+	for _, msg := range msgs {
+		evt, err := firehose.DecodeFrame(msg.Data)
+		if err != nil {
+			// Keep undecodable frames visible instead of blocking the batch
+			evt = firehose.Event{FrameInfo: firehose.FrameInfo{Type: firehose.TypeError, Seq: -1}}
+		}
+
+		if len(evt.Ops) == 0 {
+			rows = append(rows, d.row(consumer, evt, nil))
+			continue
+		}
+		for i := range evt.Ops {
+			rows = append(rows, d.row(consumer, evt, &evt.Ops[i]))
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, postgresTimeout)
+	defer cancel()
+
+	if _, err := d.pool.CopyFrom(ctx, d.table, d.columns, pgx.CopyFromRows(rows)); err != nil {
+		return fmt.Errorf("failed to copy rows into postgres: %w", err)
+	}
+	return nil
+}
+
+func (d *postgresDeliverer) DeliverEvent(ctx context.Context, consumer string, msg *nats.Msg) error {
+	return d.DeliverBatch(ctx, consumer, []*nats.Msg{msg})
+}
+
+func (d *postgresDeliverer) row(consumer string, evt firehose.Event, op *firehose.Op) []any {
+	row := make([]any, len(d.columns))
+	for i, col := range d.columns {
+		switch col {
+		case "seq":
+			row[i] = evt.Seq
+		case "type":
+			row[i] = evt.Type
+		case "did":
+			row[i] = nullString(evt.DID)
+		case "time":
+			if t, err := time.Parse(time.RFC3339, evt.Time); err == nil {
+				row[i] = t
+			}
+		case "rev":
+			row[i] = nullString(evt.Rev)
+		case "consumer":
+			row[i] = consumer
+		case "record":
+			if op != nil {
+				if op.Record != nil {
+					row[i] = string(op.Record)
+				}
+			} else if evt.Body != nil {
+				row[i] = string(evt.Body)
+			}
+		case "action":
+			if op != nil {
+				row[i] = op.Action
+			}
+		case "collection":
+			if op != nil {
+				row[i] = op.Collection
+			}
+		case "rkey":
+			if op != nil {
+				row[i] = op.Rkey
+			}
+		case "cid":
+			if op != nil {
+				row[i] = nullString(op.CID)
+			}
+		}
+	}
+	return row
+}
+
+func (d *postgresDeliverer) Close() error {
+	d.pool.Close()
+	return nil
+}
+
+func nullString(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
@@ -0,0 +1,132 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/eurosky/firehose-processor-aas/pkg/firehose"
+	"github.com/nats-io/nats.go"
+)
+
+const pubsubPublishTimeout = 10 * time.Second
+
+// DefaultPubSubAttributes is the set of event metadata copied into Pub/Sub
+// message attributes when none is configured.
+var DefaultPubSubAttributes = []string{"type", "seq", "did", "time"}
+
+type pubsubDeliverer struct {
+	client     *pubsub.Client
+	topic      *pubsub.Topic
+	encoder    payloadEncoder
+	attributes []string
+}
+
+func newPubSubDeliverer(projectID, topicID string, attributes []string, encoder payloadEncoder) (*pubsubDeliverer, error) {
+	if projectID == "" || topicID == "" {
+		return nil, fmt.Errorf("pubsub target requires a project and a topic")
+	}
+	if len(attributes) == 0 {
+		attributes = DefaultPubSubAttributes
+	}
+	for _, a := range attributes {
+		switch a {
+		case "type", "seq", "did", "time", "collections":
+		default:
+			return nil, fmt.Errorf("unknown pubsub attribute %q", a)
+		}
+	}
+
+	// Application Default Credentials
+	client, err := pubsub.NewClient(context.Background(), projectID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Pub/Sub client: %w", err)
+	}
+
+	topic := client.Topic(topicID)
+	// Ordering keys are only honored with message ordering enabled
+	topic.EnableMessageOrdering = true
+
+	return &pubsubDeliverer{
+		client:     client,
+		topic:      topic,
+		encoder:    encoder,
+		attributes: attributes,
+	}, nil
+}
+
+func (d *pubsubDeliverer) DeliverBatch(ctx context.Context, consumer string, msgs []*nats.Msg) error {
+	ctx, cancel := context.WithTimeout(ctx, pubsubPublishTimeout)
+	defer cancel()
+
+	results := make([]*pubsub.PublishResult, 0, len(msgs))
+	keys := make([]string, 0, len(msgs))
+	for _, msg := range msgs {
+		body, err := d.encoder.encodeEvent(nil, consumer, msg.Data, annotationsOf(msg))
+		if err != nil {
+			return fmt.Errorf("failed to encode payload: %w", err)
+		}
+
+		// Frames we can't inspect are still delivered, just unordered
+		info, _ := firehose.InspectFrame(msg.Data)
+
+		attrs := map[string]string{
+			"consumer":       consumer,
+			"content-type":   d.encoder.contentType(),
+			"schema-version": PayloadSchemaVersion,
+		}
+		for _, a := range d.attributes {
+			switch a {
+			case "type":
+				attrs[a] = info.Type
+			case "seq":
+				attrs[a] = strconv.FormatInt(info.Seq, 10)
+			case "did":
+				attrs[a] = info.DID
+			case "time":
+				attrs[a] = info.Time
+			case "collections":
+				attrs[a] = strings.Join(info.Collections, ",")
+			}
+		}
+
+		results = append(results, d.topic.Publish(ctx, &pubsub.Message{
+			Data:        body,
+			Attributes:  attrs,
+			OrderingKey: info.DID,
+		}))
+		keys = append(keys, info.DID)
+	}
+
+	var firstErr error
+	failed := 0
+	for i, r := range results {
+		if _, err := r.Get(ctx); err != nil {
+			failed++
+			if firstErr == nil {
+				firstErr = err
+			}
+			// A failed publish pauses its ordering key until resumed
+			if keys[i] != "" {
+				d.topic.ResumePublish(keys[i])
+			}
+		}
+	}
+	if firstErr != nil {
+		return fmt.Errorf("failed to publish %d of %d messages to Pub/Sub: %w", failed, len(msgs), firstErr)
+	}
+
+	return nil
+}
+
+func (d *pubsubDeliverer) DeliverEvent(ctx context.Context, consumer string, msg *nats.Msg) error {
+	return d.DeliverBatch(ctx, consumer, []*nats.Msg{msg})
+}
+
+func (d *pubsubDeliverer) Close() error {
+	d.topic.Stop()
+	return d.client.Close()
+}
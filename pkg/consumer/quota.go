@@ -0,0 +1,276 @@
+package consumer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+)
+
+// Quota holds the limits of a tenant. Zero values mean unlimited.
+type Quota struct {
+	Tenant string
+	// MaxConsumers bounds the number of consumers running at the same time.
+	MaxConsumers int
+	// MaxEventsPerDay bounds the events delivered per UTC day. Once reached,
+	// consumers stop fetching until the next day; undelivered events stay in
+	// the stream.
+	MaxEventsPerDay int64
+	// MaxWebhookRate bounds delivery calls (webhook requests, or target
+	// writes) per second across all consumers of the tenant.
+	MaxWebhookRate float64
+	// MaxBlobBytesPerDay bounds the bytes of blobs fetched per UTC day (see
+	// Config.FetchBlobs). Once reached, blob references are delivered
+	// without a URL until the next day.
+	MaxBlobBytesPerDay int64
+}
+
+// QuotaState is the current quota usage, as served by QuotaTracker.ServeHTTP.
+type QuotaState struct {
+	Tenant          string    `json:"tenant"`
+	Consumers       int       `json:"consumers"`
+	MaxConsumers    int       `json:"max_consumers,omitempty"`
+	EventsToday     int64     `json:"events_today"`
+	MaxEventsPerDay int64     `json:"max_events_per_day,omitempty"`
+	MaxWebhookRate  float64   `json:"max_webhook_rate,omitempty"`
+	Paused          bool      `json:"paused"`
+	PausedUntil     time.Time `json:"paused_until,omitzero"`
+	// BlobBytesToday counts the bytes of blobs fetched today.
+	BlobBytesToday     int64 `json:"blob_bytes_today"`
+	MaxBlobBytesPerDay int64 `json:"max_blob_bytes_per_day,omitempty"`
+}
+
+var (
+	quotaUsage = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "consumer_quota_usage",
+		Help: "Current usage of a tenant quota (consumers, events_per_day, blob_bytes_per_day)",
+	}, []string{"tenant", "quota"})
+	quotaLimit = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "consumer_quota_limit",
+		Help: "Configured tenant quota limits; absent when unlimited",
+	}, []string{"tenant", "quota"})
+	quotaPaused = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "consumer_quota_paused",
+		Help: "1 while delivery for the tenant is paused because a quota is exhausted",
+	}, []string{"tenant"})
+	quotaExceeded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "consumer_quota_exceeded_total",
+		Help: "Number of times a tenant quota was hit (consumer rejected, daily events exhausted, delivery throttled, blob not fetched)",
+	}, []string{"tenant", "quota"})
+)
+
+func init() {
+	prometheus.MustRegister(quotaUsage, quotaLimit, quotaPaused, quotaExceeded)
+}
+
+// QuotaTracker enforces a Quota across all consumers sharing it. A nil
+// *QuotaTracker enforces nothing.
+type QuotaTracker struct {
+	quota   Quota
+	limiter *rate.Limiter
+
+	mu        sync.Mutex
+	consumers int
+	day       string
+	events    int64
+	paused    bool
+	blobBytes int64
+}
+
+func NewQuotaTracker(q Quota) *QuotaTracker {
+	if q.Tenant == "" {
+		q.Tenant = "default"
+	}
+
+	t := &QuotaTracker{quota: q, day: utcDay(time.Now())}
+	if q.MaxWebhookRate > 0 {
+		// Allow a second's worth of burst so batch boundaries don't throttle
+		burst := int(q.MaxWebhookRate)
+		if burst < 1 {
+			burst = 1
+		}
+		t.limiter = rate.NewLimiter(rate.Limit(q.MaxWebhookRate), burst)
+	}
+
+	if q.MaxConsumers > 0 {
+		quotaLimit.WithLabelValues(q.Tenant, "consumers").Set(float64(q.MaxConsumers))
+	}
+	if q.MaxEventsPerDay > 0 {
+		quotaLimit.WithLabelValues(q.Tenant, "events_per_day").Set(float64(q.MaxEventsPerDay))
+	}
+	if q.MaxWebhookRate > 0 {
+		quotaLimit.WithLabelValues(q.Tenant, "webhook_rate").Set(q.MaxWebhookRate)
+	}
+	if q.MaxBlobBytesPerDay > 0 {
+		quotaLimit.WithLabelValues(q.Tenant, "blob_bytes_per_day").Set(float64(q.MaxBlobBytesPerDay))
+	}
+	quotaPaused.WithLabelValues(q.Tenant).Set(0)
+
+	return t
+}
+
+// acquire registers a consumer, failing if MaxConsumers are already running.
+func (t *QuotaTracker) acquire() error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.quota.MaxConsumers > 0 && t.consumers >= t.quota.MaxConsumers {
+		quotaExceeded.WithLabelValues(t.quota.Tenant, "consumers").Inc()
+		return fmt.Errorf("tenant %s already runs the maximum of %d consumers", t.quota.Tenant, t.quota.MaxConsumers)
+	}
+	t.consumers++
+	quotaUsage.WithLabelValues(t.quota.Tenant, "consumers").Set(float64(t.consumers))
+	return nil
+}
+
+func (t *QuotaTracker) release() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.consumers--
+	quotaUsage.WithLabelValues(t.quota.Tenant, "consumers").Set(float64(t.consumers))
+}
+
+// exhausted reports whether the daily event quota is used up. The counter
+// resets at UTC midnight.
+func (t *QuotaTracker) exhausted() bool {
+	if t == nil || t.quota.MaxEventsPerDay <= 0 {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.rollover(time.Now())
+	return t.paused
+}
+
+// record counts delivered events against the daily quota. A batch may
+// overshoot the quota by up to its own size.
+func (t *QuotaTracker) record(n int) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.rollover(time.Now())
+	t.events += int64(n)
+	quotaUsage.WithLabelValues(t.quota.Tenant, "events_per_day").Set(float64(t.events))
+
+	if t.quota.MaxEventsPerDay > 0 && !t.paused && t.events >= t.quota.MaxEventsPerDay {
+		t.paused = true
+		quotaPaused.WithLabelValues(t.quota.Tenant).Set(1)
+		quotaExceeded.WithLabelValues(t.quota.Tenant, "events_per_day").Inc()
+	}
+}
+
+// reserveBlob counts a blob of size bytes against the daily blob quota,
+// reporting false, without counting it, when it doesn't fit.
+func (t *QuotaTracker) reserveBlob(size int64) bool {
+	if t == nil {
+		return true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.rollover(time.Now())
+	if t.quota.MaxBlobBytesPerDay > 0 && t.blobBytes+size > t.quota.MaxBlobBytesPerDay {
+		quotaExceeded.WithLabelValues(t.quota.Tenant, "blob_bytes_per_day").Inc()
+		return false
+	}
+	t.blobBytes += size
+	quotaUsage.WithLabelValues(t.quota.Tenant, "blob_bytes_per_day").Set(float64(t.blobBytes))
+	return true
+}
+
+// rollover resets the daily counters on a new UTC day. Needs t.mu.
+func (t *QuotaTracker) rollover(now time.Time) {
+	day := utcDay(now)
+	if day == t.day {
+		return
+	}
+	t.day = day
+	t.events = 0
+	t.blobBytes = 0
+	if t.paused {
+		t.paused = false
+		quotaPaused.WithLabelValues(t.quota.Tenant).Set(0)
+	}
+	quotaUsage.WithLabelValues(t.quota.Tenant, "events_per_day").Set(0)
+	quotaUsage.WithLabelValues(t.quota.Tenant, "blob_bytes_per_day").Set(0)
+}
+
+// wait blocks until the webhook rate quota allows another delivery call.
+func (t *QuotaTracker) wait(ctx context.Context) error {
+	if t == nil || t.limiter == nil {
+		return nil
+	}
+
+	r := t.limiter.Reserve()
+	delay := r.Delay()
+	if delay == 0 {
+		return nil
+	}
+	quotaExceeded.WithLabelValues(t.quota.Tenant, "webhook_rate").Inc()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		r.Cancel()
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// State returns the current quota usage.
+func (t *QuotaTracker) State() QuotaState {
+	if t == nil {
+		return QuotaState{}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	t.rollover(now)
+
+	state := QuotaState{
+		Tenant:             t.quota.Tenant,
+		Consumers:          t.consumers,
+		MaxConsumers:       t.quota.MaxConsumers,
+		EventsToday:        t.events,
+		MaxEventsPerDay:    t.quota.MaxEventsPerDay,
+		MaxWebhookRate:     t.quota.MaxWebhookRate,
+		Paused:             t.paused,
+		BlobBytesToday:     t.blobBytes,
+		MaxBlobBytesPerDay: t.quota.MaxBlobBytesPerDay,
+	}
+	if t.paused {
+		y, m, d := now.UTC().Date()
+		state.PausedUntil = time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC)
+	}
+	return state
+}
+
+// ServeHTTP serves the quota state as JSON.
+func (t *QuotaTracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	state := t.State()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
+
+func utcDay(t time.Time) string {
+	return t.UTC().Format(time.DateOnly)
+}
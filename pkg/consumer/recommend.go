@@ -0,0 +1,268 @@
+package consumer
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/pkg/events"
+)
+
+const (
+	// TuningWindow is how far back Recommend looks at a consumer's fetches.
+	TuningWindow = 5 * time.Minute
+
+	// minTuningSpan is how long a consumer must have fetched before
+	// Recommend tells anything.
+	minTuningSpan = time.Minute
+	// maxTuningSamples bounds the fetches kept, for short poll intervals.
+	maxTuningSamples = 1000
+	// drainTarget is how soon a recommendation should clear the backlog,
+	// and tuningHeadroom how much faster than the stream it should deliver.
+	drainTarget    = 5 * time.Minute
+	tuningHeadroom = 1.2
+)
+
+// Statuses of a TuningReport.
+const (
+	TuningOK               = "ok"
+	TuningBehind           = "behind"
+	TuningInsufficientData = "insufficient_data"
+	TuningFailing          = "failing"
+	TuningPaused           = "paused"
+)
+
+// TuningReport is a consumer's throughput over the last TuningWindow, and the
+// changes of its settings that would let it keep up.
+type TuningReport struct {
+	Consumer string `json:"consumer"`
+	Status   string `json:"status"`
+	// Fetches and WindowSeconds are the fetches the report is computed
+	// from and the time they span.
+	Fetches       int     `json:"fetches"`
+	WindowSeconds float64 `json:"window_seconds"`
+	// Pending is the backlog as of the last fetch, and LagTrend how fast it
+	// grew, negative while it drains.
+	Pending  uint64  `json:"pending"`
+	LagTrend float64 `json:"lag_trend_per_second"`
+	// Delivered is the rate the consumer fetched and delivered at, Inflow
+	// the rate events arrived at, and Capacity the most the current
+	// settings fetch.
+	Delivered float64 `json:"delivered_per_second"`
+	Inflow    float64 `json:"inflow_per_second"`
+	Capacity  float64 `json:"capacity_per_second"`
+	// BatchFill is the share of fetches that returned a full batch, and
+	// CycleSeconds the mean time from a fetch to the end of its delivery.
+	BatchFill    float64 `json:"batch_fill"`
+	CycleSeconds float64 `json:"cycle_seconds"`
+
+	BatchSize           int     `json:"batch_size"`
+	PollIntervalSeconds float64 `json:"poll_interval_seconds"`
+
+	// Autotune is set when the consumer adjusts its settings itself: the
+	// report then covers the fetches since they last changed.
+	Autotune        bool             `json:"autotune,omitempty"`
+	Recommendations []Recommendation `json:"recommendations,omitempty"`
+}
+
+// Recommendation is a change of a consumer setting. Setting is the consume
+// flag, or "partition" to split the consumer's events over several
+// consumers.
+type Recommendation struct {
+	Setting     string `json:"setting"`
+	Current     string `json:"current,omitempty"`
+	Recommended string `json:"recommended"`
+	Reason      string `json:"reason"`
+}
+
+// fetchSample is one fetch of a consumer.
+type fetchSample struct {
+	at      time.Time
+	pending uint64
+	fetched int
+	// cycle is the time from the fetch to the end of its delivery, zero
+	// when it returned nothing
+	cycle time.Duration
+}
+
+// fetchHistory keeps the fetches of the last TuningWindow.
+type fetchHistory struct {
+	mu      sync.Mutex
+	samples []fetchSample
+}
+
+func (h *fetchHistory) record(s fetchSample) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	drop := 0
+	for drop < len(h.samples) && s.at.Sub(h.samples[drop].at) > TuningWindow {
+		drop++
+	}
+	if len(h.samples)-drop >= maxTuningSamples {
+		drop = len(h.samples) - maxTuningSamples + 1
+	}
+	h.samples = append(h.samples[drop:], s)
+}
+
+func (h *fetchHistory) snapshot() []fetchSample {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]fetchSample(nil), h.samples...)
+}
+
+// tuningSettings are the settings of a consumer Recommend weighs.
+type tuningSettings struct {
+	batchSize   int
+	poll        time.Duration
+	granularity DeliveryGranularity
+	concurrency int
+}
+
+// Recommend reports the consumer's throughput over the last TuningWindow and
+// the settings to change when it falls behind the stream. The
+// recommendations assume events keep arriving at the same rate.
+func (c *PullConsumer) Recommend() TuningReport {
+	batchSize, poll := c.settings()
+	settings := tuningSettings{batchSize: batchSize, poll: poll, granularity: c.granularity, concurrency: c.deliveryConcurrency}
+	st := c.Status()
+	samples := c.fetches.snapshot()
+	if c.tuner != nil {
+		// Earlier fetches measured other settings
+		samples = c.tuner.measured(samples)
+	}
+	r := recommend(settings, samples)
+	r.Consumer = c.consumerName
+	r.Autotune = c.tuner != nil
+	switch {
+	case st.State == events.ConsumerPaused:
+		r.Status, r.Recommendations = TuningPaused, nil
+	case st.ConsecutiveFailures > 0:
+		// The backlog is the failures', which no setting clears
+		r.Status, r.Recommendations = TuningFailing, nil
+	}
+	return r
+}
+
+func recommend(s tuningSettings, samples []fetchSample) TuningReport {
+	r := TuningReport{Status: TuningInsufficientData, Fetches: len(samples), BatchSize: s.batchSize, PollIntervalSeconds: s.poll.Seconds()}
+	if len(samples) == 0 {
+		return r
+	}
+	first, last := samples[0], samples[len(samples)-1]
+	span := last.at.Sub(first.at)
+	r.WindowSeconds = span.Seconds()
+	r.Pending = last.pending
+
+	var fetched, full, busy int
+	var cycles time.Duration
+	for i, smp := range samples {
+		if smp.fetched == s.batchSize {
+			full++
+		}
+		if smp.fetched > 0 {
+			busy++
+			cycles += smp.cycle
+			// The first fetch's events arrived before the window
+			if i > 0 {
+				fetched += smp.fetched
+			}
+		}
+	}
+	r.BatchFill = float64(full) / float64(len(samples))
+	var cycle, perEvent time.Duration
+	if busy > 0 {
+		cycle = cycles / time.Duration(busy)
+		perEvent = cycles / time.Duration(max(1, fetched+first.fetched))
+	}
+	r.CycleSeconds = cycle.Seconds()
+	// The ticker drops the ticks of a fetch still delivering
+	period := max(s.poll, cycle)
+	r.Capacity = float64(s.batchSize) / period.Seconds()
+	if span < minTuningSpan || len(samples) < 3 {
+		return r
+	}
+
+	r.Delivered = float64(fetched) / span.Seconds()
+	r.LagTrend = (float64(last.pending) - float64(first.pending)) / span.Seconds()
+	r.Inflow = max(0, r.Delivered+r.LagTrend)
+	r.Status = TuningOK
+	// Caught up, or draining in time
+	if last.pending <= uint64(s.batchSize) || (r.LagTrend < 0 && float64(last.pending)/-r.LagTrend <= drainTarget.Seconds()) {
+		return r
+	}
+	r.Status = TuningBehind
+
+	target := neededRate(r)
+	// The deliveries take this long per event whatever the batch, so one
+	// consumer can't deliver faster, except with concurrent event calls
+	deliveryBound := perEvent > 0 && target*perEvent.Seconds() >= 1
+	if deliveryBound {
+		if s.granularity == DeliverEvent {
+			n := int(math.Ceil(float64(s.concurrency) * target * perEvent.Seconds()))
+			r.Recommendations = append(r.Recommendations, Recommendation{
+				Setting:     "delivery-concurrency",
+				Current:     strconv.Itoa(s.concurrency),
+				Recommended: strconv.Itoa(n),
+				Reason:      fmt.Sprintf("deliveries take %s per event, and %d in flight deliver %.0f/s of the %.0f/s needed", roundDuration(perEvent), s.concurrency, r.Delivered, target),
+			})
+			return r
+		}
+		parts := int(math.Ceil(target * perEvent.Seconds()))
+		r.Recommendations = append(r.Recommendations, Recommendation{
+			Setting:     "partition",
+			Current:     "1",
+			Recommended: strconv.Itoa(parts),
+			Reason:      fmt.Sprintf("deliveries take %s per event, so one consumer delivers at most %.0f/s of the %.0f/s needed: split its events over %d consumers, e.g. by --filter-collections, or deliver with event granularity", roundDuration(perEvent), 1/perEvent.Seconds(), target, parts),
+		})
+		return r
+	}
+
+	// Not delivery bound, so a fetch of this many still ends within the poll
+	// interval
+	batch := niceCeil(target * s.poll.Seconds())
+	if batch > s.batchSize {
+		r.Recommendations = append(r.Recommendations, Recommendation{
+			Setting:     "batch-size",
+			Current:     strconv.Itoa(s.batchSize),
+			Recommended: strconv.Itoa(batch),
+			Reason:      fmt.Sprintf("a fetch every %s of at most %d events delivers %.0f/s of the %.0f/s needed", roundDuration(period), s.batchSize, r.Capacity, target),
+		})
+	}
+	// poll-interval takes whole seconds
+	if interval := math.Floor(float64(s.batchSize) / target); interval >= 1 && interval < math.Floor(s.poll.Seconds()) && cycle.Seconds() < interval {
+		r.Recommendations = append(r.Recommendations, Recommendation{
+			Setting:     "poll-interval",
+			Current:     strconv.Itoa(int(s.poll.Seconds())),
+			Recommended: strconv.Itoa(int(interval)),
+			Reason:      fmt.Sprintf("fetching %d events every %.0fs delivers the %.0f/s needed", s.batchSize, interval, target),
+		})
+	}
+	return r
+}
+
+// neededRate is the rate a consumer behind the stream should deliver at:
+// faster than the inflow, and clearing its backlog within drainTarget.
+func neededRate(r TuningReport) float64 {
+	return r.Inflow*tuningHeadroom + float64(r.Pending)/drainTarget.Seconds()
+}
+
+// niceCeil rounds v up to two significant digits, e.g. 1234 to 1300.
+func niceCeil(v float64) int {
+	if v <= 10 {
+		return int(math.Ceil(v))
+	}
+	unit := math.Pow(10, math.Floor(math.Log10(v))-1)
+	return int(math.Ceil(v/unit) * unit)
+}
+
+func roundDuration(d time.Duration) time.Duration {
+	switch {
+	case d >= time.Second:
+		return d.Round(10 * time.Millisecond)
+	case d >= time.Millisecond:
+		return d.Round(10 * time.Microsecond)
+	}
+	return d.Round(time.Microsecond)
+}
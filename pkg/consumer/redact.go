@@ -0,0 +1,26 @@
+package consumer
+
+import (
+	"github.com/eurosky/firehose-processor-aas/pkg/firehose"
+	"github.com/nats-io/nats.go"
+)
+
+// redact applies r to the frames of msgs. It returns copies of the messages
+// carrying the redacted frames, which ack the originals, and the messages
+// whose frames are not to be delivered at all.
+func redact(r *firehose.Redaction, msgs []*nats.Msg) (deliver, skip []*nats.Msg) {
+	if r == nil {
+		return msgs, nil
+	}
+	for _, msg := range msgs {
+		frame, ok := r.Apply(msg.Data)
+		if !ok {
+			skip = append(skip, msg)
+			continue
+		}
+		redacted := *msg
+		redacted.Data = frame
+		deliver = append(deliver, &redacted)
+	}
+	return deliver, skip
+}
@@ -0,0 +1,240 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/pkg/firehose"
+	"github.com/nats-io/nats.go"
+)
+
+// ReplayHeader marks webhook calls made by Replay. Its value is the ID of
+// the replay.
+const ReplayHeader = "X-Replay"
+
+// ReplayWindow is the part of the stream a Replay delivers: the sequences
+// FromSeq to ToSeq, or the events stored from From until To. A window
+// without an end runs to the end of the stream as it was when the replay
+// started.
+type ReplayWindow struct {
+	FromSeq uint64
+	ToSeq   uint64
+	From    time.Time
+	To      time.Time
+}
+
+// ReplayProgress tells how far a Replay got.
+type ReplayProgress struct {
+	// Delivered and Skipped count the events delivered and those the
+	// consumer's filters left out
+	Delivered int64
+	Skipped   int64
+	// LastSeq is the last stream sequence handled; a replay resumed from
+	// LastSeq+1 skips none
+	LastSeq uint64
+	// LastTime is when LastSeq was stored
+	LastTime time.Time
+	// EndSeq is the last stream sequence the replay may reach
+	EndSeq uint64
+}
+
+// Replay delivers a window of the stream again through cfg's pipeline: its
+// filters, redaction, label and keyword filters, granularity and delivery
+// target, as a consumer with that configuration does, from the stream it
+// reads (see Source). Webhook calls carry X-Replay with id, unless empty.
+// It calls progress after every batch, and gives up on a batch that still
+// fails after retries. History is limited to what the stream still
+// retains.
+//
+// Replay uses a temporary consumer and never touches the position of the
+// consumer's durable.
+func Replay(ctx context.Context, cfg Config, id string, w ReplayWindow, progress func(ReplayProgress), logger *slog.Logger) (ReplayProgress, error) {
+	var p ReplayProgress
+
+	if w.FromSeq == 0 && w.From.IsZero() {
+		return p, errors.New("replay window has no start")
+	}
+	if (w.ToSeq > 0 && w.ToSeq < w.FromSeq) || (!w.To.IsZero() && !w.From.Before(w.To)) {
+		return p, errors.New("replay window is empty")
+	}
+
+	if cfg.Target == "" || cfg.Target == TargetWebhook {
+		cfg.UseWebhook = true
+		if id != "" {
+			headers := map[string]string{ReplayHeader: id}
+			for k, v := range cfg.WebhookHeaders {
+				headers[k] = v
+			}
+			cfg.WebhookHeaders = headers
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		return p, err
+	}
+
+	encoder, err := newPayloadEncoder(cfg.PayloadFormat, cfg.SchemaRegistryURL)
+	if err != nil {
+		return p, err
+	}
+	redaction, err := firehose.ParseRedaction(cfg.Redaction)
+	if err != nil {
+		return p, err
+	}
+	deliverer := cfg.Deliverer
+	if deliverer == nil {
+		if deliverer, err = newDeliverer(cfg, encoder); err != nil {
+			return p, err
+		}
+		if closer, ok := deliverer.(io.Closer); ok {
+			defer closer.Close()
+		}
+	}
+
+	nc := cfg.Conn
+	if nc == nil {
+		if nc, err = nats.Connect(cfg.NATSURL); err != nil {
+			return p, fmt.Errorf("failed to connect to NATS: %w", err)
+		}
+		defer nc.Close()
+	}
+	js, err := nc.JetStream()
+	if err != nil {
+		return p, fmt.Errorf("failed to create JetStream context: %w", err)
+	}
+
+	stream, subject, err := consumerSource(js, cfg)
+	if err != nil {
+		return p, err
+	}
+	si, err := js.StreamInfo(stream)
+	if err != nil {
+		return p, fmt.Errorf("failed to get stream info: %w", err)
+	}
+	p.EndSeq = si.State.LastSeq
+	if w.ToSeq > 0 {
+		p.EndSeq = min(w.ToSeq, p.EndSeq)
+	}
+	if si.State.Msgs == 0 || p.EndSeq < max(w.FromSeq, si.State.FirstSeq) {
+		return p, nil
+	}
+
+	labelIndex := cfg.Labels
+	if labelIndex == nil && (len(cfg.ExcludeLabels) > 0 || len(cfg.AnnotateLabels) > 0) {
+		if labelIndex, err = firehose.WatchLabels(js, logger); err != nil {
+			return p, err
+		}
+		defer labelIndex.Stop()
+	}
+	languages := newLanguageFilter(cfg)
+	threads := newThreadEnricher(cfg, logger)
+	blobs, err := newBlobEnricher(js, cfg, logger)
+	if err != nil {
+		return p, err
+	}
+	filter := newEventFilter(cfg.FrameTypes, cfg.Collections, cfg.TombstoneStatuses)
+	labels := newLabelFilter(labelIndex, cfg.ExcludeLabels, cfg.AnnotateLabels)
+	var keywords *keywordFilter
+	if cfg.KeywordQueries {
+		if keywords, err = watchKeywords(js, cfg.Name, logger); err != nil {
+			return p, err
+		}
+		defer keywords.Stop()
+	}
+	if d, ok := deliverer.(jsDeliverer); ok {
+		if err := d.bind(js, logger); err != nil {
+			return p, err
+		}
+	}
+
+	startOpt := nats.StartSequence(max(w.FromSeq, si.State.FirstSeq))
+	if w.FromSeq == 0 {
+		startOpt = nats.StartTime(w.From)
+	}
+	sub, err := js.PullSubscribe(subject, "",
+		nats.BindStream(stream),
+		startOpt,
+		nats.AckNone(),
+		nats.InactiveThreshold(time.Minute),
+	)
+	if err != nil {
+		return p, fmt.Errorf("failed to subscribe: %w", err)
+	}
+	defer sub.Unsubscribe()
+
+	logger.Info("replay started", "consumer", cfg.Name, "replay", id, "from_seq", w.FromSeq, "to_seq", p.EndSeq, "from", w.From, "to", w.To)
+
+	for {
+		if ctx.Err() != nil {
+			return p, ctx.Err()
+		}
+
+		msgs, err := fetch(ctx, sub, cfg.BatchSize)
+		if errors.Is(err, nats.ErrTimeout) {
+			// The window ends after the last event stored
+			return p, nil
+		}
+		if ctx.Err() != nil {
+			return p, ctx.Err()
+		}
+		if err != nil {
+			return p, fmt.Errorf("fetch failed: %w", err)
+		}
+
+		// Cut the batch at the end of the window
+		done := false
+		last, lastTime := p.LastSeq, p.LastTime
+		for i, msg := range msgs {
+			meta, err := msg.Metadata()
+			if err != nil {
+				return p, fmt.Errorf("failed to read message metadata: %w", err)
+			}
+			if meta.Sequence.Stream > p.EndSeq || (!w.To.IsZero() && !meta.Timestamp.Before(w.To)) {
+				msgs, done = msgs[:i], true
+				break
+			}
+			last, lastTime = meta.Sequence.Stream, meta.Timestamp
+			if last == p.EndSeq {
+				done = true
+			}
+		}
+
+		deliver, skip := filter.split(msgs)
+		deliver, redacted := redact(redaction, deliver)
+		deliver, labeled := labels.split(deliver)
+		deliver, unmatched := keywords.split(deliver)
+		deliver, otherLangs := languages.split(deliver)
+		deliver = threads.annotate(ctx, deliver)
+		deliver = blobs.annotate(ctx, deliver)
+		skipped := len(slices.Concat(skip, redacted, labeled, unmatched, otherLangs))
+
+		if len(deliver) > 0 {
+			if cfg.DeliveryGranularity == DeliverEvent {
+				for _, msg := range deliver {
+					if err := retryDelivery(ctx, func() error { return deliverer.DeliverEvent(ctx, cfg.Name, msg) }); err != nil {
+						return p, fmt.Errorf("delivery failed after %d events: %w", p.Delivered, err)
+					}
+					p.Delivered++
+				}
+			} else {
+				if err := retryBatch(ctx, deliverer, cfg.Name, deliver); err != nil {
+					return p, fmt.Errorf("delivery failed after %d events: %w", p.Delivered, err)
+				}
+				p.Delivered += int64(len(deliver))
+			}
+		}
+		p.Skipped += int64(skipped)
+		p.LastSeq, p.LastTime = last, lastTime
+		if progress != nil {
+			progress(p)
+		}
+
+		if done {
+			return p, nil
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package consumer
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/eurosky/firehose-processor-aas/pkg/firehose"
+	"github.com/nats-io/nats.go"
+)
+
+// WebhookRoute sends the events it matches to another webhook path or
+// endpoint. It is parsed from a rule:
+//
+//	<collection> [<action>] <destination>
+//	#<frame type> <destination>
+//
+// A collection is an NSID, an NSID prefix ending in ".*" or "*" for every
+// collection, and matches a commit when one of its ops does; an action
+// (create, update or delete) restricts it to those ops. A destination is a
+// path, appended to the path of Config.WebhookURL, or an absolute http(s)
+// URL. For example, "app.bsky.feed.post /posts", "app.bsky.graph.* /graph"
+// and "#identity https://identity.example.com/hook".
+type WebhookRoute struct {
+	// FrameType is set for the rules matching a frame type, Collection and
+	// Action for the others
+	FrameType  string
+	Collection string
+	Action     string
+	// Path or URL is the destination
+	Path string
+	URL  string
+}
+
+// ParseWebhookRoutes parses rules, returning nil when there are none.
+func ParseWebhookRoutes(rules []string) ([]WebhookRoute, error) {
+	var routes []WebhookRoute
+	for _, s := range rules {
+		route, err := parseWebhookRoute(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid webhook route %q: %w", s, err)
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+func parseWebhookRoute(s string) (WebhookRoute, error) {
+	words := strings.Fields(s)
+	if len(words) < 2 || len(words) > 3 {
+		return WebhookRoute{}, errors.New("want <collection> [<action>] <destination> or #<frame type> <destination>")
+	}
+
+	var route WebhookRoute
+	if t := words[0]; strings.HasPrefix(t, "#") {
+		switch t {
+		case firehose.TypeCommit, firehose.TypeSync, firehose.TypeIdentity, firehose.TypeAccount, firehose.TypeInfo:
+		default:
+			return WebhookRoute{}, fmt.Errorf("unknown frame type %q", t)
+		}
+		if len(words) == 3 {
+			return WebhookRoute{}, errors.New("a frame type route takes no action")
+		}
+		route.FrameType = t
+	} else {
+		route.Collection = t
+		if t != "*" && strings.Contains(strings.TrimSuffix(t, ".*"), "*") {
+			return WebhookRoute{}, fmt.Errorf("invalid collection %q", t)
+		}
+		if len(words) == 3 {
+			switch words[1] {
+			case "create", "update", "delete":
+			default:
+				return WebhookRoute{}, fmt.Errorf("unknown action %q, want create, update or delete", words[1])
+			}
+			route.Action = words[1]
+		}
+	}
+
+	dest := words[len(words)-1]
+	if strings.HasPrefix(dest, "/") {
+		route.Path = dest
+		return route, nil
+	}
+	u, err := url.Parse(dest)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return WebhookRoute{}, fmt.Errorf("destination %q is neither a path nor an http(s) URL", dest)
+	}
+	route.URL = dest
+	return route, nil
+}
+
+// webhookRouter picks the URL each event is posted to.
+type webhookRouter struct {
+	routes []WebhookRoute
+	// urls are the destinations of routes, resolved against the webhook URL
+	urls []string
+	base string
+	// commits is whether a route needs commits decoded
+	commits bool
+}
+
+// newWebhookRouter returns nil when there are no routes.
+func newWebhookRouter(base string, rules []string) (*webhookRouter, error) {
+	routes, err := ParseWebhookRoutes(rules)
+	if err != nil || len(routes) == 0 {
+		return nil, err
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook url: %w", err)
+	}
+
+	r := &webhookRouter{routes: routes, base: base}
+	for _, route := range routes {
+		dest := route.URL
+		if route.Path != "" {
+			v := *u
+			v.Path = strings.TrimSuffix(u.Path, "/") + route.Path
+			v.RawPath = ""
+			dest = v.String()
+		}
+		r.urls = append(r.urls, dest)
+		r.commits = r.commits || route.FrameType == "" || route.FrameType == firehose.TypeCommit
+	}
+	return r, nil
+}
+
+// route returns the URL of the first route msg matches, or the webhook URL.
+// Frames that can't be decoded go to the webhook URL.
+func (r *webhookRouter) route(msg *nats.Msg) string {
+	// The shuffler sets the frame type header, which saves decoding
+	frameType := msg.Header.Get(firehose.HeaderFrameType)
+	var info firehose.FrameInfo
+	if frameType == "" || (frameType == firehose.TypeCommit && r.commits) {
+		var err error
+		if info, err = firehose.InspectFrame(msg.Data); err != nil {
+			return r.base
+		}
+		frameType = info.Type
+	}
+
+	for i, route := range r.routes {
+		if route.FrameType != "" {
+			if route.FrameType == frameType {
+				return r.urls[i]
+			}
+			continue
+		}
+		if frameType != firehose.TypeCommit {
+			continue
+		}
+		for j, path := range info.Paths {
+			collection, _, _ := strings.Cut(path, "/")
+			if matchRouteCollection(route.Collection, collection) && (route.Action == "" || route.Action == info.Actions[j]) {
+				return r.urls[i]
+			}
+		}
+	}
+	return r.base
+}
+
+func matchRouteCollection(pattern, collection string) bool {
+	if pattern == "*" {
+		return true
+	}
+	if prefix, ok := strings.CutSuffix(pattern, ".*"); ok {
+		return strings.HasPrefix(collection, prefix+".")
+	}
+	return collection == pattern
+}
+
+// routeGroup is the messages of a batch posted to one URL, with their
+// indexes in the batch.
+type routeGroup struct {
+	url     string
+	msgs    []*nats.Msg
+	indexes []int
+}
+
+// split groups msgs by URL, in the order the URLs first appear.
+func (r *webhookRouter) split(msgs []*nats.Msg) []*routeGroup {
+	var groups []*routeGroup
+	byURL := map[string]*routeGroup{}
+	for i, msg := range msgs {
+		u := r.route(msg)
+		g, ok := byURL[u]
+		if !ok {
+			g = &routeGroup{url: u}
+			byURL[u] = g
+			groups = append(groups, g)
+		}
+		g.msgs = append(g.msgs, msg)
+		g.indexes = append(g.indexes, i)
+	}
+	return groups
+}
@@ -0,0 +1,80 @@
+package consumer
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/pkg/events"
+)
+
+// statusMinutes is how many minutes of delivery attempts Status counts.
+const statusMinutes = 5
+
+// deliveryHealth tracks a consumer's recent delivery attempts.
+type deliveryHealth struct {
+	mu          sync.Mutex
+	consecutive int64
+	lastErr     string
+	// minutes counts the attempts per minute, as a ring
+	minutes [statusMinutes]attemptCount
+}
+
+type attemptCount struct {
+	minute   int64
+	attempts int64
+	failures int64
+}
+
+func (h *deliveryHealth) record(err error) {
+	now := time.Now().Unix() / 60
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	m := &h.minutes[now%statusMinutes]
+	if m.minute != now {
+		*m = attemptCount{minute: now}
+	}
+	m.attempts++
+	if err != nil {
+		m.failures++
+		h.consecutive++
+		h.lastErr = err.Error()
+		return
+	}
+	h.consecutive = 0
+}
+
+// Status returns the state of the consumer, for the replica running it to
+// publish. Instance is left empty.
+func (c *PullConsumer) Status() events.ConsumerStatus {
+	st := events.ConsumerStatus{
+		Name:      c.consumerName,
+		Target:    string(c.target),
+		State:     events.ConsumerRunning,
+		Processed: c.GetTotalCount(),
+		Pending:   atomic.LoadUint64(&c.pending),
+		Updated:   time.Now().UTC(),
+	}
+
+	now := time.Now().Unix() / 60
+	c.health.mu.Lock()
+	st.ConsecutiveFailures = c.health.consecutive
+	st.LastError = c.health.lastErr
+	for _, m := range c.health.minutes {
+		if now-m.minute < statusMinutes {
+			st.Attempts += m.attempts
+			st.Failures += m.failures
+		}
+	}
+	c.health.mu.Unlock()
+
+	_, maintenance := c.maintenance.Paused()
+	switch {
+	case c.quota.exhausted(), maintenance:
+		st.State = events.ConsumerPaused
+	case st.ConsecutiveFailures > 0:
+		st.State = events.ConsumerFailing
+	}
+	return st
+}
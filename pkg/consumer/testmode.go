@@ -0,0 +1,57 @@
+package consumer
+
+import (
+	"context"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/internal/pkg/fakerelay"
+	"github.com/eurosky/firehose-processor-aas/pkg/firehose"
+)
+
+const (
+	// DefaultTestRate and MaxTestRate are the synthetic frames per second a
+	// consumer in test mode generates when Config leaves TestRate unset, and
+	// the most it may ask for: enough to integrate an endpoint, not to load
+	// it.
+	DefaultTestRate = 1.0
+	MaxTestRate     = 10.0
+
+	// testDIDs is the number of made-up repos of the synthetic frames.
+	testDIDs = 100
+)
+
+// testRate returns the synthetic frames per second cfg's consumer
+// generates, zero when it isn't in test mode.
+func testRate(cfg Config) float64 {
+	switch {
+	case !cfg.TestMode:
+		return 0
+	case cfg.TestRate > 0:
+		return cfg.TestRate
+	}
+	return DefaultTestRate
+}
+
+// generate publishes the consumer's synthetic frames at its test rate,
+// except during maintenance, until ctx is done. Their sequences start at the
+// time in microseconds, so those of a restarted consumer keep increasing as
+// a relay's would.
+func (c *PullConsumer) generate(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / c.testRate))
+	defer ticker.Stop()
+	base := time.Now().UnixMicro()
+	for i := int64(1); ; i++ {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if _, paused := c.maintenance.Paused(); paused {
+				continue
+			}
+			frame := fakerelay.Synthetic(base+i, testDIDs, now, true)
+			if _, err := c.js.PublishMsg(firehose.SyntheticMsg(c.consumerName, frame)); err != nil {
+				c.logger.Warn("failed to publish synthetic frame", "consumer", c.consumerName, "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,334 @@
+package consumer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/pkg/events"
+	"github.com/eurosky/firehose-processor-aas/pkg/firehose"
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// DefaultAppViewURL is the AppView thread context is fetched from when
+	// Config.AppViewURL is empty: Bluesky's public one, which needs no
+	// credentials.
+	DefaultAppViewURL = "https://public.api.bsky.app"
+	// DefaultThreadCacheSize and DefaultThreadRate are the posts a
+	// ThreadResolver keeps and the AppView requests per second it makes,
+	// when left unset.
+	DefaultThreadCacheSize = 10000
+	DefaultThreadRate      = 5.0
+
+	// threadCacheTTL is how long a post, or the AppView not having it, is
+	// cached: replies come to the same threads in bursts, and edits are
+	// rare.
+	threadCacheTTL = 10 * time.Minute
+	// threadFetchBudget bounds the time a fetch waits on the AppView; the
+	// replies whose context isn't in by then are delivered without it.
+	threadFetchBudget = 5 * time.Second
+	// getPostsLimit is the most URIs app.bsky.feed.getPosts takes.
+	getPostsLimit = 25
+
+	// headerThreads carries, on the messages a consumer annotates, the JSON
+	// object of the thread context of their replies. It is set after the
+	// fetch, never in the stream.
+	headerThreads = "Fpaas-Threads"
+)
+
+var threadPosts = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "consumer_thread_posts_total",
+	Help: "Parent and root posts of replies looked up for thread context, by result (cached, fetched, missing, failed)",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(threadPosts)
+}
+
+// ThreadResolver fetches posts from an AppView for the thread context of
+// replies (see Config.ThreadContext), caching them and rate limiting its
+// requests. Consumers sharing one share both.
+type ThreadResolver struct {
+	url     string
+	client  *http.Client
+	limiter *rate.Limiter
+	cache   *lru.Cache[string, cachedPost]
+}
+
+// cachedPost is a post of the cache, nil when the AppView didn't have it.
+type cachedPost struct {
+	post    *events.ThreadPost
+	fetched time.Time
+}
+
+// NewThreadResolver returns a resolver of appViewURL (DefaultAppViewURL when
+// empty) caching cacheSize posts and making at most perSecond requests per
+// second; zero values take the defaults.
+func NewThreadResolver(appViewURL string, cacheSize int, perSecond float64) *ThreadResolver {
+	if appViewURL == "" {
+		appViewURL = DefaultAppViewURL
+	}
+	if cacheSize <= 0 {
+		cacheSize = DefaultThreadCacheSize
+	}
+	if perSecond <= 0 {
+		perSecond = DefaultThreadRate
+	}
+	// Only fails on a size under 1
+	cache, _ := lru.New[string, cachedPost](cacheSize)
+	return &ThreadResolver{
+		url:     strings.TrimSuffix(appViewURL, "/"),
+		client:  &http.Client{Timeout: threadFetchBudget},
+		limiter: rate.NewLimiter(rate.Limit(perSecond), max(1, int(perSecond))),
+		cache:   cache,
+	}
+}
+
+// posts returns those of uris the AppView has, fetching the ones not
+// cached. It stops at the first failed request, returning what it found;
+// the posts of failed requests aren't cached, so later replies retry them.
+func (r *ThreadResolver) posts(ctx context.Context, uris []string) (map[string]*events.ThreadPost, error) {
+	found := make(map[string]*events.ThreadPost, len(uris))
+	var missing []string
+	for _, uri := range uris {
+		if c, ok := r.cache.Get(uri); ok && time.Since(c.fetched) < threadCacheTTL {
+			threadPosts.WithLabelValues("cached").Inc()
+			if c.post != nil {
+				found[uri] = c.post
+			}
+		} else if !slices.Contains(missing, uri) {
+			missing = append(missing, uri)
+		}
+	}
+	now := time.Now()
+	for i := 0; i < len(missing); i += getPostsLimit {
+		chunk := missing[i:min(i+getPostsLimit, len(missing))]
+		posts, err := r.getPosts(ctx, chunk)
+		if err != nil {
+			threadPosts.WithLabelValues("failed").Add(float64(len(missing) - i))
+			return found, err
+		}
+		for _, uri := range chunk {
+			// nil when deleted or unknown to the AppView
+			p := posts[uri]
+			r.cache.Add(uri, cachedPost{post: p, fetched: now})
+			if p != nil {
+				threadPosts.WithLabelValues("fetched").Inc()
+				found[uri] = p
+			} else {
+				threadPosts.WithLabelValues("missing").Inc()
+			}
+		}
+	}
+	return found, nil
+}
+
+// getPosts fetches up to getPostsLimit posts with app.bsky.feed.getPosts.
+func (r *ThreadResolver) getPosts(ctx context.Context, uris []string) (map[string]*events.ThreadPost, error) {
+	if err := r.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	query := url.Values{"uris": uris}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.url+"/xrpc/app.bsky.feed.getPosts?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		answer, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("AppView returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(answer)))
+	}
+	var body struct {
+		Posts []struct {
+			URI    string `json:"uri"`
+			CID    string `json:"cid"`
+			Author struct {
+				DID         string `json:"did"`
+				Handle      string `json:"handle"`
+				DisplayName string `json:"displayName"`
+			} `json:"author"`
+			Record struct {
+				Text      string `json:"text"`
+				CreatedAt string `json:"createdAt"`
+			} `json:"record"`
+			IndexedAt  string `json:"indexedAt"`
+			ReplyCount int64  `json:"replyCount"`
+			LikeCount  int64  `json:"likeCount"`
+		} `json:"posts"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("failed to decode AppView posts: %w", err)
+	}
+	posts := make(map[string]*events.ThreadPost, len(body.Posts))
+	for _, p := range body.Posts {
+		posts[p.URI] = &events.ThreadPost{
+			URI:         p.URI,
+			CID:         p.CID,
+			Author:      p.Author.DID,
+			Handle:      p.Author.Handle,
+			DisplayName: p.Author.DisplayName,
+			Text:        p.Record.Text,
+			CreatedAt:   p.Record.CreatedAt,
+			IndexedAt:   p.IndexedAt,
+			ReplyCount:  p.ReplyCount,
+			LikeCount:   p.LikeCount,
+		}
+	}
+	return posts, nil
+}
+
+// threadEnricher annotates the replies a consumer delivers with their thread
+// context.
+type threadEnricher struct {
+	resolver *ThreadResolver
+	logger   *slog.Logger
+}
+
+// newThreadEnricher returns the enricher of cfg, nil when it fetches no
+// thread context.
+func newThreadEnricher(cfg Config, logger *slog.Logger) *threadEnricher {
+	if !cfg.ThreadContext {
+		return nil
+	}
+	resolver := cfg.Threads
+	if resolver == nil {
+		resolver = NewThreadResolver(cfg.AppViewURL, 0, 0)
+	}
+	return &threadEnricher{resolver: resolver, logger: logger}
+}
+
+// replyRefs are the parent and root at:// URIs of a reply.
+type replyRefs struct {
+	parent, root string
+}
+
+// annotate returns msgs with those holding replies replaced by annotated
+// copies. Fetching the context is best effort: the replies it failed for
+// are delivered as they are. It is safe to call on a nil enricher.
+func (e *threadEnricher) annotate(ctx context.Context, msgs []*nats.Msg) []*nats.Msg {
+	if e == nil {
+		return msgs
+	}
+	replies := make([]map[string]replyRefs, len(msgs))
+	var uris []string
+	for i, msg := range msgs {
+		replies[i] = messageReplies(msg.Data)
+		for _, refs := range replies[i] {
+			uris = append(uris, refs.parent)
+			if refs.root != "" {
+				uris = append(uris, refs.root)
+			}
+		}
+	}
+	if len(uris) == 0 {
+		return msgs
+	}
+	ctx, cancel := context.WithTimeout(ctx, threadFetchBudget)
+	defer cancel()
+	posts, err := e.resolver.posts(ctx, uris)
+	if err != nil {
+		e.logger.Warn("failed to fetch thread context, delivering replies without it", "error", err)
+	}
+
+	annotated := slices.Clone(msgs)
+	for i, refs := range replies {
+		var threads map[string]events.ThreadContext
+		for uri, ref := range refs {
+			tc := events.ThreadContext{Parent: posts[ref.parent], Root: posts[ref.root]}
+			if tc.Parent == nil && tc.Root == nil {
+				continue
+			}
+			if threads == nil {
+				threads = make(map[string]events.ThreadContext, len(refs))
+			}
+			threads[uri] = tc
+		}
+		if threads == nil {
+			continue
+		}
+		data, _ := json.Marshal(threads)
+		msg := *msgs[i]
+		msg.Header = maps.Clone(msgs[i].Header)
+		if msg.Header == nil {
+			msg.Header = nats.Header{}
+		}
+		msg.Header.Set(headerThreads, string(data))
+		annotated[i] = &msg
+	}
+	return annotated
+}
+
+// messageReplies returns the reply refs of the posts a frame creates, by
+// the posts' at:// URIs, or nil when it creates none.
+func messageReplies(data []byte) map[string]replyRefs {
+	info, err := firehose.InspectFrame(data)
+	if err != nil || !slices.Contains(info.Collections, "app.bsky.feed.post") {
+		return nil
+	}
+	evt, err := firehose.DecodeFrame(data)
+	if err != nil {
+		return nil
+	}
+	var replies map[string]replyRefs
+	for _, op := range evt.Ops {
+		if op.Collection != "app.bsky.feed.post" || op.Action != "create" {
+			continue
+		}
+		var record struct {
+			Reply *struct {
+				Parent struct {
+					URI string `json:"uri"`
+				} `json:"parent"`
+				Root struct {
+					URI string `json:"uri"`
+				} `json:"root"`
+			} `json:"reply"`
+		}
+		if json.Unmarshal(op.Record, &record) != nil || record.Reply == nil || record.Reply.Parent.URI == "" {
+			continue
+		}
+		if replies == nil {
+			replies = make(map[string]replyRefs)
+		}
+		replies["at://"+evt.DID+"/"+op.Collection+"/"+op.Rkey] = replyRefs{parent: record.Reply.Parent.URI, root: record.Reply.Root.URI}
+	}
+	return replies
+}
+
+// MessageThreads merges the thread context of msgs (see
+// Config.ThreadContext), nil when there is none. Custom Deliverers read it
+// with it.
+func MessageThreads(msgs ...*nats.Msg) map[string]events.ThreadContext {
+	var threads map[string]events.ThreadContext
+	for _, msg := range msgs {
+		h := msg.Header.Get(headerThreads)
+		if h == "" {
+			continue
+		}
+		var m map[string]events.ThreadContext
+		if json.Unmarshal([]byte(h), &m) != nil {
+			continue
+		}
+		if threads == nil {
+			threads = make(map[string]events.ThreadContext, len(m))
+		}
+		maps.Copy(threads, m)
+	}
+	return threads
+}
@@ -0,0 +1,57 @@
+package consumer
+
+import (
+	"context"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/internal/pkg/tracing"
+	"github.com/nats-io/nats.go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/eurosky/firehose-processor-aas/pkg/consumer")
+
+// startFetch starts the span of a fetch that returned messages, backdated to
+// when the fetch began; empty polls aren't traced. Delivery spans are its
+// children.
+func (c *PullConsumer) startFetch(ctx context.Context, start time.Time, msgs []*nats.Msg) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "consumer.fetch",
+		trace.WithTimestamp(start),
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "nats"),
+			attribute.String("fpaas.consumer", c.consumerName),
+			attribute.Int("messaging.batch.message_count", len(msgs)),
+		),
+	)
+}
+
+// startDelivery starts the span of one delivery attempt, linked to the
+// ingest spans that published msgs.
+func (c *PullConsumer) startDelivery(ctx context.Context, msgs []*nats.Msg) trace.Span {
+	first, last := seqRange(msgs)
+	_, span := tracer.Start(ctx, "consumer.deliver",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithLinks(tracing.Links(msgs)...),
+		trace.WithAttributes(
+			attribute.String("fpaas.consumer", c.consumerName),
+			attribute.String("fpaas.target", string(c.target)),
+			attribute.String("fpaas.granularity", string(c.granularity)),
+			attribute.Int("messaging.batch.message_count", len(msgs)),
+			attribute.Int64("fpaas.first_stream_seq", int64(first)),
+			attribute.Int64("fpaas.last_stream_seq", int64(last)),
+		),
+	)
+	return span
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
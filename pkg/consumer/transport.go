@@ -0,0 +1,69 @@
+package consumer
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HTTPOptions tunes the HTTP transport webhooks are delivered with.
+// Consumers with the same options share one transport, and so its idle
+// connections to each host: a batch reuses a connection another consumer
+// opened rather than doing its own TLS handshake.
+type HTTPOptions struct {
+	// MaxIdleConnsPerHost is how many idle connections are kept per host.
+	// With HTTP/2 a single connection carries concurrent requests.
+	MaxIdleConnsPerHost int
+	// HTTP2 lets TLS connections negotiate HTTP/2.
+	HTTP2               bool
+	DialTimeout         time.Duration
+	TLSHandshakeTimeout time.Duration
+	// KeepAlive is the TCP keep-alive probe interval; negative disables it.
+	KeepAlive time.Duration
+	// IdleConnTimeout is how long an idle connection is kept.
+	IdleConnTimeout time.Duration
+}
+
+// DefaultHTTPOptions keeps enough idle connections for a few hundred
+// consumers polling one host; the zero HTTPOptions stands for them.
+var DefaultHTTPOptions = HTTPOptions{
+	MaxIdleConnsPerHost: 100,
+	HTTP2:               true,
+	DialTimeout:         5 * time.Second,
+	TLSHandshakeTimeout: 5 * time.Second,
+	KeepAlive:           30 * time.Second,
+	IdleConnTimeout:     90 * time.Second,
+}
+
+// transports holds the shared transport of each HTTPOptions.
+var transports sync.Map
+
+// sharedTransport returns the transport for opts, creating it on first use.
+func sharedTransport(opts HTTPOptions) *http.Transport {
+	if opts == (HTTPOptions{}) {
+		opts = DefaultHTTPOptions
+	}
+	if t, ok := transports.Load(opts); ok {
+		return t.(*http.Transport)
+	}
+
+	dialer := &net.Dialer{Timeout: opts.DialTimeout, KeepAlive: opts.KeepAlive}
+	t := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         dialer.DialContext,
+		ForceAttemptHTTP2:   opts.HTTP2,
+		MaxIdleConnsPerHost: opts.MaxIdleConnsPerHost,
+		IdleConnTimeout:     opts.IdleConnTimeout,
+		TLSHandshakeTimeout: opts.TLSHandshakeTimeout,
+		// As in http.DefaultTransport
+		ExpectContinueTimeout: time.Second,
+	}
+	if !opts.HTTP2 {
+		// A non-nil empty map keeps TLS connections on HTTP/1.1
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	actual, _ := transports.LoadOrStore(opts, t)
+	return actual.(*http.Transport)
+}
@@ -0,0 +1,295 @@
+package consumer
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/pkg/firehose"
+)
+
+// Validate checks cfg without connecting to anything, so it can back both
+// NewPullConsumer and offline config validation.
+func (cfg Config) Validate() error {
+	var errs []error
+
+	if cfg.NATSURL == "" {
+		errs = append(errs, errors.New("nats url is required"))
+	}
+	if cfg.Name == "" {
+		errs = append(errs, errors.New("consumer name is required"))
+	}
+	if cfg.PollInterval <= 0 {
+		errs = append(errs, fmt.Errorf("poll interval must be positive, got %s", cfg.PollInterval))
+	}
+	if cfg.BatchSize < 1 {
+		errs = append(errs, fmt.Errorf("batch size must be at least 1, got %d", cfg.BatchSize))
+	}
+	if cfg.Autotune {
+		if err := cfg.AutotuneBounds.validate(cfg); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	// Polls are jittered by up to half the interval
+	if cfg.InactiveThreshold < 0 || (cfg.InactiveThreshold > 0 && cfg.InactiveThreshold < 2*cfg.PollInterval) {
+		errs = append(errs, fmt.Errorf("inactive threshold must be at least twice the poll interval, got %s", cfg.InactiveThreshold))
+	}
+
+	if o := cfg.WebhookHTTP; o.MaxIdleConnsPerHost < 0 || o.DialTimeout < 0 || o.TLSHandshakeTimeout < 0 || o.IdleConnTimeout < 0 {
+		errs = append(errs, errors.New("webhook max idle conns per host, dial, TLS handshake and idle conn timeouts must not be negative"))
+	}
+	if cfg.WebhookTimeout < 0 {
+		errs = append(errs, fmt.Errorf("webhook timeout must not be negative, got %s", cfg.WebhookTimeout))
+	}
+	if len(cfg.WebhookRoutes) > 0 {
+		if cfg.Target != "" && cfg.Target != TargetWebhook {
+			errs = append(errs, fmt.Errorf("webhook routes need the webhook target, got %q", cfg.Target))
+		}
+		if _, err := ParseWebhookRoutes(cfg.WebhookRoutes); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if cfg.AggregateWindow != 0 {
+		if cfg.AggregateWindow < MinAggregateWindow || cfg.AggregateWindow > MaxAggregateWindow {
+			errs = append(errs, fmt.Errorf("aggregate window must be between %s and %s, got %s", MinAggregateWindow, MaxAggregateWindow, cfg.AggregateWindow))
+		}
+		if cfg.Target != "" && cfg.Target != TargetWebhook {
+			errs = append(errs, fmt.Errorf("aggregation windows need the webhook target, got %q", cfg.Target))
+		}
+		if cfg.PayloadFormat != "" && cfg.PayloadFormat != FormatJSON {
+			errs = append(errs, fmt.Errorf("aggregation windows need the json payload format, got %q", cfg.PayloadFormat))
+		}
+		if len(cfg.WebhookRoutes) > 0 {
+			errs = append(errs, errors.New("aggregation windows can't be combined with webhook routes, rollups go to the webhook url"))
+		}
+	}
+
+	if cfg.Analysis != "" {
+		if _, ok := analysisFlags[cfg.Analysis]; !ok {
+			errs = append(errs, fmt.Errorf("unknown analysis %q", cfg.Analysis))
+		}
+		if len(cfg.FrameTypes) > 0 || len(cfg.Collections) > 0 || cfg.KeywordQueries || len(cfg.Languages) > 0 || cfg.DetectLanguages || cfg.Watchlist || cfg.AggregateWindow != 0 {
+			errs = append(errs, errors.New("analysis consumers deliver reports, which frame filters, keyword queries, languages, watchlists and aggregation windows don't apply to"))
+		}
+		switch cfg.Target {
+		case TargetSlack, TargetDiscord, TargetEmail:
+			errs = append(errs, fmt.Errorf("the %s target renders frames, it can't deliver analysis reports", cfg.Target))
+		}
+	}
+
+	if cfg.TestMode && (cfg.Watchlist || cfg.Analysis != "") {
+		errs = append(errs, errors.New("test mode delivers synthetic frames, it can't read a watchlist or an analysis"))
+	}
+	if cfg.TestRate < 0 || cfg.TestRate > MaxTestRate {
+		errs = append(errs, fmt.Errorf("test rate must be between 0 and %g frames per second", MaxTestRate))
+	}
+
+	switch cfg.DeliveryGranularity {
+	case "", DeliverBatch, DeliverEvent:
+	default:
+		errs = append(errs, fmt.Errorf("unknown delivery granularity %q", cfg.DeliveryGranularity))
+	}
+	if cfg.AckAll && cfg.DeliveryGranularity == DeliverEvent {
+		errs = append(errs, errors.New("ack all needs the batch delivery granularity, events are delivered out of order"))
+	}
+
+	switch cfg.PayloadFormat {
+	case "", FormatJSON, FormatProtobuf, FormatAvro:
+	default:
+		errs = append(errs, fmt.Errorf("unknown payload format %q", cfg.PayloadFormat))
+	}
+
+	for _, t := range cfg.FrameTypes {
+		switch t {
+		case firehose.TypeCommit, firehose.TypeSync, firehose.TypeIdentity, firehose.TypeAccount, firehose.TypeInfo:
+		default:
+			errs = append(errs, fmt.Errorf("unknown frame type %q in filter", t))
+		}
+	}
+	if slices.Contains(cfg.TombstoneStatuses, "") {
+		errs = append(errs, errors.New("tombstone statuses must not contain an empty status"))
+	}
+	for _, c := range cfg.Collections {
+		if c == "" || strings.Contains(strings.TrimSuffix(c, ".*"), "*") {
+			errs = append(errs, fmt.Errorf("invalid collection filter %q", c))
+		}
+	}
+	if _, err := firehose.ParseRedaction(cfg.Redaction); err != nil {
+		errs = append(errs, err)
+	}
+	if slices.Contains(cfg.ExcludeLabels, "") || slices.Contains(cfg.AnnotateLabels, "") {
+		errs = append(errs, errors.New("label filters must not contain an empty label"))
+	}
+	if len(cfg.AnnotateLabels) > 0 {
+		if cfg.PayloadFormat != "" && cfg.PayloadFormat != FormatJSON {
+			errs = append(errs, fmt.Errorf("label annotations need the json payload format, got %q", cfg.PayloadFormat))
+		}
+		if cfg.Target == TargetPostgres || cfg.Target == TargetClickHouse {
+			errs = append(errs, fmt.Errorf("the %s target can't carry label annotations", cfg.Target))
+		}
+	}
+	if err := validateLanguages(cfg.Languages); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.DetectLanguages {
+		if cfg.PayloadFormat != "" && cfg.PayloadFormat != FormatJSON {
+			errs = append(errs, fmt.Errorf("language annotations need the json payload format, got %q", cfg.PayloadFormat))
+		}
+		if cfg.Target == TargetPostgres || cfg.Target == TargetClickHouse {
+			errs = append(errs, fmt.Errorf("the %s target can't carry language annotations", cfg.Target))
+		}
+	}
+	if cfg.ThreadContext {
+		if cfg.Analysis != "" || cfg.AggregateWindow != 0 {
+			errs = append(errs, errors.New("thread context is fetched for the replies delivered, analysis reports and rollups have none"))
+		}
+		if cfg.PayloadFormat != "" && cfg.PayloadFormat != FormatJSON {
+			errs = append(errs, fmt.Errorf("thread context needs the json payload format, got %q", cfg.PayloadFormat))
+		}
+		switch cfg.Target {
+		case TargetPostgres, TargetClickHouse, TargetSlack, TargetDiscord, TargetEmail:
+			errs = append(errs, fmt.Errorf("the %s target can't carry thread context", cfg.Target))
+		}
+		if cfg.AppViewURL != "" {
+			if u, err := url.Parse(cfg.AppViewURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				errs = append(errs, fmt.Errorf("appview url must be an http:// or https:// URL, got %q", cfg.AppViewURL))
+			}
+		}
+	}
+	if cfg.Blobs || cfg.FetchBlobs {
+		if cfg.Analysis != "" || cfg.AggregateWindow != 0 {
+			errs = append(errs, errors.New("blob references are extracted from the records delivered, analysis reports and rollups have none"))
+		}
+		if cfg.PayloadFormat != "" && cfg.PayloadFormat != FormatJSON {
+			errs = append(errs, fmt.Errorf("blob references need the json payload format, got %q", cfg.PayloadFormat))
+		}
+		switch cfg.Target {
+		case TargetPostgres, TargetClickHouse, TargetSlack, TargetDiscord, TargetEmail:
+			errs = append(errs, fmt.Errorf("the %s target can't carry blob references", cfg.Target))
+		}
+	}
+	if cfg.FetchBlobs {
+		if u, err := url.Parse(cfg.BlobBaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("fetching blobs needs a blob base url, an http:// or https:// URL, got %q", cfg.BlobBaseURL))
+		}
+		if cfg.BlobMaxSize < 0 {
+			errs = append(errs, fmt.Errorf("blob max size must not be negative, got %d", cfg.BlobMaxSize))
+		}
+		if cfg.BlobURLTTL < 0 || cfg.BlobURLTTL >= BlobRetention {
+			errs = append(errs, fmt.Errorf("blob url ttl must be under the %s blobs are kept, got %s", BlobRetention, cfg.BlobURLTTL))
+		}
+	}
+
+	// With a custom Deliverer, Target is only a label
+	if cfg.Deliverer == nil {
+		errs = append(errs, validateTarget(cfg)...)
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateTarget checks the settings of the built-in delivery target.
+func validateTarget(cfg Config) []error {
+	var errs []error
+	switch cfg.Target {
+	case "", TargetWebhook:
+		if cfg.UseWebhook && cfg.WebhookURL == "" {
+			errs = append(errs, errors.New("webhook delivery is enabled but no webhook url is set"))
+		}
+	case TargetSQS:
+		if cfg.SQSQueueURL == "" {
+			errs = append(errs, errors.New("sqs target requires a queue URL"))
+		}
+	case TargetSNS:
+		if cfg.SNSTopicARN == "" {
+			errs = append(errs, errors.New("sns target requires a topic ARN"))
+		}
+	case TargetPubSub:
+		if cfg.PubSubProject == "" || cfg.PubSubTopic == "" {
+			errs = append(errs, errors.New("pubsub target requires a project and a topic"))
+		}
+	case TargetPostgres:
+		if cfg.PostgresDSN == "" {
+			errs = append(errs, errors.New("postgres target requires a DSN"))
+		}
+		for _, col := range cfg.PostgresColumns {
+			if _, ok := postgresColumnTypes[col]; !ok {
+				errs = append(errs, fmt.Errorf("unknown postgres column %q", col))
+			}
+		}
+	case TargetClickHouse:
+		if cfg.ClickHouseURL == "" {
+			errs = append(errs, errors.New("clickhouse target requires an HTTP endpoint URL"))
+		}
+	case TargetMQTT:
+		if cfg.MQTTBrokerURL == "" {
+			errs = append(errs, errors.New("mqtt target requires a broker URL"))
+		}
+		if cfg.MQTTQoS < 0 || cfg.MQTTQoS > 2 {
+			errs = append(errs, fmt.Errorf("invalid mqtt QoS %d", cfg.MQTTQoS))
+		}
+	case TargetSlack, TargetDiscord:
+		if cfg.ChatWebhookURL == "" {
+			errs = append(errs, fmt.Errorf("%s target requires an incoming webhook URL", cfg.Target))
+		} else if err := checkChatURL(cfg.Target, cfg.ChatWebhookURL); err != nil {
+			errs = append(errs, err)
+		}
+		if _, err := parseChatTemplate(cfg.ChatTemplate); err != nil {
+			errs = append(errs, err)
+		}
+		if cfg.ChatRate < 0 {
+			errs = append(errs, fmt.Errorf("chat rate must not be negative, got %g", cfg.ChatRate))
+		}
+	case TargetEmail:
+		if len(cfg.EmailTo) == 0 {
+			errs = append(errs, errors.New("email target requires recipients"))
+		}
+		for _, to := range cfg.EmailTo {
+			if _, err := mail.ParseAddress(to); err != nil {
+				errs = append(errs, fmt.Errorf("invalid email recipient %q: %w", to, err))
+			}
+		}
+		if _, err := mail.ParseAddress(cfg.EmailFrom); err != nil {
+			errs = append(errs, fmt.Errorf("invalid email sender %q: %w", cfg.EmailFrom, err))
+		}
+		if _, err := parseSMTPURL(cfg.SMTPURL); err != nil {
+			errs = append(errs, err)
+		}
+		if _, err := parseDigestTemplate(cfg.EmailTemplate); err != nil {
+			errs = append(errs, err)
+		}
+		if cfg.DigestInterval != 0 && (cfg.DigestInterval < time.Minute || cfg.DigestInterval > MaxDigestInterval) {
+			errs = append(errs, fmt.Errorf("digest interval must be between 1m and %s, got %s", MaxDigestInterval, cfg.DigestInterval))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown delivery target %q", cfg.Target))
+	}
+	return errs
+}
+
+// chatWebhookPrefixes are where Slack and Discord serve incoming webhooks.
+// Chat targets skip the handshake of webhook subscriptions, so they may
+// only post there rather than to any URL.
+var chatWebhookPrefixes = map[Target][]string{
+	TargetSlack:   {"https://hooks.slack.com/"},
+	TargetDiscord: {"https://discord.com/api/webhooks/", "https://discordapp.com/api/webhooks/"},
+}
+
+func checkChatURL(target Target, raw string) error {
+	u, err := url.Parse(raw)
+	if err == nil && u.User == nil {
+		// As parsed, so neither userinfo nor a port gets through
+		parsed := u.Scheme + "://" + u.Host + u.EscapedPath()
+		for _, prefix := range chatWebhookPrefixes[target] {
+			if strings.HasPrefix(parsed, prefix) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%s webhook URL must start with %s", target, strings.Join(chatWebhookPrefixes[target], " or "))
+}
@@ -0,0 +1,37 @@
+package consumer
+
+import (
+	"encoding/json"
+	"slices"
+
+	"github.com/eurosky/firehose-processor-aas/pkg/firehose"
+	"github.com/nats-io/nats.go"
+)
+
+// MessageWatched merges the watched DIDs msgs concern, with their roles (see
+// Config.Watchlist), nil when there are none. Custom Deliverers read them
+// with it.
+func MessageWatched(msgs ...*nats.Msg) map[string][]string {
+	var watched map[string][]string
+	for _, msg := range msgs {
+		h := msg.Header.Get(firehose.HeaderWatched)
+		if h == "" {
+			continue
+		}
+		var m map[string][]string
+		if json.Unmarshal([]byte(h), &m) != nil {
+			continue
+		}
+		if watched == nil {
+			watched = make(map[string][]string, len(m))
+		}
+		for did, roles := range m {
+			for _, role := range roles {
+				if !slices.Contains(watched[did], role) {
+					watched[did] = append(watched[did], role)
+				}
+			}
+		}
+	}
+	return watched
+}
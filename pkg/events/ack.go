@@ -0,0 +1,17 @@
+package events
+
+// Ack is the optional JSON body of a receiver's answer to a delivery,
+// acknowledging its events one by one. With a 200, webhook consumers
+// redeliver the events rejected; with another status, they keep those
+// accepted and redeliver the rest.
+type Ack struct {
+	Accepted []AckEvent `json:"accepted" doc:"Events the receiver processed."`
+	Rejected []AckEvent `json:"rejected" doc:"Events the receiver refused and wants redelivered."`
+}
+
+// AckEvent identifies an event of a delivery.
+type AckEvent struct {
+	Index  int    `json:"index" doc:"Position of the event in the delivery, from 0."`
+	Seq    int64  `json:"seq,omitempty" doc:"Relay sequence number of the event; #info frames have none."`
+	Reason string `json:"reason,omitempty" doc:"Why a rejected event was refused."`
+}
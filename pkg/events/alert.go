@@ -0,0 +1,45 @@
+package events
+
+import "time"
+
+// Throughput alert kinds.
+const (
+	AlertStalled   = "stalled"
+	AlertSpike     = "spike"
+	AlertRecovered = "recovered"
+)
+
+// Alert reports a change of the stream's throughput. The analyzer (fpaas
+// analyze) publishes one on atproto.alerts when frames stop arriving, when
+// their rate spikes, and when it is back to normal.
+type Alert struct {
+	Time     time.Time `json:"time" doc:"When the alert fired."`
+	Kind     string    `json:"kind" enum:"stalled,spike,recovered" doc:"What happened to the throughput."`
+	Rate     float64   `json:"rate" doc:"Frames per second over the last interval."`
+	Expected float64   `json:"expected" doc:"Frames per second expected from the recent past."`
+	StdDev   float64   `json:"stddev" doc:"Standard deviation of the recent rates."`
+	Text     string    `json:"text" doc:"Human-readable summary; the message shown by Slack incoming webhooks."`
+	Instance string    `json:"instance" doc:"Analyzer instance that fired the alert."`
+	Group    string    `json:"group,omitempty" doc:"Group of analyzers splitting the stream; each instance sees and alerts on its share."`
+}
+
+// Alerting rule statuses.
+const (
+	RuleFiring   = "firing"
+	RuleResolved = "resolved"
+)
+
+// RuleAlert is a notification of an alerting rule of the analyzer (fpaas
+// analyze --rules), published on atproto.alerts.rules and sent to the
+// rule's notifiers.
+type RuleAlert struct {
+	Time      time.Time `json:"time" doc:"When the rule fired or resolved."`
+	Rule      string    `json:"rule" doc:"Name of the rule."`
+	Status    string    `json:"status" enum:"firing,resolved" doc:"Whether the condition started or stopped holding."`
+	Metric    string    `json:"metric" doc:"Metric the rule checks."`
+	Consumer  string    `json:"consumer,omitempty" doc:"Consumer the value is about; empty for stream metrics."`
+	Value     float64   `json:"value" doc:"Value of the metric when the alert was sent."`
+	Condition string    `json:"condition" doc:"The rule's condition, such as \"> 100000 for 5m0s\"."`
+	Text      string    `json:"text" doc:"Human-readable summary; the message shown by Slack incoming webhooks."`
+	Instance  string    `json:"instance" doc:"Analyzer instance that evaluated the rule."`
+}
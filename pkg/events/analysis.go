@@ -0,0 +1,46 @@
+package events
+
+import "time"
+
+// DuplicateCluster is a cluster of posts with near-identical text, likely
+// spam. The analyzer (fpaas analyze --duplicates) publishes it on
+// atproto.analysis.duplicates once it is large enough, and again every time
+// it doubles.
+type DuplicateCluster struct {
+	ID          string    `json:"id" doc:"Simhash fingerprint of the cluster's first post, in hex; the reports of a cluster share it."`
+	FirstSeen   time.Time `json:"first_seen" doc:"When the analyzer saw the first post of the cluster."`
+	LastSeen    time.Time `json:"last_seen" doc:"When it saw the latest one."`
+	Posts       int64     `json:"posts" doc:"Number of posts in the cluster."`
+	DIDs        int       `json:"dids" doc:"Number of distinct DIDs that posted them, counted up to 10000."`
+	Text        string    `json:"text" doc:"Text of the first post, cut to 300 characters."`
+	Samples     []string  `json:"samples" doc:"at:// URIs of the first posts of the cluster, up to 10."`
+	SampleDIDs  []string  `json:"sample_dids" doc:"First DIDs that posted in the cluster, up to 10."`
+	MaxDistance int       `json:"max_distance" doc:"Bits by which the fingerprints of the posts may differ from those of the cluster."`
+	Instance    string    `json:"instance" doc:"Analyzer instance that made the report."`
+	Group       string    `json:"group,omitempty" doc:"Group of analyzers splitting the stream; each instance clusters its share of the posts."`
+}
+
+// Burst statuses.
+const (
+	BurstStarted = "started"
+	BurstEnded   = "ended"
+)
+
+// Burst is a DID creating records faster than a threshold, likely a spam or
+// follow bot. The analyzer (fpaas analyze --bursts) publishes it on
+// atproto.analysis.bursts when the DID's rate crosses the threshold, and
+// again when it falls back under half of it.
+type Burst struct {
+	DID           string           `json:"did" doc:"DID creating the records."`
+	Status        string           `json:"status" enum:"started,ended" doc:"Whether the burst started or ended."`
+	Time          time.Time        `json:"time" doc:"When the burst started or ended."`
+	Start         time.Time        `json:"start" doc:"When the DID's rate crossed the threshold."`
+	Rate          float64          `json:"rate" doc:"Records the DID created in the last window, estimated from the current and previous windows."`
+	Peak          float64          `json:"peak" doc:"Highest rate of the burst so far."`
+	Records       int64            `json:"records" doc:"Records created since the burst started, from the one that crossed the threshold; the rate counts those before."`
+	Collections   map[string]int64 `json:"collections" doc:"The records by collection."`
+	Threshold     int64            `json:"threshold" doc:"Records per window that make a burst."`
+	WindowSeconds int64            `json:"window_seconds" doc:"Length of the window rates are measured over."`
+	Instance      string           `json:"instance" doc:"Analyzer instance that made the report."`
+	Group         string           `json:"group,omitempty" doc:"Group of analyzers splitting the stream; each instance counts its share of the records."`
+}
@@ -0,0 +1,42 @@
+package events
+
+import "time"
+
+// Delivery statuses.
+const (
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// DeliveryRecord is one delivery attempt: a batch, or a single event with
+// event granularity. Consumers with the delivery log enabled publish one per
+// attempt on fpaas.deliveries.<consumer>; the control plane lists them.
+type DeliveryRecord struct {
+	ID           string    `json:"id" doc:"Unique ID of the attempt."`
+	Consumer     string    `json:"consumer" doc:"Name of the consumer."`
+	Target       string    `json:"target" doc:"Delivery target (webhook, sqs, sns, pubsub, postgres, clickhouse, mqtt, slack, discord, email)."`
+	Status       string    `json:"status" enum:"delivered,failed" doc:"Outcome of the attempt."`
+	Error        string    `json:"error,omitempty" doc:"Why the attempt failed."`
+	Events       int       `json:"events" doc:"Number of events in the attempt."`
+	FirstSeq     uint64    `json:"first_seq" doc:"Lowest stream sequence covered by the attempt."`
+	LastSeq      uint64    `json:"last_seq" doc:"Highest stream sequence covered by the attempt."`
+	DurationMs   int64     `json:"duration_ms" doc:"Duration of the attempt in milliseconds."`
+	Time         time.Time `json:"time" doc:"When the attempt finished."`
+	RedeliveryOf string    `json:"redelivery_of,omitempty" doc:"ID of the record a manual redelivery retried."`
+}
+
+// DeliveryStats summarizes the delivery attempts of a consumer.
+type DeliveryStats struct {
+	Attempts  int   `json:"attempts" doc:"Number of delivery attempts."`
+	Delivered int   `json:"delivered" doc:"Number of successful attempts."`
+	Failed    int   `json:"failed" doc:"Number of failed attempts."`
+	Events    int64 `json:"events" doc:"Number of events in successful attempts."`
+}
+
+// SuccessRate is the share of delivered attempts, 1 when there were none.
+func (s DeliveryStats) SuccessRate() float64 {
+	if s.Attempts == 0 {
+		return 1
+	}
+	return float64(s.Delivered) / float64(s.Attempts)
+}
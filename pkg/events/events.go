@@ -0,0 +1,96 @@
+// Package events defines the payloads fpaas emits, so Go receivers can import
+// the types instead of reverse-engineering them: the webhook envelopes
+// (Batch, Event), the firehose frames they carry once decoded (Commit, Sync,
+// Identity, Account, Info) and the delivery log (DeliveryRecord,
+// DeliveryStats).
+//
+// JSONSchema describes any of them as JSON Schema for receivers in other
+// languages; the generated schemas are in schema/json.
+package events
+
+import "time"
+
+// SchemaVersion is sent as X-Schema-Version with every webhook call. It is
+// bumped on any incompatible change to the envelopes.
+const SchemaVersion = "2"
+
+// Frame types as they appear in the event stream header.
+const (
+	TypeCommit   = "#commit"
+	TypeSync     = "#sync"
+	TypeIdentity = "#identity"
+	TypeAccount  = "#account"
+	TypeInfo     = "#info"
+	TypeError    = "error"
+)
+
+// Batch is the webhook body when the consumer delivers with batch
+// granularity. With the JSON payload format, Events are base64 strings.
+type Batch struct {
+	Consumer  string                   `json:"consumer" doc:"Name of the consumer that delivered the batch."`
+	Events    [][]byte                 `json:"events" doc:"Raw firehose frames (DAG-CBOR), in stream order; decode them with Decode. Consumers of an analysis get its JSON reports instead, e.g. DuplicateCluster."`
+	Count     int                      `json:"count" doc:"Number of events in the batch."`
+	Labels    map[string][]string      `json:"labels,omitempty" doc:"Label values of the events' subjects (account DIDs and at:// record URIs), when the consumer annotates labeled events; subjects without labels are left out."`
+	Matches   map[string][]string      `json:"matches,omitempty" doc:"IDs of the keyword queries the events' posts matched, by at:// URI, when the consumer filters on keyword queries."`
+	Languages map[string][]string      `json:"languages,omitempty" doc:"ISO 639 codes of the languages of the events' posts, by at:// URI, as their langs tag them or else detected from their text, when the consumer filters on or detects languages; posts of unknown language are left out."`
+	Watched   map[string][]string      `json:"watched,omitempty" doc:"Roles (author, mention, reply) of the watched DIDs the events concern, by DID, when the consumer reads its watchlist."`
+	Threads   map[string]ThreadContext `json:"threads,omitempty" doc:"Posts the events' replies answer, by the replies' at:// URIs, when the consumer fetches thread context; replies whose context couldn't be fetched are left out."`
+	Blobs     map[string][]BlobRef     `json:"blobs,omitempty" doc:"Blobs (images, videos, avatars) the events' records reference, by the records' at:// URIs, when the consumer extracts blob references."`
+	Meta      []EventMeta              `json:"meta,omitempty" doc:"JetStream metadata of the events, in the order of events."`
+}
+
+// Event is the webhook body when the consumer delivers with event
+// granularity.
+type Event struct {
+	Consumer  string                   `json:"consumer" doc:"Name of the consumer that delivered the event."`
+	Event     []byte                   `json:"event" doc:"Raw firehose frame (DAG-CBOR); decode it with Decode. Consumers of an analysis get one of its JSON reports instead, e.g. DuplicateCluster."`
+	Labels    map[string][]string      `json:"labels,omitempty" doc:"Label values of the event's subjects (its account DID and at:// record URIs), when the consumer annotates labeled events; subjects without labels are left out."`
+	Matches   map[string][]string      `json:"matches,omitempty" doc:"IDs of the keyword queries the event's posts matched, by at:// URI, when the consumer filters on keyword queries."`
+	Languages map[string][]string      `json:"languages,omitempty" doc:"ISO 639 codes of the languages of the event's posts, by at:// URI, as their langs tag them or else detected from their text, when the consumer filters on or detects languages; posts of unknown language are left out."`
+	Watched   map[string][]string      `json:"watched,omitempty" doc:"Roles (author, mention, reply) of the watched DIDs the event concerns, by DID, when the consumer reads its watchlist."`
+	Threads   map[string]ThreadContext `json:"threads,omitempty" doc:"Posts the event's replies answer, by the replies' at:// URIs, when the consumer fetches thread context; replies whose context couldn't be fetched are left out."`
+	Blobs     map[string][]BlobRef     `json:"blobs,omitempty" doc:"Blobs (images, videos, avatars) the event's records reference, by the records' at:// URIs, when the consumer extracts blob references."`
+	Meta      *EventMeta               `json:"meta,omitempty" doc:"JetStream metadata of the event."`
+}
+
+// EventMeta is the JetStream metadata of a delivered event. Events loaded
+// from the stream for a manual redelivery only have StreamSeq; the other
+// fields are zero.
+type EventMeta struct {
+	StreamSeq    uint64    `json:"stream_seq" doc:"Sequence of the event in the stream, the same for every consumer and delivery."`
+	ConsumerSeq  uint64    `json:"consumer_seq" doc:"Sequence of the delivery in the consumer's durable; redeliveries get new ones."`
+	Timestamp    time.Time `json:"timestamp" doc:"When the stream stored the event."`
+	NumDelivered uint64    `json:"num_delivered" doc:"Times JetStream delivered the event, 1 on its first delivery."`
+}
+
+// BlobRef is a blob a record references. URL is set when the consumer
+// fetched the blob into its own storage.
+type BlobRef struct {
+	CID      string `json:"cid" doc:"CID of the blob, which its PDS serves it by."`
+	MimeType string `json:"mime_type" doc:"MIME type the record declares."`
+	Size     int64  `json:"size" doc:"Size in bytes the record declares."`
+	Path     string `json:"path" doc:"Where the record references the blob, as dot-separated field names and array indexes, e.g. embed.images.0.image."`
+	URL      string `json:"url,omitempty" doc:"Where to download the blob from fpaas's copy, when it fetched it; signed URLs stop working at their expiry."`
+}
+
+// ThreadContext is the parent and root of a reply, as the AppView returned
+// them. Root is the parent too for replies to the thread's first post; a
+// post deleted or unknown to the AppView is left out.
+type ThreadContext struct {
+	Parent *ThreadPost `json:"parent,omitempty" doc:"Post the reply answers."`
+	Root   *ThreadPost `json:"root,omitempty" doc:"First post of the thread."`
+}
+
+// ThreadPost is a post of a ThreadContext.
+type ThreadPost struct {
+	URI         string `json:"uri" doc:"at:// URI of the post."`
+	CID         string `json:"cid" doc:"CID of the post's record."`
+	Author      string `json:"author" doc:"DID of the post's author."`
+	Handle      string `json:"handle" doc:"Handle of the author, handle.invalid when it doesn't check out."`
+	DisplayName string `json:"display_name,omitempty" doc:"Display name of the author."`
+	Text        string `json:"text" doc:"Text of the post."`
+	CreatedAt   string `json:"created_at" doc:"Creation time the record claims."`
+	IndexedAt   string `json:"indexed_at" doc:"When the AppView indexed the post."`
+	ReplyCount  int64  `json:"reply_count" doc:"Replies to the post, as counted by the AppView."`
+	LikeCount   int64  `json:"like_count" doc:"Likes of the post, as counted by the AppView."`
+}
@@ -0,0 +1,157 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	indigo "github.com/bluesky-social/indigo/events"
+	"github.com/bluesky-social/indigo/lex/util"
+)
+
+// Frame is a decoded firehose frame. Type says which of the other fields is
+// set; error frames set none.
+type Frame struct {
+	Type     string    `json:"type" enum:"#commit,#sync,#identity,#account,#info,error" doc:"Frame type from the event stream header."`
+	Commit   *Commit   `json:"commit,omitempty"`
+	Sync     *Sync     `json:"sync,omitempty"`
+	Identity *Identity `json:"identity,omitempty"`
+	Account  *Account  `json:"account,omitempty"`
+	Info     *Info     `json:"info,omitempty"`
+}
+
+// Seq returns the relay sequence number of the frame, 0 for #info and error
+// frames.
+func (f Frame) Seq() int64 {
+	switch {
+	case f.Commit != nil:
+		return f.Commit.Seq
+	case f.Sync != nil:
+		return f.Sync.Seq
+	case f.Identity != nil:
+		return f.Identity.Seq
+	case f.Account != nil:
+		return f.Account.Seq
+	}
+	return 0
+}
+
+// Commit is an update of a repository (com.atproto.sync.subscribeRepos#commit).
+type Commit struct {
+	Seq    int64    `json:"seq" doc:"Stream sequence number of the frame."`
+	Repo   string   `json:"repo" doc:"DID of the repository."`
+	Rev    string   `json:"rev" doc:"Revision of the commit."`
+	Since  string   `json:"since,omitempty" doc:"Revision of the previous commit of the repository, if any."`
+	Time   string   `json:"time" doc:"RFC 3339 time the relay broadcast the frame."`
+	Commit string   `json:"commit" doc:"CID of the commit object."`
+	Ops    []RepoOp `json:"ops" doc:"Record operations of the commit."`
+	Blobs  []string `json:"blobs,omitempty" doc:"CIDs of blobs referenced by the commit."`
+	Blocks []byte   `json:"blocks,omitempty" doc:"CAR file with the commit and record blocks."`
+	TooBig bool     `json:"tooBig,omitempty" doc:"Deprecated: the commit was too large to include its blocks."`
+}
+
+// RepoOp is a mutation of a single record.
+type RepoOp struct {
+	Action string `json:"action" enum:"create,update,delete" doc:"Kind of mutation."`
+	Path   string `json:"path" doc:"Record path, collection/rkey."`
+	CID    string `json:"cid,omitempty" doc:"CID of the new record; empty for deletes."`
+	Prev   string `json:"prev,omitempty" doc:"CID of the previous record, for updates and deletes."`
+	// Record is only set on the frames of protobuf and Avro payloads, which
+	// carry records rather than the commit's blocks.
+	Record json.RawMessage `json:"record,omitempty" doc:"Record in atproto JSON form, in protobuf and Avro payloads."`
+}
+
+// Sync resets a repository to a new state (#sync).
+type Sync struct {
+	Seq    int64  `json:"seq" doc:"Stream sequence number of the frame."`
+	DID    string `json:"did" doc:"DID of the repository."`
+	Rev    string `json:"rev" doc:"Revision of the commit."`
+	Time   string `json:"time" doc:"RFC 3339 time the relay broadcast the frame."`
+	Blocks []byte `json:"blocks,omitempty" doc:"CAR file with the commit block."`
+}
+
+// Identity signals a change of an account's handle, key or PDS (#identity).
+type Identity struct {
+	Seq    int64  `json:"seq" doc:"Stream sequence number of the frame."`
+	DID    string `json:"did" doc:"DID of the account."`
+	Handle string `json:"handle,omitempty" doc:"Current handle of the account, or handle.invalid."`
+	Time   string `json:"time" doc:"RFC 3339 time the relay broadcast the frame."`
+}
+
+// Account signals a change of an account's hosting status (#account).
+type Account struct {
+	Seq    int64  `json:"seq" doc:"Stream sequence number of the frame."`
+	DID    string `json:"did" doc:"DID of the account."`
+	Active bool   `json:"active" doc:"Whether the account's repository can be fetched from its host."`
+	Status string `json:"status,omitempty" doc:"Why the account isn't active (takendown, suspended, deleted, deactivated, ...)."`
+	Time   string `json:"time" doc:"RFC 3339 time the relay broadcast the frame."`
+}
+
+// Info is an informational message from the relay (#info).
+type Info struct {
+	Name    string `json:"name" doc:"Message name, e.g. OutdatedCursor."`
+	Message string `json:"message,omitempty" doc:"Human-readable details."`
+}
+
+// Decode decodes a raw firehose frame, as carried in Batch.Events and
+// Event.Event. Record blocks are kept as CAR bytes.
+func Decode(data []byte) (Frame, error) {
+	var evt indigo.XRPCStreamEvent
+	if err := evt.Deserialize(bytes.NewReader(data)); err != nil {
+		return Frame{}, fmt.Errorf("failed to decode frame: %w", err)
+	}
+
+	switch {
+	case evt.RepoCommit != nil:
+		return Frame{Type: TypeCommit, Commit: commit(evt.RepoCommit)}, nil
+	case evt.RepoSync != nil:
+		s := evt.RepoSync
+		return Frame{Type: TypeSync, Sync: &Sync{Seq: s.Seq, DID: s.Did, Rev: s.Rev, Time: s.Time, Blocks: s.Blocks}}, nil
+	case evt.RepoIdentity != nil:
+		i := evt.RepoIdentity
+		return Frame{Type: TypeIdentity, Identity: &Identity{Seq: i.Seq, DID: i.Did, Handle: deref(i.Handle), Time: i.Time}}, nil
+	case evt.RepoAccount != nil:
+		a := evt.RepoAccount
+		return Frame{Type: TypeAccount, Account: &Account{Seq: a.Seq, DID: a.Did, Active: a.Active, Status: deref(a.Status), Time: a.Time}}, nil
+	case evt.RepoInfo != nil:
+		return Frame{Type: TypeInfo, Info: &Info{Name: evt.RepoInfo.Name, Message: deref(evt.RepoInfo.Message)}}, nil
+	default:
+		return Frame{Type: TypeError}, nil
+	}
+}
+
+func commit(c *comatproto.SyncSubscribeRepos_Commit) *Commit {
+	out := &Commit{
+		Seq:    c.Seq,
+		Repo:   c.Repo,
+		Rev:    c.Rev,
+		Since:  deref(c.Since),
+		Time:   c.Time,
+		Commit: c.Commit.String(),
+		Ops:    make([]RepoOp, 0, len(c.Ops)),
+		Blocks: c.Blocks,
+		TooBig: c.TooBig,
+	}
+	for _, op := range c.Ops {
+		out.Ops = append(out.Ops, RepoOp{Action: op.Action, Path: op.Path, CID: link(op.Cid), Prev: link(op.Prev)})
+	}
+	for _, b := range c.Blobs {
+		out.Blobs = append(out.Blobs, b.String())
+	}
+	return out
+}
+
+func link(l *util.LexLink) string {
+	if l == nil || !l.Defined() {
+		return ""
+	}
+	return l.String()
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
@@ -0,0 +1,139 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// SchemaBaseURL prefixes the $id of the generated schemas.
+const SchemaBaseURL = "https://github.com/eurosky/firehose-processor-aas/schema/json/"
+
+// Schemas maps the name of each emitted payload to a value of its type, in
+// the order they are documented.
+var Schemas = []struct {
+	Name        string
+	Description string
+	Type        any
+}{
+	{"batch", "Webhook body with batch granularity.", Batch{}},
+	{"event", "Webhook body with event granularity.", Event{}},
+	{"rollup", "Webhook body of a consumer with an aggregation window: the rollup of a window.", Rollup{}},
+	{"frame", "A decoded firehose frame.", Frame{}},
+	{"delivery-record", "A delivery attempt, as published on fpaas.deliveries.<consumer> and listed by the control plane.", DeliveryRecord{}},
+	{"delivery-stats", "Summary of a consumer's delivery attempts.", DeliveryStats{}},
+	{"ack", "Optional webhook response body acknowledging events one by one.", Ack{}},
+	{"topn", "Most active DIDs and collections of a window, as published on atproto.stats.topn.", TopN{}},
+	{"frame-sizes", "Frame size distribution of a window, as published on atproto.stats.sizes.", FrameSizes{}},
+	{"duplicate-cluster", "Cluster of near-duplicate posts, as published on atproto.analysis.duplicates.", DuplicateCluster{}},
+	{"burst", "DID creating records faster than a threshold, as published on atproto.analysis.bursts.", Burst{}},
+	{"alert", "Throughput alert, as published on atproto.alerts.", Alert{}},
+	{"rule-alert", "Notification of an alerting rule, as published on atproto.alerts.rules.", RuleAlert{}},
+	{"ingest-status", "State of an ingest instance, as kept in the fpaas_registry KV bucket.", IngestStatus{}},
+	{"consumer-status", "State of a running consumer, as kept in the fpaas_registry KV bucket.", ConsumerStatus{}},
+}
+
+// JSONSchema returns the JSON Schema (draft 2020-12) of the payload named
+// name in Schemas. Field descriptions come from the doc struct tags and enums
+// from the enum tags.
+func JSONSchema(name string) ([]byte, error) {
+	for _, s := range Schemas {
+		if s.Name != name {
+			continue
+		}
+		b := &schemaBuilder{defs: map[string]map[string]any{}}
+		t := reflect.TypeOf(s.Type)
+		root := b.object(t)
+		root["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+		root["$id"] = SchemaBaseURL + name + ".schema.json"
+		root["title"] = t.Name()
+		root["description"] = s.Description
+		if len(b.defs) > 0 {
+			root["$defs"] = b.defs
+		}
+		return json.MarshalIndent(root, "", "  ")
+	}
+	return nil, fmt.Errorf("unknown schema %q", name)
+}
+
+var (
+	timeType = reflect.TypeOf(time.Time{})
+	rawType  = reflect.TypeOf(json.RawMessage(nil))
+)
+
+// schemaBuilder collects the nested struct types in $defs.
+type schemaBuilder struct {
+	defs map[string]map[string]any
+}
+
+func (b *schemaBuilder) of(t reflect.Type) map[string]any {
+	if t == timeType {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+	if t == rawType {
+		// Any JSON value
+		return map[string]any{}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return b.of(t.Elem())
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]any{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "contentEncoding": "base64"}
+		}
+		return map[string]any{"type": "array", "items": b.of(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": b.of(t.Elem())}
+	case reflect.Struct:
+		if _, ok := b.defs[t.Name()]; !ok {
+			b.defs[t.Name()] = nil // guards against recursive types
+			b.defs[t.Name()] = b.object(t)
+		}
+		return map[string]any{"$ref": "#/$defs/" + t.Name()}
+	default:
+		return map[string]any{}
+	}
+}
+
+// object describes a struct the way encoding/json marshals it. Fields
+// without omitempty are required; other properties are allowed, so new
+// fields don't break receivers.
+func (b *schemaBuilder) object(t reflect.Type) map[string]any {
+	properties := map[string]any{}
+	required := []string{}
+	for i := range t.NumField() {
+		f := t.Field(i)
+		name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if !f.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+
+		p := b.of(f.Type)
+		if doc := f.Tag.Get("doc"); doc != "" {
+			p["description"] = doc
+		}
+		if enum := f.Tag.Get("enum"); enum != "" {
+			p["enum"] = strings.Split(enum, ",")
+		}
+		properties[name] = p
+		if !strings.Contains(opts, "omitempty") {
+			required = append(required, name)
+		}
+	}
+	return map[string]any{"type": "object", "properties": properties, "required": required}
+}
@@ -0,0 +1,39 @@
+package events
+
+import "time"
+
+// Consumer states.
+const (
+	ConsumerRunning = "running"
+	ConsumerPaused  = "paused"
+	ConsumerFailing = "failing"
+)
+
+// IngestStatus is the state of an ingest instance, which keeps it in the
+// fpaas_registry KV bucket under ingest.<instance> while it runs.
+type IngestStatus struct {
+	Instance      string    `json:"instance" doc:"Name of the instance."`
+	Relay         string    `json:"relay" doc:"Relay host the instance reads from."`
+	Connected     bool      `json:"connected" doc:"Whether the instance is connected to the relay; a standby isn't."`
+	Leader        bool      `json:"leader" doc:"Whether the instance holds the leader lease; always true without leader election."`
+	Cursor        int64     `json:"cursor" doc:"Relay sequence of the last frame published."`
+	Frames        int64     `json:"frames" doc:"Frames read from the relay since the instance started."`
+	LastEventTime time.Time `json:"last_event_time" doc:"Relay event time of the last frame published; zero before the first."`
+	Updated       time.Time `json:"updated" doc:"When the instance wrote the entry."`
+}
+
+// ConsumerStatus is the state of a running consumer, which the replica
+// running it keeps in the fpaas_registry KV bucket under consumer.<name>.
+type ConsumerStatus struct {
+	Name                string    `json:"name" doc:"Name of the consumer, and of its durable."`
+	Instance            string    `json:"instance" doc:"Replica running the consumer."`
+	Target              string    `json:"target" doc:"Delivery target (webhook, sqs, sns, pubsub, postgres, clickhouse, mqtt, slack, discord, email)."`
+	State               string    `json:"state" enum:"running,paused,failing" doc:"Whether the consumer delivers, is paused by its daily quota or maintenance mode or failed its last delivery attempt, leaving the events to be redelivered."`
+	ConsecutiveFailures int64     `json:"consecutive_failures" doc:"Delivery attempts that failed in a row."`
+	LastError           string    `json:"last_error,omitempty" doc:"Error of the last failed attempt."`
+	Attempts            int64     `json:"attempts" doc:"Delivery attempts in the last 5 minutes."`
+	Failures            int64     `json:"failures" doc:"Failed delivery attempts in the last 5 minutes."`
+	Processed           int64     `json:"processed" doc:"Events delivered since the consumer started."`
+	Pending             uint64    `json:"pending" doc:"Events in the stream not yet fetched, as of the last fetch."`
+	Updated             time.Time `json:"updated" doc:"When the replica wrote the entry."`
+}
@@ -0,0 +1,75 @@
+package events
+
+import "time"
+
+// TopN lists the most active DIDs and collections of a window of the stream.
+// The analyzer (fpaas analyze) publishes one per window on
+// atproto.stats.topn.
+type TopN struct {
+	Start       time.Time  `json:"start" doc:"Start of the window."`
+	End         time.Time  `json:"end" doc:"End of the window; now for the window in progress."`
+	Events      int64      `json:"events" doc:"Number of frames in the window."`
+	DIDs        []TopEntry `json:"dids" doc:"DIDs with the most frames (commits, identity and account changes), most active first."`
+	Collections []TopEntry `json:"collections" doc:"Collections written by the most commits, most active first."`
+	Instance    string     `json:"instance" doc:"Analyzer instance that made the report."`
+	Group       string     `json:"group,omitempty" doc:"Group of analyzers splitting the stream; the reports of a group's instances add up."`
+}
+
+// TopEntry is a heavy hitter of a window.
+type TopEntry struct {
+	Key   string `json:"key" doc:"DID or collection NSID."`
+	Count uint64 `json:"count" doc:"Estimated number of frames; may overcount by a small fraction of the window's frames, never undercounts."`
+}
+
+// FrameSizes is the distribution of the frame sizes of a window, to size the
+// NATS max payload, compression thresholds and webhook batch limits. The
+// analyzer publishes one per window on atproto.stats.sizes.
+type FrameSizes struct {
+	Start    time.Time              `json:"start" doc:"Start of the window."`
+	End      time.Time              `json:"end" doc:"End of the window; now for the window in progress."`
+	Frames   int64                  `json:"frames" doc:"Number of frames in the window."`
+	Bytes    int64                  `json:"bytes" doc:"Total size of the frames in bytes."`
+	Max      int64                  `json:"max" doc:"Size of the largest frame in bytes."`
+	P50      int64                  `json:"p50" doc:"Median frame size in bytes, rounded up to the bound of its bucket."`
+	P95      int64                  `json:"p95" doc:"95th percentile frame size in bytes, rounded up to the bound of its bucket."`
+	P99      int64                  `json:"p99" doc:"99th percentile frame size in bytes, rounded up to the bound of its bucket."`
+	Buckets  []SizeBucket           `json:"buckets" doc:"Frames per size bucket, smallest first."`
+	Types    map[string]SizeSummary `json:"types" doc:"Frame sizes by frame type (#commit, #identity, ...)."`
+	Instance string                 `json:"instance" doc:"Analyzer instance that made the report."`
+	Group    string                 `json:"group,omitempty" doc:"Group of analyzers splitting the stream; the reports of a group's instances add up."`
+}
+
+// SizeBucket counts the frames of a size range.
+type SizeBucket struct {
+	LE    int64 `json:"le,omitempty" doc:"Largest size in the bucket, in bytes; absent for the last bucket, which holds the frames larger than every bound."`
+	Count int64 `json:"count" doc:"Number of frames in the bucket, not counting the smaller buckets."`
+}
+
+// SizeSummary sums up the sizes of some frames.
+type SizeSummary struct {
+	Frames int64 `json:"frames" doc:"Number of frames."`
+	Bytes  int64 `json:"bytes" doc:"Total size in bytes."`
+	Max    int64 `json:"max" doc:"Size of the largest frame in bytes."`
+}
+
+// Rollup sums up the events of a window of a consumer that aggregates them
+// (consumer.Config.AggregateWindow); its webhook gets one per window
+// instead of the events.
+type Rollup struct {
+	Consumer    string           `json:"consumer" doc:"Name of the consumer that delivered the rollup."`
+	Start       time.Time        `json:"start" doc:"Start of the window; windows are aligned on multiples of their length, e.g. on the hour for 1h windows."`
+	End         time.Time        `json:"end" doc:"End of the window."`
+	Events      int64            `json:"events" doc:"Number of frames the consumer's filters let through in the window, by the time the consumer pulled them."`
+	Types       map[string]int64 `json:"types" doc:"Frames by frame type (#commit, #identity, ...)."`
+	Collections map[string]int64 `json:"collections" doc:"Commit ops (creates, updates and deletes) by collection."`
+	UniqueDIDs  int64            `json:"unique_dids" doc:"Estimated number of distinct DIDs with frames in the window, within about 2%."`
+	Hashtags    []HashtagCount   `json:"hashtags" doc:"Hashtags of the posts created in the window, most used first, lowercase and without the #."`
+	FirstSeq    uint64           `json:"first_seq,omitempty" doc:"Stream sequence number of the first frame of the window; absent when it had none."`
+	LastSeq     uint64           `json:"last_seq,omitempty" doc:"Stream sequence number of the last frame of the window; absent when it had none."`
+}
+
+// HashtagCount is a hashtag of a Rollup.
+type HashtagCount struct {
+	Tag   string `json:"tag" doc:"Hashtag, lowercase and without the #."`
+	Count int64  `json:"count" doc:"Estimated number of posts using it; may overcount rare hashtags in windows with many distinct ones."`
+}
@@ -0,0 +1,27 @@
+package firehose
+
+import (
+	"log/slog"
+
+	"github.com/nats-io/nats.go"
+)
+
+// The analyzer (fpaas analyze) publishes the reports of its optional
+// analyses to AnalysisStream, one subject each, AnalysisSubject(name), so
+// consumers can deliver them instead of the firehose's frames.
+const (
+	AnalysisStream = "ATPROTO_ANALYSIS"
+	// AnalysisSubjects matches every subject of AnalysisStream.
+	AnalysisSubjects = "atproto.analysis.>"
+)
+
+// AnalysisSubject is the subject of AnalysisStream holding the reports of
+// the analysis name, e.g. duplicates.
+func AnalysisSubject(name string) string {
+	return "atproto.analysis." + name
+}
+
+// EnsureAnalysisStream creates AnalysisStream, or updates it to opts.
+func EnsureAnalysisStream(js nats.JetStreamContext, opts StreamOptions, logger *slog.Logger) error {
+	return configureStream(js, AnalysisStream, AnalysisSubjects, opts, logger)
+}
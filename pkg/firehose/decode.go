@@ -0,0 +1,120 @@
+package firehose
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/bluesky-social/indigo/atproto/data"
+	"github.com/bluesky-social/indigo/events"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car"
+)
+
+// Event is a firehose frame with its commit records decoded to JSON.
+type Event struct {
+	FrameInfo
+	// Rev is the repo revision of a commit or sync frame.
+	Rev string
+	// Ops holds the decoded operations of a commit frame.
+	Ops []Op
+	// Body is the JSON form of non-commit frames (identity, account, ...).
+	Body json.RawMessage
+}
+
+// Op is a single record operation of a commit.
+type Op struct {
+	Action     string
+	Collection string
+	Rkey       string
+	CID        string
+	// Record is the record in atproto JSON form; nil for deletes or when the
+	// block was not included in the commit (e.g. tooBig commits).
+	Record json.RawMessage
+}
+
+// DecodeFrame decodes a raw subscribeRepos frame including the records
+// carried in its CAR blocks. Only a frame that can't be parsed at all is an
+// error; records that fail to decode are left empty.
+func DecodeFrame(raw []byte) (Event, error) {
+	var evt events.XRPCStreamEvent
+	if err := evt.Deserialize(bytes.NewReader(raw)); err != nil {
+		return Event{}, fmt.Errorf("failed to decode frame: %w", err)
+	}
+
+	out := Event{FrameInfo: frameInfo(&evt)}
+
+	switch {
+	case evt.RepoCommit != nil:
+		c := evt.RepoCommit
+		out.Rev = c.Rev
+
+		blocks := readCARBlocks(c.Blocks)
+		for _, op := range c.Ops {
+			collection, rkey, _ := strings.Cut(op.Path, "/")
+			o := Op{Action: op.Action, Collection: collection, Rkey: rkey}
+			if op.Cid != nil {
+				opCID := cid.Cid(*op.Cid)
+				o.CID = opCID.String()
+				if blk, ok := blocks[opCID]; ok {
+					o.Record = recordJSON(blk)
+				}
+			}
+			out.Ops = append(out.Ops, o)
+		}
+	case evt.RepoSync != nil:
+		out.Rev = evt.RepoSync.Rev
+		out.Body = marshalBody(evt.RepoSync)
+	case evt.RepoIdentity != nil:
+		out.Body = marshalBody(evt.RepoIdentity)
+	case evt.RepoAccount != nil:
+		out.Body = marshalBody(evt.RepoAccount)
+	case evt.RepoInfo != nil:
+		out.Body = marshalBody(evt.RepoInfo)
+	case evt.Error != nil:
+		out.Body = marshalBody(evt.Error)
+	}
+
+	return out, nil
+}
+
+func readCARBlocks(b []byte) map[cid.Cid][]byte {
+	blocks := make(map[cid.Cid][]byte)
+	if len(b) == 0 {
+		return blocks
+	}
+
+	cr, err := car.NewCarReader(bytes.NewReader(b))
+	if err != nil {
+		return blocks
+	}
+	for {
+		blk, err := cr.Next()
+		if err != nil {
+			// io.EOF, or a corrupt block: keep whatever was read so far
+			return blocks
+		}
+		blocks[blk.Cid()] = blk.RawData()
+	}
+}
+
+func recordJSON(block []byte) json.RawMessage {
+	rec, err := data.UnmarshalCBOR(block)
+	if err != nil {
+		return nil
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+func marshalBody(v any) json.RawMessage {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	return b
+}
@@ -0,0 +1,82 @@
+package firehose
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/bluesky-social/indigo/events"
+	fpevents "github.com/eurosky/firehose-processor-aas/pkg/events"
+)
+
+// Frame types as they appear in the event stream header.
+const (
+	TypeCommit   = fpevents.TypeCommit
+	TypeSync     = fpevents.TypeSync
+	TypeIdentity = fpevents.TypeIdentity
+	TypeAccount  = fpevents.TypeAccount
+	TypeInfo     = fpevents.TypeInfo
+	TypeError    = fpevents.TypeError
+)
+
+// FrameInfo is the routing metadata of a raw firehose frame.
+type FrameInfo struct {
+	Type string
+	Seq  int64
+	DID  string
+	// Time is the relay's RFC 3339 timestamp for the event, if any.
+	Time string
+	// Collections lists the distinct collections touched by a commit.
+	Collections []string
+	// Paths lists the record paths (collection/rkey) of a commit's ops, and
+	// Actions their actions (create, update, delete) in the same order.
+	Paths   []string
+	Actions []string
+	// Status is why the account of an #account frame isn't active
+	// (deleted, takendown, deactivated, ...), empty when it is.
+	Status string
+}
+
+// InspectFrame decodes a raw subscribeRepos frame just far enough to extract
+// its routing metadata. Record blocks are not parsed.
+func InspectFrame(data []byte) (FrameInfo, error) {
+	var evt events.XRPCStreamEvent
+	if err := evt.Deserialize(bytes.NewReader(data)); err != nil {
+		return FrameInfo{}, fmt.Errorf("failed to decode frame: %w", err)
+	}
+	return frameInfo(&evt), nil
+}
+
+func frameInfo(evt *events.XRPCStreamEvent) FrameInfo {
+	switch {
+	case evt.RepoCommit != nil:
+		c := evt.RepoCommit
+		info := FrameInfo{Type: TypeCommit, Seq: c.Seq, DID: c.Repo, Time: c.Time}
+		seen := make(map[string]bool)
+		for _, op := range c.Ops {
+			info.Paths = append(info.Paths, op.Path)
+			info.Actions = append(info.Actions, op.Action)
+			collection, _, _ := strings.Cut(op.Path, "/")
+			if collection != "" && !seen[collection] {
+				seen[collection] = true
+				info.Collections = append(info.Collections, collection)
+			}
+		}
+		return info
+	case evt.RepoSync != nil:
+		return FrameInfo{Type: TypeSync, Seq: evt.RepoSync.Seq, DID: evt.RepoSync.Did, Time: evt.RepoSync.Time}
+	case evt.RepoIdentity != nil:
+		return FrameInfo{Type: TypeIdentity, Seq: evt.RepoIdentity.Seq, DID: evt.RepoIdentity.Did, Time: evt.RepoIdentity.Time}
+	case evt.RepoAccount != nil:
+		a := evt.RepoAccount
+		info := FrameInfo{Type: TypeAccount, Seq: a.Seq, DID: a.Did, Time: a.Time}
+		if !a.Active && a.Status != nil {
+			info.Status = *a.Status
+		}
+		return info
+	case evt.RepoInfo != nil:
+		return FrameInfo{Type: TypeInfo, Seq: -1}
+	default:
+		return FrameInfo{Type: TypeError, Seq: -1}
+	}
+}
@@ -0,0 +1,147 @@
+package firehose
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// HandoffSubject is where a starting instance asks the running one to
+	// stop reading the relay and hand over its cursor.
+	HandoffSubject = "fpaas.ingest.handoff"
+
+	// handoffQueue makes a request stop a single instance, when several
+	// serve handoffs.
+	handoffQueue = "fpaas-ingest"
+
+	// handoffTimeout bounds the handoff: the running instance stops after
+	// the frame it is publishing, saves its cursor and answers.
+	handoffTimeout = 10 * time.Second
+)
+
+// errHandedOff cancels reading when another instance took over.
+var errHandedOff = errors.New("handed off to another instance")
+
+type handoffRequest struct {
+	Instance string `json:"instance"`
+}
+
+type handoffReply struct {
+	Instance string `json:"instance"`
+	Cursor   int64  `json:"cursor"`
+	Error    string `json:"error,omitempty"`
+}
+
+// handoff serves the handoff requests of one run. The first request cancels
+// the run; it is answered once the run stopped.
+type handoff struct {
+	ctx context.Context
+	sub *nats.Subscription
+
+	mu      sync.Mutex
+	request *nats.Msg
+	closed  bool
+}
+
+func (s *SimpleSubscriber) serveHandoff(ctx context.Context, cancel context.CancelCauseFunc) (*handoff, error) {
+	h := &handoff{ctx: ctx}
+	sub, err := s.natsConn.QueueSubscribe(HandoffSubject, handoffQueue, func(msg *nats.Msg) {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if h.closed || h.request != nil {
+			respondHandoff(msg, handoffReply{Error: "instance is not reading the relay"})
+			return
+		}
+		h.request = msg
+		cancel(errHandedOff)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to subscribe to handoff requests: %w", err)
+	}
+	h.sub = sub
+	return h, nil
+}
+
+// close stops serving requests, and returns the one that cancelled the run,
+// if any. A request that came once the run stopped for another reason is
+// refused.
+func (h *handoff) close() *nats.Msg {
+	h.sub.Unsubscribe()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	if h.request != nil && context.Cause(h.ctx) != errHandedOff {
+		respondHandoff(h.request, handoffReply{Error: "instance stopped reading the relay"})
+		return nil
+	}
+	return h.request
+}
+
+func respondHandoff(msg *nats.Msg, reply handoffReply) {
+	data, _ := json.Marshal(reply)
+	msg.Respond(data)
+}
+
+// requester returns the instance that sent a handoff request.
+func requester(msg *nats.Msg) string {
+	var req handoffRequest
+	json.Unmarshal(msg.Data, &req)
+	return req.Instance
+}
+
+// RequestHandoff asks the running instance to stop reading the relay, and
+// returns the cursor of the last frame it published. It returns zero when no
+// instance serves handoffs, e.g. on the first deploy.
+func (s *SimpleSubscriber) RequestHandoff(ctx context.Context, instanceID string) (int64, error) {
+	data, _ := json.Marshal(handoffRequest{Instance: instanceID})
+	ctx, cancel := context.WithTimeout(ctx, handoffTimeout)
+	defer cancel()
+	msg, err := s.natsConn.RequestWithContext(ctx, HandoffSubject, data)
+	if errors.Is(err, nats.ErrNoResponders) {
+		s.logger.Info("no running instance to take over from", "instance", instanceID)
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("handoff request failed: %w", err)
+	}
+	var reply handoffReply
+	if err := json.Unmarshal(msg.Data, &reply); err != nil {
+		return 0, fmt.Errorf("invalid handoff reply: %w", err)
+	}
+	if reply.Error != "" {
+		return 0, fmt.Errorf("handoff refused: %s", reply.Error)
+	}
+	s.logger.Info("took over from running instance", "instance", instanceID, "from", reply.Instance, "cursor", reply.Cursor)
+	return reply.Cursor, nil
+}
+
+// RunWithHandoff is Run, but it first takes over from the running instance,
+// resuming from the cursor it stopped at, and hands over to the next one
+// that asks. It returns nil once it handed over.
+func (s *SimpleSubscriber) RunWithHandoff(parent context.Context, instanceID string) error {
+	cursor, err := s.RequestHandoff(parent, instanceID)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancelCause(parent)
+	defer cancel(nil)
+	h, err := s.serveHandoff(ctx, cancel)
+	if err != nil {
+		return err
+	}
+	err = s.run(ctx, cursor)
+	if msg := h.close(); msg != nil {
+		cursor := s.GetLastCursor()
+		respondHandoff(msg, handoffReply{Instance: instanceID, Cursor: cursor})
+		s.logger.Info("handed off to new instance", "instance", instanceID, "to", requester(msg), "cursor", cursor)
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,357 @@
+package firehose
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// The indexer copies the frames of the DIDs in consumers' watchlists from
+// the ATPROTO_FIREHOSE stream to WatchStream, once per consumer watching
+// one of them, under WatchSubject(consumer). A frame concerns a DID as:
+//
+//	author   the DID is the frame's repo or account
+//	mention  a post the frame creates or edits mentions the DID in a facet
+//	reply    such a post replies to a post of the DID, or to a thread it started
+//
+// so a consumer reading its subject gets its DIDs' events without reading
+// the whole firehose. Copies carry HeaderWatched, and a Nats-Msg-Id of the
+// consumer and the frame's relay sequence, so indexing a frame again is
+// dropped as a duplicate within the stream's duplicate window.
+const (
+	WatchStream = "FPAAS_WATCHED"
+	// WatchSubjects matches every subject of WatchStream.
+	WatchSubjects = "fpaas.watched.>"
+	// WatchBucket holds the watchlists, one entry per consumer and DID keyed
+	// by WatchKey, each a WatchedDID.
+	WatchBucket = "fpaas_watchlists"
+	// HeaderWatched carries, on the frames of WatchStream, the JSON object
+	// of the consumer's DIDs the frame concerns and how: author, mention or
+	// reply.
+	HeaderWatched = "Fpaas-Watched"
+)
+
+// Roles of a watched DID in a frame.
+const (
+	WatchAuthor  = "author"
+	WatchMention = "mention"
+	WatchReply   = "reply"
+)
+
+// WatchedDID is a DID of a consumer's watchlist, as stored in WatchBucket.
+type WatchedDID struct {
+	DID     string    `json:"did"`
+	AddedAt time.Time `json:"added_at"`
+}
+
+// WatchSubject is the subject of WatchStream holding the frames of the DIDs
+// consumer watches.
+func WatchSubject(consumer string) string {
+	return "fpaas.watched." + consumer
+}
+
+// WatchKey is the key of a DID of consumer's watchlist in WatchBucket. DIDs
+// have characters keys can't, so they are base64url-encoded.
+func WatchKey(consumer, did string) string {
+	return consumer + "." + base64.RawURLEncoding.EncodeToString([]byte(did))
+}
+
+// watchKeyParts splits a WatchKey into its consumer and DID.
+func watchKeyParts(key string) (consumer, did string, ok bool) {
+	i := strings.LastIndexByte(key, '.')
+	if i < 1 {
+		return "", "", false
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(key[i+1:])
+	return key[:i], string(raw), err == nil
+}
+
+// EnsureWatchBucket opens WatchBucket, creating it if it doesn't exist.
+func EnsureWatchBucket(js nats.JetStreamContext) (nats.KeyValue, error) {
+	return OpenKeyValue(js, &nats.KeyValueConfig{Bucket: WatchBucket, History: 1})
+}
+
+// EnsureWatchStream creates WatchStream, or updates it to opts.
+func EnsureWatchStream(js nats.JetStreamContext, opts StreamOptions, logger *slog.Logger) error {
+	return configureStream(js, WatchStream, WatchSubjects, opts, logger)
+}
+
+// IndexerOptions configures an Indexer.
+type IndexerOptions struct {
+	// Durable is the consumer indexers share on ATPROTO_FIREHOSE; they split
+	// its frames between them.
+	Durable string
+	// Workers fetch, match and copy batches of up to BatchSize frames
+	// concurrently.
+	Workers   int
+	BatchSize int
+	// Stream configures WatchStream, as RouterOptions.Stream does
+	// EventsStream.
+	Stream StreamOptions
+}
+
+// Indexer copies the frames of watched DIDs to WatchStream. It reads every
+// frame once for all consumers, which is what makes watchlists cheap next to
+// a consumer per tenant reading the whole firehose.
+type Indexer struct {
+	js      nats.JetStreamContext
+	sub     *nats.Subscription
+	watcher nats.KeyWatcher
+	opts    IndexerOptions
+	logger  *slog.Logger
+
+	mu sync.RWMutex
+	// watchers lists, by DID, the consumers watching it
+	watchers map[string][]string
+
+	indexed int64
+	copied  int64
+	failed  int64
+}
+
+// NewIndexer creates WatchStream, or updates it to opts.Stream, loads the
+// watchlists, which it then follows, and binds to the indexers' durable.
+func NewIndexer(js nats.JetStreamContext, opts IndexerOptions, logger *slog.Logger) (*Indexer, error) {
+	if err := EnsureWatchStream(js, opts.Stream, logger); err != nil {
+		return nil, err
+	}
+	kv, err := EnsureWatchBucket(js)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open watchlist bucket: %w", err)
+	}
+	watcher, err := kv.WatchAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to watch watchlists: %w", err)
+	}
+	x := &Indexer{js: js, watcher: watcher, opts: opts, logger: logger, watchers: make(map[string][]string)}
+	// The stored entries come first, then nil, so no frame is matched
+	// against a partial list
+	for entry := range watcher.Updates() {
+		if entry == nil {
+			break
+		}
+		x.apply(entry)
+	}
+	go func() {
+		for entry := range watcher.Updates() {
+			if entry != nil {
+				x.apply(entry)
+			}
+		}
+	}()
+
+	if x.sub, err = subscribeRaw(js, opts.Durable, 2*opts.Workers*opts.BatchSize); err != nil {
+		watcher.Stop()
+		return nil, err
+	}
+	return x, nil
+}
+
+func (x *Indexer) apply(entry nats.KeyValueEntry) {
+	consumer, did, ok := watchKeyParts(entry.Key())
+	if !ok {
+		return
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	consumers := slices.DeleteFunc(x.watchers[did], func(c string) bool { return c == consumer })
+	if entry.Operation() == nats.KeyValuePut {
+		consumers = append(consumers, consumer)
+	}
+	if len(consumers) == 0 {
+		delete(x.watchers, did)
+		return
+	}
+	x.watchers[did] = consumers
+}
+
+// Run indexes frames with opts.Workers workers until ctx is done.
+func (x *Indexer) Run(ctx context.Context) error {
+	fetchWorkers(ctx, x.sub, x.opts.Workers, x.opts.BatchSize, x.logger, x.index)
+	return nil
+}
+
+// index copies msgs to the consumers watching their DIDs and acks those
+// WatchStream stored in full. The others are NAKed and indexed again.
+func (x *Indexer) index(msgs []*nats.Msg) {
+	futures := make([][]nats.PubAckFuture, len(msgs))
+	for i, msg := range msgs {
+		info, err := InspectFrame(msg.Data)
+		if err != nil {
+			// Concerns no one
+			continue
+		}
+		matches := x.match(frameDIDs(info, msg.Data))
+		if len(matches) == 0 {
+			continue
+		}
+		id := strconv.FormatInt(info.Seq, 10)
+		if info.Seq <= 0 {
+			meta, err := msg.Metadata()
+			if err != nil {
+				futures[i] = append(futures[i], nil)
+				continue
+			}
+			id = "raw/" + strconv.FormatUint(meta.Sequence.Stream, 10)
+		}
+		for consumer, watched := range matches {
+			out := nats.NewMsg(WatchSubject(consumer))
+			out.Data = msg.Data
+			for k, v := range msg.Header {
+				out.Header[k] = v
+			}
+			header, _ := json.Marshal(watched)
+			out.Header.Set(HeaderWatched, string(header))
+			out.Header.Set(nats.MsgIdHdr, consumer+"/"+id)
+			f, err := x.js.PublishMsgAsync(out)
+			if err != nil {
+				x.logger.Warn("failed to publish watched frame", "subject", out.Subject, "error", err)
+			}
+			futures[i] = append(futures[i], f)
+		}
+	}
+
+	for i, ok := range settle(msgs, futures, x.logger) {
+		if !ok {
+			atomic.AddInt64(&x.failed, 1)
+			continue
+		}
+		atomic.AddInt64(&x.indexed, 1)
+		atomic.AddInt64(&x.copied, int64(len(futures[i])))
+	}
+}
+
+// match returns, by consumer, the watched DIDs of roles, those a frame
+// concerns, with their roles.
+func (x *Indexer) match(roles map[string][]string) map[string]map[string][]string {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	var matches map[string]map[string][]string
+	for did, r := range roles {
+		for _, consumer := range x.watchers[did] {
+			if matches == nil {
+				matches = make(map[string]map[string][]string)
+			}
+			if matches[consumer] == nil {
+				matches[consumer] = make(map[string][]string)
+			}
+			matches[consumer][did] = r
+		}
+	}
+	return matches
+}
+
+// frameDIDs returns the DIDs a frame concerns, with their roles. Only frames
+// creating or editing posts are decoded in full, for their mentions and
+// replies.
+func frameDIDs(info FrameInfo, data []byte) map[string][]string {
+	if info.DID == "" {
+		return nil
+	}
+	roles := map[string][]string{info.DID: {WatchAuthor}}
+	add := func(did, role string) {
+		if strings.HasPrefix(did, "did:") && !slices.Contains(roles[did], role) {
+			roles[did] = append(roles[did], role)
+		}
+	}
+
+	posts := false
+	for i, path := range info.Paths {
+		if strings.HasPrefix(path, "app.bsky.feed.post/") && info.Actions[i] != "delete" {
+			posts = true
+		}
+	}
+	if !posts {
+		return roles
+	}
+	evt, err := DecodeFrame(data)
+	if err != nil {
+		return roles
+	}
+	for _, op := range evt.Ops {
+		if op.Collection != "app.bsky.feed.post" || op.Record == nil {
+			continue
+		}
+		var post struct {
+			Reply *struct {
+				Root struct {
+					URI string `json:"uri"`
+				} `json:"root"`
+				Parent struct {
+					URI string `json:"uri"`
+				} `json:"parent"`
+			} `json:"reply"`
+			Facets []struct {
+				Features []struct {
+					Type string `json:"$type"`
+					DID  string `json:"did"`
+				} `json:"features"`
+			} `json:"facets"`
+		}
+		if json.Unmarshal(op.Record, &post) != nil {
+			continue
+		}
+		for _, facet := range post.Facets {
+			for _, feature := range facet.Features {
+				if feature.Type == "app.bsky.richtext.facet#mention" {
+					add(feature.DID, WatchMention)
+				}
+			}
+		}
+		if post.Reply != nil {
+			add(uriDID(post.Reply.Parent.URI), WatchReply)
+			add(uriDID(post.Reply.Root.URI), WatchReply)
+		}
+	}
+	return roles
+}
+
+// uriDID returns the authority of an at:// URI.
+func uriDID(uri string) string {
+	rest, ok := strings.CutPrefix(uri, "at://")
+	if !ok {
+		return ""
+	}
+	did, _, _ := strings.Cut(rest, "/")
+	return did
+}
+
+// GetIndexedFrames returns the number of frames indexed, copied or not.
+func (x *Indexer) GetIndexedFrames() int64 {
+	return atomic.LoadInt64(&x.indexed)
+}
+
+// GetCopiedFrames returns the number of copies published to WatchStream.
+func (x *Indexer) GetCopiedFrames() int64 {
+	return atomic.LoadInt64(&x.copied)
+}
+
+// GetFailedFrames returns the number of frames whose copies failed, which
+// are indexed again.
+func (x *Indexer) GetFailedFrames() int64 {
+	return atomic.LoadInt64(&x.failed)
+}
+
+// GetWatchedDIDs returns the number of distinct DIDs watched.
+func (x *Indexer) GetWatchedDIDs() int {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return len(x.watchers)
+}
+
+// Close stops following the watchlists and unsubscribes; the durable stays
+// for the next indexer.
+func (x *Indexer) Close() error {
+	x.watcher.Stop()
+	return x.sub.Unsubscribe()
+}
@@ -0,0 +1,381 @@
+package firehose
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/events"
+	"github.com/gorilla/websocket"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// LabelBucket holds the labels of the followed labelers, one entry per
+	// subject: an account DID or a record's at:// URI. The shuffler writes
+	// it, consumers read it through a LabelIndex.
+	LabelBucket = "fpaas_labels"
+
+	labelSubjectPrefix = "s."
+	labelCursorPrefix  = "cursor."
+
+	labelerRetryInterval = 5 * time.Second
+)
+
+// Label is a label a labeler applied to a subject, as stored in LabelBucket.
+type Label struct {
+	// Src is the DID of the labeler
+	Src string `json:"src"`
+	Val string `json:"val"`
+	// Cts is when the label was created, Exp when it stops applying, if
+	// ever; both RFC 3339
+	Cts string `json:"cts"`
+	Exp string `json:"exp,omitempty"`
+}
+
+// active returns whether the label still applies at now.
+func (l Label) active(now time.Time) bool {
+	if l.Exp == "" {
+		return true
+	}
+	exp, err := time.Parse(time.RFC3339Nano, l.Exp)
+	return err != nil || now.Before(exp)
+}
+
+func labelKey(subject string) string {
+	return labelSubjectPrefix + base64.RawURLEncoding.EncodeToString([]byte(subject))
+}
+
+func labelSubject(key string) (string, bool) {
+	enc, ok := strings.CutPrefix(key, labelSubjectPrefix)
+	if !ok {
+		return "", false
+	}
+	subject, err := base64.RawURLEncoding.DecodeString(enc)
+	return string(subject), err == nil
+}
+
+// labelFollower reads the labels of labelers
+// (com.atproto.label.subscribeLabels) into LabelBucket, resuming each from
+// its cursor in the bucket. A negation label removes the label it negates.
+type labelFollower struct {
+	hosts   []string
+	kv      nats.KeyValue
+	logger  *slog.Logger
+	applied int64
+}
+
+func labelBucketConfig() *nats.KeyValueConfig {
+	return &nats.KeyValueConfig{Bucket: LabelBucket, History: 1, Storage: nats.FileStorage}
+}
+
+func newLabelFollower(js nats.JetStreamContext, hosts []string, logger *slog.Logger) (*labelFollower, error) {
+	kv, err := OpenKeyValue(js, labelBucketConfig())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open label bucket: %w", err)
+	}
+	return &labelFollower{hosts: hosts, kv: kv, logger: logger}, nil
+}
+
+// run follows every labeler until ctx is done, reconnecting to those whose
+// connection fails.
+func (f *labelFollower) run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, host := range f.hosts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				err := f.follow(ctx, host)
+				if ctx.Err() != nil {
+					return
+				}
+				f.logger.Warn("labeler connection failed; reconnecting", "labeler", host, "error", err)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(labelerRetryInterval):
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// follow reads the labels of host until ctx is done or the connection
+// fails, saving its cursor every second.
+func (f *labelFollower) follow(ctx context.Context, host string) error {
+	cursorKey := labelCursorPrefix + base64.RawURLEncoding.EncodeToString([]byte(host))
+	var cursor int64
+	if e, err := f.kv.Get(cursorKey); err == nil {
+		cursor, _ = strconv.ParseInt(string(e.Value()), 10, 64)
+	} else if !errors.Is(err, nats.ErrKeyNotFound) {
+		return err
+	}
+	saved := cursor
+
+	u, err := url.Parse(host)
+	if err != nil {
+		return fmt.Errorf("invalid labeler host URI: %w", err)
+	}
+	u.Path = "xrpc/com.atproto.label.subscribeLabels"
+	u.RawQuery = url.Values{"cursor": {strconv.FormatInt(cursor, 10)}}.Encode()
+	con, _, err := websocket.DefaultDialer.Dial(u.String(), http.Header{
+		"User-Agent": []string{"fpaas-firehose-subscriber/1.0"},
+	})
+	if err != nil {
+		return fmt.Errorf("subscribing to labeler failed: %w", err)
+	}
+	defer con.Close()
+	stop := context.AfterFunc(ctx, func() { con.Close() })
+	defer stop()
+	f.logger.Info("following labeler", "labeler", host, "cursor", cursor)
+
+	lastSave := time.Now()
+	defer func() {
+		if cursor != saved {
+			f.kv.Put(cursorKey, []byte(strconv.FormatInt(cursor, 10)))
+		}
+	}()
+	for {
+		_, data, err := con.ReadMessage()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		var evt events.XRPCStreamEvent
+		if err := evt.Deserialize(bytes.NewReader(data)); err != nil {
+			f.logger.Debug("skipping undecodable labeler frame", "labeler", host, "error", err)
+			continue
+		}
+		if evt.Error != nil {
+			return fmt.Errorf("labeler error: %s: %s", evt.Error.Error, evt.Error.Message)
+		}
+		if evt.LabelLabels == nil {
+			continue
+		}
+		for _, l := range evt.LabelLabels.Labels {
+			if err := f.apply(l); err != nil {
+				return fmt.Errorf("failed to store label: %w", err)
+			}
+			atomic.AddInt64(&f.applied, 1)
+		}
+		cursor = evt.LabelLabels.Seq
+		if cursor != saved && time.Since(lastSave) >= cursorSaveInterval {
+			if _, err := f.kv.Put(cursorKey, []byte(strconv.FormatInt(cursor, 10))); err != nil {
+				return err
+			}
+			saved = cursor
+			lastSave = time.Now()
+		}
+	}
+}
+
+// apply stores a label, or removes the one a negation label negates. It
+// retries when another writer updated the subject in between.
+func (f *labelFollower) apply(l *comatproto.LabelDefs_Label) error {
+	key := labelKey(l.Uri)
+	for {
+		var current []Label
+		var rev uint64
+		e, err := f.kv.Get(key)
+		switch {
+		case errors.Is(err, nats.ErrKeyNotFound):
+		case err != nil:
+			return err
+		default:
+			rev = e.Revision()
+			if err := json.Unmarshal(e.Value(), &current); err != nil {
+				current = nil
+			}
+		}
+
+		next, changed := mergeLabel(current, l)
+		if !changed {
+			return nil
+		}
+		switch {
+		case len(next) == 0:
+			err = f.kv.Delete(key, nats.LastRevision(rev))
+		case rev == 0:
+			data, _ := json.Marshal(next)
+			_, err = f.kv.Create(key, data)
+		default:
+			data, _ := json.Marshal(next)
+			_, err = f.kv.Update(key, data, rev)
+		}
+		if !isRevisionConflict(err) {
+			return err
+		}
+	}
+}
+
+func isRevisionConflict(err error) bool {
+	var apiErr *nats.APIError
+	return errors.Is(err, nats.ErrKeyExists) ||
+		(errors.As(err, &apiErr) && apiErr.ErrorCode == nats.JSErrCodeStreamWrongLastSequence)
+}
+
+// mergeLabel returns the labels of a subject once l is applied, and whether
+// they changed. A label older than the one of the same labeler and value it
+// would replace or negate is ignored.
+func mergeLabel(labels []Label, l *comatproto.LabelDefs_Label) ([]Label, bool) {
+	neg := l.Neg != nil && *l.Neg
+	label := Label{Src: l.Src, Val: l.Val, Cts: l.Cts}
+	if l.Exp != nil {
+		label.Exp = *l.Exp
+	}
+
+	next := make([]Label, 0, len(labels)+1)
+	for _, old := range labels {
+		if old.Src != l.Src || old.Val != l.Val {
+			next = append(next, old)
+			continue
+		}
+		if newer(old.Cts, l.Cts) || (!neg && old == label) {
+			return labels, false
+		}
+	}
+	if neg {
+		return next, len(next) != len(labels)
+	}
+	return append(next, label), true
+}
+
+// newer returns whether timestamp a is after b. Unparsable timestamps are
+// never newer, so the label being applied wins.
+func newer(a, b string) bool {
+	ta, err := time.Parse(time.RFC3339Nano, a)
+	if err != nil {
+		return false
+	}
+	tb, err := time.Parse(time.RFC3339Nano, b)
+	return err == nil && ta.After(tb)
+}
+
+// LabelIndex is an in-memory copy of LabelBucket, kept up to date by
+// watching it.
+type LabelIndex struct {
+	watcher nats.KeyWatcher
+	logger  *slog.Logger
+	done    chan struct{}
+
+	mu     sync.RWMutex
+	labels map[string][]Label
+}
+
+// WatchLabels loads LabelBucket, creating it if needed, and returns an
+// index following its changes until Stop.
+func WatchLabels(js nats.JetStreamContext, logger *slog.Logger) (*LabelIndex, error) {
+	kv, err := OpenKeyValue(js, labelBucketConfig())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open label bucket: %w", err)
+	}
+	watcher, err := kv.Watch(labelSubjectPrefix + ">")
+	if err != nil {
+		return nil, fmt.Errorf("failed to watch label bucket: %w", err)
+	}
+	idx := &LabelIndex{watcher: watcher, logger: logger, done: make(chan struct{}), labels: make(map[string][]Label)}
+
+	// The watcher sends the current entries, then nil
+	for e := range watcher.Updates() {
+		if e == nil {
+			break
+		}
+		idx.update(e)
+	}
+	go func() {
+		defer close(idx.done)
+		for e := range watcher.Updates() {
+			if e != nil {
+				idx.update(e)
+			}
+		}
+	}()
+	return idx, nil
+}
+
+func (idx *LabelIndex) update(e nats.KeyValueEntry) {
+	subject, ok := labelSubject(e.Key())
+	if !ok {
+		return
+	}
+	var labels []Label
+	if e.Operation() == nats.KeyValuePut {
+		if err := json.Unmarshal(e.Value(), &labels); err != nil {
+			idx.logger.Debug("skipping undecodable label entry", "subject", subject, "error", err)
+			return
+		}
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if len(labels) == 0 {
+		delete(idx.labels, subject)
+	} else {
+		idx.labels[subject] = labels
+	}
+}
+
+// Labels returns the values of the labels that apply to subject, sorted.
+// It is safe to call on a nil index, which has none.
+func (idx *LabelIndex) Labels(subject string) []string {
+	if idx == nil {
+		return nil
+	}
+	idx.mu.RLock()
+	labels := idx.labels[subject]
+	idx.mu.RUnlock()
+
+	now := time.Now()
+	var vals []string
+	for _, l := range labels {
+		if l.active(now) && !slices.Contains(vals, l.Val) {
+			vals = append(vals, l.Val)
+		}
+	}
+	sort.Strings(vals)
+	return vals
+}
+
+// Len returns the number of labeled subjects.
+func (idx *LabelIndex) Len() int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return len(idx.labels)
+}
+
+// Stop stops following the bucket.
+func (idx *LabelIndex) Stop() {
+	idx.watcher.Stop()
+	<-idx.done
+}
+
+// LabelSubjects returns the subjects a frame's labels may be on: the DID of
+// its account and, for a commit, the at:// URIs of its records.
+func LabelSubjects(info FrameInfo) []string {
+	if info.DID == "" {
+		return nil
+	}
+	subjects := []string{info.DID}
+	for _, path := range info.Paths {
+		subjects = append(subjects, "at://"+info.DID+"/"+path)
+	}
+	return subjects
+}
@@ -0,0 +1,292 @@
+package firehose
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// LeaseBucket holds the leader lease. Its TTL is the lease TTL: a leader
+	// that stops renewing loses the lease when the entry expires.
+	LeaseBucket = "fpaas_shuffler_lease"
+	// StateBucket holds the relay cursor shared by all shuffler instances.
+	StateBucket = "fpaas_shuffler_state"
+
+	leaseKey  = "leader"
+	cursorKey = "cursor"
+
+	cursorSaveInterval = time.Second
+)
+
+// LeaderConfig configures active/standby ingestion.
+type LeaderConfig struct {
+	// InstanceID is stored in the lease; it must be unique per instance.
+	InstanceID string
+	LeaseTTL   time.Duration
+	// Handoff takes over from the running leader on start, rather than
+	// waiting for its lease, and hands the lease over to the next instance
+	// that asks. RunWithLeaderElection returns once it handed over.
+	Handoff bool
+}
+
+// RunWithLeaderElection runs the subscriber only while this instance holds
+// the leader lease. The leader saves the relay cursor every second; a new
+// leader resumes from it. Events read twice around a takeover are dropped by
+// the stream's duplicate window, as their message IDs are content hashes.
+func (s *SimpleSubscriber) RunWithLeaderElection(ctx context.Context, cfg LeaderConfig) error {
+	if cfg.InstanceID == "" {
+		return errors.New("instance id is required")
+	}
+	if cfg.LeaseTTL < 3*time.Second {
+		return errors.New("lease ttl must be at least 3s")
+	}
+
+	leases, err := OpenKeyValue(s.js, leaseBucketConfig(cfg.LeaseTTL))
+	if err != nil {
+		return fmt.Errorf("failed to open lease bucket: %w", err)
+	}
+	state, err := OpenKeyValue(s.js, stateBucketConfig())
+	if err != nil {
+		return fmt.Errorf("failed to open state bucket: %w", err)
+	}
+	l := &lease{kv: leases, id: cfg.InstanceID, ttl: cfg.LeaseTTL}
+
+	if cfg.Handoff {
+		// The leader saves its cursor and passes its lease to this instance
+		// before it answers, so acquire takes the lease right away
+		if _, err := s.RequestHandoff(ctx, cfg.InstanceID); err != nil {
+			return err
+		}
+	}
+
+	for ctx.Err() == nil {
+		s.logger.Info("waiting for leader lease", "instance", cfg.InstanceID)
+		if err := l.acquire(ctx); err != nil {
+			break
+		}
+		s.logger.Info("acquired leader lease", "instance", cfg.InstanceID)
+
+		err := s.lead(ctx, l, state, cfg.Handoff)
+		atomic.StoreInt32(&s.leader, 0)
+		if errors.Is(err, errHandedOff) {
+			break
+		}
+		l.release()
+		if ctx.Err() != nil {
+			break
+		}
+		s.logger.Warn("stepped down as leader", "instance", cfg.InstanceID, "error", err)
+	}
+	return nil
+}
+
+// lead reads the firehose until the lease is lost, the subscriber fails, ctx
+// is done or, with handoff, another instance takes over. It returns
+// errHandedOff once the lease is the new leader's.
+func (s *SimpleSubscriber) lead(parent context.Context, l *lease, state nats.KeyValue, handoff bool) error {
+	ctx, cancel := context.WithCancelCause(parent)
+	defer cancel(nil)
+
+	cursor, err := loadCursor(state)
+	if err != nil {
+		return fmt.Errorf("failed to load cursor: %w", err)
+	}
+	atomic.StoreInt64(&s.lastCursor, cursor)
+	atomic.StoreInt32(&s.leader, 1)
+
+	saved := cursor
+	closeHandoff := func() *nats.Msg { return nil }
+	if handoff {
+		h, err := s.serveHandoff(ctx, cancel)
+		if err != nil {
+			return err
+		}
+		closeHandoff = h.close
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(l.ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := l.renew(); err != nil {
+					cancel(fmt.Errorf("lost leader lease: %w", err))
+					return
+				}
+			}
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(cursorSaveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := saveCursor(state, s.GetLastCursor(), &saved); err != nil {
+					s.logger.Warn("failed to save cursor", "error", err)
+				}
+			}
+		}
+	}()
+
+	s.logger.Info("reading firehose as leader", "cursor", cursor)
+	err = s.run(ctx, cursor)
+	cancel(nil)
+	wg.Wait()
+
+	if msg := closeHandoff(); msg != nil {
+		return s.handOver(msg, l, state, &saved)
+	}
+	if cause := context.Cause(ctx); cause != context.Canceled {
+		// Another instance may be leading already; don't move its cursor
+		return cause
+	}
+	if serr := saveCursor(state, s.GetLastCursor(), &saved); serr != nil {
+		s.logger.Warn("failed to save cursor", "error", serr)
+	}
+	if err == nil && parent.Err() == nil {
+		err = errors.New("firehose connection closed")
+	}
+	return err
+}
+
+// handOver saves the cursor, passes the lease to the instance that asked for
+// it and answers it. Should the lease have moved on, it is released, and the
+// requester waits for it as any standby.
+func (s *SimpleSubscriber) handOver(msg *nats.Msg, l *lease, state nats.KeyValue, saved *int64) error {
+	to := requester(msg)
+	cursor := s.GetLastCursor()
+	if err := saveCursor(state, cursor, saved); err != nil {
+		s.logger.Warn("failed to save cursor", "error", err)
+	}
+	if to == "" {
+		l.release()
+	} else if _, err := l.kv.Update(leaseKey, []byte(to), l.revision); err != nil {
+		s.logger.Warn("failed to pass leader lease, releasing it", "to", to, "error", err)
+		l.release()
+	}
+	respondHandoff(msg, handoffReply{Instance: l.id, Cursor: cursor})
+	s.logger.Info("handed off to new instance", "instance", l.id, "to", to, "cursor", cursor)
+	return errHandedOff
+}
+
+// IsLeader reports whether this instance currently holds the leader lease.
+func (s *SimpleSubscriber) IsLeader() bool {
+	return atomic.LoadInt32(&s.leader) == 1
+}
+
+type lease struct {
+	kv       nats.KeyValue
+	id       string
+	ttl      time.Duration
+	revision uint64
+}
+
+// acquire blocks until the lease is held or ctx is done. A lease left by a
+// previous run of the same instance is taken over right away.
+func (l *lease) acquire(ctx context.Context) error {
+	for {
+		rev, err := l.kv.Create(leaseKey, []byte(l.id))
+		if errors.Is(err, nats.ErrKeyExists) {
+			if e, gerr := l.kv.Get(leaseKey); gerr == nil && string(e.Value()) == l.id {
+				rev, err = l.kv.Update(leaseKey, []byte(l.id), e.Revision())
+			}
+		}
+		if err == nil {
+			l.revision = rev
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(l.ttl / 3):
+		}
+	}
+}
+
+// renew extends the lease. It fails when another instance took it over.
+func (l *lease) renew() error {
+	rev, err := l.kv.Update(leaseKey, []byte(l.id), l.revision)
+	if err != nil {
+		return err
+	}
+	l.revision = rev
+	return nil
+}
+
+// release hands the lease over without waiting for it to expire.
+func (l *lease) release() {
+	l.kv.Delete(leaseKey, nats.LastRevision(l.revision))
+}
+
+// OpenKeyValue opens the bucket cfg names, creating it from cfg if it doesn't
+// exist. When processes race to create it, the losers open the winner's.
+func OpenKeyValue(js nats.JetStreamContext, cfg *nats.KeyValueConfig) (nats.KeyValue, error) {
+	kv, err := js.KeyValue(cfg.Bucket)
+	if !errors.Is(err, nats.ErrBucketNotFound) {
+		return kv, err
+	}
+	kv, err = js.CreateKeyValue(cfg)
+	if errors.Is(err, nats.ErrStreamNameAlreadyInUse) {
+		return js.KeyValue(cfg.Bucket)
+	}
+	return kv, err
+}
+
+// EnsureBuckets creates the buckets of ingest that don't exist yet:
+// LabelBucket, StateBucket and LeaseBucket, whose leases last leaseTTL.
+func EnsureBuckets(js nats.JetStreamContext, leaseTTL time.Duration) error {
+	for _, cfg := range []*nats.KeyValueConfig{labelBucketConfig(), leaseBucketConfig(leaseTTL), stateBucketConfig()} {
+		if _, err := OpenKeyValue(js, cfg); err != nil {
+			return fmt.Errorf("failed to create bucket %s: %w", cfg.Bucket, err)
+		}
+	}
+	return nil
+}
+
+func leaseBucketConfig(ttl time.Duration) *nats.KeyValueConfig {
+	return &nats.KeyValueConfig{Bucket: LeaseBucket, TTL: ttl, History: 1}
+}
+
+func stateBucketConfig() *nats.KeyValueConfig {
+	return &nats.KeyValueConfig{Bucket: StateBucket, History: 1, Storage: nats.FileStorage}
+}
+
+func loadCursor(state nats.KeyValue) (int64, error) {
+	e, err := state.Get(cursorKey)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(e.Value()), 10, 64)
+}
+
+func saveCursor(state nats.KeyValue, cursor int64, saved *int64) error {
+	if cursor <= 0 || cursor == *saved {
+		return nil
+	}
+	if _, err := state.Put(cursorKey, []byte(strconv.FormatInt(cursor, 10))); err != nil {
+		return err
+	}
+	*saved = cursor
+	return nil
+}
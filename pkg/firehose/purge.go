@@ -0,0 +1,211 @@
+package firehose
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// purgePruneInterval is how often the index drops the frames the stream no
+// longer holds.
+const purgePruneInterval = time.Minute
+
+// accountPurger deletes the frames of an account from the stream once an
+// #account frame says it was deleted or taken down, so consumers that are
+// behind, redeliveries and backfills no longer hand them out. The #account
+// frame itself is kept: consumers deliver it as the tombstone.
+//
+// It indexes the stream sequences of each DID's frames as they are
+// published. On start it reads the stream to index the frames published
+// before, by another leader or a previous run, and to purge the accounts of
+// the #account frames it finds, whose purge may not have finished.
+type accountPurger struct {
+	js       nats.JetStreamContext
+	statuses map[string]bool
+	logger   *slog.Logger
+	purged   int64
+
+	mu      sync.Mutex
+	seqs    map[string][]uint64
+	pending []accountPurge
+	wake    chan struct{}
+}
+
+// accountPurge is an #account frame asking to purge the frames of did
+// published before it, at seq.
+type accountPurge struct {
+	did    string
+	status string
+	seq    uint64
+}
+
+func newAccountPurger(js nats.JetStreamContext, statuses []string, logger *slog.Logger) *accountPurger {
+	p := &accountPurger{
+		js:       js,
+		statuses: make(map[string]bool, len(statuses)),
+		logger:   logger,
+		seqs:     make(map[string][]uint64),
+		wake:     make(chan struct{}, 1),
+	}
+	for _, s := range statuses {
+		p.statuses[s] = true
+	}
+	return p
+}
+
+// published indexes a frame stored at seq, or queues the purge it asks for.
+func (p *accountPurger) published(info FrameInfo, seq uint64) {
+	if info.DID == "" {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if info.Type == TypeAccount && p.statuses[info.Status] {
+		p.pending = append(p.pending, accountPurge{did: info.DID, status: info.Status, seq: seq})
+		select {
+		case p.wake <- struct{}{}:
+		default:
+		}
+		return
+	}
+	p.seqs[info.DID] = append(p.seqs[info.DID], seq)
+}
+
+// run indexes the stream, then purges accounts as their #account frames are
+// published, until ctx is done.
+func (p *accountPurger) run(ctx context.Context) {
+	p.mu.Lock()
+	p.seqs = make(map[string][]uint64)
+	p.pending = nil
+	p.mu.Unlock()
+
+	if err := p.index(ctx); err != nil && ctx.Err() == nil {
+		p.logger.Warn("failed to index the stream; frames already in it won't be purged", "error", err)
+	}
+
+	ticker := time.NewTicker(purgePruneInterval)
+	defer ticker.Stop()
+	for {
+		p.purgePending(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.wake:
+		case <-ticker.C:
+			p.prune()
+		}
+	}
+}
+
+// index reads the frames already in the stream.
+func (p *accountPurger) index(ctx context.Context) error {
+	info, err := p.js.StreamInfo("ATPROTO_FIREHOSE", nats.Context(ctx))
+	if err != nil {
+		return err
+	}
+	if info.State.Msgs == 0 {
+		return nil
+	}
+	last := info.State.LastSeq
+
+	sub, err := p.js.SubscribeSync("atproto.firehose.>", nats.BindStream("ATPROTO_FIREHOSE"), nats.OrderedConsumer(), nats.DeliverAll())
+	if err != nil {
+		return err
+	}
+	defer sub.Unsubscribe()
+
+	for {
+		msg, err := sub.NextMsgWithContext(ctx)
+		if err != nil {
+			return err
+		}
+		meta, err := msg.Metadata()
+		if err != nil {
+			return err
+		}
+		if info, err := InspectFrame(msg.Data); err == nil {
+			p.published(info, meta.Sequence.Stream)
+		}
+		// Frames published since are indexed as they are
+		if meta.Sequence.Stream >= last || meta.NumPending == 0 {
+			return nil
+		}
+	}
+}
+
+// purgePending deletes the frames of the accounts queued for a purge.
+func (p *accountPurger) purgePending(ctx context.Context) {
+	p.mu.Lock()
+	pending := p.pending
+	p.pending = nil
+	victims := make([][]uint64, len(pending))
+	for i, pur := range pending {
+		var keep []uint64
+		for _, seq := range p.seqs[pur.did] {
+			if seq < pur.seq {
+				victims[i] = append(victims[i], seq)
+			} else {
+				keep = append(keep, seq)
+			}
+		}
+		if len(keep) > 0 {
+			p.seqs[pur.did] = keep
+		} else {
+			delete(p.seqs, pur.did)
+		}
+	}
+	p.mu.Unlock()
+
+	for i, pur := range pending {
+		deleted := 0
+		for _, seq := range victims[i] {
+			// Overwrites the frame in the stream's storage, not only its index
+			err := p.js.SecureDeleteMsg("ATPROTO_FIREHOSE", seq, nats.Context(ctx))
+			if errors.Is(err, nats.ErrMsgNotFound) {
+				// Aged out already
+				continue
+			}
+			if err != nil {
+				if ctx.Err() == nil {
+					p.logger.Warn("failed to purge account frame; a restart retries it", "did", pur.did, "seq", seq, "error", err)
+				}
+				continue
+			}
+			deleted++
+		}
+		atomic.AddInt64(&p.purged, int64(deleted))
+		p.logger.Info("purged account frames", "did", pur.did, "status", pur.status, "frames", deleted)
+	}
+}
+
+// prune forgets the frames the stream dropped.
+func (p *accountPurger) prune() {
+	info, err := p.js.StreamInfo("ATPROTO_FIREHOSE")
+	if err != nil {
+		p.logger.Debug("failed to read stream state", "error", err)
+		return
+	}
+	first := info.State.FirstSeq
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for did, seqs := range p.seqs {
+		kept := seqs[:0]
+		for _, seq := range seqs {
+			if seq >= first {
+				kept = append(kept, seq)
+			}
+		}
+		if len(kept) > 0 {
+			p.seqs[did] = kept
+		} else {
+			delete(p.seqs, did)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package firehose
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/atproto/data"
+	"github.com/bluesky-social/indigo/events"
+	"github.com/bluesky-social/indigo/lex/util"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car"
+	carutil "github.com/ipld/go-car/util"
+)
+
+// Redaction removes content from commit frames before they are delivered.
+// It is built from rules, one per string:
+//
+//	drop <collection>           removes the ops of the collection's records
+//	strip <collection> <field>  removes a field from the collection's records
+//
+// A collection is an NSID, an NSID prefix ending in ".*" or "*" for every
+// collection. A field is a dotted path through nested objects, such as embed
+// or reply.root. For example, "drop chat.bsky.*" and "strip * embed".
+//
+// A commit the rules touch carries only its remaining records: the commit
+// and MST blocks would name the dropped ones, so they are left out, and a
+// stripped record gets a new CID. Its signature can't be verified anymore.
+// Commits the rules don't touch are delivered as they are.
+type Redaction struct {
+	rules []RedactionRule
+}
+
+// RedactionRule is a parsed redaction rule.
+type RedactionRule struct {
+	// Drop removes the records; otherwise Field is stripped from them
+	Drop       bool
+	Collection string
+	Field      []string
+}
+
+// ParseRedaction parses rules, returning nil when there are none.
+func ParseRedaction(rules []string) (*Redaction, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	r := &Redaction{}
+	for _, s := range rules {
+		rule, err := parseRedactionRule(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redaction rule %q: %w", s, err)
+		}
+		r.rules = append(r.rules, rule)
+	}
+	return r, nil
+}
+
+func parseRedactionRule(s string) (RedactionRule, error) {
+	words := strings.Fields(s)
+	if len(words) == 0 {
+		return RedactionRule{}, errors.New("empty rule")
+	}
+	var rule RedactionRule
+	switch words[0] {
+	case "drop":
+		if len(words) != 2 {
+			return RedactionRule{}, errors.New("want drop <collection>")
+		}
+		rule.Drop = true
+	case "strip":
+		if len(words) != 3 {
+			return RedactionRule{}, errors.New("want strip <collection> <field>")
+		}
+		rule.Field = strings.Split(words[2], ".")
+		for _, f := range rule.Field {
+			if f == "" {
+				return RedactionRule{}, fmt.Errorf("invalid field %q", words[2])
+			}
+		}
+		if rule.Field[0] == "$type" && len(rule.Field) == 1 {
+			return RedactionRule{}, errors.New("the record type can't be stripped")
+		}
+	default:
+		return RedactionRule{}, fmt.Errorf("unknown action %q, want drop or strip", words[0])
+	}
+	rule.Collection = words[1]
+	if c := rule.Collection; c != "*" && strings.Contains(strings.TrimSuffix(c, ".*"), "*") {
+		return RedactionRule{}, fmt.Errorf("invalid collection %q", c)
+	}
+	return rule, nil
+}
+
+// Rules returns the parsed rules.
+func (r *Redaction) Rules() []RedactionRule {
+	if r == nil {
+		return nil
+	}
+	return r.rules
+}
+
+// Matches returns whether the rule applies to the collection's records.
+func (rule RedactionRule) Matches(collection string) bool {
+	if rule.Collection == "*" {
+		return true
+	}
+	if prefix, ok := strings.CutSuffix(rule.Collection, ".*"); ok {
+		return strings.HasPrefix(collection, prefix+".")
+	}
+	return collection == rule.Collection
+}
+
+// Apply returns the frame with the rules applied, and false when it is not
+// to be delivered: a commit whose ops are all dropped, or a frame that can't
+// be decoded, as its content can't be checked. For the same reason, a record
+// that can't be decoded is dropped when a field is to be stripped from it.
+// Apply on a nil Redaction returns the frame.
+func (r *Redaction) Apply(frame []byte) ([]byte, bool) {
+	if r == nil {
+		return frame, true
+	}
+	var evt events.XRPCStreamEvent
+	if err := evt.Deserialize(bytes.NewReader(frame)); err != nil {
+		return nil, false
+	}
+	c := evt.RepoCommit
+	if c == nil || !r.touches(c) {
+		return frame, true
+	}
+
+	blocks := readCARBlocks(c.Blocks)
+	redacted := *c
+	redacted.Ops = nil
+	var kept []cid.Cid
+	keptBlocks := make(map[cid.Cid][]byte)
+	for _, op := range c.Ops {
+		collection, _, _ := strings.Cut(op.Path, "/")
+		var fields [][]string
+		dropped := false
+		for _, rule := range r.rules {
+			if !rule.Matches(collection) {
+				continue
+			}
+			if rule.Drop {
+				dropped = true
+				break
+			}
+			fields = append(fields, rule.Field)
+		}
+		if dropped {
+			continue
+		}
+
+		var blk []byte
+		if op.Cid != nil {
+			blk = blocks[cid.Cid(*op.Cid)]
+		}
+		if blk == nil {
+			// A delete, or a record the commit doesn't carry
+			redacted.Ops = append(redacted.Ops, op)
+			continue
+		}
+		opCID := cid.Cid(*op.Cid)
+		if len(fields) > 0 {
+			var ok bool
+			if blk, opCID, ok = stripRecord(blk, opCID, fields); !ok {
+				continue
+			}
+			op = &comatproto.SyncSubscribeRepos_RepoOp{Action: op.Action, Path: op.Path, Cid: (*util.LexLink)(&opCID), Prev: op.Prev}
+		}
+		redacted.Ops = append(redacted.Ops, op)
+		if _, ok := keptBlocks[opCID]; !ok {
+			kept = append(kept, opCID)
+			keptBlocks[opCID] = blk
+		}
+	}
+	if len(redacted.Ops) == 0 {
+		return nil, false
+	}
+
+	var blocksCAR bytes.Buffer
+	if err := writeCAR(&blocksCAR, cid.Cid(c.Commit), kept, keptBlocks); err != nil {
+		return nil, false
+	}
+	redacted.Blocks = blocksCAR.Bytes()
+	var out bytes.Buffer
+	if err := (&events.XRPCStreamEvent{RepoCommit: &redacted}).Serialize(&out); err != nil {
+		return nil, false
+	}
+	return out.Bytes(), true
+}
+
+// touches returns whether a rule applies to one of the commit's ops.
+func (r *Redaction) touches(c *comatproto.SyncSubscribeRepos_Commit) bool {
+	for _, op := range c.Ops {
+		collection, _, _ := strings.Cut(op.Path, "/")
+		for _, rule := range r.rules {
+			if rule.Matches(collection) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// stripRecord removes the fields from a record block and returns it with
+// its CID, a new one if a field was removed.
+func stripRecord(blk []byte, c cid.Cid, fields [][]string) ([]byte, cid.Cid, bool) {
+	rec, err := data.UnmarshalCBOR(blk)
+	if err != nil {
+		return nil, cid.Undef, false
+	}
+	changed := false
+	for _, f := range fields {
+		if deleteField(rec, f) {
+			changed = true
+		}
+	}
+	if !changed {
+		return blk, c, true
+	}
+	if blk, err = data.MarshalCBOR(rec); err != nil {
+		return nil, cid.Undef, false
+	}
+	if c, err = c.Prefix().Sum(blk); err != nil {
+		return nil, cid.Undef, false
+	}
+	return blk, c, true
+}
+
+// deleteField removes the field at path from obj and returns whether it was
+// there.
+func deleteField(obj map[string]any, path []string) bool {
+	for _, key := range path[:len(path)-1] {
+		next, ok := obj[key].(map[string]any)
+		if !ok {
+			return false
+		}
+		obj = next
+	}
+	last := path[len(path)-1]
+	if _, ok := obj[last]; !ok {
+		return false
+	}
+	delete(obj, last)
+	return true
+}
+
+func writeCAR(w *bytes.Buffer, root cid.Cid, order []cid.Cid, blocks map[cid.Cid][]byte) error {
+	if err := car.WriteHeader(&car.CarHeader{Roots: []cid.Cid{root}, Version: 1}, w); err != nil {
+		return err
+	}
+	for _, c := range order {
+		if err := carutil.LdWrite(w, c.Bytes(), blocks[c]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,340 @@
+package firehose
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// The router republishes the frames of the ATPROTO_FIREHOSE stream to
+// EventsStream, under subjects naming their partition, type and collection:
+//
+//	atproto.events.<partition>.commit.<collection>  commits, once per collection
+//	atproto.events.<partition>.commit.other         commits without ops or a valid NSID
+//	atproto.events.<partition>.<type>               the other frame types
+//	atproto.events.0.undecodable                    frames that don't decode
+//
+// The partition is a hash of the frame's DID, so the frames of a repo stay
+// in one partition. Frames without a DID are in partition 0.
+//
+// Every message gets a Nats-Msg-Id derived from the frame's relay sequence
+// and, for commits, the index of the first op of its collection, so routing
+// a frame again, after a restart or a redelivery, is dropped as a duplicate
+// within the stream's duplicate window.
+const (
+	EventsStream = "ATPROTO_EVENTS"
+	// EventsSubjects matches every subject of EventsStream.
+	EventsSubjects = "atproto.events.>"
+	// RawSubject is where ingest publishes the frames the router reads.
+	RawSubject = "atproto.firehose.raw"
+)
+
+// RouterOptions configures a Router.
+type RouterOptions struct {
+	// Durable is the consumer routers share on ATPROTO_FIREHOSE; they split
+	// its frames between them.
+	Durable string
+	// Partitions is how many partitions the frames are hashed into.
+	Partitions int
+	// Workers fetch, decode and republish batches of up to BatchSize
+	// frames concurrently.
+	Workers   int
+	BatchSize int
+	// Stream configures EventsStream; DedupID and the ingest settings don't
+	// apply. Its DuplicateWindow should cover the time a frame may take to
+	// be routed again, e.g. a router's restart.
+	Stream StreamOptions
+}
+
+// Router republishes the raw frames of the firehose stream to the subjects of
+// EventsStream, so ingest doesn't decode for routing and decoding scales on
+// its own.
+type Router struct {
+	js     nats.JetStreamContext
+	sub    *nats.Subscription
+	opts   RouterOptions
+	logger *slog.Logger
+
+	routed      int64
+	undecodable int64
+	failed      int64
+}
+
+// NewRouter creates EventsStream, or updates it to opts.Stream, and binds to
+// the routers' durable.
+func NewRouter(js nats.JetStreamContext, opts RouterOptions, logger *slog.Logger) (*Router, error) {
+	if err := EnsureEventsStream(js, opts.Stream, logger); err != nil {
+		return nil, err
+	}
+	sub, err := subscribeRaw(js, opts.Durable, 2*opts.Workers*opts.BatchSize)
+	if err != nil {
+		return nil, err
+	}
+	return &Router{js: js, sub: sub, opts: opts, logger: logger}, nil
+}
+
+// EnsureEventsStream creates EventsStream, or updates it to opts.
+func EnsureEventsStream(js nats.JetStreamContext, opts StreamOptions, logger *slog.Logger) error {
+	return configureStream(js, EventsStream, EventsSubjects, opts, logger)
+}
+
+// subscribeRaw binds to durable, a work queue of the raw frames shared by the
+// processes naming it, creating it unless it exists.
+func subscribeRaw(js nats.JetStreamContext, durable string, maxAckPending int) (*nats.Subscription, error) {
+	stream, err := js.StreamNameBySubject(RawSubject)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find the firehose stream (is ingest running?): %w", err)
+	}
+
+	// Bound to, not created by, the subscription, which would delete it on
+	// Unsubscribe: the next process then resumes at its ack floor. A new
+	// durable starts with the frames the stream still has
+	info, err := js.ConsumerInfo(stream, durable)
+	switch {
+	case errors.Is(err, nats.ErrConsumerNotFound):
+		_, err = js.AddConsumer(stream, &nats.ConsumerConfig{
+			Durable:       durable,
+			DeliverPolicy: nats.DeliverAllPolicy,
+			AckPolicy:     nats.AckExplicitPolicy,
+			FilterSubject: RawSubject,
+			MaxAckPending: maxAckPending,
+		})
+		if err != nil {
+			if _, ierr := js.ConsumerInfo(stream, durable); ierr == nil {
+				// Another process created it first; its MaxAckPending will do
+				err = nil
+			}
+		}
+	case err == nil && info.Config.MaxAckPending < maxAckPending:
+		cfg := info.Config
+		cfg.MaxAckPending = maxAckPending
+		_, err = js.UpdateConsumer(stream, &cfg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create consumer %s: %w", durable, err)
+	}
+	sub, err := js.PullSubscribe(RawSubject, durable, nats.Bind(stream, durable))
+	if err != nil {
+		return nil, fmt.Errorf("failed to subscribe: %w", err)
+	}
+	return sub, nil
+}
+
+// Run routes frames with opts.Workers workers until ctx is done.
+func (r *Router) Run(ctx context.Context) error {
+	fetchWorkers(ctx, r.sub, r.opts.Workers, r.opts.BatchSize, r.logger, r.route)
+	return nil
+}
+
+// fetchWorkers has workers fetch batches of up to batchSize messages of sub
+// and handle them until ctx is done.
+func fetchWorkers(ctx context.Context, sub *nats.Subscription, workers, batchSize int, logger *slog.Logger, handle func([]*nats.Msg)) {
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				fetchCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+				msgs, err := sub.Fetch(batchSize, nats.Context(fetchCtx))
+				cancel()
+				if err != nil {
+					if ctx.Err() == nil && !errors.Is(err, nats.ErrTimeout) && !errors.Is(err, context.DeadlineExceeded) {
+						logger.Warn("fetch error", "error", err)
+						time.Sleep(time.Second)
+					}
+					continue
+				}
+				handle(msgs)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// route republishes msgs and acks those EventsStream stored in full. The
+// others are NAKed and routed again.
+func (r *Router) route(msgs []*nats.Msg) {
+	futures := make([][]nats.PubAckFuture, len(msgs))
+	undecodable := make([]bool, len(msgs))
+	for i, msg := range msgs {
+		var routes []EventRoute
+		info, err := InspectFrame(msg.Data)
+		if err != nil {
+			routes = []EventRoute{{Subject: "atproto.events.0.undecodable"}}
+			undecodable[i] = true
+		} else {
+			routes = EventRoutes(info, r.opts.Partitions)
+		}
+		for _, route := range routes {
+			out := nats.NewMsg(route.Subject)
+			out.Data = msg.Data
+			for k, v := range msg.Header {
+				out.Header[k] = v
+			}
+			if route.MsgID == "" {
+				meta, err := msg.Metadata()
+				if err != nil {
+					futures[i] = append(futures[i], nil)
+					continue
+				}
+				route.MsgID = "raw/" + strconv.FormatUint(meta.Sequence.Stream, 10)
+			}
+			out.Header.Set(nats.MsgIdHdr, route.MsgID)
+			f, err := r.js.PublishMsgAsync(out)
+			if err != nil {
+				r.logger.Warn("failed to publish routed frame", "subject", out.Subject, "error", err)
+			}
+			futures[i] = append(futures[i], f)
+		}
+	}
+
+	for i, ok := range settle(msgs, futures, r.logger) {
+		if !ok {
+			atomic.AddInt64(&r.failed, 1)
+			continue
+		}
+		atomic.AddInt64(&r.routed, 1)
+		if undecodable[i] {
+			atomic.AddInt64(&r.undecodable, 1)
+		}
+	}
+}
+
+// settle waits for the stream to store the messages published for each of
+// msgs, in futures (nil for one that couldn't be), then acks the messages
+// stored in full and NAKs the others to have them handled again. It returns
+// which were acked.
+func settle(msgs []*nats.Msg, futures [][]nats.PubAckFuture, logger *slog.Logger) []bool {
+	// Bounds the wait for the stream's acks of the whole batch
+	waitCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	acked := make([]bool, len(msgs))
+	for i, msg := range msgs {
+		ok := true
+		for _, f := range futures[i] {
+			if f == nil {
+				ok = false
+				continue
+			}
+			select {
+			case <-f.Ok():
+			case err := <-f.Err():
+				logger.Warn("failed to publish frame", "subject", f.Msg().Subject, "error", err)
+				ok = false
+			case <-waitCtx.Done():
+				ok = false
+			}
+		}
+		if !ok {
+			_ = msg.NakWithDelay(time.Second)
+			continue
+		}
+		_ = msg.Ack()
+		acked[i] = true
+	}
+	return acked
+}
+
+// EventRoute is a message the router publishes for a frame.
+type EventRoute struct {
+	Subject string
+	// MsgID is the same every time the frame is routed. It is empty for
+	// frames without a relay sequence, which the router names by their
+	// sequence in ATPROTO_FIREHOSE instead.
+	MsgID string
+}
+
+// EventRoutes returns the messages a frame is routed to: one per collection
+// for a commit, one for the other frames.
+func EventRoutes(info FrameInfo, partitions int) []EventRoute {
+	prefix := "atproto.events." + strconv.Itoa(Partition(info.DID, partitions)) + "." + strings.TrimPrefix(info.Type, "#")
+	msgID := func(op int) string {
+		if info.Seq <= 0 {
+			return ""
+		}
+		if op < 0 {
+			return strconv.FormatInt(info.Seq, 10)
+		}
+		return strconv.FormatInt(info.Seq, 10) + "/" + strconv.Itoa(op)
+	}
+	if info.Type != TypeCommit {
+		return []EventRoute{{Subject: prefix, MsgID: msgID(-1)}}
+	}
+	if len(info.Paths) == 0 {
+		return []EventRoute{{Subject: prefix + ".other", MsgID: msgID(-1)}}
+	}
+
+	var routes []EventRoute
+	seen := make(map[string]bool, len(info.Collections))
+	for i, path := range info.Paths {
+		collection, _, _ := strings.Cut(path, "/")
+		subject := prefix + ".other"
+		if subjectSafe(collection) {
+			subject = prefix + "." + collection
+		}
+		if !seen[subject] {
+			seen[subject] = true
+			routes = append(routes, EventRoute{Subject: subject, MsgID: msgID(i)})
+		}
+	}
+	return routes
+}
+
+// Partition hashes did into one of partitions partitions; an empty DID is in
+// partition 0.
+func Partition(did string, partitions int) int {
+	if did == "" || partitions <= 1 {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write([]byte(did))
+	return int(h.Sum32() % uint32(partitions))
+}
+
+// subjectSafe reports whether an NSID can be spliced into a subject: only
+// letters, digits and hyphens between its dots.
+func subjectSafe(nsid string) bool {
+	for _, token := range strings.Split(nsid, ".") {
+		if token == "" {
+			return false
+		}
+		for _, c := range token {
+			if !(c == '-' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// GetRoutedFrames returns the number of frames republished to EventsStream.
+func (r *Router) GetRoutedFrames() int64 {
+	return atomic.LoadInt64(&r.routed)
+}
+
+// GetUndecodableFrames returns the number of routed frames that didn't
+// decode.
+func (r *Router) GetUndecodableFrames() int64 {
+	return atomic.LoadInt64(&r.undecodable)
+}
+
+// GetFailedFrames returns the number of frames whose republishing failed,
+// which are routed again.
+func (r *Router) GetFailedFrames() int64 {
+	return atomic.LoadInt64(&r.failed)
+}
+
+// Close unsubscribes; the durable stays for the next router.
+func (r *Router) Close() error {
+	return r.sub.Unsubscribe()
+}
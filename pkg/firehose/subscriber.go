@@ -0,0 +1,445 @@
+package firehose
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bluesky-social/indigo/events"
+	"github.com/cespare/xxhash/v2"
+	"github.com/eurosky/firehose-processor-aas/internal/pkg/tracing"
+	"github.com/gorilla/websocket"
+	"github.com/nats-io/nats.go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/eurosky/firehose-processor-aas/pkg/firehose")
+
+// maxPooledFrame bounds the read buffers kept for reuse, so a rare huge
+// frame doesn't stay allocated.
+const maxPooledFrame = 1 << 20
+
+// frameBuffers are the buffers frames are read into. Publishing copies the
+// frame into the NATS connection's buffer, so they are reused once it
+// returns.
+var frameBuffers = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+// readFrame reads the next frame into a buffer from frameBuffers; the caller
+// hands it back with releaseFrame.
+func readFrame(con *websocket.Conn) (*bytes.Buffer, error) {
+	_, r, err := con.NextReader()
+	if err != nil {
+		return nil, err
+	}
+	buf := frameBuffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	if _, err := buf.ReadFrom(r); err != nil {
+		releaseFrame(buf)
+		return nil, err
+	}
+	return buf, nil
+}
+
+func releaseFrame(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledFrame {
+		frameBuffers.Put(buf)
+	}
+}
+
+// Headers set on every message published to the stream.
+const (
+	// HeaderEventTime carries the relay's RFC 3339 event timestamp.
+	HeaderEventTime = "Fpaas-Event-Time"
+	// HeaderSeq carries the firehose sequence number of the frame.
+	HeaderSeq = "Fpaas-Seq"
+	// HeaderFrameType carries the frame type (#commit, #identity, ...).
+	HeaderFrameType = "Fpaas-Frame-Type"
+	// HeaderAccountStatus carries why the account of an #account frame
+	// isn't active (deleted, takendown, ...); it's unset when it is.
+	HeaderAccountStatus = "Fpaas-Account-Status"
+)
+
+type SimpleSubscriber struct {
+	logger      *slog.Logger
+	natsConn    *nats.Conn
+	js          nats.JetStreamContext
+	relayHost   string
+	totalEvents int64
+	lastCursor  int64
+	// lastEventTime is the relay event time of the last published frame, in
+	// Unix nanoseconds
+	lastEventTime int64
+	leader        int32
+	dedupID       DedupID
+	// purger is nil unless StreamOptions.PurgeAccountStatuses is set
+	purger *accountPurger
+	// labels is nil unless StreamOptions.Labelers is set
+	labels *labelFollower
+	// connected is 1 while the subscriber reads from the relay
+	connected int32
+}
+
+// StreamOptions configures the ATPROTO_FIREHOSE stream.
+type StreamOptions struct {
+	MaxAge time.Duration
+	// Storage is nats.MemoryStorage or nats.FileStorage. It only applies
+	// when the stream is created.
+	Storage  nats.StorageType
+	Replicas int
+	// DuplicateWindow is how long message IDs are remembered to drop frames
+	// published twice.
+	DuplicateWindow time.Duration
+	// DedupID picks how message IDs are derived from frames, DedupSHA256
+	// when empty. It only applies when the subscriber is created.
+	DedupID DedupID
+	// PurgeAccountStatuses lists the account statuses (deleted, takendown,
+	// ...) whose #account frames make the subscriber delete the account's
+	// earlier frames from the stream. Empty disables it. It only applies
+	// when the subscriber is created.
+	PurgeAccountStatuses []string
+	// Labelers lists the ws:// or wss:// hosts of labelers whose labels are
+	// read into LabelBucket alongside the firehose, for consumers filtering
+	// on labels. It only applies when the subscriber is created.
+	Labelers []string
+}
+
+// DefaultStreamOptions keeps five minutes of firehose in memory.
+var DefaultStreamOptions = StreamOptions{
+	MaxAge:          5 * time.Minute,
+	Storage:         nats.MemoryStorage,
+	Replicas:        1,
+	DuplicateWindow: 5 * time.Minute,
+	DedupID:         DedupSHA256,
+}
+
+// DedupID is how the Nats-Msg-Id of a frame, which the stream deduplicates
+// on, is derived.
+type DedupID string
+
+const (
+	// DedupSHA256 hashes the frame with SHA-256.
+	DedupSHA256 DedupID = "sha256"
+	// DedupXXHash hashes the frame with xxHash, much faster and still
+	// collision-free in practice within a duplicate window.
+	DedupXXHash DedupID = "xxhash"
+	// DedupSeq uses the relay's sequence number, hashing nothing. Frames
+	// without one (#info, and those that don't decode) fall back to xxHash.
+	// A relay's seqs only identify frames of that relay.
+	DedupSeq DedupID = "seq"
+)
+
+// ParseDedupID checks the name of a DedupID.
+func ParseDedupID(name string) (DedupID, error) {
+	switch id := DedupID(name); id {
+	case DedupSHA256, DedupXXHash, DedupSeq:
+		return id, nil
+	default:
+		return "", fmt.Errorf("dedup-id must be sha256, xxhash or seq, got %q", name)
+	}
+}
+
+// msgID returns the message ID of a frame; seq is its relay sequence, or
+// zero when it has none.
+func (id DedupID) msgID(frame []byte, seq int64) string {
+	switch {
+	case id == DedupSeq && seq > 0:
+		return "seq:" + strconv.FormatInt(seq, 10)
+	case id == DedupXXHash || id == DedupSeq:
+		return "xxh:" + strconv.FormatUint(xxhash.Sum64(frame), 16)
+	default:
+		hash := sha256.Sum256(frame)
+		return hex.EncodeToString(hash[:])
+	}
+}
+
+func NewSimpleSubscriber(relayHost, natsURL string, opts StreamOptions, logger *slog.Logger) (*SimpleSubscriber, error) {
+	nc, err := nats.Connect(natsURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+
+	js, err := nc.JetStream()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create JetStream context: %w", err)
+	}
+
+	s := &SimpleSubscriber{
+		logger:    logger,
+		natsConn:  nc,
+		js:        js,
+		relayHost: relayHost,
+		dedupID:   opts.DedupID,
+	}
+	if err := s.ConfigureStream(opts); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	if len(opts.PurgeAccountStatuses) > 0 {
+		s.purger = newAccountPurger(js, opts.PurgeAccountStatuses, logger)
+	}
+	if len(opts.Labelers) > 0 {
+		if s.labels, err = newLabelFollower(js, opts.Labelers, logger); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// ConfigureStream creates the stream, or updates it to opts. It doesn't
+// touch the relay connection, so it can run while the subscriber does.
+func (s *SimpleSubscriber) ConfigureStream(opts StreamOptions) error {
+	return EnsureFirehoseStream(s.js, opts, s.logger)
+}
+
+// EnsureFirehoseStream creates the ATPROTO_FIREHOSE stream ingest publishes
+// to, or updates it to opts.
+func EnsureFirehoseStream(js nats.JetStreamContext, opts StreamOptions, logger *slog.Logger) error {
+	return configureStream(js, "ATPROTO_FIREHOSE", "atproto.firehose.>", opts, logger)
+}
+
+// configureStream creates the stream of subjects, or updates it to opts.
+func configureStream(js nats.JetStreamContext, streamName, subjects string, opts StreamOptions, logger *slog.Logger) error {
+	info, err := js.StreamInfo(streamName)
+	if err != nil {
+		logger.Info("creating JetStream stream", "name", streamName)
+		_, err = js.AddStream(&nats.StreamConfig{
+			Name:       streamName,
+			Subjects:   []string{subjects},
+			Retention:  nats.LimitsPolicy,
+			MaxAge:     opts.MaxAge,
+			Storage:    opts.Storage,
+			Replicas:   opts.Replicas,
+			Duplicates: opts.DuplicateWindow,
+		})
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, nats.ErrStreamNameAlreadyInUse) {
+			return fmt.Errorf("failed to create stream: %w", err)
+		}
+		// Another process created it first, with its own settings
+		if info, err = js.StreamInfo(streamName); err != nil {
+			return fmt.Errorf("failed to read stream: %w", err)
+		}
+	}
+
+	if cfg := info.Config; cfg.MaxAge != opts.MaxAge || cfg.Replicas != opts.Replicas || cfg.Duplicates != opts.DuplicateWindow {
+		logger.Info("updating JetStream stream", "name", streamName, "max_age", opts.MaxAge, "replicas", opts.Replicas, "duplicate_window", opts.DuplicateWindow)
+		cfg.MaxAge = opts.MaxAge
+		cfg.Replicas = opts.Replicas
+		cfg.Duplicates = opts.DuplicateWindow
+		if _, err := js.UpdateStream(&cfg); err != nil {
+			return fmt.Errorf("failed to update stream: %w", err)
+		}
+	}
+	if info.Config.Storage != opts.Storage {
+		logger.Warn("stream storage differs from configuration; recreate the stream to change it", "name", streamName, "storage", info.Config.Storage)
+	}
+	return nil
+}
+
+func (s *SimpleSubscriber) Run(ctx context.Context) error {
+	return s.run(ctx, 0)
+}
+
+// run reads the firehose from cursor, or from the live tip when it's zero,
+// until ctx is done or the connection fails.
+func (s *SimpleSubscriber) run(ctx context.Context, cursor int64) error {
+	dialer := websocket.DefaultDialer
+	u, err := url.Parse(s.relayHost)
+	if err != nil {
+		return fmt.Errorf("invalid relay host URI: %w", err)
+	}
+	u.Path = "xrpc/com.atproto.sync.subscribeRepos"
+	if cursor > 0 {
+		u.RawQuery = url.Values{"cursor": {strconv.FormatInt(cursor, 10)}}.Encode()
+	}
+
+	con, _, err := dialer.Dial(u.String(), http.Header{
+		"User-Agent": []string{"fpaas-firehose-subscriber/1.0"},
+	})
+	if err != nil {
+		return fmt.Errorf("subscribing to firehose failed: %w", err)
+	}
+	defer con.Close()
+	atomic.StoreInt32(&s.connected, 1)
+	defer atomic.StoreInt32(&s.connected, 0)
+
+	// Unblocks ReadMessage when ctx is done
+	stop := context.AfterFunc(ctx, func() { con.Close() })
+	defer stop()
+
+	if s.purger != nil {
+		pctx, cancel := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			s.purger.run(pctx)
+		}()
+		defer func() {
+			cancel()
+			<-done
+		}()
+	}
+
+	if s.labels != nil {
+		lctx, cancel := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			s.labels.run(lctx)
+		}()
+		defer func() {
+			cancel()
+			<-done
+		}()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+			buf, err := readFrame(con)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return err
+			}
+			message := buf.Bytes()
+
+			pctx, span := tracer.Start(ctx, "firehose.publish", trace.WithSpanKind(trace.SpanKindProducer))
+
+			msg := nats.NewMsg("atproto.firehose.raw")
+			msg.Data = message
+
+			// Extract sequence number using indigo SDK
+			var evt events.XRPCStreamEvent
+			var seq int64
+			var info FrameInfo
+			reader := bytes.NewReader(message)
+			if err := evt.Deserialize(reader); err == nil {
+				info = frameInfo(&evt)
+				if info.Seq > 0 {
+					seq = info.Seq
+					msg.Header.Set(HeaderSeq, strconv.FormatInt(info.Seq, 10))
+				}
+				msg.Header.Set(HeaderFrameType, info.Type)
+				if info.Status != "" {
+					msg.Header.Set(HeaderAccountStatus, info.Status)
+				}
+				// Lets consumers measure end-to-end latency from the relay's event time
+				if info.Time != "" {
+					msg.Header.Set(HeaderEventTime, info.Time)
+				}
+			}
+			msg.Header.Set(nats.MsgIdHdr, s.dedupID.msgID(message, seq))
+
+			atomic.AddInt64(&s.totalEvents, 1)
+
+			span.SetAttributes(
+				attribute.String("messaging.system", "nats"),
+				attribute.String("messaging.destination.name", msg.Subject),
+				attribute.Int64("fpaas.seq", seq),
+				attribute.String("fpaas.frame_type", msg.Header.Get(HeaderFrameType)),
+			)
+			// Consumers link their delivery spans to this one
+			tracing.Inject(pctx, msg)
+			ack, err := s.js.PublishMsg(msg)
+			releaseFrame(buf)
+			if err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, "publish failed")
+				span.End()
+				return err
+			}
+			span.End()
+			if s.purger != nil && !ack.Duplicate {
+				s.purger.published(info, ack.Sequence)
+			}
+			// Only published frames move the cursor, so resuming from it
+			// doesn't skip any
+			if seq > 0 {
+				atomic.StoreInt64(&s.lastCursor, seq)
+			}
+			if t, err := time.Parse(time.RFC3339, msg.Header.Get(HeaderEventTime)); err == nil {
+				atomic.StoreInt64(&s.lastEventTime, t.UnixNano())
+			}
+		}
+	}
+}
+
+// Healthy reports whether NATS is connected and the stream exists.
+func (s *SimpleSubscriber) Healthy(ctx context.Context) error {
+	if status := s.natsConn.Status(); status != nats.CONNECTED {
+		return fmt.Errorf("nats connection is %s", status)
+	}
+	if _, err := s.js.StreamInfo("ATPROTO_FIREHOSE", nats.Context(ctx)); err != nil {
+		return fmt.Errorf("stream unavailable: %w", err)
+	}
+	return nil
+}
+
+func (s *SimpleSubscriber) Close() error {
+	s.natsConn.Close()
+	return nil
+}
+
+// JetStream returns the JetStream context the subscriber publishes with.
+func (s *SimpleSubscriber) JetStream() nats.JetStreamContext {
+	return s.js
+}
+
+func (s *SimpleSubscriber) GetTotalEvents() int64 {
+	return atomic.LoadInt64(&s.totalEvents)
+}
+
+// GetPurgedFrames returns the number of frames deleted from the stream
+// because their account was purged.
+func (s *SimpleSubscriber) GetPurgedFrames() int64 {
+	if s.purger == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&s.purger.purged)
+}
+
+// GetAppliedLabels returns the number of labels read from the labelers.
+func (s *SimpleSubscriber) GetAppliedLabels() int64 {
+	if s.labels == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&s.labels.applied)
+}
+
+// IsConnected reports whether the subscriber is reading from the relay.
+func (s *SimpleSubscriber) IsConnected() bool {
+	return atomic.LoadInt32(&s.connected) == 1
+}
+
+func (s *SimpleSubscriber) GetLastCursor() int64 {
+	return atomic.LoadInt64(&s.lastCursor)
+}
+
+// GetLastEventTime returns the relay event time of the last published frame,
+// or the zero time before the first one.
+func (s *SimpleSubscriber) GetLastEventTime() time.Time {
+	if ns := atomic.LoadInt64(&s.lastEventTime); ns != 0 {
+		return time.Unix(0, ns)
+	}
+	return time.Time{}
+}
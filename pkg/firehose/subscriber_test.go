@@ -0,0 +1,117 @@
+package firehose
+
+import (
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+// benchFrameSize is the mean size of a fake relay commit frame with its
+// records.
+const benchFrameSize = 600
+
+// relayConn connects to a websocket server writing frame n times.
+func relayConn(b *testing.B, frame []byte, n int) *websocket.Conn {
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		con, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer con.Close()
+		for range n {
+			if err := con.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+				return
+			}
+		}
+	}))
+	b.Cleanup(srv.Close)
+	con, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { con.Close() })
+	return con
+}
+
+func benchFrame() []byte {
+	frame := make([]byte, benchFrameSize)
+	rand.New(rand.NewSource(1)).Read(frame)
+	return frame
+}
+
+// BenchmarkReadFrame compares reading frames into pooled buffers with
+// websocket's ReadMessage, which allocates each.
+func BenchmarkReadFrame(b *testing.B) {
+	frame := benchFrame()
+	b.Run("pooled", func(b *testing.B) {
+		con := relayConn(b, frame, b.N)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for range b.N {
+			buf, err := readFrame(con)
+			if err != nil {
+				b.Fatal(err)
+			}
+			releaseFrame(buf)
+		}
+	})
+	b.Run("ReadMessage", func(b *testing.B) {
+		con := relayConn(b, frame, b.N)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for range b.N {
+			if _, _, err := con.ReadMessage(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkReadPublishFrame reads frames and publishes them to JetStream, as
+// ingest does, returning each buffer once the publish returned.
+func BenchmarkReadPublishFrame(b *testing.B) {
+	ns, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: server.RANDOM_PORT, JetStream: true, StoreDir: b.TempDir(), NoSigs: true})
+	if err != nil {
+		b.Fatal(err)
+	}
+	go ns.Start()
+	b.Cleanup(ns.Shutdown)
+	if !ns.ReadyForConnections(10 * time.Second) {
+		b.Fatal("NATS server not ready")
+	}
+	nc, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(nc.Close)
+	js, err := nc.JetStream()
+	if err != nil {
+		b.Fatal(err)
+	}
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "ATPROTO_FIREHOSE", Subjects: []string{"atproto.firehose.>"}, Storage: nats.MemoryStorage}); err != nil {
+		b.Fatal(err)
+	}
+
+	con := relayConn(b, benchFrame(), b.N)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		buf, err := readFrame(con)
+		if err != nil {
+			b.Fatal(err)
+		}
+		_, err = js.PublishMsg(&nats.Msg{Subject: "atproto.firehose.commit", Data: buf.Bytes()})
+		releaseFrame(buf)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
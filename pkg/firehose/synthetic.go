@@ -0,0 +1,57 @@
+package firehose
+
+import (
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Consumers in test mode publish the synthetic frames they deliver to
+// SyntheticStream, each under SyntheticSubject(consumer), and read them
+// back like the firehose's, so acks, replays and the delivery log work as
+// they will on live data. The frames are only kept for SyntheticMaxAge:
+// they are made up, and there is nothing to catch up on.
+const (
+	SyntheticStream = "FPAAS_SYNTHETIC"
+	// SyntheticSubjects matches every subject of SyntheticStream.
+	SyntheticSubjects = "fpaas.synthetic.>"
+	SyntheticMaxAge   = time.Hour
+)
+
+// SyntheticSubject is the subject of SyntheticStream holding the synthetic
+// frames of consumer.
+func SyntheticSubject(consumer string) string {
+	return "fpaas.synthetic." + consumer
+}
+
+// EnsureSyntheticStream creates SyntheticStream, or updates it to keep its
+// frames for SyntheticMaxAge.
+func EnsureSyntheticStream(js nats.JetStreamContext, logger *slog.Logger) error {
+	// NATS's default duplicate window; frames carry no Nats-Msg-Id
+	opts := StreamOptions{MaxAge: SyntheticMaxAge, Storage: nats.FileStorage, Replicas: 1, DuplicateWindow: 2 * time.Minute}
+	return configureStream(js, SyntheticStream, SyntheticSubjects, opts, logger)
+}
+
+// SyntheticMsg returns the message publishing frame to the subject of
+// consumer, with the headers the subscriber sets on the firehose's.
+func SyntheticMsg(consumer string, frame []byte) *nats.Msg {
+	msg := nats.NewMsg(SyntheticSubject(consumer))
+	msg.Data = frame
+	info, err := InspectFrame(frame)
+	if err != nil {
+		return msg
+	}
+	if info.Seq > 0 {
+		msg.Header.Set(HeaderSeq, strconv.FormatInt(info.Seq, 10))
+	}
+	msg.Header.Set(HeaderFrameType, info.Type)
+	if info.Status != "" {
+		msg.Header.Set(HeaderAccountStatus, info.Status)
+	}
+	if info.Time != "" {
+		msg.Header.Set(HeaderEventTime, info.Time)
+	}
+	return msg
+}
@@ -0,0 +1,312 @@
+// Package fpaas embeds the firehose processor in a Go service: read the relay
+// into JetStream, filter and deliver the events, without deploying the fpaas
+// binaries.
+//
+//	err := fpaas.NewPipeline().
+//		FromRelay("wss://bsky.network").
+//		Filter("app.bsky.feed.post").
+//		ToWebhook("https://example.com/hook", fpaas.WithSecret(secret)).
+//		Run(ctx)
+//
+// A pipeline needs a NATS server with JetStream, like the binaries do; the
+// stream and the durable consumer keep the position across restarts. The
+// building blocks are in the firehose (ingest) and consumer (delivery)
+// packages for anything the builder doesn't cover.
+package fpaas
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/pkg/consumer"
+	"github.com/eurosky/firehose-processor-aas/pkg/events"
+	"github.com/eurosky/firehose-processor-aas/pkg/firehose"
+	"github.com/nats-io/nats.go"
+)
+
+// Pipeline is built by chaining its methods and started with Run. Invalid
+// settings are reported by Run.
+type Pipeline struct {
+	relayHost string
+	stream    firehose.StreamOptions
+	leaderID  string
+	leaseTTL  time.Duration
+	cfg       consumer.Config
+	hasSink   bool
+	logger    *slog.Logger
+	errs      []error
+}
+
+// NewPipeline returns a pipeline using the local NATS server and a durable
+// consumer named "fpaas" that fetches up to 100 events every second.
+func NewPipeline() *Pipeline {
+	return &Pipeline{
+		stream:   firehose.DefaultStreamOptions,
+		leaseTTL: 10 * time.Second,
+		cfg: consumer.Config{
+			NATSURL:      nats.DefaultURL,
+			Name:         "fpaas",
+			PollInterval: time.Second,
+			BatchSize:    100,
+		},
+		logger: slog.Default(),
+	}
+}
+
+// FromRelay reads the firehose of the relay (ws:// or wss://) into the
+// stream. Without it the pipeline consumes a stream fed by a separately
+// deployed fpaas ingest.
+func (p *Pipeline) FromRelay(host string) *Pipeline {
+	p.relayHost = host
+	return p
+}
+
+// NATS sets the NATS server URL.
+func (p *Pipeline) NATS(url string) *Pipeline {
+	p.cfg.NATSURL = url
+	return p
+}
+
+// Stream sets the retention of the stream created by FromRelay.
+func (p *Pipeline) Stream(opts firehose.StreamOptions) *Pipeline {
+	p.stream = opts
+	return p
+}
+
+// LeaderElection lets several instances run FromRelay with only one reading
+// the relay at a time, resuming from the leader's cursor on takeover.
+// instanceID must be unique per instance.
+func (p *Pipeline) LeaderElection(instanceID string, leaseTTL time.Duration) *Pipeline {
+	p.leaderID = instanceID
+	p.leaseTTL = leaseTTL
+	return p
+}
+
+// Name sets the durable consumer name. Pipelines with different names each
+// receive every event; instances sharing a name share the work.
+func (p *Pipeline) Name(name string) *Pipeline {
+	p.cfg.Name = name
+	return p
+}
+
+// Batch sets how many events are fetched at most and how often.
+func (p *Pipeline) Batch(size int, interval time.Duration) *Pipeline {
+	p.cfg.BatchSize = size
+	p.cfg.PollInterval = interval
+	return p
+}
+
+// Autotune adjusts the Batch settings to the backlog and the sink's latency,
+// within bounds (see consumer.AutotuneBounds).
+func (p *Pipeline) Autotune(bounds consumer.AutotuneBounds) *Pipeline {
+	p.cfg.Autotune = true
+	p.cfg.AutotuneBounds = bounds
+	return p
+}
+
+// Filter only delivers commits touching one of the collections, which may
+// end in ".*" to match an NSID prefix ("app.bsky.feed.*"). Calls add up.
+func (p *Pipeline) Filter(collections ...string) *Pipeline {
+	p.cfg.Collections = append(p.cfg.Collections, collections...)
+	return p
+}
+
+// FrameTypes only delivers frames of these types (events.TypeCommit, ...).
+// Calls add up.
+func (p *Pipeline) FrameTypes(types ...string) *Pipeline {
+	p.cfg.FrameTypes = append(p.cfg.FrameTypes, types...)
+	return p
+}
+
+// Tombstones delivers #account frames with these statuses (deleted,
+// takendown, ...) even when Filter or FrameTypes leave them out, so the sink
+// learns to erase those accounts. Calls add up.
+func (p *Pipeline) Tombstones(statuses ...string) *Pipeline {
+	p.cfg.TombstoneStatuses = append(p.cfg.TombstoneStatuses, statuses...)
+	return p
+}
+
+// Redact removes content from commits before they reach the sink, with
+// rules such as "drop chat.bsky.*" or "strip * embed" (see
+// firehose.Redaction). Calls add up.
+func (p *Pipeline) Redact(rules ...string) *Pipeline {
+	p.cfg.Redaction = append(p.cfg.Redaction, rules...)
+	return p
+}
+
+// ExcludeLabels leaves out the events whose account or records carry one
+// of these labels, such as "!takedown" ("*" for any), as kept by
+// fpaas ingest --labelers. Calls add up.
+func (p *Pipeline) ExcludeLabels(labels ...string) *Pipeline {
+	p.cfg.ExcludeLabels = append(p.cfg.ExcludeLabels, labels...)
+	return p
+}
+
+// AnnotateLabels passes these labels of the events' accounts and records on
+// in events.Batch.Labels ("*" for any). Calls add up.
+func (p *Pipeline) AnnotateLabels(labels ...string) *Pipeline {
+	p.cfg.AnnotateLabels = append(p.cfg.AnnotateLabels, labels...)
+	return p
+}
+
+// Logger sets the logger, slog.Default() by default.
+func (p *Pipeline) Logger(logger *slog.Logger) *Pipeline {
+	p.logger = logger
+	return p
+}
+
+// WebhookOption configures ToWebhook.
+type WebhookOption func(*consumer.Config)
+
+// WithSecret signs every body with HMAC-SHA256 in X-Signature.
+func WithSecret(secret string) WebhookOption {
+	return func(cfg *consumer.Config) { cfg.WebhookSecret = secret }
+}
+
+// WithHeaders adds headers to every request.
+func WithHeaders(headers map[string]string) WebhookOption {
+	return func(cfg *consumer.Config) { cfg.WebhookHeaders = headers }
+}
+
+// WithTimeout bounds every call, consumer.DefaultWebhookTimeout by default.
+// A call that times out is redelivered.
+func WithTimeout(timeout time.Duration) WebhookOption {
+	return func(cfg *consumer.Config) { cfg.WebhookTimeout = timeout }
+}
+
+// WithRoutes sends the events the rules match to other paths or endpoints,
+// e.g. "app.bsky.graph.* /graph"; see consumer.WebhookRoute.
+func WithRoutes(rules ...string) WebhookOption {
+	return func(cfg *consumer.Config) { cfg.WebhookRoutes = rules }
+}
+
+// WithPayloadFormat selects the body encoding, JSON by default.
+func WithPayloadFormat(format consumer.PayloadFormat) WebhookOption {
+	return func(cfg *consumer.Config) { cfg.PayloadFormat = format }
+}
+
+// WithEventGranularity posts every event on its own, with at most
+// concurrency requests in flight, instead of one request per batch. Zero
+// sizes it from the CPUs, see consumer.DefaultDeliveryConcurrency.
+func WithEventGranularity(concurrency int) WebhookOption {
+	return func(cfg *consumer.Config) {
+		cfg.DeliveryGranularity = consumer.DeliverEvent
+		cfg.DeliveryConcurrency = concurrency
+	}
+}
+
+// ToWebhook delivers to url, the way fpaas consume does (see
+// pkg/webhookclient for the receiving side).
+func (p *Pipeline) ToWebhook(url string, opts ...WebhookOption) *Pipeline {
+	p.setSink()
+	p.cfg.Target = consumer.TargetWebhook
+	p.cfg.UseWebhook = true
+	p.cfg.WebhookURL = url
+	for _, opt := range opts {
+		opt(&p.cfg)
+	}
+	return p
+}
+
+// To delivers with d, a built-in or custom consumer.Deliverer.
+func (p *Pipeline) To(d consumer.Deliverer) *Pipeline {
+	p.setSink()
+	p.cfg.Target = "custom"
+	p.cfg.Deliverer = d
+	return p
+}
+
+// ToFunc calls fn with every batch. An error redelivers the batch later; a
+// *consumer.PartialDeliveryError only the events it doesn't list.
+func (p *Pipeline) ToFunc(fn func(batch events.Batch) error) *Pipeline {
+	p.setSink()
+	p.cfg.Target = "func"
+	p.cfg.Deliverer = funcDeliverer(fn)
+	return p
+}
+
+func (p *Pipeline) setSink() {
+	if p.hasSink {
+		p.errs = append(p.errs, errors.New("fpaas: a pipeline has a single destination"))
+	}
+	p.hasSink = true
+}
+
+// Run starts the pipeline and blocks until ctx is done or a part fails.
+func (p *Pipeline) Run(ctx context.Context) error {
+	if !p.hasSink {
+		p.errs = append(p.errs, errors.New("fpaas: no destination, call ToWebhook, To or ToFunc"))
+	}
+	if err := errors.Join(p.errs...); err != nil {
+		return err
+	}
+	if err := p.cfg.Validate(); err != nil {
+		return fmt.Errorf("fpaas: %w", err)
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	var wg sync.WaitGroup
+
+	if p.relayHost != "" {
+		sub, err := firehose.NewSimpleSubscriber(p.relayHost, p.cfg.NATSURL, p.stream, p.logger)
+		if err != nil {
+			return err
+		}
+		defer sub.Close()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var err error
+			if p.leaderID != "" {
+				err = sub.RunWithLeaderElection(ctx, firehose.LeaderConfig{InstanceID: p.leaderID, LeaseTTL: p.leaseTTL})
+			} else {
+				err = sub.Run(ctx)
+			}
+			if ctx.Err() == nil {
+				if err == nil {
+					err = errors.New("relay connection closed")
+				}
+				cancel(fmt.Errorf("fpaas: ingest stopped: %w", err))
+			}
+		}()
+		// Stop the subscriber before closing its connection
+		defer wg.Wait()
+		defer cancel(nil)
+	}
+
+	c, err := consumer.NewPullConsumer(p.cfg, p.logger)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if err := c.Run(ctx); err != nil {
+		return err
+	}
+	// A failed ingest, rather than the caller, stopped the pipeline
+	if cause := context.Cause(ctx); cause != ctx.Err() {
+		return cause
+	}
+	return nil
+}
+
+// funcDeliverer adapts ToFunc callbacks to consumer.Deliverer.
+type funcDeliverer func(events.Batch) error
+
+func (f funcDeliverer) DeliverBatch(_ context.Context, name string, msgs []*nats.Msg) error {
+	frames := make([][]byte, len(msgs))
+	for i, msg := range msgs {
+		frames[i] = msg.Data
+	}
+	return f(events.Batch{Consumer: name, Events: frames, Count: len(frames), Labels: consumer.MessageLabels(msgs...), Matches: consumer.MessageMatches(msgs...), Languages: consumer.MessageLanguages(msgs...), Watched: consumer.MessageWatched(msgs...), Threads: consumer.MessageThreads(msgs...), Blobs: consumer.MessageBlobs(msgs...), Meta: consumer.MessageMeta(msgs...)})
+}
+
+func (f funcDeliverer) DeliverEvent(_ context.Context, name string, msg *nats.Msg) error {
+	return f(events.Batch{Consumer: name, Events: [][]byte{msg.Data}, Count: 1, Labels: consumer.MessageLabels(msg), Matches: consumer.MessageMatches(msg), Languages: consumer.MessageLanguages(msg), Watched: consumer.MessageWatched(msg), Threads: consumer.MessageThreads(msg), Blobs: consumer.MessageBlobs(msg), Meta: consumer.MessageMeta(msg)})
+}
@@ -0,0 +1,440 @@
+package webhookclient
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/eurosky/firehose-processor-aas/pkg/events"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// decodeJSON accepts both envelopes: a batch has "events", an event "event".
+func decodeJSON(body []byte, d *Delivery) error {
+	var payload struct {
+		events.Batch
+		Event []byte `json:"event"`
+		// An array in batches, an object in events
+		Meta json.RawMessage `json:"meta"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return fmt.Errorf("invalid JSON payload: %w", err)
+	}
+	d.Consumer = payload.Consumer
+	d.Events = payload.Events
+	d.Count = payload.Count
+	if payload.Event != nil {
+		d.Events = [][]byte{payload.Event}
+		d.Count = 1
+	}
+	if len(payload.Meta) > 0 {
+		var err error
+		if payload.Meta[0] == '{' {
+			d.Meta = make([]events.EventMeta, 1)
+			err = json.Unmarshal(payload.Meta, &d.Meta[0])
+		} else {
+			err = json.Unmarshal(payload.Meta, &d.Meta)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid JSON payload: meta: %w", err)
+		}
+	}
+	return nil
+}
+
+// decodeNDJSON reads one event envelope per line. Every line must name the
+// same consumer.
+func decodeNDJSON(body []byte, d *Delivery) error {
+	for i, line := range bytes.Split(body, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		var e events.Event
+		if err := json.Unmarshal(line, &e); err != nil {
+			return fmt.Errorf("invalid NDJSON payload: line %d: %w", i+1, err)
+		}
+		if len(d.Events) == 0 {
+			d.Consumer = e.Consumer
+		} else if e.Consumer != d.Consumer {
+			return fmt.Errorf("invalid NDJSON payload: line %d: consumer %q, want %q", i+1, e.Consumer, d.Consumer)
+		}
+		d.Events = append(d.Events, e.Event)
+		if e.Meta != nil {
+			// Lines without meta keep zero values, so Meta lines up with Events
+			d.Meta = append(d.Meta, make([]events.EventMeta, len(d.Events)-1-len(d.Meta))...)
+			d.Meta = append(d.Meta, *e.Meta)
+		}
+	}
+	d.Count = len(d.Events)
+	return nil
+}
+
+// cloudEvent is the part of a structured mode CloudEvent the handler uses.
+type cloudEvent struct {
+	SpecVersion string `json:"specversion"`
+	Source      string `json:"source"`
+	Consumer    string `json:"fpaasconsumer"`
+	DataBase64  []byte `json:"data_base64"`
+}
+
+// decodeCloudEvents reads a CloudEvents batch, or a single CloudEvent.
+func decodeCloudEvents(body []byte, batch bool, d *Delivery) error {
+	var ces []cloudEvent
+	var err error
+	if batch {
+		err = json.Unmarshal(body, &ces)
+	} else {
+		ces = make([]cloudEvent, 1)
+		err = json.Unmarshal(body, &ces[0])
+	}
+	if err != nil {
+		return fmt.Errorf("invalid CloudEvents payload: %w", err)
+	}
+	for i, ce := range ces {
+		if ce.SpecVersion != "1.0" {
+			return fmt.Errorf("invalid CloudEvents payload: event %d: unsupported specversion %q", i, ce.SpecVersion)
+		}
+		consumer := ce.Consumer
+		if consumer == "" {
+			consumer = ce.Source
+		}
+		if i == 0 {
+			d.Consumer = consumer
+		} else if consumer != d.Consumer {
+			return fmt.Errorf("invalid CloudEvents payload: event %d: consumer %q, want %q", i, consumer, d.Consumer)
+		}
+		d.Events = append(d.Events, ce.DataBase64)
+	}
+	d.Count = len(d.Events)
+	return nil
+}
+
+// decodeProtobuf reads the messages of schema/webhook.proto.
+// Both messages number the consumer 1 and the events 2; a batch numbers its
+// meta 4, an event 3.
+func decodeProtobuf(body []byte, batch bool, d *Delivery) error {
+	if !batch {
+		d.Count = 1
+	}
+	err := protoFields(body, func(num protowire.Number, v uint64, b []byte) error {
+		switch {
+		case num == 1:
+			d.Consumer = string(b)
+		case num == 2:
+			var f typedFrame
+			if err := protoFields(b, f.field); err != nil {
+				return err
+			}
+			frame, err := f.frame()
+			if err != nil {
+				return err
+			}
+			d.Typed = append(d.Typed, frame)
+		case num == 3 && batch:
+			d.Count = int(int32(v))
+		case num == 4 && batch, num == 3:
+			m, err := decodeProtoMeta(b)
+			if err != nil {
+				return err
+			}
+			d.Meta = append(d.Meta, m)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("invalid protobuf payload: %w", err)
+	}
+	return nil
+}
+
+// decodeProtoMeta reads a Meta message.
+func decodeProtoMeta(b []byte) (events.EventMeta, error) {
+	var m events.EventMeta
+	err := protoFields(b, func(num protowire.Number, v uint64, b []byte) error {
+		switch num {
+		case 1:
+			m.StreamSeq = v
+		case 2:
+			m.ConsumerSeq = v
+		case 3:
+			var err error
+			if m.Timestamp, err = metaTimestamp(string(b)); err != nil {
+				return err
+			}
+		case 4:
+			m.NumDelivered = v
+		}
+		return nil
+	})
+	return m, err
+}
+
+// metaTimestamp parses the timestamp of a Meta, empty when there's none.
+func metaTimestamp(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("meta: %w", err)
+	}
+	return t, nil
+}
+
+// protoFields calls fn with the number and value of each field of a protobuf
+// message: v for varints, b for length-delimited fields. Fields of other wire
+// types are skipped.
+func protoFields(msg []byte, fn func(num protowire.Number, v uint64, b []byte) error) error {
+	for len(msg) > 0 {
+		num, typ, n := protowire.ConsumeTag(msg)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		msg = msg[n:]
+
+		var v uint64
+		var b []byte
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(msg)
+		case protowire.BytesType:
+			b, n = protowire.ConsumeBytes(msg)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, msg)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		msg = msg[n:]
+		if typ != protowire.VarintType && typ != protowire.BytesType {
+			continue
+		}
+		if err := fn(num, v, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// typedFrame is the Frame of the protobuf and Avro schemas, as read.
+type typedFrame struct {
+	seq                  int64
+	did, time, typ, rev  string
+	ops                  []events.RepoOp
+	handle, status, body string
+	active               bool
+}
+
+// field sets the field num of the Frame message.
+func (f *typedFrame) field(num protowire.Number, v uint64, b []byte) error {
+	switch num {
+	case 1:
+		f.seq = int64(v)
+	case 2:
+		f.did = string(b)
+	case 3:
+		f.time = string(b)
+	case 4:
+		f.typ = string(b)
+	case 5:
+		f.rev = string(b)
+	case 6:
+		var collection, rkey string
+		var op events.RepoOp
+		err := protoFields(b, func(num protowire.Number, _ uint64, b []byte) error {
+			switch num {
+			case 1:
+				op.Action = string(b)
+			case 2:
+				collection = string(b)
+			case 3:
+				rkey = string(b)
+			case 4:
+				op.CID = string(b)
+			case 5:
+				op.Record = bytes.Clone(b)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		op.Path = collection + "/" + rkey
+		f.ops = append(f.ops, op)
+	case 7:
+		f.handle = string(b)
+	case 8:
+		f.active = v != 0
+	case 9:
+		f.status = string(b)
+	case 10:
+		f.body = string(b)
+	}
+	return nil
+}
+
+// frame returns f as events.Decode would have decoded the raw frame, less
+// the blocks.
+func (f typedFrame) frame() (events.Frame, error) {
+	switch f.typ {
+	case events.TypeCommit:
+		ops := f.ops
+		if ops == nil {
+			ops = []events.RepoOp{}
+		}
+		return events.Frame{Type: f.typ, Commit: &events.Commit{Seq: f.seq, Repo: f.did, Rev: f.rev, Time: f.time, Ops: ops}}, nil
+	case events.TypeSync:
+		return events.Frame{Type: f.typ, Sync: &events.Sync{Seq: f.seq, DID: f.did, Rev: f.rev, Time: f.time}}, nil
+	case events.TypeIdentity:
+		return events.Frame{Type: f.typ, Identity: &events.Identity{Seq: f.seq, DID: f.did, Handle: f.handle, Time: f.time}}, nil
+	case events.TypeAccount:
+		return events.Frame{Type: f.typ, Account: &events.Account{Seq: f.seq, DID: f.did, Active: f.active, Status: f.status, Time: f.time}}, nil
+	case events.TypeInfo:
+		var info events.Info
+		if err := json.Unmarshal([]byte(f.body), &info); err != nil {
+			return events.Frame{}, fmt.Errorf("#info frame: %w", err)
+		}
+		return events.Frame{Type: f.typ, Info: &info}, nil
+	default:
+		return events.Frame{Type: events.TypeError}, nil
+	}
+}
+
+// decodeAvro reads the records of schema/webhook_*.avsc, with or without the
+// schema registry prefix.
+func decodeAvro(body []byte, batch bool, d *Delivery) error {
+	r := avroReader{b: body}
+	if len(body) >= 5 && body[0] == 0 {
+		r.b = body[5:]
+	}
+
+	d.Consumer = r.string()
+	if !batch {
+		d.Count = 1
+		r.frame(d)
+		// The union index of null or Meta
+		if r.long() == 1 {
+			d.Meta = []events.EventMeta{r.meta()}
+		}
+		return r.err
+	}
+	r.array(func() { r.frame(d) })
+	d.Count = int(r.long())
+	r.array(func() { d.Meta = append(d.Meta, r.meta()) })
+	return r.err
+}
+
+var errAvroTruncated = errors.New("invalid avro payload: truncated")
+
+type avroReader struct {
+	b   []byte
+	err error
+}
+
+// frame reads a Frame record into d.Typed.
+func (r *avroReader) frame(d *Delivery) {
+	f := typedFrame{seq: r.long()}
+	f.did, f.time, f.typ, f.rev = r.string(), r.string(), r.string(), r.string()
+	r.array(func() {
+		op := events.RepoOp{Action: r.string()}
+		collection, rkey := r.string(), r.string()
+		op.Path = collection + "/" + rkey
+		op.CID = r.string()
+		if record := r.bytes(); len(record) > 0 {
+			op.Record = bytes.Clone(record)
+		}
+		f.ops = append(f.ops, op)
+	})
+	f.handle, f.active, f.status, f.body = r.string(), r.boolean(), r.string(), r.string()
+	if r.err != nil {
+		return
+	}
+	frame, err := f.frame()
+	if err != nil {
+		r.err = fmt.Errorf("invalid avro payload: %w", err)
+		return
+	}
+	d.Typed = append(d.Typed, frame)
+}
+
+// meta reads a Meta record.
+func (r *avroReader) meta() events.EventMeta {
+	m := events.EventMeta{StreamSeq: uint64(r.long()), ConsumerSeq: uint64(r.long())}
+	ts := r.string()
+	m.NumDelivered = uint64(r.long())
+	if r.err == nil {
+		var err error
+		if m.Timestamp, err = metaTimestamp(ts); err != nil {
+			r.err = fmt.Errorf("invalid avro payload: %w", err)
+		}
+	}
+	return m
+}
+
+// array calls item for each item of an array.
+func (r *avroReader) array(item func()) {
+	for {
+		n := r.long()
+		if r.err != nil || n == 0 {
+			return
+		}
+		if n < 0 {
+			// A negative count is followed by the block size in bytes
+			n = -n
+			r.long()
+		}
+		for range n {
+			if item(); r.err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (r *avroReader) long() int64 {
+	if r.err != nil {
+		return 0
+	}
+	u, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		r.err = errAvroTruncated
+		return 0
+	}
+	r.b = r.b[n:]
+	return int64(u>>1) ^ -int64(u&1)
+}
+
+func (r *avroReader) boolean() bool {
+	if r.err != nil {
+		return false
+	}
+	if len(r.b) == 0 {
+		r.err = errAvroTruncated
+		return false
+	}
+	v := r.b[0] != 0
+	r.b = r.b[1:]
+	return v
+}
+
+func (r *avroReader) string() string {
+	return string(r.bytes())
+}
+
+func (r *avroReader) bytes() []byte {
+	n := r.long()
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || int64(len(r.b)) < n {
+		r.err = errAvroTruncated
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
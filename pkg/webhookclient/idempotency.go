@@ -0,0 +1,51 @@
+package webhookclient
+
+import "sync"
+
+// IdempotencyStore remembers the Idempotency-Keys of processed deliveries.
+// Two concurrent requests with the same key may both be processed; a store
+// backed by a database can close that gap by making Mark conditional.
+type IdempotencyStore interface {
+	// Seen reports whether key was already processed.
+	Seen(key string) bool
+	// Mark records key as processed.
+	Mark(key string)
+}
+
+// MemoryStore is an IdempotencyStore keeping the most recent keys in memory.
+type MemoryStore struct {
+	mu   sync.Mutex
+	keys map[string]struct{}
+	ring []string
+	next int
+}
+
+// NewMemoryStore returns a store remembering the last size keys.
+func NewMemoryStore(size int) *MemoryStore {
+	if size < 1 {
+		size = 1
+	}
+	return &MemoryStore{keys: make(map[string]struct{}, size), ring: make([]string, size)}
+}
+
+func (s *MemoryStore) Seen(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.keys[key]
+	return ok
+}
+
+func (s *MemoryStore) Mark(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.keys[key]; ok {
+		return
+	}
+	// Evict the oldest key
+	if old := s.ring[s.next]; old != "" {
+		delete(s.keys, old)
+	}
+	s.ring[s.next] = key
+	s.keys[key] = struct{}{}
+	s.next = (s.next + 1) % len(s.ring)
+}
@@ -0,0 +1,482 @@
+// Package webhookclient is the receiving side of fpaas webhooks: an
+// http.Handler that checks the signature, decompresses and decrypts the body,
+// decodes the batch in any payload format, skips deliveries it has already
+// processed and hands the rest to a callback.
+//
+//	http.Handle("/webhook", &webhookclient.Handler{
+//		Secret:      []byte(os.Getenv("WEBHOOK_SECRET")),
+//		Idempotency: webhookclient.NewMemoryStore(10000),
+//		OnDelivery: func(ctx context.Context, d *webhookclient.Delivery) error {
+//			frames, err := d.Frames()
+//			...
+//		},
+//	})
+package webhookclient
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/eurosky/firehose-processor-aas/internal/pkg/signature"
+	"github.com/eurosky/firehose-processor-aas/pkg/events"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Headers set by fpaas on webhook requests.
+const (
+	SignatureHeader          = signature.Header
+	IdempotencyKeyHeader     = "Idempotency-Key"
+	EventCountHeader         = "X-Event-Count"
+	SchemaVersionHeader      = "X-Schema-Version"
+	PayloadContentTypeHeader = "X-Payload-Content-Type"
+	// StreamSeqFirstHeader and StreamSeqLastHeader are the lowest and
+	// highest JetStream stream sequences of the delivered events.
+	StreamSeqFirstHeader = "X-Stream-Seq-First"
+	StreamSeqLastHeader  = "X-Stream-Seq-Last"
+	// DeliveryAttemptHeader, RedeliveredHeader and RedeliveredSeqHeader are
+	// set by consumers with --redelivery-headers: the delivery attempt of
+	// the call, counted by JetStream, and whether and which of its events
+	// were delivered before, as ranges of stream sequences.
+	DeliveryAttemptHeader = "X-Delivery-Attempt"
+	RedeliveredHeader     = "X-Redelivered"
+	RedeliveredSeqHeader  = "X-Redelivered-Stream-Seq"
+	// VerificationEventHeader is "url_verification" on the control plane's
+	// verification challenge.
+	VerificationEventHeader = "X-Webhook-Event"
+)
+
+// Payload formats, by Content-Type:
+//
+//   - FormatJSON, application/json: a Batch or Event of pkg/events
+//   - FormatNDJSON, application/x-ndjson or application/jsonl: one Event
+//     per line
+//   - FormatCloudEvents, application/cloudevents-batch+json (an array) or
+//     application/cloudevents+json (one): CloudEvents 1.0 in structured mode,
+//     with the frame in data_base64 and the consumer in the fpaasconsumer
+//     extension, or else source
+//   - FormatProtobuf, application/x-protobuf: schema/webhook.proto
+//   - FormatAvro, avro/binary: schema/webhook_*.avsc
+//
+// The consumer sends JSON, protobuf and Avro; the other formats are accepted
+// for senders that batch that way.
+const (
+	FormatJSON        = "json"
+	FormatNDJSON      = "ndjson"
+	FormatCloudEvents = "cloudevents"
+	FormatProtobuf    = "protobuf"
+	FormatAvro        = "avro"
+)
+
+// DefaultMaxBodySize bounds request bodies when Handler.MaxBodySize is zero.
+const DefaultMaxBodySize = 64 << 20
+
+// Delivery is one webhook call: a batch, or a single event with event
+// granularity.
+type Delivery struct {
+	Consumer string
+	// Events are the raw firehose frames, in stream order. Protobuf and Avro
+	// payloads carry their frames decoded instead, in Typed.
+	Events [][]byte
+	// Typed are the frames of protobuf and Avro payloads, in stream order.
+	// Their commits have the records of their ops rather than blocks.
+	Typed []events.Frame
+	// Meta is the JetStream metadata of the events, in the same order, when the
+	// payload carries it: the JSON, protobuf and Avro payloads of fpaas
+	// consumers do.
+	Meta []events.EventMeta
+	// Count is the event count of the envelope: the count field of a batch,
+	// 1 for a single event. It matches Len unless the sender is broken.
+	Count int
+	// IdempotencyKey identifies the delivery across retries; it is empty
+	// when the sender didn't set it.
+	IdempotencyKey string
+	// FirstSeq and LastSeq are the stream sequences of the first and last
+	// events, zero when the sender didn't set them. Events filtered out by
+	// the consumer leave holes in the range.
+	FirstSeq, LastSeq uint64
+	// Attempt is the delivery attempt, 1 on a first delivery, and
+	// Redelivered the stream sequences of the events delivered before. An
+	// event in them may have been processed already. Both are zero when the
+	// sender didn't set them.
+	Attempt     int
+	Redelivered []SeqRange
+	Header      http.Header
+	// RawBody is the request body as sent, before decompression and
+	// decryption; with Header it is enough to replay the request.
+	RawBody []byte
+	// Format is the payload format the body was decoded from, FormatJSON,
+	// FormatProtobuf, ...
+	Format string
+	// Response, when OnDelivery sets it, is answered as the JSON body of the
+	// 200, e.g. an events.Ack. When OnDelivery fails, it is the body of the
+	// error's status: an events.Ack listing the events processed before the
+	// failure keeps the consumer from redelivering them.
+	Response any
+}
+
+// Len returns the number of events of the delivery.
+func (d *Delivery) Len() int {
+	return len(d.Events) + len(d.Typed)
+}
+
+// Frame decodes the event at index i.
+func (d *Delivery) Frame(i int) (events.Frame, error) {
+	if d.Typed != nil {
+		return d.Typed[i], nil
+	}
+	return events.Decode(d.Events[i])
+}
+
+// Frames decodes every event of the delivery.
+func (d *Delivery) Frames() ([]events.Frame, error) {
+	frames := make([]events.Frame, 0, d.Len())
+	for i := range d.Len() {
+		f, err := d.Frame(i)
+		if err != nil {
+			return nil, fmt.Errorf("event %d: %w", i, err)
+		}
+		frames = append(frames, f)
+	}
+	return frames, nil
+}
+
+// SeqRange is a range of stream sequences, First to Last included.
+type SeqRange struct {
+	First, Last uint64
+}
+
+// WasRedelivered reports whether the event at stream sequence seq was
+// delivered before, so it may have been processed already.
+func (d *Delivery) WasRedelivered(seq uint64) bool {
+	for _, r := range d.Redelivered {
+		if seq >= r.First && seq <= r.Last {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSeqRanges parses RedeliveredSeqHeader, e.g. "12-40,55", skipping
+// malformed ranges.
+func parseSeqRanges(value string) []SeqRange {
+	var ranges []SeqRange
+	for _, part := range strings.Split(value, ",") {
+		first, last, found := strings.Cut(strings.TrimSpace(part), "-")
+		if !found {
+			last = first
+		}
+		f, ferr := strconv.ParseUint(first, 10, 64)
+		l, lerr := strconv.ParseUint(last, 10, 64)
+		if ferr == nil && lerr == nil && f <= l {
+			ranges = append(ranges, SeqRange{First: f, Last: l})
+		}
+	}
+	return ranges
+}
+
+// Handler receives fpaas webhooks. OnDelivery is required; the other fields
+// are optional.
+type Handler struct {
+	// OnDelivery processes a delivery. An error answers 500, so the consumer
+	// retries the delivery later, all of it unless Response acks some events.
+	OnDelivery func(ctx context.Context, d *Delivery) error
+	// Secret, when set, rejects requests without a valid X-Signature.
+	Secret []byte
+	// DecryptionKey is the private key matching the consumer's JWE public
+	// key; encrypted bodies are rejected without it.
+	DecryptionKey crypto.PrivateKey
+	// Idempotency, when set, answers deliveries whose Idempotency-Key was
+	// already processed without calling OnDelivery again.
+	Idempotency IdempotencyStore
+	// MaxBodySize bounds the request body, DefaultMaxBodySize when zero.
+	MaxBodySize int64
+	// OnReject, when set, is called with every request rejected before
+	// OnDelivery, e.g. to count them by Reason.
+	OnReject func(r *http.Request, err *Error)
+	// OnDuplicate, when set, is called with the deliveries the Idempotency
+	// store skipped.
+	OnDuplicate func(ctx context.Context, d *Delivery)
+	// Logger reports rejected requests and failed deliveries; nil discards.
+	Logger *slog.Logger
+}
+
+// Reasons of the requests Handler rejects.
+const (
+	ReasonTooLarge    = "too_large"
+	ReasonRead        = "read"
+	ReasonSignature   = "signature"
+	ReasonEncoding    = "encoding"
+	ReasonDecrypt     = "decrypt"
+	ReasonContentType = "content_type"
+	ReasonPayload     = "payload"
+)
+
+// Error is a rejected request. Handler passes its own to OnReject; an Error
+// returned by OnDelivery is answered with its Status instead of 500.
+type Error struct {
+	Status int
+	// Reason is a short label for metrics, e.g. ReasonSignature.
+	Reason string
+	Err    error
+}
+
+func (e *Error) Error() string { return e.Err.Error() }
+
+func (e *Error) Unwrap() error { return e.Err }
+
+func reject(status int, reason, format string, args ...any) error {
+	return &Error{Status: status, Reason: reason, Err: fmt.Errorf(format, args...)}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	raw, body, err := h.readBody(w, r)
+	if err == nil && r.Header.Get(VerificationEventHeader) == "url_verification" {
+		h.answerChallenge(w, body)
+		return
+	}
+
+	var d *Delivery
+	if err == nil {
+		d, err = h.decode(r, body)
+	}
+	if err == nil {
+		d.RawBody = raw
+	}
+	if err != nil {
+		var re *Error
+		if !errors.As(err, &re) {
+			re = &Error{Status: http.StatusBadRequest, Reason: ReasonPayload, Err: err}
+		}
+		h.logger().Warn("rejected webhook", "status", re.Status, "reason", re.Reason, "error", re.Err)
+		if h.OnReject != nil {
+			h.OnReject(r, re)
+		}
+		http.Error(w, re.Error(), re.Status)
+		return
+	}
+
+	if h.Idempotency != nil && d.IdempotencyKey != "" && h.Idempotency.Seen(d.IdempotencyKey) {
+		h.logger().Debug("skipping duplicate delivery", "consumer", d.Consumer, "idempotency_key", d.IdempotencyKey)
+		if h.OnDuplicate != nil {
+			h.OnDuplicate(r.Context(), d)
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if err := h.OnDelivery(r.Context(), d); err != nil {
+		status, msg := http.StatusInternalServerError, "failed to process delivery"
+		var re *Error
+		if errors.As(err, &re) {
+			status, msg = re.Status, re.Error()
+		} else {
+			h.logger().Error("failed to process delivery", "consumer", d.Consumer, "events", d.Len(), "error", err)
+		}
+		if d.Response != nil {
+			// e.g. an events.Ack of the events processed before the failure
+			writeResponse(w, status, d.Response)
+			return
+		}
+		http.Error(w, msg, status)
+		return
+	}
+	if h.Idempotency != nil && d.IdempotencyKey != "" {
+		h.Idempotency.Mark(d.IdempotencyKey)
+	}
+	if d.Response != nil {
+		writeResponse(w, http.StatusOK, d.Response)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func writeResponse(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Decompressors are reused across requests: a zstd decoder in particular
+// allocates its window up front.
+var (
+	gzipReaders  sync.Pool
+	flateReaders sync.Pool
+	zstdReaders  = sync.Pool{New: func() any {
+		// One at a time decodes synchronously, with no goroutines to close
+		zr, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return (*zstd.Decoder)(nil)
+		}
+		return zr
+	}}
+)
+
+// readBody reads the body, checks its signature and undoes Content-Encoding.
+// The signature covers the bytes as sent, which are returned too.
+func (h *Handler) readBody(w http.ResponseWriter, r *http.Request) (raw, body []byte, err error) {
+	limit := h.MaxBodySize
+	if limit <= 0 {
+		limit = DefaultMaxBodySize
+	}
+	raw, err = io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, nil, reject(http.StatusRequestEntityTooLarge, ReasonTooLarge, "body exceeds %d bytes", limit)
+		}
+		return nil, nil, reject(http.StatusBadRequest, ReasonRead, "failed to read body: %v", err)
+	}
+
+	if len(h.Secret) > 0 && !signature.Verify(h.Secret, raw, r.Header.Get(SignatureHeader)) {
+		return nil, nil, reject(http.StatusUnauthorized, ReasonSignature, "invalid signature")
+	}
+
+	var dec io.Reader
+	switch enc := strings.ToLower(r.Header.Get("Content-Encoding")); enc {
+	case "", "identity":
+		return raw, raw, nil
+	case "gzip":
+		zr, _ := gzipReaders.Get().(*gzip.Reader)
+		if zr == nil {
+			zr, err = gzip.NewReader(bytes.NewReader(raw))
+		} else {
+			err = zr.Reset(bytes.NewReader(raw))
+		}
+		if err != nil {
+			return nil, nil, reject(http.StatusBadRequest, ReasonEncoding, "invalid gzip body: %v", err)
+		}
+		defer gzipReaders.Put(zr)
+		dec = zr
+	case "deflate":
+		fr, _ := flateReaders.Get().(io.ReadCloser)
+		if fr == nil {
+			fr = flate.NewReader(bytes.NewReader(raw))
+		} else {
+			fr.(flate.Resetter).Reset(bytes.NewReader(raw), nil)
+		}
+		defer flateReaders.Put(fr)
+		dec = fr
+	case "zstd":
+		zr := zstdReaders.Get().(*zstd.Decoder)
+		if zr == nil {
+			return nil, nil, reject(http.StatusInternalServerError, ReasonEncoding, "no zstd decoder")
+		}
+		defer zstdReaders.Put(zr)
+		if err := zr.Reset(bytes.NewReader(raw)); err != nil {
+			return nil, nil, reject(http.StatusBadRequest, ReasonEncoding, "invalid zstd body: %v", err)
+		}
+		dec = zr
+	default:
+		return nil, nil, reject(http.StatusUnsupportedMediaType, ReasonEncoding, "unsupported Content-Encoding %q", enc)
+	}
+	// Bound the decompressed size too
+	body, err = io.ReadAll(io.LimitReader(dec, limit+1))
+	if err != nil {
+		return nil, nil, reject(http.StatusBadRequest, ReasonEncoding, "failed to decompress body: %v", err)
+	}
+	if int64(len(body)) > limit {
+		return nil, nil, reject(http.StatusRequestEntityTooLarge, ReasonTooLarge, "decompressed body exceeds %d bytes", limit)
+	}
+	return raw, body, nil
+}
+
+// decode decrypts the body if needed and decodes it by content type.
+func (h *Handler) decode(r *http.Request, body []byte) (*Delivery, error) {
+	contentType := mediaType(r.Header.Get("Content-Type"))
+	if contentType == "application/jose" {
+		if h.DecryptionKey == nil {
+			return nil, reject(http.StatusUnsupportedMediaType, ReasonDecrypt, "encrypted body but no decryption key")
+		}
+		obj, err := jose.ParseEncrypted(string(body),
+			[]jose.KeyAlgorithm{jose.RSA_OAEP_256, jose.ECDH_ES_A256KW},
+			[]jose.ContentEncryption{jose.A256GCM})
+		if err != nil {
+			return nil, reject(http.StatusBadRequest, ReasonDecrypt, "invalid JWE body: %v", err)
+		}
+		if body, err = obj.Decrypt(h.DecryptionKey); err != nil {
+			return nil, reject(http.StatusBadRequest, ReasonDecrypt, "failed to decrypt body: %v", err)
+		}
+		contentType = mediaType(r.Header.Get(PayloadContentTypeHeader))
+	}
+
+	d := &Delivery{IdempotencyKey: r.Header.Get(IdempotencyKeyHeader), Header: r.Header}
+	// Optional, and only informative
+	d.FirstSeq, _ = strconv.ParseUint(r.Header.Get(StreamSeqFirstHeader), 10, 64)
+	d.LastSeq, _ = strconv.ParseUint(r.Header.Get(StreamSeqLastHeader), 10, 64)
+	d.Attempt, _ = strconv.Atoi(r.Header.Get(DeliveryAttemptHeader))
+	if r.Header.Get(RedeliveredHeader) == "true" {
+		d.Redelivered = parseSeqRanges(r.Header.Get(RedeliveredSeqHeader))
+	}
+	batch := r.Header.Get("X-Schema-Type") != "fpaas.webhook.v2.Event"
+	var err error
+	switch contentType {
+	case "application/json", "":
+		d.Format = FormatJSON
+		err = decodeJSON(body, d)
+	case "application/x-ndjson", "application/jsonl":
+		d.Format = FormatNDJSON
+		err = decodeNDJSON(body, d)
+	case "application/cloudevents-batch+json":
+		d.Format = FormatCloudEvents
+		err = decodeCloudEvents(body, true, d)
+	case "application/cloudevents+json":
+		d.Format = FormatCloudEvents
+		err = decodeCloudEvents(body, false, d)
+	case "application/x-protobuf":
+		d.Format = FormatProtobuf
+		err = decodeProtobuf(body, batch, d)
+	case "avro/binary":
+		d.Format = FormatAvro
+		err = decodeAvro(body, batch, d)
+	default:
+		return nil, reject(http.StatusUnsupportedMediaType, ReasonContentType, "unsupported Content-Type %q", contentType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// answerChallenge echoes the control plane's verification challenge.
+func (h *Handler) answerChallenge(w http.ResponseWriter, body []byte) {
+	var challenge struct {
+		Challenge      string `json:"challenge"`
+		SubscriptionID string `json:"subscription_id"`
+	}
+	if err := json.Unmarshal(body, &challenge); err != nil {
+		http.Error(w, "invalid challenge", http.StatusBadRequest)
+		return
+	}
+	h.logger().Info("answering webhook verification", "subscription", challenge.SubscriptionID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"challenge": challenge.Challenge})
+}
+
+func (h *Handler) logger() *slog.Logger {
+	if h.Logger == nil {
+		return slog.New(slog.DiscardHandler)
+	}
+	return h.Logger
+}
+
+func mediaType(contentType string) string {
+	t, _, _ := strings.Cut(contentType, ";")
+	return strings.ToLower(strings.TrimSpace(t))
+}
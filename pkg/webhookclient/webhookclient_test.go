@@ -0,0 +1,112 @@
+package webhookclient
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// benchBody is a JSON batch of about the size of 500 events.
+func benchBody() []byte {
+	var b bytes.Buffer
+	b.WriteString(`{"consumer":"bench","events":[`)
+	for i := range 500 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `{"type":"commit","seq":%d,"did":"did:plc:fake%d","time":"2026-10-14T12:00:00Z","ops":[{"action":"create","path":"app.bsky.feed.post/%x","record":{"text":"post number %d","createdAt":"2026-10-14T12:00:00Z"}}]}`, i+1, i%100, i, i)
+	}
+	b.WriteString(`]}`)
+	return b.Bytes()
+}
+
+func compress(b *testing.B, enc string, body []byte) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch enc {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+	case "zstd":
+		w, _ = zstd.NewWriter(&buf)
+	}
+	if _, err := w.Write(body); err != nil {
+		b.Fatal(err)
+	}
+	w.Close()
+	return buf.Bytes()
+}
+
+// freshReader is how bodies were decompressed before the decoders were
+// pooled, for comparison.
+func freshReader(enc string, raw []byte) (io.Reader, func(), error) {
+	switch enc {
+	case "gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(raw))
+		return zr, func() {}, err
+	case "deflate":
+		fr := flate.NewReader(bytes.NewReader(raw))
+		return fr, func() { fr.Close() }, nil
+	}
+	zr, err := zstd.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return nil, nil, err
+	}
+	return zr, zr.Close, nil
+}
+
+// BenchmarkReadBody decompresses webhook bodies with the pooled decoders of
+// readBody, and with a decoder created for each body.
+func BenchmarkReadBody(b *testing.B) {
+	body := benchBody()
+	h := &Handler{}
+	for _, enc := range []string{"gzip", "deflate", "zstd"} {
+		raw := compress(b, enc, body)
+		b.Run(enc+"/pooled", func(b *testing.B) {
+			b.ReportAllocs()
+			for range b.N {
+				r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(raw))
+				r.Header.Set("Content-Encoding", enc)
+				_, got, err := h.readBody(httptest.NewRecorder(), r)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(got) != len(body) {
+					b.Fatalf("decompressed %d bytes, want %d", len(got), len(body))
+				}
+			}
+		})
+		b.Run(enc+"/fresh", func(b *testing.B) {
+			b.ReportAllocs()
+			for range b.N {
+				// Read like readBody, but with a new decoder
+				r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(raw))
+				w := httptest.NewRecorder()
+				sent, err := io.ReadAll(http.MaxBytesReader(w, r.Body, DefaultMaxBodySize))
+				if err != nil {
+					b.Fatal(err)
+				}
+				dec, done, err := freshReader(enc, sent)
+				if err != nil {
+					b.Fatal(err)
+				}
+				got, err := io.ReadAll(io.LimitReader(dec, DefaultMaxBodySize+1))
+				if err != nil {
+					b.Fatal(err)
+				}
+				done()
+				if len(got) != len(body) {
+					b.Fatalf("decompressed %d bytes, want %d", len(got), len(body))
+				}
+			}
+		})
+	}
+}
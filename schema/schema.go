@@ -0,0 +1,23 @@
+// Package schema publishes the webhook payload schemas so they can be shared
+// with receivers and registered with a schema registry at runtime.
+//
+// The JSON Schemas in json/ are generated from the pkg/events types with
+// fpaas schema export --dir schema/json.
+package schema
+
+import "embed"
+
+//go:embed webhook.proto
+var WebhookProto string
+
+//go:embed webhook_batch.avsc
+var WebhookBatchAvro string
+
+//go:embed webhook_event.avsc
+var WebhookEventAvro string
+
+// JSONSchemas holds json/<name>.schema.json for each payload of
+// events.Schemas.
+//
+//go:embed json/*.schema.json
+var JSONSchemas embed.FS